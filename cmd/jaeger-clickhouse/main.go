@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	// Package contains time zone info for connecting to ClickHouse servers with non-UTC time zone
 	_ "time/tzdata"
@@ -13,39 +20,66 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"gopkg.in/yaml.v3"
+	grpcserver "google.golang.org/grpc"
 
 	"github.com/jaegertracing/jaeger-clickhouse/storage"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
 )
 
 func main() {
-	var configPath string
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "maintain" {
+		runMaintain(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "smoketest" {
+		runSmokeTest(os.Args[2:])
+	}
+
+	var (
+		configPath    string
+		set           overrides
+		doctor        bool
+		exampleConfig bool
+	)
 	flag.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flag.Var(&set, "set", "Override an option of the configuration file as path=value, e.g. grpc_server.address=:17271, can be repeated")
+	flag.BoolVar(&doctor, "doctor", false, "Diagnose the ClickHouse setup, print a report and exit")
+	flag.BoolVar(&exampleConfig, "example-config", false, "Print an example configuration with defaults of all options and exit")
 	flag.Parse()
 
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name: "jaeger-clickhouse",
-		// If this is set to e.g. Warn, the debug logs are never sent to Jaeger even despite
-		// --grpc-storage-plugin.log-level=debug
-		Level:      hclog.Trace,
-		JSONFormat: true,
-	})
-
-	cfgFile, err := ioutil.ReadFile(filepath.Clean(configPath))
-	if err != nil {
-		logger.Error("Could not read config file", "config", configPath, "error", err)
-		os.Exit(1)
+	logger := newLogger()
+	if exampleConfig {
+		if err := storage.WriteExampleConfiguration(os.Stdout); err != nil {
+			logger.Error("Failed to write example configuration", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	var cfg storage.Configuration
-	err = yaml.Unmarshal(cfgFile, &cfg)
-	if err != nil {
-		logger.Error("Could not parse config file", "error", err)
+	cfg := loadConfig(logger, configPath, set)
+
+	if doctor {
+		runDoctor(logger, cfg)
 	}
 
+	// The pprof package registers its handlers to the default mux, they are served only when enabled
+	mux := http.NewServeMux()
+	if cfg.DebugEndpoints {
+		handleDebug(mux)
+	}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		err = http.ListenAndServe(cfg.MetricsEndpoint, nil)
+		// OpenMetrics is negotiated by scrapers supporting it, it is the only format with exemplars
+		mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+		))
+		err := http.ListenAndServe(cfg.MetricsEndpoint, mux)
 		if err != nil {
 			logger.Error("Failed to listen for metrics endpoint", "error", err)
 		}
@@ -58,11 +92,376 @@ func main() {
 		os.Exit(1)
 	}
 	pluginServices.Store = store
-	pluginServices.ArchiveStore = store
+	// The served gRPC storage reports archive capabilities when it has the archive storage
+	capabilities, err := store.Capabilities()
+	if err != nil {
+		logger.Error("Failed to get capabilities of the storage", "error", err)
+		os.Exit(1)
+	}
+	if capabilities.ArchiveSpanReader && capabilities.ArchiveSpanWriter {
+		pluginServices.ArchiveStore = store
+	}
+	if cfg.Dependencies {
+		mux.Handle("/api/operation-dependencies", store.DependencyHandler())
+	}
+	if cfg.StoredDependencies {
+		mux.Handle("/api/dependencies", store.DependencyWriteHandler())
+	}
+	if cfg.TraceQuality {
+		mux.Handle("/api/trace-quality", store.TraceQualityHandler())
+	}
+	if cfg.OperationProfiles.Enabled {
+		mux.Handle("/api/operation-profiles", store.OperationProfilesHandler())
+	}
+	if cfg.TagStatsSampleRate > 0 {
+		mux.Handle("/api/tag-stats", store.TagStatsHandler())
+	}
+	if cfg.HiddenTraces {
+		mux.Handle("/api/hidden-traces", store.HiddenTracesHandler())
+	}
+	if cfg.PurgeEndpoint {
+		mux.Handle("/api/purge", store.PurgeHandler())
+	}
+	if cfg.MaintenanceEndpoint {
+		mux.Handle("/api/maintenance", store.MaintenanceHandler())
+	}
+	if cfg.Archive.Endpoint {
+		mux.Handle("/api/archive", store.ArchiveHandler())
+	}
+	if cfg.ExportEndpoint {
+		mux.Handle("/api/export", store.ExportHandler())
+	}
+	if cfg.TraceIDsEndpoint {
+		mux.Handle("/api/trace-ids", store.TraceIDsHandler())
+	}
+	// Users of HTTP requests are not authenticated, so summaries are not served with row level security
+	if cfg.TraceSummaries && cfg.RowLevelSecurity.UserHeader == "" {
+		mux.Handle("/api/trace-summaries", store.TraceSummariesHandler())
+	}
 
-	grpc.Serve(&pluginServices)
+	if cfg.GRPCServer.Address != "" {
+		serveRemoteStorage(logger, cfg.GRPCServer, &pluginServices)
+	} else {
+		grpc.Serve(&pluginServices)
+	}
 	if err = store.Close(); err != nil {
 		logger.Error("Failed to close store", "error", err)
 		os.Exit(1)
 	}
 }
+
+// handleDebug serves profiles of the plugin at /debug/pprof/, e.g. /debug/pprof/heap for memory of the writer
+func handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func newLogger() hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name: "jaeger-clickhouse",
+		// If this is set to e.g. Warn, the debug logs are never sent to Jaeger even despite
+		// --grpc-storage-plugin.log-level=debug
+		Level:      hclog.Trace,
+		JSONFormat: true,
+	})
+}
+
+// overrides are options set by repeated --set flags, they take precedence over the file and environment variables
+type overrides []string
+
+func (o *overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrides) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+func loadConfig(logger hclog.Logger, configPath string, set overrides) storage.Configuration {
+	cfg, err := storage.LoadConfiguration(configPath, os.Environ(), set)
+	if err != nil {
+		logger.Error("Could not load configuration", "config", configPath, "error", err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// runExport streams spans of a time range to a file or stdout and exits, logs are written to stderr
+func runExport(args []string) {
+	var (
+		configPath string
+		set        overrides
+		format     string
+		start      string
+		end        string
+		output     string
+		params     storage.ExportParams
+	)
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.Var(&set, "set", "Override an option of the configuration file as path=value, e.g. grpc_server.address=:17271, can be repeated")
+	flags.StringVar(&format, "format", string(clickhousespanstore.ExportNDJSON), "Output format, either ndjson or otlp")
+	flags.StringVar(&start, "start", "", "Spans started at or after this RFC 3339 time are exported")
+	flags.StringVar(&end, "end", "", "Spans started before this RFC 3339 time are exported, default now")
+	flags.StringVar(&output, "output", "", "File spans are written to, default stdout")
+	flags.StringVar(&params.Tenant, "tenant", "", "Tenant whose spans are exported when multi_tenant is enabled, default all tenants")
+	flags.BoolVar(&params.Archive, "archive", false, "Export spans from the archive table")
+	_ = flags.Parse(args)
+
+	logger := newLogger()
+	cfg := loadConfig(logger, configPath, set)
+
+	var err error
+	params.Format = clickhousespanstore.ExportFormat(format)
+	if params.Start, err = time.Parse(time.RFC3339, start); err != nil {
+		logger.Error("Invalid start time", "start", start, "error", err)
+		os.Exit(1)
+	}
+	params.End = time.Now()
+	if end != "" {
+		if params.End, err = time.Parse(time.RFC3339, end); err != nil {
+			logger.Error("Invalid end time", "end", end, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	w := os.Stdout
+	if output != "" {
+		if w, err = os.Create(filepath.Clean(output)); err != nil {
+			logger.Error("Could not create output file", "output", output, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	count, err := storage.Export(ctx, logger, cfg, w, params)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.Error("Failed to export spans", "exported", count, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Exported spans", "count", count)
+	os.Exit(0)
+}
+
+func runMigrate(args []string) {
+	var (
+		configPath  string
+		set         overrides
+		input       string
+		format      string
+		start       string
+		end         string
+		chunkSize   int
+		params      storage.MigrateParams
+		queryParams storage.QueryMigrationParams
+	)
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.Var(&set, "set", "Override an option of the configuration file as path=value, e.g. grpc_server.address=:17271, can be repeated")
+	flags.StringVar(&input, "input", "", "File with spans in the format of export, - for stdin")
+	flags.StringVar(&format, "format", string(clickhousespanstore.ExportNDJSON), "Format of the input file, either ndjson or otlp")
+	flags.IntVar(&chunkSize, "chunk-size", 1000, "Number of spans of the input file written at once")
+	flags.StringVar(&queryParams.Address, "query-address", "", "HTTP address of Jaeger Query spans are read from, e.g. http://jaeger-query:16686")
+	flags.StringVar(&start, "start", "", "Spans started at or after this RFC 3339 time are read from Jaeger Query")
+	flags.StringVar(&end, "end", "", "Spans started before this RFC 3339 time are read from Jaeger Query, default now")
+	flags.DurationVar(&queryParams.Window, "window", 10*time.Minute, "Time range of spans read from Jaeger Query at once")
+	flags.IntVar(&queryParams.SearchDepth, "search-depth", 1000, "Maximal number of traces of a service read from Jaeger Query at once")
+	flags.IntVar(&params.MaxSpansPerSecond, "rate", 0, "Maximal number of written spans per second, unlimited if 0")
+	flags.StringVar(&params.CheckpointFile, "checkpoint", "", "File with the progress of the migration, an interrupted migration resumes from it")
+	flags.StringVar(&params.Tenant, "tenant", "", "Tenant the spans are written for when multi_tenant is enabled")
+	_ = flags.Parse(args)
+
+	logger := newLogger()
+	cfg := loadConfig(logger, configPath, set)
+
+	var source storage.MigrationSource
+	switch {
+	case input != "" && queryParams.Address != "":
+		logger.Error("Spans can be migrated either from an input file or from Jaeger Query")
+		os.Exit(1)
+	case input != "":
+		r := os.Stdin
+		if input != "-" {
+			var err error
+			if r, err = os.Open(filepath.Clean(input)); err != nil {
+				logger.Error("Could not open input file", "input", input, "error", err)
+				os.Exit(1)
+			}
+			defer r.Close()
+		}
+		source = storage.NewFileMigrationSource(r, clickhousespanstore.ExportFormat(format), chunkSize)
+	case queryParams.Address != "":
+		var err error
+		if queryParams.Start, err = time.Parse(time.RFC3339, start); err != nil {
+			logger.Error("Invalid start time", "start", start, "error", err)
+			os.Exit(1)
+		}
+		queryParams.End = time.Now()
+		if end != "" {
+			if queryParams.End, err = time.Parse(time.RFC3339, end); err != nil {
+				logger.Error("Invalid end time", "end", end, "error", err)
+				os.Exit(1)
+			}
+		}
+		source = storage.NewQueryMigrationSource(logger, http.DefaultClient, queryParams)
+	default:
+		logger.Error("Either an input file or the address of Jaeger Query is required")
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	count, err := storage.Migrate(ctx, logger, cfg, source, params)
+	if err != nil {
+		logger.Error("Failed to migrate spans", "migrated", count, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Migrated spans", "count", count)
+	os.Exit(0)
+}
+
+// runMaintain runs a maintenance operation, prints its statements and exits
+func runMaintain(args []string) {
+	var (
+		configPath string
+		set        overrides
+		operation  string
+		tables     string
+		before     string
+		params     storage.MaintenanceParams
+	)
+	flags := flag.NewFlagSet("maintain", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.Var(&set, "set", "Override an option of the configuration file as path=value, e.g. grpc_server.address=:17271, can be repeated")
+	flags.StringVar(&operation, "operation", "", "Maintenance operation, either optimize, materialize-ttl or drop-partitions")
+	flags.StringVar(&tables, "tables", "", "Comma separated local tables the operation is run on, default all tables storing spans")
+	flags.StringVar(&params.Partition, "partition", "", "ID of the partition optimize and materialize-ttl are run on, e.g. 20210801, default all partitions")
+	flags.StringVar(&before, "before", "", "Partitions with data only before this date or RFC 3339 time are dropped by drop-partitions")
+	flags.BoolVar(&params.DryRun, "dry-run", false, "Print the statements without running them")
+	flags.BoolVar(&params.Confirm, "confirm", false, "Confirm dropping of partitions")
+	_ = flags.Parse(args)
+
+	logger := newLogger()
+	cfg := loadConfig(logger, configPath, set)
+
+	params.Operation = storage.MaintenanceOperation(operation)
+	if tables != "" {
+		params.Tables = strings.Split(tables, ",")
+	}
+	if before != "" {
+		var err error
+		if params.Before, err = storage.ParseMaintenanceTime(before); err != nil {
+			logger.Error("Invalid before time", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	statements, err := storage.Maintain(ctx, logger, cfg, params)
+	for _, statement := range statements {
+		fmt.Println(statement)
+	}
+	if err != nil {
+		logger.Error("Failed to run maintenance", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Ran maintenance", "operation", operation, "statements", len(statements), "dryRun", params.DryRun)
+	os.Exit(0)
+}
+
+// runSmokeTest writes a synthetic trace, reads it back, prints a report with timings and exits with non-zero code
+// if any step failed
+func runSmokeTest(args []string) {
+	var (
+		configPath string
+		set        overrides
+		params     storage.SmokeTestParams
+	)
+	flags := flag.NewFlagSet("smoketest", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.Var(&set, "set", "Override an option of the configuration file as path=value, e.g. grpc_server.address=:17271, can be repeated")
+	flags.StringVar(&params.Tenant, "tenant", "", "Tenant the synthetic trace is written for when multi_tenant is enabled")
+	flags.StringVar(&params.User, "user", "", "User the synthetic trace is read as when row_level_security is enabled")
+	flags.DurationVar(&params.Timeout, "timeout", 30*time.Second, "How long reads are retried until the synthetic trace is found")
+	_ = flags.Parse(args)
+
+	logger := newLogger()
+	cfg := loadConfig(logger, configPath, set)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	results, err := storage.SmokeTest(ctx, logger, cfg, params)
+	if err != nil {
+		logger.Error("Failed to run smoke test", "error", err)
+		os.Exit(1)
+	}
+	passed, err := storage.WriteDoctorReport(os.Stdout, results)
+	if err != nil {
+		logger.Error("Failed to write report", "error", err)
+		os.Exit(1)
+	}
+	if !passed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runDoctor(logger hclog.Logger, cfg storage.Configuration) {
+	results, err := storage.Doctor(logger, cfg)
+	if err != nil {
+		logger.Error("Failed to diagnose ClickHouse", "error", err)
+		os.Exit(1)
+	}
+	healthy, err := storage.WriteDoctorReport(os.Stdout, results)
+	if err != nil {
+		logger.Error("Failed to write report", "error", err)
+		os.Exit(1)
+	}
+	if !healthy {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serveRemoteStorage serves the storage as a standalone gRPC remote storage server until the process is terminated
+func serveRemoteStorage(logger hclog.Logger, cfg storage.GRPCServerConfiguration, services *shared.PluginServices) {
+	opts, err := cfg.ServerOptions()
+	if err != nil {
+		logger.Error("Invalid gRPC server configuration", "error", err)
+		os.Exit(1)
+	}
+	server := grpcserver.NewServer(opts...)
+	plugin := shared.StorageGRPCPlugin{Impl: services.Store, ArchiveImpl: services.ArchiveStore}
+	if err = plugin.GRPCServer(nil, server); err != nil {
+		logger.Error("Failed to register storage services", "error", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		logger.Error("Failed to listen for gRPC remote storage", "address", cfg.Address, "error", err)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Info("Stopping gRPC remote storage server")
+		server.GracefulStop()
+	}()
+
+	logger.Info("Serving gRPC remote storage", "address", cfg.Address)
+	if err = server.Serve(listener); err != nil {
+		logger.Error("Failed to serve gRPC remote storage", "error", err)
+	}
+}
@@ -2,8 +2,7 @@ package jaegerclickhouse
 
 import "embed"
 
-//go:embed sqlscripts/local/*
-var EmbeddedFilesNoReplication embed.FS
-
-//go:embed sqlscripts/replication/*
-var EmbeddedFilesReplication embed.FS
+// SQLScripts contains templates of the SQL scripts creating tables at plugin startup
+//
+//go:embed sqlscripts/*
+var SQLScripts embed.FS
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}
+ON CLUSTER '{cluster}' AS {{.QuotedDatabase}}.{{.LocalTable}}
+ENGINE = Distributed('{cluster}', {{.QuotedDatabase}}, {{.LocalTable}}, {{.Hash}})
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant    LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    user      LowCardinality(String) CODEC ({{.Codec "user" "ZSTD(1)"}}),
+    operation LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+    params    String CODEC ({{.Codec "params" "ZSTD(3)"}}),
+    traceIDs  Array(String) CODEC ({{.Codec "traceIDs" "ZSTD(3)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{.TTLAudit}}
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}user, timestamp)
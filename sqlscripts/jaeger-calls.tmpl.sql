@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant       LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp    DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    traceID      String CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    spanID       String CODEC ({{.Codec "spanID" "ZSTD(1)"}}),
+    parentSpanID String CODEC ({{.Codec "parentSpanID" "ZSTD(1)"}}),
+    service      LowCardinality(String) CODEC ({{.Codec "service" "ZSTD(1)"}}),
+    operation    LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+    error        UInt8 CODEC ({{.Codec "error" "ZSTD(1)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{.TTLTimestamp}}
+PARTITION BY toDate(timestamp)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}timestamp, traceID)
+SETTINGS index_granularity = 1024{{if .DeduplicationWindow}}, {{if .Replication}}replicated{{else}}non_replicated{{end}}_deduplication_window = {{.DeduplicationWindow}}{{end}}{{if and .Replication .DeduplicationWindowSeconds}}, replicated_deduplication_window_seconds = {{.DeduplicationWindowSeconds}}{{end}}
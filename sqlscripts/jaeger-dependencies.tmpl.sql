@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant    LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    parent    LowCardinality(String) CODEC ({{.Codec "parent" "ZSTD(1)"}}),
+    child     LowCardinality(String) CODEC ({{.Codec "child" "ZSTD(1)"}}),
+    callCount UInt64 CODEC ({{.Codec "callCount" "ZSTD(1)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{.TTLTimestamp}}
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}timestamp, parent, child)
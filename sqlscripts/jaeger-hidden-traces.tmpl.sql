@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant  LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    traceID String CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    hidden  UInt8 CODEC ({{.Codec "hidden" "ZSTD(1)"}}),
+    version UInt64 CODEC ({{.Codec "version" "Delta, ZSTD(1)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.SharedReplicatedArgs}}{{else}}MergeTree(){{end}}
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}traceID)
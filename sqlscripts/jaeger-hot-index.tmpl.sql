@@ -0,0 +1,10 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+TTL timestamp + {{.HotIndexWindow}} DELETE
+PARTITION BY toStartOfHour(timestamp)
+ORDER BY ({{if .IndexOrderBy}}{{.IndexOrderBy}}{{else}}{{if .MultiTenant}}tenant, {{end}}service, -toUnixTimestamp(timestamp){{end}})
+SETTINGS index_granularity = 1024, ttl_only_drop_parts = 1
+POPULATE
+AS SELECT *
+FROM {{.IndexTable}}
+WHERE timestamp >= now() - {{.HotIndexWindow}}
@@ -0,0 +1,4 @@
+ALTER TABLE {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+{{- range $i, $tag := .ExtractedTags}}{{if $i}},{{end}}
+ADD COLUMN IF NOT EXISTS {{$tag.Column}} Nullable({{$tag.Type}}) CODEC ({{$.Codec $tag.Column "ZSTD(1)"}})
+{{- end}}
@@ -0,0 +1,2 @@
+ALTER TABLE {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ADD COLUMN IF NOT EXISTS insertedAt DateTime DEFAULT timestamp CODEC ({{.Codec "insertedAt" "Delta, ZSTD(1)"}})
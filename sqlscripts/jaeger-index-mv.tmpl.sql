@@ -0,0 +1,33 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+TO {{.IndexTable}}
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    timestamp,
+    traceID,
+    service,
+    operation,
+    durationUs,
+    {{- if .IndexFlags}}
+    flags,
+    {{- end}}
+    {{- if .IndexLinks}}
+    linkedTraceIDs,
+    {{- end}}
+    {{- if .IndexStatusCodes}}
+    httpStatusCode,
+    grpcStatusCode,
+    {{- end}}
+    {{- if .IndexSpanKind}}
+    spanKind,
+    {{- end}}
+    {{- if .IndexRoots}}
+    isRoot,
+    {{- end}}
+    {{- if .SamplingPriority}}
+    priority,
+    {{- end}}
+    tags.key,
+    tags.value
+FROM {{.SpansTable}}
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant     LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp  DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    traceID    {{.TraceIDType}} CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    service    LowCardinality(String) CODEC ({{.Codec "service" "ZSTD(1)"}}),
+    operation  LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+    durationUs UInt64 CODEC ({{.Codec "durationUs" "ZSTD(1)"}}),
+    {{- if .IndexFlags}}
+    flags      UInt32 CODEC ({{.Codec "flags" "ZSTD(1)"}}),
+    {{- end}}
+    {{- if .IndexLinks}}
+    linkedTraceIDs Array(String) CODEC ({{.Codec "linkedTraceIDs" "ZSTD(1)"}}),
+    {{- end}}
+    {{- if .IndexStatusCodes}}
+    httpStatusCode Nullable(UInt16) CODEC ({{.Codec "httpStatusCode" "ZSTD(1)"}}),
+    grpcStatusCode Nullable(UInt16) CODEC ({{.Codec "grpcStatusCode" "ZSTD(1)"}}),
+    {{- end}}
+    {{- if .IndexSpanKind}}
+    spanKind   LowCardinality(String) CODEC ({{.Codec "spanKind" "ZSTD(1)"}}),
+    {{- end}}
+    {{- if .IndexRoots}}
+    isRoot     UInt8 CODEC ({{.Codec "isRoot" "ZSTD(1)"}}),
+    {{- end}}
+    {{- if .IndexInsertTime}}
+    insertedAt DateTime DEFAULT timestamp CODEC ({{.Codec "insertedAt" "Delta, ZSTD(1)"}}),
+    {{- end}}
+    {{- if .SamplingPriority}}
+    priority   UInt8 CODEC ({{.Codec "priority" "ZSTD(1)"}}),
+    {{- end}}
+    {{- range .ExtractedTags}}
+    {{.Column}} Nullable({{.Type}}) CODEC ({{$.Codec .Column "ZSTD(1)"}}),
+    {{- end}}
+    tags Nested
+    (
+        key LowCardinality(String),
+        value String
+    ) CODEC ({{.Codec "tags" "ZSTD(1)"}}),
+    INDEX idx_tag_keys tags.key TYPE bloom_filter(0.01) GRANULARITY 64,
+    {{- if .IndexLinks}}
+    INDEX idx_linked_trace_ids linkedTraceIDs TYPE bloom_filter(0.01) GRANULARITY 64,
+    {{- end}}
+    INDEX idx_duration durationUs TYPE minmax GRANULARITY 1
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{if .SamplingPriority}}{{.TTLPriority}}{{else}}{{.TTLTimestamp}}{{end}}
+PARTITION BY toDate(timestamp)
+ORDER BY ({{if .IndexOrderBy}}{{.IndexOrderBy}}{{else}}{{if .MultiTenant}}tenant, {{end}}service, -toUnixTimestamp(timestamp){{end}})
+SETTINGS index_granularity = 1024{{if .DeduplicationWindow}}, {{if .Replication}}replicated{{else}}non_replicated{{end}}_deduplication_window = {{.DeduplicationWindow}}{{end}}{{if and .Replication .DeduplicationWindowSeconds}}, replicated_deduplication_window_seconds = {{.DeduplicationWindowSeconds}}{{end}}
@@ -0,0 +1,16 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedAggregatingMergeTree{{.ReplicatedArgs}}{{else}}AggregatingMergeTree(){{end}}
+{{.TTLDate}}
+PARTITION BY toYYYYMM(date)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}service, operation, date)
+SETTINGS index_granularity = 1024
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    toDate(timestamp) AS date,
+    service,
+    operation,
+    quantilesTDigestState(0.5, 0.9, 0.95, 0.99)(durationUs) AS durations
+FROM {{.IndexTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}date, service, operation
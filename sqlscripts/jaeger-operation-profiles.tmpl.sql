@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant         LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp      DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    traceID        String CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    rootService    LowCardinality(String) CODEC ({{.Codec "rootService" "ZSTD(1)"}}),
+    rootOperation  LowCardinality(String) CODEC ({{.Codec "rootOperation" "ZSTD(1)"}}),
+    service        LowCardinality(String) CODEC ({{.Codec "service" "ZSTD(1)"}}),
+    operation      LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+    stack          String CODEC ({{.Codec "stack" "ZSTD(3)"}}),
+    spans          UInt32 CODEC ({{.Codec "spans" "ZSTD(1)"}}),
+    selfTimeUs     UInt64 CODEC ({{.Codec "selfTimeUs" "ZSTD(1)"}}),
+    criticalPathUs UInt64 CODEC ({{.Codec "criticalPathUs" "ZSTD(1)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{.TTLProfiles}}
+PARTITION BY toDate(timestamp)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}rootService, rootOperation, timestamp)
+SETTINGS index_granularity = 1024{{if .DeduplicationWindow}}, {{if .Replication}}replicated{{else}}non_replicated{{end}}_deduplication_window = {{.DeduplicationWindow}}{{end}}{{if and .Replication .DeduplicationWindowSeconds}}, replicated_deduplication_window_seconds = {{.DeduplicationWindowSeconds}}{{end}}
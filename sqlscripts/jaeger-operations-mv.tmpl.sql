@@ -0,0 +1,13 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+TO {{.TargetTable}}
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    toDate(timestamp) AS date,
+    service,
+    operation,
+    count() AS count,
+    if(has(tags.key, 'span.kind'), tags.value[indexOf(tags.key, 'span.kind')], '') AS spankind
+FROM {{.IndexTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}date, service, operation, tags.key, tags.value
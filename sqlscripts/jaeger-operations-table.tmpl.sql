@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant    LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    date      Date CODEC ({{.Codec "date" "Delta, ZSTD(1)"}}),
+    service   LowCardinality(String) CODEC ({{.Codec "service" "ZSTD(1)"}}),
+    operation LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+    count     UInt64 CODEC ({{.Codec "count" "ZSTD(1)"}}),
+    spankind  String CODEC ({{.Codec "spankind" "ZSTD(1)"}})
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}SummingMergeTree{{end}}
+{{.TTLDate}}
+PARTITION BY toYYYYMM(date)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}date, service, operation)
+SETTINGS index_granularity = 32
@@ -0,0 +1,18 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}SummingMergeTree{{end}}
+{{.TTLDate}}
+PARTITION BY toYYYYMM(date)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}date, service, operation)
+SETTINGS index_granularity = 32
+POPULATE
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    toDate(timestamp) AS date,
+    service,
+    operation,
+    count() AS count,
+    if(has(tags.key, 'span.kind'), tags.value[indexOf(tags.key, 'span.kind')], '') AS spankind
+FROM {{.IndexTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}date, service, operation, tags.key, tags.value
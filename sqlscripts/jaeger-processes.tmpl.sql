@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant  LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    hash    String CODEC ({{.Codec "hash" "ZSTD(1)"}}),
+    process String CODEC ({{.Codec "process" "ZSTD(3)"}})
+) ENGINE {{if .Replication}}ReplicatedReplacingMergeTree{{.ReplicatedArgs}}{{else}}ReplacingMergeTree(){{end}}
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}hash)
+SETTINGS index_granularity = 1024
@@ -0,0 +1,15 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedReplacingMergeTree{{.ReplicatedArgs}}{{else}}ReplacingMergeTree{{end}}
+{{.TTLRecentTraces}}
+PARTITION BY toStartOfHour(timestamp)
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}service, traceID)
+SETTINGS index_granularity = 1024, ttl_only_drop_parts = 1
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    service,
+    traceID,
+    max(timestamp) AS timestamp
+FROM {{.IndexTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}service, traceID
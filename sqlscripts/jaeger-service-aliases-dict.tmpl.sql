@@ -0,0 +1,9 @@
+CREATE DICTIONARY IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    alias   String,
+    service String
+)
+PRIMARY KEY alias
+SOURCE(CLICKHOUSE(DB '{{.Database}}' TABLE '{{.SourceTable.Unquoted}}'))
+LIFETIME(MIN 60 MAX 300)
+LAYOUT(COMPLEX_KEY_HASHED())
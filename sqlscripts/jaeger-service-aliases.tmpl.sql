@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    alias   String,
+    service String
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.SharedReplicatedArgs}}{{else}}MergeTree(){{end}}
+ORDER BY alias
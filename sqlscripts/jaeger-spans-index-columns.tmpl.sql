@@ -0,0 +1,25 @@
+ALTER TABLE {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ADD COLUMN IF NOT EXISTS service LowCardinality(String) CODEC ({{.Codec "service" "ZSTD(1)"}}),
+ADD COLUMN IF NOT EXISTS operation LowCardinality(String) CODEC ({{.Codec "operation" "ZSTD(1)"}}),
+ADD COLUMN IF NOT EXISTS durationUs UInt64 CODEC ({{.Codec "durationUs" "ZSTD(1)"}}),
+{{- if .IndexFlags}}
+ADD COLUMN IF NOT EXISTS flags UInt32 CODEC ({{.Codec "flags" "ZSTD(1)"}}),
+{{- end}}
+{{- if .IndexLinks}}
+ADD COLUMN IF NOT EXISTS linkedTraceIDs Array(String) CODEC ({{.Codec "linkedTraceIDs" "ZSTD(1)"}}),
+{{- end}}
+{{- if .IndexStatusCodes}}
+ADD COLUMN IF NOT EXISTS httpStatusCode Nullable(UInt16) CODEC ({{.Codec "httpStatusCode" "ZSTD(1)"}}),
+ADD COLUMN IF NOT EXISTS grpcStatusCode Nullable(UInt16) CODEC ({{.Codec "grpcStatusCode" "ZSTD(1)"}}),
+{{- end}}
+{{- if .IndexSpanKind}}
+ADD COLUMN IF NOT EXISTS spanKind LowCardinality(String) CODEC ({{.Codec "spanKind" "ZSTD(1)"}}),
+{{- end}}
+{{- if .IndexRoots}}
+ADD COLUMN IF NOT EXISTS isRoot UInt8 CODEC ({{.Codec "isRoot" "ZSTD(1)"}}),
+{{- end}}
+ADD COLUMN IF NOT EXISTS tags Nested
+(
+    key LowCardinality(String),
+    value String
+) CODEC ({{.Codec "tags" "ZSTD(1)"}})
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant     LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp  DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    traceID    {{.TraceIDType}} CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    model      String CODEC ({{.Codec "model" "ZSTD(3)"}}),
+    insertedAt DateTime DEFAULT now() CODEC ({{.Codec "insertedAt" "Delta, ZSTD(1)"}}){{if .SamplingPriority}},
+    priority   UInt8 CODEC ({{.Codec "priority" "ZSTD(1)"}}){{end}}
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{.TTLInsertedAt}}
+PARTITION BY toDate(insertedAt)
+ORDER BY traceID
+SETTINGS index_granularity = 1024
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+(
+    {{- if .MultiTenant}}
+    tenant    LowCardinality(String) CODEC ({{.Codec "tenant" "ZSTD(1)"}}),
+    {{- end}}
+    timestamp DateTime CODEC ({{.Codec "timestamp" "Delta, ZSTD(1)"}}),
+    traceID   {{.TraceIDType}} CODEC ({{.Codec "traceID" "ZSTD(1)"}}),
+    model     String CODEC ({{.Codec "model" "ZSTD(3)"}}){{if .SamplingPriority}},
+    priority  UInt8 CODEC ({{.Codec "priority" "ZSTD(1)"}}){{end}}
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicatedArgs}}{{else}}MergeTree(){{end}}
+{{if .SamplingPriority}}{{.TTLPriority}}{{else}}{{.TTLTimestamp}}{{end}}
+PARTITION BY toDate(timestamp)
+ORDER BY {{if .SpansOrderBy}}({{.SpansOrderBy}}){{else}}traceID{{end}}
+SETTINGS index_granularity = 1024{{if .DeduplicationWindow}}, {{if .Replication}}replicated{{else}}non_replicated{{end}}_deduplication_window = {{.DeduplicationWindow}}{{end}}{{if and .Replication .DeduplicationWindowSeconds}}, replicated_deduplication_window_seconds = {{.DeduplicationWindowSeconds}}{{end}}
@@ -0,0 +1,19 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedAggregatingMergeTree{{.ReplicatedArgs}}{{else}}AggregatingMergeTree(){{end}}
+{{.TTLDate}}
+PARTITION BY date
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}traceID)
+SETTINGS index_granularity = 1024
+POPULATE
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    toDate(timestamp) AS date,
+    traceID,
+    CAST(count() AS SimpleAggregateFunction(sum, UInt64)) AS spans,
+    CAST(min(timestamp) AS SimpleAggregateFunction(min, DateTime)) AS start,
+    CAST(max(durationUs) AS SimpleAggregateFunction(max, UInt64)) AS durationUs,
+    argMaxState(service, durationUs) AS rootService
+FROM {{.IndexTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}date, traceID
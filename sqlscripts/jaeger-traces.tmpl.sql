@@ -0,0 +1,16 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+ENGINE {{if .Replication}}ReplicatedAggregatingMergeTree{{.ReplicatedArgs}}{{else}}AggregatingMergeTree(){{end}}
+{{.TTLDate}}
+PARTITION BY date
+ORDER BY ({{if .MultiTenant}}tenant, {{end}}traceID)
+SETTINGS index_granularity = 128
+POPULATE
+AS SELECT
+    {{- if .MultiTenant}}
+    tenant,
+    {{- end}}
+    toDate(timestamp) AS date,
+    traceID,
+    CAST(groupArray(model) AS SimpleAggregateFunction(groupArrayArray, Array(String))) AS models
+FROM {{.SpansTable}}
+GROUP BY {{if .MultiTenant}}tenant, {{end}}date, traceID
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS {{.Table}}{{if .Replication}} ON CLUSTER '{cluster}'{{end}}
+AS {{.QuotedDatabase}}.{{.SourceTable}}
+ENGINE = Merge({{.QuotedDatabase}}, '{{.MergePattern}}')
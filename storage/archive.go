@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errArchiveDisabled = status.Error(codes.Unimplemented, "archive storage is disabled")
+
+var _ shared.PluginCapabilities = (*Store)(nil)
+
+// Capabilities reports whether the archive storage is enabled, the plugin is served with the archive storage
+// only if it is, so that jaeger-query does not offer archiving otherwise. The plugin API of this Jaeger version
+// has no streaming span writer, so there is no capability to report for it.
+func (s *Store) Capabilities() (*shared.Capabilities, error) {
+	archive := s.newArchiveWriter != nil
+	return &shared.Capabilities{
+		ArchiveSpanReader: archive,
+		ArchiveSpanWriter: archive,
+	}, nil
+}
+
+// disabledArchive is the archive storage when the archive is disabled, all its methods fail with Unimplemented
+type disabledArchive struct{}
+
+var (
+	_ spanstore.Reader = disabledArchive{}
+	_ spanstore.Writer = disabledArchive{}
+)
+
+func (disabledArchive) WriteSpan(context.Context, *model.Span) error {
+	return errArchiveDisabled
+}
+
+func (disabledArchive) GetTrace(context.Context, model.TraceID) (*model.Trace, error) {
+	return nil, errArchiveDisabled
+}
+
+func (disabledArchive) GetServices(context.Context) ([]string, error) {
+	return nil, errArchiveDisabled
+}
+
+func (disabledArchive) GetOperations(context.Context, spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, errArchiveDisabled
+}
+
+func (disabledArchive) FindTraces(context.Context, *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, errArchiveDisabled
+}
+
+func (disabledArchive) FindTraceIDs(context.Context, *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, errArchiveDisabled
+}
@@ -0,0 +1,251 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+var (
+	errNotImplemented = errors.New("not implemented")
+)
+
+// DependencyStore handles all queries and insertions to Clickhouse dependencies
+type DependencyStore struct {
+	db         *sql.DB
+	callsTable clickhousespanstore.TableName
+	// parentsTable is joined to find parent spans, the local table of sharded calls
+	parentsTable clickhousespanstore.TableName
+	// dependenciesTable has links written by WriteDependencies, service dependencies are read from it if set
+	dependenciesTable clickhousespanstore.TableName
+	// profilesTable has operation profiles of sampled traces, they are not served if empty
+	profilesTable clickhousespanstore.TableName
+	tenantHeader  string
+	// userDB returns connections of the user from the gRPC metadata key userHeader, db is used if nil
+	userDB     clickhousespanstore.UserDB
+	userHeader string
+}
+
+// OperationDependencyLink is a dependency between operations of services
+type OperationDependencyLink struct {
+	ParentService   string
+	ParentOperation string
+	ChildService    string
+	ChildOperation  string
+	CallCount       uint64
+	ErrorCount      uint64
+}
+
+// DependencyStoreOption configures optional behaviour of DependencyStore
+type DependencyStoreOption func(store *DependencyStore)
+
+// WithTenantHeader scopes dependencies to the tenant from the gRPC metadata key header of the request
+func WithTenantHeader(header string) DependencyStoreOption {
+	return func(store *DependencyStore) {
+		store.tenantHeader = header
+	}
+}
+
+// WithLocalParents joins parent spans from the local table of calls sharded by trace ID.
+// Spans of a trace are on the same shard, so parents are found without reading other shards.
+func WithLocalParents(localTable clickhousespanstore.TableName) DependencyStoreOption {
+	return func(store *DependencyStore) {
+		store.parentsTable = localTable
+	}
+}
+
+// WithUserDB queries with connections of the ClickHouse user of every request, so that row policies of the user apply.
+// Requests over HTTP pass the user in the HTTP header with the same name as the gRPC metadata key header.
+func WithUserDB(header string, userDB clickhousespanstore.UserDB) DependencyStoreOption {
+	return func(store *DependencyStore) {
+		store.userHeader = header
+		store.userDB = userDB
+	}
+}
+
+var _ dependencystore.Reader = (*DependencyStore)(nil)
+
+// NewDependencyStore returns a DependencyStore without dependencies
+func NewDependencyStore() *DependencyStore {
+	return &DependencyStore{}
+}
+
+// NewCallsDependencyStore returns a DependencyStore computing dependencies from calls between spans in the table
+func NewCallsDependencyStore(db *sql.DB, callsTable clickhousespanstore.TableName, opts ...DependencyStoreOption) *DependencyStore {
+	store := &DependencyStore{
+		db:           db,
+		callsTable:   callsTable,
+		parentsTable: callsTable,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// GetDependencies returns all interservice dependencies, implements DependencyReader
+func (s *DependencyStore) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	return s.GetServiceDependencies(ctx, "", endTs, lookback)
+}
+
+// GetServiceDependencies returns interservice dependencies with the service as the parent or the child,
+// all dependencies if the service is empty. Dependencies are filtered by ClickHouse, so that large meshes
+// are not read to show the neighbours of one service.
+func (s *DependencyStore) GetServiceDependencies(ctx context.Context, service string, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetServiceDependencies")
+	defer span.Finish()
+
+	if s.db == nil {
+		return nil, errNotImplemented
+	}
+	if s.dependenciesTable != "" {
+		return s.getStoredDependencies(ctx, service, endTs, lookback)
+	}
+
+	links, err := s.GetServiceOperationDependencies(ctx, service, endTs, lookback)
+	if err != nil {
+		return nil, err
+	}
+
+	type serviceLink struct {
+		parent, child string
+	}
+	counts := make(map[serviceLink]uint64)
+	var order []serviceLink
+	for _, link := range links {
+		if link.ParentService == link.ChildService {
+			continue
+		}
+		key := serviceLink{parent: link.ParentService, child: link.ChildService}
+		if _, ok := counts[key]; !ok {
+			order = append(order, key)
+		}
+		counts[key] += link.CallCount
+	}
+
+	dependencies := make([]model.DependencyLink, 0, len(order))
+	for _, key := range order {
+		dependencies = append(dependencies, model.DependencyLink{Parent: key.parent, Child: key.child, CallCount: counts[key]})
+	}
+	return dependencies, nil
+}
+
+// GetOperationDependencies returns dependencies between operations with numbers of calls and failed calls
+func (s *DependencyStore) GetOperationDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]OperationDependencyLink, error) {
+	return s.GetServiceOperationDependencies(ctx, "", endTs, lookback)
+}
+
+// GetServiceOperationDependencies returns dependencies between operations with operations of the service
+// as the parent or the child, all dependencies if the service is empty
+func (s *DependencyStore) GetServiceOperationDependencies(
+	ctx context.Context,
+	service string,
+	endTs time.Time,
+	lookback time.Duration,
+) ([]OperationDependencyLink, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetServiceOperationDependencies")
+	defer span.Finish()
+
+	if s.db == nil || s.callsTable == "" {
+		return nil, errNotImplemented
+	}
+
+	start := endTs.Add(-lookback)
+	parentCondition, childCondition := "timestamp >= ? AND timestamp <= ?", "child.timestamp >= ? AND child.timestamp <= ?"
+	parentArgs := []interface{}{start, endTs}
+	childArgs := []interface{}{start, endTs}
+	if s.tenantHeader != "" {
+		tenant := clickhousespanstore.TenantFromContext(ctx, s.tenantHeader)
+		parentCondition += " AND tenant = ?"
+		childCondition += " AND child.tenant = ?"
+		parentArgs = append(parentArgs, tenant)
+		childArgs = append(childArgs, tenant)
+	}
+	if service != "" {
+		childCondition += " AND (parent.service = ? OR child.service = ?)"
+		childArgs = append(childArgs, service, service)
+	}
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT parent.service, parent.operation, child.service, child.operation, count(), countIf(child.error = 1)"+
+			" FROM %s AS child"+
+			" INNER JOIN (SELECT traceID, spanID, service, operation FROM %s WHERE %s) AS parent"+
+			" ON child.traceID = parent.traceID AND child.parentSpanID = parent.spanID"+
+			" WHERE %s"+
+			" GROUP BY parent.service, parent.operation, child.service, child.operation"+
+			" ORDER BY parent.service, parent.operation, child.service, child.operation",
+		s.callsTable,
+		s.parentsTable,
+		parentCondition,
+		childCondition,
+	)
+	args := append(parentArgs, childArgs...)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	links := make([]OperationDependencyLink, 0)
+	for rows.Next() {
+		var link OperationDependencyLink
+		if err := rows.Scan(
+			&link.ParentService,
+			&link.ParentOperation,
+			&link.ChildService,
+			&link.ChildOperation,
+			&link.CallCount,
+			&link.ErrorCount,
+		); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// userRows keep the connection pool of the user of the request until they are closed
+type userRows struct {
+	*sql.Rows
+	release func()
+}
+
+// Close closes the rows and releases the connection pool
+func (r *userRows) Close() error {
+	defer r.release()
+	return r.Rows.Close()
+}
+
+// query runs the query with the connection of the user of the request, if there is one
+func (s *DependencyStore) query(ctx context.Context, query string, args ...interface{}) (*userRows, error) {
+	db, release := s.db, func() {}
+	if s.userDB != nil {
+		var err error
+		if db, release, err = s.userDB(ctx); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &userRows{Rows: rows, release: release}, nil
+}
@@ -2,10 +2,18 @@ package clickhousedependencystore
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
 )
 
 func TestDependencyStore_GetDependencies(t *testing.T) {
@@ -16,3 +24,147 @@ func TestDependencyStore_GetDependencies(t *testing.T) {
 	assert.EqualError(t, err, errNotImplemented.Error())
 	assert.Nil(t, dependencies)
 }
+
+const testCallsTable = clickhousespanstore.TableName("jaeger_calls_local")
+
+var testOperationDependenciesQuery = "SELECT parent.service, parent.operation, child.service, child.operation, count(), countIf(child.error = 1)" +
+	" FROM jaeger_calls_local AS child" +
+	" INNER JOIN (SELECT traceID, spanID, service, operation FROM jaeger_calls_local WHERE timestamp >= ? AND timestamp <= ?) AS parent" +
+	" ON child.traceID = parent.traceID AND child.parentSpanID = parent.spanID" +
+	" WHERE child.timestamp >= ? AND child.timestamp <= ?" +
+	" GROUP BY parent.service, parent.operation, child.service, child.operation" +
+	" ORDER BY parent.service, parent.operation, child.service, child.operation"
+
+func getOperationDependencyRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"parent.service", "parent.operation", "child.service", "child.operation", "count()", "countIf(child.error = 1)"}).
+		AddRow("frontend", "GET /", "frontend", "render", uint64(10), uint64(0)).
+		AddRow("frontend", "GET /", "customer", "SQL SELECT", uint64(5), uint64(1)).
+		AddRow("frontend", "GET /dispatch", "customer", "SQL SELECT", uint64(3), uint64(0)).
+		AddRow("customer", "SQL SELECT", "mysql", "query", uint64(8), uint64(2))
+}
+
+func TestDependencyStore_GetOperationDependencies(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery(testOperationDependenciesQuery).
+		WithArgs(start, endTs, start, endTs).
+		WillReturnRows(getOperationDependencyRows())
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable)
+	links, err := dependencyStore.GetOperationDependencies(context.Background(), endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []OperationDependencyLink{
+		{ParentService: "frontend", ParentOperation: "GET /", ChildService: "frontend", ChildOperation: "render", CallCount: 10},
+		{ParentService: "frontend", ParentOperation: "GET /", ChildService: "customer", ChildOperation: "SQL SELECT", CallCount: 5, ErrorCount: 1},
+		{ParentService: "frontend", ParentOperation: "GET /dispatch", ChildService: "customer", ChildOperation: "SQL SELECT", CallCount: 3},
+		{ParentService: "customer", ParentOperation: "SQL SELECT", ChildService: "mysql", ChildOperation: "query", CallCount: 8, ErrorCount: 2},
+	}, links)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_GetOperationDependenciesMultiTenant(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	tenant := "tenant_1"
+	mock.ExpectQuery(
+		"SELECT parent.service, parent.operation, child.service, child.operation, count(), countIf(child.error = 1)"+
+			" FROM jaeger_calls AS child"+
+			" INNER JOIN (SELECT traceID, spanID, service, operation FROM jaeger_calls_local WHERE timestamp >= ? AND timestamp <= ? AND tenant = ?) AS parent"+
+			" ON child.traceID = parent.traceID AND child.parentSpanID = parent.spanID"+
+			" WHERE child.timestamp >= ? AND child.timestamp <= ? AND child.tenant = ?"+
+			" GROUP BY parent.service, parent.operation, child.service, child.operation"+
+			" ORDER BY parent.service, parent.operation, child.service, child.operation",
+	).
+		WithArgs(start, endTs, tenant, start, endTs, tenant).
+		WillReturnRows(getOperationDependencyRows())
+
+	dependencyStore := NewCallsDependencyStore(db, "jaeger_calls", WithTenantHeader("x-tenant"), WithLocalParents(testCallsTable))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", tenant))
+	links, err := dependencyStore.GetOperationDependencies(ctx, endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, links, 4)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_GetDependenciesFromCalls(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery(testOperationDependenciesQuery).
+		WithArgs(start, endTs, start, endTs).
+		WillReturnRows(getOperationDependencyRows())
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable)
+	dependencies, err := dependencyStore.GetDependencies(context.Background(), endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{
+		{Parent: "frontend", Child: "customer", CallCount: 8},
+		{Parent: "customer", Child: "mysql", CallCount: 8},
+	}, dependencies)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_GetServiceDependencies(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery(
+		"SELECT parent.service, parent.operation, child.service, child.operation, count(), countIf(child.error = 1)"+
+			" FROM jaeger_calls_local AS child"+
+			" INNER JOIN (SELECT traceID, spanID, service, operation FROM jaeger_calls_local WHERE timestamp >= ? AND timestamp <= ?) AS parent"+
+			" ON child.traceID = parent.traceID AND child.parentSpanID = parent.spanID"+
+			" WHERE child.timestamp >= ? AND child.timestamp <= ? AND (parent.service = ? OR child.service = ?)"+
+			" GROUP BY parent.service, parent.operation, child.service, child.operation"+
+			" ORDER BY parent.service, parent.operation, child.service, child.operation",
+	).
+		WithArgs(start, endTs, start, endTs, "mysql", "mysql").
+		WillReturnRows(sqlmock.NewRows([]string{"parent.service", "parent.operation", "child.service", "child.operation", "count()", "countIf(child.error = 1)"}).
+			AddRow("customer", "SQL SELECT", "mysql", "query", uint64(8), uint64(2)))
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable)
+	dependencies, err := dependencyStore.GetServiceDependencies(context.Background(), "mysql", endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{{Parent: "customer", Child: "mysql", CallCount: 8}}, dependencies)
+
+	mock.ExpectQuery("SELECT parent, child, sum(callCount) FROM jaeger_dependencies_local WHERE timestamp >= ? AND timestamp <= ?"+
+		" AND (parent = ? OR child = ?) GROUP BY parent, child ORDER BY parent, child").
+		WithArgs(start, endTs, "mysql", "mysql").
+		WillReturnRows(sqlmock.NewRows([]string{"parent", "child", "sum(callCount)"}).AddRow("customer", "mysql", uint64(8)))
+
+	dependencies, err = NewLinksDependencyStore(db, testDependenciesTable).GetServiceDependencies(context.Background(), "mysql", endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{{Parent: "customer", Child: "mysql", CallCount: 8}}, dependencies)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_GetDependenciesQueryError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery(testOperationDependenciesQuery).
+		WithArgs(start, endTs, start, endTs).
+		WillReturnError(errors.New("query error"))
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable)
+	dependencies, err := dependencyStore.GetDependencies(context.Background(), endTs, time.Hour)
+	assert.EqualError(t, err, "query error")
+	assert.Nil(t, dependencies)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
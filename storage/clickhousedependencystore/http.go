@@ -0,0 +1,109 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const defaultLookback = 24 * time.Hour
+
+// ddgPayload is the format of dependencies of Jaeger UI deep dependency graph, every path is a single call
+type ddgPayload struct {
+	Dependencies []ddgPath `json:"dependencies"`
+}
+
+type ddgPath struct {
+	Path       []ddgNode      `json:"path"`
+	Attributes []ddgAttribute `json:"attributes"`
+}
+
+type ddgNode struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+}
+
+type ddgAttribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ServeHTTP returns operation dependencies in the format of Jaeger UI deep dependency graph.
+// Like Jaeger query API, it accepts endTs and lookback query parameters in milliseconds.
+// With the service query parameter, only dependencies with operations of the service are returned.
+// The tenant is taken from the HTTP header with the same name as the gRPC metadata key.
+func (s *DependencyStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, endTs, lookback, ok := s.parseRequest(w, r)
+	if !ok {
+		return
+	}
+	links, err := s.GetServiceOperationDependencies(ctx, r.URL.Query().Get("service"), endTs, lookback)
+	if err == errNotImplemented {
+		http.Error(w, "operation dependencies are not enabled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	payload := ddgPayload{Dependencies: make([]ddgPath, 0, len(links))}
+	for _, link := range links {
+		payload.Dependencies = append(payload.Dependencies, ddgPath{
+			Path: []ddgNode{
+				{Service: link.ParentService, Operation: link.ParentOperation},
+				{Service: link.ChildService, Operation: link.ChildOperation},
+			},
+			Attributes: []ddgAttribute{
+				{Key: "call_count", Value: strconv.FormatUint(link.CallCount, 10)},
+				{Key: "error_count", Value: strconv.FormatUint(link.ErrorCount, 10)},
+			},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+// parseRequest returns the time range of the endTs and lookback query parameters and the context with the tenant
+// and the user from HTTP headers. The request is answered with an error and ok is false if the parameters are invalid.
+func (s *DependencyStore) parseRequest(w http.ResponseWriter, r *http.Request) (ctx context.Context, endTs time.Time, lookback time.Duration, ok bool) {
+	endTs = time.Now()
+	if value := r.URL.Query().Get("endTs"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid endTs", http.StatusBadRequest)
+			return nil, endTs, 0, false
+		}
+		endTs = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	lookback = defaultLookback
+	if value := r.URL.Query().Get("lookback"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || millis <= 0 {
+			http.Error(w, "invalid lookback", http.StatusBadRequest)
+			return nil, endTs, 0, false
+		}
+		lookback = time.Duration(millis) * time.Millisecond
+	}
+
+	return s.requestContext(r), endTs, lookback, true
+}
+
+// requestContext returns the context of the request with the tenant and the user from HTTP headers
+func (s *DependencyStore) requestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	md := metadata.MD{}
+	for _, header := range []string{s.tenantHeader, s.userHeader} {
+		if header != "" {
+			md.Set(header, r.Header.Get(header))
+		}
+	}
+	if len(md) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	return ctx
+}
@@ -0,0 +1,62 @@
+package clickhousedependencystore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestDependencyStore_ServeHTTP(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Unix(1628000000, 0)
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery(testOperationDependenciesQuery).
+		WithArgs(start, endTs, start, endTs).
+		WillReturnRows(getOperationDependencyRows())
+
+	recorder := httptest.NewRecorder()
+	NewCallsDependencyStore(db, testCallsTable).
+		ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/operation-dependencies?endTs=1628000000000&lookback=3600000", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"dependencies": [
+		{"path": [{"service": "frontend", "operation": "GET /"}, {"service": "frontend", "operation": "render"}],
+		 "attributes": [{"key": "call_count", "value": "10"}, {"key": "error_count", "value": "0"}]},
+		{"path": [{"service": "frontend", "operation": "GET /"}, {"service": "customer", "operation": "SQL SELECT"}],
+		 "attributes": [{"key": "call_count", "value": "5"}, {"key": "error_count", "value": "1"}]},
+		{"path": [{"service": "frontend", "operation": "GET /dispatch"}, {"service": "customer", "operation": "SQL SELECT"}],
+		 "attributes": [{"key": "call_count", "value": "3"}, {"key": "error_count", "value": "0"}]},
+		{"path": [{"service": "customer", "operation": "SQL SELECT"}, {"service": "mysql", "operation": "query"}],
+		 "attributes": [{"key": "call_count", "value": "8"}, {"key": "error_count", "value": "2"}]}
+	]}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_ServeHTTPErrors(t *testing.T) {
+	tests := map[string]struct {
+		store        *DependencyStore
+		target       string
+		expectedCode int
+	}{
+		"not enabled":      {store: NewDependencyStore(), target: "/", expectedCode: http.StatusNotFound},
+		"invalid endTs":    {store: NewCallsDependencyStore(nil, testCallsTable), target: "/?endTs=now", expectedCode: http.StatusBadRequest},
+		"invalid lookback": {store: NewCallsDependencyStore(nil, testCallsTable), target: "/?lookback=-1", expectedCode: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.store.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.target, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+var _ dependencystore.Writer = (*DependencyStore)(nil)
+
+// WithDependenciesTable serves service dependencies from links written to the table by WriteDependencies,
+// e.g. computed by Spark or Flink dependency jobs, instead of computing them from calls between spans
+func WithDependenciesTable(table clickhousespanstore.TableName) DependencyStoreOption {
+	return func(store *DependencyStore) {
+		store.dependenciesTable = table
+	}
+}
+
+// NewLinksDependencyStore returns a DependencyStore serving only service dependencies written to the table
+func NewLinksDependencyStore(db *sql.DB, dependenciesTable clickhousespanstore.TableName, opts ...DependencyStoreOption) *DependencyStore {
+	store := &DependencyStore{
+		db:                db,
+		dependenciesTable: dependenciesTable,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// WriteDependencies stores links computed for the timestamp, implements DependencyWriter.
+// The request has no tenant, so links are written with the empty tenant when dependencies are scoped to tenants.
+func (s *DependencyStore) WriteDependencies(ts time.Time, dependencies []model.DependencyLink) error {
+	return s.writeDependencies(context.Background(), ts, dependencies)
+}
+
+func (s *DependencyStore) writeDependencies(ctx context.Context, ts time.Time, dependencies []model.DependencyLink) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WriteDependencies")
+	defer span.Finish()
+
+	if s.db == nil || s.dependenciesTable == "" {
+		return errNotImplemented
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := fmt.Sprintf("INSERT INTO %s (timestamp, parent, child, callCount) VALUES (?, ?, ?, ?)", s.dependenciesTable)
+	tenant := ""
+	if s.tenantHeader != "" {
+		query = fmt.Sprintf("INSERT INTO %s (tenant, timestamp, parent, child, callCount) VALUES (?, ?, ?, ?, ?)", s.dependenciesTable)
+		tenant = clickhousespanstore.TenantFromContext(ctx, s.tenantHeader)
+	}
+	statement, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, link := range dependencies {
+		args := []interface{}{ts, link.Parent, link.Child, link.CallCount}
+		if s.tenantHeader != "" {
+			args = append([]interface{}{tenant}, args...)
+		}
+		if _, err = statement.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	return tx.Commit()
+}
+
+// getStoredDependencies sums calls of links written for timestamps in the time range, links of the service if it is set
+func (s *DependencyStore) getStoredDependencies(
+	ctx context.Context,
+	service string,
+	endTs time.Time,
+	lookback time.Duration,
+) ([]model.DependencyLink, error) {
+	condition := "timestamp >= ? AND timestamp <= ?"
+	args := []interface{}{endTs.Add(-lookback), endTs}
+	if s.tenantHeader != "" {
+		condition += " AND tenant = ?"
+		args = append(args, clickhousespanstore.TenantFromContext(ctx, s.tenantHeader))
+	}
+	if service != "" {
+		condition += " AND (parent = ? OR child = ?)"
+		args = append(args, service, service)
+	}
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT parent, child, sum(callCount) FROM %s WHERE %s GROUP BY parent, child ORDER BY parent, child",
+		s.dependenciesTable,
+		condition,
+	)
+
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	dependencies := make([]model.DependencyLink, 0)
+	for rows.Next() {
+		var link model.DependencyLink
+		if err := rows.Scan(&link.Parent, &link.Child, &link.CallCount); err != nil {
+			return nil, err
+		}
+		dependencies = append(dependencies, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return dependencies, nil
+}
+
+// WriteHandler stores links of the JSON array in the body of POST requests, in the format of Jaeger query API,
+// for the ts query parameter in milliseconds, now by default. The tenant is taken from the HTTP header
+// with the same name as the gRPC metadata key.
+func (s *DependencyStore) WriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ts := time.Now()
+		if value := r.URL.Query().Get("ts"); value != "" {
+			millis, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid ts", http.StatusBadRequest)
+				return
+			}
+			ts = time.Unix(0, millis*int64(time.Millisecond))
+		}
+		var links []uimodel.DependencyLink
+		if err := json.NewDecoder(r.Body).Decode(&links); err != nil {
+			http.Error(w, "invalid dependencies: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		dependencies := make([]model.DependencyLink, 0, len(links))
+		for _, link := range links {
+			dependencies = append(dependencies, model.DependencyLink{Parent: link.Parent, Child: link.Child, CallCount: link.CallCount})
+		}
+
+		err := s.writeDependencies(s.requestContext(r), ts, dependencies)
+		if err == errNotImplemented {
+			http.Error(w, "stored dependencies are not enabled", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"written": len(dependencies)})
+	})
+}
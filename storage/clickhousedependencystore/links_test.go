@@ -0,0 +1,117 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testDependenciesTable = clickhousespanstore.TableName("jaeger_dependencies_local")
+
+func TestDependencyStore_WriteDependencies(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	ts := time.Unix(1628000000, 0)
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare("INSERT INTO jaeger_dependencies_local (timestamp, parent, child, callCount) VALUES (?, ?, ?, ?)")
+	prepare.ExpectExec().WithArgs(ts, "frontend", "customer", uint64(5)).WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WithArgs(ts, "customer", "mysql", uint64(8)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	dependencyStore := NewLinksDependencyStore(db, testDependenciesTable)
+	err = dependencyStore.WriteDependencies(ts, []model.DependencyLink{
+		{Parent: "frontend", Child: "customer", CallCount: 5},
+		{Parent: "customer", Child: "mysql", CallCount: 8},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, errNotImplemented, NewCallsDependencyStore(db, testCallsTable).WriteDependencies(ts, nil))
+}
+
+func TestDependencyStore_GetStoredDependencies(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	mock.ExpectQuery("SELECT parent, child, sum(callCount) FROM jaeger_dependencies_local WHERE timestamp >= ? AND timestamp <= ? AND tenant = ?"+
+		" GROUP BY parent, child ORDER BY parent, child").
+		WithArgs(start, endTs, "tenant_1").
+		WillReturnRows(sqlmock.NewRows([]string{"parent", "child", "sum(callCount)"}).
+			AddRow("customer", "mysql", uint64(8)).
+			AddRow("frontend", "customer", uint64(5)))
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable, WithDependenciesTable(testDependenciesTable), WithTenantHeader("x-tenant"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	dependencies, err := dependencyStore.GetDependencies(ctx, endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{
+		{Parent: "customer", Child: "mysql", CallCount: 8},
+		{Parent: "frontend", Child: "customer", CallCount: 5},
+	}, dependencies, "written links are served instead of ones computed from calls")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewLinksDependencyStore(db, testDependenciesTable).GetOperationDependencies(ctx, endTs, time.Hour)
+	assert.Equal(t, errNotImplemented, err, "operation dependencies are computed from calls only")
+}
+
+func TestDependencyStore_WriteHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO jaeger_dependencies_local (tenant, timestamp, parent, child, callCount) VALUES (?, ?, ?, ?, ?)").
+		ExpectExec().
+		WithArgs("tenant_1", time.Unix(1628000000, 0), "frontend", "customer", uint64(5)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/dependencies?ts=1628000000000",
+		strings.NewReader(`[{"parent": "frontend", "child": "customer", "callCount": 5}]`))
+	request.Header.Set("x-tenant", "tenant_1")
+	recorder := httptest.NewRecorder()
+	NewLinksDependencyStore(db, testDependenciesTable, WithTenantHeader("x-tenant")).WriteHandler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"written": 1}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyStore_WriteHandlerErrors(t *testing.T) {
+	tests := map[string]struct {
+		store        *DependencyStore
+		method       string
+		target       string
+		body         string
+		expectedCode int
+	}{
+		"not enabled":      {store: NewCallsDependencyStore(nil, testCallsTable), method: http.MethodPost, target: "/", body: "[]", expectedCode: http.StatusNotFound},
+		"wrong method":     {store: NewLinksDependencyStore(nil, testDependenciesTable), method: http.MethodGet, target: "/", expectedCode: http.StatusMethodNotAllowed},
+		"invalid ts":       {store: NewLinksDependencyStore(nil, testDependenciesTable), method: http.MethodPost, target: "/?ts=now", body: "[]", expectedCode: http.StatusBadRequest},
+		"invalid document": {store: NewLinksDependencyStore(nil, testDependenciesTable), method: http.MethodPost, target: "/", body: "{", expectedCode: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.store.WriteHandler().ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// OperationProfile sums times of spans of an operation at a stack of operations over profiled traces
+type OperationProfile struct {
+	// Stack are service:operation frames from the root span to spans of the operation separated by semicolons
+	Stack     string `json:"stack"`
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+	// Traces is the number of profiled traces with the stack
+	Traces uint64 `json:"traces"`
+	Spans  uint64 `json:"spans"`
+	// SelfTimeUs is the time of spans not covered by their children in microseconds
+	SelfTimeUs uint64 `json:"selfTimeUs"`
+	// CriticalPathUs is the time of spans on critical paths of their traces in microseconds
+	CriticalPathUs uint64 `json:"criticalPathUs"`
+}
+
+// profilesPayload is the response of the operation profiles API
+type profilesPayload struct {
+	Profiles []OperationProfile `json:"profiles"`
+}
+
+// WithProfilesTable serves operation profiles of sampled traces from the table
+func WithProfilesTable(table clickhousespanstore.TableName) DependencyStoreOption {
+	return func(store *DependencyStore) {
+		store.profilesTable = table
+	}
+}
+
+// GetOperationProfiles returns profiles of traces started in the time range by stacks of operations, only of traces
+// with root spans of the service and the operation if they are not empty
+func (s *DependencyStore) GetOperationProfiles(
+	ctx context.Context,
+	service,
+	operation string,
+	endTs time.Time,
+	lookback time.Duration,
+) ([]OperationProfile, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetOperationProfiles")
+	defer span.Finish()
+
+	if s.db == nil || s.profilesTable == "" {
+		return nil, errNotImplemented
+	}
+
+	condition := "timestamp >= ? AND timestamp <= ?"
+	args := []interface{}{endTs.Add(-lookback), endTs}
+	if s.tenantHeader != "" {
+		condition += " AND tenant = ?"
+		args = append(args, clickhousespanstore.TenantFromContext(ctx, s.tenantHeader))
+	}
+	if service != "" {
+		condition += " AND rootService = ?"
+		args = append(args, service)
+	}
+	if operation != "" {
+		condition += " AND rootOperation = ?"
+		args = append(args, operation)
+	}
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT stack, any(service), any(operation), uniq(traceID), sum(spans), sum(selfTimeUs), sum(criticalPathUs)"+
+			" FROM %s WHERE %s"+
+			" GROUP BY stack"+
+			" ORDER BY stack",
+		s.profilesTable,
+		condition,
+	)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	profiles := make([]OperationProfile, 0)
+	for rows.Next() {
+		var profile OperationProfile
+		if err := rows.Scan(
+			&profile.Stack,
+			&profile.Service,
+			&profile.Operation,
+			&profile.Traces,
+			&profile.Spans,
+			&profile.SelfTimeUs,
+			&profile.CriticalPathUs,
+		); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// ProfilesHandler serves operation profiles of sampled traces over HTTP. Like ServeHTTP, it accepts endTs and
+// lookback query parameters in milliseconds, service and operation query parameters select traces by their root spans.
+// With format=folded, stacks are returned in the folded format of flamegraph tools weighted by self time in
+// microseconds, or by time on the critical path with weight=critical_path.
+func (s *DependencyStore) ProfilesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, endTs, lookback, ok := s.parseRequest(w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		format, weight := query.Get("format"), query.Get("weight")
+		if format != "" && format != "json" && format != "folded" {
+			http.Error(w, "invalid format", http.StatusBadRequest)
+			return
+		}
+		if weight != "" && weight != "self_time" && weight != "critical_path" {
+			http.Error(w, "invalid weight", http.StatusBadRequest)
+			return
+		}
+		profiles, err := s.GetOperationProfiles(ctx, query.Get("service"), query.Get("operation"), endTs, lookback)
+		if err == errNotImplemented {
+			http.Error(w, "operation profiles are not enabled", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if format == "folded" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, profile := range profiles {
+				value := profile.SelfTimeUs
+				if weight == "critical_path" {
+					value = profile.CriticalPathUs
+				}
+				if value > 0 {
+					_, _ = fmt.Fprintf(w, "%s %d\n", profile.Stack, value)
+				}
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(profilesPayload{Profiles: profiles})
+	})
+}
@@ -0,0 +1,119 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testProfilesTable = "jaeger_operation_profiles_local"
+
+func getOperationProfilesQuery(condition string) string {
+	return "SELECT stack, any(service), any(operation), uniq(traceID), sum(spans), sum(selfTimeUs), sum(criticalPathUs)" +
+		" FROM jaeger_operation_profiles_local WHERE " + condition +
+		" GROUP BY stack" +
+		" ORDER BY stack"
+}
+
+func getOperationProfilesRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"stack", "service", "operation", "traces", "spans", "selfTimeUs", "criticalPathUs"}).
+		AddRow("frontend:GET /", "frontend", "GET /", uint64(10), uint64(10), uint64(1500), uint64(3500)).
+		AddRow("frontend:GET /;frontend:auth", "frontend", "auth", uint64(8), uint64(16), uint64(3300), uint64(0))
+}
+
+func TestDependencyStore_GetOperationProfiles(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	tenant := "tenant_1"
+	mock.ExpectQuery(getOperationProfilesQuery("timestamp >= ? AND timestamp <= ? AND tenant = ? AND rootService = ? AND rootOperation = ?")).
+		WithArgs(start, endTs, tenant, "frontend", "GET /").
+		WillReturnRows(getOperationProfilesRows())
+
+	dependencyStore := NewLinksDependencyStore(db, "", WithTenantHeader("x-tenant"), WithProfilesTable(testProfilesTable))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", tenant))
+	profiles, err := dependencyStore.GetOperationProfiles(ctx, "frontend", "GET /", endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []OperationProfile{
+		{Stack: "frontend:GET /", Service: "frontend", Operation: "GET /", Traces: 10, Spans: 10, SelfTimeUs: 1500, CriticalPathUs: 3500},
+		{Stack: "frontend:GET /;frontend:auth", Service: "frontend", Operation: "auth", Traces: 8, Spans: 16, SelfTimeUs: 3300},
+	}, profiles)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewCallsDependencyStore(db, testCallsTable).GetOperationProfiles(context.Background(), "", "", endTs, time.Hour)
+	assert.Equal(t, errNotImplemented, err)
+}
+
+func TestDependencyStore_ProfilesHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Unix(1628000000, 0)
+	dependencyStore := NewLinksDependencyStore(db, "", WithProfilesTable(testProfilesTable))
+	tests := map[string]struct {
+		query       string
+		contentType string
+		expected    string
+	}{
+		"json": {
+			query:       "",
+			contentType: "application/json",
+			expected: `{"profiles": [
+				{"stack": "frontend:GET /", "service": "frontend", "operation": "GET /", "traces": 10, "spans": 10, "selfTimeUs": 1500, "criticalPathUs": 3500},
+				{"stack": "frontend:GET /;frontend:auth", "service": "frontend", "operation": "auth", "traces": 8, "spans": 16, "selfTimeUs": 3300, "criticalPathUs": 0}
+			]}`,
+		},
+		"folded": {
+			query:       "&format=folded",
+			contentType: "text/plain; charset=utf-8",
+			expected:    "frontend:GET / 1500\nfrontend:GET /;frontend:auth 3300\n",
+		},
+		"folded critical path": {
+			query:       "&format=folded&weight=critical_path",
+			contentType: "text/plain; charset=utf-8",
+			expected:    "frontend:GET / 3500\n",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mock.ExpectQuery(getOperationProfilesQuery("timestamp >= ? AND timestamp <= ? AND rootService = ?")).
+				WithArgs(endTs.Add(-time.Hour), endTs, "frontend").
+				WillReturnRows(getOperationProfilesRows())
+
+			recorder := httptest.NewRecorder()
+			dependencyStore.ProfilesHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+				"/api/operation-profiles?endTs=1628000000000&lookback=3600000&service=frontend"+test.query, nil))
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, test.contentType, recorder.Header().Get("Content-Type"))
+			if test.contentType == "application/json" {
+				assert.JSONEq(t, test.expected, recorder.Body.String())
+			} else {
+				assert.Equal(t, test.expected, recorder.Body.String())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	for _, query := range []string{"format=svg", "weight=spans", "lookback=-1"} {
+		recorder := httptest.NewRecorder()
+		dependencyStore.ProfilesHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/operation-profiles?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewDependencyStore().ProfilesHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -0,0 +1,141 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// ServiceTraceQuality counts traces with spans of a service by problems found in their calls.
+// A trace can have several problems, so that counts of problems do not add up to the number of incomplete traces.
+type ServiceTraceQuality struct {
+	Service string `json:"service"`
+	Traces  uint64 `json:"traces"`
+	// MissingRoot traces have no span without a parent
+	MissingRoot uint64 `json:"missingRoot"`
+	// Orphans are traces with spans referencing parents not found in the trace
+	Orphans uint64 `json:"orphans"`
+	// ClockSkew traces have spans starting earlier than their parents
+	ClockSkew uint64 `json:"clockSkew"`
+	// Complete traces have none of the problems
+	Complete uint64 `json:"complete"`
+}
+
+// Completeness is the share of complete traces, 1 if there are no traces
+func (q ServiceTraceQuality) Completeness() float64 {
+	if q.Traces == 0 {
+		return 1
+	}
+	return float64(q.Complete) / float64(q.Traces)
+}
+
+// qualityPayload is the response of the trace quality API
+type qualityPayload struct {
+	Services []qualityService `json:"services"`
+}
+
+type qualityService struct {
+	ServiceTraceQuality
+	Completeness float64 `json:"completeness"`
+}
+
+// GetTraceQuality checks traces with calls in the time range for missing root spans, orphan references
+// and clock skew, and returns numbers of checked and complete traces of every service taking part in them.
+// Only calls in the time range are checked, so traces crossing its bounds may be reported incomplete.
+func (s *DependencyStore) GetTraceQuality(ctx context.Context, endTs time.Time, lookback time.Duration) ([]ServiceTraceQuality, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTraceQuality")
+	defer span.Finish()
+
+	if s.db == nil || s.callsTable == "" {
+		return nil, errNotImplemented
+	}
+
+	condition := "timestamp >= ? AND timestamp <= ?"
+	args := []interface{}{endTs.Add(-lookback), endTs}
+	if s.tenantHeader != "" {
+		condition += " AND tenant = ?"
+		args = append(args, clickhousespanstore.TenantFromContext(ctx, s.tenantHeader))
+	}
+
+	// Calls are grouped into traces first, a span whose parent is in the trace is compared with the parent by index
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT service, count(), countIf(missingRoot), countIf(orphan), countIf(skewed),"+
+			" countIf(NOT missingRoot AND NOT orphan AND NOT skewed)"+
+			" FROM (SELECT groupUniqArray(service) AS services, groupArray(spanID) AS spanIDs,"+
+			" groupArray(parentSpanID) AS parentIDs, groupArray(timestamp) AS timestamps,"+
+			" arrayMap(parent -> indexOf(spanIDs, parent), parentIDs) AS parents,"+
+			" NOT has(parentIDs, '') AS missingRoot,"+
+			" arrayExists((parent, index) -> parent != '' AND index = 0, parentIDs, parents) AS orphan,"+
+			" arrayExists((index, time) -> index > 0 AND time < timestamps[index], parents, timestamps) AS skewed"+
+			" FROM %s WHERE %s GROUP BY traceID)"+
+			" ARRAY JOIN services AS service"+
+			" GROUP BY service"+
+			" ORDER BY service",
+		s.callsTable,
+		condition,
+	)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	quality := make([]ServiceTraceQuality, 0)
+	for rows.Next() {
+		var service ServiceTraceQuality
+		if err := rows.Scan(
+			&service.Service,
+			&service.Traces,
+			&service.MissingRoot,
+			&service.Orphans,
+			&service.ClockSkew,
+			&service.Complete,
+		); err != nil {
+			return nil, err
+		}
+		quality = append(quality, service)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return quality, nil
+}
+
+// QualityHandler serves numbers of traces with problems and completeness scores of services over HTTP.
+// Like ServeHTTP, it accepts endTs and lookback query parameters in milliseconds.
+func (s *DependencyStore) QualityHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, endTs, lookback, ok := s.parseRequest(w, r)
+		if !ok {
+			return
+		}
+		quality, err := s.GetTraceQuality(ctx, endTs, lookback)
+		if err == errNotImplemented {
+			http.Error(w, "trace quality checks are not enabled", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		payload := qualityPayload{Services: make([]qualityService, 0, len(quality))}
+		for _, service := range quality {
+			payload.Services = append(payload.Services, qualityService{ServiceTraceQuality: service, Completeness: service.Completeness()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(payload)
+	})
+}
@@ -0,0 +1,94 @@
+package clickhousedependencystore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func getTraceQualityQuery(condition string) string {
+	return "SELECT service, count(), countIf(missingRoot), countIf(orphan), countIf(skewed)," +
+		" countIf(NOT missingRoot AND NOT orphan AND NOT skewed)" +
+		" FROM (SELECT groupUniqArray(service) AS services, groupArray(spanID) AS spanIDs," +
+		" groupArray(parentSpanID) AS parentIDs, groupArray(timestamp) AS timestamps," +
+		" arrayMap(parent -> indexOf(spanIDs, parent), parentIDs) AS parents," +
+		" NOT has(parentIDs, '') AS missingRoot," +
+		" arrayExists((parent, index) -> parent != '' AND index = 0, parentIDs, parents) AS orphan," +
+		" arrayExists((index, time) -> index > 0 AND time < timestamps[index], parents, timestamps) AS skewed" +
+		" FROM jaeger_calls_local WHERE " + condition + " GROUP BY traceID)" +
+		" ARRAY JOIN services AS service" +
+		" GROUP BY service" +
+		" ORDER BY service"
+}
+
+func getTraceQualityRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"service", "count()", "missingRoot", "orphan", "skewed", "complete"}).
+		AddRow("customer", uint64(10), uint64(0), uint64(1), uint64(0), uint64(9)).
+		AddRow("frontend", uint64(20), uint64(2), uint64(1), uint64(3), uint64(15))
+}
+
+func TestDependencyStore_GetTraceQuality(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Now()
+	start := endTs.Add(-time.Hour)
+	tenant := "tenant_1"
+	mock.ExpectQuery(getTraceQualityQuery("timestamp >= ? AND timestamp <= ? AND tenant = ?")).
+		WithArgs(start, endTs, tenant).
+		WillReturnRows(getTraceQualityRows())
+
+	dependencyStore := NewCallsDependencyStore(db, testCallsTable, WithTenantHeader("x-tenant"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", tenant))
+	quality, err := dependencyStore.GetTraceQuality(ctx, endTs, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []ServiceTraceQuality{
+		{Service: "customer", Traces: 10, Orphans: 1, Complete: 9},
+		{Service: "frontend", Traces: 20, MissingRoot: 2, Orphans: 1, ClockSkew: 3, Complete: 15},
+	}, quality)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewDependencyStore().GetTraceQuality(context.Background(), endTs, time.Hour)
+	assert.Equal(t, errNotImplemented, err)
+}
+
+func TestServiceTraceQuality_Completeness(t *testing.T) {
+	assert.Equal(t, 0.75, ServiceTraceQuality{Traces: 20, Complete: 15}.Completeness())
+	assert.Equal(t, 1.0, ServiceTraceQuality{}.Completeness())
+}
+
+func TestDependencyStore_QualityHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	endTs := time.Unix(1628000000, 0)
+	mock.ExpectQuery(getTraceQualityQuery("timestamp >= ? AND timestamp <= ?")).
+		WithArgs(endTs.Add(-time.Hour), endTs).
+		WillReturnRows(getTraceQualityRows())
+
+	recorder := httptest.NewRecorder()
+	NewCallsDependencyStore(db, testCallsTable).QualityHandler().
+		ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/trace-quality?endTs=1628000000000&lookback=3600000", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"services": [
+		{"service": "customer", "traces": 10, "missingRoot": 0, "orphans": 1, "clockSkew": 0, "complete": 9, "completeness": 0.9},
+		{"service": "frontend", "traces": 20, "missingRoot": 2, "orphans": 1, "clockSkew": 3, "complete": 15, "completeness": 0.75}
+	]}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	recorder = httptest.NewRecorder()
+	NewDependencyStore().QualityHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
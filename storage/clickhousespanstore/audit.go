@@ -0,0 +1,219 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	auditGetTrace   = "GetTrace"
+	auditFindTraces = "FindTraces"
+
+	// maxAuditRecords bounds memory used by records not written yet, e.g. while ClickHouse is unavailable
+	maxAuditRecords = 10000
+)
+
+var numDroppedAuditRecords = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_dropped_audit_records_total",
+	Help: "Number of records of reads of traces dropped because too many records could not be written to the audit table",
+})
+
+// AuditLog records sampled reads of traces with the user of the request, the query and IDs of returned traces
+// into the audit table. Records are written in the background every interval, records of reads are dropped
+// while maxAuditRecords records are waiting to be written.
+type AuditLog struct {
+	logger       hclog.Logger
+	db           *sql.DB
+	table        TableName
+	userHeader   string
+	tenantHeader string
+	sampleRate   uint64
+	interval     time.Duration
+	reads        uint64
+
+	mutex   sync.Mutex
+	records []auditRecord
+	finish  chan bool
+	done    sync.WaitGroup
+}
+
+type auditRecord struct {
+	timestamp time.Time
+	tenant    string
+	user      string
+	operation string
+	params    string
+	traceIDs  []string
+}
+
+// NewAuditLog returns an AuditLog recording every sampleRate-th read with the user from the gRPC metadata key
+// userHeader. The tenant is recorded from the tenantHeader metadata key, unless it is empty.
+func NewAuditLog(
+	logger hclog.Logger,
+	db *sql.DB,
+	table TableName,
+	userHeader, tenantHeader string,
+	sampleRate int,
+	interval time.Duration,
+) *AuditLog {
+	return &AuditLog{
+		logger:       logger,
+		db:           db,
+		table:        table,
+		userHeader:   userHeader,
+		tenantHeader: tenantHeader,
+		sampleRate:   uint64(sampleRate),
+		interval:     interval,
+		finish:       make(chan bool),
+	}
+}
+
+// WithAuditLog records reads of traces by GetTrace and FindTraces into the audit log
+func WithAuditLog(audit *AuditLog) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.audit = audit
+	}
+}
+
+// Start writes records every interval in the background until the audit log is closed
+func (a *AuditLog) Start() {
+	a.done.Add(1)
+	go func() {
+		defer a.done.Done()
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.finish:
+				return
+			case <-ticker.C:
+				if err := a.Flush(); err != nil {
+					a.logger.Error("Could not write the audit log", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops writing in the background and writes the remaining records
+func (a *AuditLog) Close() {
+	close(a.finish)
+	a.done.Wait()
+	if err := a.Flush(); err != nil {
+		a.logger.Error("Could not write the audit log", "error", err)
+	}
+}
+
+// record remembers the read for writing, if it is sampled. Params are recorded as JSON.
+func (a *AuditLog) record(ctx context.Context, operation string, params interface{}, traces []*model.Trace) {
+	if a == nil || atomic.AddUint64(&a.reads, 1)%a.sampleRate != 0 {
+		return
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		encoded = []byte(fmt.Sprintf("%q", err.Error()))
+	}
+	record := auditRecord{
+		timestamp: time.Now(),
+		user:      TenantFromContext(ctx, a.userHeader),
+		operation: operation,
+		params:    string(encoded),
+		traceIDs:  make([]string, 0, len(traces)),
+	}
+	if a.tenantHeader != "" {
+		record.tenant = TenantFromContext(ctx, a.tenantHeader)
+	}
+	for _, trace := range traces {
+		if len(trace.Spans) > 0 {
+			record.traceIDs = append(record.traceIDs, trace.Spans[0].TraceID.String())
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.records) >= maxAuditRecords {
+		numDroppedAuditRecords.Inc()
+		return
+	}
+	a.records = append(a.records, record)
+}
+
+// Flush writes the recorded reads, records that could not be written are written by the next call
+func (a *AuditLog) Flush() error {
+	a.mutex.Lock()
+	records := a.records
+	a.records = nil
+	a.mutex.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := a.write(records); err != nil {
+		a.mutex.Lock()
+		a.records = append(records, a.records...)
+		if dropped := len(a.records) - maxAuditRecords; dropped > 0 {
+			numDroppedAuditRecords.Add(float64(dropped))
+			a.records = a.records[:maxAuditRecords]
+		}
+		a.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (a *AuditLog) write(records []auditRecord) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{"timestamp", "user", "operation", "params", "traceIDs"}
+	if a.tenantHeader != "" {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		a.table,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, record := range records {
+		args := []interface{}{record.timestamp, record.user, record.operation, record.params, record.traceIDs}
+		if a.tenantHeader != "" {
+			args = append([]interface{}{record.tenant}, args...)
+		}
+		if _, err = statement.Exec(args...); err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	return tx.Commit()
+}
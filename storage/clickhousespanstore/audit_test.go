@@ -0,0 +1,87 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testAuditTable TableName = "test_audit_table"
+
+func TestAuditLog_GetTrace(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	audit := NewAuditLog(mocks.NewSpyLogger(), db, testAuditTable, "x-user", "x-tenant", 1, time.Hour)
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithAuditLog(audit))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user", "alice", "x-tenant", "tenant_1"))
+
+	span := testSpan
+	spanJSON, err := json.Marshal(&span)
+	require.NoError(t, err)
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(span.TraceID.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+	_, err = reader.GetTrace(ctx, span.TraceID)
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (tenant, timestamp, user, operation, params, traceIDs) VALUES (?, ?, ?, ?, ?, ?)", testAuditTable)).
+		ExpectExec().
+		WithArgs(
+			"tenant_1", sqlmock.AnyArg(), "alice", auditGetTrace,
+			fmt.Sprintf(`{"traceID":%q}`, span.TraceID.String()), []string{span.TraceID.String()},
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	require.NoError(t, audit.Flush())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditLog_record(t *testing.T) {
+	audit := NewAuditLog(mocks.NewSpyLogger(), nil, testAuditTable, "x-user", "", 2, time.Hour)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user", "bob"))
+	traces := []*model.Trace{
+		{Spans: []*model.Span{{TraceID: model.NewTraceID(0, 1)}}},
+		{Spans: []*model.Span{{TraceID: model.NewTraceID(0, 2)}}},
+	}
+	for i := 0; i < 4; i++ {
+		audit.record(ctx, auditFindTraces, map[string]string{"ServiceName": "frontend"}, traces)
+	}
+
+	require.Len(t, audit.records, 2, "every second read is recorded")
+	record := audit.records[0]
+	assert.Equal(t, "bob", record.user)
+	assert.Empty(t, record.tenant)
+	assert.Equal(t, auditFindTraces, record.operation)
+	assert.Equal(t, `{"ServiceName":"frontend"}`, record.params)
+	assert.Equal(t, []string{"0000000000000001", "0000000000000002"}, record.traceIDs)
+
+	var disabled *AuditLog
+	assert.NotPanics(t, func() { disabled.record(ctx, auditFindTraces, nil, traces) })
+}
+
+func TestAuditLog_FlushError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	audit := NewAuditLog(mocks.NewSpyLogger(), db, testAuditTable, "x-user", "", 1, time.Hour)
+	audit.record(context.Background(), auditGetTrace, nil, nil)
+
+	mock.ExpectBegin().WillReturnError(errorMock)
+	assert.ErrorIs(t, audit.Flush(), errorMock)
+	assert.Len(t, audit.records, 1, "records are written by the next flush")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,235 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxAutoArchivedTraces is the number of recently archived traces remembered, so that they are copied once
+	maxAutoArchivedTraces = 100_000
+	// maxAutoArchiveBatch is the maximal number of traces copied by one query
+	maxAutoArchiveBatch = 1000
+)
+
+var numAutoArchivedTraces = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_auto_archived_traces_total",
+	Help: "Number of traces copied to the archive table by auto archive rules",
+})
+
+// ArchiveRule matches spans by all of its set criteria
+type ArchiveRule struct {
+	// MinDuration matches spans lasting at least as long, if not zero
+	MinDuration time.Duration
+	// Error matches spans tagged as failed by the error tag, if true
+	Error bool
+	// Tags match spans having all the tags with the values, span tags take precedence over process tags
+	Tags map[string]string
+}
+
+func (r ArchiveRule) matches(span *model.Span) bool {
+	if r.MinDuration > 0 && span.Duration < r.MinDuration {
+		return false
+	}
+	if r.Error && !hasError(span) {
+		return false
+	}
+	for key, value := range r.Tags {
+		kv, ok := model.KeyValues(span.Tags).FindByKey(key)
+		if !ok && span.Process != nil {
+			kv, ok = model.KeyValues(span.Process.Tags).FindByKey(key)
+		}
+		if !ok || kv.AsString() != value {
+			return false
+		}
+	}
+	return true
+}
+
+// AutoArchiver copies traces having a span matching any of its rules from the spans table to the archive table,
+// so that they outlive TTL of the spans table without archiving them from Jaeger UI. Whole traces are copied
+// between one and two delays after their first matching span is written, other spans of the trace written
+// after that are not archived.
+type AutoArchiver struct {
+	logger       hclog.Logger
+	db           *sql.DB
+	spansTable   TableName
+	archiveTable TableName
+	rules        []ArchiveRule
+	delay        time.Duration
+	// Whether the tenant and priority columns are copied
+	multiTenant      bool
+	samplingPriority bool
+
+	mutex sync.Mutex
+	// pending traces are copied on the tick after the next one, waiting ones on the next tick
+	pending  map[model.TraceID]bool
+	waiting  map[model.TraceID]bool
+	archived cache.Cache
+	finish   chan bool
+	done     sync.WaitGroup
+}
+
+// AutoArchiverOption configures optional behaviour of AutoArchiver
+type AutoArchiverOption func(archiver *AutoArchiver)
+
+// WithAutoArchiverMultiTenant copies the tenant column of spans
+func WithAutoArchiverMultiTenant() AutoArchiverOption {
+	return func(archiver *AutoArchiver) {
+		archiver.multiTenant = true
+	}
+}
+
+// WithAutoArchiverSamplingPriority copies the priority column of spans
+func WithAutoArchiverSamplingPriority() AutoArchiverOption {
+	return func(archiver *AutoArchiver) {
+		archiver.samplingPriority = true
+	}
+}
+
+// NewAutoArchiver returns an AutoArchiver copying traces from the spans table to the archive table. Only columns
+// of the archive table are copied, the spans table may have more, e.g. columns of the index written from spans.
+func NewAutoArchiver(
+	logger hclog.Logger,
+	db *sql.DB,
+	spansTable,
+	archiveTable TableName,
+	rules []ArchiveRule,
+	delay time.Duration,
+	opts ...AutoArchiverOption,
+) *AutoArchiver {
+	archiver := &AutoArchiver{
+		logger:       logger,
+		db:           db,
+		spansTable:   spansTable,
+		archiveTable: archiveTable,
+		rules:        rules,
+		delay:        delay,
+		pending:      make(map[model.TraceID]bool),
+		waiting:      make(map[model.TraceID]bool),
+		archived:     cache.NewLRU(maxAutoArchivedTraces),
+		finish:       make(chan bool),
+	}
+	for _, opt := range opts {
+		opt(archiver)
+	}
+	return archiver
+}
+
+// WithAutoArchiver archives traces of written spans matching rules of the archiver
+func WithAutoArchiver(archiver *AutoArchiver) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.autoArchiver = archiver
+	}
+}
+
+// Start copies traces every delay in the background until the archiver is closed
+func (a *AutoArchiver) Start() {
+	a.done.Add(1)
+	go func() {
+		defer a.done.Done()
+		ticker := time.NewTicker(a.delay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.finish:
+				return
+			case <-ticker.C:
+				if err := a.Archive(); err != nil {
+					a.logger.Error("Could not archive traces", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops copying traces, traces not copied yet are not archived
+func (a *AutoArchiver) Close() {
+	close(a.finish)
+	a.done.Wait()
+}
+
+// observe remembers the trace of the span for archiving, if the span matches any rule
+func (a *AutoArchiver) observe(span *model.Span) {
+	if a == nil {
+		return
+	}
+	matches := false
+	for _, rule := range a.rules {
+		if rule.matches(span) {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.pending[span.TraceID] || a.waiting[span.TraceID] || a.archived.Get(span.TraceID.String()) != nil {
+		return
+	}
+	a.pending[span.TraceID] = true
+}
+
+// Archive copies traces that have waited for at least the delay, so that their other spans were written meanwhile.
+// Traces that could not be copied are copied on the next call.
+func (a *AutoArchiver) Archive() error {
+	a.mutex.Lock()
+	due := make([]model.TraceID, 0, len(a.waiting))
+	for traceID := range a.waiting {
+		due = append(due, traceID)
+	}
+	a.waiting, a.pending = a.pending, make(map[model.TraceID]bool)
+	a.mutex.Unlock()
+
+	for start := 0; start < len(due); start += maxAutoArchiveBatch {
+		end := start + maxAutoArchiveBatch
+		if end > len(due) {
+			end = len(due)
+		}
+		if err := a.copyTraces(due[start:end]); err != nil {
+			a.mutex.Lock()
+			for _, traceID := range due[start:] {
+				a.waiting[traceID] = true
+			}
+			a.mutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AutoArchiver) copyTraces(traceIDs []model.TraceID) error {
+	args := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		args[i] = traceID.String()
+	}
+	columns := strings.Join(archivedColumns(a.multiTenant, a.samplingPriority), ", ")
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM %s WHERE traceID IN (%s)",
+		a.archiveTable,
+		columns,
+		columns,
+		a.spansTable,
+		"?"+strings.Repeat(",?", len(args)-1),
+	)
+	if _, err := a.db.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, traceID := range traceIDs {
+		a.archived.Put(traceID.String(), true)
+	}
+	numAutoArchivedTraces.Add(float64(len(traceIDs)))
+	return nil
+}
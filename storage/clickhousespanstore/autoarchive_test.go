@@ -0,0 +1,91 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testArchiveTable = "test_archive_table"
+
+func TestArchiveRule_matches(t *testing.T) {
+	span := &model.Span{
+		Duration: 2 * time.Second,
+		Tags:     []model.KeyValue{model.Bool("error", true), model.Int64("http.status_code", 500)},
+		Process:  &model.Process{ServiceName: "cart", Tags: []model.KeyValue{model.String("region", "eu")}},
+	}
+	tests := map[string]struct {
+		rule     ArchiveRule
+		expected bool
+	}{
+		"long":                   {rule: ArchiveRule{MinDuration: time.Second}, expected: true},
+		"too short":              {rule: ArchiveRule{MinDuration: time.Minute}},
+		"error":                  {rule: ArchiveRule{Error: true}, expected: true},
+		"tags":                   {rule: ArchiveRule{Tags: map[string]string{"http.status_code": "500", "region": "eu"}}, expected: true},
+		"other tag value":        {rule: ArchiveRule{Tags: map[string]string{"region": "us"}}},
+		"all criteria":           {rule: ArchiveRule{MinDuration: time.Second, Error: true, Tags: map[string]string{"region": "eu"}}, expected: true},
+		"one criterion mismatch": {rule: ArchiveRule{MinDuration: time.Minute, Error: true}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.rule.matches(span))
+		})
+	}
+}
+
+func TestAutoArchiver_Archive(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	archiver := NewAutoArchiver(mocks.NewSpyLogger(), db, testSpansTable, testArchiveTable, []ArchiveRule{{Error: true}}, time.Minute)
+	failed := &model.Span{TraceID: model.TraceID{Low: 1}, Tags: []model.KeyValue{model.Bool("error", true)}}
+	succeeded := &model.Span{TraceID: model.TraceID{Low: 2}}
+	query := "INSERT INTO test_archive_table (timestamp, traceID, model) SELECT timestamp, traceID, model FROM test_spans_table WHERE traceID IN (?)"
+
+	archiver.observe(failed)
+	archiver.observe(failed)
+	archiver.observe(succeeded)
+	require.NoError(t, archiver.Archive(), "traces wait for the next archiving")
+
+	mock.ExpectExec(query).WithArgs(failed.TraceID.String()).WillReturnError(errorMock)
+	assert.ErrorIs(t, archiver.Archive(), errorMock)
+
+	mock.ExpectExec(query).WithArgs(failed.TraceID.String()).WillReturnResult(sqlmock.NewResult(0, 3))
+	require.NoError(t, archiver.Archive(), "traces that could not be copied are copied again")
+
+	archiver.observe(failed)
+	require.NoError(t, archiver.Archive())
+	require.NoError(t, archiver.Archive(), "archived traces are not copied again")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var disabled *AutoArchiver
+	disabled.observe(failed)
+}
+
+func TestAutoArchiver_ArchiveColumns(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	archiver := NewAutoArchiver(mocks.NewSpyLogger(), db, testSpansTable, testArchiveTable, []ArchiveRule{{Error: true}}, time.Minute,
+		WithAutoArchiverMultiTenant(), WithAutoArchiverSamplingPriority())
+	span := &model.Span{TraceID: model.TraceID{Low: 1}, Tags: []model.KeyValue{model.Bool("error", true)}}
+	archiver.observe(span)
+	require.NoError(t, archiver.Archive())
+
+	// Columns of the index written from spans are not copied
+	mock.ExpectExec("INSERT INTO test_archive_table (tenant, timestamp, traceID, model, priority)" +
+		" SELECT tenant, timestamp, traceID, model, priority FROM test_spans_table WHERE traceID IN (?)").
+		WithArgs(span.TraceID.String()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, archiver.Archive())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
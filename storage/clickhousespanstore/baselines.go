@@ -0,0 +1,101 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// slowerThanTag is a search tag finding spans slower than a percentile of durations of their operations,
+// when duration baselines are aggregated, e.g. jaeger.slower_than=p99
+const slowerThanTag = "jaeger.slower_than"
+
+// baselinePercentiles are indexes of percentiles in the array of quantiles aggregated by the baselines table
+var baselinePercentiles = map[string]int{
+	"p50": 1,
+	"p90": 2,
+	"p95": 3,
+	"p99": 4,
+}
+
+var errInvalidPercentile = errors.New("percentile search tag must be one of p50, p90, p95 or p99")
+
+// WithDurationBaselines finds spans slower than a percentile of their operations by the jaeger.slower_than search tag,
+// percentiles are merged from daily quantiles of durations in the table within the window before the searched range
+func WithDurationBaselines(table TableName, window time.Duration) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.baselinesTable = table
+		reader.baselinesWindow = window
+	}
+}
+
+// isBaselineTag tells whether the search tag is served by the duration baselines
+func (r *TraceReader) isBaselineTag(key string) bool {
+	return key == slowerThanTag && r.baselinesTable != ""
+}
+
+// baselineCondition restricts spans to ones slower than the requested percentile of their operation.
+// Operations without a baseline have no slower spans.
+func (r *TraceReader) baselineCondition(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	end time.Time,
+) (string, []interface{}, error) {
+	value, ok := params.Tags[slowerThanTag]
+	if !ok || r.baselinesTable == "" {
+		return "", nil, nil
+	}
+	percentile, ok := baselinePercentiles[strings.ToLower(strings.TrimSpace(value))]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s=%q", errInvalidPercentile, slowerThanTag, value)
+	}
+
+	query := fmt.Sprintf("SELECT operation, quantilesTDigestMerge(0.5, 0.9, 0.95, 0.99)(durations)[?] FROM %s WHERE", r.baselinesTable)
+	args := []interface{}{percentile}
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	serviceCondition, serviceArgs := r.serviceCondition(params.ServiceName)
+	query += " " + serviceCondition
+	args = append(args, serviceArgs...)
+	if params.OperationName != "" {
+		query += " AND operation = ?"
+		args = append(args, params.OperationName)
+	}
+	query += " AND date >= toDate(?) AND date <= toDate(?) GROUP BY operation"
+	args = append(args, end.Add(-r.baselinesWindow), end)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var (
+		conditions    []string
+		conditionArgs []interface{}
+	)
+	for rows.Next() {
+		var (
+			operation string
+			threshold float64
+		)
+		if err := rows.Scan(&operation, &threshold); err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "operation = ? AND durationUs > ?")
+		conditionArgs = append(conditionArgs, operation, threshold)
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	if len(conditions) == 0 {
+		return " AND 0", nil, nil
+	}
+	return " AND (" + strings.Join(conditions, " OR ") + ")", conditionArgs, nil
+}
@@ -0,0 +1,80 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testBaselinesTable TableName = "jaeger_operation_durations_local"
+
+func TestTraceReader_baselineCondition(t *testing.T) {
+	end := time.Date(2021, 8, 8, 12, 0, 0, 0, time.UTC)
+	query := fmt.Sprintf(
+		"SELECT operation, quantilesTDigestMerge(0.5, 0.9, 0.95, 0.99)(durations)[?] FROM %s WHERE service = ? AND date >= toDate(?) AND date <= toDate(?) GROUP BY operation",
+		testBaselinesTable,
+	)
+
+	t.Run("operations slower than percentile", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		mock.ExpectQuery(query).
+			WithArgs(4, "frontend", end.Add(-7*24*time.Hour), end).
+			WillReturnRows(sqlmock.NewRows([]string{"operation", "threshold"}).AddRow("GET /", 1500.5).AddRow("POST /cart", 20000.0))
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithDurationBaselines(testBaselinesTable, 7*24*time.Hour))
+		params := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{slowerThanTag: "p99"}}
+		condition, args, err := reader.baselineCondition(context.Background(), params, end)
+		require.NoError(t, err)
+		assert.Equal(t, " AND (operation = ? AND durationUs > ? OR operation = ? AND durationUs > ?)", condition)
+		assert.Equal(t, []interface{}{"GET /", 1500.5, "POST /cart", 20000.0}, args)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no baselines", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		mock.ExpectQuery(query).
+			WithArgs(1, "frontend", end.Add(-time.Hour), end).
+			WillReturnRows(sqlmock.NewRows([]string{"operation", "threshold"}))
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithDurationBaselines(testBaselinesTable, time.Hour))
+		params := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{slowerThanTag: "P50"}}
+		condition, args, err := reader.baselineCondition(context.Background(), params, end)
+		require.NoError(t, err)
+		assert.Equal(t, " AND 0", condition, "operations without baselines have no slower spans")
+		assert.Empty(t, args)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid percentile", func(t *testing.T) {
+		reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable, WithDurationBaselines(testBaselinesTable, time.Hour))
+		params := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{slowerThanTag: "p42"}}
+		_, _, err := reader.baselineCondition(context.Background(), params, end)
+		assert.True(t, errors.Is(err, errInvalidPercentile))
+		assert.EqualError(t, err, errInvalidPercentile.Error()+`: jaeger.slower_than="p42"`)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+		params := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{slowerThanTag: "p99"}}
+		condition, args, err := reader.baselineCondition(context.Background(), params, end)
+		require.NoError(t, err)
+		assert.Empty(t, condition)
+		assert.Empty(t, args)
+		assert.False(t, reader.isBaselineTag(slowerThanTag), "the tag is matched as a normal tag")
+	})
+}
@@ -0,0 +1,107 @@
+package clickhousespanstore
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// defaultIndexOrderBy is the sort key of the index table created by the embedded scripts, without the tenant
+var defaultIndexOrderBy = []string{"service", "-toUnixTimestamp(timestamp)"}
+
+// spanComparison compares two spans by an expression of the index sort key, negative if a goes first
+type spanComparison func(a, b *model.Span) int
+
+// spanComparisons are comparisons of spans by expressions of the index sort key without spaces
+var spanComparisons = map[string]spanComparison{
+	"service":                    compareServices,
+	"operation":                  compareOperations,
+	"traceID":                    compareTraceIDs,
+	"timestamp":                  compareTimestamps,
+	"toUnixTimestamp(timestamp)": compareTimestamps,
+	"durationUs":                 compareDurations,
+}
+
+// batchOrder returns comparisons of spans by the longest prefix of the index sort key that can be computed from spans.
+// The tenant is skipped, as batches are per tenant, expressions after one that cannot be computed are left unsorted.
+func batchOrder(orderBy []string) []spanComparison {
+	if len(orderBy) == 0 {
+		orderBy = defaultIndexOrderBy
+	}
+	var order []spanComparison
+	for _, expression := range orderBy {
+		expression = strings.ReplaceAll(expression, " ", "")
+		if expression == "tenant" {
+			continue
+		}
+		descending := strings.HasPrefix(expression, "-")
+		compare, ok := spanComparisons[strings.TrimPrefix(expression, "-")]
+		if !ok {
+			break
+		}
+		if descending {
+			ascending := compare
+			compare = func(a, b *model.Span) int { return ascending(b, a) }
+		}
+		order = append(order, compare)
+	}
+	return order
+}
+
+// sortBatch sorts spans of the batch in the order, spans equal by all comparisons keep their order
+func sortBatch(batch []*model.Span, order []spanComparison) {
+	sort.SliceStable(batch, func(i, j int) bool {
+		for _, compare := range order {
+			if result := compare(batch[i], batch[j]); result != 0 {
+				return result < 0
+			}
+		}
+		return false
+	})
+}
+
+func compareServices(a, b *model.Span) int {
+	return strings.Compare(a.Process.ServiceName, b.Process.ServiceName)
+}
+
+func compareOperations(a, b *model.Span) int {
+	return strings.Compare(a.OperationName, b.OperationName)
+}
+
+// compareTimestamps compares start times of spans in seconds, the precision of timestamps of the index
+func compareTimestamps(a, b *model.Span) int {
+	return compareInts(a.StartTime.Unix(), b.StartTime.Unix())
+}
+
+// compareDurations compares durations of spans in microseconds, the precision of durations of the index
+func compareDurations(a, b *model.Span) int {
+	return compareInts(a.Duration.Microseconds(), b.Duration.Microseconds())
+}
+
+func compareTraceIDs(a, b *model.Span) int {
+	if a.TraceID.High != b.TraceID.High {
+		return compareUints(a.TraceID.High, b.TraceID.High)
+	}
+	return compareUints(a.TraceID.Low, b.TraceID.Low)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
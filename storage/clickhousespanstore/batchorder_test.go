@@ -0,0 +1,49 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanWriter_sortBatch(t *testing.T) {
+	first := &model.Span{SpanID: 1, OperationName: "b", StartTime: testStartTime, Duration: time.Second,
+		Process: &model.Process{ServiceName: "b"}}
+	second := &model.Span{SpanID: 2, OperationName: "a", StartTime: testStartTime.Add(time.Second), Duration: time.Second,
+		Process: &model.Process{ServiceName: "a"}}
+	third := &model.Span{SpanID: 3, OperationName: "a", StartTime: testStartTime.Add(2 * time.Second),
+		Duration: time.Millisecond, Process: &model.Process{ServiceName: "b"}}
+	fourth := &model.Span{SpanID: 4, OperationName: "a", StartTime: testStartTime.Add(2*time.Second + time.Millisecond),
+		Duration: time.Second, Process: &model.Process{ServiceName: "b"}}
+
+	tests := map[string]struct {
+		orderBy  []string
+		expected []*model.Span
+	}{
+		"default": {
+			expected: []*model.Span{second, third, fourth, first},
+		},
+		"tenant and timestamp in seconds": {
+			orderBy:  []string{"tenant", "service", "- toUnixTimestamp(timestamp)", "-durationUs"},
+			expected: []*model.Span{second, fourth, third, first},
+		},
+		"operation": {
+			orderBy:  []string{"service", "operation", "timestamp"},
+			expected: []*model.Span{second, third, fourth, first},
+		},
+		"prefix of known expressions": {
+			orderBy:  []string{"operation", "cityHash64(traceID)", "service"},
+			expected: []*model.Span{second, third, fourth, first},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			batch := []*model.Span{first, second, third, fourth}
+			sortBatch(batch, batchOrder(test.orderBy))
+			assert.Equal(t, test.expected, batch)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package clickhousespanstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// binaryTraceIDLength is the length of trace IDs stored as FixedString(16), high and low parts in big endian
+const binaryTraceIDLength = 16
+
+// WithBinaryTraceIDs writes trace IDs to the traceID column of spans and index tables as 16 bytes
+// instead of hexadecimal strings, the column is FixedString(16)
+func WithBinaryTraceIDs() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.binaryTraceIDs = true
+	}
+}
+
+// WithReaderBinaryTraceIDs reads trace IDs stored as 16 bytes in the traceID column of spans and index tables
+func WithReaderBinaryTraceIDs() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.binaryTraceIDs = true
+	}
+}
+
+// encodeTraceID returns the value of the trace ID written to the traceID column
+func encodeTraceID(traceID model.TraceID, binaryTraceIDs bool) string {
+	if !binaryTraceIDs {
+		return traceID.String()
+	}
+	encoded := make([]byte, binaryTraceIDLength)
+	binary.BigEndian.PutUint64(encoded[:8], traceID.High)
+	binary.BigEndian.PutUint64(encoded[8:], traceID.Low)
+	return string(encoded)
+}
+
+// decodeTraceID parses the value read from the traceID column
+func decodeTraceID(value string, binaryTraceIDs bool) (model.TraceID, error) {
+	if !binaryTraceIDs {
+		return model.TraceIDFromString(value)
+	}
+	if len(value) != binaryTraceIDLength {
+		return model.TraceID{}, fmt.Errorf("binary trace ID must be %d bytes long, got %d", binaryTraceIDLength, len(value))
+	}
+	return model.NewTraceID(binary.BigEndian.Uint64([]byte(value[:8])), binary.BigEndian.Uint64([]byte(value[8:]))), nil
+}
+
+// traceIDCondition returns placeholders of the trace IDs compared with the traceID column and their arguments.
+// Binary trace IDs are passed as hexadecimal strings converted by ClickHouse, so that queries stay printable.
+func (r *TraceReader) traceIDCondition(traceIDs []model.TraceID) (string, []interface{}) {
+	placeholder := "?"
+	if r.binaryTraceIDs {
+		placeholder = "unhex(?)"
+	}
+	args := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		if r.binaryTraceIDs {
+			args[i] = fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+		} else {
+			args[i] = traceID.String()
+		}
+	}
+	return placeholder + strings.Repeat(","+placeholder, len(traceIDs)-1), args
+}
+
+// zeroHighPart matches the high part of a hexadecimal trace ID if it is zero
+const zeroHighPart = `^0{16}`
+
+// traceIDString is the expression of the traceID column in the format of model.TraceID.String,
+// which omits the high part if it is zero and keeps leading zeros of both parts otherwise
+func (r *TraceReader) traceIDString() string {
+	if r.binaryTraceIDs {
+		return fmt.Sprintf("replaceRegexpOne(lower(hex(traceID)), '%s', '')", zeroHighPart)
+	}
+	return "traceID"
+}
@@ -0,0 +1,84 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestBinaryTraceIDs_encode(t *testing.T) {
+	traceIDs := []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0x1a, 0xff00000000000002), model.NewTraceID(1<<63, 0)}
+	for _, traceID := range traceIDs {
+		encoded := encodeTraceID(traceID, true)
+		require.Len(t, encoded, binaryTraceIDLength)
+		decoded, err := decodeTraceID(encoded, true)
+		require.NoError(t, err)
+		assert.Equal(t, traceID, decoded)
+
+		decoded, err = decodeTraceID(encodeTraceID(traceID, false), false)
+		require.NoError(t, err)
+		assert.Equal(t, traceID, decoded)
+	}
+	assert.Equal(t, "\x00\x00\x00\x00\x00\x00\x00\x1a\xff\x00\x00\x00\x00\x00\x00\x02", encodeTraceID(traceIDs[1], true))
+
+	_, err := decodeTraceID("1", true)
+	assert.EqualError(t, err, "binary trace ID must be 16 bytes long, got 1")
+}
+
+func TestTraceReader_traceIDString(t *testing.T) {
+	// ClickHouse replaces the zero high part of the hexadecimal trace ID the same way as Go does
+	zeros := regexp.MustCompile(zeroHighPart)
+	traceIDs := []model.TraceID{
+		model.NewTraceID(0, 0),
+		model.NewTraceID(0, 1),
+		model.NewTraceID(0, 0x0abcdef012345678),
+		model.NewTraceID(0x1a, 2),
+		model.NewTraceID(0x0abcdef012345678, 0x0abcdef012345678),
+	}
+	for _, traceID := range traceIDs {
+		hex := fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+		assert.Equal(t, traceID.String(), zeros.ReplaceAllString(hex, ""))
+	}
+}
+
+func TestTraceReader_BinaryTraceIDs(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderBinaryTraceIDs())
+	span := testSpan
+	span.TraceID = model.NewTraceID(0x1a, 2)
+	spanJSON, err := json.Marshal(&span)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (unhex(?))", testSpansTable)).
+		WithArgs("000000000000001a0000000000000002").
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+	trace, err := reader.GetTrace(context.Background(), span.TraceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 1)
+	assert.Equal(t, span.TraceID, trace.Spans[0].TraceID)
+
+	start := time.Unix(1628000000, 0)
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT DISTINCT traceID FROM %s WHERE startsWith(replaceRegexpOne(lower(hex(traceID)), '^0{16}', ''), ?) AND timestamp >= ? LIMIT ?",
+		testSpansTable,
+	)).
+		WithArgs("000000000000001a", start, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID"}).AddRow(encodeTraceID(span.TraceID, true)))
+	found, err := reader.FindTraceIDsByPrefix(context.Background(), "000000000000001a", start, time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{span.TraceID}, found)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,220 @@
+package clickhousespanstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// bufferHealthInterval is how often metrics of unwritten spans are updated and alarms checked
+	bufferHealthInterval = 5 * time.Second
+	// defaultFailuresWindow is the window of counted flush failures when no alarm window is configured
+	defaultFailuresWindow = time.Minute
+
+	alarmSpanAge       = "span_age"
+	alarmFlushFailures = "flush_failures"
+	alarmBytes         = "unwritten_bytes"
+)
+
+var (
+	oldestUnwrittenSpanAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_oldest_unwritten_span_age_seconds",
+		Help: "Age of the oldest span accepted by the writer and not written yet, by the table the writer writes spans to",
+	}, []string{"table"})
+	unwrittenSpanBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_unwritten_span_bytes",
+		Help: "Estimated serialized size of spans accepted by the writer and not written yet, lost if the plugin crashes, by the table the writer writes spans to",
+	}, []string{"table"})
+	numFlushFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_flush_failures_total",
+		Help: "Number of failed writes of batches of spans, by the table the writer writes spans to",
+	}, []string{"table"})
+	recentFlushFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_recent_flush_failures",
+		Help: "Number of failed writes of batches of spans within the alarm window, by the table the writer writes spans to",
+	}, []string{"table"})
+)
+
+// BufferAlarms are thresholds of spans kept in memory by the writer, crossing them is logged as a warning before
+// spans are silently lost, e.g. when ClickHouse rejects inserts for long. Zero thresholds are disabled.
+type BufferAlarms struct {
+	// Window of counted flush failures, default 1m
+	Window time.Duration
+	// Maximal age of the oldest span not written yet
+	MaxSpanAge time.Duration
+	// Maximal number of failed writes of batches within the window
+	MaxFlushFailures int
+	// Maximal estimated size of spans not written yet in bytes
+	MaxUnwrittenBytes int64
+}
+
+// WithBufferAlarms logs warnings when spans kept in memory by the writer cross the thresholds
+func WithBufferAlarms(alarms BufferAlarms) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.alarms = alarms
+	}
+}
+
+// pendingBatch is a batch of spans of a tenant from when its first span is batched until it is written or dropped
+type pendingBatch struct {
+	oldest time.Time
+	bytes  int64
+}
+
+// bufferHealth tracks spans accepted by the writer and not written yet: queued for the batch, batched and retried
+// by workers. Spans in the queue are tracked by their size only, their age is estimated by the last batched span.
+type bufferHealth struct {
+	logger hclog.Logger
+	alarms BufferAlarms
+
+	age       prometheus.Gauge
+	bytes     prometheus.Gauge
+	failures  prometheus.Counter
+	recent    prometheus.Gauge
+	queued    int64
+	queuedAt  int64
+	mutex     sync.Mutex
+	pending   map[*pendingBatch]struct{}
+	failedAt  []time.Time
+	triggered map[string]bool
+	finish    chan bool
+	done      sync.WaitGroup
+}
+
+func newBufferHealth(logger hclog.Logger, table TableName, alarms BufferAlarms) *bufferHealth {
+	if alarms.Window <= 0 {
+		alarms.Window = defaultFailuresWindow
+	}
+	return &bufferHealth{
+		logger:    logger,
+		alarms:    alarms,
+		age:       oldestUnwrittenSpanAge.WithLabelValues(string(table)),
+		bytes:     unwrittenSpanBytes.WithLabelValues(string(table)),
+		failures:  numFlushFailures.WithLabelValues(string(table)),
+		recent:    recentFlushFailures.WithLabelValues(string(table)),
+		queuedAt:  time.Now().UnixNano(),
+		pending:   make(map[*pendingBatch]struct{}),
+		triggered: make(map[string]bool),
+		finish:    make(chan bool),
+	}
+}
+
+// start updates metrics and checks alarms every bufferHealthInterval until the health is closed
+func (h *bufferHealth) start() {
+	h.done.Add(1)
+	go func() {
+		defer h.done.Done()
+		ticker := time.NewTicker(bufferHealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.finish:
+				return
+			case now := <-ticker.C:
+				h.report(now)
+			}
+		}
+	}()
+}
+
+func (h *bufferHealth) close() {
+	close(h.finish)
+	h.done.Wait()
+}
+
+// queue tracks a span accepted by the writer until it is batched
+func (h *bufferHealth) queue(bytes int64) {
+	if h == nil {
+		return
+	}
+	atomic.AddInt64(&h.queued, bytes)
+}
+
+// batch moves a queued span accepted at the time to the pending batch, a new batch is returned if it is nil
+func (h *bufferHealth) batch(pending *pendingBatch, accepted time.Time, bytes int64) *pendingBatch {
+	if h == nil {
+		return nil
+	}
+	atomic.AddInt64(&h.queued, -bytes)
+	atomic.StoreInt64(&h.queuedAt, accepted.UnixNano())
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if pending == nil {
+		pending = &pendingBatch{oldest: accepted}
+		h.pending[pending] = struct{}{}
+	}
+	pending.bytes += bytes
+	return pending
+}
+
+// release stops tracking the batch after it is written or dropped
+func (h *bufferHealth) release(pending *pendingBatch) {
+	if h == nil || pending == nil {
+		return
+	}
+	h.mutex.Lock()
+	delete(h.pending, pending)
+	h.mutex.Unlock()
+}
+
+// failed counts a failed write of a batch
+func (h *bufferHealth) failed(now time.Time) {
+	if h == nil {
+		return
+	}
+	h.failures.Inc()
+	h.mutex.Lock()
+	h.failedAt = append(h.failedAt, now)
+	h.mutex.Unlock()
+}
+
+// report updates metrics of unwritten spans and logs alarms whose thresholds are crossed or no longer crossed
+func (h *bufferHealth) report(now time.Time) {
+	queued := atomic.LoadInt64(&h.queued)
+	bytes := queued
+	oldest := now
+	if queued > 0 {
+		oldest = time.Unix(0, atomic.LoadInt64(&h.queuedAt))
+	}
+
+	h.mutex.Lock()
+	for pending := range h.pending {
+		bytes += pending.bytes
+		if pending.oldest.Before(oldest) {
+			oldest = pending.oldest
+		}
+	}
+	start := 0
+	for start < len(h.failedAt) && now.Sub(h.failedAt[start]) > h.alarms.Window {
+		start++
+	}
+	h.failedAt = h.failedAt[start:]
+	failures := len(h.failedAt)
+	h.mutex.Unlock()
+
+	age := now.Sub(oldest)
+	h.age.Set(age.Seconds())
+	h.bytes.Set(float64(bytes))
+	h.recent.Set(float64(failures))
+
+	h.alarm(alarmSpanAge, h.alarms.MaxSpanAge > 0 && age > h.alarms.MaxSpanAge, "age", age)
+	h.alarm(alarmFlushFailures, h.alarms.MaxFlushFailures > 0 && failures > h.alarms.MaxFlushFailures, "failures", failures)
+	h.alarm(alarmBytes, h.alarms.MaxUnwrittenBytes > 0 && bytes > h.alarms.MaxUnwrittenBytes, "bytes", bytes)
+}
+
+// alarm logs the alarm once when its threshold is crossed and once when it is not crossed anymore
+func (h *bufferHealth) alarm(name string, crossed bool, key string, value interface{}) {
+	if crossed == h.triggered[name] {
+		return
+	}
+	h.triggered[name] = crossed
+	if crossed {
+		h.logger.Warn("Spans kept in memory by the writer crossed the alarm threshold, they are lost if the plugin crashes", "alarm", name, key, value)
+	} else {
+		h.logger.Info("Spans kept in memory by the writer are below the alarm threshold again", "alarm", name, key, value)
+	}
+}
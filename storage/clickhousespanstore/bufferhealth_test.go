@@ -0,0 +1,77 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestBufferHealth_report(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	health := newBufferHealth(logger, "test_buffer_health", BufferAlarms{
+		Window:            time.Minute,
+		MaxSpanAge:        30 * time.Second,
+		MaxFlushFailures:  1,
+		MaxUnwrittenBytes: 250,
+	})
+	now := time.Unix(1628000000, 0)
+
+	health.queue(100)
+	health.queue(100)
+	health.queue(100)
+	pending := health.batch(nil, now.Add(-40*time.Second), 100)
+	assert.Same(t, pending, health.batch(pending, now.Add(-20*time.Second), 100))
+	health.failed(now.Add(-2 * time.Minute))
+	health.failed(now.Add(-10 * time.Second))
+	health.failed(now.Add(-5 * time.Second))
+
+	health.report(now)
+	assert.Equal(t, float64(40), testutil.ToFloat64(health.age), "the oldest batched span is the oldest")
+	assert.Equal(t, float64(300), testutil.ToFloat64(health.bytes), "queued and batched spans are unwritten")
+	assert.Equal(t, float64(2), testutil.ToFloat64(health.recent), "failures outside of the window are not counted")
+	warnings := []mocks.LogMock{
+		{
+			Msg:  "Spans kept in memory by the writer crossed the alarm threshold, they are lost if the plugin crashes",
+			Args: []interface{}{"alarm", alarmSpanAge, "age", 40 * time.Second},
+		},
+		{
+			Msg:  "Spans kept in memory by the writer crossed the alarm threshold, they are lost if the plugin crashes",
+			Args: []interface{}{"alarm", alarmFlushFailures, "failures", 2},
+		},
+		{
+			Msg:  "Spans kept in memory by the writer crossed the alarm threshold, they are lost if the plugin crashes",
+			Args: []interface{}{"alarm", alarmBytes, "bytes", int64(300)},
+		},
+	}
+	logger.AssertLogsOfLevelEqual(t, hclog.Warn, warnings)
+
+	// Crossed alarms are not logged again, only when they are resolved
+	health.release(pending)
+	health.report(now.Add(time.Second))
+	assert.Equal(t, float64(100), testutil.ToFloat64(health.bytes))
+	assert.Equal(t, float64(21), testutil.ToFloat64(health.age), "queued spans are as old as the last batched span")
+	logger.AssertLogsOfLevelEqual(t, hclog.Warn, warnings)
+	logger.AssertLogsOfLevelEqual(t, hclog.Info, []mocks.LogMock{
+		{
+			Msg:  "Spans kept in memory by the writer are below the alarm threshold again",
+			Args: []interface{}{"alarm", alarmSpanAge, "age", 21 * time.Second},
+		},
+		{
+			Msg:  "Spans kept in memory by the writer are below the alarm threshold again",
+			Args: []interface{}{"alarm", alarmBytes, "bytes", int64(100)},
+		},
+	})
+}
+
+func TestBufferHealth_nil(t *testing.T) {
+	var health *bufferHealth
+	health.queue(100)
+	assert.Nil(t, health.batch(nil, time.Now(), 100))
+	health.release(&pendingBatch{})
+	health.failed(time.Now())
+}
@@ -0,0 +1,79 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrStorageDegraded is returned by readers without querying ClickHouse while the circuit breaker is open
+var ErrStorageDegraded = errors.New("storage degraded: ClickHouse queries are failing, try again later")
+
+var circuitBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "jaeger_clickhouse_circuit_breaker_open",
+	Help: "Whether read queries fail fast due to failing ClickHouse, 1 while the circuit breaker is open",
+})
+
+// circuitBreaker fails read queries fast after failureThreshold consecutive failed queries, so that requests
+// of the query service do not pile up waiting for ClickHouse that is down. After coolDown queries are let through
+// again, the first failed one opens the circuit breaker for another coolDown, the first successful one closes it.
+type circuitBreaker struct {
+	failureThreshold int
+	coolDown         time.Duration
+	now              func() time.Time
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// WithCircuitBreaker fails queries with ErrStorageDegraded for coolDown after failureThreshold consecutive queries
+// failed or timed out, also while their rows were read. Queries cancelled by their requests are not counted. Readers configured with the same option
+// share the circuit breaker.
+func WithCircuitBreaker(failureThreshold int, coolDown time.Duration) TraceReaderOption {
+	var breaker *circuitBreaker
+	if failureThreshold > 0 {
+		breaker = &circuitBreaker{failureThreshold: failureThreshold, coolDown: coolDown, now: time.Now}
+	}
+	return func(reader *TraceReader) {
+		reader.breaker = breaker
+	}
+}
+
+// allow returns ErrStorageDegraded while the circuit breaker is open
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.now().Before(b.openUntil) {
+		return ErrStorageDegraded
+	}
+	return nil
+}
+
+// observe records the result of a query
+func (b *circuitBreaker) observe(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil {
+		if b.failures >= b.failureThreshold {
+			circuitBreakerOpen.Set(0)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.failureThreshold {
+		b.openUntil = b.now().Add(b.coolDown)
+		circuitBreakerOpen.Set(1)
+	}
+}
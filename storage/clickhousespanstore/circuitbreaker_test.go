@@ -0,0 +1,90 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	breaker := &circuitBreaker{failureThreshold: 2, coolDown: time.Minute, now: func() time.Time { return now }}
+
+	breaker.observe(errorMock)
+	breaker.observe(context.Canceled)
+	assert.NoError(t, breaker.allow(), "cancelled queries are not counted")
+	breaker.observe(errorMock)
+	assert.ErrorIs(t, breaker.allow(), ErrStorageDegraded)
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.allow(), "queries are tried again after the cool down")
+	breaker.observe(errorMock)
+	assert.ErrorIs(t, breaker.allow(), ErrStorageDegraded, "a failed query after the cool down opens the breaker again")
+
+	now = now.Add(time.Minute)
+	breaker.observe(nil)
+	breaker.observe(errorMock)
+	assert.NoError(t, breaker.allow(), "a successful query closes the breaker")
+
+	assert.NoError(t, (*circuitBreaker)(nil).allow())
+}
+
+func TestTraceReader_WithCircuitBreaker(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	breakerOpt := WithCircuitBreaker(1, time.Hour)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, breakerOpt)
+	archiveReader := NewTraceReader(db, "", "", testArchiveTable, breakerOpt)
+	query := fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)
+	mock.ExpectQuery(query).WillReturnRows(getRows([]driver.Value{"service"}))
+	mock.ExpectQuery(query).WillReturnError(errorMock)
+
+	services, err := traceReader.GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"service"}, services)
+	_, err = traceReader.GetServices(context.Background())
+	assert.ErrorIs(t, err, errorMock)
+
+	// Queries fail without reaching ClickHouse, readers with the same option share the breaker
+	_, err = traceReader.GetServices(context.Background())
+	assert.ErrorIs(t, err, ErrStorageDegraded)
+	_, err = archiveReader.GetTrace(context.Background(), testSpan.TraceID)
+	assert.ErrorIs(t, err, ErrStorageDegraded)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_WithCircuitBreakerRowsErrors(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)
+	tests := map[string]*sqlmock.Rows{
+		"rows error": getRows([]driver.Value{"service"}).RowError(0, errorMock),
+		"scan error": sqlmock.NewRows([]string{"service"}).AddRow(nil),
+	}
+
+	for name, rows := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+				WithCircuitBreaker(1, time.Hour))
+			mock.ExpectQuery(query).WillReturnRows(rows)
+
+			_, err := traceReader.GetServices(context.Background())
+			assert.Error(t, err)
+			_, err = traceReader.GetServices(context.Background())
+			assert.ErrorIs(t, err, ErrStorageDegraded, "errors of reading rows open the breaker")
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
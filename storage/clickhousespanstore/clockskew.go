@@ -0,0 +1,90 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ClockSkewPolicy is what is done with spans starting too far in the past or in the future
+type ClockSkewPolicy string
+
+const (
+	// ClockSkewKeep writes skewed spans as they are
+	ClockSkewKeep ClockSkewPolicy = "keep"
+	// ClockSkewClamp writes skewed spans with the write time as their start time
+	ClockSkewClamp ClockSkewPolicy = "clamp"
+	// ClockSkewDrop does not write skewed spans
+	ClockSkewDrop ClockSkewPolicy = "drop"
+	// ClockSkewQuarantine writes skewed spans to a separate table
+	ClockSkewQuarantine ClockSkewPolicy = "quarantine"
+)
+
+var numClockSkewedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_clock_skewed_spans_total",
+	Help: "Number of spans starting too far in the past or in the future, by applied policy",
+}, []string{"policy"})
+
+// clockSkew detects spans that would be written to old or future partitions of the day partitioned tables.
+// Every such span creates small parts in its own partition that are rarely merged.
+type clockSkew struct {
+	policy     ClockSkewPolicy
+	maxAge     time.Duration
+	maxFuture  time.Duration
+	quarantine spanstore.Writer
+}
+
+// WithClockSkewClamp sets start time of spans starting more than maxAge ago or more than maxFuture ahead to the write time.
+// Zero disables the corresponding limit.
+func WithClockSkewClamp(maxAge, maxFuture time.Duration) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.clockSkew = clockSkew{policy: ClockSkewClamp, maxAge: maxAge, maxFuture: maxFuture}
+	}
+}
+
+// WithClockSkewDrop drops spans starting more than maxAge ago or more than maxFuture ahead.
+// Zero disables the corresponding limit.
+func WithClockSkewDrop(maxAge, maxFuture time.Duration) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.clockSkew = clockSkew{policy: ClockSkewDrop, maxAge: maxAge, maxFuture: maxFuture}
+	}
+}
+
+// WithClockSkewQuarantine writes spans starting more than maxAge ago or more than maxFuture ahead with the quarantine writer.
+// Zero disables the corresponding limit.
+func WithClockSkewQuarantine(maxAge, maxFuture time.Duration, quarantine spanstore.Writer) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.clockSkew = clockSkew{policy: ClockSkewQuarantine, maxAge: maxAge, maxFuture: maxFuture, quarantine: quarantine}
+	}
+}
+
+func (c clockSkew) skewed(start, now time.Time) bool {
+	return (c.maxAge > 0 && start.Before(now.Add(-c.maxAge))) || (c.maxFuture > 0 && start.After(now.Add(c.maxFuture)))
+}
+
+// handle applies the policy to a skewed span, it returns the span to write or nil if the span is already handled
+func (c clockSkew) handle(ctx context.Context, span *model.Span, now time.Time) (*model.Span, error) {
+	if c.policy == "" || c.policy == ClockSkewKeep || !c.skewed(span.StartTime, now) {
+		return span, nil
+	}
+	numClockSkewedSpans.WithLabelValues(string(c.policy)).Inc()
+
+	switch c.policy {
+	case ClockSkewClamp:
+		clamped := *span
+		clamped.StartTime = now
+		clamped.Warnings = append(span.Warnings[:len(span.Warnings):len(span.Warnings)], fmt.Sprintf(
+			"start time %s was replaced with the write time due to clock skew",
+			span.StartTime.Format(time.RFC3339Nano),
+		))
+		return &clamped, nil
+	case ClockSkewQuarantine:
+		return nil, c.quarantine.WriteSpan(ctx, span)
+	default:
+		return nil, nil
+	}
+}
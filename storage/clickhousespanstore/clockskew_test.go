@@ -0,0 +1,112 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spanRecorder is a spanstore.Writer remembering written spans
+type spanRecorder struct {
+	spans []*model.Span
+}
+
+func (r *spanRecorder) WriteSpan(_ context.Context, span *model.Span) error {
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+func TestClockSkew_handle(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+	tests := map[string]struct {
+		clockSkew   clockSkew
+		start       time.Time
+		expectWrite bool
+		expectStart time.Time
+		quarantined bool
+	}{
+		"keep": {
+			clockSkew:   clockSkew{policy: ClockSkewKeep, maxAge: time.Hour},
+			start:       old,
+			expectWrite: true,
+			expectStart: old,
+		},
+		"not skewed": {
+			clockSkew:   clockSkew{policy: ClockSkewDrop, maxAge: 24 * time.Hour, maxFuture: time.Hour},
+			start:       now.Add(-time.Hour),
+			expectWrite: true,
+			expectStart: now.Add(-time.Hour),
+		},
+		"no age limit": {
+			clockSkew:   clockSkew{policy: ClockSkewDrop, maxFuture: time.Hour},
+			start:       old,
+			expectWrite: true,
+			expectStart: old,
+		},
+		"clamp past": {
+			clockSkew:   clockSkew{policy: ClockSkewClamp, maxAge: 24 * time.Hour, maxFuture: time.Hour},
+			start:       old,
+			expectWrite: true,
+			expectStart: now,
+		},
+		"clamp future": {
+			clockSkew:   clockSkew{policy: ClockSkewClamp, maxAge: 24 * time.Hour, maxFuture: time.Hour},
+			start:       now.Add(2 * time.Hour),
+			expectWrite: true,
+			expectStart: now,
+		},
+		"drop": {
+			clockSkew: clockSkew{policy: ClockSkewDrop, maxAge: 24 * time.Hour, maxFuture: time.Hour},
+			start:     old,
+		},
+		"quarantine": {
+			clockSkew:   clockSkew{policy: ClockSkewQuarantine, maxAge: 24 * time.Hour, maxFuture: time.Hour},
+			start:       old,
+			quarantined: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			quarantine := &spanRecorder{}
+			test.clockSkew.quarantine = quarantine
+			span := testSpan
+			span.StartTime = test.start
+
+			written, err := test.clockSkew.handle(context.Background(), &span, now)
+			require.NoError(t, err)
+			if test.expectWrite {
+				require.NotNil(t, written)
+				assert.Equal(t, test.expectStart, written.StartTime)
+			} else {
+				assert.Nil(t, written)
+			}
+			if test.quarantined {
+				assert.Equal(t, []*model.Span{&span}, quarantine.spans)
+			} else {
+				assert.Empty(t, quarantine.spans)
+			}
+			assert.Equal(t, test.start, span.StartTime, "written span is not modified")
+		})
+	}
+}
+
+func TestClockSkew_clampWarning(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	span := testSpan
+	span.StartTime = time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	span.Warnings = []string{"existing warning"}
+
+	written, err := clockSkew{policy: ClockSkewClamp, maxAge: time.Hour}.handle(context.Background(), &span, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"existing warning",
+		"start time 2021-07-01T12:00:00Z was replaced with the write time due to clock skew",
+	}, written.Warnings)
+	assert.Equal(t, []string{"existing warning"}, span.Warnings)
+}
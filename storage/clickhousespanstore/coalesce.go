@@ -0,0 +1,76 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// queryGroup coalesces concurrent identical queries, so that callers arriving while a query runs wait for its result
+// instead of running it again, e.g. when the query service lists operations of many services at startup
+type queryGroup struct {
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a running query, done is closed once its result is set
+type coalescedCall struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// WithCoalescedQueries makes concurrent identical GetServices and GetOperations calls share one query.
+// Calls are identical if they have the same tenant and parameters, so readers with connections
+// of users of requests should not use it.
+func WithCoalescedQueries() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.coalescedQueries = &queryGroup{calls: map[string]*coalescedCall{}}
+	}
+}
+
+// do runs the query of the key, or waits for the result of the same query already running. Callers waiting for
+// a query cancelled with the context of its caller run it themselves. The result is shared, callers must not modify it.
+func (g *queryGroup) do(
+	ctx context.Context,
+	key string,
+	query func(ctx context.Context) (interface{}, error),
+) (interface{}, error) {
+	if g == nil {
+		return query(ctx)
+	}
+
+	g.mutex.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			span.SetTag("query.coalesced", true)
+		}
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if isContextError(call.err) && ctx.Err() == nil {
+			return query(ctx)
+		}
+		return call.result, call.err
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.result, call.err = query(ctx)
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(call.done)
+	return call.result, call.err
+}
+
+// isContextError returns whether the query failed because its context was cancelled or timed out
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,94 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_GetOperationsCoalesced(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	// Calls arriving while the only expected query runs fail if they query again
+	mock.
+		ExpectQuery(fmt.Sprintf("SELECT operation, spankind FROM %s WHERE service = ? GROUP BY operation, spankind ORDER BY operation", testOperationsTable)).
+		WithArgs("frontend").
+		WillDelayFor(200 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"operation", "spankind"}).AddRow("GET /", "server"))
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithCoalescedQueries())
+	const calls = 5
+	results := make([][]spanstore.Operation, calls)
+	errs := make([]error, calls)
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = traceReader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "frontend"})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < calls; i++ {
+		require.NoError(t, errs[i])
+		assert.Equal(t, []spanstore.Operation{{Name: "GET /", SpanKind: "server"}}, results[i])
+	}
+	results[0][0].Name = "changed"
+	assert.Equal(t, "GET /", results[1][0].Name, "callers get copies of the shared result")
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, traceReader.coalescedQueries.calls, "finished queries are forgotten")
+}
+
+func TestQueryGroup_do(t *testing.T) {
+	var group *queryGroup
+	result, err := group.do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "result", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "result", result, "queries run without a group")
+
+	group = &queryGroup{calls: map[string]*coalescedCall{}}
+	failure := errors.New("query failed")
+	_, err = group.do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return nil, failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	// A call waiting for a query of a cancelled caller runs the query itself
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leaderDone := make(chan error)
+	go func() {
+		_, err := group.do(leaderCtx, "key", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		leaderDone <- err
+	}()
+	<-started
+	followerDone := make(chan interface{})
+	go func() {
+		result, _ := group.do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+			return "follower", nil
+		})
+		followerDone <- result
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leaderDone, context.Canceled)
+	assert.Equal(t, "follower", <-followerDone)
+}
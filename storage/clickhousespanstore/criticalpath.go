@@ -0,0 +1,445 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxProfiledTraces is the number of recently profiled traces remembered, so that late spans do not profile
+	// a trace twice
+	maxProfiledTraces = 100_000
+	// maxProfileBatch is the maximal number of traces read by one query
+	maxProfileBatch = 100
+)
+
+var numProfiledTraces = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_profiled_traces_total",
+	Help: "Number of sampled traces whose critical paths and self times were written to the operation profiles table",
+})
+
+// frameReplacer keeps separators of folded stacks out of their frames
+var frameReplacer = strings.NewReplacer(";", "_", "\n", " ")
+
+// CriticalPathAnalyzer computes critical paths and self times of operations of sampled traces and writes them
+// aggregated by stacks of operations to the operation profiles table, so that flamegraphs of thousands of traces
+// are served by summing few rows. Traces are profiled between one and two delays after their first span is written,
+// spans of the trace written after that are left out.
+type CriticalPathAnalyzer struct {
+	logger        hclog.Logger
+	db            *sql.DB
+	spansTable    TableName
+	profilesTable TableName
+	multiTenant   bool
+	sampleRate    uint64
+	delay         time.Duration
+
+	mutex sync.Mutex
+	// pending traces are profiled on the tick after the next one, waiting ones on the next tick
+	pending  map[profiledTrace]bool
+	waiting  map[profiledTrace]bool
+	profiled cache.Cache
+	finish   chan bool
+	done     sync.WaitGroup
+}
+
+type profiledTrace struct {
+	tenant  string
+	traceID model.TraceID
+}
+
+// operationProfile is the self time and the time on the critical path of spans of an operation at a stack of a trace
+type operationProfile struct {
+	service   string
+	operation string
+	// stack are service:operation frames from the root span to the span separated by semicolons
+	stack string
+	spans uint32
+	// selfTime is the time of spans not covered by their children
+	selfTime time.Duration
+	// criticalPath is the time of spans on the critical path of the trace, the path that determines its duration
+	criticalPath time.Duration
+}
+
+// NewCriticalPathAnalyzer returns a CriticalPathAnalyzer profiling every sampleRate-th trace by its ID,
+// read from the spans table, into the profiles table
+func NewCriticalPathAnalyzer(
+	logger hclog.Logger,
+	db *sql.DB,
+	spansTable,
+	profilesTable TableName,
+	multiTenant bool,
+	sampleRate int,
+	delay time.Duration,
+) *CriticalPathAnalyzer {
+	return &CriticalPathAnalyzer{
+		logger:        logger,
+		db:            db,
+		spansTable:    spansTable,
+		profilesTable: profilesTable,
+		multiTenant:   multiTenant,
+		sampleRate:    uint64(sampleRate),
+		delay:         delay,
+		pending:       make(map[profiledTrace]bool),
+		waiting:       make(map[profiledTrace]bool),
+		profiled:      cache.NewLRU(maxProfiledTraces),
+		finish:        make(chan bool),
+	}
+}
+
+// WithCriticalPathAnalyzer profiles sampled traces of written spans
+func WithCriticalPathAnalyzer(analyzer *CriticalPathAnalyzer) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.criticalPaths = analyzer
+	}
+}
+
+// Start profiles traces every delay in the background until the analyzer is closed
+func (a *CriticalPathAnalyzer) Start() {
+	a.done.Add(1)
+	go func() {
+		defer a.done.Done()
+		ticker := time.NewTicker(a.delay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.finish:
+				return
+			case <-ticker.C:
+				if err := a.Analyze(); err != nil {
+					a.logger.Error("Could not profile traces", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops profiling traces, traces not profiled yet are not profiled
+func (a *CriticalPathAnalyzer) Close() {
+	close(a.finish)
+	a.done.Wait()
+}
+
+// observe remembers the trace of the span of the tenant for profiling, if the trace is sampled
+func (a *CriticalPathAnalyzer) observe(tenant string, span *model.Span) {
+	if a == nil || span.TraceID.Low%a.sampleRate != 0 {
+		return
+	}
+	trace := profiledTrace{tenant: tenant, traceID: span.TraceID}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.pending[trace] || a.waiting[trace] || a.profiled.Get(trace.key()) != nil {
+		return
+	}
+	a.pending[trace] = true
+}
+
+func (t profiledTrace) key() string {
+	return t.tenant + "\x00" + t.traceID.String()
+}
+
+// Analyze profiles traces that have waited for at least the delay, so that their other spans were written meanwhile.
+// Traces that could not be profiled are profiled on the next call.
+func (a *CriticalPathAnalyzer) Analyze() error {
+	a.mutex.Lock()
+	due := make(map[string][]model.TraceID)
+	for trace := range a.waiting {
+		due[trace.tenant] = append(due[trace.tenant], trace.traceID)
+	}
+	a.waiting, a.pending = a.pending, make(map[profiledTrace]bool)
+	a.mutex.Unlock()
+
+	var err error
+	for tenant, traceIDs := range due {
+		for start := 0; start < len(traceIDs) && err == nil; start += maxProfileBatch {
+			end := start + maxProfileBatch
+			if end > len(traceIDs) {
+				end = len(traceIDs)
+			}
+			if err = a.profileTraces(tenant, traceIDs[start:end]); err != nil {
+				a.mutex.Lock()
+				for _, traceID := range traceIDs[start:] {
+					a.waiting[profiledTrace{tenant: tenant, traceID: traceID}] = true
+				}
+				a.mutex.Unlock()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *CriticalPathAnalyzer) profileTraces(tenant string, traceIDs []model.TraceID) error {
+	spans, err := a.readSpans(tenant, traceIDs)
+	if err != nil {
+		return err
+	}
+	traces := make(map[model.TraceID][]*model.Span, len(traceIDs))
+	for _, span := range spans {
+		traces[span.TraceID] = append(traces[span.TraceID], span)
+	}
+	if err := a.writeProfiles(tenant, traces); err != nil {
+		return err
+	}
+	for _, traceID := range traceIDs {
+		a.profiled.Put(profiledTrace{tenant: tenant, traceID: traceID}.key(), true)
+	}
+	numProfiledTraces.Add(float64(len(traces)))
+	return nil
+}
+
+func (a *CriticalPathAnalyzer) readSpans(tenant string, traceIDs []model.TraceID) ([]*model.Span, error) {
+	args := make([]interface{}, 0, len(traceIDs)+1)
+	condition := ""
+	if a.multiTenant {
+		condition = "tenant = ? AND "
+		args = append(args, tenant)
+	}
+	for _, traceID := range traceIDs {
+		args = append(args, traceID.String())
+	}
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT model FROM %s WHERE %straceID IN (%s)",
+		a.spansTable,
+		condition,
+		"?"+strings.Repeat(",?", len(traceIDs)-1),
+	)
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serialized [][]byte
+	for rows.Next() {
+		var span []byte
+		if err := rows.Scan(&span); err != nil {
+			return nil, err
+		}
+		serialized = append(serialized, span)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Spans failing to decode are left out of profiles instead of failing them
+	decoded, errs := unmarshalEachSpan(serialized, "", 1)
+	spans := make([]*model.Span, 0, len(decoded))
+	for i, span := range decoded {
+		if errs[i] == nil {
+			spans = append(spans, span)
+		}
+	}
+	return spans, nil
+}
+
+func (a *CriticalPathAnalyzer) writeProfiles(tenant string, traces map[model.TraceID][]*model.Span) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{
+		"timestamp", "traceID", "rootService", "rootOperation", "service", "operation", "stack", "spans", "selfTimeUs",
+		"criticalPathUs",
+	}
+	if a.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		a.profilesTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	for traceID, spans := range traces {
+		root, profiles := profileTrace(spans)
+		if root == nil {
+			continue
+		}
+		for _, profile := range profiles {
+			args := []interface{}{
+				root.StartTime,
+				traceID.String(),
+				root.Process.ServiceName,
+				root.OperationName,
+				profile.service,
+				profile.operation,
+				profile.stack,
+				int64(profile.spans),
+				profile.selfTime.Microseconds(),
+				profile.criticalPath.Microseconds(),
+			}
+			if a.multiTenant {
+				args = append([]interface{}{tenant}, args...)
+			}
+			if _, err := statement.Exec(args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	committed = true
+	return tx.Commit()
+}
+
+// profiledSpan is a span of a trace with its children, with times clipped to its parent
+type profiledSpan struct {
+	span       *model.Span
+	stack      string
+	start, end time.Time
+	children   []*profiledSpan
+}
+
+// profileTrace returns the longest root span of the trace and profiles of its spans aggregated by stacks.
+// Spans are clipped to their parents, spans whose parents are not in the trace start their own stacks, but only
+// spans descending from the returned root are on the critical path. The root is nil if every span has a parent.
+func profileTrace(spans []*model.Span) (*model.Span, []operationProfile) {
+	nodes := make(map[model.SpanID]*profiledSpan, len(spans))
+	for _, span := range spans {
+		nodes[span.SpanID] = &profiledSpan{span: span, start: span.StartTime, end: span.StartTime.Add(span.Duration)}
+	}
+	var roots []*profiledSpan
+	for _, span := range spans {
+		node := nodes[span.SpanID]
+		if node.span != span {
+			// Duplicate span IDs
+			continue
+		}
+		parent, ok := nodes[span.ParentSpanID()]
+		if !ok || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.children = append(parent.children, node)
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+
+	// Descending from roots visits every span once, spans in reference cycles are never reached
+	profiles := make(map[string]*operationProfile)
+	var order []string
+	var visit func(node *profiledSpan, parentStack string)
+	visit = func(node *profiledSpan, parentStack string) {
+		service := ""
+		if node.span.Process != nil {
+			service = node.span.Process.ServiceName
+		}
+		frame := frameReplacer.Replace(service) + ":" + frameReplacer.Replace(node.span.OperationName)
+		node.stack = frame
+		if parentStack != "" {
+			node.stack = parentStack + ";" + frame
+		}
+		profile, ok := profiles[node.stack]
+		if !ok {
+			profile = &operationProfile{service: service, operation: node.span.OperationName, stack: node.stack}
+			profiles[node.stack] = profile
+			order = append(order, node.stack)
+		}
+		profile.spans++
+
+		for _, child := range node.children {
+			if child.start.Before(node.start) {
+				child.start = node.start
+			}
+			if child.end.After(node.end) {
+				child.end = node.end
+			}
+			if child.end.Before(child.start) {
+				child.end = child.start
+			}
+		}
+		sort.SliceStable(node.children, func(i, j int) bool {
+			return node.children[i].start.Before(node.children[j].start)
+		})
+		profile.selfTime += node.selfTime()
+		for _, child := range node.children {
+			visit(child, node.stack)
+		}
+	}
+	root := roots[0]
+	for _, node := range roots {
+		if node.span.Duration > root.span.Duration {
+			root = node
+		}
+		visit(node, "")
+	}
+	root.walkCriticalPath(root.end, profiles)
+
+	result := make([]operationProfile, len(order))
+	for i, stack := range order {
+		result[i] = *profiles[stack]
+	}
+	return root.span, result
+}
+
+// selfTime is the time of the span not covered by any of its children, children have to be clipped and sorted
+// by their starts
+func (node *profiledSpan) selfTime() time.Duration {
+	self := node.end.Sub(node.start)
+	covered := node.start
+	for _, child := range node.children {
+		start := child.start
+		if start.Before(covered) {
+			start = covered
+		}
+		if child.end.After(start) {
+			self -= child.end.Sub(start)
+			covered = child.end
+		}
+	}
+	return self
+}
+
+// walkCriticalPath adds time of the span and its descendants on the critical path until end to their profiles.
+// Like in Jaeger UI, the path goes from the end back through the last child finishing before the path reaches it,
+// the span is on the path while none of its children is.
+func (node *profiledSpan) walkCriticalPath(end time.Time, profiles map[string]*operationProfile) {
+	children := make([]*profiledSpan, len(node.children))
+	copy(children, node.children)
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].end.After(children[j].end)
+	})
+
+	profile := profiles[node.stack]
+	cursor := end
+	for _, child := range children {
+		if child.end.After(cursor) || !child.start.Before(cursor) {
+			// Overlaps the part of the path already walked
+			continue
+		}
+		profile.criticalPath += cursor.Sub(child.end)
+		child.walkCriticalPath(child.end, profiles)
+		cursor = child.start
+	}
+	if cursor.After(node.start) {
+		profile.criticalPath += cursor.Sub(node.start)
+	}
+}
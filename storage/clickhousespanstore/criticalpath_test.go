@@ -0,0 +1,123 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testProfilesTable = "test_profiles_table"
+
+// profiledTestTrace returns a trace of a root span lasting 100ms with overlapping children, a child ending after
+// the root, a grandchild and a span whose parent is missing
+func profiledTestTrace() []*model.Span {
+	traceID := model.TraceID{Low: 100}
+	start := time.Unix(1628000000, 0)
+	frontend := &model.Process{ServiceName: "frontend"}
+	db := &model.Process{ServiceName: "db"}
+	span := func(id, parent uint64, process *model.Process, operation string, from, to int) *model.Span {
+		span := &model.Span{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(id),
+			OperationName: operation,
+			StartTime:     start.Add(time.Duration(from) * time.Millisecond),
+			Duration:      time.Duration(to-from) * time.Millisecond,
+			Process:       process,
+		}
+		if parent != 0 {
+			span.References = []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(parent))}
+		}
+		return span
+	}
+	return []*model.Span{
+		span(1, 0, frontend, "GET /", 0, 100),
+		span(2, 1, frontend, "auth", 10, 40),
+		span(3, 1, frontend, "load", 30, 90),
+		span(4, 1, frontend, "render", 95, 120),
+		span(5, 3, db, "SELECT", 50, 60),
+		span(6, 1, frontend, "auth", 42, 45),
+		span(7, 99, db, "INSERT", 0, 10),
+	}
+}
+
+func TestProfileTrace(t *testing.T) {
+	spans := profiledTestTrace()
+	root, profiles := profileTrace(spans)
+	require.NotNil(t, root)
+	assert.Equal(t, spans[0], root)
+	assert.Equal(t, []operationProfile{
+		{service: "frontend", operation: "GET /", stack: "frontend:GET /", spans: 1, selfTime: 15 * time.Millisecond, criticalPath: 35 * time.Millisecond},
+		{service: "frontend", operation: "auth", stack: "frontend:GET /;frontend:auth", spans: 2, selfTime: 33 * time.Millisecond},
+		{service: "frontend", operation: "load", stack: "frontend:GET /;frontend:load", spans: 1, selfTime: 50 * time.Millisecond, criticalPath: 50 * time.Millisecond},
+		{service: "db", operation: "SELECT", stack: "frontend:GET /;frontend:load;db:SELECT", spans: 1, selfTime: 10 * time.Millisecond, criticalPath: 10 * time.Millisecond},
+		{service: "frontend", operation: "render", stack: "frontend:GET /;frontend:render", spans: 1, selfTime: 5 * time.Millisecond, criticalPath: 5 * time.Millisecond},
+		{service: "db", operation: "INSERT", stack: "db:INSERT", spans: 1, selfTime: 10 * time.Millisecond},
+	}, profiles)
+
+	var criticalPath time.Duration
+	for _, profile := range profiles {
+		criticalPath += profile.criticalPath
+	}
+	assert.Equal(t, root.Duration, criticalPath, "the critical path covers the root span")
+}
+
+func TestProfileTrace_Cycle(t *testing.T) {
+	traceID := model.TraceID{Low: 100}
+	root, profiles := profileTrace([]*model.Span{
+		{TraceID: traceID, SpanID: 1, References: []model.SpanRef{model.NewChildOfRef(traceID, 2)}},
+		{TraceID: traceID, SpanID: 2, References: []model.SpanRef{model.NewChildOfRef(traceID, 1)}},
+	})
+	assert.Nil(t, root)
+	assert.Empty(t, profiles)
+}
+
+func TestCriticalPathAnalyzer_Analyze(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	analyzer := NewCriticalPathAnalyzer(mocks.NewSpyLogger(), db, testSpansTable, testProfilesTable, true, 100, time.Minute)
+	spans := profiledTestTrace()
+	for _, span := range spans {
+		analyzer.observe("tenant_1", span)
+	}
+	analyzer.observe("tenant_1", &model.Span{TraceID: model.TraceID{Low: 101}})
+	require.NoError(t, analyzer.Analyze(), "traces wait for the next analysis")
+	assert.Len(t, analyzer.waiting, 1, "traces are sampled by their IDs")
+
+	query := "SELECT model FROM test_spans_table WHERE tenant = ? AND traceID IN (?)"
+	mock.ExpectQuery(query).WithArgs("tenant_1", spans[0].TraceID.String()).WillReturnError(errorMock)
+	assert.ErrorIs(t, analyzer.Analyze(), errorMock)
+
+	rows := sqlmock.NewRows([]string{"model"})
+	for _, span := range spans {
+		serialized, err := marshalSpan(span, EncodingJSON)
+		require.NoError(t, err)
+		rows.AddRow(serialized)
+	}
+	rows.AddRow([]byte("{"))
+	mock.ExpectQuery(query).WithArgs("tenant_1", spans[0].TraceID.String()).WillReturnRows(rows)
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare("INSERT INTO test_profiles_table (tenant, timestamp, traceID, rootService, rootOperation," +
+		" service, operation, stack, spans, selfTimeUs, criticalPathUs) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	_, profiles := profileTrace(spans)
+	for _, profile := range profiles {
+		prepare.ExpectExec().WithArgs(
+			"tenant_1", sqlmock.AnyArg(), spans[0].TraceID.String(), "frontend", "GET /", profile.service,
+			profile.operation, profile.stack, int64(profile.spans), profile.selfTime.Microseconds(),
+			profile.criticalPath.Microseconds(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	require.NoError(t, analyzer.Analyze(), "spans failing to decode are left out")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	analyzer.observe("tenant_1", spans[0])
+	assert.Empty(t, analyzer.pending, "profiled traces are not profiled again")
+}
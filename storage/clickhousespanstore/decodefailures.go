@@ -0,0 +1,129 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DecodeFailurePolicy is what is done with fetched spans that cannot be decoded
+type DecodeFailurePolicy string
+
+const (
+	// DecodeFailureIgnore skips spans failing protobuf decoding and fails reads of spans failing JSON decoding,
+	// without counting or logging them
+	DecodeFailureIgnore DecodeFailurePolicy = "ignore"
+	// DecodeFailureFail fails reads of traces with a DecodeError
+	DecodeFailureFail DecodeFailurePolicy = "fail"
+	// DecodeFailureAnnotate skips spans that cannot be decoded and adds a warning to their traces
+	DecodeFailureAnnotate DecodeFailurePolicy = "annotate"
+)
+
+// decodeFailureLogInterval is the minimal interval between logged decode failures, others are only counted
+const decodeFailureLogInterval = time.Minute
+
+var numDecodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_decode_failures_total",
+	Help: "Number of fetched spans that could not be decoded, by encoding",
+}, []string{"encoding"})
+
+// DecodeError is returned for traces with spans that cannot be decoded by the fail decode failure policy
+type DecodeError struct {
+	TraceID  string
+	Encoding Encoding
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode %s span of trace %s: %v", e.Encoding, e.TraceID, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decodeDiagnostics counts and logs samples of spans that cannot be decoded. Protobuf decoding of corrupted data
+// often succeeds, so spans decoded to another trace than the one they are stored for are also corrupted.
+type decodeDiagnostics struct {
+	logger hclog.Logger
+	policy DecodeFailurePolicy
+
+	mutex      sync.Mutex
+	logged     time.Time
+	suppressed int
+}
+
+// WithDecodeFailurePolicy counts fetched spans that cannot be decoded by encoding, logs samples of them at most
+// once a minute and fails or annotates their traces by the policy, so that corrupted data is detected instead of
+// hidden. Spans are read with their trace IDs to attribute failures to traces.
+func WithDecodeFailurePolicy(logger hclog.Logger, policy DecodeFailurePolicy) TraceReaderOption {
+	return func(reader *TraceReader) {
+		if policy == DecodeFailureIgnore || policy == "" {
+			reader.decodeDiagnostics = nil
+			return
+		}
+		reader.decodeDiagnostics = &decodeDiagnostics{logger: logger, policy: policy}
+	}
+}
+
+// decode decodes the stored spans, it returns the number of spans that could not be decoded by trace
+func (d *decodeDiagnostics) decode(stored storedSpans, encoding Encoding, workers int) ([]*model.Span, map[string]int, error) {
+	decoded, errs := unmarshalEachSpan(stored.models, encoding, workers)
+	spans := make([]*model.Span, 0, len(decoded))
+	var failed map[string]int
+	for i, span := range decoded {
+		err := errs[i]
+		traceID := stored.traceIDs[i]
+		if err == nil && span.TraceID.String() != traceID {
+			err = fmt.Errorf("decoded span belongs to trace %s", span.TraceID)
+		}
+		if err == nil {
+			spans = append(spans, span)
+			continue
+		}
+
+		decodeErr := &DecodeError{TraceID: traceID, Encoding: detectEncoding(stored.models[i], encoding), Err: err}
+		d.report(decodeErr)
+		if d.policy == DecodeFailureFail {
+			return nil, nil, decodeErr
+		}
+		if failed == nil {
+			failed = make(map[string]int)
+		}
+		failed[traceID]++
+	}
+	return spans, failed, nil
+}
+
+// report counts the decode failure and logs it unless another one was logged within the log interval
+func (d *decodeDiagnostics) report(err *DecodeError) {
+	numDecodeFailures.WithLabelValues(string(err.Encoding)).Inc()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(d.logged) < decodeFailureLogInterval {
+		d.suppressed++
+		return
+	}
+	d.logger.Warn("Could not decode stored span", "traceID", err.TraceID, "encoding", err.Encoding,
+		"error", err.Err, "suppressed", d.suppressed)
+	d.logged = now
+	d.suppressed = 0
+}
+
+// annotateUndecoded adds a warning about spans that could not be decoded to the earliest span of their traces
+func annotateUndecoded(traces []*model.Trace, failed map[string]int) {
+	for _, trace := range traces {
+		if len(trace.Spans) == 0 {
+			continue
+		}
+		if count := failed[trace.Spans[0].TraceID.String()]; count > 0 {
+			addTraceWarning(trace, fmt.Sprintf("trace is incomplete, %d spans could not be decoded", count))
+		}
+	}
+}
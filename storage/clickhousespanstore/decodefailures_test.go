@@ -0,0 +1,102 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_getTracesDecodeFailures(t *testing.T) {
+	traceID := model.NewTraceID(0, 1)
+	span := generateRandomSpan()
+	span.TraceID = traceID
+	span.Warnings = nil
+	valid, err := json.Marshal(span)
+	require.NoError(t, err)
+	otherTrace := span
+	otherTrace.TraceID = model.NewTraceID(0, 2)
+	misplaced, err := json.Marshal(otherTrace)
+	require.NoError(t, err)
+
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"traceID", "model"}).
+			AddRow(traceID.String(), valid).
+			AddRow(traceID.String(), []byte("{not_a_key}")).
+			AddRow(traceID.String(), misplaced)
+	}
+	query := fmt.Sprintf("SELECT traceID, model FROM %s PREWHERE traceID IN (?)", testSpansTable)
+
+	t.Run("annotate", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		logger := mocks.NewSpyLogger()
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+			WithDecodeFailurePolicy(logger, DecodeFailureAnnotate))
+		mock.ExpectQuery(query).WithArgs(traceID.String()).WillReturnRows(rows())
+
+		traces, err := reader.getTraces(context.Background(), []model.TraceID{traceID})
+		require.NoError(t, err)
+		require.Len(t, traces, 1)
+		require.Len(t, traces[0].Spans, 1)
+		assert.Equal(t, []string{"trace is incomplete, 2 spans could not be decoded"}, traces[0].Spans[0].Warnings)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// Only the first failure within the log interval is logged
+		_, expectedErr := unmarshalSpan([]byte("{not_a_key}"), EncodingJSON)
+		logger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{{
+			Msg:  "Could not decode stored span",
+			Args: []interface{}{"traceID", traceID.String(), "encoding", EncodingJSON, "error", expectedErr, "suppressed", 0},
+		}})
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+			WithDecodeFailurePolicy(mocks.NewSpyLogger(), DecodeFailureFail))
+		mock.ExpectQuery(query).WithArgs(traceID.String()).WillReturnRows(rows())
+
+		_, err = reader.getTraces(context.Background(), []model.TraceID{traceID})
+		var decodeErr *DecodeError
+		require.True(t, errors.As(err, &decodeErr))
+		assert.Equal(t, traceID.String(), decodeErr.TraceID)
+		assert.Equal(t, EncodingJSON, decodeErr.Encoding)
+		assert.EqualError(t, err, fmt.Sprintf(
+			"could not decode json span of trace %s: invalid character 'n' looking for beginning of object key string", traceID))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestTraceReader_getTracesDecodeFailuresMisplacedProtobuf(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	// Protobuf decoding of garbage succeeds with a span of another trace, which is skipped when failures are ignored
+	traceID := model.NewTraceID(0, 1)
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithDecodeFailurePolicy(mocks.NewSpyLogger(), DecodeFailureFail))
+	mock.ExpectQuery(fmt.Sprintf("SELECT traceID, model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(traceID.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "model"}).AddRow(traceID.String(), []byte("incorrect")))
+
+	_, err = reader.getTraces(context.Background(), []model.TraceID{traceID})
+	var decodeErr *DecodeError
+	require.True(t, errors.As(err, &decodeErr))
+	assert.Equal(t, EncodingProto, decodeErr.Encoding)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
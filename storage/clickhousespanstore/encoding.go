@@ -0,0 +1,94 @@
+package clickhousespanstore
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func marshalSpan(span *model.Span, encoding Encoding) ([]byte, error) {
+	if encoding == EncodingJSON {
+		return json.Marshal(span)
+	}
+	return proto.Marshal(span)
+}
+
+// detectEncoding returns the encoding of the serialized span, detected from the data if encoding is empty
+func detectEncoding(serialized []byte, encoding Encoding) Encoding {
+	if encoding != "" {
+		return encoding
+	}
+	if isJSONEncoded(serialized) {
+		return EncodingJSON
+	}
+	return EncodingProto
+}
+
+// unmarshalSpan decodes a span stored in the given encoding. If encoding is empty, it is detected from the data.
+func unmarshalSpan(serialized []byte, encoding Encoding) (*model.Span, error) {
+	span := model.Span{}
+	var err error
+	if detectEncoding(serialized, encoding) == EncodingJSON {
+		err = json.Unmarshal(serialized, &span)
+	} else {
+		err = proto.Unmarshal(serialized, &span)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &span, nil
+}
+
+// unmarshalSpans decodes spans with up to workers goroutines, each decoding a contiguous chunk, spans keep their order
+func unmarshalSpans(serialized [][]byte, encoding Encoding, workers int) ([]*model.Span, error) {
+	spans, errs := unmarshalEachSpan(serialized, encoding, workers)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return spans, nil
+}
+
+// unmarshalEachSpan decodes all spans like unmarshalSpans, spans failing to decode are nil and have their errors
+// at the same index
+func unmarshalEachSpan(serialized [][]byte, encoding Encoding, workers int) ([]*model.Span, []error) {
+	spans := make([]*model.Span, len(serialized))
+	errs := make([]error, len(serialized))
+	if workers > len(serialized) {
+		workers = len(serialized)
+	}
+	if workers <= 1 {
+		for i, data := range serialized {
+			spans[i], errs[i] = unmarshalSpan(data, encoding)
+		}
+		return spans, errs
+	}
+
+	var (
+		wg    sync.WaitGroup
+		chunk = (len(serialized) + workers - 1) / workers
+	)
+	for worker := 0; worker < workers; worker++ {
+		start, end := worker*chunk, (worker+1)*chunk
+		if end > len(serialized) {
+			end = len(serialized)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				spans[i], errs[i] = unmarshalSpan(serialized[i], encoding)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return spans, errs
+}
+
+func isJSONEncoded(serialized []byte) bool {
+	return len(serialized) > 0 && serialized[0] == '{'
+}
@@ -0,0 +1,165 @@
+package clickhousespanstore
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+type ExportFormat string
+
+const (
+	// ExportNDJSON writes every span as a line of JSON, the same as spans stored in JSON encoding
+	ExportNDJSON ExportFormat = "ndjson"
+	// ExportOTLP writes every span as a line of OTLP ExportTraceServiceRequest in its JSON encoding
+	ExportOTLP ExportFormat = "otlp"
+	// ExportCSV writes index rows of found spans as CSV with a header, see WriteIndexRows
+	ExportCSV ExportFormat = "csv"
+	// ExportTSV writes index rows of found spans as tab separated values with a header, see WriteIndexRows
+	ExportTSV ExportFormat = "tsv"
+
+	defaultExportWindow = time.Hour
+)
+
+// Exporter streams spans of a time range from the spans table, e.g. for jaeger anonymizer or offline analysis
+type Exporter struct {
+	db         *sql.DB
+	spansTable TableName
+	window     time.Duration
+	// tenant whose spans are exported, all spans are exported if not set
+	tenant    string
+	hasTenant bool
+	// processes restores processes of spans stored with their hashes, spans are stored with processes if nil
+	processes *processes
+}
+
+// ExporterOption configures optional behaviour of Exporter
+type ExporterOption func(exporter *Exporter)
+
+// WithExportTenant exports only spans of the tenant, the spans table must have the tenant column
+func WithExportTenant(tenant string) ExporterOption {
+	return func(exporter *Exporter) {
+		exporter.tenant = tenant
+		exporter.hasTenant = true
+	}
+}
+
+// WithExportWindow sets the time range read by a single query. Default 1h.
+func WithExportWindow(window time.Duration) ExporterOption {
+	return func(exporter *Exporter) {
+		exporter.window = window
+	}
+}
+
+// NewExporter returns an Exporter of spans in the table
+func NewExporter(db *sql.DB, spansTable TableName, opts ...ExporterOption) *Exporter {
+	exporter := &Exporter{
+		db:         db,
+		spansTable: spansTable,
+		window:     defaultExportWindow,
+	}
+	for _, opt := range opts {
+		opt(exporter)
+	}
+	return exporter
+}
+
+// Export writes spans started at or after start and before end to w in the format, ordered by start time.
+// The time range is read window by window, so a cursor over the spans table never holds more than a window of spans.
+// It returns the number of exported spans.
+func (e *Exporter) Export(ctx context.Context, w io.Writer, format ExportFormat, start, end time.Time) (int, error) {
+	if format != ExportNDJSON && format != ExportOTLP {
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	count := 0
+	for windowStart := start; windowStart.Before(end); windowStart = windowStart.Add(e.window) {
+		windowEnd := windowStart.Add(e.window)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		exported, err := e.exportWindow(ctx, encoder, format, windowStart, windowEnd)
+		count += exported
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, buffered.Flush()
+}
+
+func (e *Exporter) exportWindow(ctx context.Context, encoder *json.Encoder, format ExportFormat, start, end time.Time) (int, error) {
+	query := fmt.Sprintf("SELECT model FROM %s WHERE timestamp >= ? AND timestamp < ?", e.spansTable)
+	args := []interface{}{start, end}
+	if e.hasTenant {
+		query += " AND tenant = ?"
+		args = append(args, e.tenant)
+	}
+	query += " ORDER BY timestamp"
+
+	rows, err := e.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var serialized string
+		if err := rows.Scan(&serialized); err != nil {
+			return count, err
+		}
+		span, err := unmarshalSpan([]byte(serialized), "")
+		if err != nil {
+			return count, err
+		}
+		// Processes are read by another connection while rows of spans are read, they are mostly cached
+		if err := e.processes.resolve(ctx, []*model.Span{span}, e.tenant, e.hasTenant,
+			func(ctx context.Context, query string, args ...interface{}) (processRows, error) {
+				return e.db.QueryContext(ctx, query, args...)
+			}); err != nil {
+			return count, err
+		}
+		if err := encodeExportedSpan(encoder, format, span); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+func encodeExportedSpan(encoder *json.Encoder, format ExportFormat, span *model.Span) error {
+	if format == ExportOTLP {
+		return encoder.Encode(toOTLP(span))
+	}
+	return encoder.Encode(span)
+}
+
+// DecodeExportedSpans decodes a line written by Export in the format, e.g. to import exported spans.
+// A line of OTLP may have several spans.
+func DecodeExportedSpans(format ExportFormat, line []byte) ([]*model.Span, error) {
+	switch format {
+	case ExportNDJSON:
+		span, err := unmarshalSpan(line, EncodingJSON)
+		if err != nil {
+			return nil, err
+		}
+		return []*model.Span{span}, nil
+	case ExportOTLP:
+		var traces otlpTraces
+		if err := json.Unmarshal(line, &traces); err != nil {
+			return nil, err
+		}
+		return fromOTLP(traces)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
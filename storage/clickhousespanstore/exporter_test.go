@@ -0,0 +1,101 @@
+package clickhousespanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestExporter_Export(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	middle := start.Add(time.Hour)
+	end := start.Add(90 * time.Minute)
+	spans := generateRandomSpans(3)
+	jsonSpan, err := json.Marshal(spans[0])
+	require.NoError(t, err)
+	protoSpan, err := marshalSpan(spans[1], EncodingProto)
+	require.NoError(t, err)
+	otherJSONSpan, err := json.Marshal(spans[2])
+	require.NoError(t, err)
+
+	query := fmt.Sprintf("SELECT model FROM %s WHERE timestamp >= ? AND timestamp < ? AND tenant = ? ORDER BY timestamp", testSpansTable)
+	mock.ExpectQuery(query).
+		WithArgs(start, middle, "tenant_1").
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(jsonSpan).AddRow(protoSpan))
+	mock.ExpectQuery(query).
+		WithArgs(middle, end, "tenant_1").
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(otherJSONSpan))
+
+	var exported bytes.Buffer
+	count, err := NewExporter(db, testSpansTable, WithExportTenant("tenant_1")).
+		Export(context.Background(), &exported, ExportNDJSON, start, end)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	lines := strings.Split(strings.TrimSuffix(exported.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		expected, err := json.Marshal(spans[i])
+		require.NoError(t, err)
+		assert.JSONEq(t, string(expected), line)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExporter_ExportOTLP(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Minute)
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s WHERE timestamp >= ? AND timestamp < ? ORDER BY timestamp", testSpansTable)).
+		WithArgs(start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+
+	var exported bytes.Buffer
+	count, err := NewExporter(db, testSpansTable).Export(context.Background(), &exported, ExportOTLP, start, end)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	var traces otlpTraces
+	require.NoError(t, json.Unmarshal(exported.Bytes(), &traces))
+	assert.Equal(t, toOTLP(&testSpan), traces)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExporter_ExportErrors(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Minute)
+	exporter := NewExporter(db, testSpansTable)
+
+	_, err = exporter.Export(context.Background(), &bytes.Buffer{}, "csv", start, end)
+	assert.EqualError(t, err, `unknown export format "csv"`)
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s WHERE timestamp >= ? AND timestamp < ? ORDER BY timestamp", testSpansTable)).
+		WithArgs(start, end).
+		WillReturnError(errorMock)
+	_, err = exporter.Export(context.Background(), &bytes.Buffer{}, ExportNDJSON, start, end)
+	assert.ErrorIs(t, err, errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
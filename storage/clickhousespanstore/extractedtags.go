@@ -0,0 +1,116 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// extractedTagTypes are ClickHouse types of extracted tag columns with the bit size of their values
+var extractedTagTypes = map[string]int{
+	"String":  0,
+	"Int8":    8,
+	"Int16":   16,
+	"Int32":   32,
+	"Int64":   64,
+	"UInt8":   8,
+	"UInt16":  16,
+	"UInt32":  32,
+	"UInt64":  64,
+	"Float32": 32,
+	"Float64": 64,
+}
+
+// ExtractedTag is a tag whose values are written to a dedicated typed column of the index table besides the tags
+// columns, so searches by the tag read only its column. Spans without the tag or with a value not convertible
+// to the type have NULL in the column.
+type ExtractedTag struct {
+	Key  string
+	Type string
+}
+
+// ParseExtractedTag parses a tag key and the ClickHouse type of its column separated by the last colon,
+// e.g. http.status_code:UInt16
+func ParseExtractedTag(tag string) (ExtractedTag, error) {
+	separator := strings.LastIndex(tag, ":")
+	if separator <= 0 {
+		return ExtractedTag{}, fmt.Errorf("extracted tag %q must be key:type", tag)
+	}
+	extracted := ExtractedTag{Key: tag[:separator], Type: tag[separator+1:]}
+	if _, ok := extractedTagTypes[extracted.Type]; !ok {
+		return ExtractedTag{}, fmt.Errorf("unsupported type %q of extracted tag %q", extracted.Type, extracted.Key)
+	}
+	return extracted, nil
+}
+
+// Column is the name of the column of the tag, characters not allowed in identifiers are replaced with underscores
+func (t ExtractedTag) Column() string {
+	var column strings.Builder
+	column.WriteString("tag_")
+	for _, c := range t.Key {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			column.WriteRune(c)
+		} else {
+			column.WriteRune('_')
+		}
+	}
+	return column.String()
+}
+
+// convert returns the value converted to the type of the column, or false if it is not convertible
+func (t ExtractedTag) convert(value string) (interface{}, bool) {
+	bits := extractedTagTypes[t.Type]
+	var (
+		converted interface{}
+		err       error
+	)
+	switch {
+	case t.Type == "String":
+		return value, true
+	case strings.HasPrefix(t.Type, "UInt"):
+		converted, err = strconv.ParseUint(strings.TrimSpace(value), 10, bits)
+	case strings.HasPrefix(t.Type, "Int"):
+		converted, err = strconv.ParseInt(strings.TrimSpace(value), 10, bits)
+	default:
+		converted, err = strconv.ParseFloat(strings.TrimSpace(value), bits)
+	}
+	return converted, err == nil
+}
+
+// WithWriterExtractedTags writes values of the tags to their columns of the index table
+func WithWriterExtractedTags(tags []ExtractedTag) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.extractedTags = tags
+	}
+}
+
+// WithReaderExtractedTags filters spans by columns of the tags, instead of the tags columns of the index table
+func WithReaderExtractedTags(tags []ExtractedTag) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.extractedTags = make(map[string]ExtractedTag, len(tags))
+		for _, tag := range tags {
+			reader.extractedTags[tag.Key] = tag
+		}
+	}
+}
+
+// extractedTagValues returns values of the tags in the span converted to the types of their columns,
+// nil if the span does not have the tag or its value is not convertible. Span tags take precedence over process tags.
+func extractedTagValues(span *model.Span, tags []ExtractedTag) []interface{} {
+	values := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		kv, ok := model.KeyValues(span.Tags).FindByKey(tag.Key)
+		if !ok && span.Process != nil {
+			kv, ok = model.KeyValues(span.Process.Tags).FindByKey(tag.Key)
+		}
+		if !ok {
+			continue
+		}
+		if value, ok := tag.convert(kv.AsString()); ok {
+			values[i] = value
+		}
+	}
+	return values
+}
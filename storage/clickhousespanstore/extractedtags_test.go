@@ -0,0 +1,52 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtractedTag(t *testing.T) {
+	tag, err := ParseExtractedTag("http.status_code:UInt16")
+	require.NoError(t, err)
+	assert.Equal(t, ExtractedTag{Key: "http.status_code", Type: "UInt16"}, tag)
+	assert.Equal(t, "tag_http_status_code", tag.Column())
+
+	tag, err = ParseExtractedTag("k8s:pod-name:String")
+	require.NoError(t, err)
+	assert.Equal(t, ExtractedTag{Key: "k8s:pod-name", Type: "String"}, tag)
+	assert.Equal(t, "tag_k8s_pod_name", tag.Column())
+
+	_, err = ParseExtractedTag("http.status_code")
+	assert.EqualError(t, err, `extracted tag "http.status_code" must be key:type`)
+	_, err = ParseExtractedTag("http.status_code:UInt128")
+	assert.EqualError(t, err, `unsupported type "UInt128" of extracted tag "http.status_code"`)
+}
+
+func TestExtractedTag_convert(t *testing.T) {
+	tests := map[string]struct {
+		tag       ExtractedTag
+		value     string
+		expected  interface{}
+		converted bool
+	}{
+		"string":            {tag: ExtractedTag{Type: "String"}, value: " 42 ", expected: " 42 ", converted: true},
+		"unsigned":          {tag: ExtractedTag{Type: "UInt16"}, value: "404", expected: uint64(404), converted: true},
+		"unsigned overflow": {tag: ExtractedTag{Type: "UInt8"}, value: "404"},
+		"negative unsigned": {tag: ExtractedTag{Type: "UInt32"}, value: "-1"},
+		"signed":            {tag: ExtractedTag{Type: "Int32"}, value: "-1", expected: int64(-1), converted: true},
+		"float":             {tag: ExtractedTag{Type: "Float64"}, value: "0.5", expected: 0.5, converted: true},
+		"not a number":      {tag: ExtractedTag{Type: "Int64"}, value: "true"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			converted, ok := test.tag.convert(test.value)
+			assert.Equal(t, test.converted, ok)
+			if test.converted {
+				assert.Equal(t, test.expected, converted)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package clickhousespanstore
+
+import (
+	"context"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// WithArchiveSearch finds traces of the archive reader as well, so that a single search finds traces of both the spans
+// and the archive storage. Traces found in the spans table come first, traces found only in the archive fill up
+// the number of searched traces. The archive reader has to have an index table or search its spans table.
+func WithArchiveSearch(archive *TraceReader) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.archive = archive
+	}
+}
+
+// searchArchive returns IDs of traces found in the archive which are not among found traces, as many as the search
+// still lacks, none if the archive is not searched
+func (r *TraceReader) searchArchive(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	found []model.TraceID,
+) ([]model.TraceID, error) {
+	if r.archive == nil || len(found) >= params.NumTraces {
+		return nil, nil
+	}
+	// Traces in both tables are found in the spans table, so the archive is searched for all traces
+	archived, err := r.archive.searchTraceIDs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[model.TraceID]bool, len(found))
+	for _, traceID := range found {
+		seen[traceID] = true
+	}
+	var missing []model.TraceID
+	for _, traceID := range archived {
+		if len(found)+len(missing) >= params.NumTraces {
+			break
+		}
+		if !seen[traceID] {
+			seen[traceID] = true
+			missing = append(missing, traceID)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,126 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const (
+	testArchiveIndexTable TableName = "test_index_archive_table"
+	testArchiveSpansTable TableName = "test_spans_archive_table"
+)
+
+const testFederatedSearchQuery = "SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?" +
+	" ORDER BY service, timestamp DESC LIMIT ?"
+
+func TestTraceReader_FindTraceIDsWithArchive(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	archive := NewTraceReader(db, "", testArchiveIndexTable, testArchiveSpansTable)
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithArchiveSearch(archive))
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Minute)
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start, StartTimeMax: end, NumTraces: 3}
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}, {Low: 3}, {Low: 4}}
+
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testIndexTable)).
+		WithArgs("frontend", start, end, 3).
+		WillReturnRows(getRows([]driver.Value{traceIDs[0].String(), traceIDs[1].String()}))
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testArchiveIndexTable)).
+		WithArgs("frontend", start, end, 3).
+		WillReturnRows(getRows([]driver.Value{traceIDs[1].String(), traceIDs[2].String(), traceIDs[3].String()}))
+
+	found, err := reader.FindTraceIDs(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, traceIDs[:3], found, "traces in both tables are found once, up to the number of traces")
+
+	// The archive is not searched when the spans table has enough traces
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testIndexTable)).
+		WithArgs("frontend", start, end, 3).
+		WillReturnRows(getRows([]driver.Value{traceIDs[0].String(), traceIDs[1].String(), traceIDs[2].String()}))
+	found, err = reader.FindTraceIDs(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, traceIDs[:3], found)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_FindTracesWithArchive(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	archive := NewTraceReader(db, "", testArchiveIndexTable, testArchiveSpansTable)
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithArchiveSearch(archive))
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Minute)
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start, StartTimeMax: end, NumTraces: 2}
+	recent := testSpan
+	archived := testSpan
+	archived.TraceID = model.TraceID{Low: 5}
+	marshal := func(span *model.Span) ([]byte, error) { return proto.Marshal(span) }
+
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testIndexTable)).
+		WithArgs("frontend", start, end, 2).
+		WillReturnRows(getRows([]driver.Value{recent.TraceID.String()}))
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testArchiveIndexTable)).
+		WithArgs("frontend", start, end, 2).
+		WillReturnRows(getRows([]driver.Value{archived.TraceID.String()}))
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(recent.TraceID).
+		WillReturnRows(getEncodedSpans([]model.Span{recent}, marshal))
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testArchiveSpansTable)).
+		WithArgs(archived.TraceID).
+		WillReturnRows(getEncodedSpans([]model.Span{archived}, marshal))
+
+	traces, err := reader.FindTraces(context.Background(), params)
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+	assert.Equal(t, recent.TraceID, traces[0].Spans[0].TraceID)
+	assert.Equal(t, archived.TraceID, traces[1].Spans[0].TraceID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_FindTraceIDsWithArchiveSpansSearch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	archive := NewTraceReader(db, "", "", testArchiveSpansTable, WithSpansTableSearch(100))
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithArchiveSearch(archive))
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Minute)
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start, StartTimeMax: end, NumTraces: 2}
+	archived := testSpan
+	archived.TraceID = model.TraceID{Low: 5}
+	archived.Process = model.NewProcess("frontend", nil)
+	serialized, err := marshalSpan(&archived, EncodingJSON)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(fmt.Sprintf(testFederatedSearchQuery, testIndexTable)).
+		WithArgs("frontend", start, end, 2).
+		WillReturnRows(getRows([]driver.Value{model.TraceID{Low: 1}.String()}))
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT model FROM %s WHERE timestamp >= ? AND timestamp <= ? ORDER BY timestamp DESC LIMIT ?",
+		testArchiveSpansTable,
+	)).
+		WithArgs(start, end, 100).
+		WillReturnRows(getRows([]driver.Value{serialized}))
+
+	found, err := reader.FindTraceIDs(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}, archived.TraceID}, found, "the archive table is scanned without its index")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
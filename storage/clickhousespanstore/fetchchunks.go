@@ -0,0 +1,81 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go"
+)
+
+// WithFetchChunkSize fetches spans of at most size traces per query, the queries are run concurrently and their
+// spans merged, so that fetching many traces, e.g. 1500 found by a search, does not exceed max_query_size
+func WithFetchChunkSize(size int) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.fetchChunkSize = size
+	}
+}
+
+// getStoredSpans returns serialized spans of the traces, in chunks of fetchChunkSize traces fetched concurrently.
+// Spans of chunks are in the order of the chunks.
+func (r *TraceReader) getStoredSpans(ctx context.Context, traceIDs []model.TraceID) (storedSpans, error) {
+	if r.fetchChunkSize <= 0 || len(traceIDs) <= r.fetchChunkSize {
+		return r.getChunkSpans(ctx, traceIDs)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		chunks  = (len(traceIDs) + r.fetchChunkSize - 1) / r.fetchChunkSize
+		results = make([]storedSpans, chunks)
+		errs    = make([]error, chunks)
+	)
+	for chunk := 0; chunk < chunks; chunk++ {
+		start, end := chunk*r.fetchChunkSize, (chunk+1)*r.fetchChunkSize
+		if end > len(traceIDs) {
+			end = len(traceIDs)
+		}
+		wg.Add(1)
+		go func(chunk int, traceIDs []model.TraceID) {
+			defer wg.Done()
+			span, ctx := opentracing.StartSpanFromContext(ctx, "getTracesChunk")
+			defer span.Finish()
+			results[chunk], errs[chunk] = r.getChunkSpans(ctx, traceIDs)
+		}(chunk, traceIDs[start:end])
+	}
+	wg.Wait()
+
+	var stored storedSpans
+	for chunk, result := range results {
+		if errs[chunk] != nil {
+			return storedSpans{}, errs[chunk]
+		}
+		stored.models = append(stored.models, result.models...)
+		stored.traceIDs = append(stored.traceIDs, result.traceIDs...)
+	}
+	return stored, nil
+}
+
+// getChunkSpans returns serialized spans of the traces from the traces table, if there is one,
+// and spans of traces not found in it from the spans table
+func (r *TraceReader) getChunkSpans(ctx context.Context, traceIDs []model.TraceID) (storedSpans, error) {
+	var (
+		stored storedSpans
+		err    error
+	)
+	missing := traceIDs
+	if r.tracesTable != "" {
+		stored, missing, err = r.getTraceModels(ctx, traceIDs)
+		if err != nil {
+			return storedSpans{}, err
+		}
+	}
+	if len(missing) > 0 {
+		spanModels, err := r.getSpanModels(ctx, missing)
+		if err != nil {
+			return storedSpans{}, err
+		}
+		stored.models = append(stored.models, spanModels.models...)
+		stored.traceIDs = append(stored.traceIDs, spanModels.traceIDs...)
+	}
+	return stored, nil
+}
@@ -0,0 +1,74 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_WithFetchChunkSize(t *testing.T) {
+	spans := make([]model.Span, 3)
+	traceIDs := make([]model.TraceID, len(spans))
+	models := make([]driver.Value, len(spans))
+	for i := range spans {
+		spans[i] = generateRandomSpan()
+		traceIDs[i] = spans[i].TraceID
+		spanJSON, err := json.Marshal(&spans[i])
+		require.NoError(t, err)
+		models[i] = spanJSON
+	}
+	firstChunk := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?,?)", testSpansTable)
+	secondChunk := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)
+
+	t.Run("chunks", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+		// Chunks are fetched concurrently
+		mock.MatchExpectationsInOrder(false)
+
+		mock.ExpectQuery(firstChunk).
+			WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+			WillReturnRows(getRows(models[:2]))
+		mock.ExpectQuery(secondChunk).
+			WithArgs(traceIDs[2].String()).
+			WillReturnRows(getRows(models[2:]))
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithFetchChunkSize(2))
+		traces, err := reader.getTraces(context.Background(), traceIDs)
+		require.NoError(t, err)
+		require.Len(t, traces, len(traceIDs))
+		for i, trace := range traces {
+			require.Len(t, trace.Spans, 1)
+			assert.Equal(t, traceIDs[i], trace.Spans[0].TraceID, "traces are in the order of their IDs")
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("failed chunk", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+		mock.MatchExpectationsInOrder(false)
+
+		mock.ExpectQuery(firstChunk).
+			WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+			WillReturnRows(getRows(models[:2]))
+		mock.ExpectQuery(secondChunk).
+			WithArgs(traceIDs[2].String()).
+			WillReturnError(errorMock)
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithFetchChunkSize(2))
+		_, err = reader.getTraces(context.Background(), traceIDs)
+		assert.ErrorIs(t, err, errorMock)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
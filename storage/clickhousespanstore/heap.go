@@ -46,9 +46,10 @@ func (workerHeap *workerHeap) RemoveWorker(worker *WriteWorker) error {
 	return nil
 }
 
-func (workerHeap *workerHeap) CLoseWorkers() {
+// StopWorkers stops retries of all workers without waiting for them
+func (workerHeap *workerHeap) StopWorkers() {
 	for _, item := range *workerHeap.elems {
-		item.worker.CLose()
+		item.worker.stop()
 	}
 }
 
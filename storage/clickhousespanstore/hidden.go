@@ -0,0 +1,254 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"google.golang.org/grpc/metadata"
+)
+
+var errPurgeNotSupported = errors.New("purging of traces is not supported with table rotation")
+
+// HiddenTraces hides traces from readers by tombstones, e.g. traces with sensitive data, until they are unhidden.
+// Tombstones take effect immediately, unlike deletion of spans by a mutation, which rewrites whole parts.
+// The latest tombstone of a trace decides whether it is hidden, so tombstones are never deleted.
+type HiddenTraces struct {
+	db           *sql.DB
+	table        TableName
+	tenantHeader string
+	// purgeTables are tables spans of purged traces are deleted from, on all nodes of the cluster if onCluster
+	purgeTables []TableName
+	onCluster   bool
+}
+
+// HiddenTracesOption configures optional behaviour of HiddenTraces
+type HiddenTracesOption func(hidden *HiddenTraces)
+
+// WithHiddenTracesTenantHeader hides traces of the tenant from the header of the request
+func WithHiddenTracesTenantHeader(header string) HiddenTracesOption {
+	return func(hidden *HiddenTraces) {
+		hidden.tenantHeader = header
+	}
+}
+
+// WithPurgeTables deletes spans of purged traces from the tables, from the local tables on all nodes if onCluster
+func WithPurgeTables(tables []TableName, onCluster bool) HiddenTracesOption {
+	return func(hidden *HiddenTraces) {
+		hidden.purgeTables = tables
+		hidden.onCluster = onCluster
+	}
+}
+
+// NewHiddenTraces returns HiddenTraces writing tombstones to the table
+func NewHiddenTraces(db *sql.DB, table TableName, opts ...HiddenTracesOption) *HiddenTraces {
+	hidden := &HiddenTraces{db: db, table: table}
+	for _, opt := range opts {
+		opt(hidden)
+	}
+	return hidden
+}
+
+// WithHiddenTraces skips traces hidden by tombstones in the table, as if they were not found
+func WithHiddenTraces(table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.hiddenTable = table
+	}
+}
+
+// Hide hides the traces from readers
+func (h *HiddenTraces) Hide(ctx context.Context, traceIDs []model.TraceID) error {
+	return h.write(ctx, traceIDs, true)
+}
+
+// Unhide shows the hidden traces to readers again, unless they were purged
+func (h *HiddenTraces) Unhide(ctx context.Context, traceIDs []model.TraceID) error {
+	return h.write(ctx, traceIDs, false)
+}
+
+func (h *HiddenTraces) write(ctx context.Context, traceIDs []model.TraceID, hidden bool) error {
+	columns, placeholders := "traceID, hidden, version", "?, ?, ?"
+	tenant, multiTenant := h.tenant(ctx)
+	if multiTenant {
+		columns, placeholders = "tenant, "+columns, "?, "+placeholders
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", h.table, columns, placeholders))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	// The version orders tombstones of a trace, e.g. hiding and unhiding it within a second
+	version := time.Now().UnixNano()
+	var flag int64
+	if hidden {
+		flag = 1
+	}
+	for _, traceID := range traceIDs {
+		args := []interface{}{traceID.String(), flag, version}
+		if multiTenant {
+			args = []interface{}{tenant, traceID.String(), flag, version}
+		}
+		if _, err := statement.Exec(args...); err != nil {
+			return err
+		}
+	}
+	committed = true
+	return tx.Commit()
+}
+
+// Purge deletes spans of the traces by mutations, which ClickHouse runs in the background.
+// Traces should be hidden first, so that they are not read while they are being deleted.
+func (h *HiddenTraces) Purge(ctx context.Context, traceIDs []model.TraceID) error {
+	if len(h.purgeTables) == 0 {
+		return errPurgeNotSupported
+	}
+	if len(traceIDs) == 0 {
+		return nil
+	}
+	onCluster := ""
+	if h.onCluster {
+		onCluster = " ON CLUSTER '{cluster}'"
+	}
+	args := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		args[i] = traceID.String()
+	}
+	condition := fmt.Sprintf("traceID IN (?%s)", strings.Repeat(", ?", len(traceIDs)-1))
+	if tenant, ok := h.tenant(ctx); ok {
+		condition += " AND tenant = ?"
+		args = append(args, tenant)
+	}
+	for _, table := range h.purgeTables {
+		//nolint:gosec  , G201: SQL string formatting
+		mutation := fmt.Sprintf("ALTER TABLE %s%s DELETE WHERE %s", table, onCluster, condition)
+		if _, err := h.db.ExecContext(ctx, mutation, args...); err != nil {
+			return fmt.Errorf("could not purge traces from %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// tenant returns the tenant of the request, false if tenants are not used
+func (h *HiddenTraces) tenant(ctx context.Context) (string, bool) {
+	if h.tenantHeader == "" {
+		return "", false
+	}
+	return TenantFromContext(ctx, h.tenantHeader), true
+}
+
+// ServeHTTP hides traces given by traceID query parameters on POST and unhides them on DELETE.
+// POST with purge=true also deletes spans of the traces in the background.
+// The tenant is taken from the HTTP header with the same name as the gRPC metadata key.
+func (h *HiddenTraces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h == nil {
+		http.Error(w, "hidden traces are not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	purge := query.Get("purge") == "true"
+	if purge && r.Method != http.MethodPost {
+		http.Error(w, "unhidden traces cannot be purged", http.StatusBadRequest)
+		return
+	}
+	values := query["traceID"]
+	if len(values) == 0 {
+		http.Error(w, "traceID is required", http.StatusBadRequest)
+		return
+	}
+	traceIDs := make([]model.TraceID, 0, len(values))
+	for _, value := range values {
+		traceID, err := model.TraceIDFromString(strings.TrimSpace(value))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid traceID %q", value), http.StatusBadRequest)
+			return
+		}
+		traceIDs = append(traceIDs, traceID)
+	}
+	if purge && len(h.purgeTables) == 0 {
+		http.Error(w, errPurgeNotSupported.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if h.tenantHeader != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(h.tenantHeader, r.Header.Get(h.tenantHeader)))
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		err = h.Hide(ctx, traceIDs)
+		if err == nil && purge {
+			err = h.Purge(ctx, traceIDs)
+		}
+	} else {
+		err = h.Unhide(ctx, traceIDs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := make([]string, len(traceIDs))
+	for i, traceID := range traceIDs {
+		result[i] = traceID.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"traceIDs": result, "hidden": r.Method == http.MethodPost, "purged": purge})
+}
+
+// withoutHidden returns the traces that are not hidden, in the same order
+func (r *TraceReader) withoutHidden(ctx context.Context, traceIDs []model.TraceID) ([]model.TraceID, error) {
+	if r.hiddenTable == "" || len(traceIDs) == 0 {
+		return traceIDs, nil
+	}
+	args := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		args[i] = traceID.String()
+	}
+	query := fmt.Sprintf("SELECT traceID FROM %s WHERE traceID IN (?%s)", r.hiddenTable, strings.Repeat(", ?", len(traceIDs)-1))
+	if r.multiTenant() {
+		query += " AND tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += " GROUP BY traceID HAVING argMax(hidden, version) = 1"
+
+	hidden, err := r.getTraceIDs(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(hidden) == 0 {
+		return traceIDs, nil
+	}
+	isHidden := make(map[model.TraceID]bool, len(hidden))
+	for _, traceID := range hidden {
+		isHidden[traceID] = true
+	}
+	visible := make([]model.TraceID, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		if !isHidden[traceID] {
+			visible = append(visible, traceID)
+		}
+	}
+	return visible, nil
+}
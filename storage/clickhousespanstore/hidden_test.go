@@ -0,0 +1,159 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testHiddenTable TableName = "test_hidden_traces"
+
+func TestHiddenTraces_HideAndUnhide(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0, 2)}
+	for _, hidden := range []int64{1, 0} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (tenant, traceID, hidden, version) VALUES (?, ?, ?, ?)", testHiddenTable))
+		for _, traceID := range traceIDs {
+			prep.ExpectExec().WithArgs("tenant_1", traceID.String(), hidden, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	hidden := NewHiddenTraces(db, testHiddenTable, WithHiddenTracesTenantHeader("x-tenant"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	require.NoError(t, hidden.Hide(ctx, traceIDs))
+	require.NoError(t, hidden.Unhide(ctx, traceIDs))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHiddenTraces_Purge(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0, 2)}
+	for _, table := range []TableName{testSpansTable, testIndexTable} {
+		mock.ExpectExec(fmt.Sprintf("ALTER TABLE %s ON CLUSTER '{cluster}' DELETE WHERE traceID IN (?, ?)", table)).
+			WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	hidden := NewHiddenTraces(db, testHiddenTable, WithPurgeTables([]TableName{testSpansTable, testIndexTable}, true))
+	require.NoError(t, hidden.Purge(context.Background(), traceIDs))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.ErrorIs(t, NewHiddenTraces(db, testHiddenTable).Purge(context.Background(), traceIDs), errPurgeNotSupported)
+}
+
+func TestHiddenTraces_ServeHTTP(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceID := model.NewTraceID(0, 1)
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (traceID, hidden, version) VALUES (?, ?, ?)", testHiddenTable)).
+		ExpectExec().WithArgs(traceID.String(), int64(1), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(fmt.Sprintf("ALTER TABLE %s DELETE WHERE traceID IN (?)", testSpansTable)).
+		WithArgs(traceID.String()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	hidden := NewHiddenTraces(db, testHiddenTable, WithPurgeTables([]TableName{testSpansTable}, false))
+	recorder := httptest.NewRecorder()
+	hidden.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/hidden-traces?traceID=1&purge=true", nil))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, map[string]interface{}{"traceIDs": []interface{}{traceID.String()}, "hidden": true, "purged": true}, response)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	tests := map[string]struct {
+		method       string
+		target       string
+		expectedCode int
+	}{
+		"no trace ID":        {method: http.MethodPost, target: "/api/hidden-traces", expectedCode: http.StatusBadRequest},
+		"invalid trace ID":   {method: http.MethodPost, target: "/api/hidden-traces?traceID=xyz", expectedCode: http.StatusBadRequest},
+		"purge unhidden":     {method: http.MethodDelete, target: "/api/hidden-traces?traceID=1&purge=true", expectedCode: http.StatusBadRequest},
+		"method not allowed": {method: http.MethodGet, target: "/api/hidden-traces?traceID=1", expectedCode: http.StatusMethodNotAllowed},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			hidden.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+
+	recorder = httptest.NewRecorder()
+	NewHiddenTraces(db, testHiddenTable).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/hidden-traces?traceID=1&purge=true", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var disabled *HiddenTraces
+	recorder = httptest.NewRecorder()
+	disabled.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/hidden-traces?traceID=1", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestTraceReader_HiddenTraces(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceID := model.NewTraceID(0, 1)
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT traceID FROM %s WHERE traceID IN (?) GROUP BY traceID HAVING argMax(hidden, version) = 1",
+		testHiddenTable,
+	)).
+		WithArgs(traceID.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID"}).AddRow(traceID.String()))
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithHiddenTraces(testHiddenTable))
+	_, err = reader.GetTrace(context.Background(), traceID)
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_withoutHidden(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0, 2), model.NewTraceID(0, 3)}
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT traceID FROM %s WHERE traceID IN (?, ?, ?) AND tenant = ? GROUP BY traceID HAVING argMax(hidden, version) = 1",
+		testHiddenTable,
+	)).
+		WithArgs(traceIDs[0].String(), traceIDs[1].String(), traceIDs[2].String(), "tenant_1").
+		WillReturnRows(sqlmock.NewRows([]string{"traceID"}).AddRow(traceIDs[1].String()))
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithHiddenTraces(testHiddenTable), WithReaderTenantHeader("x-tenant"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	visible, err := reader.withoutHidden(ctx, traceIDs)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{traceIDs[0], traceIDs[2]}, visible)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Nothing is queried without the table
+	visible, err = NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable).withoutHidden(ctx, traceIDs)
+	require.NoError(t, err)
+	assert.Equal(t, traceIDs, visible)
+}
@@ -0,0 +1,23 @@
+package clickhousespanstore
+
+import (
+	"time"
+)
+
+// WithHotIndex searches traces in the table of index rows written within the window instead of in the index table,
+// when the searched time range starts within the window
+func WithHotIndex(table TableName, window time.Duration) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.hotIndexTable = table
+		reader.hotIndexWindow = window
+	}
+}
+
+// searchedIndexTable returns the hot index table if it has all index rows of time ranges starting at start,
+// and the index table otherwise
+func (r *TraceReader) searchedIndexTable(start, now time.Time) TableName {
+	if r.hotIndexTable != "" && !start.Before(now.Add(-r.hotIndexWindow)) {
+		return r.hotIndexTable
+	}
+	return r.indexTable
+}
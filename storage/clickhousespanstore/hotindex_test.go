@@ -0,0 +1,64 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testHotIndexTable TableName = "jaeger_hot_index_local"
+
+func TestTraceReader_searchedIndexTable(t *testing.T) {
+	now := time.Now()
+	reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable, WithHotIndex(testHotIndexTable, time.Hour))
+	assert.Equal(t, testHotIndexTable, reader.searchedIndexTable(now.Add(-time.Hour), now))
+	assert.Equal(t, TableName(testIndexTable), reader.searchedIndexTable(now.Add(-time.Hour-time.Second), now))
+
+	withoutTable := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+	assert.Equal(t, TableName(testIndexTable), withoutTable.searchedIndexTable(now, now))
+}
+
+func TestTraceReader_FindTraceIDsHotIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithHotIndex(testHotIndexTable, 24*time.Hour))
+	end := time.Now().Truncate(time.Second)
+	// Progressive search scans the hot index for recent steps and the index table for earlier ones
+	start := end.Add(-48 * time.Hour)
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start, StartTimeMax: end, NumTraces: 2}
+	query := "SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s ORDER BY service, timestamp DESC LIMIT ?"
+	skip := " AND traceID NOT IN (?)"
+	found := model.TraceID{Low: 1}.String()
+
+	firstStep := end.Add(-3 * time.Hour)
+	mock.ExpectQuery(fmt.Sprintf(query, testHotIndexTable, "")).
+		WithArgs("frontend", firstStep, end, 2).
+		WillReturnRows(getRows([]driver.Value{found}))
+	secondStep := firstStep.Add(-6 * time.Hour)
+	mock.ExpectQuery(fmt.Sprintf(query, testHotIndexTable, skip)).
+		WithArgs("frontend", secondStep, firstStep, found, 1).
+		WillReturnRows(getRows([]driver.Value{}))
+	thirdStep := secondStep.Add(-12 * time.Hour)
+	mock.ExpectQuery(fmt.Sprintf(query, testHotIndexTable, skip)).
+		WithArgs("frontend", thirdStep, secondStep, found, 1).
+		WillReturnRows(getRows([]driver.Value{}))
+	mock.ExpectQuery(fmt.Sprintf(query, testIndexTable, skip)).
+		WithArgs("frontend", start, thirdStep, found, 1).
+		WillReturnRows(getRows([]driver.Value{model.TraceID{Low: 2}.String()}))
+
+	traceIDs, err := reader.FindTraceIDs(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}, {Low: 2}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,209 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of tables inserts are reported by, so that tables of rotated periods are reported together
+const (
+	insertedSpans      = "spans"
+	insertedIndex      = "index"
+	insertedCalls      = "calls"
+	insertedOperations = "operations"
+	insertedSpanLogs   = "span_logs"
+	insertedProcesses  = "processes"
+)
+
+const (
+	// maxProfiledInsertAge is how long inserts are looked up in the query log, ClickHouse flushes it every 7.5s
+	// by default, inserts not found within it, e.g. failed ones, are forgotten
+	maxProfiledInsertAge = 5 * time.Minute
+	// maxProfiledInsertsPerQuery limits the number of query IDs looked up by a query of the query log
+	maxProfiledInsertsPerQuery = 1000
+)
+
+var (
+	insertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_duration_seconds",
+		Help:    "Duration of successful inserts of batches measured by the plugin, by the kind of the table, spans, index, calls, operations, span_logs or processes",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"table"})
+	insertServerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_server_duration_seconds",
+		Help:    "Duration of inserts of batches reported by the query log of ClickHouse, by the kind of the table",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"table"})
+	insertWrittenRows = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_written_rows",
+		Help:    "Number of rows written by inserts of batches reported by the query log of ClickHouse, by the kind of the table",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 10),
+	}, []string{"table"})
+	insertWrittenBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_written_bytes",
+		Help:    "Number of bytes written by inserts of batches reported by the query log of ClickHouse, by the kind of the table",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"table"})
+)
+
+// insertQueryIDKey keeps the query ID of an insert in its context for inserts over HTTP,
+// the driver keeps it under its own key
+type insertQueryIDKey struct{}
+
+// InsertProfiler tags inserts of writers with query IDs and reports their durations, written rows and bytes
+// from system.query_log, so that time spent by ClickHouse can be told apart from time spent by the plugin
+// and the network, which jaeger_clickhouse_insert_duration_seconds includes.
+type InsertProfiler struct {
+	logger   hclog.Logger
+	db       *sql.DB
+	interval time.Duration
+
+	mutex sync.Mutex
+	// pending are tables of inserts not found in the query log yet by their query IDs
+	pending map[string]profiledInsert
+	finish  chan bool
+	done    sync.WaitGroup
+}
+
+// profiledInsert is an insert waiting for its entry in the query log
+type profiledInsert struct {
+	table string
+	at    time.Time
+}
+
+// WithInsertProfiler tags inserts with query IDs reported by the profiler
+func WithInsertProfiler(profiler *InsertProfiler) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.insertProfiler = profiler
+	}
+}
+
+// NewInsertProfiler returns an InsertProfiler reading the query log every interval. Inserts are looked up
+// in the query log of the node the plugin is connected to.
+func NewInsertProfiler(logger hclog.Logger, db *sql.DB, interval time.Duration) *InsertProfiler {
+	return &InsertProfiler{
+		logger:   logger,
+		db:       db,
+		interval: interval,
+		pending:  map[string]profiledInsert{},
+		finish:   make(chan bool),
+	}
+}
+
+// Start reports profiled inserts every interval in the background until the profiler is closed
+func (p *InsertProfiler) Start() {
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.finish:
+				return
+			case <-ticker.C:
+				if err := p.Report(); err != nil {
+					p.logger.Error("Could not read profiles of inserts from the query log", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops reporting profiled inserts
+func (p *InsertProfiler) Close() {
+	close(p.finish)
+	p.done.Wait()
+}
+
+// tag returns the context of an insert into the table of the kind with a new query ID
+func (p *InsertProfiler) tag(ctx context.Context, table string) context.Context {
+	if p == nil {
+		return ctx
+	}
+	//nolint:gosec  , G404: query IDs do not need a secure random generator
+	queryID := fmt.Sprintf("jaeger-clickhouse-%016x%016x", rand.Uint64(), rand.Uint64())
+	p.mutex.Lock()
+	p.pending[queryID] = profiledInsert{table: table, at: time.Now()}
+	p.mutex.Unlock()
+	return context.WithValue(clickhouse.WithQueryID(ctx, queryID), insertQueryIDKey{}, queryID)
+}
+
+// Report observes durations, written rows and bytes of inserts found in the query log and forgets them,
+// inserts not found for too long are forgotten as well
+func (p *InsertProfiler) Report() error {
+	p.mutex.Lock()
+	queryIDs := make([]interface{}, 0, len(p.pending))
+	for queryID, insert := range p.pending {
+		if time.Since(insert.at) > maxProfiledInsertAge {
+			delete(p.pending, queryID)
+		} else if len(queryIDs) < maxProfiledInsertsPerQuery {
+			queryIDs = append(queryIDs, queryID)
+		}
+	}
+	p.mutex.Unlock()
+	if len(queryIDs) == 0 {
+		return nil
+	}
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT query_id, query_duration_ms, written_rows, written_bytes FROM system.query_log"+
+			" WHERE event_date >= yesterday() AND type = 'QueryFinish' AND query_id IN (%s)",
+		"?"+strings.Repeat(",?", len(queryIDs)-1),
+	)
+	rows, err := p.db.Query(query, queryIDs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			queryID                               string
+			durationMs, writtenRows, writtenBytes uint64
+		)
+		if err := rows.Scan(&queryID, &durationMs, &writtenRows, &writtenBytes); err != nil {
+			return err
+		}
+		p.mutex.Lock()
+		insert, ok := p.pending[queryID]
+		delete(p.pending, queryID)
+		p.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		insertServerDuration.WithLabelValues(insert.table).Observe((time.Duration(durationMs) * time.Millisecond).Seconds())
+		insertWrittenRows.WithLabelValues(insert.table).Observe(float64(writtenRows))
+		insertWrittenBytes.WithLabelValues(insert.table).Observe(float64(writtenBytes))
+	}
+	return rows.Err()
+}
+
+// startInsert returns the context of an insert into the table of the kind, tagged with a query ID when inserts are
+// profiled, and a function observing the duration of the insert if it succeeded and returning its error
+func (worker *WriteWorker) startInsert(table string) (context.Context, func(err error) error) {
+	ctx := worker.params.insertProfiler.tag(context.Background(), table)
+	start := time.Now()
+	return ctx, func(err error) error {
+		if err == nil {
+			insertDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+		}
+		return err
+	}
+}
+
+// insertQueryID returns the query ID the insert is tagged with, empty if inserts are not profiled
+func insertQueryID(ctx context.Context) string {
+	queryID, _ := ctx.Value(insertQueryIDKey{}).(string)
+	return queryID
+}
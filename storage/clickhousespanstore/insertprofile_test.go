@@ -0,0 +1,92 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	require.NoError(t, observer.(prometheus.Metric).Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestInsertProfiler_Report(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	profiler := NewInsertProfiler(hclog.NewNullLogger(), db, time.Minute)
+	queryID := insertQueryID(profiler.tag(context.Background(), insertedCalls))
+	assert.True(t, strings.HasPrefix(queryID, "jaeger-clickhouse-"), queryID)
+	profiler.pending["expired"] = profiledInsert{table: insertedCalls, at: time.Now().Add(-maxProfiledInsertAge - time.Second)}
+
+	mock.ExpectQuery("SELECT query_id, query_duration_ms, written_rows, written_bytes FROM system.query_log" +
+		" WHERE event_date >= yesterday() AND type = 'QueryFinish' AND query_id IN (?)").
+		WithArgs(queryID).
+		WillReturnRows(sqlmock.NewRows([]string{"query_id", "query_duration_ms", "written_rows", "written_bytes"}).
+			AddRow(queryID, uint64(120), uint64(1000), uint64(65536)))
+
+	rows := sampleCount(t, insertWrittenRows.WithLabelValues(insertedCalls))
+	require.NoError(t, profiler.Report())
+	assert.Equal(t, rows+1, sampleCount(t, insertWrittenRows.WithLabelValues(insertedCalls)))
+	assert.Empty(t, profiler.pending, "found and expired inserts are forgotten")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	require.NoError(t, profiler.Report(), "the query log is not read without pending inserts")
+}
+
+func TestWriteWorker_InsertDuration(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	worker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable)
+	worker.params.insertProfiler = NewInsertProfiler(hclog.NewNullLogger(), db, time.Minute)
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO test_index_table (timestamp, traceID, service, operation, durationUs, tags.key, tags.value)" +
+		" VALUES (?, ?, ?, ?, ?, ?, ?)").
+		ExpectExec().
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	inserts := sampleCount(t, insertDuration.WithLabelValues(insertedIndex))
+	span := testSpan
+	require.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.Equal(t, inserts+1, sampleCount(t, insertDuration.WithLabelValues(insertedIndex)))
+	assert.Len(t, worker.params.insertProfiler.pending, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWriteWorker_writeModelBatchRowBinaryQueryID(t *testing.T) {
+	var queryID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queryID = r.URL.Query().Get("query_id")
+	}))
+	defer server.Close()
+
+	profiler := NewInsertProfiler(hclog.NewNullLogger(), nil, time.Minute)
+	worker := WriteWorker{params: &WriteParams{
+		spansTable:     testSpansTable,
+		encoding:       EncodingJSON,
+		rowBinary:      NewRowBinaryInserter(server.Client(), server.URL, "", "default", "", nil),
+		insertProfiler: profiler,
+	}}
+	span := testSpan
+	require.NoError(t, worker.writeModelBatch([]*model.Span{&span}))
+	assert.Contains(t, profiler.pending, queryID, "inserts over HTTP are tagged with query IDs")
+}
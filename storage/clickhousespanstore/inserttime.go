@@ -0,0 +1,43 @@
+package clickhousespanstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AsOfTag is a search tag restricting searches to spans inserted at or before a time in RFC 3339 format,
+// e.g. to reconstruct search results during an incident before late spans arrived, when insert times are indexed
+const AsOfTag = "jaeger.as_of"
+
+var errInvalidAsOf = errors.New("as of search tag must be a time in RFC 3339 format")
+
+// WithWriterInsertTimeIndex writes the insert time of index rows to the insertedAt column of the index table
+func WithWriterInsertTimeIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexInsertTime = true
+	}
+}
+
+// WithReaderInsertTimeIndex restricts searches with the jaeger.as_of search tag by the insertedAt column
+// of the index table
+func WithReaderInsertTimeIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.insertTimeIndex = true
+	}
+}
+
+// isAsOfTag returns whether the search tag restricts the search by insert times
+func (r *TraceReader) isAsOfTag(key string) bool {
+	return key == AsOfTag && r.insertTimeIndex && r.schema.hasColumn(insertedAtColumn)
+}
+
+// asOfCondition matches index rows inserted at or before the time of the search tag value
+func asOfCondition(value string) (string, []interface{}, error) {
+	asOf, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s=%q", errInvalidAsOf, AsOfTag, value)
+	}
+	return fmt.Sprintf(" AND %s <= ?", insertedAtColumn), []interface{}{asOf}, nil
+}
@@ -0,0 +1,108 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestSpanWriter_InsertTimeIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	worker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable)
+	worker.params.indexInsertTime = true
+	worker.insertedAt = time.Unix(1628000000, 0)
+
+	span := testSpan
+	keys, values := uniqueTagsForSpan(&span)
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, insertedAt, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(args[:5:5], worker.insertedAt, keys, values)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanReader_findTraceIDsInRangeAsOf(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	asOf := time.Date(2021, 8, 3, 14, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		condition     string
+		conditionArgs []driver.Value
+	}{
+		"insert times indexed": {
+			options:       []TraceReaderOption{WithReaderInsertTimeIndex()},
+			condition:     " AND insertedAt <= ?",
+			conditionArgs: []driver.Value{asOf},
+		},
+		"insert times not indexed": {
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{AsOfTag, AsOfTag, "2021-08-03T14:00:00Z"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+			mock.
+				ExpectQuery(fmt.Sprintf(
+					"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+						" ORDER BY service, timestamp DESC LIMIT ?",
+					testIndexTable,
+					test.condition,
+				)).
+				WithArgs(append(args, testNumTraces)...).
+				WillReturnRows(getRows([]driver.Value{"1"}))
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{
+					ServiceName: service,
+					NumTraces:   testNumTraces,
+					Tags:        map[string]string{AsOfTag: "2021-08-03T14:00:00Z"},
+				},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			require.NoError(t, err)
+			assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderInsertTimeIndex())
+	_, err = traceReader.findTraceIDsInRange(
+		context.Background(),
+		&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: map[string]string{AsOfTag: "yesterday"}},
+		start,
+		end,
+		nil)
+	assert.ErrorIs(t, err, errInvalidAsOf)
+}
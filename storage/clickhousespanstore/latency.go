@@ -0,0 +1,69 @@
+package clickhousespanstore
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceIDExemplarLabel is the exemplar label with the trace ID, as expected by Grafana to link exemplars to traces
+const traceIDExemplarLabel = "trace_id"
+
+// LatencyHistogram observes durations of written spans per service, and optionally per operation, with trace IDs
+// of the spans as exemplars, so that latency spikes on dashboards link to representative traces. Exemplars are
+// exposed only in the OpenMetrics format, the latest observed span is the exemplar of every bucket.
+type LatencyHistogram struct {
+	histogram   *prometheus.HistogramVec
+	byOperation bool
+}
+
+var _ prometheus.Collector = (*LatencyHistogram)(nil)
+
+// NewLatencyHistogram returns a LatencyHistogram with the upper bounds of buckets in seconds,
+// prometheus.DefBuckets if none are given
+func NewLatencyHistogram(buckets []float64, byOperation bool) *LatencyHistogram {
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	labels := []string{"service"}
+	if byOperation {
+		labels = append(labels, "operation")
+	}
+	return &LatencyHistogram{
+		histogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "jaeger_clickhouse_span_duration_seconds",
+			Help:    "Durations of written spans with their trace IDs as exemplars",
+			Buckets: buckets,
+		}, labels),
+		byOperation: byOperation,
+	}
+}
+
+// WithLatencyHistogram observes durations of written spans by the histogram, it has to be registered separately
+func WithLatencyHistogram(histogram *LatencyHistogram) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.latency = histogram
+	}
+}
+
+// Describe implements prometheus.Collector
+func (h *LatencyHistogram) Describe(descs chan<- *prometheus.Desc) {
+	h.histogram.Describe(descs)
+}
+
+// Collect implements prometheus.Collector
+func (h *LatencyHistogram) Collect(metrics chan<- prometheus.Metric) {
+	h.histogram.Collect(metrics)
+}
+
+func (h *LatencyHistogram) observe(span *model.Span) {
+	if h == nil || span.Process == nil {
+		return
+	}
+	labels := []string{span.Process.ServiceName}
+	if h.byOperation {
+		labels = append(labels, span.OperationName)
+	}
+	observer := h.histogram.WithLabelValues(labels...)
+	exemplar := prometheus.Labels{traceIDExemplarLabel: span.TraceID.String()}
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(span.Duration.Seconds(), exemplar)
+}
@@ -0,0 +1,61 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram_observe(t *testing.T) {
+	histogram := NewLatencyHistogram([]float64{0.1, 1}, true)
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(histogram))
+
+	span := &model.Span{
+		TraceID:       model.TraceID{Low: 0xabc},
+		OperationName: "GET /",
+		Duration:      500 * time.Millisecond,
+		Process:       &model.Process{ServiceName: "service"},
+	}
+	histogram.observe(span)
+	histogram.observe(&model.Span{Duration: time.Second})
+	(*LatencyHistogram)(nil).observe(span)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	require.Len(t, families[0].Metric, 1)
+	metric := families[0].Metric[0]
+	labels := make(map[string]string)
+	for _, label := range metric.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, map[string]string{"service": "service", "operation": "GET /"}, labels)
+	assert.Equal(t, uint64(1), metric.Histogram.GetSampleCount())
+
+	buckets := metric.Histogram.Bucket
+	require.Len(t, buckets, 2)
+	assert.Nil(t, buckets[0].Exemplar)
+	require.NotNil(t, buckets[1].Exemplar)
+	assert.Equal(t, 0.5, buckets[1].Exemplar.GetValue())
+	require.Len(t, buckets[1].Exemplar.Label, 1)
+	assert.Equal(t, traceIDExemplarLabel, buckets[1].Exemplar.Label[0].GetName())
+	assert.Equal(t, "0000000000000abc", buckets[1].Exemplar.Label[0].GetValue())
+}
+
+func TestNewLatencyHistogram_defaultBuckets(t *testing.T) {
+	histogram := NewLatencyHistogram(nil, false)
+	histogram.observe(&model.Span{Duration: time.Second, Process: &model.Process{ServiceName: "service"}})
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(histogram))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	assert.Len(t, families[0].Metric[0].Histogram.Bucket, len(prometheus.DefBuckets))
+	assert.Len(t, families[0].Metric[0].Label, 1)
+}
@@ -30,6 +30,10 @@ func (conv ConverterMock) ConvertValue(v interface{}) (driver.Value, error) {
 		return driver.Value(t), nil
 	case int:
 		return driver.Value(t), nil
+	case uint64:
+		return driver.Value(t), nil
+	case nil:
+		return nil, nil
 	case []string:
 		return driver.Value(fmt.Sprint(t)), nil
 	default:
@@ -0,0 +1,40 @@
+package clickhousespanstore
+
+import (
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// DefaultNumTraces is the number of traces found by searches without a positive number of traces
+const DefaultNumTraces = 20
+
+// WithNumTracesLimits finds defaultLimit traces for searches without a positive number of traces, e.g. searches
+// through the API omitting it, and at most maxLimit traces for any search, so that a single search does not load
+// traces without bound. A non-positive default keeps DefaultNumTraces, a non-positive maximum does not cap searches.
+func WithNumTracesLimits(defaultLimit, maxLimit int) TraceReaderOption {
+	return func(reader *TraceReader) {
+		if defaultLimit > 0 {
+			reader.defaultNumTraces = defaultLimit
+		}
+		if maxLimit > 0 {
+			reader.maxNumTraces = maxLimit
+		}
+	}
+}
+
+// limitNumTraces returns the search parameters with the number of traces defaulted and capped,
+// the parameters themselves are not modified
+func (r *TraceReader) limitNumTraces(params *spanstore.TraceQueryParameters) *spanstore.TraceQueryParameters {
+	numTraces := params.NumTraces
+	if numTraces <= 0 {
+		numTraces = r.defaultNumTraces
+	}
+	if r.maxNumTraces > 0 && numTraces > r.maxNumTraces {
+		numTraces = r.maxNumTraces
+	}
+	if numTraces == params.NumTraces {
+		return params
+	}
+	limited := *params
+	limited.NumTraces = numTraces
+	return &limited
+}
@@ -0,0 +1,72 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_limitNumTraces(t *testing.T) {
+	tests := map[string]struct {
+		opts      []TraceReaderOption
+		numTraces int
+		expected  int
+	}{
+		"positive":                   {numTraces: 10, expected: 10},
+		"zero":                       {numTraces: 0, expected: DefaultNumTraces},
+		"negative":                   {numTraces: -1, expected: DefaultNumTraces},
+		"no maximum":                 {numTraces: 100_000, expected: 100_000},
+		"configured default":         {opts: []TraceReaderOption{WithNumTracesLimits(50, 0)}, numTraces: 0, expected: 50},
+		"configured maximum":         {opts: []TraceReaderOption{WithNumTracesLimits(0, 100)}, numTraces: 200, expected: 100},
+		"default above maximum":      {opts: []TraceReaderOption{WithNumTracesLimits(200, 100)}, numTraces: 0, expected: 100},
+		"non-positive limits":        {opts: []TraceReaderOption{WithNumTracesLimits(-1, -1)}, numTraces: 0, expected: DefaultNumTraces},
+		"positive within configured": {opts: []TraceReaderOption{WithNumTracesLimits(50, 100)}, numTraces: 70, expected: 70},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable, test.opts...)
+			params := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: test.numTraces}
+			limited := reader.limitNumTraces(params)
+			assert.Equal(t, test.expected, limited.NumTraces)
+			assert.Equal(t, "frontend", limited.ServiceName)
+			assert.Equal(t, test.numTraces, params.NumTraces, "the search parameters are not modified")
+		})
+	}
+}
+
+func TestTraceReader_FindTraceIDsDefaultNumTraces(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithNumTracesLimits(5, 0))
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Minute)
+	traceID := model.TraceID{Low: 1}
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+		)).
+		WithArgs("frontend", start, end, 5).
+		WillReturnRows(getRows([]driver.Value{traceID.String()}))
+
+	traceIDs, err := reader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: start,
+		StartTimeMax: end,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{traceID}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
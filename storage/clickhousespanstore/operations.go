@@ -0,0 +1,121 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// WithOperationsTable writes operations of spans to the table, for ClickHouse without materialized views
+// or when the materialized view of the index table is disabled. Spans of every batch are counted by day, service,
+// operation and span kind, so the table is upserted with a row per operation on every flush.
+func WithOperationsTable(table TableName) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.operationsTable = table
+	}
+}
+
+// operationKey is a row of the operations table
+type operationKey struct {
+	date      time.Time
+	service   string
+	operation string
+	spanKind  string
+}
+
+// countOperations counts spans of the batch by their rows of the operations table,
+// rows are sorted by the order of the table. Span kinds are left out withoutSpanKind.
+func countOperations(batch []*model.Span, withoutSpanKind bool) ([]operationKey, map[operationKey]uint64) {
+	counts := make(map[operationKey]uint64)
+	for _, span := range batch {
+		start := span.StartTime.UTC()
+		key := operationKey{
+			date:      time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC),
+			service:   span.Process.ServiceName,
+			operation: span.OperationName,
+		}
+		// Span kinds are stored as they are like the materialized view of the index table does
+		if kind, ok := model.KeyValues(span.Tags).FindByKey(spanKindTag); ok && !withoutSpanKind {
+			key.spanKind = kind.AsString()
+		}
+		counts[key]++
+	}
+
+	keys := make([]operationKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if !a.date.Equal(b.date) {
+			return a.date.Before(b.date)
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		return a.spanKind < b.spanKind
+	})
+	return keys, counts
+}
+
+func (worker *WriteWorker) writeOperationsBatch(batch []*model.Span) error {
+	keys, counts := countOperations(batch, worker.params.operationsWithoutSpanKind)
+
+	ctx, observe := worker.startInsert(insertedOperations)
+	tx, err := worker.params.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{"date", "service", "operation", "count", "spankind"}
+	if worker.params.operationsWithoutSpanKind {
+		columns = columns[:len(columns)-1]
+	}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		worker.params.operationsTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, key := range keys {
+		args := []interface{}{key.date, key.service, key.operation, int64(counts[key])}
+		if !worker.params.operationsWithoutSpanKind {
+			args = append(args, key.spanKind)
+		}
+		if worker.params.multiTenant {
+			args = append([]interface{}{worker.tenant}, args...)
+		}
+		if _, err = statement.Exec(args...); err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	return observe(tx.Commit())
+}
@@ -0,0 +1,366 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// Span kinds of OTLP
+const (
+	otlpSpanKindUnspecified = iota
+	otlpSpanKindInternal
+	otlpSpanKindServer
+	otlpSpanKindClient
+	otlpSpanKindProducer
+	otlpSpanKindConsumer
+)
+
+// Status codes of OTLP
+const (
+	otlpStatusUnset = iota
+	otlpStatusOK
+	otlpStatusError
+)
+
+var otlpSpanKinds = map[string]int{
+	"internal": otlpSpanKindInternal,
+	"server":   otlpSpanKindServer,
+	"client":   otlpSpanKindClient,
+	"producer": otlpSpanKindProducer,
+	"consumer": otlpSpanKindConsumer,
+}
+
+// otlpTraces is ExportTraceServiceRequest of OTLP in its JSON encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource                    otlpResource       `json:"resource"`
+	InstrumentationLibrarySpans []otlpLibrarySpans `json:"instrumentationLibrarySpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpLibrarySpans struct {
+	InstrumentationLibrary otlpLibrary `json:"instrumentationLibrary"`
+	Spans                  []otlpSpan  `json:"spans"`
+}
+
+type otlpLibrary struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name,omitempty"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue has exactly one of the values set, 64-bit integers are strings in JSON encoding of OTLP
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BytesValue  []byte   `json:"bytesValue,omitempty"`
+}
+
+// toOTLP converts the span to OTLP the way OpenTelemetry Collector translates Jaeger spans,
+// tags describing span kind, status and instrumentation library become the corresponding OTLP fields
+func toOTLP(span *model.Span) otlpTraces {
+	converted := otlpSpan{
+		TraceID:           otlpTraceID(span.TraceID),
+		SpanID:            otlpSpanID(span.SpanID),
+		Name:              span.OperationName,
+		StartTimeUnixNano: otlpTime(span.StartTime.UnixNano()),
+		EndTimeUnixNano:   otlpTime(span.StartTime.Add(span.Duration).UnixNano()),
+	}
+	parentSpanID := span.ParentSpanID()
+	if parentSpanID != 0 {
+		converted.ParentSpanID = otlpSpanID(parentSpanID)
+	}
+	for _, ref := range span.References {
+		if ref.TraceID == span.TraceID && ref.SpanID == parentSpanID {
+			continue
+		}
+		converted.Links = append(converted.Links, otlpLink{TraceID: otlpTraceID(ref.TraceID), SpanID: otlpSpanID(ref.SpanID)})
+	}
+
+	var library otlpLibrary
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case "span.kind":
+			converted.Kind = otlpSpanKinds[tag.AsString()]
+		case "error":
+			if tag.AsString() == "true" {
+				converted.Status.Code = otlpStatusError
+			}
+		case "otel.status_code":
+			switch tag.AsString() {
+			case "OK":
+				converted.Status.Code = otlpStatusOK
+			case "ERROR":
+				converted.Status.Code = otlpStatusError
+			}
+		case "otel.status_description":
+			converted.Status.Message = tag.AsString()
+		case "otel.library.name":
+			library.Name = tag.AsString()
+		case "otel.library.version":
+			library.Version = tag.AsString()
+		default:
+			converted.Attributes = append(converted.Attributes, otlpAttribute(tag))
+		}
+	}
+
+	for _, log := range span.Logs {
+		event := otlpEvent{TimeUnixNano: otlpTime(log.Timestamp.UnixNano())}
+		for _, field := range log.Fields {
+			if field.Key == "event" && field.VType == model.StringType {
+				event.Name = field.VStr
+				continue
+			}
+			event.Attributes = append(event.Attributes, otlpAttribute(field))
+		}
+		converted.Events = append(converted.Events, event)
+	}
+
+	resource := otlpResource{Attributes: []otlpKeyValue{}}
+	if span.Process != nil {
+		serviceName := span.Process.ServiceName
+		resource.Attributes = append(resource.Attributes, otlpKeyValue{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}})
+		for _, tag := range span.Process.Tags {
+			resource.Attributes = append(resource.Attributes, otlpAttribute(tag))
+		}
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: resource,
+		InstrumentationLibrarySpans: []otlpLibrarySpans{{
+			InstrumentationLibrary: library,
+			Spans:                  []otlpSpan{converted},
+		}},
+	}}}
+}
+
+func otlpAttribute(tag model.KeyValue) otlpKeyValue {
+	attribute := otlpKeyValue{Key: tag.Key}
+	switch tag.VType {
+	case model.BoolType:
+		value := tag.Bool()
+		attribute.Value.BoolValue = &value
+	case model.Int64Type:
+		value := strconv.FormatInt(tag.Int64(), 10)
+		attribute.Value.IntValue = &value
+	case model.Float64Type:
+		value := tag.Float64()
+		attribute.Value.DoubleValue = &value
+	case model.BinaryType:
+		attribute.Value.BytesValue = tag.Binary()
+	default:
+		value := tag.AsString()
+		attribute.Value.StringValue = &value
+	}
+	return attribute
+}
+
+// fromOTLP converts spans of OTLP back to Jaeger spans, the reverse of toOTLP
+func fromOTLP(traces otlpTraces) ([]*model.Span, error) {
+	var spans []*model.Span
+	for _, resourceSpans := range traces.ResourceSpans {
+		process := &model.Process{}
+		for _, attribute := range resourceSpans.Resource.Attributes {
+			if attribute.Key == "service.name" && attribute.Value.StringValue != nil {
+				process.ServiceName = *attribute.Value.StringValue
+				continue
+			}
+			tag, err := fromOTLPAttribute(attribute)
+			if err != nil {
+				return nil, err
+			}
+			process.Tags = append(process.Tags, tag)
+		}
+		for _, librarySpans := range resourceSpans.InstrumentationLibrarySpans {
+			for _, otlp := range librarySpans.Spans {
+				span, err := fromOTLPSpan(otlp, librarySpans.InstrumentationLibrary)
+				if err != nil {
+					return nil, fmt.Errorf("invalid OTLP span %q: %w", otlp.SpanID, err)
+				}
+				span.Process = process
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans, nil
+}
+
+func fromOTLPSpan(otlp otlpSpan, library otlpLibrary) (*model.Span, error) {
+	traceID, err := model.TraceIDFromString(otlp.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := model.SpanIDFromString(otlp.SpanID)
+	if err != nil {
+		return nil, err
+	}
+	start, err := fromOTLPTime(otlp.StartTimeUnixNano)
+	if err != nil {
+		return nil, err
+	}
+	end, err := fromOTLPTime(otlp.EndTimeUnixNano)
+	if err != nil {
+		return nil, err
+	}
+	span := &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: otlp.Name,
+		StartTime:     start,
+		Duration:      end.Sub(start),
+	}
+	if otlp.ParentSpanID != "" {
+		parentSpanID, err := model.SpanIDFromString(otlp.ParentSpanID)
+		if err != nil {
+			return nil, err
+		}
+		span.References = append(span.References, model.NewChildOfRef(traceID, parentSpanID))
+	}
+	for _, link := range otlp.Links {
+		linkedTraceID, err := model.TraceIDFromString(link.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		linkedSpanID, err := model.SpanIDFromString(link.SpanID)
+		if err != nil {
+			return nil, err
+		}
+		span.References = append(span.References, model.NewFollowsFromRef(linkedTraceID, linkedSpanID))
+	}
+
+	for kind, value := range otlpSpanKinds {
+		if value == otlp.Kind {
+			span.Tags = append(span.Tags, model.String("span.kind", kind))
+		}
+	}
+	switch otlp.Status.Code {
+	case otlpStatusOK:
+		span.Tags = append(span.Tags, model.String("otel.status_code", "OK"))
+	case otlpStatusError:
+		span.Tags = append(span.Tags, model.Bool("error", true))
+	}
+	if otlp.Status.Message != "" {
+		span.Tags = append(span.Tags, model.String("otel.status_description", otlp.Status.Message))
+	}
+	if library.Name != "" {
+		span.Tags = append(span.Tags, model.String("otel.library.name", library.Name))
+	}
+	if library.Version != "" {
+		span.Tags = append(span.Tags, model.String("otel.library.version", library.Version))
+	}
+	for _, attribute := range otlp.Attributes {
+		tag, err := fromOTLPAttribute(attribute)
+		if err != nil {
+			return nil, err
+		}
+		span.Tags = append(span.Tags, tag)
+	}
+
+	for _, event := range otlp.Events {
+		timestamp, err := fromOTLPTime(event.TimeUnixNano)
+		if err != nil {
+			return nil, err
+		}
+		log := model.Log{Timestamp: timestamp}
+		if event.Name != "" {
+			log.Fields = append(log.Fields, model.String("event", event.Name))
+		}
+		for _, attribute := range event.Attributes {
+			field, err := fromOTLPAttribute(attribute)
+			if err != nil {
+				return nil, err
+			}
+			log.Fields = append(log.Fields, field)
+		}
+		span.Logs = append(span.Logs, log)
+	}
+	return span, nil
+}
+
+func fromOTLPAttribute(attribute otlpKeyValue) (model.KeyValue, error) {
+	value := attribute.Value
+	switch {
+	case value.BoolValue != nil:
+		return model.Bool(attribute.Key, *value.BoolValue), nil
+	case value.IntValue != nil:
+		converted, err := strconv.ParseInt(*value.IntValue, 10, 64)
+		if err != nil {
+			return model.KeyValue{}, fmt.Errorf("invalid integer attribute %q: %w", attribute.Key, err)
+		}
+		return model.Int64(attribute.Key, converted), nil
+	case value.DoubleValue != nil:
+		return model.Float64(attribute.Key, *value.DoubleValue), nil
+	case value.BytesValue != nil:
+		return model.Binary(attribute.Key, value.BytesValue), nil
+	case value.StringValue != nil:
+		return model.String(attribute.Key, *value.StringValue), nil
+	default:
+		return model.String(attribute.Key, ""), nil
+	}
+}
+
+func fromOTLPTime(unixNano string) (time.Time, error) {
+	converted, err := strconv.ParseInt(unixNano, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, converted), nil
+}
+
+// otlpTraceID returns the trace ID in hex with leading zeros, unlike model.TraceID.String
+func otlpTraceID(traceID model.TraceID) string {
+	return fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+}
+
+func otlpSpanID(spanID model.SpanID) string {
+	return fmt.Sprintf("%016x", uint64(spanID))
+}
+
+func otlpTime(unixNano int64) string {
+	return strconv.FormatInt(unixNano, 10)
+}
@@ -0,0 +1,123 @@
+package clickhousespanstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToOTLP(t *testing.T) {
+	start := time.Unix(1628000000, 500)
+	span := model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(2),
+		OperationName: "GET /",
+		References: []model.SpanRef{
+			model.NewChildOfRef(model.NewTraceID(0, 1), model.NewSpanID(3)),
+			model.NewFollowsFromRef(model.NewTraceID(4, 5), model.NewSpanID(6)),
+		},
+		StartTime: start,
+		Duration:  time.Second,
+		Tags: []model.KeyValue{
+			model.String("span.kind", "server"),
+			model.Bool("error", true),
+			model.String("otel.status_description", "failed"),
+			model.String("otel.library.name", "net/http"),
+			model.Int64("http.status_code", 500),
+			model.Float64("ratio", 0.5),
+			model.Binary("payload", []byte{1, 2}),
+		},
+		Logs: []model.Log{{
+			Timestamp: start,
+			Fields:    []model.KeyValue{model.String("event", "retry"), model.Int64("attempt", 2)},
+		}},
+		Process: model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "host")}),
+	}
+
+	converted, err := json.Marshal(toOTLP(&span))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceSpans": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "frontend"}},
+			{"key": "hostname", "value": {"stringValue": "host"}}
+		]},
+		"instrumentationLibrarySpans": [{
+			"instrumentationLibrary": {"name": "net/http"},
+			"spans": [{
+				"traceId": "00000000000000000000000000000001",
+				"spanId": "0000000000000002",
+				"parentSpanId": "0000000000000003",
+				"name": "GET /",
+				"kind": 2,
+				"startTimeUnixNano": "1628000000000000500",
+				"endTimeUnixNano": "1628000001000000500",
+				"attributes": [
+					{"key": "http.status_code", "value": {"intValue": "500"}},
+					{"key": "ratio", "value": {"doubleValue": 0.5}},
+					{"key": "payload", "value": {"bytesValue": "AQI="}}
+				],
+				"events": [{
+					"timeUnixNano": "1628000000000000500",
+					"name": "retry",
+					"attributes": [{"key": "attempt", "value": {"intValue": "2"}}]
+				}],
+				"links": [{"traceId": "00000000000000040000000000000005", "spanId": "0000000000000006"}],
+				"status": {"code": 2, "message": "failed"}
+			}]
+		}]
+	}]}`, string(converted))
+}
+
+func TestFromOTLP(t *testing.T) {
+	start := time.Unix(1628000000, 500)
+	span := model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(2),
+		OperationName: "GET /",
+		References: []model.SpanRef{
+			model.NewChildOfRef(model.NewTraceID(0, 1), model.NewSpanID(3)),
+			model.NewFollowsFromRef(model.NewTraceID(4, 5), model.NewSpanID(6)),
+		},
+		StartTime: start,
+		Duration:  time.Second,
+		Tags: []model.KeyValue{
+			model.String("span.kind", "server"),
+			model.Bool("error", true),
+			model.String("otel.status_description", "failed"),
+			model.String("otel.library.name", "net/http"),
+			model.Int64("http.status_code", 500),
+			model.Float64("ratio", 0.5),
+			model.Binary("payload", []byte{1, 2}),
+		},
+		Logs: []model.Log{{
+			Timestamp: start,
+			Fields:    []model.KeyValue{model.String("event", "retry"), model.Int64("attempt", 2)},
+		}},
+		Process: model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "host")}),
+	}
+
+	line, err := json.Marshal(toOTLP(&span))
+	require.NoError(t, err)
+	spans, err := DecodeExportedSpans(ExportOTLP, line)
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	assert.Equal(t, span.TraceID, spans[0].TraceID)
+	assert.Equal(t, span.SpanID, spans[0].SpanID)
+	assert.Equal(t, span.OperationName, spans[0].OperationName)
+	assert.Equal(t, span.References, spans[0].References)
+	assert.True(t, span.StartTime.Equal(spans[0].StartTime))
+	assert.Equal(t, span.Duration, spans[0].Duration)
+	assert.ElementsMatch(t, span.Tags, spans[0].Tags)
+	assert.True(t, span.Logs[0].Timestamp.Equal(spans[0].Logs[0].Timestamp))
+	assert.ElementsMatch(t, span.Logs[0].Fields, spans[0].Logs[0].Fields)
+	assert.Equal(t, span.Process, spans[0].Process)
+
+	_, err = DecodeExportedSpans(ExportOTLP, []byte(`{"resourceSpans": [{"instrumentationLibrarySpans": [{"spans": [{"traceId": "x"}]}]}]}`))
+	assert.Error(t, err)
+	_, err = DecodeExportedSpans("csv", line)
+	assert.Error(t, err)
+}
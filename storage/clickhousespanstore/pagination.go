@@ -0,0 +1,166 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+// ErrInvalidPageToken is returned for page tokens not returned by FindTraceIDsPage
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// pageToken is the position after the last trace of a page. Traces are ordered by their last matching span,
+// so the next page continues with traces whose last span is older, or as old but not seen yet.
+type pageToken struct {
+	// Timestamp of the last trace in nanoseconds
+	Timestamp int64    `json:"t"`
+	Seen      []string `json:"s,omitempty"`
+}
+
+func encodePageToken(token pageToken) (string, error) {
+	encoded, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodePageToken(encoded string) (pageToken, error) {
+	var token pageToken
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return token, ErrInvalidPageToken
+	}
+	if err := json.Unmarshal(decoded, &token); err != nil || token.Timestamp <= 0 {
+		return token, ErrInvalidPageToken
+	}
+	for _, traceID := range token.Seen {
+		if _, err := model.TraceIDFromString(traceID); err != nil {
+			return token, ErrInvalidPageToken
+		}
+	}
+	return token, nil
+}
+
+// FindTraceIDsPage retrieves a page of up to NumTraces trace IDs matching the search parameters, starting with the most
+// recent traces. The page continues after the page the token was returned with, an empty token requests the first page.
+// The returned token is empty after the last page. Unlike FindTraceIDs, pages are deterministic: traces are ordered by
+// their last matching span, then by trace ID, so traces are not repeated or skipped between pages.
+func (r *TraceReader) FindTraceIDsPage(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	token string,
+) ([]model.TraceID, string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDsPage")
+	defer span.Finish()
+
+	if params.StartTimeMin.IsZero() {
+		return nil, "", errStartTimeRequired
+	}
+	params = r.limitNumTraces(params)
+	if r.indexTable == "" {
+		return nil, "", errNoIndexTable
+	}
+
+	end := params.StartTimeMax
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	if prefix, ok := params.Tags[traceIDPrefixTag]; ok {
+		// Trace IDs matching a prefix are few, they are returned as a single page
+		traceIDs, err := r.FindTraceIDsByPrefix(ctx, prefix, params.StartTimeMin, end, params.NumTraces)
+		return traceIDs, "", err
+	}
+	if linkedTo, ok := params.Tags[linkedToTag]; ok && r.linksIndex {
+		// Linked traces are few as well
+		traceIDs, err := r.FindTraceIDsLinkedTo(ctx, linkedTo, params.StartTimeMin, end, params.NumTraces)
+		return traceIDs, "", err
+	}
+
+	filter, args, err := r.searchFilter(ctx, params, params.StartTimeMin, end)
+	if err != nil {
+		return nil, "", err
+	}
+	query := fmt.Sprintf("SELECT traceID, max(timestamp) AS lastTimestamp FROM %s%s GROUP BY traceID", r.indexTable, filter)
+
+	var after pageToken
+	if token != "" {
+		if after, err = decodePageToken(token); err != nil {
+			return nil, "", err
+		}
+		query += " HAVING lastTimestamp < ?"
+		args = append(args, time.Unix(0, after.Timestamp))
+		if len(after.Seen) > 0 {
+			seen := make([]model.TraceID, len(after.Seen))
+			for i, traceID := range after.Seen {
+				// Trace IDs of the token are validated when it is decoded
+				seen[i], _ = model.TraceIDFromString(traceID)
+			}
+			placeholders, seenArgs := r.traceIDCondition(seen)
+			query += fmt.Sprintf(" OR (lastTimestamp = ? AND traceID NOT IN (%s))", placeholders)
+			args = append(args, time.Unix(0, after.Timestamp))
+			args = append(args, seenArgs...)
+		}
+	}
+
+	query += " ORDER BY lastTimestamp DESC, traceID LIMIT ?"
+	args = append(args, params.NumTraces)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	var (
+		traceIDs []model.TraceID
+		next     pageToken
+	)
+	for rows.Next() {
+		var (
+			traceIDString string
+			lastTimestamp time.Time
+		)
+		if err := rows.Scan(&traceIDString, &lastTimestamp); err != nil {
+			return nil, "", err
+		}
+		traceID, err := decodeTraceID(traceIDString, r.binaryTraceIDs)
+		if err != nil {
+			return nil, "", err
+		}
+		traceIDs = append(traceIDs, traceID)
+
+		if lastTimestamp.UnixNano() != next.Timestamp {
+			next = pageToken{Timestamp: lastTimestamp.UnixNano()}
+		}
+		next.Seen = append(next.Seen, traceID.String())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(traceIDs) < params.NumTraces {
+		return traceIDs, "", nil
+	}
+	if next.Timestamp == after.Timestamp {
+		// The whole page has the same timestamp as the previous one, traces of both are seen
+		next.Seen = append(after.Seen, next.Seen...)
+	}
+	nextToken, err := encodePageToken(next)
+	if err != nil {
+		return nil, "", err
+	}
+	return traceIDs, nextToken, nil
+}
@@ -0,0 +1,114 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_FindTraceIDsPage(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Hour)
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		StartTimeMin: start,
+		StartTimeMax: end,
+		NumTraces:    2,
+	}
+	first, second := start.Add(30*time.Minute), start.Add(10*time.Minute)
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}, {Low: 3}, {Low: 4}}
+	queryPrefix := fmt.Sprintf(
+		"SELECT traceID, max(timestamp) AS lastTimestamp FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? GROUP BY traceID",
+		testIndexTable,
+	)
+	querySuffix := " ORDER BY lastTimestamp DESC, traceID LIMIT ?"
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"traceID", "lastTimestamp"})
+	}
+
+	mock.ExpectQuery(queryPrefix+querySuffix).
+		WithArgs(params.ServiceName, start, end, params.NumTraces).
+		WillReturnRows(rows().AddRow(traceIDs[0].String(), first).AddRow(traceIDs[1].String(), second))
+	found, token, err := traceReader.FindTraceIDsPage(context.Background(), &params, "")
+	require.NoError(t, err)
+	assert.Equal(t, traceIDs[:2], found)
+	require.NotEmpty(t, token)
+
+	// The next page starts after the last trace, including traces with the same timestamp not seen yet
+	mock.ExpectQuery(queryPrefix+" HAVING lastTimestamp < ? OR (lastTimestamp = ? AND traceID NOT IN (?))"+querySuffix).
+		WithArgs(params.ServiceName, start, end, second, second, traceIDs[1].String(), params.NumTraces).
+		WillReturnRows(rows().AddRow(traceIDs[2].String(), second).AddRow(traceIDs[3].String(), second))
+	found, token, err = traceReader.FindTraceIDsPage(context.Background(), &params, token)
+	require.NoError(t, err)
+	assert.Equal(t, traceIDs[2:], found)
+	require.NotEmpty(t, token)
+
+	// Traces of the previous page with the same timestamp stay seen
+	mock.ExpectQuery(queryPrefix+" HAVING lastTimestamp < ? OR (lastTimestamp = ? AND traceID NOT IN (?,?,?))"+querySuffix).
+		WithArgs(params.ServiceName, start, end, second, second, traceIDs[1].String(), traceIDs[2].String(), traceIDs[3].String(), params.NumTraces).
+		WillReturnRows(rows())
+	found, token, err = traceReader.FindTraceIDsPage(context.Background(), &params, token)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+	assert.Empty(t, token, "there is no page after the last one")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_FindTraceIDsPageErrors(t *testing.T) {
+	db, _, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	invalidTraceIDToken, err := encodePageToken(pageToken{Timestamp: time.Now().UnixNano(), Seen: []string{"not a trace ID"}})
+	require.NoError(t, err)
+	tests := map[string]struct {
+		params        spanstore.TraceQueryParameters
+		token         string
+		expectedError error
+	}{
+		"no start time": {
+			params:        spanstore.TraceQueryParameters{NumTraces: 10},
+			expectedError: errStartTimeRequired,
+		},
+		"token not base64": {
+			params:        spanstore.TraceQueryParameters{StartTimeMin: time.Now(), NumTraces: 10},
+			token:         "not a token",
+			expectedError: ErrInvalidPageToken,
+		},
+		"token without timestamp": {
+			params:        spanstore.TraceQueryParameters{StartTimeMin: time.Now(), NumTraces: 10},
+			token:         "e30",
+			expectedError: ErrInvalidPageToken,
+		},
+		"token with invalid trace ID": {
+			params:        spanstore.TraceQueryParameters{StartTimeMin: time.Now(), NumTraces: 10},
+			token:         invalidTraceIDToken,
+			expectedError: ErrInvalidPageToken,
+		},
+	}
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			found, token, err := traceReader.FindTraceIDsPage(context.Background(), &test.params, test.token)
+			assert.ErrorIs(t, err, test.expectedError)
+			assert.Nil(t, found)
+			assert.Empty(t, token)
+		})
+	}
+}
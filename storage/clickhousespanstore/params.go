@@ -15,4 +15,50 @@ type WriteParams struct {
 	spansTable TableName
 	encoding   Encoding
 	delay      time.Duration
+	// Whether tenant column is written
+	multiTenant bool
+	// Whether flags column of the index is written
+	indexFlags bool
+	// Whether IDs of linked traces are written to the linkedTraceIDs column of the index
+	indexLinks bool
+	// Whether HTTP and gRPC status codes are written to their columns of the index
+	indexStatusCodes bool
+	// Whether span.kind tags are written to the spanKind column of the index
+	indexSpanKind bool
+	// Whether spans without a parent are marked in the isRoot column of the index
+	indexRoots bool
+	// Whether insert times of index rows are written to the insertedAt column of the index
+	indexInsertTime bool
+	// Whether positive sampling priorities of spans are written to the priority columns of spans and index
+	samplingPriority bool
+	// Whether index columns are written to the spans table, the index table is filled by a materialized view from it
+	indexFromSpans bool
+	// Whether trace IDs are written to spans and index tables as 16 bytes
+	binaryTraceIDs bool
+	// Comparisons of spans by the sort key of the index table, spans are sorted by them before insert if not empty
+	batchOrder []spanComparison
+	// Tags whose values are written to their own columns of the index
+	extractedTags []ExtractedTag
+	// Table with calls between spans for dependencies, calls are not written if empty
+	callsTable TableName
+	// Table the operations of spans are written to, operations are not written if empty
+	operationsTable TableName
+	// Table logs of spans are written to, logs are not written if empty
+	spanLogsTable TableName
+	// Writes processes of spans to their table and only their hashes with spans, processes are kept in spans if nil
+	processes *processes
+	// Whether the operations table has no spankind column
+	operationsWithoutSpanKind bool
+	// Routes spans and their index to tables of their periods, spans and index tables are not rotated if nil
+	rotation *TableRotation
+	// Skips optional columns of the index found missing, all columns are written if nil
+	schema *SchemaMonitor
+	// Drops spans while ClickHouse is overloaded, spans are not shed if nil
+	shedder *loadShedder
+	// Tracks spans accepted by the writer and not written yet, they are not tracked if nil
+	health *bufferHealth
+	// Inserts spans in RowBinary format over HTTP, spans are inserted over the native protocol if nil
+	rowBinary *RowBinaryInserter
+	// Tags inserts with query IDs looked up in the query log, inserts are not tagged if nil
+	insertProfiler *InsertProfiler
 }
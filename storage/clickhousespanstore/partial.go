@@ -0,0 +1,99 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	// unavailableShardsQuery returns shards of the cluster whose all replicas failed recently.
+	// Queries skip such shards with skip_unavailable_shards setting.
+	unavailableShardsQuery = "SELECT shard_num FROM system.clusters WHERE cluster = getMacro('cluster')" +
+		" GROUP BY shard_num HAVING min(estimated_recovery_time) > 0 ORDER BY shard_num"
+	defaultShardsCheckInterval = 5 * time.Second
+)
+
+// shardHealth keeps shards that were unavailable at the last check, it is checked at most once per interval
+type shardHealth struct {
+	db       *sql.DB
+	interval time.Duration
+
+	mutex       sync.Mutex
+	checked     time.Time
+	unavailable []uint32
+}
+
+// WithPartialResults annotates returned traces with a warning while some shards of the cluster are unavailable,
+// the connection has to skip unavailable shards instead of failing queries. Trace IDs found meanwhile are not cached.
+func WithPartialResults() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.shardHealth = &shardHealth{db: reader.db, interval: defaultShardsCheckInterval}
+	}
+}
+
+// unavailableShards returns numbers of unavailable shards. Shards are considered available if they could not be checked.
+func (h *shardHealth) unavailableShards(ctx context.Context) []uint32 {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if time.Since(h.checked) < h.interval {
+		return h.unavailable
+	}
+	h.checked = time.Now()
+	h.unavailable = nil
+
+	rows, err := h.db.QueryContext(ctx, unavailableShardsQuery)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var unavailable []uint32
+	for rows.Next() {
+		var shard uint32
+		if err := rows.Scan(&shard); err != nil {
+			return nil
+		}
+		unavailable = append(unavailable, shard)
+	}
+	if rows.Err() != nil {
+		return nil
+	}
+	h.unavailable = unavailable
+	return unavailable
+}
+
+// annotatePartial adds a warning about unavailable shards to the earliest span of every trace
+func annotatePartial(traces []*model.Trace, unavailable []uint32) {
+	shards := make([]string, len(unavailable))
+	for i, shard := range unavailable {
+		shards[i] = fmt.Sprint(shard)
+	}
+	warning := fmt.Sprintf("trace may be incomplete, unavailable ClickHouse shards: %s", strings.Join(shards, ", "))
+	for _, trace := range traces {
+		addTraceWarning(trace, warning)
+	}
+}
+
+// addTraceWarning adds the warning to the earliest span of the trace, shown by the UI at the top of the trace
+func addTraceWarning(trace *model.Trace, warning string) {
+	if len(trace.Spans) == 0 {
+		return
+	}
+	earliest := trace.Spans[0]
+	for _, span := range trace.Spans[1:] {
+		if span.StartTime.Before(earliest.StartTime) {
+			earliest = span
+		}
+	}
+	earliest.Warnings = append(earliest.Warnings, warning)
+}
@@ -0,0 +1,70 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestShardHealth_unavailableShards(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	health := &shardHealth{db: db, interval: time.Hour}
+	mock.ExpectQuery(unavailableShardsQuery).WillReturnRows(sqlmock.NewRows([]string{"shard_num"}).AddRow(2).AddRow(3))
+
+	assert.Equal(t, []uint32{2, 3}, health.unavailableShards(context.Background()))
+	// checked at most once per interval
+	assert.Equal(t, []uint32{2, 3}, health.unavailableShards(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	health.checked = time.Time{}
+	mock.ExpectQuery(unavailableShardsQuery).WillReturnError(errorMock)
+	assert.Empty(t, health.unavailableShards(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var disabled *shardHealth
+	assert.Empty(t, disabled.unavailableShards(context.Background()))
+}
+
+func TestAnnotatePartial(t *testing.T) {
+	first := &model.Span{SpanID: 1, StartTime: testStartTime}
+	second := &model.Span{SpanID: 2, StartTime: testStartTime.Add(-time.Second)}
+	traces := []*model.Trace{{Spans: []*model.Span{first, second}}, {}}
+
+	annotatePartial(traces, []uint32{2, 3})
+
+	assert.Empty(t, first.Warnings)
+	assert.Equal(t, []string{"trace may be incomplete, unavailable ClickHouse shards: 2, 3"}, second.Warnings)
+}
+
+func TestTraceReader_GetTracePartialResults(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithPartialResults())
+	span := testSpan
+	span.Warnings = nil
+	mock.
+		ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(span.TraceID).
+		WillReturnRows(getEncodedSpans([]model.Span{span}, func(span *model.Span) ([]byte, error) { return json.Marshal(span) }))
+	mock.ExpectQuery(unavailableShardsQuery).WillReturnRows(sqlmock.NewRows([]string{"shard_num"}).AddRow(2))
+
+	trace, err := traceReader.GetTrace(context.Background(), span.TraceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 1)
+	assert.Equal(t, []string{"trace may be incomplete, unavailable ClickHouse shards: 2"}, trace.Spans[0].Warnings)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
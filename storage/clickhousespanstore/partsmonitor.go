@@ -0,0 +1,206 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeParts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_active_parts",
+		Help: "Maximal number of active parts in a partition of a table",
+	}, []string{"table"})
+	runningMerges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_running_merges",
+		Help: "Number of running merges of a table",
+	}, []string{"table"})
+	flushSlowdown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_flush_slowdown",
+		Help: "Factor by which flush interval and batch size are increased due to too many parts or merges",
+	})
+)
+
+// PartsMonitor checks parts and merges of tables the plugin writes to. Every insert creates a part per partition,
+// too many small parts make ClickHouse merge more than it inserts and eventually reject inserts.
+// While the number of active parts in a partition or of running merges is above its threshold, flushes of writers
+// can be slowed down, so that fewer and bigger parts are inserted.
+type PartsMonitor struct {
+	logger    hclog.Logger
+	db        *sql.DB
+	tables    []TableName
+	interval  time.Duration
+	maxParts  uint64
+	maxMerges uint64
+	slowdown  int64
+
+	// factor is the current slowdown of flushes, 1 when thresholds are not exceeded
+	factor int64
+	finish chan bool
+	done   sync.WaitGroup
+}
+
+// PartsMonitorOption configures optional behaviour of PartsMonitor
+type PartsMonitorOption func(monitor *PartsMonitor)
+
+// WithFlushSlowdown increases flush interval and batch size of writers by the factor while thresholds are exceeded
+func WithFlushSlowdown(factor int) PartsMonitorOption {
+	return func(monitor *PartsMonitor) {
+		if factor > 1 {
+			monitor.slowdown = int64(factor)
+		}
+	}
+}
+
+// WithPartsMonitor slows down flushes as the monitor requests
+func WithPartsMonitor(monitor *PartsMonitor) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.partsMonitor = monitor
+	}
+}
+
+// NewPartsMonitor returns a PartsMonitor of the tables of the current database, they have to be local tables
+// in replication mode. Thresholds are the number of active parts in a partition and of running merges of a table.
+func NewPartsMonitor(
+	logger hclog.Logger,
+	db *sql.DB,
+	tables []TableName,
+	interval time.Duration,
+	maxParts,
+	maxMerges uint64,
+	opts ...PartsMonitorOption,
+) *PartsMonitor {
+	monitor := &PartsMonitor{
+		logger:    logger,
+		db:        db,
+		tables:    tables,
+		interval:  interval,
+		maxParts:  maxParts,
+		maxMerges: maxMerges,
+		slowdown:  1,
+		factor:    1,
+		finish:    make(chan bool),
+	}
+	for _, opt := range opts {
+		opt(monitor)
+	}
+	return monitor
+}
+
+// Start checks parts and merges every interval in the background until the monitor is closed
+func (m *PartsMonitor) Start() {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.finish:
+				return
+			case <-ticker.C:
+				if err := m.Check(); err != nil {
+					m.logger.Error("Could not check parts of tables", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops checking parts
+func (m *PartsMonitor) Close() {
+	close(m.finish)
+	m.done.Wait()
+}
+
+// Check reports active parts and running merges of the tables and updates the slowdown of flushes
+func (m *PartsMonitor) Check() error {
+	tables := make([]interface{}, len(m.tables))
+	for i, table := range m.tables {
+		tables[i] = string(table)
+	}
+	in := "?" + strings.Repeat(",?", len(tables)-1)
+
+	parts, err := m.countByTable(fmt.Sprintf(
+		"SELECT table, max(parts) FROM ("+
+			"SELECT table, partition, count() AS parts FROM system.parts"+
+			" WHERE database = currentDatabase() AND active AND table IN (%s) GROUP BY table, partition"+
+			") GROUP BY table",
+		in,
+	), tables)
+	if err != nil {
+		return err
+	}
+	merges, err := m.countByTable(fmt.Sprintf(
+		"SELECT table, count() FROM system.merges WHERE database = currentDatabase() AND table IN (%s) GROUP BY table",
+		in,
+	), tables)
+	if err != nil {
+		return err
+	}
+
+	var exceeded []interface{}
+	for _, table := range m.tables {
+		activeParts.WithLabelValues(string(table)).Set(float64(parts[table]))
+		runningMerges.WithLabelValues(string(table)).Set(float64(merges[table]))
+		if m.maxParts > 0 && parts[table] > m.maxParts {
+			exceeded = append(exceeded, "table", table, "parts", parts[table])
+		}
+		if m.maxMerges > 0 && merges[table] > m.maxMerges {
+			exceeded = append(exceeded, "table", table, "merges", merges[table])
+		}
+	}
+
+	overloaded := len(exceeded) > 0
+	if overloaded {
+		m.logger.Warn("Too many parts or merges, inserts may be rejected", exceeded...)
+	}
+	factor := int64(1)
+	if overloaded {
+		factor = m.slowdown
+	}
+	if previous := atomic.SwapInt64(&m.factor, factor); previous != factor {
+		if factor > 1 {
+			m.logger.Warn("Slowing down flushes", "factor", factor)
+		} else {
+			m.logger.Info("Parts and merges are back to normal, flushing at the configured rate")
+		}
+	}
+	flushSlowdown.Set(float64(factor))
+	return nil
+}
+
+func (m *PartsMonitor) countByTable(query string, tables []interface{}) (map[TableName]uint64, error) {
+	rows, err := m.db.Query(query, tables...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[TableName]uint64, len(tables))
+	for rows.Next() {
+		var (
+			table string
+			count uint64
+		)
+		if err := rows.Scan(&table, &count); err != nil {
+			return nil, err
+		}
+		counts[TableName(table)] = count
+	}
+	return counts, rows.Err()
+}
+
+// flushFactor returns by how much flush interval and batch size are increased, 1 if flushes are not slowed down
+func (m *PartsMonitor) flushFactor() int64 {
+	if m == nil {
+		return 1
+	}
+	return atomic.LoadInt64(&m.factor)
+}
@@ -0,0 +1,97 @@
+package clickhousespanstore
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const (
+	testPartsQuery = "SELECT table, max(parts) FROM (" +
+		"SELECT table, partition, count() AS parts FROM system.parts" +
+		" WHERE database = currentDatabase() AND active AND table IN (?,?) GROUP BY table, partition" +
+		") GROUP BY table"
+	testMergesQuery = "SELECT table, count() FROM system.merges WHERE database = currentDatabase() AND table IN (?,?) GROUP BY table"
+)
+
+func TestPartsMonitor_Check(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	monitor := NewPartsMonitor(spyLogger, db, []TableName{testIndexTable, testSpansTable}, time.Minute, 100, 5, WithFlushSlowdown(4))
+	tables := []driver.Value{string(testIndexTable), string(testSpansTable)}
+	expectCheck := func(spansParts, indexMerges uint64) {
+		mock.ExpectQuery(testPartsQuery).WithArgs(tables...).WillReturnRows(
+			sqlmock.NewRows([]string{"table", "parts"}).
+				AddRow(string(testIndexTable), 10).
+				AddRow(string(testSpansTable), spansParts),
+		)
+		mock.ExpectQuery(testMergesQuery).WithArgs(tables...).WillReturnRows(
+			sqlmock.NewRows([]string{"table", "merges"}).AddRow(string(testIndexTable), indexMerges),
+		)
+	}
+
+	expectCheck(50, 1)
+	require.NoError(t, monitor.Check())
+	assert.Equal(t, int64(1), monitor.flushFactor())
+
+	expectCheck(200, 1)
+	require.NoError(t, monitor.Check())
+	assert.Equal(t, int64(4), monitor.flushFactor(), "too many parts slow down flushes")
+
+	expectCheck(50, 6)
+	require.NoError(t, monitor.Check())
+	assert.Equal(t, int64(4), monitor.flushFactor(), "too many merges slow down flushes")
+
+	expectCheck(50, 1)
+	require.NoError(t, monitor.Check())
+	assert.Equal(t, int64(1), monitor.flushFactor())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{
+		{Msg: "Too many parts or merges, inserts may be rejected", Args: []interface{}{"table", TableName(testSpansTable), "parts", uint64(200)}},
+		{Msg: "Slowing down flushes", Args: []interface{}{"factor", int64(4)}},
+		{Msg: "Too many parts or merges, inserts may be rejected", Args: []interface{}{"table", TableName(testIndexTable), "merges", uint64(6)}},
+	})
+}
+
+func TestPartsMonitor_CheckWithoutSlowdown(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	monitor := NewPartsMonitor(mocks.NewSpyLogger(), db, []TableName{testIndexTable, testSpansTable}, time.Minute, 100, 5)
+	mock.ExpectQuery(testPartsQuery).WillReturnRows(
+		sqlmock.NewRows([]string{"table", "parts"}).AddRow(string(testSpansTable), 200),
+	)
+	mock.ExpectQuery(testMergesQuery).WillReturnRows(sqlmock.NewRows([]string{"table", "merges"}))
+
+	require.NoError(t, monitor.Check())
+	assert.Equal(t, int64(1), monitor.flushFactor())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPartsMonitor_CheckError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	monitor := NewPartsMonitor(mocks.NewSpyLogger(), db, []TableName{testIndexTable, testSpansTable}, time.Minute, 100, 5)
+	mock.ExpectQuery(testPartsQuery).WillReturnError(errorMock)
+
+	assert.True(t, errors.Is(monitor.Check(), errorMock))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var nilMonitor *PartsMonitor
+	assert.Equal(t, int64(1), nilMonitor.flushFactor())
+}
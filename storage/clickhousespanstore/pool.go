@@ -2,27 +2,37 @@ package clickhousespanstore
 
 import (
 	"container/heap"
-	"fmt"
 	"sync"
 
 	"github.com/jaegertracing/jaeger/model"
 )
 
+// tenantBatch is a batch of spans of a single tenant
+type tenantBatch struct {
+	tenant string
+	spans  []*model.Span
+	// pending tracks the spans until they are written or dropped, they are not tracked if nil
+	pending *pendingBatch
+}
+
 // WriteWorkerPool is a worker pool for writing batches of spans.
-// Given a new batch, WriteWorkerPool creates a new WriteWorker.
-// If the number of currently processed spans if more than maxSpanCount, then the oldest worker is removed.
+// Given a new batch, WriteWorkerPool creates a new WriteWorker writing and retrying it in the background.
+// If the number of currently processed spans is more than maxSpanCount, then the oldest workers are stopped.
+// Accepting a batch never waits for writes, so slow flushes do not block the writer.
 type WriteWorkerPool struct {
 	params *WriteParams
 
 	finish  chan bool
 	done    sync.WaitGroup
-	batches chan []*model.Span
+	batches chan tenantBatch
 
 	totalSpanCount int
 	maxSpanCount   int
 	mutex          sync.Mutex
-	workers        workerHeap
-	workerDone     chan *WriteWorker
+	// workers are running workers, a worker stopped to make room for new batches is removed before it finishes
+	workers workerHeap
+	// running are workers that did not finish yet, including stopped ones
+	running sync.WaitGroup
 }
 
 func NewWorkerPool(params *WriteParams, maxSpanCount int) WriteWorkerPool {
@@ -30,70 +40,80 @@ func NewWorkerPool(params *WriteParams, maxSpanCount int) WriteWorkerPool {
 		params:  params,
 		finish:  make(chan bool),
 		done:    sync.WaitGroup{},
-		batches: make(chan []*model.Span),
+		batches: make(chan tenantBatch),
 
-		mutex:      sync.Mutex{},
-		workers:    newWorkerHeap(100),
-		workerDone: make(chan *WriteWorker),
+		mutex:   sync.Mutex{},
+		workers: newWorkerHeap(100),
 
 		maxSpanCount: maxSpanCount,
 	}
 }
 
 func (pool *WriteWorkerPool) Work() {
-	finish := false
+	pool.done.Add(1)
+	defer pool.done.Done()
 
 	for {
-		pool.done.Add(1)
 		select {
 		case batch := <-pool.batches:
-			pool.CleanWorkers(len(batch))
-			worker := WriteWorker{
-				params: pool.params,
-
-				counter:    &pool.totalSpanCount,
-				mutex:      &pool.mutex,
-				finish:     make(chan bool),
-				workerDone: pool.workerDone,
-				done:       sync.WaitGroup{},
-			}
-			pool.workers.AddWorker(&worker)
-			go worker.Work(batch)
-		case worker := <-pool.workerDone:
-			if err := pool.workers.RemoveWorker(worker); err != nil {
-				pool.params.logger.Error("could not remove worker", "worker", worker, "error", err)
-			}
+			pool.startWorker(batch)
 		case <-pool.finish:
-			pool.workers.CLoseWorkers()
-			finish = true
-		}
-		pool.done.Done()
-
-		if finish {
-			break
+			pool.mutex.Lock()
+			pool.workers.StopWorkers()
+			pool.mutex.Unlock()
+			pool.running.Wait()
+			return
 		}
 	}
 }
 
-func (pool *WriteWorkerPool) WriteBatch(batch []*model.Span) {
+func (pool *WriteWorkerPool) WriteBatch(tenant string, batch []*model.Span) {
+	pool.writeBatch(tenantBatch{tenant: tenant, spans: batch})
+}
+
+func (pool *WriteWorkerPool) writeBatch(batch tenantBatch) {
 	pool.batches <- batch
 }
 
+// CLose stops all workers and waits until they finish, batches not written yet are dropped
 func (pool *WriteWorkerPool) CLose() {
 	pool.finish <- true
 	pool.done.Wait()
 }
 
-func (pool *WriteWorkerPool) CleanWorkers(batchSize int) {
+// startWorker starts writing the batch in the background, after stopping the oldest workers
+// if there is no room for its spans
+func (pool *WriteWorkerPool) startWorker(batch tenantBatch) {
 	pool.mutex.Lock()
-	if pool.totalSpanCount+batchSize > pool.maxSpanCount {
-		earliest := heap.Pop(pool.workers)
-		switch worker := earliest.(type) {
-		case WriteWorker:
-			worker.CLose()
-		default:
-			panic(fmt.Sprintf("undefined type %T return from workerHeap", worker))
-		}
+	defer pool.mutex.Unlock()
+
+	for pool.workers.Len() > 0 && pool.totalSpanCount+len(batch.spans) > pool.maxSpanCount {
+		oldest := heap.Pop(pool.workers).(*WriteWorker)
+		pool.totalSpanCount -= oldest.size
+		oldest.stop()
+	}
+
+	worker := &WriteWorker{
+		params:  pool.params,
+		tenant:  batch.tenant,
+		pending: batch.pending,
+
+		pool:   pool,
+		size:   len(batch.spans),
+		finish: make(chan bool),
+	}
+	pool.workers.AddWorker(worker)
+	pool.totalSpanCount += worker.size
+	pool.running.Add(1)
+	go worker.Work(batch.spans)
+}
+
+// remove forgets the finished worker, unless it was stopped and removed already
+func (pool *WriteWorkerPool) remove(worker *WriteWorker) {
+	pool.mutex.Lock()
+	if err := pool.workers.RemoveWorker(worker); err == nil {
+		pool.totalSpanCount -= worker.size
 	}
 	pool.mutex.Unlock()
+	pool.running.Done()
 }
@@ -0,0 +1,52 @@
+package clickhousespanstore
+
+import (
+	"strconv"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	samplingPriorityTag    = "sampling.priority"
+	samplingPriorityColumn = "priority"
+)
+
+// WithSamplingPriority writes whether spans have a positive sampling.priority tag to the priority column
+// of spans and index tables, so that TTL of the tables can keep them longer
+func WithSamplingPriority() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.samplingPriority = true
+	}
+}
+
+// WithReencoderSamplingPriority writes the priority column of re-encoded spans, like WithSamplingPriority
+func WithReencoderSamplingPriority() ReencoderOption {
+	return func(reencoder *Reencoder) {
+		reencoder.samplingPriority = true
+	}
+}
+
+// samplingPriority returns 1 if the span has a positive sampling.priority tag, 0 otherwise
+func samplingPriority(span *model.Span) int64 {
+	tag, ok := model.KeyValues(span.Tags).FindByKey(samplingPriorityTag)
+	if !ok {
+		return 0
+	}
+	var priority float64
+	switch tag.VType {
+	case model.Int64Type:
+		priority = float64(tag.Int64())
+	case model.Float64Type:
+		priority = tag.Float64()
+	case model.BoolType:
+		if tag.Bool() {
+			priority = 1
+		}
+	default:
+		priority, _ = strconv.ParseFloat(tag.AsString(), 64)
+	}
+	if priority > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package clickhousespanstore
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestSamplingPriority(t *testing.T) {
+	tests := map[string]struct {
+		tags     []model.KeyValue
+		expected int64
+	}{
+		"no tag":         {expected: 0},
+		"positive int":   {tags: []model.KeyValue{model.Int64(samplingPriorityTag, 1)}, expected: 1},
+		"zero int":       {tags: []model.KeyValue{model.Int64(samplingPriorityTag, 0)}, expected: 0},
+		"negative int":   {tags: []model.KeyValue{model.Int64(samplingPriorityTag, -1)}, expected: 0},
+		"positive float": {tags: []model.KeyValue{model.Float64(samplingPriorityTag, 0.5)}, expected: 1},
+		"true":           {tags: []model.KeyValue{model.Bool(samplingPriorityTag, true)}, expected: 1},
+		"string":         {tags: []model.KeyValue{model.String(samplingPriorityTag, "2")}, expected: 1},
+		"invalid string": {tags: []model.KeyValue{model.String(samplingPriorityTag, "high")}, expected: 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, samplingPriority(&model.Span{Tags: test.tags}))
+		})
+	}
+}
+
+func TestSpanWriter_SamplingPriority(t *testing.T) {
+	span := testSpan
+	span.Tags = append(model.KeyValues{model.Int64(samplingPriorityTag, 1)}, span.Tags...)
+	spanJSON, err := json.Marshal(&span)
+	require.NoError(t, err)
+	keys, values := uniqueTagsForSpan(&span)
+	indexArgs := append(indexWriteExpectation.execArgs[0][:5:5], int64(1), keys, values)
+	expectations := []expectation{
+		{
+			preparation: fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model, priority) VALUES (?, ?, ?, ?)", testSpansTable),
+			execArgs:    [][]driver.Value{{span.StartTime, span.TraceID.String(), spanJSON, int64(1)}},
+		},
+		{
+			preparation: fmt.Sprintf(
+				"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, priority, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				testIndexTable,
+			),
+			execArgs: [][]driver.Value{indexArgs},
+		},
+	}
+
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	worker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable)
+	worker.params.samplingPriority = true
+
+	for _, expectation := range expectations {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	assert.NoError(t, worker.writeBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
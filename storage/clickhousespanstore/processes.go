@@ -0,0 +1,280 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
+)
+
+const (
+	// processHashTag is the only tag of processes of stored spans whose processes are stored in the processes table
+	processHashTag = "jaeger.process_hash"
+	// processesCacheSize is the number of processes kept by readers and of hashes of processes written by writers
+	processesCacheSize = 10000
+)
+
+// processes stores processes of spans once in the processes table, stored spans keep only the service and
+// the hash of their process. Processes are immutable, so they are cached by their hashes.
+type processes struct {
+	table TableName
+	// cache has written hashes for writers and processes by their hashes for readers, keyed by tenants and hashes
+	cache cache.Cache
+}
+
+// processRows are rows of processes read from the processes table
+type processRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// WithProcessesTable writes processes of spans to the table once and only their hashes with spans,
+// which cuts stored spans of services sending the same process tags with every span
+func WithProcessesTable(table TableName) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.processes = newProcesses(table)
+	}
+}
+
+// WithReaderProcessesTable restores processes of spans stored with their hashes from the table
+func WithReaderProcessesTable(table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.processes = newProcesses(table)
+	}
+}
+
+// WithExportProcessesTable restores processes of exported spans stored with their hashes from the table
+func WithExportProcessesTable(table TableName) ExporterOption {
+	return func(exporter *Exporter) {
+		exporter.processes = newProcesses(table)
+	}
+}
+
+func newProcesses(table TableName) *processes {
+	return &processes{table: table, cache: cache.NewLRU(processesCacheSize)}
+}
+
+// processHash returns the hash of the process, spans with equal processes have the same hash
+func processHash(process *model.Process) (string, []byte, error) {
+	serialized, err := proto.Marshal(process)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(serialized)
+	return hex.EncodeToString(sum[:16]), serialized, nil
+}
+
+// strip returns the span with its process replaced by the service and the hash of the process,
+// the span itself is not modified. Spans without process tags are returned as they are.
+func (p *processes) strip(span *model.Span) (*model.Span, error) {
+	if p == nil || span.Process == nil || len(span.Process.Tags) == 0 {
+		return span, nil
+	}
+	hash, _, err := processHash(span.Process)
+	if err != nil {
+		return nil, err
+	}
+	stripped := *span
+	stripped.Process = &model.Process{
+		ServiceName: span.Process.ServiceName,
+		Tags:        []model.KeyValue{model.String(processHashTag, hash)},
+	}
+	return &stripped, nil
+}
+
+// marshalStoredSpan serializes the span as it is stored, without its process if processes are stored separately
+func (worker *WriteWorker) marshalStoredSpan(span *model.Span) ([]byte, error) {
+	stored, err := worker.params.processes.strip(span)
+	if err != nil {
+		return nil, err
+	}
+	return marshalSpan(stored, worker.params.encoding)
+}
+
+// storedProcessHash returns the hash of the process of the span stored without its process, empty otherwise
+func storedProcessHash(span *model.Span) string {
+	if span.Process == nil || len(span.Process.Tags) != 1 || span.Process.Tags[0].Key != processHashTag {
+		return ""
+	}
+	return span.Process.Tags[0].VStr
+}
+
+func processKey(tenant, hash string) string {
+	return tenant + "/" + hash
+}
+
+// writeProcessesBatch writes processes of spans of the batch which were not written by the writer before.
+// Processes written twice, e.g. by several writers, are merged by the table.
+func (worker *WriteWorker) writeProcessesBatch(batch []*model.Span) error {
+	p := worker.params.processes
+	written := make(map[string]bool)
+	var rows [][]interface{}
+	for _, span := range batch {
+		if span.Process == nil || len(span.Process.Tags) == 0 {
+			continue
+		}
+		hash, serialized, err := processHash(span.Process)
+		if err != nil {
+			return err
+		}
+		key := processKey(worker.tenant, hash)
+		if written[key] || p.cache.Get(key) != nil {
+			continue
+		}
+		written[key] = true
+		row := []interface{}{hash, serialized}
+		if worker.params.multiTenant {
+			row = append([]interface{}{worker.tenant}, row...)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ctx, observe := worker.startInsert(insertedProcesses)
+	tx, err := worker.params.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := "hash, process"
+	if worker.params.multiTenant {
+		columns = "tenant, " + columns
+	}
+	statement, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		p.table,
+		columns,
+		strings.Repeat(", ?", len(rows[0])-1),
+	))
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, row := range rows {
+		if _, err = statement.Exec(row...); err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	if err := observe(tx.Commit()); err != nil {
+		return err
+	}
+	// Hashes are cached only once processes are written, so that failed batches write them again
+	for key := range written {
+		p.cache.Put(key, true)
+	}
+	return nil
+}
+
+// resolve restores processes of spans stored with their hashes, processes missing in the cache are read with query.
+// Spans whose processes are not found keep the hashes of their processes.
+func (p *processes) resolve(
+	ctx context.Context,
+	spans []*model.Span,
+	tenant string,
+	multiTenant bool,
+	query func(ctx context.Context, query string, args ...interface{}) (processRows, error),
+) error {
+	if p == nil {
+		return nil
+	}
+	var missing []interface{}
+	requested := make(map[string]bool)
+	for _, span := range spans {
+		hash := storedProcessHash(span)
+		if hash == "" || requested[hash] || p.cache.Get(processKey(tenant, hash)) != nil {
+			continue
+		}
+		requested[hash] = true
+		missing = append(missing, hash)
+	}
+
+	if len(missing) > 0 {
+		var args []interface{}
+		condition := ""
+		if multiTenant {
+			condition = "tenant = ? AND "
+			args = append(args, tenant)
+		}
+		rows, err := query(ctx, fmt.Sprintf(
+			"SELECT hash, any(process) FROM %s WHERE %shash IN (?%s) GROUP BY hash",
+			p.table,
+			condition,
+			strings.Repeat(", ?", len(missing)-1),
+		), append(args, missing...)...)
+		if err != nil {
+			return err
+		}
+		if err := p.load(rows, tenant); err != nil {
+			return err
+		}
+	}
+
+	for _, span := range spans {
+		hash := storedProcessHash(span)
+		if hash == "" {
+			continue
+		}
+		if cached, ok := p.cache.Get(processKey(tenant, hash)).(*model.Process); ok {
+			// Spans get copies, so that changing a span does not change the cached process
+			process := *cached
+			process.Tags = append([]model.KeyValue(nil), cached.Tags...)
+			span.Process = &process
+		}
+	}
+	return nil
+}
+
+// load caches processes of the rows
+func (p *processes) load(rows processRows, tenant string) error {
+	defer rows.Close()
+	for rows.Next() {
+		var hash, serialized string
+		if err := rows.Scan(&hash, &serialized); err != nil {
+			return err
+		}
+		process := &model.Process{}
+		if err := proto.Unmarshal([]byte(serialized), process); err != nil {
+			return fmt.Errorf("could not decode process %s: %w", hash, err)
+		}
+		p.cache.Put(processKey(tenant, hash), process)
+	}
+	return rows.Err()
+}
+
+// resolveProcesses restores processes of spans stored with their hashes, if processes are stored separately
+func (r *TraceReader) resolveProcesses(ctx context.Context, spans []*model.Span) error {
+	if r.processes == nil {
+		return nil
+	}
+	return r.processes.resolve(ctx, spans, TenantFromContext(ctx, r.tenantHeader), r.multiTenant(),
+		func(ctx context.Context, query string, args ...interface{}) (processRows, error) {
+			rows, err := r.query(ctx, query, args...)
+			if err != nil {
+				return nil, err
+			}
+			return rows, nil
+		})
+}
@@ -0,0 +1,136 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testProcessesTable TableName = "test_processes_table"
+
+func TestProcesses_strip(t *testing.T) {
+	var disabled *processes
+	stored, err := disabled.strip(&testSpan)
+	require.NoError(t, err)
+	assert.Same(t, &testSpan, stored)
+
+	p := newProcesses(testProcessesTable)
+	hash, _, err := processHash(testSpan.Process)
+	require.NoError(t, err)
+	stored, err = p.strip(&testSpan)
+	require.NoError(t, err)
+	assert.Equal(t, model.NewProcess("test_service", []model.KeyValue{model.String(processHashTag, hash)}), stored.Process)
+	assert.Equal(t, hash, storedProcessHash(stored))
+	assert.Equal(t, process, testSpan.Process, "the written span keeps its process")
+	assert.Empty(t, storedProcessHash(&testSpan))
+
+	withoutTags := testSpan
+	withoutTags.Process = model.NewProcess("test_service", nil)
+	stored, err = p.strip(&withoutTags)
+	require.NoError(t, err)
+	assert.Same(t, &withoutTags, stored, "processes without tags are kept in spans")
+}
+
+func TestSpanWriter_ProcessesBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.processes = newProcesses(testProcessesTable)
+
+	other := testSpan
+	other.SpanID = model.NewSpanID(4)
+	hash, serialized, err := processHash(testSpan.Process)
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (hash, process) VALUES (?, ?)", testProcessesTable)).
+		ExpectExec().
+		WithArgs(hash, serialized).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, worker.writeProcessesBatch([]*model.Span{&testSpan, &other}), "spans with equal processes write one")
+	assert.NoError(t, worker.writeProcessesBatch([]*model.Span{&testSpan}), "written processes are not written again")
+
+	stripped, err := worker.params.processes.strip(&testSpan)
+	require.NoError(t, err)
+	storedModel, err := json.Marshal(stripped)
+	require.NoError(t, err)
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) VALUES (?, ?, ?)", testSpansTable)).
+		ExpectExec().
+		WithArgs(testSpan.StartTime, testSpan.TraceID, storedModel).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, worker.writeModelBatch([]*model.Span{&testSpan}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_GetTraceProcesses(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithReaderProcessesTable(testProcessesTable))
+	p := newProcesses(testProcessesTable)
+	stripped, err := p.strip(&testSpan)
+	require.NoError(t, err)
+	hash, serializedProcess, err := processHash(testSpan.Process)
+	require.NoError(t, err)
+	spansQuery := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)
+
+	mock.ExpectQuery(spansQuery).
+		WithArgs(testSpan.TraceID).
+		WillReturnRows(getEncodedSpans([]model.Span{*stripped}, func(span *model.Span) ([]byte, error) { return proto.Marshal(span) }))
+	mock.ExpectQuery(fmt.Sprintf("SELECT hash, any(process) FROM %s WHERE hash IN (?) GROUP BY hash", testProcessesTable)).
+		WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "any(process)"}).AddRow(hash, serializedProcess))
+	trace, err := traceReader.GetTrace(context.Background(), testSpan.TraceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 1)
+	assert.Equal(t, testSpan.Process, trace.Spans[0].Process)
+
+	// Processes are cached
+	mock.ExpectQuery(spansQuery).
+		WithArgs(testSpan.TraceID).
+		WillReturnRows(getEncodedSpans([]model.Span{*stripped}, func(span *model.Span) ([]byte, error) { return proto.Marshal(span) }))
+	trace, err = traceReader.GetTrace(context.Background(), testSpan.TraceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 1)
+	assert.Equal(t, testSpan.Process, trace.Spans[0].Process)
+	assert.NotSame(t, trace.Spans[0].Process, traceReader.processes.cache.Get(processKey("", hash)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcesses_resolveMissing(t *testing.T) {
+	p := newProcesses(testProcessesTable)
+	stripped, err := p.strip(&testSpan)
+	require.NoError(t, err)
+	err = p.resolve(context.Background(), []*model.Span{stripped}, "tenant", true,
+		func(_ context.Context, query string, args ...interface{}) (processRows, error) {
+			assert.Equal(t, fmt.Sprintf("SELECT hash, any(process) FROM %s WHERE tenant = ? AND hash IN (?) GROUP BY hash", testProcessesTable), query)
+			assert.Equal(t, []interface{}{"tenant", storedProcessHash(stripped)}, args)
+			return &emptyRows{}, nil
+		})
+	require.NoError(t, err)
+	assert.NotEmpty(t, storedProcessHash(stripped), "spans keep hashes of processes which are not found")
+}
+
+type emptyRows struct{}
+
+func (*emptyRows) Next() bool                  { return false }
+func (*emptyRows) Scan(_ ...interface{}) error { return nil }
+func (*emptyRows) Err() error                  { return nil }
+func (*emptyRows) Close() error                { return nil }
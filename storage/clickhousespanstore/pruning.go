@@ -0,0 +1,121 @@
+package clickhousespanstore
+
+import (
+	"unicode/utf8"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	pruneDropLogs    = "drop_logs"
+	pruneMaxLogs     = "max_logs"
+	pruneMaxTagBytes = "max_tag_value_bytes"
+)
+
+var numPrunedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_pruned_spans_total",
+	Help: "Number of written spans with removed logs or truncated tag values, by the pruning rule",
+}, []string{"rule"})
+
+// SpanPruner removes parts of spans before they are serialized, so that teams not needing logs or long tag values
+// in traces store smaller spans
+type SpanPruner struct {
+	dropLogs         bool
+	maxLogs          int
+	maxTagValueBytes int
+}
+
+// NewSpanPruner returns a SpanPruner dropping all logs of spans or keeping their maxLogs earliest logs, and truncating
+// string and binary values of tags, process tags and log fields to maxTagValueBytes. Zero limits are disabled.
+func NewSpanPruner(dropLogs bool, maxLogs, maxTagValueBytes int) *SpanPruner {
+	return &SpanPruner{dropLogs: dropLogs, maxLogs: maxLogs, maxTagValueBytes: maxTagValueBytes}
+}
+
+// WithSpanPruner prunes spans before they are written
+func WithSpanPruner(pruner *SpanPruner) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.pruner = pruner
+	}
+}
+
+// prune returns the pruned span, spans are copied instead of modified as they may be shared with other writers
+func (p *SpanPruner) prune(span *model.Span) *model.Span {
+	if p == nil {
+		return span
+	}
+	pruned := *span
+
+	switch {
+	case p.dropLogs && len(span.Logs) > 0:
+		pruned.Logs = nil
+		numPrunedSpans.WithLabelValues(pruneDropLogs).Inc()
+	case p.maxLogs > 0 && len(span.Logs) > p.maxLogs:
+		pruned.Logs = span.Logs[:p.maxLogs:p.maxLogs]
+		numPrunedSpans.WithLabelValues(pruneMaxLogs).Inc()
+	}
+
+	if p.maxTagValueBytes > 0 {
+		tags, truncated := p.truncate(pruned.Tags)
+		pruned.Tags = tags
+		if pruned.Process != nil {
+			tags, truncatedProcess := p.truncate(pruned.Process.Tags)
+			if truncatedProcess {
+				process := *pruned.Process
+				process.Tags = tags
+				pruned.Process = &process
+				truncated = true
+			}
+		}
+		var logs []model.Log
+		for i, log := range pruned.Logs {
+			fields, truncatedFields := p.truncate(log.Fields)
+			if !truncatedFields {
+				continue
+			}
+			if logs == nil {
+				logs = append([]model.Log(nil), pruned.Logs...)
+			}
+			logs[i].Fields = fields
+			truncated = true
+		}
+		if logs != nil {
+			pruned.Logs = logs
+		}
+		if truncated {
+			numPrunedSpans.WithLabelValues(pruneMaxTagBytes).Inc()
+		}
+	}
+	return &pruned
+}
+
+// truncate returns the key values with string and binary values cut to the maximal size, copied if any is cut
+func (p *SpanPruner) truncate(keyValues []model.KeyValue) ([]model.KeyValue, bool) {
+	var truncated []model.KeyValue
+	for i, kv := range keyValues {
+		switch {
+		case kv.VType == model.StringType && len(kv.VStr) > p.maxTagValueBytes:
+			if truncated == nil {
+				truncated = append([]model.KeyValue(nil), keyValues...)
+			}
+			truncated[i].VStr = truncateString(kv.VStr, p.maxTagValueBytes)
+		case kv.VType == model.BinaryType && len(kv.VBinary) > p.maxTagValueBytes:
+			if truncated == nil {
+				truncated = append([]model.KeyValue(nil), keyValues...)
+			}
+			truncated[i].VBinary = kv.VBinary[:p.maxTagValueBytes]
+		}
+	}
+	if truncated == nil {
+		return keyValues, false
+	}
+	return truncated, true
+}
+
+// truncateString cuts the string to at most size bytes without splitting a UTF-8 encoded character
+func truncateString(value string, size int) string {
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
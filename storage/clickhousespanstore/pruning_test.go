@@ -0,0 +1,81 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanPruner_prune(t *testing.T) {
+	logs := []model.Log{
+		{Timestamp: time.Unix(1, 0), Fields: []model.KeyValue{model.String("event", "first")}},
+		{Timestamp: time.Unix(2, 0), Fields: []model.KeyValue{model.String("payload", "0123456789")}},
+		{Timestamp: time.Unix(3, 0), Fields: []model.KeyValue{model.String("event", "third")}},
+	}
+	span := &model.Span{
+		OperationName: "GET /orders",
+		Tags:          []model.KeyValue{model.String("http.url", "/orders?page=1"), model.Int64("http.status_code", 200)},
+		Process:       model.NewProcess("frontend", []model.KeyValue{model.Binary("certificate", []byte("0123456789"))}),
+		Logs:          logs,
+	}
+
+	tests := map[string]struct {
+		pruner   *SpanPruner
+		expected *model.Span
+	}{
+		"nil pruner": {
+			expected: span,
+		},
+		"drop logs": {
+			pruner: NewSpanPruner(true, 1, 0),
+			expected: &model.Span{
+				OperationName: span.OperationName,
+				Tags:          span.Tags,
+				Process:       span.Process,
+			},
+		},
+		"max logs": {
+			pruner: NewSpanPruner(false, 2, 0),
+			expected: &model.Span{
+				OperationName: span.OperationName,
+				Tags:          span.Tags,
+				Process:       span.Process,
+				Logs:          logs[:2],
+			},
+		},
+		"max tag value bytes": {
+			pruner: NewSpanPruner(false, 0, 8),
+			expected: &model.Span{
+				OperationName: span.OperationName,
+				Tags:          []model.KeyValue{model.String("http.url", "/orders?"), model.Int64("http.status_code", 200)},
+				Process:       model.NewProcess("frontend", []model.KeyValue{model.Binary("certificate", []byte("01234567"))}),
+				Logs: []model.Log{
+					logs[0],
+					{Timestamp: time.Unix(2, 0), Fields: []model.KeyValue{model.String("payload", "01234567")}},
+					logs[2],
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.pruner.prune(span))
+		})
+	}
+
+	assert.Equal(t, "/orders?page=1", span.Tags[0].VStr, "pruned spans are copies")
+	assert.Equal(t, []byte("0123456789"), span.Process.Tags[0].VBinary)
+	assert.Equal(t, "0123456789", span.Logs[1].Fields[0].VStr)
+	assert.Len(t, span.Logs, 3)
+}
+
+func TestTruncateString(t *testing.T) {
+	assert.Equal(t, "abc", truncateString("abcdef", 3))
+	// "é" is encoded in 2 bytes, it is not split
+	assert.Equal(t, "ab", truncateString("abéd", 3))
+	assert.Equal(t, "abé", truncateString("abéd", 4))
+	assert.Equal(t, "", truncateString("éa", 1))
+}
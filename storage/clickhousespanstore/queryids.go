@@ -0,0 +1,48 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// readQueryIDs derives query IDs of read queries from the queries and their arguments
+type readQueryIDs struct {
+	// withoutTimes leaves time arguments out, so that a search refreshed with a moved time range has the same ID
+	withoutTimes bool
+}
+
+// WithReadQueryIDs tags read queries with query IDs derived from their text and arguments, so that a query retried
+// by a proxy or a load balancer while it still runs is rejected by ClickHouse instead of running twice.
+// With withoutTimes, time arguments are left out of IDs, so that with the replace_running_query setting
+// a refreshed search replaces the previous run of the same search still running.
+func WithReadQueryIDs(withoutTimes bool) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.queryIDs = &readQueryIDs{withoutTimes: withoutTimes}
+	}
+}
+
+// tag returns the context of the query with its query ID, the context is returned as is if query IDs are not derived
+func (ids *readQueryIDs) tag(ctx context.Context, query string, args []interface{}) context.Context {
+	if ids == nil {
+		return ctx
+	}
+	return clickhouse.WithQueryID(ctx, ids.queryID(query, args))
+}
+
+// queryID returns the ID of the query with the arguments
+func (ids *readQueryIDs) queryID(query string, args []interface{}) string {
+	hash := sha256.New()
+	_, _ = hash.Write([]byte(query))
+	for _, arg := range args {
+		if _, ok := arg.(time.Time); ok && ids.withoutTimes {
+			continue
+		}
+		_, _ = fmt.Fprintf(hash, "\x00%v", arg)
+	}
+	return "jaeger-clickhouse-" + hex.EncodeToString(hash.Sum(nil)[:16])
+}
@@ -0,0 +1,37 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadQueryIDs_queryID(t *testing.T) {
+	query := "SELECT DISTINCT traceID FROM jaeger_index WHERE service = ? AND timestamp >= ? AND timestamp <= ?"
+	start := time.Unix(1628000000, 0)
+	args := []interface{}{"frontend", start, start.Add(time.Hour)}
+	refreshed := []interface{}{"frontend", start.Add(time.Minute), start.Add(time.Hour + time.Minute)}
+	other := []interface{}{"backend", start, start.Add(time.Hour)}
+
+	ids := &readQueryIDs{}
+	id := ids.queryID(query, args)
+	assert.True(t, strings.HasPrefix(id, "jaeger-clickhouse-"), id)
+	assert.Len(t, id, len("jaeger-clickhouse-")+32)
+	assert.Equal(t, id, ids.queryID(query, args), "retries have the same ID")
+	assert.NotEqual(t, id, ids.queryID(query, refreshed))
+	assert.NotEqual(t, id, ids.queryID(query, other))
+
+	ids = &readQueryIDs{withoutTimes: true}
+	assert.Equal(t, ids.queryID(query, args), ids.queryID(query, refreshed), "refreshed searches have the same ID")
+	assert.NotEqual(t, ids.queryID(query, args), ids.queryID(query, other))
+}
+
+func TestReadQueryIDs_tag(t *testing.T) {
+	ctx := context.Background()
+	var ids *readQueryIDs
+	assert.Equal(t, ctx, ids.tag(ctx, "SELECT 1", nil), "queries are not tagged without IDs")
+	assert.NotEqual(t, ctx, (&readQueryIDs{}).tag(ctx, "SELECT 1", nil))
+}
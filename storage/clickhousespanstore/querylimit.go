@@ -0,0 +1,82 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errQueryQueueTimeout = errors.New("timed out waiting for a free slot among concurrent queries")
+
+// queryLimiter admits up to a maximal number of concurrent read queries, further queries wait for a free slot
+// in the order they came, so that bursts of searches do not saturate ClickHouse shared with the write path
+type queryLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// WithMaxConcurrentQueries runs at most max queries at the same time, other queries wait for a free slot
+// up to timeout or until their request is cancelled. Zero timeout waits until the request is cancelled.
+// Readers configured with the same option share the limit.
+func WithMaxConcurrentQueries(max int, timeout time.Duration) TraceReaderOption {
+	var limiter *queryLimiter
+	if max > 0 {
+		limiter = &queryLimiter{slots: make(chan struct{}, max), timeout: timeout}
+	}
+	return func(reader *TraceReader) {
+		reader.limiter = limiter
+	}
+}
+
+// acquire waits for a free slot, the returned function releases it
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-l.slots }) }, nil
+	case <-timeout:
+		return nil, errQueryQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedRows keep the slot of their query until they are closed, as the query runs while rows are read.
+// The result of the query is observed when they are closed, including errors of reading and scanning rows.
+type limitedRows struct {
+	*sql.Rows
+	release func()
+	observe func(error)
+	scanErr error
+}
+
+// Scan scans the current row, keeping the first error for the result of the query
+func (r *limitedRows) Scan(dest ...interface{}) error {
+	err := r.Rows.Scan(dest...)
+	if err != nil && r.scanErr == nil {
+		r.scanErr = err
+	}
+	return err
+}
+
+// Close closes the rows, observes the result of the query and releases its slot
+func (r *limitedRows) Close() error {
+	defer r.release()
+	err := r.Rows.Err()
+	if err == nil {
+		err = r.scanErr
+	}
+	r.observe(err)
+	return r.Rows.Close()
+}
@@ -0,0 +1,71 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestQueryLimiter_acquire(t *testing.T) {
+	limiter := &queryLimiter{slots: make(chan struct{}, 1), timeout: 10 * time.Millisecond}
+
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+
+	_, err = limiter.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueryQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = (&queryLimiter{slots: limiter.slots}).acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Releasing twice frees only the one slot
+	release()
+	release()
+	release, err = limiter.acquire(context.Background())
+	require.NoError(t, err)
+	_, err = limiter.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueryQueueTimeout)
+	release()
+
+	release, err = (*queryLimiter)(nil).acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestTraceReader_WithMaxConcurrentQueries(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	limitOpt := WithMaxConcurrentQueries(1, 10*time.Millisecond)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, limitOpt)
+	archiveReader := NewTraceReader(db, "", "", testArchiveTable, limitOpt)
+	query := fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)
+	mock.ExpectQuery(query).WillReturnRows(getRows([]driver.Value{"service"}))
+	mock.ExpectQuery(query).WillReturnError(errorMock)
+	mock.ExpectQuery(query).WillReturnRows(getRows([]driver.Value{"service"}))
+
+	rows, err := traceReader.query(context.Background(), query)
+	require.NoError(t, err)
+	// Readers with the same option share the slot held by the open rows
+	_, err = archiveReader.GetTrace(context.Background(), testSpan.TraceID)
+	assert.ErrorIs(t, err, errQueryQueueTimeout)
+	require.NoError(t, rows.Close())
+
+	// Failed queries release their slot
+	_, err = traceReader.GetServices(context.Background())
+	assert.ErrorIs(t, err, errorMock)
+	services, err := traceReader.GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"service"}, services)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,91 @@
+package clickhousespanstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	numSpanBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_span_bytes_total",
+		Help: "Estimated serialized bytes of written spans by service",
+	}, []string{"service"})
+	numOverQuotaSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_over_quota_spans_total",
+		Help: "Number of spans of services over their daily byte quota, by service and whether they were kept or dropped",
+	}, []string{"service", "action"})
+)
+
+// ByteQuotas limit estimated serialized bytes of spans every service writes per UTC day, so that storage costs
+// of noisy services are predictable. Beyond its quota, a fraction of traces of the service is kept, chosen
+// by trace ID like by load shedding, the rest is dropped. Usage is counted by every writer on its own.
+type ByteQuotas struct {
+	quotas       map[string]int64
+	defaultQuota int64
+	keepFraction float64
+	now          func() time.Time
+
+	mutex sync.Mutex
+	day   time.Time
+	used  map[string]int64
+}
+
+// NewByteQuotas returns ByteQuotas of the services, services not listed have the default quota.
+// Zero quotas are unlimited. Beyond the quota, keepFraction of traces of the service are written.
+func NewByteQuotas(quotas map[string]int64, defaultQuota int64, keepFraction float64) *ByteQuotas {
+	return &ByteQuotas{
+		quotas:       quotas,
+		defaultQuota: defaultQuota,
+		keepFraction: keepFraction,
+		now:          time.Now,
+		used:         make(map[string]int64),
+	}
+}
+
+// WithByteQuotas drops spans of services beyond their daily byte quotas
+func WithByteQuotas(quotas *ByteQuotas) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.quotas = quotas
+	}
+}
+
+// allow reports whether the span of the given size is written and counts the bytes of written spans
+func (q *ByteQuotas) allow(span *model.Span, size int64) bool {
+	service := span.Process.GetServiceName()
+	if q == nil {
+		numSpanBytes.WithLabelValues(service).Add(float64(size))
+		return true
+	}
+	quota, ok := q.quotas[service]
+	if !ok {
+		quota = q.defaultQuota
+	}
+
+	q.mutex.Lock()
+	day := q.now().UTC().Truncate(24 * time.Hour)
+	if !day.Equal(q.day) {
+		q.day = day
+		q.used = make(map[string]int64)
+	}
+	over := quota > 0 && q.used[service] >= quota
+	keep := !over || traceFraction(span.TraceID) < q.keepFraction
+	if keep {
+		q.used[service] += size
+	}
+	q.mutex.Unlock()
+
+	if over {
+		action := "dropped"
+		if keep {
+			action = "kept"
+		}
+		numOverQuotaSpans.WithLabelValues(service, action).Inc()
+	}
+	if keep {
+		numSpanBytes.WithLabelValues(service).Add(float64(size))
+	}
+	return keep
+}
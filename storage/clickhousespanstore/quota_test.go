@@ -0,0 +1,54 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestByteQuotas_allow(t *testing.T) {
+	now := time.Date(2021, 8, 1, 23, 0, 0, 0, time.UTC)
+	quotas := NewByteQuotas(map[string]int64{"noisy": 100, "unlimited": 0}, 1000, 0.5)
+	quotas.now = func() time.Time { return now }
+	newSpan := func(service string, traceID uint64) *model.Span {
+		return &model.Span{TraceID: model.NewTraceID(0, traceID), Process: model.NewProcess(service, nil)}
+	}
+	// Trace IDs in the lower half of the range are kept beyond the quota
+	kept, dropped := uint64(1), uint64(1)<<63
+
+	assert.True(t, quotas.allow(newSpan("noisy", dropped), 60))
+	assert.True(t, quotas.allow(newSpan("noisy", dropped), 60), "the quota is checked before the span")
+	assert.False(t, quotas.allow(newSpan("noisy", dropped), 60))
+	assert.True(t, quotas.allow(newSpan("noisy", kept), 60))
+	assert.Equal(t, int64(180), quotas.used["noisy"], "bytes of dropped spans are not counted")
+
+	assert.True(t, quotas.allow(newSpan("other", dropped), 1000))
+	assert.False(t, quotas.allow(newSpan("other", dropped), 1), "services not listed have the default quota")
+	assert.True(t, quotas.allow(newSpan("unlimited", dropped), 1<<40))
+	assert.True(t, quotas.allow(newSpan("unlimited", dropped), 1))
+
+	// Quotas are renewed every UTC day
+	now = now.Add(time.Hour)
+	assert.True(t, quotas.allow(newSpan("noisy", dropped), 60))
+	assert.Equal(t, int64(60), quotas.used["noisy"])
+
+	var nilQuotas *ByteQuotas
+	assert.True(t, nilQuotas.allow(newSpan("noisy", dropped), 1<<40))
+}
+
+func TestSpanWriter_WriteSpanByteQuotas(t *testing.T) {
+	writer := &SpanWriter{
+		spans:  make(chan tenantSpan, 2),
+		quotas: NewByteQuotas(nil, 1, 0),
+	}
+
+	span := testSpan
+	assert.NoError(t, writer.WriteSpan(context.Background(), &span))
+	assert.NoError(t, writer.WriteSpan(context.Background(), &span))
+	assert.Len(t, writer.spans, 1, "span over the quota is not queued")
+	queued := <-writer.spans
+	assert.Equal(t, int64(span.Size()), queued.bytes)
+}
@@ -3,16 +3,17 @@ package clickhousespanstore
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/opentracing/opentracing-go"
 
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 )
 
@@ -20,12 +21,39 @@ const (
 	minTimespanForProgressiveSearch       = time.Hour
 	minTimespanForProgressiveSearchMargin = time.Minute
 	maxProgressiveSteps                   = 4
+
+	// traceIDPrefixTag is a search tag whose value is matched against the beginning of trace IDs
+	traceIDPrefixTag        = "trace.id_prefix"
+	maxTraceIDPrefixResults = 100
+	// minSpansTag and minServicesTag are search tags limiting the minimal number of spans and distinct services in a trace
+	minSpansTag    = "jaeger.min_spans"
+	minServicesTag = "jaeger.min_services"
+	// debugTag and sampledTag are search tags filtering spans by their flags, when flags are indexed
+	debugTag   = "jaeger.debug"
+	sampledTag = "jaeger.sampled"
+	// linkedToTag is a search tag whose value is a trace ID referenced by spans of found traces, when links are indexed
+	linkedToTag = "jaeger.linked_to"
+	// negatedTagPrefix negates a search tag value, e.g. error=!true matches spans with the tag having another value,
+	// absentTagValue matches spans without the tag and escapedTagPrefix matches values starting with the prefix
+	negatedTagPrefix = "!"
+	absentTagValue   = "!*"
+	escapedTagPrefix = `\!`
 )
 
+var flagTags = map[string]model.Flags{
+	debugTag:   model.DebugFlag,
+	sampledTag: model.SampledFlag,
+}
+
 var (
 	errNoOperationsTable = errors.New("no operations table supplied")
 	errNoIndexTable      = errors.New("no index table supplied")
 	errStartTimeRequired = errors.New("start time is required for search queries")
+	errInvalidTraceSize  = errors.New("minimal number of spans or services must be a non-negative integer")
+	errInvalidPrefix     = errors.New("trace ID prefix must be a non-empty hexadecimal string of at most 32 characters")
+	errInvalidFlag       = errors.New("flag search tag must be either true or false")
+	errInvalidLinkedTo   = errors.New("linked trace ID must be a hexadecimal trace ID")
+	errInvalidRoot       = errors.New("root search tag must be either true or false")
 )
 
 // TraceReader for reading spans from ClickHouse
@@ -34,18 +62,244 @@ type TraceReader struct {
 	operationsTable TableName
 	indexTable      TableName
 	spansTable      TableName
+	tenantHeader    string
+	flagsIndex      bool
+	linksIndex      bool
+	// statusCodesIndex filters by status code search tags using the status code columns of the index table
+	statusCodesIndex bool
+	// spanKindIndex filters by the span.kind search tag using the spanKind column of the index table
+	spanKindIndex bool
+	// rootsIndex filters by the jaeger.root search tag using the isRoot column of the index table
+	rootsIndex bool
+	// insertTimeIndex filters by the jaeger.as_of search tag using the insertedAt column of the index table
+	insertTimeIndex bool
+	// operationsByPopularity orders operations by number of their spans since yesterday instead of by name
+	operationsByPopularity bool
+	// spanLogsTable has fields of logs of spans, searched by log.<field> and jaeger.log_contains search tags
+	spanLogsTable TableName
+	// archive is searched along with the spans table, traces of both are found by searches if it is set
+	archive *TraceReader
+	// processes restores processes of spans stored with their hashes, spans are stored with processes if nil
+	processes *processes
+	// operationsWithoutSpanKind reads operations of an operations table without the spankind column
+	operationsWithoutSpanKind bool
+	// rotation restricts searches to index tables of periods of the searched time range
+	rotation *TableRotation
+	// extractedTags are tags with their own columns in the index table by their keys
+	extractedTags map[string]ExtractedTag
+	// encoding of all stored spans, if empty the encoding of each span is detected
+	encoding Encoding
+	// decodingWorkers decode spans of fetched traces concurrently, spans are decoded sequentially if at most 1
+	decodingWorkers int
+	// searchCache keeps trace IDs found by recent searches, searchCacheTTL also buckets search time ranges
+	searchCache    cache.Cache
+	searchCacheTTL time.Duration
+	// summariesTable aggregates number of spans, start, duration and root service per trace
+	summariesTable TableName
+	// serviceAliasesDict maps aliases to canonical service names, serviceAliasesTable is its source
+	serviceAliasesDict  TableName
+	serviceAliasesTable TableName
+	// withoutPrewhere moves PREWHERE conditions to WHERE, for servers and proxies not supporting PREWHERE
+	withoutPrewhere bool
+	// userDB returns connections of the user of the request, db is used if nil
+	userDB UserDB
+	// schema tracks optional columns of the index table, features whose columns are missing are skipped
+	schema *SchemaMonitor
+	// shardHealth tracks unavailable shards skipped by queries, traces are annotated while there are any
+	shardHealth *shardHealth
+	// limiter restricts the number of concurrent queries, queries are not limited if nil
+	limiter *queryLimiter
+	// breaker fails queries fast while ClickHouse is failing, queries are always run if nil
+	breaker *circuitBreaker
+	// hiddenTable has tombstones of traces hidden from readers
+	hiddenTable TableName
+	// tracesTable aggregates spans of every trace into a row, traces are read from the spans table if empty
+	tracesTable TableName
+	// defaultNumTraces is the number of traces found by searches without a positive number of traces,
+	// maxNumTraces caps the number of traces of any search if positive
+	defaultNumTraces int
+	maxNumTraces     int
+	// spansSearchLimit is the number of the newest spans scanned by searches without the index table, 0 disables them
+	spansSearchLimit int
+	// recentTracesTable has traces of every service written within recentTracesWindow, searched by service only
+	recentTracesTable  TableName
+	recentTracesWindow time.Duration
+	// hotIndexTable has index rows written within hotIndexWindow, searched instead of the index table within the window
+	hotIndexTable  TableName
+	hotIndexWindow time.Duration
+	// baselinesTable has daily quantiles of durations of operations, aggregated within baselinesWindow for searches
+	baselinesTable  TableName
+	baselinesWindow time.Duration
+	// decodeDiagnostics counts spans that cannot be decoded and fails or annotates their traces, they are skipped if nil
+	decodeDiagnostics *decodeDiagnostics
+	// sequentialConsistency fetches spans of traces only from replicas having all spans inserted with quorum
+	sequentialConsistency bool
+	// fetchChunkSize is the maximal number of traces fetched by a query, all traces are fetched by one query if 0
+	fetchChunkSize int
+	// audit records sampled reads of traces, reads are not recorded if nil
+	audit *AuditLog
+	// binaryTraceIDs reads trace IDs stored as 16 bytes in spans and index tables
+	binaryTraceIDs bool
+	// timeouts limit how long methods wait for ClickHouse
+	timeouts QueryTimeouts
+	// servicesLookback lists services of the index table within it, services of the operations table are listed if 0
+	servicesLookback time.Duration
+	// excludedServices are left out of listed services
+	excludedServices map[string]bool
+	// coalescedQueries shares results of concurrent identical service and operation queries, they always run if nil
+	coalescedQueries *queryGroup
+	// queryIDs derives query IDs of queries from their parameters, ClickHouse generates them if nil
+	queryIDs *readQueryIDs
+}
+
+// UserDB returns the connection pool of the ClickHouse user the request is made for and a function releasing it,
+// which is called once queries on the pool are done
+type UserDB func(ctx context.Context) (db *sql.DB, release func(), err error)
+
+// TraceReaderOption configures optional behaviour of TraceReader
+type TraceReaderOption func(reader *TraceReader)
+
+// WithReaderTenantHeader scopes all queries to the tenant from the gRPC metadata key header of the request
+func WithReaderTenantHeader(header string) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.tenantHeader = header
+	}
+}
+
+// WithReaderFlagsIndex filters spans by the flags column of the index table for jaeger.debug and jaeger.sampled search tags
+func WithReaderFlagsIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.flagsIndex = true
+	}
+}
+
+// WithReaderLinksIndex finds traces linked to the trace of the jaeger.linked_to search tag by the linkedTraceIDs column
+// of the index table
+func WithReaderLinksIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.linksIndex = true
+	}
+}
+
+// WithOperationsByPopularity lists operations of a service with the most spans since yesterday first, then by name,
+// so that the relevant ones come first for services with many operations
+func WithOperationsByPopularity() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.operationsByPopularity = true
+	}
+}
+
+// WithSingleEncoding decodes all spans with the encoding instead of detecting the encoding of each span
+func WithSingleEncoding(encoding Encoding) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.encoding = encoding
+	}
+}
+
+// WithDecodingWorkers decodes spans of fetched traces with up to workers goroutines, e.g. for traces of thousands of spans
+func WithDecodingWorkers(workers int) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.decodingWorkers = workers
+	}
+}
+
+// WithSearchCache caches trace IDs of up to size recent searches for ttl.
+// Searches with time ranges falling into the same ttl bucket share the cached result,
+// e.g. auto-refreshed dashboards searching for the last hour.
+func WithSearchCache(size int, ttl time.Duration) TraceReaderOption {
+	return func(reader *TraceReader) {
+		if size <= 0 || ttl <= 0 {
+			return
+		}
+		reader.searchCache = cache.NewLRUWithOptions(size, &cache.Options{TTL: ttl})
+		reader.searchCacheTTL = ttl
+	}
+}
+
+// WithServiceAliases lists services under their canonical names from the dictionary and searches a canonical service
+// together with its aliases from the source table of the dictionary, so renamed services are searched under one name.
+// Both names have to be qualified with the database.
+func WithServiceAliases(dictionary, table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.serviceAliasesDict = dictionary
+		reader.serviceAliasesTable = table
+	}
+}
+
+// WithoutPrewhere filters with WHERE only, for ClickHouse versions and proxies not supporting PREWHERE
+func WithoutPrewhere() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.withoutPrewhere = true
+	}
+}
+
+// WithSequentialConsistency fetches spans of traces with select_sequential_consistency, so that traces are found right
+// after they are written despite replication lag. Spans have to be inserted with insert_quorum, queries fail on replicas
+// lagging behind the quorum instead of returning incomplete traces.
+func WithSequentialConsistency() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.sequentialConsistency = true
+	}
+}
+
+// WithUserDB queries with connections of the ClickHouse user of every request, so that row policies of the user apply
+func WithUserDB(userDB UserDB) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.userDB = userDB
+	}
 }
 
 var _ spanstore.Reader = (*TraceReader)(nil)
 
 // NewTraceReader returns a TraceReader for the database
-func NewTraceReader(db *sql.DB, operationsTable, indexTable, spansTable TableName) *TraceReader {
-	return &TraceReader{
-		db:              db,
-		operationsTable: operationsTable,
-		indexTable:      indexTable,
-		spansTable:      spansTable,
+func NewTraceReader(db *sql.DB, operationsTable, indexTable, spansTable TableName, opts ...TraceReaderOption) *TraceReader {
+	reader := &TraceReader{
+		db:               db,
+		operationsTable:  operationsTable,
+		indexTable:       indexTable,
+		spansTable:       spansTable,
+		defaultNumTraces: DefaultNumTraces,
 	}
+	for _, opt := range opts {
+		opt(reader)
+	}
+	return reader
+}
+
+// query runs the query with connections of the user of the request, if there is one,
+// once the limiter admits it, unless the circuit breaker is open. The rows have to be closed to let other queries run.
+func (r *TraceReader) query(ctx context.Context, query string, args ...interface{}) (*limitedRows, error) {
+	db, releaseDB := r.db, func() {}
+	if r.userDB != nil {
+		var err error
+		if db, releaseDB, err = r.userDB(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.breaker.allow(); err != nil {
+		releaseDB()
+		return nil, err
+	}
+	releaseSlot, err := r.limiter.acquire(ctx)
+	if err != nil {
+		releaseDB()
+		return nil, err
+	}
+	release := func() {
+		releaseSlot()
+		releaseDB()
+	}
+	rows, err := db.QueryContext(r.queryIDs.tag(ctx, query, args), query, args...)
+	if err != nil {
+		r.breaker.observe(err)
+		release()
+		return nil, err
+	}
+	return &limitedRows{Rows: rows, release: release, observe: r.breaker.observe}, nil
+}
+
+func (r *TraceReader) multiTenant() bool {
+	return r.tenantHeader != ""
 }
 
 func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) ([]*model.Trace, error) {
@@ -55,81 +309,150 @@ func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) (
 		return returning, nil
 	}
 
-	span, _ := opentracing.StartSpanFromContext(ctx, "getTraces")
+	span, ctx := opentracing.StartSpanFromContext(ctx, "getTraces")
 	defer span.Finish()
 
-	values := make([]interface{}, len(traceIDs))
-	for i, traceID := range traceIDs {
-		values[i] = traceID.String()
+	traceIDs, err := r.withoutHidden(ctx, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(traceIDs) == 0 {
+		return returning, nil
+	}
+
+	stored, err := r.getStoredSpans(ctx, traceIDs)
+	if err != nil {
+		return nil, err
 	}
 
+	var (
+		spans  []*model.Span
+		failed map[string]int
+	)
+	if r.decodeDiagnostics != nil {
+		spans, failed, err = r.decodeDiagnostics.decode(stored, r.encoding, r.decodingWorkers)
+	} else {
+		spans, err = unmarshalSpans(stored.models, r.encoding, r.decodingWorkers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.resolveProcesses(ctx, spans); err != nil {
+		return nil, err
+	}
+
+	traces := map[model.TraceID]*model.Trace{}
+	for _, span := range spans {
+		if _, ok := traces[span.TraceID]; !ok {
+			traces[span.TraceID] = &model.Trace{}
+		}
+
+		traces[span.TraceID].Spans = append(traces[span.TraceID].Spans, span)
+	}
+
+	for _, traceID := range traceIDs {
+		if trace, ok := traces[traceID]; ok {
+			returning = append(returning, trace)
+		}
+	}
+
+	if len(failed) > 0 {
+		annotateUndecoded(returning, failed)
+	}
+	if unavailable := r.shardHealth.unavailableShards(ctx); len(unavailable) > 0 {
+		span.SetTag("shards.unavailable", fmt.Sprint(unavailable))
+		annotatePartial(returning, unavailable)
+	}
+
+	return returning, nil
+}
+
+// storedSpans are serialized spans of traces with IDs of the traces they are stored for,
+// trace IDs are read only when they are needed
+type storedSpans struct {
+	models   [][]byte
+	traceIDs []string
+}
+
+// getSpanModels returns serialized spans of the traces from the spans table
+func (r *TraceReader) getSpanModels(ctx context.Context, traceIDs []model.TraceID) (storedSpans, error) {
+	span := opentracing.SpanFromContext(ctx)
+
+	placeholders, values := r.traceIDCondition(traceIDs)
+
+	columns := "model"
+	if r.decodeDiagnostics != nil {
+		columns = r.traceIDString() + ", model"
+	}
 	// It's more efficient to do PREWHERE on traceID to the only read needed models:
 	// * https://clickhouse.tech/docs/en/sql-reference/statements/select/prewhere/
 	//nolint:gosec  , G201: SQL string formatting
-	query := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (%s)", r.spansTable, "?"+strings.Repeat(",?", len(values)-1))
+	query := fmt.Sprintf("SELECT %s FROM %s PREWHERE traceID IN (%s)", columns, r.spansTable, placeholders)
+	tenantCondition := " WHERE tenant = ?"
+	if r.withoutPrewhere {
+		query = fmt.Sprintf("SELECT %s FROM %s WHERE traceID IN (%s)", columns, r.spansTable, placeholders)
+		tenantCondition = " AND tenant = ?"
+	}
+	if r.multiTenant() {
+		query += tenantCondition
+		values = append(values, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += r.fetchSettings()
 
 	span.SetTag("db.statement", query)
 	span.SetTag("db.args", values)
 
-	rows, err := r.db.QueryContext(ctx, query, values...)
+	defer observeTraceFetch("spans", time.Now())
+	rows, err := r.query(ctx, query, values...)
 	if err != nil {
-		return nil, err
+		return storedSpans{}, err
 	}
 
 	defer rows.Close()
 
-	traces := map[model.TraceID]*model.Trace{}
-
+	var stored storedSpans
 	for rows.Next() {
-		var serialized string
-
-		err = rows.Scan(&serialized)
-		if err != nil {
-			return nil, err
-		}
-
-		span := model.Span{}
+		var traceID, data string
 
-		if serialized[0] == '{' {
-			err = json.Unmarshal([]byte(serialized), &span)
+		if r.decodeDiagnostics != nil {
+			err = rows.Scan(&traceID, &data)
 		} else {
-			err = proto.Unmarshal([]byte(serialized), &span)
+			err = rows.Scan(&data)
 		}
-
 		if err != nil {
-			return nil, err
+			return storedSpans{}, err
 		}
-
-		if _, ok := traces[span.TraceID]; !ok {
-			traces[span.TraceID] = &model.Trace{}
-		}
-
-		traces[span.TraceID].Spans = append(traces[span.TraceID].Spans, &span)
+		stored.models = append(stored.models, []byte(data))
+		stored.traceIDs = append(stored.traceIDs, traceID)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return storedSpans{}, err
 	}
+	return stored, nil
+}
 
-	for _, traceID := range traceIDs {
-		if trace, ok := traces[traceID]; ok {
-			returning = append(returning, trace)
-		}
+// fetchSettings returns the SETTINGS clause of queries fetching spans of traces, empty if there are no settings
+func (r *TraceReader) fetchSettings() string {
+	if r.sequentialConsistency {
+		return " SETTINGS select_sequential_consistency = 1"
 	}
-
-	return returning, nil
+	return ""
 }
 
 // GetTrace takes a traceID and returns a Trace associated with that traceID
 func (r *TraceReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTrace")
 	defer span.Finish()
+	ctx, cancel := withTimeout(ctx, r.timeouts.GetTrace)
+	defer cancel()
 
 	traces, err := r.getTraces(ctx, []model.TraceID{traceID})
 	if err != nil {
 		return nil, err
 	}
 
+	r.audit.record(ctx, auditGetTrace, map[string]string{"traceID": traceID.String()}, traces)
 	if len(traces) == 0 {
 		return nil, spanstore.ErrTraceNotFound
 	}
@@ -138,7 +461,7 @@ func (r *TraceReader) GetTrace(ctx context.Context, traceID model.TraceID) (*mod
 }
 
 func (r *TraceReader) getStrings(ctx context.Context, sql string, args ...interface{}) ([]string, error) {
-	rows, err := r.db.QueryContext(ctx, sql, args...)
+	rows, err := r.query(ctx, sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -166,16 +489,70 @@ func (r *TraceReader) getStrings(ctx context.Context, sql string, args ...interf
 func (r *TraceReader) GetServices(ctx context.Context) ([]string, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetServices")
 	defer span.Finish()
+	ctx, cancel := withTimeout(ctx, r.timeouts.GetServices)
+	defer cancel()
 
-	if r.operationsTable == "" {
+	services, err := r.coalescedQueries.do(ctx, "services\x00"+TenantFromContext(ctx, r.tenantHeader),
+		func(ctx context.Context) (interface{}, error) {
+			return r.getServices(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	// Callers get copies, as the result may be shared
+	shared := services.([]string)
+	return append(make([]string, 0, len(shared)), shared...), nil
+}
+
+// getServices queries services, without excluded ones
+func (r *TraceReader) getServices(ctx context.Context) ([]string, error) {
+	span := opentracing.SpanFromContext(ctx)
+	table := r.operationsTable
+	if r.servicesLookback > 0 {
+		if r.indexTable == "" {
+			return nil, errNoIndexTable
+		}
+		table = r.indexTable
+	} else if table == "" {
 		return nil, errNoOperationsTable
 	}
 
-	query := fmt.Sprintf("SELECT service FROM %s GROUP BY service", r.operationsTable)
+	column, group := "service", "service"
+	if r.serviceAliasesDict != "" {
+		// Aliases are listed under their canonical service
+		column = fmt.Sprintf("dictGetOrDefault('%s', 'service', tuple(service), service) AS canonicalService", r.serviceAliasesDict.Unquoted())
+		group = "canonicalService"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", column, table)
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if r.multiTenant() {
+		conditions = append(conditions, "tenant = ?")
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	if r.servicesLookback > 0 {
+		end := time.Now()
+		start := end.Add(-r.servicesLookback)
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, start)
+		periods, periodArgs := r.periodsCondition(table, start, end)
+		query += " WHERE " + strings.Join(conditions, " AND ") + periods
+		args = append(args, periodArgs...)
+	} else if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " GROUP BY " + group
 
 	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
 
-	return r.getStrings(ctx, query)
+	services, err := r.getStrings(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return r.withoutExcludedServices(services), nil
 }
 
 // GetOperations fetches operations in the service and empty slice if service does not exists
@@ -185,19 +562,52 @@ func (r *TraceReader) GetOperations(
 ) ([]spanstore.Operation, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetOperations")
 	defer span.Finish()
+	ctx, cancel := withTimeout(ctx, r.timeouts.GetServices)
+	defer cancel()
+
+	key := fmt.Sprintf("operations\x00%s\x00%s\x00%s", TenantFromContext(ctx, r.tenantHeader), params.ServiceName, params.SpanKind)
+	operations, err := r.coalescedQueries.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return r.getOperations(ctx, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Callers get copies, as the result may be shared
+	shared := operations.([]spanstore.Operation)
+	return append(make([]spanstore.Operation, 0, len(shared)), shared...), nil
+}
 
+// getOperations queries operations in the service
+func (r *TraceReader) getOperations(ctx context.Context, params spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	span := opentracing.SpanFromContext(ctx)
 	if r.operationsTable == "" {
 		return nil, errNoOperationsTable
 	}
 
 	//nolint:gosec  , G201: SQL string formatting
-	query := fmt.Sprintf("SELECT operation, spankind FROM %s WHERE service = ? GROUP BY operation, spankind ORDER BY operation", r.operationsTable)
-	args := []interface{}{params.ServiceName}
+	columns, group := "operation, spankind", "operation, spankind"
+	if r.operationsWithoutSpanKind {
+		columns, group = "operation, '' AS spankind", "operation"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE", columns, r.operationsTable)
+	args := make([]interface{}, 0, 2)
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	serviceCondition, serviceArgs := r.serviceCondition(params.ServiceName)
+	query += " " + serviceCondition + " GROUP BY " + group + " ORDER BY "
+	if r.operationsByPopularity {
+		// Operations are counted per day, yesterday is included to cover the last 24 hours
+		query += "sumIf(count, date >= yesterday()) DESC, "
+	}
+	query += "operation"
+	args = append(args, serviceArgs...)
 
 	span.SetTag("db.statement", query)
 	span.SetTag("db.args", args)
 
-	rows, err := r.db.QueryContext(ctx, query, args...)
+	rows, err := r.query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -229,20 +639,110 @@ func (r *TraceReader) GetOperations(
 func (r *TraceReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraces")
 	defer span.Finish()
+	ctx, cancel := withTimeout(ctx, r.timeouts.FindTraces)
+	defer cancel()
 
-	traceIDs, err := r.FindTraceIDs(ctx, query)
+	query = r.limitNumTraces(query)
+	traceIDs, err := r.searchTraceIDs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := r.searchArchive(ctx, query, traceIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	return r.getTraces(ctx, traceIDs)
+	traces, err := r.getTraces(ctx, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(archived) > 0 {
+		archivedTraces, err := r.archive.getTraces(ctx, archived)
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, archivedTraces...)
+	}
+	r.audit.record(ctx, auditFindTraces, query, traces)
+	return traces, nil
 }
 
 // FindTraceIDs retrieves only the TraceIDs that match the traceQuery, but not the trace data
 func (r *TraceReader) FindTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDs")
 	defer span.Finish()
+	ctx, cancel := withTimeout(ctx, r.timeouts.FindTraces)
+	defer cancel()
+
+	params = r.limitNumTraces(params)
+	traceIDs, err := r.searchTraceIDs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := r.searchArchive(ctx, params, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+	// Found trace IDs may be cached, so they are not appended to in place
+	return r.withoutHidden(ctx, append(traceIDs[:len(traceIDs):len(traceIDs)], archived...))
+}
+
+// searchTraceIDs returns IDs of traces matching the search, including hidden ones, from the search cache if enabled
+func (r *TraceReader) searchTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	span := opentracing.SpanFromContext(ctx)
+	if r.searchCache == nil {
+		return r.findTraceIDs(ctx, params)
+	}
+
+	key := r.searchCacheKey(ctx, params)
+	if found, ok := r.searchCache.Get(key).([]model.TraceID); ok {
+		span.SetTag("cache.hit", true)
+		return found, nil
+	}
 
+	found, err := r.findTraceIDs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.shardHealth.unavailableShards(ctx)) == 0 {
+		r.searchCache.Put(key, found)
+	}
+	return found, nil
+}
+
+// searchCacheKey normalizes search parameters, so that equal searches within the same time bucket have the same key
+func (r *TraceReader) searchCacheKey(ctx context.Context, params *spanstore.TraceQueryParameters) string {
+	end := params.StartTimeMax
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	tags := make([]string, 0, len(params.Tags))
+	for key, value := range params.Tags {
+		tags = append(tags, fmt.Sprintf("%q=%q", key, value))
+	}
+	sort.Strings(tags)
+
+	var tenant string
+	if r.multiTenant() {
+		tenant = TenantFromContext(ctx, r.tenantHeader)
+	}
+
+	return fmt.Sprintf(
+		"%q %q %q %d %d %d %d %d %s",
+		tenant,
+		params.ServiceName,
+		params.OperationName,
+		params.StartTimeMin.Truncate(r.searchCacheTTL).UnixNano(),
+		end.Truncate(r.searchCacheTTL).UnixNano(),
+		params.DurationMin,
+		params.DurationMax,
+		params.NumTraces,
+		strings.Join(tags, ","),
+	)
+}
+
+func (r *TraceReader) findTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
 	if params.StartTimeMin.IsZero() {
 		return nil, errStartTimeRequired
 	}
@@ -252,6 +752,25 @@ func (r *TraceReader) FindTraceIDs(ctx context.Context, params *spanstore.TraceQ
 		end = time.Now()
 	}
 
+	if prefix, ok := params.Tags[traceIDPrefixTag]; ok {
+		return r.FindTraceIDsByPrefix(ctx, prefix, params.StartTimeMin, end, params.NumTraces)
+	}
+
+	if linkedTo, ok := params.Tags[linkedToTag]; ok && r.linksIndex && r.schema.hasColumn(linkedTraceIDsColumn) {
+		return r.FindTraceIDsLinkedTo(ctx, linkedTo, params.StartTimeMin, end, params.NumTraces)
+	}
+
+	if r.isRecentSearch(params, time.Now()) {
+		found, err := r.findRecentTraceIDs(ctx, params, end)
+		if err != nil {
+			return nil, err
+		}
+		// Too few traces may be found in the table right after its creation, so the index is searched then
+		if len(found) >= params.NumTraces {
+			return found, nil
+		}
+	}
+
 	fullTimeSpan := end.Sub(params.StartTimeMin)
 
 	if fullTimeSpan < minTimespanForProgressiveSearch+minTimespanForProgressiveSearchMargin {
@@ -313,11 +832,80 @@ func (r *TraceReader) findTraceIDsInRange(ctx context.Context, params *spanstore
 	span.SetTag("range", end.Sub(start).String())
 
 	if r.indexTable == "" {
+		if r.spansSearchLimit > 0 {
+			return r.findTraceIDsInSpans(ctx, params, start, end, skip)
+		}
 		return nil, errNoIndexTable
 	}
 
-	query := fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE service = ?", r.indexTable)
-	args := []interface{}{params.ServiceName}
+	filter, args, err := r.searchFilter(ctx, params, start, end)
+	if err != nil {
+		return nil, err
+	}
+	table := r.searchedIndexTable(start, time.Now())
+	query := fmt.Sprintf("SELECT DISTINCT traceID FROM %s%s", table, filter)
+
+	if len(skip) > 0 {
+		placeholders, skipArgs := r.traceIDCondition(skip)
+		query += fmt.Sprintf(" AND traceID NOT IN (%s)", placeholders)
+		args = append(args, skipArgs...)
+	}
+
+	// Sorting by service is required for early termination of primary key scan:
+	// * https://github.com/ClickHouse/ClickHouse/issues/7102
+	if r.multiTenant() {
+		query += " ORDER BY tenant, service, timestamp DESC LIMIT ?"
+	} else {
+		query += " ORDER BY service, timestamp DESC LIMIT ?"
+	}
+	args = append(args, params.NumTraces-len(skip))
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	return r.getTraceIDs(ctx, query, args...)
+}
+
+// searchFilter returns PREWHERE and WHERE clauses of index rows matching search parameters in the time range
+func (r *TraceReader) searchFilter(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	start, end time.Time,
+) (string, []interface{}, error) {
+	var query string
+	args := make([]interface{}, 0)
+
+	// Duration is filtered first, so that the rest of columns is read only for matching granules.
+	// Together with the skip index on durationUs, it makes search of latency outliers cheap.
+	var prewhere []string
+	if params.DurationMin != 0 {
+		prewhere = append(prewhere, "durationUs >= ?")
+		args = append(args, params.DurationMin.Microseconds())
+	}
+
+	if params.DurationMax != 0 {
+		prewhere = append(prewhere, "durationUs <= ?")
+		args = append(args, params.DurationMax.Microseconds())
+	}
+
+	where := " WHERE"
+	if len(prewhere) > 0 {
+		if r.withoutPrewhere {
+			where += " " + strings.Join(prewhere, " AND ") + " AND"
+		} else {
+			query += " PREWHERE " + strings.Join(prewhere, " AND ")
+		}
+	}
+
+	query += where
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+
+	serviceCondition, serviceArgs := r.serviceCondition(params.ServiceName)
+	query += " " + serviceCondition
+	args = append(args, serviceArgs...)
 
 	if params.OperationName != "" {
 		query += " AND operation = ?"
@@ -330,36 +918,272 @@ func (r *TraceReader) findTraceIDsInRange(ctx context.Context, params *spanstore
 	query += " AND timestamp <= ?"
 	args = append(args, end)
 
-	if params.DurationMin != 0 {
-		query += " AND durationUs >= ?"
-		args = append(args, params.DurationMin.Microseconds())
+	periodsQuery, periodsArgs := r.periodsCondition(r.indexTable, start, end)
+	query += periodsQuery
+	args = append(args, periodsArgs...)
+
+	for key, value := range params.Tags {
+		if key == minSpansTag || key == minServicesTag || r.isBaselineTag(key) || r.isSpanLogsTag(key) {
+			continue
+		}
+		// Negated and escaped values are matched against span tags only
+		if strings.HasPrefix(value, negatedTagPrefix) || strings.HasPrefix(value, escapedTagPrefix) {
+			condition, conditionArgs := tagCondition(key, value)
+			query += condition
+			args = append(args, conditionArgs...)
+			continue
+		}
+		if flag, ok := flagTags[key]; ok && r.flagsIndex && r.schema.hasColumn(flagsColumn) {
+			set, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: %s=%q", errInvalidFlag, key, value)
+			}
+			if set {
+				query += " AND bitAnd(flags, ?) != 0"
+			} else {
+				query += " AND bitAnd(flags, ?) = 0"
+			}
+			args = append(args, int64(flag))
+			continue
+		}
+		if key == rootTag && r.rootsIndex && r.schema.hasColumn(isRootColumn) {
+			root, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: %s=%q", errInvalidRoot, key, value)
+			}
+			query += " AND isRoot = ?"
+			args = append(args, boolValue(root))
+			continue
+		}
+		if r.isAsOfTag(key) {
+			condition, conditionArgs, err := asOfCondition(value)
+			if err != nil {
+				return "", nil, err
+			}
+			query += condition
+			args = append(args, conditionArgs...)
+			continue
+		}
+		if key == spanKindTag && r.spanKindIndex && r.schema.hasColumn(spanKindColumn) {
+			query += " AND spanKind = ?"
+			args = append(args, strings.ToLower(strings.TrimSpace(value)))
+			continue
+		}
+		if column, ok := statusCodeColumn(key); ok && r.statusCodesIndex && r.schema.hasColumn(column) {
+			condition, conditionArgs, err := statusCodeCondition(column, value)
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: %s=%q", err, key, value)
+			}
+			query += condition
+			args = append(args, conditionArgs...)
+			continue
+		}
+		// Values not convertible to the type of the column are not written to it, they are searched in tags columns
+		if tag, ok := r.extractedTags[key]; ok && r.schema.hasColumn(tag.Column()) {
+			if converted, ok := tag.convert(value); ok {
+				query += fmt.Sprintf(" AND %s = ?", tag.Column())
+				args = append(args, converted)
+				continue
+			}
+		}
+		condition, conditionArgs := tagCondition(key, value)
+		query += condition
+		args = append(args, conditionArgs...)
 	}
 
-	if params.DurationMax != 0 {
-		query += " AND durationUs <= ?"
-		args = append(args, params.DurationMax.Microseconds())
+	sizeQuery, sizeArgs, err := r.traceSizeCondition(ctx, params, start, end)
+	if err != nil {
+		return "", nil, err
 	}
+	query += sizeQuery
+	args = append(args, sizeArgs...)
 
-	for key, value := range params.Tags {
-		query += " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?"
-		args = append(args, key, key, value)
+	baselineQuery, baselineArgs, err := r.baselineCondition(ctx, params, end)
+	if err != nil {
+		return "", nil, err
 	}
+	query += baselineQuery
+	args = append(args, baselineArgs...)
 
-	if len(skip) > 0 {
-		query += fmt.Sprintf(" AND traceID NOT IN (%s)", "?"+strings.Repeat(",?", len(skip)-1))
-		for _, traceID := range skip {
-			args = append(args, traceID.String())
+	logsQuery, logsArgs := r.spanLogsCondition(ctx, params, start, end)
+	query += logsQuery
+	args = append(args, logsArgs...)
+
+	return query, args, nil
+}
+
+// tagCondition matches spans by the tags columns of the index table, the value may be negated or escaped
+func tagCondition(key, value string) (string, []interface{}) {
+	switch {
+	case value == absentTagValue:
+		return " AND NOT has(tags.key, ?)", []interface{}{key}
+	case strings.HasPrefix(value, escapedTagPrefix):
+		value = strings.TrimPrefix(value, `\`)
+	case strings.HasPrefix(value, negatedTagPrefix):
+		return " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] != ?",
+			[]interface{}{key, key, strings.TrimPrefix(value, negatedTagPrefix)}
+	}
+	return " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?", []interface{}{key, key, value}
+}
+
+// serviceCondition matches the service and, with service aliases, the aliases of the service.
+// The service column stays compared with a set, so that the primary key of the index is still used.
+func (r *TraceReader) serviceCondition(service string) (string, []interface{}) {
+	if r.serviceAliasesTable == "" {
+		return "service = ?", []interface{}{service}
+	}
+	return fmt.Sprintf("service IN (SELECT alias FROM %s WHERE service = ? UNION ALL SELECT ?)", r.serviceAliasesTable),
+		[]interface{}{service, service}
+}
+
+// traceSizeCondition restricts found traces to ones having at least as many spans and services as requested by search tags
+func (r *TraceReader) traceSizeCondition(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	start, end time.Time,
+) (string, []interface{}, error) {
+	var (
+		having []string
+		args   []interface{}
+	)
+	for _, condition := range []struct {
+		tag       string
+		aggregate string
+	}{
+		{tag: minSpansTag, aggregate: "count()"},
+		{tag: minServicesTag, aggregate: "uniqExact(service)"},
+	} {
+		value, ok := params.Tags[condition.tag]
+		if !ok {
+			continue
 		}
+		minimum, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || minimum < 0 {
+			return "", nil, fmt.Errorf("%w: %s=%q", errInvalidTraceSize, condition.tag, value)
+		}
+		having = append(having, condition.aggregate+" >= ?")
+		args = append(args, minimum)
+	}
+	if len(having) == 0 {
+		return "", nil, nil
 	}
 
-	// Sorting by service is required for early termination of primary key scan:
-	// * https://github.com/ClickHouse/ClickHouse/issues/7102
-	query += " ORDER BY service, timestamp DESC LIMIT ?"
-	args = append(args, params.NumTraces-len(skip))
+	query := fmt.Sprintf(" AND traceID IN (SELECT traceID FROM %s WHERE", r.indexTable)
+	subqueryArgs := make([]interface{}, 0, 3+len(args))
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		subqueryArgs = append(subqueryArgs, TenantFromContext(ctx, r.tenantHeader))
+	}
+	periodsQuery, periodsArgs := r.periodsCondition(r.indexTable, start, end)
+	query += " timestamp >= ? AND timestamp <= ?" + periodsQuery + " GROUP BY traceID HAVING " + strings.Join(having, " AND ") + ")"
+	subqueryArgs = append(append(subqueryArgs, start, end), periodsArgs...)
+
+	return query, append(subqueryArgs, args...), nil
+}
+
+// FindTraceIDsByPrefix retrieves up to limit TraceIDs starting with the given hexadecimal prefix.
+// Zero start or end leaves the corresponding side of the time range open.
+func (r *TraceReader) FindTraceIDsByPrefix(ctx context.Context, prefix string, start, end time.Time, limit int) ([]model.TraceID, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDsByPrefix")
+	defer span.Finish()
+
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if !isHexPrefix(prefix) {
+		return nil, errInvalidPrefix
+	}
+
+	if limit <= 0 || limit > maxTraceIDPrefixResults {
+		limit = maxTraceIDPrefixResults
+	}
+
+	// Spans table is ordered by traceID, so prefix match is served by the primary key,
+	// unless trace IDs are binary and their hexadecimal form is matched
+	query := fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE startsWith(%s, ?)", r.spansTable, r.traceIDString())
+	args := []interface{}{prefix}
+
+	if r.multiTenant() {
+		query += " AND tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+
+	if !start.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, start)
+	}
+
+	if !end.IsZero() {
+		query += " AND timestamp <= ?"
+		args = append(args, end)
+	}
+
+	query += " LIMIT ?"
+	args = append(args, limit)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	return r.getTraceIDs(ctx, query, args...)
+}
+
+// FindTraceIDsLinkedTo retrieves up to limit TraceIDs of traces with spans referencing the trace, started in the time range.
+// Zero limit returns all of them.
+func (r *TraceReader) FindTraceIDsLinkedTo(ctx context.Context, traceID string, start, end time.Time, limit int) ([]model.TraceID, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDsLinkedTo")
+	defer span.Finish()
+
+	if r.indexTable == "" {
+		return nil, errNoIndexTable
+	}
+	linkedTo, err := model.TraceIDFromString(strings.ToLower(strings.TrimSpace(traceID)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", errInvalidLinkedTo, traceID)
+	}
+
+	// Links are written in the format of model.TraceID.String, so the trace ID is normalized the same way
+	query := fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE has(linkedTraceIDs, ?)", r.indexTable)
+	args := []interface{}{linkedTo.String()}
+
+	if r.multiTenant() {
+		query += " AND tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+
+	query += " AND timestamp >= ? AND timestamp <= ?"
+	args = append(args, start, end)
+
+	periodsQuery, periodsArgs := r.periodsCondition(r.indexTable, start, end)
+	query += periodsQuery
+	args = append(args, periodsArgs...)
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
 
 	span.SetTag("db.statement", query)
 	span.SetTag("db.args", args)
 
+	return r.getTraceIDs(ctx, query, args...)
+}
+
+// periodsCondition restricts rows of the Merge table over rotated tables to tables of periods of the time range,
+// so that tables of other periods are not read at all
+func (r *TraceReader) periodsCondition(table TableName, start, end time.Time) (string, []interface{}) {
+	if r.rotation == nil {
+		return "", nil
+	}
+	tables := r.rotation.Tables(table, start, end)
+	if len(tables) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(tables))
+	for i, period := range tables {
+		args[i] = string(period)
+	}
+	return " AND _table IN (?" + strings.Repeat(", ?", len(tables)-1) + ")", args
+}
+
+func (r *TraceReader) getTraceIDs(ctx context.Context, query string, args ...interface{}) ([]model.TraceID, error) {
 	traceIDStrings, err := r.getStrings(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -367,7 +1191,7 @@ func (r *TraceReader) findTraceIDsInRange(ctx context.Context, params *spanstore
 
 	traceIDs := make([]model.TraceID, len(traceIDStrings))
 	for i, traceIDString := range traceIDStrings {
-		traceID, err := model.TraceIDFromString(traceIDString)
+		traceID, err := decodeTraceID(traceIDString, r.binaryTraceIDs)
 		if err != nil {
 			return nil, err
 		}
@@ -376,3 +1200,15 @@ func (r *TraceReader) findTraceIDsInRange(ctx context.Context, params *spanstore
 
 	return traceIDs, nil
 }
+
+func isHexPrefix(prefix string) bool {
+	if prefix == "" || len(prefix) > 32 {
+		return false
+	}
+	for _, c := range prefix {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package clickhousespanstore
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -432,6 +434,46 @@ func TestTraceReader_GetOperations(t *testing.T) {
 	}
 }
 
+func TestTraceReader_GetOperationsByPopularity(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithOperationsByPopularity())
+	service := "test service"
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT operation, spankind FROM %s WHERE service = ? GROUP BY operation, spankind"+
+				" ORDER BY sumIf(count, date >= yesterday()) DESC, operation",
+			testOperationsTable,
+		)).
+		WithArgs(service).
+		WillReturnRows(sqlmock.NewRows([]string{"operation", "spankind"}).AddRow("operation_2", "").AddRow("operation_1", ""))
+
+	operations, err := traceReader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: service})
+	require.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "operation_2"}, {Name: "operation_1"}}, operations)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_GetOperationsWithoutSpanKind(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderOperationsWithoutSpanKind())
+	service := "test service"
+	mock.
+		ExpectQuery(fmt.Sprintf("SELECT operation, '' AS spankind FROM %s WHERE service = ? GROUP BY operation ORDER BY operation", testOperationsTable)).
+		WithArgs(service).
+		WillReturnRows(sqlmock.NewRows([]string{"operation", "spankind"}).AddRow("operation_1", "").AddRow("operation_2", ""))
+
+	operations, err := traceReader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: service})
+	require.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "operation_1"}, {Name: "operation_2"}}, operations)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestTraceReader_GetOperationsQueryError(t *testing.T) {
 	db, mock, err := mocks.GetDbMock()
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
@@ -464,6 +506,65 @@ func TestTraceReader_GetOperationsNoTable(t *testing.T) {
 	assert.Equal(t, []spanstore.Operation(nil), operations)
 }
 
+func TestTraceReader_ServiceAliases(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(
+		db,
+		testOperationsTable,
+		testIndexTable,
+		testSpansTable,
+		WithServiceAliases("default.jaeger_service_aliases_dict", "default.jaeger_service_aliases"),
+	)
+	service := "cart-service"
+	aliasCondition := "service IN (SELECT alias FROM default.jaeger_service_aliases WHERE service = ? UNION ALL SELECT ?)"
+
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT dictGetOrDefault('default.jaeger_service_aliases_dict', 'service', tuple(service), service) AS canonicalService"+
+				" FROM %s GROUP BY canonicalService",
+			testOperationsTable,
+		)).
+		WillReturnRows(getRows([]driver.Value{service}))
+	services, err := traceReader.GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{service}, services)
+
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT operation, spankind FROM %s WHERE %s GROUP BY operation, spankind ORDER BY operation",
+			testOperationsTable,
+			aliasCondition,
+		)).
+		WithArgs(service, service).
+		WillReturnRows(sqlmock.NewRows([]string{"operation", "spankind"}).AddRow("checkout", "server"))
+	operations, err := traceReader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: service})
+	require.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "checkout", SpanKind: "server"}}, operations)
+
+	start := time.Unix(0, 0)
+	end := time.Unix(3600, 0)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE %s AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+			aliasCondition,
+		)).
+		WithArgs(service, service, start, end, testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"1"}))
+	traceIDs, err := traceReader.findTraceIDsInRange(
+		context.Background(),
+		&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces},
+		start,
+		end,
+		make([]model.TraceID, 0))
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestTraceReader_GetTrace(t *testing.T) {
 	db, mock, err := mocks.GetDbMock()
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
@@ -754,6 +855,63 @@ func getRows(values []driver.Value) *sqlmock.Rows {
 	return rows
 }
 
+func TestSpanWriter_getTracesDecodingWorkers(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithDecodingWorkers(3))
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}}
+	spans := make([]model.Span, 2*testSpansInTrace)
+	for i := range spans {
+		spans[i] = generateRandomSpan()
+		spans[i].TraceID = traceIDs[i%len(traceIDs)]
+	}
+	query := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?,?)", testSpansTable)
+
+	mock.
+		ExpectQuery(query).
+		WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+		WillReturnRows(getEncodedSpans(spans, func(span *model.Span) ([]byte, error) { return proto.Marshal(span) }))
+
+	traces, err := traceReader.getTraces(context.Background(), traceIDs)
+	require.NoError(t, err)
+	// spans keep the order of rows within their traces
+	expected := getTracesFromSpans(spans)
+	model.SortTraces(traces)
+	assert.Equal(t, expected, traces)
+
+	mock.
+		ExpectQuery(query).
+		WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+		WillReturnRows(getRows([]driver.Value{"{}", "{}", "{not_a_key}"}))
+
+	_, err = traceReader.getTraces(context.Background(), traceIDs)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// BenchmarkTraceReader_unmarshalSpans decodes a trace of 50k spans with different numbers of decoding workers
+func BenchmarkTraceReader_unmarshalSpans(b *testing.B) {
+	serialized := make([][]byte, 50_000)
+	for i := range serialized {
+		span := generateRandomSpan()
+		data, err := proto.Marshal(&span)
+		require.NoError(b, err)
+		serialized[i] = data
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := unmarshalSpans(serialized, EncodingProto, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func getTracesFromSpans(spans []model.Span) []*model.Trace {
 	traces := make(map[model.TraceID]*model.Trace)
 	for i, span := range spans {
@@ -832,14 +990,14 @@ func TestSpanWriter_findTraceIDsInRange(t *testing.T) {
 			queryParams: spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, DurationMax: maxDuration},
 			skip:        make([]model.TraceID, 0),
 			expectedQuery: fmt.Sprintf(
-				"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? AND durationUs <= ? ORDER BY service, timestamp DESC LIMIT ?",
+				"SELECT DISTINCT traceID FROM %s PREWHERE durationUs <= ? WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
 				testIndexTable,
 			),
 			expectedArgs: []driver.Value{
+				maxDuration.Microseconds(),
 				service,
 				start,
 				end,
-				maxDuration.Microseconds(),
 				testNumTraces,
 			},
 		},
@@ -847,14 +1005,30 @@ func TestSpanWriter_findTraceIDsInRange(t *testing.T) {
 			queryParams: spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, DurationMin: minDuration},
 			skip:        make([]model.TraceID, 0),
 			expectedQuery: fmt.Sprintf(
-				"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? AND durationUs >= ? ORDER BY service, timestamp DESC LIMIT ?",
+				"SELECT DISTINCT traceID FROM %s PREWHERE durationUs >= ? WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
 				testIndexTable,
 			),
 			expectedArgs: []driver.Value{
+				minDuration.Microseconds(),
 				service,
 				start,
 				end,
+				testNumTraces,
+			},
+		},
+		"minDuration and maxDuration": {
+			queryParams: spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, DurationMin: minDuration, DurationMax: maxDuration},
+			skip:        make([]model.TraceID, 0),
+			expectedQuery: fmt.Sprintf(
+				"SELECT DISTINCT traceID FROM %s PREWHERE durationUs >= ? AND durationUs <= ? WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+				testIndexTable,
+			),
+			expectedArgs: []driver.Value{
 				minDuration.Microseconds(),
+				maxDuration.Microseconds(),
+				service,
+				start,
+				end,
 				testNumTraces,
 			},
 		},
@@ -1110,3 +1284,924 @@ func TestSpanReader_getStringsRowError(t *testing.T) {
 	assert.EqualValues(t, []string(nil), queryResult)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestTraceReader_FindTraceIDsByPrefix(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	start := testStartTime
+	end := start.Add(time.Hour)
+	rowValues := []driver.Value{"0000000000000001", "00000000000000010000000000000002"}
+	expectedTraceIDs := []model.TraceID{{Low: 1}, {High: 1, Low: 2}}
+
+	tests := map[string]struct {
+		prefix        string
+		start         time.Time
+		end           time.Time
+		limit         int
+		expectedQuery string
+		expectedArgs  []driver.Value
+	}{
+		"default": {
+			prefix:        "00000000",
+			limit:         testNumTraces,
+			expectedQuery: fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) LIMIT ?", testSpansTable),
+			expectedArgs:  []driver.Value{"00000000", testNumTraces},
+		},
+		"time range": {
+			prefix: "00000000",
+			start:  start,
+			end:    end,
+			limit:  testNumTraces,
+			expectedQuery: fmt.Sprintf(
+				"SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) AND timestamp >= ? AND timestamp <= ? LIMIT ?",
+				testSpansTable,
+			),
+			expectedArgs: []driver.Value{"00000000", start, end, testNumTraces},
+		},
+		"normalized prefix": {
+			prefix:        " 00000000ABC ",
+			limit:         testNumTraces,
+			expectedQuery: fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) LIMIT ?", testSpansTable),
+			expectedArgs:  []driver.Value{"00000000abc", testNumTraces},
+		},
+		"limit above maximum": {
+			prefix:        "00000000",
+			limit:         maxTraceIDPrefixResults + 1,
+			expectedQuery: fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) LIMIT ?", testSpansTable),
+			expectedArgs:  []driver.Value{"00000000", maxTraceIDPrefixResults},
+		},
+		"zero limit": {
+			prefix:        "00000000",
+			expectedQuery: fmt.Sprintf("SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) LIMIT ?", testSpansTable),
+			expectedArgs:  []driver.Value{"00000000", maxTraceIDPrefixResults},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mock.
+				ExpectQuery(test.expectedQuery).
+				WithArgs(test.expectedArgs...).
+				WillReturnRows(getRows(rowValues))
+
+			traceIDs, err := traceReader.FindTraceIDsByPrefix(context.Background(), test.prefix, test.start, test.end, test.limit)
+			require.NoError(t, err)
+			assert.Equal(t, expectedTraceIDs, traceIDs)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTraceReader_FindTraceIDsByPrefixInvalidPrefix(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	tests := map[string]string{
+		"empty":     "",
+		"not hex":   "xyz",
+		"too long":  strings.Repeat("a", 33),
+		"injection": "a') OR 1=1 --",
+	}
+
+	for name, prefix := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceIDs, err := traceReader.FindTraceIDsByPrefix(context.Background(), prefix, time.Time{}, time.Time{}, testNumTraces)
+			assert.ErrorIs(t, err, errInvalidPrefix)
+			assert.Equal(t, []model.TraceID(nil), traceIDs)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTraceReader_FindTraceIDsPrefixTag(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	start := testStartTime
+	end := start.Add(24 * time.Hour)
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		Tags:         map[string]string{traceIDPrefixTag: "abc"},
+		NumTraces:    testNumTraces,
+		StartTimeMin: start,
+		StartTimeMax: end,
+	}
+
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE startsWith(traceID, ?) AND timestamp >= ? AND timestamp <= ? LIMIT ?",
+			testSpansTable,
+		)).
+		WithArgs("abc", start, end, testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"abc0000000000001"}))
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &params)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 0xabc0000000000001}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_MultiTenant(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderTenantHeader(testTenantHeader))
+	tenant := "tenant_1"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(testTenantHeader, tenant))
+	service := "service"
+	start := testStartTime
+	end := start.Add(time.Hour)
+
+	t.Run("GetServices", func(t *testing.T) {
+		mock.
+			ExpectQuery(fmt.Sprintf("SELECT service FROM %s WHERE tenant = ? GROUP BY service", testOperationsTable)).
+			WithArgs(tenant).
+			WillReturnRows(getRows([]driver.Value{service}))
+
+		services, err := traceReader.GetServices(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{service}, services)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("GetOperations", func(t *testing.T) {
+		mock.
+			ExpectQuery(fmt.Sprintf(
+				"SELECT operation, spankind FROM %s WHERE tenant = ? AND service = ? GROUP BY operation, spankind ORDER BY operation",
+				testOperationsTable,
+			)).
+			WithArgs(tenant, service).
+			WillReturnRows(sqlmock.NewRows([]string{"operation", "spankind"}).AddRow("operation", "server"))
+
+		operations, err := traceReader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: service})
+		require.NoError(t, err)
+		assert.Equal(t, []spanstore.Operation{{Name: "operation", SpanKind: "server"}}, operations)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("FindTraceIDs", func(t *testing.T) {
+		mock.
+			ExpectQuery(fmt.Sprintf(
+				"SELECT DISTINCT traceID FROM %s WHERE tenant = ? AND service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY tenant, service, timestamp DESC LIMIT ?",
+				testIndexTable,
+			)).
+			WithArgs(tenant, service, start, end, testNumTraces).
+			WillReturnRows(getRows([]driver.Value{"1"}))
+
+		traceIDs, err := traceReader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+			ServiceName:  service,
+			NumTraces:    testNumTraces,
+			StartTimeMin: start,
+			StartTimeMax: end,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []model.TraceID{{Low: 1}}, traceIDs)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("GetTrace", func(t *testing.T) {
+		span := testSpan
+		mock.
+			ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?) WHERE tenant = ?", testSpansTable)).
+			WithArgs(span.TraceID, tenant).
+			WillReturnRows(getEncodedSpans([]model.Span{span}, func(span *model.Span) ([]byte, error) { return proto.Marshal(span) }))
+
+		trace, err := traceReader.GetTrace(ctx, span.TraceID)
+		require.NoError(t, err)
+		assert.Equal(t, &model.Trace{Spans: []*model.Span{&span}}, trace)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no tenant in request", func(t *testing.T) {
+		mock.
+			ExpectQuery(fmt.Sprintf("SELECT service FROM %s WHERE tenant = ? GROUP BY service", testOperationsTable)).
+			WithArgs("").
+			WillReturnRows(getRows([]driver.Value{}))
+
+		services, err := traceReader.GetServices(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, services)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestSpanReader_findTraceIDsInRangeTraceSize(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		tags         map[string]string
+		having       string
+		havingValues []driver.Value
+	}{
+		"min spans": {
+			tags:         map[string]string{minSpansTag: "100"},
+			having:       "count() >= ?",
+			havingValues: []driver.Value{100},
+		},
+		"min services": {
+			tags:         map[string]string{minServicesTag: " 3 "},
+			having:       "uniqExact(service) >= ?",
+			havingValues: []driver.Value{3},
+		},
+		"min spans and services": {
+			tags:         map[string]string{minSpansTag: "100", minServicesTag: "3"},
+			having:       "count() >= ? AND uniqExact(service) >= ?",
+			havingValues: []driver.Value{100, 3},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := append([]driver.Value{service, start, end, start, end}, test.havingValues...)
+			mock.
+				ExpectQuery(fmt.Sprintf(
+					"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?"+
+						" AND traceID IN (SELECT traceID FROM %s WHERE timestamp >= ? AND timestamp <= ? GROUP BY traceID HAVING %s)"+
+						" ORDER BY service, timestamp DESC LIMIT ?",
+					testIndexTable,
+					testIndexTable,
+					test.having,
+				)).
+				WithArgs(append(args, testNumTraces)...).
+				WillReturnRows(getRows([]driver.Value{"1"}))
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			require.NoError(t, err)
+			assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeInvalidTraceSize(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+	tests := map[string]map[string]string{
+		"not a number":      {minSpansTag: "many"},
+		"negative":          {minServicesTag: "-1"},
+		"injection attempt": {minSpansTag: "1) OR (1"},
+	}
+
+	for name, tags := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: "service", NumTraces: testNumTraces, Tags: tags},
+				time.Unix(0, 0),
+				time.Now(),
+				make([]model.TraceID, 0))
+			assert.ErrorIs(t, err, errInvalidTraceSize)
+			assert.Equal(t, []model.TraceID(nil), res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeFlags(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		tags          map[string]string
+		condition     string
+		conditionArgs []driver.Value
+		expectedError error
+	}{
+		"debug": {
+			options:       []TraceReaderOption{WithReaderFlagsIndex()},
+			tags:          map[string]string{debugTag: "true"},
+			condition:     " AND bitAnd(flags, ?) != 0",
+			conditionArgs: []driver.Value{int64(model.DebugFlag)},
+		},
+		"not sampled": {
+			options:       []TraceReaderOption{WithReaderFlagsIndex()},
+			tags:          map[string]string{sampledTag: "false"},
+			condition:     " AND bitAnd(flags, ?) = 0",
+			conditionArgs: []driver.Value{int64(model.SampledFlag)},
+		},
+		"flags not indexed": {
+			tags:          map[string]string{debugTag: "true"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{debugTag, debugTag, "true"},
+		},
+		"flags column missing": {
+			options: []TraceReaderOption{
+				WithReaderFlagsIndex(),
+				WithReaderSchemaMonitor(&SchemaMonitor{missing: map[string]bool{flagsColumn: true}}),
+			},
+			tags:          map[string]string{debugTag: "true"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{debugTag, debugTag, "true"},
+		},
+		"invalid value": {
+			options:       []TraceReaderOption{WithReaderFlagsIndex()},
+			tags:          map[string]string{debugTag: "yes"},
+			expectedError: errInvalidFlag,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			if test.expectedError == nil {
+				args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+				mock.
+					ExpectQuery(fmt.Sprintf(
+						"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+							" ORDER BY service, timestamp DESC LIMIT ?",
+						testIndexTable,
+						test.condition,
+					)).
+					WithArgs(append(args, testNumTraces)...).
+					WillReturnRows(getRows([]driver.Value{"1"}))
+			}
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeStatusCodes(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		tags          map[string]string
+		condition     string
+		conditionArgs []driver.Value
+		expectedError error
+	}{
+		"code": {
+			options:       []TraceReaderOption{WithReaderStatusCodesIndex()},
+			tags:          map[string]string{httpStatusCodeTag: "404"},
+			condition:     " AND httpStatusCode = ?",
+			conditionArgs: []driver.Value{int64(404)},
+		},
+		"class": {
+			options:       []TraceReaderOption{WithReaderStatusCodesIndex()},
+			tags:          map[string]string{httpStatusCodeTag: "5XX"},
+			condition:     " AND httpStatusCode >= ? AND httpStatusCode <= ?",
+			conditionArgs: []driver.Value{int64(500), int64(599)},
+		},
+		"range": {
+			options:       []TraceReaderOption{WithReaderStatusCodesIndex()},
+			tags:          map[string]string{grpcStatusCodeTag: "13-14"},
+			condition:     " AND grpcStatusCode >= ? AND grpcStatusCode <= ?",
+			conditionArgs: []driver.Value{int64(13), int64(14)},
+		},
+		"status codes not indexed": {
+			tags:          map[string]string{httpStatusCodeTag: "404"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{httpStatusCodeTag, httpStatusCodeTag, "404"},
+		},
+		"status code column missing": {
+			options: []TraceReaderOption{
+				WithReaderStatusCodesIndex(),
+				WithReaderSchemaMonitor(&SchemaMonitor{missing: map[string]bool{httpStatusCodeColumn: true}}),
+			},
+			tags:          map[string]string{httpStatusCodeTag: "404"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{httpStatusCodeTag, httpStatusCodeTag, "404"},
+		},
+		"invalid value": {
+			options:       []TraceReaderOption{WithReaderStatusCodesIndex()},
+			tags:          map[string]string{httpStatusCodeTag: "error"},
+			expectedError: errInvalidStatusCode,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			if test.expectedError == nil {
+				args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+				mock.
+					ExpectQuery(fmt.Sprintf(
+						"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+							" ORDER BY service, timestamp DESC LIMIT ?",
+						testIndexTable,
+						test.condition,
+					)).
+					WithArgs(append(args, testNumTraces)...).
+					WillReturnRows(getRows([]driver.Value{"1"}))
+			}
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeSpanKind(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		tags          map[string]string
+		condition     string
+		conditionArgs []driver.Value
+	}{
+		"span kind": {
+			options:       []TraceReaderOption{WithReaderSpanKindIndex()},
+			tags:          map[string]string{spanKindTag: "Server"},
+			condition:     " AND spanKind = ?",
+			conditionArgs: []driver.Value{"server"},
+		},
+		"negated span kind": {
+			options:       []TraceReaderOption{WithReaderSpanKindIndex()},
+			tags:          map[string]string{spanKindTag: "!client"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] != ?",
+			conditionArgs: []driver.Value{spanKindTag, spanKindTag, "client"},
+		},
+		"span kind not indexed": {
+			tags:          map[string]string{spanKindTag: "server"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{spanKindTag, spanKindTag, "server"},
+		},
+		"span kind column missing": {
+			options: []TraceReaderOption{
+				WithReaderSpanKindIndex(),
+				WithReaderSchemaMonitor(&SchemaMonitor{missing: map[string]bool{spanKindColumn: true}}),
+			},
+			tags:          map[string]string{spanKindTag: "server"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{spanKindTag, spanKindTag, "server"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+			mock.
+				ExpectQuery(fmt.Sprintf(
+					"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+						" ORDER BY service, timestamp DESC LIMIT ?",
+					testIndexTable,
+					test.condition,
+				)).
+				WithArgs(append(args, testNumTraces)...).
+				WillReturnRows(getRows([]driver.Value{"1"}))
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			require.NoError(t, err)
+			assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeNegatedTags(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		tags          map[string]string
+		condition     string
+		conditionArgs []driver.Value
+		expectedError error
+	}{
+		"negated": {
+			tags:          map[string]string{"error": "!true"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] != ?",
+			conditionArgs: []driver.Value{"error", "error", "true"},
+		},
+		"absent": {
+			tags:          map[string]string{"error": "!*"},
+			condition:     " AND NOT has(tags.key, ?)",
+			conditionArgs: []driver.Value{"error"},
+		},
+		"escaped": {
+			tags:          map[string]string{"note": `\!important`},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{"note", "note", "!important"},
+		},
+		"negated status code": {
+			options:       []TraceReaderOption{WithReaderStatusCodesIndex()},
+			tags:          map[string]string{httpStatusCodeTag: "!200"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] != ?",
+			conditionArgs: []driver.Value{httpStatusCodeTag, httpStatusCodeTag, "200"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			if test.expectedError == nil {
+				args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+				mock.
+					ExpectQuery(fmt.Sprintf(
+						"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+							" ORDER BY service, timestamp DESC LIMIT ?",
+						testIndexTable,
+						test.condition,
+					)).
+					WithArgs(append(args, testNumTraces)...).
+					WillReturnRows(getRows([]driver.Value{"1"}))
+			}
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeExtractedTags(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderExtractedTags([]ExtractedTag{
+		{Key: "http.status_code", Type: "UInt16"},
+		{Key: "user.id", Type: "String"},
+	}))
+	tests := map[string]struct {
+		tags          map[string]string
+		condition     string
+		conditionArgs []driver.Value
+	}{
+		"typed column": {
+			tags:          map[string]string{"http.status_code": "500"},
+			condition:     " AND tag_http_status_code = ?",
+			conditionArgs: []driver.Value{uint64(500)},
+		},
+		"string column": {
+			tags:          map[string]string{"user.id": "42"},
+			condition:     " AND tag_user_id = ?",
+			conditionArgs: []driver.Value{"42"},
+		},
+		"value not convertible": {
+			tags:          map[string]string{"http.status_code": "unknown"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{"http.status_code", "http.status_code", "unknown"},
+		},
+		"not extracted": {
+			tags:          map[string]string{"http.method": "GET"},
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{"http.method", "http.method", "GET"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+			mock.
+				ExpectQuery(fmt.Sprintf(
+					"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+						" ORDER BY service, timestamp DESC LIMIT ?",
+					testIndexTable,
+					test.condition,
+				)).
+				WithArgs(append(args, testNumTraces)...).
+				WillReturnRows(getRows([]driver.Value{"1"}))
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: test.tags},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			require.NoError(t, err)
+			assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSpanReader_findTraceIDsInRangeTableRotation(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	rotation, err := NewTableRotation(RotationMonthly, nil)
+	require.NoError(t, err)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderTableRotation(rotation))
+	service := "test_service"
+	start := time.Date(2021, time.October, 15, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, time.November, 15, 0, 0, 0, 0, time.UTC)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? AND _table IN (?, ?)"+
+				" AND traceID IN (SELECT traceID FROM %s WHERE timestamp >= ? AND timestamp <= ? AND _table IN (?, ?)"+
+				" GROUP BY traceID HAVING count() >= ?)"+
+				" ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+			testIndexTable,
+		)).
+		WithArgs(
+			service, start, end, testIndexTable+"_202110", testIndexTable+"_202111",
+			start, end, testIndexTable+"_202110", testIndexTable+"_202111", 2,
+			testNumTraces,
+		).
+		WillReturnRows(getRows([]driver.Value{"1"}))
+
+	res, err := traceReader.findTraceIDsInRange(
+		context.Background(),
+		&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: map[string]string{minSpansTag: "2"}},
+		start,
+		end,
+		make([]model.TraceID, 0))
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_FindTraceIDsSearchCache(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithSearchCache(10, time.Hour))
+	start := testStartTime.Truncate(time.Hour)
+	end := start.Add(time.Minute)
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		NumTraces:    testNumTraces,
+		StartTimeMin: start,
+		StartTimeMax: end,
+		Tags:         map[string]string{"key": "value"},
+	}
+	query := fmt.Sprintf(
+		"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?"+
+			" AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ? ORDER BY service, timestamp DESC LIMIT ?",
+		testIndexTable,
+	)
+	mock.
+		ExpectQuery(query).
+		WithArgs(params.ServiceName, start, end, "key", "key", "value", testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"1"}))
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &params)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}}, traceIDs)
+
+	// the same search a few seconds later falls into the same time bucket
+	refreshed := params
+	refreshed.StartTimeMin = start.Add(time.Second)
+	refreshed.StartTimeMax = end.Add(time.Second)
+	traceIDs, err = traceReader.FindTraceIDs(context.Background(), &refreshed)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	other := params
+	other.OperationName = "operation"
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND operation = ? AND timestamp >= ? AND timestamp <= ?"+
+				" AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ? ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+		)).
+		WithArgs(params.ServiceName, other.OperationName, start, end, "key", "key", "value", testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"2"}))
+
+	traceIDs, err = traceReader.FindTraceIDs(context.Background(), &other)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 2}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_getTracesSingleEncoding(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithSingleEncoding(EncodingProto))
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	mock.
+		ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(testSpan.TraceID.String()).
+		WillReturnRows(getRows([]driver.Value{spanJSON}))
+
+	_, err = traceReader.getTraces(context.Background(), []model.TraceID{testSpan.TraceID})
+	assert.Error(t, err, "JSON encoded span is not decoded when protobuf is enforced")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_WithoutPrewhere(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(
+		db,
+		testOperationsTable,
+		testIndexTable,
+		testSpansTable,
+		WithReaderTenantHeader("x-tenant"),
+		WithoutPrewhere(),
+	)
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	mock.
+		ExpectQuery(fmt.Sprintf("SELECT model FROM %s WHERE traceID IN (?) AND tenant = ?", testSpansTable)).
+		WithArgs(testSpan.TraceID.String(), "").
+		WillReturnRows(getRows([]driver.Value{spanJSON}))
+
+	traces, err := traceReader.getTraces(context.Background(), []model.TraceID{testSpan.TraceID})
+	require.NoError(t, err)
+	assert.Len(t, traces, 1)
+
+	start := time.Unix(0, 0)
+	end := time.Unix(3600, 0)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE durationUs >= ? AND tenant = ? AND service = ? AND timestamp >= ? AND timestamp <= ?"+
+				" ORDER BY tenant, service, timestamp DESC LIMIT ?",
+			testIndexTable,
+		)).
+		WithArgs(int64(1000), "", "service", start, end, testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"1"}))
+
+	traceIDs, err := traceReader.findTraceIDsInRange(
+		context.Background(),
+		&spanstore.TraceQueryParameters{ServiceName: "service", DurationMin: time.Millisecond, NumTraces: testNumTraces},
+		start,
+		end,
+		make([]model.TraceID, 0))
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_WithSequentialConsistency(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(
+		db,
+		testOperationsTable,
+		testIndexTable,
+		testSpansTable,
+		WithReaderTenantHeader("x-tenant"),
+		WithTracesTable(testTracesTable),
+		WithSequentialConsistency(),
+	)
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT traceID, arrayJoin(models) FROM %s WHERE traceID IN (?) AND tenant = ? SETTINGS select_sequential_consistency = 1",
+			testTracesTable,
+		)).
+		WithArgs(testSpan.TraceID.String(), "").
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "model"}))
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT model FROM %s PREWHERE traceID IN (?) WHERE tenant = ? SETTINGS select_sequential_consistency = 1",
+			testSpansTable,
+		)).
+		WithArgs(testSpan.TraceID.String(), "").
+		WillReturnRows(getRows([]driver.Value{spanJSON}))
+
+	trace, err := traceReader.GetTrace(context.Background(), testSpan.TraceID)
+	require.NoError(t, err)
+	assert.Len(t, trace.Spans, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_WithUserDB(t *testing.T) {
+	db, _, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+	userDB, userMock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer userDB.Close()
+
+	released := 0
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithUserDB(func(ctx context.Context) (*sql.DB, func(), error) {
+		return userDB, func() { released++ }, nil
+	}))
+	userMock.
+		ExpectQuery(fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)).
+		WillReturnRows(getRows([]driver.Value{"allowed"}))
+
+	services, err := traceReader.GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"allowed"}, services)
+	assert.Equal(t, 1, released, "the pool of the user is released once the rows are closed")
+	assert.NoError(t, userMock.ExpectationsWereMet())
+
+	denied := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithUserDB(func(ctx context.Context) (*sql.DB, func(), error) {
+		return nil, nil, errorMock
+	}))
+	_, err = denied.GetServices(context.Background())
+	assert.ErrorIs(t, err, errorMock)
+}
+
+func TestTraceReader_FindTraceIDsLinkedTo(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderLinksIndex())
+	start := time.Unix(0, 0)
+	end := time.Unix(3600, 0)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE has(linkedTraceIDs, ?) AND timestamp >= ? AND timestamp <= ? LIMIT ?",
+			testIndexTable,
+		)).
+		WithArgs("0000000000000abc", start, end, testNumTraces).
+		WillReturnRows(getRows([]driver.Value{"1", "2"}))
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "ignored",
+		Tags:         map[string]string{linkedToTag: " ABC "},
+		StartTimeMin: start,
+		StartTimeMax: end,
+		NumTraces:    testNumTraces,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{{Low: 1}, {Low: 2}}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = traceReader.FindTraceIDsLinkedTo(context.Background(), "not a trace", start, end, testNumTraces)
+	assert.ErrorIs(t, err, errInvalidLinkedTo)
+}
@@ -0,0 +1,55 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+// WithRecentTraces finds traces of searches by the service only, e.g. the blank search of Jaeger UI, in the table
+// of traces of every service written within the window instead of in the index table
+func WithRecentTraces(table TableName, window time.Duration) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.recentTracesTable = table
+		reader.recentTracesWindow = window
+	}
+}
+
+// isRecentSearch tells whether the search is by the service only and starts within the window of recent traces
+func (r *TraceReader) isRecentSearch(params *spanstore.TraceQueryParameters, now time.Time) bool {
+	if r.recentTracesTable == "" {
+		return false
+	}
+	if params.OperationName != "" || len(params.Tags) > 0 || params.DurationMin != 0 || params.DurationMax != 0 {
+		return false
+	}
+	return !params.StartTimeMin.Before(now.Add(-r.recentTracesWindow))
+}
+
+// findRecentTraceIDs finds the most recent traces of the service in the recent traces table
+func (r *TraceReader) findRecentTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters, end time.Time) ([]model.TraceID, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "findRecentTraceIDs")
+	defer span.Finish()
+
+	query := fmt.Sprintf("SELECT traceID FROM %s WHERE", r.recentTracesTable)
+	args := make([]interface{}, 0, 6)
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	serviceCondition, serviceArgs := r.serviceCondition(params.ServiceName)
+	query += " " + serviceCondition
+	args = append(args, serviceArgs...)
+	// Rows of a trace are not replaced until parts are merged, so they are grouped
+	query += " AND timestamp >= ? AND timestamp <= ? GROUP BY traceID ORDER BY max(timestamp) DESC LIMIT ?"
+	args = append(args, params.StartTimeMin, end, params.NumTraces)
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	return r.getTraceIDs(ctx, query, args...)
+}
@@ -0,0 +1,90 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testRecentTracesTable TableName = "jaeger_recent_traces_local"
+
+func TestTraceReader_isRecentSearch(t *testing.T) {
+	now := time.Now()
+	reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable, WithRecentTraces(testRecentTracesTable, time.Hour))
+	tests := map[string]struct {
+		params   spanstore.TraceQueryParameters
+		expected bool
+	}{
+		"service only":      {params: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: now.Add(-time.Hour)}, expected: true},
+		"before the window": {params: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: now.Add(-2 * time.Hour)}},
+		"operation":         {params: spanstore.TraceQueryParameters{ServiceName: "frontend", OperationName: "GET /", StartTimeMin: now}},
+		"tags":              {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"error": "true"}, StartTimeMin: now}},
+		"duration":          {params: spanstore.TraceQueryParameters{ServiceName: "frontend", DurationMin: time.Second, StartTimeMin: now}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, reader.isRecentSearch(&test.params, now))
+		})
+	}
+
+	withoutTable := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+	assert.False(t, withoutTable.isRecentSearch(&spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: now}, now))
+}
+
+func TestTraceReader_FindTraceIDsRecent(t *testing.T) {
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Minute)
+	recentQuery := fmt.Sprintf(
+		"SELECT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? GROUP BY traceID ORDER BY max(timestamp) DESC LIMIT ?",
+		testRecentTracesTable,
+	)
+	indexQuery := fmt.Sprintf(
+		"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+		testIndexTable,
+	)
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start, StartTimeMax: end, NumTraces: 2}
+
+	t.Run("found", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		mock.ExpectQuery(recentQuery).
+			WithArgs("frontend", start, end, 2).
+			WillReturnRows(getRows([]driver.Value{model.NewTraceID(0, 2).String(), model.NewTraceID(0, 1).String()}))
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithRecentTraces(testRecentTracesTable, time.Hour))
+		traceIDs, err := reader.FindTraceIDs(context.Background(), params)
+		require.NoError(t, err)
+		assert.Equal(t, []model.TraceID{model.NewTraceID(0, 2), model.NewTraceID(0, 1)}, traceIDs)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("too few found", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		mock.ExpectQuery(recentQuery).
+			WithArgs("frontend", start, end, 2).
+			WillReturnRows(getRows([]driver.Value{model.NewTraceID(0, 2).String()}))
+		mock.ExpectQuery(indexQuery).
+			WithArgs("frontend", start, end, 2).
+			WillReturnRows(getRows([]driver.Value{model.NewTraceID(0, 2).String(), model.NewTraceID(0, 1).String()}))
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithRecentTraces(testRecentTracesTable, time.Hour))
+		traceIDs, err := reader.FindTraceIDs(context.Background(), params)
+		require.NoError(t, err)
+		assert.Equal(t, []model.TraceID{model.NewTraceID(0, 2), model.NewTraceID(0, 1)}, traceIDs)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,289 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const reencodeBatchSize = 10_000
+
+// Reencoder rewrites spans stored in another encoding than the configured one, one day partition at a time,
+// until the dual encoding period is over. Re-encoded spans are inserted first, then old ones are deleted
+// by a mutation, so a trace can show duplicate spans until the mutation is done.
+type Reencoder struct {
+	logger     hclog.Logger
+	db         *sql.DB
+	spansTable TableName
+	encoding   Encoding
+	until      time.Time
+	interval   time.Duration
+
+	// mutationTable is the table old spans are deleted from, the local table in replication mode
+	mutationTable TableName
+	onCluster     bool
+	multiTenant   bool
+	// samplingPriority writes the priority column of re-encoded spans
+	samplingPriority bool
+	binaryTraceIDs   bool
+
+	finish chan bool
+	done   sync.WaitGroup
+}
+
+// ReencoderOption configures optional behaviour of Reencoder
+type ReencoderOption func(reencoder *Reencoder)
+
+// WithReencoderLocalTable deletes old spans from the local table on the whole cluster, for distributed spans tables
+func WithReencoderLocalTable(localTable TableName) ReencoderOption {
+	return func(reencoder *Reencoder) {
+		reencoder.mutationTable = localTable
+		reencoder.onCluster = true
+	}
+}
+
+// WithReencoderMultiTenant keeps the tenant of re-encoded spans
+func WithReencoderMultiTenant() ReencoderOption {
+	return func(reencoder *Reencoder) {
+		reencoder.multiTenant = true
+	}
+}
+
+// WithReencoderBinaryTraceIDs writes trace IDs of re-encoded spans as 16 bytes
+func WithReencoderBinaryTraceIDs() ReencoderOption {
+	return func(reencoder *Reencoder) {
+		reencoder.binaryTraceIDs = true
+	}
+}
+
+// NewReencoder returns a Reencoder of spans in the table to the encoding
+func NewReencoder(
+	logger hclog.Logger,
+	db *sql.DB,
+	spansTable TableName,
+	encoding Encoding,
+	until time.Time,
+	interval time.Duration,
+	opts ...ReencoderOption,
+) *Reencoder {
+	reencoder := &Reencoder{
+		logger:        logger,
+		db:            db,
+		spansTable:    spansTable,
+		encoding:      encoding,
+		until:         until,
+		interval:      interval,
+		mutationTable: spansTable,
+		finish:        make(chan bool),
+	}
+	for _, opt := range opts {
+		opt(reencoder)
+	}
+	return reencoder
+}
+
+// Start re-encodes a partition every interval in the background until the dual encoding period is over
+func (r *Reencoder) Start() {
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.finish:
+				return
+			case <-ticker.C:
+				if time.Now().After(r.until) {
+					r.logger.Info("Dual encoding period is over, stopping re-encoding", "table", r.spansTable)
+					return
+				}
+				if _, err := r.ReencodeNextPartition(); err != nil {
+					r.logger.Error("Could not re-encode spans", "table", r.spansTable, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops re-encoding, a partition being re-encoded is finished first
+func (r *Reencoder) Close() {
+	close(r.finish)
+	r.done.Wait()
+}
+
+// ReencodeNextPartition re-encodes the oldest day with spans in the other encoding.
+// It returns false if there is nothing to re-encode or a previous deletion is still running.
+func (r *Reencoder) ReencodeNextPartition() (bool, error) {
+	var running uint64
+	if err := r.db.QueryRow(
+		"SELECT count() FROM system.mutations WHERE database = currentDatabase() AND table = ? AND NOT is_done",
+		string(r.mutationTable),
+	).Scan(&running); err != nil {
+		return false, err
+	}
+	if running > 0 {
+		r.logger.Debug("Waiting for deletion of re-encoded spans", "table", r.mutationTable)
+		return false, nil
+	}
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"SELECT toDate(timestamp) AS day FROM %s WHERE %s AND timestamp < toStartOfDay(now()) GROUP BY day ORDER BY day LIMIT 1",
+		r.spansTable,
+		r.otherEncodingCondition(),
+	)
+	var day time.Time
+	if err := r.db.QueryRow(query).Scan(&day); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	r.logger.Info("Re-encoding spans", "table", r.spansTable, "day", day.Format("2006-01-02"), "encoding", r.encoding)
+	count, err := r.reencodeDay(day)
+	if err != nil {
+		return false, err
+	}
+
+	onCluster := ""
+	if r.onCluster {
+		onCluster = " ON CLUSTER '{cluster}'"
+	}
+	//nolint:gosec  , G201: SQL string formatting
+	mutation := fmt.Sprintf(
+		"ALTER TABLE %s%s DELETE WHERE toDate(timestamp) = ? AND %s",
+		r.mutationTable,
+		onCluster,
+		r.otherEncodingCondition(),
+	)
+	if _, err := r.db.Exec(mutation, day); err != nil {
+		return false, err
+	}
+	r.logger.Info("Re-encoded spans", "table", r.spansTable, "day", day.Format("2006-01-02"), "count", count)
+	return true, nil
+}
+
+func (r *Reencoder) reencodeDay(day time.Time) (int, error) {
+	columns := "model"
+	if r.multiTenant {
+		columns = "tenant, " + columns
+	}
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE toDate(timestamp) = ? AND %s", columns, r.spansTable, r.otherEncodingCondition())
+	rows, err := r.db.Query(query, day)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		count   int
+		tenants []string
+		batch   []*model.Span
+	)
+	for rows.Next() {
+		var tenant, serialized string
+		dest := []interface{}{&serialized}
+		if r.multiTenant {
+			dest = append([]interface{}{&tenant}, dest...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		span, err := unmarshalSpan([]byte(serialized), "")
+		if err != nil {
+			return count, err
+		}
+		tenants = append(tenants, tenant)
+		batch = append(batch, span)
+
+		if len(batch) >= reencodeBatchSize {
+			if err := r.insert(tenants, batch); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			tenants, batch = nil, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if len(batch) > 0 {
+		if err := r.insert(tenants, batch); err != nil {
+			return count, err
+		}
+		count += len(batch)
+	}
+	return count, nil
+}
+
+func (r *Reencoder) insert(tenants []string, batch []*model.Span) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{"timestamp", "traceID", "model"}
+	if r.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	if r.samplingPriority {
+		columns = append(columns, samplingPriorityColumn)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		r.spansTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for i, span := range batch {
+		serialized, err := marshalSpan(span, r.encoding)
+		if err != nil {
+			return err
+		}
+		args := []interface{}{span.StartTime, encodeTraceID(span.TraceID, r.binaryTraceIDs), serialized}
+		if r.multiTenant {
+			args = append([]interface{}{tenants[i]}, args...)
+		}
+		if r.samplingPriority {
+			args = append(args, samplingPriority(span))
+		}
+		if _, err := statement.Exec(args...); err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	return tx.Commit()
+}
+
+// otherEncodingCondition matches spans not stored in the configured encoding
+func (r *Reencoder) otherEncodingCondition() string {
+	if r.encoding == EncodingJSON {
+		return "NOT startsWith(model, '{')"
+	}
+	return "startsWith(model, '{')"
+}
@@ -0,0 +1,157 @@
+package clickhousespanstore
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testMutationsQuery = "SELECT count() FROM system.mutations WHERE database = currentDatabase() AND table = ? AND NOT is_done"
+
+func TestReencoder_ReencodeNextPartition(t *testing.T) {
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	spanProto, err := proto.Marshal(&testSpan)
+	require.NoError(t, err)
+	day := testStartTime.Truncate(24 * time.Hour)
+
+	tests := map[string]struct {
+		encoding      Encoding
+		opts          []ReencoderOption
+		condition     string
+		mutationTable TableName
+		onCluster     string
+		stored        []byte
+		reencoded     []byte
+		tenant        bool
+		traceID       string
+	}{
+		"json to protobuf": {
+			encoding:      EncodingProto,
+			condition:     "startsWith(model, '{')",
+			mutationTable: testSpansTable,
+			stored:        spanJSON,
+			reencoded:     spanProto,
+		},
+		"protobuf to json": {
+			encoding:      EncodingJSON,
+			condition:     "NOT startsWith(model, '{')",
+			mutationTable: testSpansTable,
+			stored:        spanProto,
+			reencoded:     spanJSON,
+		},
+		"replication and multi tenant": {
+			encoding:      EncodingProto,
+			opts:          []ReencoderOption{WithReencoderLocalTable(TableName(testSpansTable).ToLocal()), WithReencoderMultiTenant()},
+			condition:     "startsWith(model, '{')",
+			mutationTable: TableName(testSpansTable).ToLocal(),
+			onCluster:     " ON CLUSTER '{cluster}'",
+			stored:        spanJSON,
+			reencoded:     spanProto,
+			tenant:        true,
+		},
+		"binary trace IDs": {
+			encoding:      EncodingProto,
+			opts:          []ReencoderOption{WithReencoderBinaryTraceIDs()},
+			condition:     "startsWith(model, '{')",
+			mutationTable: testSpansTable,
+			stored:        spanJSON,
+			reencoded:     spanProto,
+			traceID:       encodeTraceID(testSpan.TraceID, true),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err, "an error was not expected when opening a stub database connection")
+			defer db.Close()
+
+			mock.ExpectQuery(testMutationsQuery).
+				WithArgs(string(test.mutationTable)).
+				WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+			mock.ExpectQuery(fmt.Sprintf(
+				"SELECT toDate(timestamp) AS day FROM %s WHERE %s AND timestamp < toStartOfDay(now()) GROUP BY day ORDER BY day LIMIT 1",
+				testSpansTable,
+				test.condition,
+			)).WillReturnRows(sqlmock.NewRows([]string{"day"}).AddRow(day))
+
+			columns, insertColumns, insertArgs := "model", "timestamp, traceID, model", "?, ?, ?"
+			row := []driver.Value{test.stored}
+			traceID := testSpan.TraceID.String()
+			if test.traceID != "" {
+				traceID = test.traceID
+			}
+			args := []driver.Value{testSpan.StartTime, traceID, test.reencoded}
+			if test.tenant {
+				columns, insertColumns, insertArgs = "tenant, model", "tenant, timestamp, traceID, model", "?, ?, ?, ?"
+				row = append([]driver.Value{"tenant_1"}, row...)
+				args = append([]driver.Value{"tenant_1"}, args...)
+			}
+			mock.ExpectQuery(fmt.Sprintf("SELECT %s FROM %s WHERE toDate(timestamp) = ? AND %s", columns, testSpansTable, test.condition)).
+				WithArgs(day).
+				WillReturnRows(sqlmock.NewRows(make([]string, len(row))).AddRow(row...))
+			mock.ExpectBegin()
+			mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", testSpansTable, insertColumns, insertArgs)).
+				ExpectExec().
+				WithArgs(args...).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(fmt.Sprintf(
+				"ALTER TABLE %s%s DELETE WHERE toDate(timestamp) = ? AND %s",
+				test.mutationTable,
+				test.onCluster,
+				test.condition,
+			)).WithArgs(day).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			reencoder := NewReencoder(mocks.NewSpyLogger(), db, testSpansTable, test.encoding, time.Now().Add(time.Hour), time.Minute, test.opts...)
+			reencoded, err := reencoder.ReencodeNextPartition()
+			require.NoError(t, err)
+			assert.True(t, reencoded)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestReencoder_ReencodeNextPartitionNothingToDo(t *testing.T) {
+	tests := map[string]struct {
+		runningMutations uint64
+		expectDay        bool
+	}{
+		"mutation running": {runningMutations: 1},
+		"all re-encoded":   {expectDay: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err, "an error was not expected when opening a stub database connection")
+			defer db.Close()
+
+			mock.ExpectQuery(testMutationsQuery).
+				WithArgs(testSpansTable).
+				WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(test.runningMutations))
+			if test.expectDay {
+				mock.ExpectQuery(fmt.Sprintf(
+					"SELECT toDate(timestamp) AS day FROM %s WHERE startsWith(model, '{') AND timestamp < toStartOfDay(now()) GROUP BY day ORDER BY day LIMIT 1",
+					testSpansTable,
+				)).WillReturnRows(sqlmock.NewRows([]string{"day"}))
+			}
+
+			reencoder := NewReencoder(mocks.NewSpyLogger(), db, testSpansTable, EncodingProto, time.Now().Add(time.Hour), time.Minute)
+			reencoded, err := reencoder.ReencodeNextPartition()
+			require.NoError(t, err)
+			assert.False(t, reencoded)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// rootTag is a search tag filtering spans by whether they have a parent, when roots are indexed
+const rootTag = "jaeger.root"
+
+// WithWriterRootsIndex marks spans without a parent in the isRoot column of the index table
+func WithWriterRootsIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexRoots = true
+	}
+}
+
+// WithReaderRootsIndex filters spans by the jaeger.root search tag using the isRoot column of the index table,
+// e.g. to search traces by the operations of their entry points, and fills root operations of trace summaries
+func WithReaderRootsIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.rootsIndex = true
+	}
+}
+
+// isRootValue returns 1 if the span has no parent span in its trace, otherwise 0
+func isRootValue(span *model.Span) int64 {
+	return boolValue(span.ParentSpanID() == 0)
+}
+
+func boolValue(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// rootSpan is the service and operation of the root span of a trace
+type rootSpan struct {
+	service   string
+	operation string
+}
+
+// getRootSpans returns root spans of the traces found in the index table within the time range.
+// Traces whose root span is outside of the time range or not written yet are missing.
+func (r *TraceReader) getRootSpans(ctx context.Context, traceIDs []model.TraceID, start, end time.Time) (map[model.TraceID]rootSpan, error) {
+	roots := make(map[model.TraceID]rootSpan, len(traceIDs))
+	if len(traceIDs) == 0 || !r.rootsIndex || !r.schema.hasColumn(isRootColumn) {
+		return roots, nil
+	}
+
+	query := fmt.Sprintf("SELECT traceID, any(service), any(operation) FROM %s WHERE", r.indexTable)
+	args := make([]interface{}, 0, len(traceIDs)+3)
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += " timestamp >= ? AND timestamp <= ? AND isRoot = 1"
+	args = append(args, start, end)
+	placeholders, traceIDArgs := r.traceIDCondition(traceIDs)
+	query += fmt.Sprintf(" AND traceID IN (%s) GROUP BY traceID", placeholders)
+	args = append(args, traceIDArgs...)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			traceIDString string
+			root          rootSpan
+		)
+		if err := rows.Scan(&traceIDString, &root.service, &root.operation); err != nil {
+			return nil, err
+		}
+		traceID, err := decodeTraceID(traceIDString, r.binaryTraceIDs)
+		if err != nil {
+			return nil, err
+		}
+		roots[traceID] = root
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
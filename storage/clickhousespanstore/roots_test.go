@@ -0,0 +1,172 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestIsRootValue(t *testing.T) {
+	traceID := model.NewTraceID(0, 1)
+	root := &model.Span{TraceID: traceID}
+	assert.Equal(t, int64(1), isRootValue(root))
+
+	child := &model.Span{TraceID: traceID, References: []model.SpanRef{model.NewChildOfRef(traceID, 2)}}
+	assert.Equal(t, int64(0), isRootValue(child))
+
+	// Spans whose parents are in other traces are roots of their own traces
+	linked := &model.Span{TraceID: traceID, References: []model.SpanRef{model.NewChildOfRef(model.NewTraceID(0, 2), 2)}}
+	assert.Equal(t, int64(1), isRootValue(linked))
+}
+
+func TestSpanWriter_RootsIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	worker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable)
+	worker.params.indexRoots = true
+
+	span := testSpan
+	span.References = nil
+	keys, values := uniqueTagsForSpan(&span)
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, isRoot, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(args[:5:5], int64(1), keys, values)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanReader_findTraceIDsInRangeRoots(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	service := "test_service"
+	start := time.Unix(0, 0)
+	end := time.Now()
+	tests := map[string]struct {
+		options       []TraceReaderOption
+		value         string
+		condition     string
+		conditionArgs []driver.Value
+	}{
+		"roots": {
+			options:       []TraceReaderOption{WithReaderRootsIndex()},
+			value:         "true",
+			condition:     " AND isRoot = ?",
+			conditionArgs: []driver.Value{int64(1)},
+		},
+		"not roots": {
+			options:       []TraceReaderOption{WithReaderRootsIndex()},
+			value:         "false",
+			condition:     " AND isRoot = ?",
+			conditionArgs: []driver.Value{int64(0)},
+		},
+		"roots not indexed": {
+			value:         "true",
+			condition:     " AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?",
+			conditionArgs: []driver.Value{rootTag, rootTag, "true"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.options...)
+			args := append([]driver.Value{service, start, end}, test.conditionArgs...)
+			mock.
+				ExpectQuery(fmt.Sprintf(
+					"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?%s"+
+						" ORDER BY service, timestamp DESC LIMIT ?",
+					testIndexTable,
+					test.condition,
+				)).
+				WithArgs(append(args, testNumTraces)...).
+				WillReturnRows(getRows([]driver.Value{"1"}))
+
+			res, err := traceReader.findTraceIDsInRange(
+				context.Background(),
+				&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: map[string]string{rootTag: test.value}},
+				start,
+				end,
+				make([]model.TraceID, 0))
+			require.NoError(t, err)
+			assert.Equal(t, []model.TraceID{{Low: 1}}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderRootsIndex())
+	_, err = traceReader.findTraceIDsInRange(
+		context.Background(),
+		&spanstore.TraceQueryParameters{ServiceName: service, NumTraces: testNumTraces, Tags: map[string]string{rootTag: "yes"}},
+		start,
+		end,
+		nil)
+	assert.ErrorIs(t, err, errInvalidRoot)
+}
+
+func TestTraceReader_FindTraceSummariesRoots(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}}
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Minute)
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+		testIndexTable,
+	)).
+		WithArgs("frontend", start, end, 2).
+		WillReturnRows(getRows([]driver.Value{traceIDs[0].String(), traceIDs[1].String()}))
+	mock.ExpectQuery(
+		"SELECT traceID, sum(spans), min(start), max(durationUs), argMaxMerge(rootService) FROM test_summaries_table"+
+			" WHERE traceID IN (?,?) GROUP BY traceID",
+	).
+		WithArgs(traceIDs[0].String(), traceIDs[1].String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "sum(spans)", "min(start)", "max(durationUs)", "argMaxMerge(rootService)"}).
+			AddRow(traceIDs[0].String(), uint64(10), start, uint64(2000000), "database").
+			AddRow(traceIDs[1].String(), uint64(3), start, uint64(1500), "frontend"))
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT traceID, any(service), any(operation) FROM %s WHERE timestamp >= ? AND timestamp <= ? AND isRoot = 1"+
+			" AND traceID IN (?,?) GROUP BY traceID",
+		testIndexTable,
+	)).
+		WithArgs(start, end, traceIDs[0].String(), traceIDs[1].String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "any(service)", "any(operation)"}).
+			AddRow(traceIDs[0].String(), "gateway", "GET /orders"))
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithTraceSummaries(testSummariesTable), WithReaderRootsIndex())
+	summaries, err := traceReader.FindTraceSummaries(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: start,
+		StartTimeMax: end,
+		NumTraces:    2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []TraceSummary{
+		{TraceID: traceIDs[0], SpanCount: 10, StartTime: start, Duration: 2 * time.Second, RootService: "gateway", RootOperation: "GET /orders"},
+		{TraceID: traceIDs[1], SpanCount: 3, StartTime: start, Duration: 1500 * time.Microsecond, RootService: "frontend"},
+	}, summaries, "traces whose root span is not found keep the service of their longest span")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,134 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// RotationPeriod is the time range of spans stored in a single pair of spans and index tables
+type RotationPeriod string
+
+const (
+	// RotationDaily stores spans of every day in their own tables
+	RotationDaily RotationPeriod = "daily"
+	// RotationMonthly stores spans of every month in their own tables
+	RotationMonthly RotationPeriod = "monthly"
+
+	localSuffix = "_local"
+)
+
+// TableRotation routes spans to spans and index tables of the period they started in, e.g. jaeger_spans_202110
+// for spans of October 2021, so that whole periods can be backed up, moved or dropped as tables.
+// Tables of a period are named after the configured tables with the period appended before the _local suffix.
+// Reading goes through Merge tables with the configured names, searches read only tables of their time range.
+type TableRotation struct {
+	period RotationPeriod
+	// create creates tables of the period with the suffix
+	create func(suffix string) error
+
+	mutex   sync.Mutex
+	created map[string]bool
+}
+
+// NewTableRotation returns TableRotation of the period, tables of a period are created by create on first write to it
+func NewTableRotation(period RotationPeriod, create func(suffix string) error) (*TableRotation, error) {
+	if period != RotationDaily && period != RotationMonthly {
+		return nil, fmt.Errorf("unknown table rotation period %q", period)
+	}
+	return &TableRotation{
+		period:  period,
+		create:  create,
+		created: make(map[string]bool),
+	}, nil
+}
+
+// WithTableRotation writes spans and their index to tables of the period of their start time
+func WithTableRotation(rotation *TableRotation) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.rotation = rotation
+	}
+}
+
+// WithReaderTableRotation searches only index tables of periods overlapping the searched time range
+func WithReaderTableRotation(rotation *TableRotation) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.rotation = rotation
+	}
+}
+
+// Suffix returns the suffix of tables of the period containing the time
+func (r *TableRotation) Suffix(t time.Time) string {
+	if r.period == RotationDaily {
+		return t.UTC().Format("20060102")
+	}
+	return t.UTC().Format("200601")
+}
+
+// Table returns the table of the period with the suffix
+func (r *TableRotation) Table(table TableName, suffix string) TableName {
+	if base := strings.TrimSuffix(string(table), localSuffix); base != string(table) {
+		return TableName(base + "_" + suffix + localSuffix)
+	}
+	return TableName(string(table) + "_" + suffix)
+}
+
+// Pattern returns the regular expression matching names of tables of all periods, for the Merge table engine
+func (r *TableRotation) Pattern(table TableName) string {
+	if base := strings.TrimSuffix(string(table), localSuffix); base != string(table) {
+		return "^" + regexp.QuoteMeta(base) + "_[0-9]+" + localSuffix + "$"
+	}
+	return "^" + regexp.QuoteMeta(string(table)) + "_[0-9]+$"
+}
+
+// Tables returns tables of all periods overlapping the time range
+func (r *TableRotation) Tables(table TableName, start, end time.Time) []TableName {
+	var tables []TableName
+	for period := r.periodStart(start); !period.After(end); period = r.nextPeriod(period) {
+		tables = append(tables, r.Table(table, r.Suffix(period)))
+	}
+	return tables
+}
+
+func (r *TableRotation) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if r.period == RotationDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (r *TableRotation) nextPeriod(period time.Time) time.Time {
+	if r.period == RotationDaily {
+		return period.AddDate(0, 0, 1)
+	}
+	return period.AddDate(0, 1, 0)
+}
+
+// split groups spans by suffixes of their periods
+func (r *TableRotation) split(batch []*model.Span) map[string][]*model.Span {
+	periods := make(map[string][]*model.Span)
+	for _, span := range batch {
+		suffix := r.Suffix(span.StartTime)
+		periods[suffix] = append(periods[suffix], span)
+	}
+	return periods
+}
+
+// ensureTables creates tables of the period with the suffix, unless they were created before
+func (r *TableRotation) ensureTables(suffix string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.created[suffix] {
+		return nil
+	}
+	if err := r.create(suffix); err != nil {
+		return fmt.Errorf("could not create tables of period %s: %w", suffix, err)
+	}
+	r.created[suffix] = true
+	return nil
+}
@@ -0,0 +1,71 @@
+package clickhousespanstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableRotation_Tables(t *testing.T) {
+	monthly, err := NewTableRotation(RotationMonthly, nil)
+	require.NoError(t, err)
+	daily, err := NewTableRotation(RotationDaily, nil)
+	require.NoError(t, err)
+
+	start := time.Date(2021, time.October, 30, 23, 0, 0, 0, time.UTC)
+	end := time.Date(2021, time.November, 1, 1, 0, 0, 0, time.UTC)
+	assert.Equal(t, "202110", monthly.Suffix(start))
+	assert.Equal(t, "20211030", daily.Suffix(start))
+	assert.Equal(t, []TableName{"jaeger_index_202110", "jaeger_index_202111"}, monthly.Tables("jaeger_index", start, end))
+	assert.Equal(t,
+		[]TableName{"jaeger_index_20211030_local", "jaeger_index_20211031_local", "jaeger_index_20211101_local"},
+		daily.Tables("jaeger_index_local", start, end),
+	)
+	assert.Equal(t, []TableName{"jaeger_index_202110"}, monthly.Tables("jaeger_index", start, start))
+
+	assert.Equal(t, "^jaeger_spans_[0-9]+$", monthly.Pattern("jaeger_spans"))
+	assert.Equal(t, "^jaeger_spans_[0-9]+_local$", monthly.Pattern("jaeger_spans_local"))
+
+	_, err = NewTableRotation("weekly", nil)
+	assert.EqualError(t, err, `unknown table rotation period "weekly"`)
+}
+
+func TestTableRotation_ensureTables(t *testing.T) {
+	var created []string
+	fail := false
+	rotation, err := NewTableRotation(RotationMonthly, func(suffix string) error {
+		if fail {
+			return errorMock
+		}
+		created = append(created, suffix)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, rotation.ensureTables("202110"))
+	require.NoError(t, rotation.ensureTables("202110"))
+	assert.Equal(t, []string{"202110"}, created, "tables of a period are created once")
+
+	fail = true
+	assert.True(t, errors.Is(rotation.ensureTables("202111"), errorMock))
+	fail = false
+	require.NoError(t, rotation.ensureTables("202111"))
+	assert.Equal(t, []string{"202110", "202111"}, created, "creation is retried after a failure")
+}
+
+func TestTableRotation_split(t *testing.T) {
+	rotation, err := NewTableRotation(RotationDaily, nil)
+	require.NoError(t, err)
+
+	first := &model.Span{StartTime: time.Date(2021, time.October, 30, 23, 0, 0, 0, time.UTC)}
+	second := &model.Span{StartTime: time.Date(2021, time.October, 31, 1, 0, 0, 0, time.UTC)}
+	third := &model.Span{StartTime: time.Date(2021, time.October, 30, 1, 0, 0, 0, time.UTC)}
+	assert.Equal(t,
+		map[string][]*model.Span{"20211030": {first, third}, "20211031": {second}},
+		rotation.split([]*model.Span{first, second, third}),
+	)
+}
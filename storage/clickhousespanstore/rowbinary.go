@@ -0,0 +1,155 @@
+package clickhousespanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// maxErrorBodySize is the maximal number of bytes of an error response of ClickHouse included in errors
+const maxErrorBodySize = 4096
+
+// RowBinaryInserter inserts rows over the HTTP interface of ClickHouse in RowBinary format,
+// which ClickHouse reads without parsing values and the driver does not convert them row by row.
+type RowBinaryInserter struct {
+	client   *http.Client
+	address  string
+	user     string
+	password string
+	// params are the database and settings of inserts sent as query parameters
+	params url.Values
+}
+
+// NewRowBinaryInserter returns an inserter to the HTTP interface at the address, e.g. http://localhost:8123,
+// with ClickHouse settings of inserts by their names
+func NewRowBinaryInserter(
+	client *http.Client,
+	address, database, user, password string,
+	settings map[string]string,
+) *RowBinaryInserter {
+	params := url.Values{}
+	for name, value := range settings {
+		params.Set(name, value)
+	}
+	if database != "" {
+		params.Set("database", database)
+	}
+	return &RowBinaryInserter{
+		client:   client,
+		address:  strings.TrimSuffix(address, "/") + "/",
+		user:     user,
+		password: password,
+		params:   params,
+	}
+}
+
+// WithRowBinaryInserts inserts spans into the spans table in RowBinary format over HTTP instead of the native protocol.
+// The index, calls and operations are still inserted over the native protocol. Not used with index from spans.
+func WithRowBinaryInserts(inserter *RowBinaryInserter) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.rowBinary = inserter
+	}
+}
+
+// Insert inserts rows encoded in RowBinary format with values of the columns into the table
+func (inserter *RowBinaryInserter) Insert(ctx context.Context, table TableName, columns []string, rows []byte) error {
+	params := url.Values{}
+	for name, values := range inserter.params {
+		params[name] = values
+	}
+	if queryID := insertQueryID(ctx); queryID != "" {
+		params.Set("query_id", queryID)
+	}
+	params.Set("query", fmt.Sprintf("INSERT INTO %s (%s) FORMAT RowBinary", table, strings.Join(columns, ", ")))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, inserter.address+"?"+params.Encode(), bytes.NewReader(rows))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-ClickHouse-User", inserter.user)
+	if inserter.password != "" {
+		request.Header.Set("X-ClickHouse-Key", inserter.password)
+	}
+	response, err := inserter.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBodySize))
+		return fmt.Errorf("insert into %s failed with %s: %s", table, response.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(ioutil.Discard, response.Body)
+	return err
+}
+
+// rowBinary is a buffer of rows in RowBinary format
+type rowBinary struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+// writeString writes a String value, its length as a variable-length integer followed by its bytes
+func (rows *rowBinary) writeString(value string) {
+	rows.Write(rows.scratch[:binary.PutUvarint(rows.scratch[:], uint64(len(value)))])
+	rows.WriteString(value)
+}
+
+// writeBytes writes bytes as a String value
+func (rows *rowBinary) writeBytes(value []byte) {
+	rows.Write(rows.scratch[:binary.PutUvarint(rows.scratch[:], uint64(len(value)))])
+	rows.Write(value)
+}
+
+// writeDateTime writes a DateTime value, seconds since epoch as 4 bytes in little endian
+func (rows *rowBinary) writeDateTime(value time.Time) {
+	binary.LittleEndian.PutUint32(rows.scratch[:4], uint32(value.Unix()))
+	rows.Write(rows.scratch[:4])
+}
+
+// writeTraceID writes a trace ID either as a FixedString(16) value or as a String with its hexadecimal form
+func (rows *rowBinary) writeTraceID(traceID model.TraceID, binaryTraceIDs bool) {
+	if binaryTraceIDs {
+		rows.WriteString(encodeTraceID(traceID, true))
+		return
+	}
+	rows.writeString(encodeTraceID(traceID, false))
+}
+
+// writeModelBatchRowBinary inserts spans into the spans table in RowBinary format
+func (worker *WriteWorker) writeModelBatchRowBinary(batch []*model.Span) error {
+	columns := []string{"timestamp", "traceID", "model"}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	if worker.params.samplingPriority {
+		columns = append(columns, samplingPriorityColumn)
+	}
+
+	var rows rowBinary
+	for _, span := range batch {
+		serialized, err := worker.marshalStoredSpan(span)
+		if err != nil {
+			return err
+		}
+		if worker.params.multiTenant {
+			rows.writeString(worker.tenant)
+		}
+		rows.writeDateTime(span.StartTime)
+		rows.writeTraceID(span.TraceID, worker.params.binaryTraceIDs)
+		rows.writeBytes(serialized)
+		if worker.params.samplingPriority {
+			rows.WriteByte(uint8(samplingPriority(span)))
+		}
+	}
+	ctx, observe := worker.startInsert(insertedSpans)
+	return observe(worker.params.rowBinary.Insert(ctx, worker.params.spansTable, columns, rows.Bytes()))
+}
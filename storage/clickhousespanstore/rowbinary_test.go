@@ -0,0 +1,125 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/ClickHouse/clickhouse-go" // import driver
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteWorker_writeModelBatchRowBinary(t *testing.T) {
+	var (
+		query, database, setting, user, key string
+		body                                []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, database, setting = r.URL.Query().Get("query"), r.URL.Query().Get("database"), r.URL.Query().Get("async_insert")
+		user, key = r.Header.Get("X-ClickHouse-User"), r.Header.Get("X-ClickHouse-Key")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	span := model.Span{
+		TraceID:       model.NewTraceID(0x1a, 2),
+		SpanID:        model.NewSpanID(3),
+		OperationName: "GET /",
+		StartTime:     time.Unix(0x01020304, 0),
+		Tags:          model.KeyValues{model.Int64(samplingPriorityTag, 2)},
+	}
+	worker := WriteWorker{
+		params: &WriteParams{
+			spansTable:       testSpansTable,
+			encoding:         EncodingProto,
+			multiTenant:      true,
+			samplingPriority: true,
+			binaryTraceIDs:   true,
+			rowBinary: NewRowBinaryInserter(server.Client(), server.URL, "jaeger", "writer", "secret",
+				map[string]string{"async_insert": "1"}),
+		},
+		tenant: "tenant_1",
+	}
+	require.NoError(t, worker.writeModelBatch([]*model.Span{&span}))
+
+	assert.Equal(t, fmt.Sprintf("INSERT INTO %s (tenant, timestamp, traceID, model, priority) FORMAT RowBinary", testSpansTable), query)
+	assert.Equal(t, "jaeger", database)
+	assert.Equal(t, "1", setting)
+	assert.Equal(t, "writer", user)
+	assert.Equal(t, "secret", key)
+
+	serialized, err := marshalSpan(&span, EncodingProto)
+	require.NoError(t, err)
+	require.Less(t, len(serialized), 128, "the length of the model is a single byte")
+	expected := append([]byte("\x08tenant_1\x04\x03\x02\x01"+encodeTraceID(span.TraceID, true)), byte(len(serialized)))
+	expected = append(append(expected, serialized...), 1)
+	assert.Equal(t, expected, body)
+}
+
+func TestRowBinaryInserter_InsertError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. DB::Exception: Table default.missing doesn't exist", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	inserter := NewRowBinaryInserter(server.Client(), server.URL+"/", "", "default", "", nil)
+	err := inserter.Insert(context.Background(), "missing", []string{"model"}, []byte("\x00"))
+	assert.EqualError(t, err, "insert into missing failed with 404 Not Found: Code: 60. DB::Exception: Table default.missing doesn't exist")
+}
+
+func TestRowBinary_writeString(t *testing.T) {
+	var rows rowBinary
+	rows.writeString("")
+	rows.writeString(string(make([]byte, 300)))
+	assert.Equal(t, []byte{0, 0xac, 0x02}, rows.Bytes()[:3], "lengths are variable-length integers")
+	assert.Equal(t, 303, rows.Len())
+}
+
+// BenchmarkWriteWorker_InsertSpans compares inserts of spans over the native protocol with RowBinary inserts over HTTP
+// into a ClickHouse server at the host in CLICKHOUSE_BENCHMARK, listening on the default ports 9000 and 8123
+func BenchmarkWriteWorker_InsertSpans(b *testing.B) {
+	host := os.Getenv("CLICKHOUSE_BENCHMARK")
+	if host == "" {
+		b.Skip("Set CLICKHOUSE_BENCHMARK to the host of ClickHouse to run the benchmark")
+	}
+	const (
+		table     TableName = "jaeger_benchmark_spans"
+		batchSize           = 10_000
+	)
+	db, err := sql.Open("clickhouse", fmt.Sprintf("tcp://%s:9000", host))
+	require.NoError(b, err)
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (timestamp DateTime, traceID String, model String) ENGINE MergeTree() ORDER BY traceID",
+		table,
+	))
+	require.NoError(b, err)
+	defer func() {
+		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+	}()
+	batch := generateRandomSpans(batchSize)
+
+	for _, format := range []string{"native", "row_binary"} {
+		b.Run(format, func(b *testing.B) {
+			params := &WriteParams{logger: hclog.NewNullLogger(), db: db, spansTable: table, encoding: EncodingJSON}
+			if format == "row_binary" {
+				params.rowBinary = NewRowBinaryInserter(http.DefaultClient, fmt.Sprintf("http://%s:8123", host), "", "default", "", nil)
+			}
+			worker := WriteWorker{params: params}
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, worker.writeModelBatch(batch))
+			}
+			b.ReportMetric(float64(b.N*batchSize)/time.Since(start).Seconds(), "spans/s")
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	schemaColumnsQuery = "SELECT name FROM system.columns WHERE database = currentDatabase() AND table = ?"
+
+	// Optional columns of the index table
+	flagsColumn          = "flags"
+	linkedTraceIDsColumn = "linkedTraceIDs"
+	httpStatusCodeColumn = "httpStatusCode"
+	grpcStatusCodeColumn = "grpcStatusCode"
+	spanKindColumn       = "spanKind"
+	isRootColumn         = "isRoot"
+	insertedAtColumn     = "insertedAt"
+)
+
+// SchemaMonitor checks that columns of the index table optional features depend on exist, e.g. after a partial
+// migration. Features whose columns are missing are skipped by writers and readers instead of failing every query,
+// until the columns are found by a later check.
+type SchemaMonitor struct {
+	logger   hclog.Logger
+	db       *sql.DB
+	table    TableName
+	columns  []string
+	interval time.Duration
+
+	mutex   sync.RWMutex
+	missing map[string]bool
+	finish  chan bool
+	done    sync.WaitGroup
+}
+
+// NewSchemaMonitor returns a SchemaMonitor of the columns of the table of the current database
+func NewSchemaMonitor(logger hclog.Logger, db *sql.DB, table TableName, columns []string, interval time.Duration) *SchemaMonitor {
+	return &SchemaMonitor{
+		logger:   logger,
+		db:       db,
+		table:    table,
+		columns:  columns,
+		interval: interval,
+		missing:  make(map[string]bool),
+		finish:   make(chan bool),
+	}
+}
+
+// WithSchemaMonitor writes only columns of the index table the monitor has found
+func WithSchemaMonitor(monitor *SchemaMonitor) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.schema = monitor
+	}
+}
+
+// WithReaderSchemaMonitor filters only by columns of the index table the monitor has found
+func WithReaderSchemaMonitor(monitor *SchemaMonitor) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.schema = monitor
+	}
+}
+
+// Start checks the columns every interval in the background until the monitor is closed
+func (m *SchemaMonitor) Start() {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.finish:
+				return
+			case <-ticker.C:
+				if err := m.Check(); err != nil {
+					m.logger.Error("Could not check columns of the index table", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops checking the columns
+func (m *SchemaMonitor) Close() {
+	close(m.finish)
+	m.done.Wait()
+}
+
+// Check looks up the columns of the table and logs which of them went missing or were added since the last check
+func (m *SchemaMonitor) Check() error {
+	rows, err := m.db.Query(schemaColumnsQuery, string(m.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		existing[column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// A table without columns does not exist, e.g. it was not created by init scripts yet
+	if len(existing) == 0 {
+		return fmt.Errorf("table %s does not exist", m.table)
+	}
+
+	var missing, added []string
+	m.mutex.Lock()
+	for _, column := range m.columns {
+		if !existing[column] && !m.missing[column] {
+			missing = append(missing, column)
+		}
+		if existing[column] && m.missing[column] {
+			added = append(added, column)
+		}
+		m.missing[column] = !existing[column]
+	}
+	m.mutex.Unlock()
+
+	sort.Strings(missing)
+	sort.Strings(added)
+	if len(missing) > 0 {
+		m.logger.Error(
+			"Columns of the index table are missing, features depending on them are disabled until they are added",
+			"table", m.table,
+			"columns", strings.Join(missing, ", "),
+		)
+	}
+	if len(added) > 0 {
+		m.logger.Info(
+			"Columns of the index table were added, features depending on them are enabled",
+			"table", m.table,
+			"columns", strings.Join(added, ", "),
+		)
+	}
+	return nil
+}
+
+// hasColumn returns false only if the column was missing at the last check
+func (m *SchemaMonitor) hasColumn(column string) bool {
+	if m == nil {
+		return true
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return !m.missing[column]
+}
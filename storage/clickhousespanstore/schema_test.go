@@ -0,0 +1,89 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestSchemaMonitor_Check(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	monitor := NewSchemaMonitor(spyLogger, db, testIndexTable, []string{flagsColumn, linkedTraceIDsColumn}, time.Minute)
+	expectColumns := func(columns ...string) {
+		rows := sqlmock.NewRows([]string{"name"}).AddRow("timestamp")
+		for _, column := range columns {
+			rows.AddRow(column)
+		}
+		mock.ExpectQuery(schemaColumnsQuery).WithArgs(string(testIndexTable)).WillReturnRows(rows)
+	}
+
+	assert.True(t, monitor.hasColumn(flagsColumn), "columns are considered existing before the first check")
+
+	expectColumns(linkedTraceIDsColumn)
+	require.NoError(t, monitor.Check())
+	assert.False(t, monitor.hasColumn(flagsColumn))
+	assert.True(t, monitor.hasColumn(linkedTraceIDsColumn))
+
+	expectColumns(linkedTraceIDsColumn)
+	require.NoError(t, monitor.Check())
+
+	expectColumns(flagsColumn, linkedTraceIDsColumn)
+	require.NoError(t, monitor.Check())
+	assert.True(t, monitor.hasColumn(flagsColumn))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Error, []mocks.LogMock{{
+		Msg:  "Columns of the index table are missing, features depending on them are disabled until they are added",
+		Args: []interface{}{"table", TableName(testIndexTable), "columns", flagsColumn},
+	}})
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Info, []mocks.LogMock{{
+		Msg:  "Columns of the index table were added, features depending on them are enabled",
+		Args: []interface{}{"table", TableName(testIndexTable), "columns", flagsColumn},
+	}})
+}
+
+func TestSchemaMonitor_CheckMissingTable(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	monitor := NewSchemaMonitor(mocks.NewSpyLogger(), db, testIndexTable, []string{flagsColumn}, time.Minute)
+	mock.ExpectQuery(schemaColumnsQuery).WithArgs(string(testIndexTable)).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+
+	assert.EqualError(t, monitor.Check(), "table test_index_table does not exist")
+	assert.True(t, monitor.hasColumn(flagsColumn))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_SchemaDrift(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	worker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable)
+	worker.params.indexFlags = true
+	worker.params.extractedTags = []ExtractedTag{{Key: "test_int64_key", Type: "Int64"}}
+	worker.params.schema = &SchemaMonitor{missing: map[string]bool{flagsColumn: true, "tag_test_int64_key": true}}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(indexWriteExpectation.preparation).
+		ExpectExec().
+		WithArgs(indexWriteExpectation.execArgs[0]...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	span := testSpan
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,151 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+// ErrUnsupportedExportSearch is returned by ExportIndexRows for searches of few traces by their IDs
+var ErrUnsupportedExportSearch = errors.New("index rows cannot be exported by trace ID prefix or linked trace, search them by services and tags")
+
+// IndexRow is a row of the index of a span matching a search, exported for offline analysis
+type IndexRow struct {
+	TraceID   model.TraceID
+	Service   string
+	Operation string
+	Duration  time.Duration
+	Timestamp time.Time
+}
+
+// ExportIndexRows calls fn with index rows of spans matching the search parameters as they are read, for offline
+// analysis of large results, e.g. durations of all requests of a service from yesterday. Unlike FindTraceIDs,
+// every matching span is exported, not only found traces. Hidden traces are excluded. NumTraces limits the number
+// of rows if positive. Exporting stops with the first error returned by fn.
+func (r *TraceReader) ExportIndexRows(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	fn func(row IndexRow) error,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ExportIndexRows")
+	defer span.Finish()
+
+	if params.StartTimeMin.IsZero() {
+		return errStartTimeRequired
+	}
+	if r.indexTable == "" {
+		return errNoIndexTable
+	}
+	_, byPrefix := params.Tags[traceIDPrefixTag]
+	_, byLink := params.Tags[linkedToTag]
+	if byPrefix || byLink {
+		return ErrUnsupportedExportSearch
+	}
+
+	end := params.StartTimeMax
+	if end.IsZero() {
+		end = time.Now()
+	}
+	filter, args, err := r.searchFilter(ctx, params, params.StartTimeMin, end)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT traceID, service, operation, durationUs, timestamp FROM %s%s", r.indexTable, filter)
+	hiddenCondition, hiddenArgs := r.notHiddenCondition(ctx)
+	query += hiddenCondition
+	args = append(args, hiddenArgs...)
+	if params.NumTraces > 0 {
+		query += " LIMIT ?"
+		args = append(args, params.NumTraces)
+	}
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			traceIDString string
+			durationUs    uint64
+			row           IndexRow
+		)
+		if err := rows.Scan(&traceIDString, &row.Service, &row.Operation, &durationUs, &row.Timestamp); err != nil {
+			return err
+		}
+		if row.TraceID, err = decodeTraceID(traceIDString, r.binaryTraceIDs); err != nil {
+			return err
+		}
+		row.Duration = time.Duration(durationUs) * time.Microsecond
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// indexRowColumns are names of the columns written to the header of exported index rows
+var indexRowColumns = []string{"traceID", "service", "operation", "durationUs", "timestamp"}
+
+// IndexRowWriter writes index rows as CSV or TSV. The header is written with the first row or by Flush,
+// so that nothing is written before the first row is found.
+type IndexRowWriter struct {
+	out    *csv.Writer
+	header bool
+}
+
+// NewIndexRowWriter returns a writer of index rows to w in the format, either csv or tsv
+func NewIndexRowWriter(w io.Writer, format ExportFormat) (*IndexRowWriter, error) {
+	out := csv.NewWriter(w)
+	switch format {
+	case ExportCSV:
+	case ExportTSV:
+		out.Comma = '\t'
+	default:
+		return nil, fmt.Errorf("unknown format of index rows %q, use %s or %s", format, ExportCSV, ExportTSV)
+	}
+	return &IndexRowWriter{out: out}, nil
+}
+
+// Write writes the row, timestamps are in RFC 3339 format in UTC
+func (w *IndexRowWriter) Write(row IndexRow) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.out.Write([]string{
+		row.TraceID.String(),
+		row.Service,
+		row.Operation,
+		strconv.FormatInt(row.Duration.Microseconds(), 10),
+		row.Timestamp.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Flush writes buffered rows to the underlying writer
+func (w *IndexRowWriter) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.out.Flush()
+	return w.out.Error()
+}
+
+func (w *IndexRowWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	return w.out.Write(indexRowColumns)
+}
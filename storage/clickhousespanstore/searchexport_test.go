@@ -0,0 +1,48 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexRowWriter(t *testing.T) {
+	var out strings.Builder
+	writer, err := NewIndexRowWriter(&out, ExportTSV)
+	require.NoError(t, err)
+	require.NoError(t, writer.Flush())
+	assert.Equal(t, "traceID\tservice\toperation\tdurationUs\ttimestamp\n", out.String(), "the header is written without rows")
+
+	require.NoError(t, writer.Write(IndexRow{
+		TraceID:   model.NewTraceID(1, 2),
+		Service:   "frontend",
+		Operation: "GET /a,b",
+		Duration:  time.Millisecond * 3,
+		Timestamp: time.Unix(1628000000, 500),
+	}))
+	require.NoError(t, writer.Flush())
+	assert.Equal(t, "traceID\tservice\toperation\tdurationUs\ttimestamp\n"+
+		"00000000000000010000000000000002\tfrontend\tGET /a,b\t3000\t2021-08-03T14:13:20.0000005Z\n", out.String())
+
+	_, err = NewIndexRowWriter(&out, ExportNDJSON)
+	assert.EqualError(t, err, `unknown format of index rows "ndjson", use csv or tsv`)
+}
+
+func TestTraceReader_ExportIndexRowsErrors(t *testing.T) {
+	reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+	noop := func(IndexRow) error { return nil }
+
+	assert.Equal(t, errStartTimeRequired, reader.ExportIndexRows(context.Background(), &spanstore.TraceQueryParameters{}, noop))
+	assert.Equal(t, ErrUnsupportedExportSearch, reader.ExportIndexRows(context.Background(), &spanstore.TraceQueryParameters{
+		StartTimeMin: time.Now(),
+		Tags:         map[string]string{traceIDPrefixTag: "1a"},
+	}, noop))
+	assert.Equal(t, errNoIndexTable, NewTraceReader(nil, testOperationsTable, "", testSpansTable).
+		ExportIndexRows(context.Background(), &spanstore.TraceQueryParameters{StartTimeMin: time.Now()}, noop))
+}
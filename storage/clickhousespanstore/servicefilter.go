@@ -0,0 +1,112 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var numFilteredSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_filtered_spans_total",
+	Help: "Number of spans not written as their services are denied or not allowed, by the list that filtered them",
+}, []string{"list"})
+
+// ServiceFilter decides by service names which spans are written, so that e.g. test or load generating services
+// are excluded from storage centrally instead of in every collector
+type ServiceFilter struct {
+	allow serviceList
+	deny  serviceList
+}
+
+// serviceList matches services by exact names or regular expressions
+type serviceList struct {
+	names    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func newServiceList(names, patterns []string) (serviceList, error) {
+	list := serviceList{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		list.names[name] = true
+	}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return serviceList{}, fmt.Errorf("invalid service pattern %q: %w", pattern, err)
+		}
+		list.patterns = append(list.patterns, compiled)
+	}
+	return list, nil
+}
+
+func (l serviceList) empty() bool {
+	return len(l.names) == 0 && len(l.patterns) == 0
+}
+
+func (l serviceList) matches(service string) bool {
+	if l.names[service] {
+		return true
+	}
+	for _, pattern := range l.patterns {
+		if pattern.MatchString(service) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewServiceFilter returns a ServiceFilter writing spans of services matching neither denied names nor denied
+// regular expressions. When allowed names or regular expressions are given, only spans of services matching them
+// are written, services that are both allowed and denied are denied.
+func NewServiceFilter(allow, allowPatterns, deny, denyPatterns []string) (*ServiceFilter, error) {
+	allowList, err := newServiceList(allow, allowPatterns)
+	if err != nil {
+		return nil, err
+	}
+	denyList, err := newServiceList(deny, denyPatterns)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceFilter{allow: allowList, deny: denyList}, nil
+}
+
+// WithServiceFilter writes only spans of services allowed by the filter
+func WithServiceFilter(filter *ServiceFilter) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.serviceFilter = filter
+	}
+}
+
+// Allows reports whether spans of the service are written
+func (f *ServiceFilter) Allows(service string) bool {
+	return f.list(service) == ""
+}
+
+// list returns the list filtering out the service, empty if the service is allowed
+func (f *ServiceFilter) list(service string) string {
+	if f == nil {
+		return ""
+	}
+	if f.deny.matches(service) {
+		return "deny"
+	}
+	if !f.allow.empty() && !f.allow.matches(service) {
+		return "allow"
+	}
+	return ""
+}
+
+// filter reports whether the span is written and counts filtered spans
+func (f *ServiceFilter) filter(span *model.Span) bool {
+	if f == nil || span.Process == nil {
+		return true
+	}
+	list := f.list(span.Process.ServiceName)
+	if list == "" {
+		return true
+	}
+	numFilteredSpans.WithLabelValues(list).Inc()
+	return false
+}
@@ -0,0 +1,77 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceFilter_Allows(t *testing.T) {
+	tests := map[string]struct {
+		allow, allowPatterns, deny, denyPatterns []string
+		allowed                                  []string
+		filtered                                 []string
+	}{
+		"no lists": {allowed: []string{"frontend"}},
+		"deny": {
+			deny:         []string{"load-test"},
+			denyPatterns: []string{"^loadgen-"},
+			allowed:      []string{"frontend", "load-test-report"},
+			filtered:     []string{"load-test", "loadgen-1"},
+		},
+		"allow": {
+			allow:         []string{"frontend"},
+			allowPatterns: []string{"^backend-"},
+			allowed:       []string{"frontend", "backend-1"},
+			filtered:      []string{"customer", "my-frontend"},
+		},
+		"deny wins": {
+			allowPatterns: []string{".*"},
+			deny:          []string{"load-test"},
+			allowed:       []string{"frontend"},
+			filtered:      []string{"load-test"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter, err := NewServiceFilter(test.allow, test.allowPatterns, test.deny, test.denyPatterns)
+			require.NoError(t, err)
+			for _, service := range test.allowed {
+				assert.True(t, filter.Allows(service), service)
+			}
+			for _, service := range test.filtered {
+				assert.False(t, filter.Allows(service), service)
+			}
+		})
+	}
+
+	var nilFilter *ServiceFilter
+	assert.True(t, nilFilter.Allows("frontend"))
+}
+
+func TestNewServiceFilterInvalidPattern(t *testing.T) {
+	_, err := NewServiceFilter(nil, nil, nil, []string{"("})
+	assert.EqualError(t, err, "invalid service pattern \"(\": error parsing regexp: missing closing ): `(`")
+}
+
+func TestSpanWriter_WriteSpanServiceFilter(t *testing.T) {
+	filter, err := NewServiceFilter(nil, nil, []string{"load-test"}, nil)
+	require.NoError(t, err)
+	writer := &SpanWriter{
+		spans:         make(chan tenantSpan, 1),
+		serviceFilter: filter,
+	}
+
+	denied := testSpan
+	denied.Process = model.NewProcess("load-test", nil)
+	assert.NoError(t, writer.WriteSpan(context.Background(), &denied))
+	assert.Empty(t, writer.spans, "filtered span is not queued")
+
+	span := testSpan
+	assert.NoError(t, writer.WriteSpan(context.Background(), &span))
+	assert.Len(t, writer.spans, 1)
+}
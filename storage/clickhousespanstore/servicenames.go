@@ -0,0 +1,84 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// ServiceNameNormalizer rewrites service names of written spans, so that spellings of one service, e.g. MyService
+// and myservice, are stored as one service in spans, the index and everything derived from it
+type ServiceNameNormalizer struct {
+	trim         bool
+	lowercase    bool
+	replacements []serviceNameReplacement
+}
+
+// ServiceNameReplacement replaces matches of the regular expression Pattern in service names with Replacement,
+// which may refer to submatches as $1
+type ServiceNameReplacement struct {
+	Pattern     string
+	Replacement string
+}
+
+type serviceNameReplacement struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewServiceNameNormalizer returns a ServiceNameNormalizer trimming whitespace, lowercasing and then applying
+// the replacements in their order, so that a replacement applies to the result of the previous ones
+func NewServiceNameNormalizer(trim, lowercase bool, replacements []ServiceNameReplacement) (*ServiceNameNormalizer, error) {
+	normalizer := &ServiceNameNormalizer{trim: trim, lowercase: lowercase}
+	for _, replacement := range replacements {
+		compiled, err := regexp.Compile(replacement.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service name pattern %q: %w", replacement.Pattern, err)
+		}
+		normalizer.replacements = append(normalizer.replacements, serviceNameReplacement{
+			pattern:     compiled,
+			replacement: replacement.Replacement,
+		})
+	}
+	return normalizer, nil
+}
+
+// WithServiceNameNormalizer writes spans with service names normalized by the normalizer
+func WithServiceNameNormalizer(normalizer *ServiceNameNormalizer) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.serviceNames = normalizer
+	}
+}
+
+// Normalize returns the normalized service name
+func (n *ServiceNameNormalizer) Normalize(service string) string {
+	if n.trim {
+		service = strings.TrimSpace(service)
+	}
+	if n.lowercase {
+		service = strings.ToLower(service)
+	}
+	for _, replacement := range n.replacements {
+		service = replacement.pattern.ReplaceAllString(service, replacement.replacement)
+	}
+	return service
+}
+
+// normalize returns the span with the normalized service name, spans are copied instead of modified
+// as their processes may be shared with other spans
+func (n *ServiceNameNormalizer) normalize(span *model.Span) *model.Span {
+	if n == nil || span.Process == nil {
+		return span
+	}
+	service := n.Normalize(span.Process.ServiceName)
+	if service == span.Process.ServiceName {
+		return span
+	}
+	process := *span.Process
+	process.ServiceName = service
+	normalized := *span
+	normalized.Process = &process
+	return &normalized
+}
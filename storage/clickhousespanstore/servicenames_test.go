@@ -0,0 +1,82 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceNameNormalizer_Normalize(t *testing.T) {
+	tests := map[string]struct {
+		trim         bool
+		lowercase    bool
+		replacements []ServiceNameReplacement
+		service      string
+		expected     string
+	}{
+		"trim":      {trim: true, service: " MyService\t", expected: "MyService"},
+		"lowercase": {lowercase: true, service: "MyService", expected: "myservice"},
+		"replacements": {
+			lowercase: true,
+			replacements: []ServiceNameReplacement{
+				{Pattern: "^svc-", Replacement: ""},
+				{Pattern: "-(prod|staging)$", Replacement: ""},
+				{Pattern: "_", Replacement: "-"},
+			},
+			service:  "SVC-Cart_Service-Prod",
+			expected: "cart-service",
+		},
+		"overlapping replacements in configured order": {
+			replacements: []ServiceNameReplacement{
+				{Pattern: "^payments-api$", Replacement: "payments"},
+				{Pattern: "-api$", Replacement: "-gateway"},
+			},
+			service:  "payments-api",
+			expected: "payments",
+		},
+		"overlapping replacements in reverse order": {
+			replacements: []ServiceNameReplacement{
+				{Pattern: "-api$", Replacement: "-gateway"},
+				{Pattern: "^payments-api$", Replacement: "payments"},
+			},
+			service:  "payments-api",
+			expected: "payments-gateway",
+		},
+		"submatch": {
+			replacements: []ServiceNameReplacement{{Pattern: `^(\w+)\.v\d+$`, Replacement: "$1"}},
+			service:      "cart.v2",
+			expected:     "cart",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			normalizer, err := NewServiceNameNormalizer(test.trim, test.lowercase, test.replacements)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, normalizer.Normalize(test.service))
+		})
+	}
+}
+
+func TestNewServiceNameNormalizerInvalidPattern(t *testing.T) {
+	_, err := NewServiceNameNormalizer(false, false, []ServiceNameReplacement{{Pattern: "("}})
+	assert.EqualError(t, err, "invalid service name pattern \"(\": error parsing regexp: missing closing ): `(`")
+}
+
+func TestServiceNameNormalizer_normalize(t *testing.T) {
+	normalizer, err := NewServiceNameNormalizer(true, true, nil)
+	require.NoError(t, err)
+
+	process := &model.Process{ServiceName: "MyService", Tags: []model.KeyValue{model.String("hostname", "host")}}
+	span := &model.Span{SpanID: 1, Process: process}
+	normalized := normalizer.normalize(span)
+	assert.Equal(t, "myservice", normalized.Process.ServiceName)
+	assert.Equal(t, process.Tags, normalized.Process.Tags)
+	assert.Equal(t, "MyService", process.ServiceName, "shared processes are not modified")
+
+	assert.Same(t, normalized, normalizer.normalize(normalized), "normalized spans are not copied")
+	var disabled *ServiceNameNormalizer
+	assert.Same(t, span, disabled.normalize(span))
+}
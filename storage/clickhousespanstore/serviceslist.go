@@ -0,0 +1,35 @@
+package clickhousespanstore
+
+import "time"
+
+// WithServicesLookback lists services having spans in the index table within the lookback instead of all services
+// of the operations table, so that services of old, backfilled or archived spans do not fill the list
+func WithServicesLookback(lookback time.Duration) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.servicesLookback = lookback
+	}
+}
+
+// WithExcludedServices leaves the services out of listed services, their spans can still be searched
+func WithExcludedServices(services []string) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.excludedServices = make(map[string]bool, len(services))
+		for _, service := range services {
+			reader.excludedServices[service] = true
+		}
+	}
+}
+
+// withoutExcludedServices returns the services that are not excluded, in the same order
+func (r *TraceReader) withoutExcludedServices(services []string) []string {
+	if len(r.excludedServices) == 0 {
+		return services
+	}
+	listed := make([]string, 0, len(services))
+	for _, service := range services {
+		if !r.excludedServices[service] {
+			listed = append(listed, service)
+		}
+	}
+	return listed
+}
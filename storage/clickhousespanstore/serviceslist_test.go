@@ -0,0 +1,51 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_GetServicesWithinLookback(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT service FROM %s WHERE tenant = ? AND timestamp >= ? GROUP BY service", testIndexTable)).
+		WithArgs("tenant_1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"service"}).AddRow("frontend").AddRow("load-generator").AddRow("route"))
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithReaderTenantHeader("x-tenant"),
+		WithServicesLookback(time.Hour), WithExcludedServices([]string{"load-generator"}))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	services, err := reader.GetServices(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"frontend", "route"}, services)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewTraceReader(db, testOperationsTable, "", testSpansTable, WithServicesLookback(time.Hour)).GetServices(ctx)
+	assert.ErrorIs(t, err, errNoIndexTable)
+}
+
+func TestTraceReader_GetServicesExcluded(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)).
+		WillReturnRows(sqlmock.NewRows([]string{"service"}).AddRow("frontend").AddRow("smoke-test"))
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithExcludedServices([]string{"smoke-test"}))
+	services, err := reader.GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"frontend"}, services)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
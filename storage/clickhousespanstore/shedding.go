@@ -0,0 +1,115 @@
+package clickhousespanstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	loadSheddingActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_load_shedding_active",
+		Help: "Whether spans are shed due to ClickHouse overload, 1 while shedding",
+	})
+	numShedSpans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_shed_spans_total",
+		Help: "Number of spans dropped while shedding load",
+	})
+)
+
+// loadShedder drops a fraction of spans while ClickHouse is overloaded, so that batches waiting for retries do not
+// pile up in memory and slow down collectors. After failureThreshold consecutive failed or slow inserts shedding starts,
+// after recoveryThreshold consecutive successful fast inserts it stops.
+type loadShedder struct {
+	logger            hclog.Logger
+	fraction          float64
+	maxLatency        time.Duration
+	failureThreshold  int
+	recoveryThreshold int
+
+	mutex     sync.Mutex
+	failures  int
+	successes int
+	shedding  int32
+}
+
+// WithLoadShedding drops the fraction of traces while inserts are failing or take longer than maxLatency.
+// Zero maxLatency disables the latency check.
+func WithLoadShedding(fraction float64, maxLatency time.Duration, failureThreshold, recoveryThreshold int) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.shedder = &loadShedder{
+			logger:            writer.writeParams.logger,
+			fraction:          fraction,
+			maxLatency:        maxLatency,
+			failureThreshold:  failureThreshold,
+			recoveryThreshold: recoveryThreshold,
+		}
+	}
+}
+
+// observe records an insert, inserts that failed or were slower than maxLatency are unhealthy
+func (s *loadShedder) observe(err error, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil || (s.maxLatency > 0 && latency > s.maxLatency) {
+		s.failures++
+		s.successes = 0
+		if !s.active() && s.failures >= s.failureThreshold {
+			s.logger.Warn(
+				"ClickHouse is overloaded, shedding spans",
+				"fraction", s.fraction,
+				"latency", latency,
+				"error", err,
+			)
+			s.setActive(true)
+		}
+		return
+	}
+
+	s.failures = 0
+	s.successes++
+	if s.active() && s.successes >= s.recoveryThreshold {
+		s.logger.Info("ClickHouse recovered, stopped shedding spans")
+		s.setActive(false)
+	}
+}
+
+// shed reports whether the span is dropped. It depends only on the trace ID, so traces are kept or dropped whole,
+// also by other collectors shedding the same fraction.
+func (s *loadShedder) shed(span *model.Span) bool {
+	if s == nil || !s.active() {
+		return false
+	}
+	if traceFraction(span.TraceID) >= s.fraction {
+		return false
+	}
+	numShedSpans.Inc()
+	return true
+}
+
+// traceFraction maps the trace ID to a uniformly distributed float in [0, 1), so that decisions on fractions of traces
+// depend only on their IDs. The lowest bits of trace IDs are random, their top 53 bits make the float.
+func traceFraction(traceID model.TraceID) float64 {
+	return float64(traceID.Low>>11) / (1 << 53)
+}
+
+func (s *loadShedder) active() bool {
+	return atomic.LoadInt32(&s.shedding) == 1
+}
+
+func (s *loadShedder) setActive(active bool) {
+	var value int32
+	if active {
+		value = 1
+	}
+	atomic.StoreInt32(&s.shedding, value)
+	loadSheddingActive.Set(float64(value))
+}
@@ -0,0 +1,69 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestLoadShedder_observe(t *testing.T) {
+	shedder := &loadShedder{
+		logger:            mocks.NewSpyLogger(),
+		fraction:          1,
+		maxLatency:        time.Second,
+		failureThreshold:  2,
+		recoveryThreshold: 2,
+	}
+	span := &model.Span{TraceID: model.TraceID{Low: 1}}
+
+	shedder.observe(errors.New("overloaded"), time.Millisecond)
+	assert.False(t, shedder.shed(span), "a single failure does not start shedding")
+	shedder.observe(nil, 2*time.Second)
+	assert.True(t, shedder.shed(span), "slow inserts count as failures")
+
+	shedder.observe(nil, time.Millisecond)
+	assert.True(t, shedder.shed(span), "a single success does not stop shedding")
+	shedder.observe(nil, time.Millisecond)
+	assert.False(t, shedder.shed(span))
+}
+
+func TestLoadShedder_shedWholeTraces(t *testing.T) {
+	shedder := &loadShedder{fraction: 0.5, shedding: 1}
+
+	kept := &model.Span{TraceID: model.TraceID{Low: math.MaxUint64}}
+	shed := &model.Span{TraceID: model.TraceID{Low: 1 << 10}}
+	for i := 0; i < 3; i++ {
+		kept.SpanID = model.SpanID(i)
+		shed.SpanID = model.SpanID(i)
+		assert.False(t, shedder.shed(kept))
+		assert.True(t, shedder.shed(shed))
+	}
+
+	var nilShedder *loadShedder
+	nilShedder.observe(errors.New("overloaded"), time.Second)
+	assert.False(t, nilShedder.shed(shed))
+}
+
+func TestSpanWriter_WriteSpanShedding(t *testing.T) {
+	writer := &SpanWriter{
+		spans: make(chan tenantSpan, 1),
+		writeParams: WriteParams{
+			shedder: &loadShedder{fraction: 1, shedding: 1},
+		},
+	}
+
+	span := testSpan
+	assert.NoError(t, writer.WriteSpan(context.Background(), &span))
+	assert.Empty(t, writer.spans, "shed span is not queued")
+
+	writer.writeParams.shedder.setActive(false)
+	assert.NoError(t, writer.WriteSpan(context.Background(), &span))
+	assert.Len(t, writer.spans, 1)
+}
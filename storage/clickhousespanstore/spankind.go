@@ -0,0 +1,33 @@
+package clickhousespanstore
+
+import (
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const spanKindTag = "span.kind"
+
+// WithWriterSpanKindIndex writes the span.kind tag of spans to the spanKind column of the index table
+func WithWriterSpanKindIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexSpanKind = true
+	}
+}
+
+// WithReaderSpanKindIndex filters spans by the span.kind search tag using the spanKind column of the index table,
+// e.g. to search only server spans
+func WithReaderSpanKindIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.spanKindIndex = true
+	}
+}
+
+// spanKindValue returns the span.kind tag of the span in lower case, empty if the span does not have it
+func spanKindValue(span *model.Span) string {
+	kv, ok := model.KeyValues(span.Tags).FindByKey(spanKindTag)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(kv.AsString()))
+}
@@ -0,0 +1,165 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+const (
+	// logFieldTagPrefix prefixes search tags matching fields of span logs by their keys, e.g. log.event=exception
+	logFieldTagPrefix = "log."
+	// logContainsTag is a search tag whose value is searched case-insensitively in values of fields of span logs
+	logContainsTag = "jaeger.log_contains"
+)
+
+// WithSpanLogsTable writes a row of every log of spans with its fields to the table, so that traces can be searched
+// by fields of single logs
+func WithSpanLogsTable(table TableName) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.spanLogsTable = table
+	}
+}
+
+// WithReaderSpanLogsTable finds traces by log.<field> and jaeger.log_contains search tags in the span logs table
+func WithReaderSpanLogsTable(table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.spanLogsTable = table
+	}
+}
+
+func (worker *WriteWorker) writeSpanLogsBatch(batch []*model.Span) error {
+	hasLogs := false
+	for _, span := range batch {
+		if len(span.Logs) > 0 {
+			hasLogs = true
+			break
+		}
+	}
+	if !hasLogs {
+		return nil
+	}
+
+	ctx, observe := worker.startInsert(insertedSpanLogs)
+	tx, err := worker.params.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{"timestamp", "traceID", "spanID", "service", "fields.key", "fields.value"}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		worker.params.spanLogsTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, span := range batch {
+		for _, log := range span.Logs {
+			keys, values := logFields(log)
+			args := []interface{}{
+				log.Timestamp,
+				encodeTraceID(span.TraceID, worker.params.binaryTraceIDs),
+				span.SpanID.String(),
+				span.Process.ServiceName,
+				keys,
+				values,
+			}
+			if worker.params.multiTenant {
+				args = append([]interface{}{worker.tenant}, args...)
+			}
+			if _, err = statement.Exec(args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	committed = true
+
+	return observe(tx.Commit())
+}
+
+// logFields returns keys and values of fields of the log sorted by keys
+func logFields(log model.Log) ([]string, []string) {
+	fields := make(model.KeyValues, len(log.Fields))
+	copy(fields, log.Fields)
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Key < fields[j].Key
+	})
+	keys := make([]string, 0, len(fields))
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, field.Key)
+		values = append(values, field.AsString())
+	}
+	return keys, values
+}
+
+// isSpanLogsTag returns whether the search tag is matched against span logs instead of tags of spans
+func (r *TraceReader) isSpanLogsTag(key string) bool {
+	return r.spanLogsTable != "" && (key == logContainsTag || strings.HasPrefix(key, logFieldTagPrefix))
+}
+
+// spanLogsCondition restricts found traces to ones with a log of a span of the service within the time range
+// matching all log search tags
+func (r *TraceReader) spanLogsCondition(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	start, end time.Time,
+) (string, []interface{}) {
+	keys := make([]string, 0)
+	for key := range params.Tags {
+		if r.isSpanLogsTag(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil
+	}
+	sort.Strings(keys)
+
+	query := fmt.Sprintf(" AND traceID IN (SELECT traceID FROM %s WHERE", r.spanLogsTable)
+	args := make([]interface{}, 0, 3+3*len(keys))
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	serviceCondition, serviceArgs := r.serviceCondition(params.ServiceName)
+	query += " " + serviceCondition + " AND timestamp >= ? AND timestamp <= ?"
+	args = append(append(args, serviceArgs...), start, end)
+	for _, key := range keys {
+		value := params.Tags[key]
+		if key == logContainsTag {
+			query += " AND arrayExists(value -> positionCaseInsensitive(value, ?) > 0, fields.value)"
+			args = append(args, value)
+			continue
+		}
+		field := strings.TrimPrefix(key, logFieldTagPrefix)
+		query += " AND has(fields.key, ?) AND fields.value[indexOf(fields.key, ?)] = ?"
+		args = append(args, field, field, value)
+	}
+	return query + ")", args
+}
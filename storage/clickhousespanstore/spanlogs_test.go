@@ -0,0 +1,113 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testSpanLogsTable TableName = "test_span_logs_table"
+
+func TestSpanWriter_SpanLogsBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.spanLogsTable = testSpanLogsTable
+
+	withoutLogs := testSpan
+	withoutLogs.Logs = nil
+	assert.NoError(t, worker.writeSpanLogsBatch([]*model.Span{&withoutLogs}), "nothing is inserted without logs")
+
+	failed := testSpan
+	failed.SpanID = model.NewSpanID(4)
+	failed.Logs = []model.Log{{
+		Timestamp: testStartTime.Add(time.Second),
+		Fields:    []model.KeyValue{model.String("message", "connection refused"), model.String("event", "error")},
+	}}
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(
+		"INSERT INTO test_span_logs_table (timestamp, traceID, spanID, service, fields.key, fields.value) VALUES (?, ?, ?, ?, ?, ?)",
+	)
+	prep.ExpectExec().
+		WithArgs(testStartTime, testSpan.TraceID.String(), testSpan.SpanID.String(), "test_service",
+			[]string{"test_log_key"}, []string{"test_log_value"}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().
+		WithArgs(testStartTime.Add(time.Second), failed.TraceID.String(), failed.SpanID.String(), "test_service",
+			[]string{"event", "message"}, []string{"error", "connection refused"}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeSpanLogsBatch([]*model.Span{&testSpan, &withoutLogs, &failed}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_FindTraceIDsByLogs(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithReaderSpanLogsTable(testSpanLogsTable))
+	service := "service"
+	start := testStartTime
+	end := start.Add(time.Hour)
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  service,
+		Tags:         map[string]string{"error": "true", "log.event": "exception", logContainsTag: "Timeout"},
+		NumTraces:    testNumTraces,
+		StartTimeMin: start,
+		StartTimeMax: end,
+	}
+
+	traceID := model.TraceID{Low: 1}
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?"+
+				" AND has(tags.key, ?) AND tags.value[indexOf(tags.key, ?)] == ?"+
+				" AND traceID IN (SELECT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?"+
+				" AND arrayExists(value -> positionCaseInsensitive(value, ?) > 0, fields.value)"+
+				" AND has(fields.key, ?) AND fields.value[indexOf(fields.key, ?)] = ?)"+
+				" ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+			testSpanLogsTable,
+		)).
+		WithArgs(service, start, end, "error", "error", "true",
+			service, start, end, "Timeout", "event", "event", "exception", testNumTraces).
+		WillReturnRows(getRows([]driver.Value{traceID.String()}))
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &params)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{traceID}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_spanLogsCondition(t *testing.T) {
+	params := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"log.event": "exception"}}
+
+	reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+	condition, args := reader.spanLogsCondition(context.Background(), params, testStartTime, testStartTime)
+	assert.Empty(t, condition, "log tags are matched as normal tags without the span logs table")
+	assert.Empty(t, args)
+	assert.False(t, reader.isSpanLogsTag("log.event"))
+
+	reader = NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable,
+		WithReaderSpanLogsTable(testSpanLogsTable), WithReaderTenantHeader("x-tenant"))
+	condition, args = reader.spanLogsCondition(context.Background(), params, testStartTime, testStartTime)
+	assert.Equal(t, " AND traceID IN (SELECT traceID FROM test_span_logs_table WHERE tenant = ? AND service = ?"+
+		" AND timestamp >= ? AND timestamp <= ? AND has(fields.key, ?) AND fields.value[indexOf(fields.key, ?)] = ?)", condition)
+	assert.Equal(t, []interface{}{"", "frontend", testStartTime, testStartTime, "event", "event", "exception"}, args)
+}
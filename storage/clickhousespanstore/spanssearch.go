@@ -0,0 +1,156 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+// WithSpansTableSearch searches the spans table when there is no index table, e.g. in minimal deployments.
+// The spans table has no search columns, so at most maxScannedSpans of the newest spans of the searched
+// time range are decoded and matched against the search parameters. Traces with older matching spans are not found,
+// service aliases and jaeger.min_spans and jaeger.min_services search tags are not supported.
+func WithSpansTableSearch(maxScannedSpans int) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.spansSearchLimit = maxScannedSpans
+	}
+}
+
+// findTraceIDsInSpans finds traces with spans matching search parameters by scanning the spans table
+func (r *TraceReader) findTraceIDsInSpans(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	start, end time.Time,
+	skip []model.TraceID,
+) ([]model.TraceID, error) {
+	span := opentracing.SpanFromContext(ctx)
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf("SELECT model FROM %s WHERE timestamp >= ? AND timestamp <= ?", r.spansTable)
+	args := []interface{}{start, end}
+	if r.multiTenant() {
+		query += " AND tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, r.spansSearchLimit)
+
+	if span != nil {
+		span.SetTag("db.statement", query)
+		span.SetTag("db.args", args)
+	}
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serialized [][]byte
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		serialized = append(serialized, []byte(data))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	spans, err := unmarshalSpans(serialized, r.encoding, r.decodingWorkers)
+	if err != nil {
+		return nil, err
+	}
+	// Process tags are matched like tags of spans
+	if err := r.resolveProcesses(ctx, spans); err != nil {
+		return nil, err
+	}
+
+	found := make(map[model.TraceID]bool, len(skip))
+	for _, traceID := range skip {
+		found[traceID] = true
+	}
+	traceIDs := make([]model.TraceID, 0)
+	for _, span := range spans {
+		if len(skip)+len(traceIDs) >= params.NumTraces {
+			break
+		}
+		if found[span.TraceID] {
+			continue
+		}
+		matches, err := spanMatches(span, params)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			found[span.TraceID] = true
+			traceIDs = append(traceIDs, span.TraceID)
+		}
+	}
+	return traceIDs, nil
+}
+
+// spanMatches tells whether the span matches search parameters like its row in the index table would
+func spanMatches(span *model.Span, params *spanstore.TraceQueryParameters) (bool, error) {
+	if span.Process.ServiceName != params.ServiceName {
+		return false, nil
+	}
+	if params.OperationName != "" && span.OperationName != params.OperationName {
+		return false, nil
+	}
+	// Durations are compared in microseconds like the durationUs column
+	if params.DurationMin != 0 && span.Duration.Microseconds() < params.DurationMin.Microseconds() {
+		return false, nil
+	}
+	if params.DurationMax != 0 && span.Duration.Microseconds() > params.DurationMax.Microseconds() {
+		return false, nil
+	}
+
+	keys, values := uniqueTagsForSpan(span)
+	for key, value := range params.Tags {
+		if key == minSpansTag || key == minServicesTag {
+			continue
+		}
+		if flag, ok := flagTags[key]; ok {
+			set, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return false, fmt.Errorf("%w: %s=%q", errInvalidFlag, key, value)
+			}
+			if span.Flags&flag != 0 != set {
+				return false, nil
+			}
+			continue
+		}
+		if !tagMatches(keys, values, key, value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// tagMatches matches tags of a span like tagCondition matches the tags columns of the index table
+func tagMatches(keys, values []string, key, value string) bool {
+	index := -1
+	for i := range keys {
+		if keys[i] == key {
+			index = i
+			break
+		}
+	}
+	switch {
+	case value == absentTagValue:
+		return index < 0
+	case strings.HasPrefix(value, escapedTagPrefix):
+		value = strings.TrimPrefix(value, `\`)
+	case strings.HasPrefix(value, negatedTagPrefix):
+		return index >= 0 && values[index] != strings.TrimPrefix(value, negatedTagPrefix)
+	}
+	return index >= 0 && values[index] == value
+}
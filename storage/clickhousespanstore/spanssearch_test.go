@@ -0,0 +1,117 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_FindTraceIDsInSpans(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+	newSpan := func(traceID uint64, service, operation string, tags ...model.KeyValue) *model.Span {
+		return &model.Span{
+			TraceID:       model.NewTraceID(0, traceID),
+			SpanID:        model.NewSpanID(traceID),
+			OperationName: operation,
+			StartTime:     start,
+			Duration:      time.Second,
+			Tags:          tags,
+			Process:       model.NewProcess(service, nil),
+		}
+	}
+	spans := []*model.Span{
+		newSpan(1, "frontend", "GET /", model.Int64("http.status_code", 200)),
+		newSpan(2, "backend", "GET /"),
+		newSpan(1, "frontend", "GET /"),
+		newSpan(3, "frontend", "POST /", model.Int64("http.status_code", 200)),
+		newSpan(4, "frontend", "GET /", model.Int64("http.status_code", 500)),
+		newSpan(5, "frontend", "GET /", model.Int64("http.status_code", 200)),
+		newSpan(6, "frontend", "GET /", model.Int64("http.status_code", 200)),
+		newSpan(7, "frontend", "GET /", model.Int64("http.status_code", 200)),
+	}
+	rows := sqlmock.NewRows([]string{"model"})
+	for _, span := range spans {
+		serialized, err := marshalSpan(span, EncodingJSON)
+		require.NoError(t, err)
+		rows.AddRow(serialized)
+	}
+	mock.ExpectQuery(fmt.Sprintf(
+		"SELECT model FROM %s WHERE timestamp >= ? AND timestamp <= ? AND tenant = ? ORDER BY timestamp DESC LIMIT ?",
+		testSpansTable,
+	)).
+		WithArgs(start, end, "tenant_1", 1000).
+		WillReturnRows(rows)
+
+	reader := NewTraceReader(db, testOperationsTable, "", testSpansTable,
+		WithSpansTableSearch(1000), WithReaderTenantHeader("x-tenant"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	traceIDs, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:   "frontend",
+		OperationName: "GET /",
+		Tags:          map[string]string{"http.status_code": "200"},
+		StartTimeMin:  start,
+		StartTimeMax:  end,
+		NumTraces:     3,
+	})
+	require.NoError(t, err)
+	// Traces are found in the order of their newest matching spans, up to the number of traces
+	assert.Equal(t, []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0, 5), model.NewTraceID(0, 6)}, traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanMatches(t *testing.T) {
+	span := &model.Span{
+		OperationName: "GET /",
+		Duration:      time.Second,
+		Flags:         model.SampledFlag,
+		Tags:          []model.KeyValue{model.String("http.method", "GET")},
+		Logs:          []model.Log{{Fields: []model.KeyValue{model.String("event", "retry")}}},
+		Process:       model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "host")}),
+	}
+	tests := map[string]struct {
+		params   spanstore.TraceQueryParameters
+		expected bool
+	}{
+		"service":            {params: spanstore.TraceQueryParameters{ServiceName: "frontend"}, expected: true},
+		"other service":      {params: spanstore.TraceQueryParameters{ServiceName: "backend"}},
+		"other operation":    {params: spanstore.TraceQueryParameters{ServiceName: "frontend", OperationName: "POST /"}},
+		"duration":           {params: spanstore.TraceQueryParameters{ServiceName: "frontend", DurationMin: time.Second, DurationMax: time.Second}, expected: true},
+		"too short":          {params: spanstore.TraceQueryParameters{ServiceName: "frontend", DurationMin: 2 * time.Second}},
+		"too long":           {params: spanstore.TraceQueryParameters{ServiceName: "frontend", DurationMax: time.Millisecond}},
+		"span tag":           {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"http.method": "GET"}}, expected: true},
+		"process tag":        {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"hostname": "host"}}, expected: true},
+		"log field":          {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"event": "retry"}}, expected: true},
+		"other tag value":    {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"http.method": "POST"}}},
+		"negated tag":        {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"http.method": "!POST"}}, expected: true},
+		"absent tag":         {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"error": "!*"}}, expected: true},
+		"present tag":        {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"http.method": "!*"}}},
+		"sampled":            {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{sampledTag: "true"}}, expected: true},
+		"debug":              {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{debugTag: "true"}}},
+		"trace size ignored": {params: spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{minSpansTag: "10"}}, expected: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			matches, err := spanMatches(span, &test.params)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, matches)
+		})
+	}
+
+	_, err := spanMatches(span, &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{debugTag: "maybe"}})
+	assert.ErrorIs(t, err, errInvalidFlag)
+}
@@ -0,0 +1,94 @@
+package clickhousespanstore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	httpStatusCodeTag = "http.status_code"
+	grpcStatusCodeTag = "rpc.grpc.status_code"
+)
+
+// statusCodeTags are tags of status codes with their columns of the index table, in the order the columns are written
+var statusCodeTags = []struct {
+	key    string
+	column string
+}{
+	{key: httpStatusCodeTag, column: httpStatusCodeColumn},
+	{key: grpcStatusCodeTag, column: grpcStatusCodeColumn},
+}
+
+var errInvalidStatusCode = errors.New("status code search tag must be a code, a class like 5xx or a range like 500-504")
+
+// WithWriterStatusCodesIndex writes HTTP and gRPC status codes of spans to the httpStatusCode and grpcStatusCode columns
+// of the index table
+func WithWriterStatusCodesIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexStatusCodes = true
+	}
+}
+
+// WithReaderStatusCodesIndex filters spans by the http.status_code and rpc.grpc.status_code search tags using
+// the status code columns of the index table, the tags may also be classes like 5xx or ranges like 500-504
+func WithReaderStatusCodesIndex() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.statusCodesIndex = true
+	}
+}
+
+// statusCodeValues returns the status codes of the span in the order of statusCodeTags,
+// nil if the span does not have the tag or its value is not a status code
+func statusCodeValues(span *model.Span) []interface{} {
+	values := make([]interface{}, len(statusCodeTags))
+	for i, tag := range statusCodeTags {
+		kv, ok := model.KeyValues(span.Tags).FindByKey(tag.key)
+		if !ok {
+			continue
+		}
+		if code, err := strconv.ParseUint(strings.TrimSpace(kv.AsString()), 10, 16); err == nil {
+			values[i] = int64(code)
+		}
+	}
+	return values
+}
+
+// statusCodeColumn returns the column of the status code search tag
+func statusCodeColumn(key string) (string, bool) {
+	for _, tag := range statusCodeTags {
+		if tag.key == key {
+			return tag.column, true
+		}
+	}
+	return "", false
+}
+
+// statusCodeCondition returns the predicate of the column matching a code, e.g. 404, a class of codes, e.g. 5xx,
+// or an inclusive range of codes, e.g. 500-504
+func statusCodeCondition(column, value string) (string, []interface{}, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) == 3 && strings.HasSuffix(value, "xx") {
+		class, err := strconv.ParseUint(value[:1], 10, 16)
+		if err != nil {
+			return "", nil, errInvalidStatusCode
+		}
+		return fmt.Sprintf(" AND %s >= ? AND %s <= ?", column, column), []interface{}{int64(class * 100), int64(class*100 + 99)}, nil
+	}
+	if separator := strings.Index(value, "-"); separator > 0 {
+		min, minErr := strconv.ParseUint(strings.TrimSpace(value[:separator]), 10, 16)
+		max, maxErr := strconv.ParseUint(strings.TrimSpace(value[separator+1:]), 10, 16)
+		if minErr != nil || maxErr != nil || min > max {
+			return "", nil, errInvalidStatusCode
+		}
+		return fmt.Sprintf(" AND %s >= ? AND %s <= ?", column, column), []interface{}{int64(min), int64(max)}, nil
+	}
+	code, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return "", nil, errInvalidStatusCode
+	}
+	return fmt.Sprintf(" AND %s = ?", column), []interface{}{int64(code)}, nil
+}
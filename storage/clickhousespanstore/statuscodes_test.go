@@ -0,0 +1,59 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCodeValues(t *testing.T) {
+	span := &model.Span{
+		Tags: model.KeyValues{
+			model.String(httpStatusCodeTag, " 200 "),
+			model.Int64(grpcStatusCodeTag, 70000),
+		},
+		Process: &model.Process{Tags: model.KeyValues{model.Int64(grpcStatusCodeTag, 2)}},
+	}
+	assert.Equal(t, []interface{}{int64(200), nil}, statusCodeValues(span))
+	assert.Equal(t, []interface{}{nil, nil}, statusCodeValues(&model.Span{}))
+}
+
+func TestStatusCodeCondition(t *testing.T) {
+	tests := map[string]struct {
+		value             string
+		expectedCondition string
+		expectedArgs      []interface{}
+	}{
+		"code": {
+			value:             "404",
+			expectedCondition: " AND httpStatusCode = ?",
+			expectedArgs:      []interface{}{int64(404)},
+		},
+		"class": {
+			value:             " 4xx ",
+			expectedCondition: " AND httpStatusCode >= ? AND httpStatusCode <= ?",
+			expectedArgs:      []interface{}{int64(400), int64(499)},
+		},
+		"range": {
+			value:             "500 - 504",
+			expectedCondition: " AND httpStatusCode >= ? AND httpStatusCode <= ?",
+			expectedArgs:      []interface{}{int64(500), int64(504)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			condition, args, err := statusCodeCondition(httpStatusCodeColumn, test.value)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCondition, condition)
+			assert.Equal(t, test.expectedArgs, args)
+		})
+	}
+
+	for _, value := range []string{"", "error", "axx", "504-500", "-1", "1-", "70000", "1) OR (1"} {
+		_, _, err := statusCodeCondition(httpStatusCodeColumn, value)
+		assert.ErrorIs(t, err, errInvalidStatusCode, value)
+	}
+}
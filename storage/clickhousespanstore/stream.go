@@ -0,0 +1,114 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+// StreamTraceIDs calls fn with IDs of traces matching the search parameters as they are read, instead of collecting
+// them into a list, for tools processing large results, e.g. exporting all traces of a service from yesterday.
+// The whole time range is searched at once, without ordering, NumTraces limits the number of traces if positive.
+// Streaming stops with the first error returned by fn. fn is called while the search query runs,
+// so the query keeps its slot of the concurrent query limit until streaming ends.
+func (r *TraceReader) StreamTraceIDs(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	fn func(traceID model.TraceID) error,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "StreamTraceIDs")
+	defer span.Finish()
+
+	if params.StartTimeMin.IsZero() {
+		return errStartTimeRequired
+	}
+	if r.indexTable == "" {
+		return errNoIndexTable
+	}
+
+	end := params.StartTimeMax
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	if _, ok := params.Tags[traceIDPrefixTag]; ok {
+		// Trace IDs matching a prefix or linked to a trace are few, they are found at once
+		return r.streamFound(ctx, params, fn)
+	}
+	if _, ok := params.Tags[linkedToTag]; ok && r.linksIndex && r.schema.hasColumn(linkedTraceIDsColumn) {
+		return r.streamFound(ctx, params, fn)
+	}
+
+	filter, args, err := r.searchFilter(ctx, params, params.StartTimeMin, end)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT DISTINCT traceID FROM %s%s", r.indexTable, filter)
+	hiddenCondition, hiddenArgs := r.notHiddenCondition(ctx)
+	query += hiddenCondition
+	args = append(args, hiddenArgs...)
+	if params.NumTraces > 0 {
+		query += " LIMIT ?"
+		args = append(args, params.NumTraces)
+	}
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var traceIDString string
+		if err := rows.Scan(&traceIDString); err != nil {
+			return err
+		}
+		traceID, err := decodeTraceID(traceIDString, r.binaryTraceIDs)
+		if err != nil {
+			return err
+		}
+		if err := fn(traceID); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// streamFound calls fn with IDs of visible traces found by FindTraceIDs
+func (r *TraceReader) streamFound(
+	ctx context.Context,
+	params *spanstore.TraceQueryParameters,
+	fn func(traceID model.TraceID) error,
+) error {
+	traceIDs, err := r.FindTraceIDs(ctx, params)
+	if err != nil {
+		return err
+	}
+	for _, traceID := range traceIDs {
+		if err := fn(traceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notHiddenCondition excludes hidden traces by the query, as they cannot be checked while its rows are read
+func (r *TraceReader) notHiddenCondition(ctx context.Context) (string, []interface{}) {
+	if r.hiddenTable == "" {
+		return "", nil
+	}
+	var args []interface{}
+	hidden := fmt.Sprintf("SELECT traceID FROM %s", r.hiddenTable)
+	if r.multiTenant() {
+		hidden += " WHERE tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	return fmt.Sprintf(" AND traceID NOT IN (%s GROUP BY traceID HAVING argMax(hidden, version) = 1)", hidden), args
+}
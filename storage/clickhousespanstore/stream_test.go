@@ -0,0 +1,86 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_StreamTraceIDs(t *testing.T) {
+	start := time.Unix(1628000000, 0)
+	end := start.Add(24 * time.Hour)
+	params := &spanstore.TraceQueryParameters{ServiceName: "service", StartTimeMin: start, StartTimeMax: end}
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}, {Low: 3}}
+	rows := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"traceID"})
+		for _, traceID := range traceIDs {
+			rows.AddRow(traceID.String())
+		}
+		return rows
+	}
+
+	t.Run("all", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		mock.ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ?"+
+				" AND traceID NOT IN (SELECT traceID FROM %s GROUP BY traceID HAVING argMax(hidden, version) = 1)",
+			testIndexTable, testHiddenTable,
+		)).WithArgs("service", start, end).WillReturnRows(rows())
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithHiddenTraces(testHiddenTable))
+		var streamed []model.TraceID
+		err = reader.StreamTraceIDs(context.Background(), params, func(traceID model.TraceID) error {
+			streamed = append(streamed, traceID)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, traceIDs, streamed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		db, mock, err := mocks.GetDbMock()
+		require.NoError(t, err, "an error was not expected when opening a stub database connection")
+		defer db.Close()
+
+		limited := *params
+		limited.NumTraces = 10
+		mock.ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND timestamp >= ? AND timestamp <= ? LIMIT ?",
+			testIndexTable,
+		)).WithArgs("service", start, end, 10).WillReturnRows(rows())
+
+		reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable)
+		errStop := errors.New("stop")
+		var streamed []model.TraceID
+		err = reader.StreamTraceIDs(context.Background(), &limited, func(traceID model.TraceID) error {
+			streamed = append(streamed, traceID)
+			if len(streamed) == 2 {
+				return errStop
+			}
+			return nil
+		})
+		assert.Equal(t, errStop, err)
+		assert.Equal(t, traceIDs[:2], streamed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("start time required", func(t *testing.T) {
+		reader := NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)
+		err := reader.StreamTraceIDs(context.Background(), &spanstore.TraceQueryParameters{}, func(model.TraceID) error { return nil })
+		assert.Equal(t, errStartTimeRequired, err)
+	})
+}
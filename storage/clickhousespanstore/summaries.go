@@ -0,0 +1,131 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+)
+
+var errNoSummariesTable = errors.New("no trace summaries table supplied")
+
+// TraceSummary is what search results show about a trace without fetching all its spans.
+// The longest span is considered the root span, its service and duration are the ones of the trace.
+// With roots indexed, searched traces have the service and operation of the span without a parent instead.
+type TraceSummary struct {
+	TraceID       model.TraceID
+	SpanCount     uint64
+	StartTime     time.Time
+	Duration      time.Duration
+	RootService   string
+	RootOperation string
+}
+
+// WithTraceSummaries reads trace summaries from the table aggregating the index table
+func WithTraceSummaries(table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.summariesTable = table
+	}
+}
+
+// FindTraceSummaries retrieves summaries of traces matching the search parameters, in the order of FindTraceIDs
+func (r *TraceReader) FindTraceSummaries(ctx context.Context, params *spanstore.TraceQueryParameters) ([]TraceSummary, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceSummaries")
+	defer span.Finish()
+
+	traceIDs, err := r.FindTraceIDs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := r.GetTraceSummaries(ctx, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	end := params.StartTimeMax
+	if end.IsZero() {
+		end = time.Now()
+	}
+	roots, err := r.getRootSpans(ctx, traceIDs, params.StartTimeMin, end)
+	if err != nil {
+		return nil, err
+	}
+	for i, summary := range summaries {
+		if root, ok := roots[summary.TraceID]; ok {
+			summaries[i].RootService = root.service
+			summaries[i].RootOperation = root.operation
+		}
+	}
+	return summaries, nil
+}
+
+// GetTraceSummaries retrieves summaries of the traces in the given order, traces without a summary are skipped
+func (r *TraceReader) GetTraceSummaries(ctx context.Context, traceIDs []model.TraceID) ([]TraceSummary, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTraceSummaries")
+	defer span.Finish()
+
+	if r.summariesTable == "" {
+		return nil, errNoSummariesTable
+	}
+	if len(traceIDs) == 0 {
+		return []TraceSummary{}, nil
+	}
+
+	// A trace crossing midnight has a row per day, rows are merged by the aggregation
+	query := fmt.Sprintf(
+		"SELECT traceID, sum(spans), min(start), max(durationUs), argMaxMerge(rootService) FROM %s WHERE",
+		r.summariesTable,
+	)
+	args := make([]interface{}, 0, len(traceIDs)+1)
+	if r.multiTenant() {
+		query += " tenant = ? AND"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += fmt.Sprintf(" traceID IN (%s) GROUP BY traceID", "?"+strings.Repeat(",?", len(traceIDs)-1))
+	for _, traceID := range traceIDs {
+		args = append(args, traceID.String())
+	}
+
+	span.SetTag("db.statement", query)
+	span.SetTag("db.args", args)
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	summaries := make(map[model.TraceID]TraceSummary, len(traceIDs))
+	for rows.Next() {
+		var (
+			summary       TraceSummary
+			traceIDString string
+			durationUs    uint64
+		)
+		if err := rows.Scan(&traceIDString, &summary.SpanCount, &summary.StartTime, &durationUs, &summary.RootService); err != nil {
+			return nil, err
+		}
+		if summary.TraceID, err = model.TraceIDFromString(traceIDString); err != nil {
+			return nil, err
+		}
+		summary.Duration = time.Duration(durationUs) * time.Microsecond
+		summaries[summary.TraceID] = summary
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ordered := make([]TraceSummary, 0, len(summaries))
+	for _, traceID := range traceIDs {
+		if summary, ok := summaries[traceID]; ok {
+			ordered = append(ordered, summary)
+		}
+	}
+	return ordered, nil
+}
@@ -0,0 +1,71 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testSummariesTable = "test_summaries_table"
+
+func TestTraceReader_GetTraceSummaries(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{{Low: 1}, {Low: 2}, {Low: 3}}
+	start := time.Unix(1628000000, 0)
+	mock.ExpectQuery(
+		"SELECT traceID, sum(spans), min(start), max(durationUs), argMaxMerge(rootService) FROM test_summaries_table"+
+			" WHERE tenant = ? AND traceID IN (?,?,?) GROUP BY traceID",
+	).
+		WithArgs("tenant_1", traceIDs[0].String(), traceIDs[1].String(), traceIDs[2].String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "sum(spans)", "min(start)", "max(durationUs)", "argMaxMerge(rootService)"}).
+			AddRow(traceIDs[2].String(), uint64(3), start, uint64(1500), "frontend").
+			AddRow(traceIDs[0].String(), uint64(10), start, uint64(2000000), "gateway"))
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithReaderTenantHeader("x-tenant"), WithTraceSummaries(testSummariesTable))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	summaries, err := traceReader.GetTraceSummaries(ctx, traceIDs)
+	require.NoError(t, err)
+	assert.Equal(t, []TraceSummary{
+		{TraceID: traceIDs[0], SpanCount: 10, StartTime: start, Duration: 2 * time.Second, RootService: "gateway"},
+		{TraceID: traceIDs[2], SpanCount: 3, StartTime: start, Duration: 1500 * time.Microsecond, RootService: "frontend"},
+	}, summaries, "summaries are in the order of trace IDs, traces without summary are skipped")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_GetTraceSummariesErrors(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{{Low: 1}}
+	_, err = NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable).
+		GetTraceSummaries(context.Background(), traceIDs)
+	assert.ErrorIs(t, err, errNoSummariesTable)
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithTraceSummaries(testSummariesTable))
+	summaries, err := traceReader.GetTraceSummaries(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Empty(t, summaries)
+
+	mock.ExpectQuery(
+		"SELECT traceID, sum(spans), min(start), max(durationUs), argMaxMerge(rootService) FROM test_summaries_table" +
+			" WHERE traceID IN (?) GROUP BY traceID",
+	).
+		WithArgs(traceIDs[0].String()).
+		WillReturnError(errorMock)
+	_, err = traceReader.GetTraceSummaries(context.Background(), traceIDs)
+	assert.ErrorIs(t, err, errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
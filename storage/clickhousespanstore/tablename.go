@@ -1,9 +1,26 @@
 package clickhousespanstore
 
 import (
-	"fmt"
+	"regexp"
+	"strings"
 )
 
+// plainIdentifierPattern matches identifiers inserted into queries as they are, other identifiers are quoted
+var plainIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var identifierEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+
+// QuoteIdentifier returns the name of a database or a table to be inserted into queries: plain names as they are,
+// others, e.g. with dashes, enclosed in backquotes
+func QuoteIdentifier(name string) string {
+	if plainIdentifierPattern.MatchString(name) {
+		return name
+	}
+	return "`" + identifierEscaper.Replace(name) + "`"
+}
+
+// TableName is the name of a table with an optional database. It is formatted quoted, so that it can be inserted
+// into queries and templates of scripts, string(tableName) or Unquoted returns the name as it is.
 type TableName string
 
 func (tableName TableName) ToLocal() TableName {
@@ -11,5 +28,19 @@ func (tableName TableName) ToLocal() TableName {
 }
 
 func (tableName TableName) AddDbName(databaseName string) TableName {
-	return TableName(fmt.Sprintf("%s.%s", databaseName, tableName))
+	return TableName(databaseName + "." + string(tableName))
+}
+
+// String returns the name quoted for queries, the database and the table are quoted separately
+func (tableName TableName) String() string {
+	name := string(tableName)
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		return QuoteIdentifier(name[:dot]) + "." + QuoteIdentifier(name[dot+1:])
+	}
+	return QuoteIdentifier(name)
+}
+
+// Unquoted returns the name as it is, e.g. for string literals of scripts
+func (tableName TableName) Unquoted() string {
+	return string(tableName)
 }
@@ -1,6 +1,7 @@
 package clickhousespanstore
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,3 +16,26 @@ func TestTableName_ToLocal(t *testing.T) {
 	assert.Equal(t, tableName+"_local", tableName.ToLocal())
 
 }
+
+func TestTableName_String(t *testing.T) {
+	tests := map[string]struct {
+		table    TableName
+		expected string
+	}{
+		"plain":          {table: "jaeger_spans_local", expected: "jaeger_spans_local"},
+		"uppercase":      {table: "Jaeger_Spans", expected: "Jaeger_Spans"},
+		"dashes":         {table: "jaeger-spans", expected: "`jaeger-spans`"},
+		"leading digit":  {table: "2021_spans", expected: "`2021_spans`"},
+		"database":       {table: "jaeger-prod.jaeger_spans", expected: "`jaeger-prod`.jaeger_spans"},
+		"backquotes":     {table: "spans` DROP TABLE x", expected: "`spans\\` DROP TABLE x`"},
+		"backslashes":    {table: `spans\`, expected: "`spans\\\\`"},
+		"database added": {table: TableName("jaeger-spans").AddDbName("jaeger-prod"), expected: "`jaeger-prod`.`jaeger-spans`"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.table.String())
+			assert.Equal(t, test.expected, fmt.Sprintf("%s", test.table))
+		})
+	}
+	assert.Equal(t, "jaeger-spans", TableName("jaeger-spans").Unquoted())
+}
@@ -0,0 +1,216 @@
+package clickhousespanstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	tagStatsQueueSize = 1000
+	// maxTagStatsKeys and maxTagStatsValues bound memory used by tags with unbounded keys or values, e.g. IDs
+	maxTagStatsKeys        = 1000
+	maxTagStatsValues      = 100
+	defaultTagStatsLimit   = 50
+	tagStatsReportedValues = 10
+)
+
+// TagStats counts tag keys and values of a sample of written spans in the background, so that operators can decide
+// which tags deserve dedicated columns of the index table. Only the first maxTagStatsKeys keys
+// and maxTagStatsValues values of every key are counted.
+type TagStats struct {
+	sampleRate uint64
+	written    uint64
+	spans      chan *model.Span
+
+	mutex         sync.Mutex
+	sampled       uint64
+	keys          map[string]*tagKeyStats
+	untrackedKeys uint64
+
+	finish chan bool
+	done   sync.WaitGroup
+}
+
+type tagKeyStats struct {
+	count           uint64
+	values          map[string]uint64
+	untrackedValues uint64
+}
+
+// TagStatsReport is the most frequent tag keys of sampled spans
+type TagStatsReport struct {
+	SampledSpans uint64 `json:"sampledSpans"`
+	// Number of occurrences of keys that are not counted, because too many keys were seen
+	UntrackedKeys uint64         `json:"untrackedKeys"`
+	Keys          []TagKeyReport `json:"keys"`
+}
+
+// TagKeyReport is the statistics of a tag key with its most frequent values
+type TagKeyReport struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	// Fraction of sampled spans having the tag
+	Frequency      float64 `json:"frequency"`
+	DistinctValues int     `json:"distinctValues"`
+	// Whether the key has more distinct values than counted
+	ManyValues bool             `json:"manyValues"`
+	TopValues  []TagValueReport `json:"topValues"`
+}
+
+// TagValueReport is a tag value with its number of occurrences
+type TagValueReport struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// WithTagStats samples written spans for the tag statistics
+func WithTagStats(stats *TagStats) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.tagStats = stats
+	}
+}
+
+// NewTagStats returns TagStats counting tags of every sampleRate-th span
+func NewTagStats(sampleRate int) *TagStats {
+	return &TagStats{
+		sampleRate: uint64(sampleRate),
+		spans:      make(chan *model.Span, tagStatsQueueSize),
+		keys:       make(map[string]*tagKeyStats),
+		finish:     make(chan bool),
+	}
+}
+
+// Start counts tags of sampled spans in the background until TagStats is closed
+func (s *TagStats) Start() {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for {
+			select {
+			case <-s.finish:
+				return
+			case span := <-s.spans:
+				s.record(span)
+			}
+		}
+	}()
+}
+
+// Close stops counting tags
+func (s *TagStats) Close() {
+	close(s.finish)
+	s.done.Wait()
+}
+
+// sample queues every sampleRate-th span for counting. It never blocks writes, spans are not sampled if the queue is full.
+func (s *TagStats) sample(span *model.Span) {
+	if s == nil || atomic.AddUint64(&s.written, 1)%s.sampleRate != 0 {
+		return
+	}
+	select {
+	case s.spans <- span:
+	default:
+	}
+}
+
+func (s *TagStats) record(span *model.Span) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sampled++
+	// A key is counted once per span, even if the span and its process have it
+	seen := make(map[string]bool, len(span.Tags))
+	count := func(tags []model.KeyValue) {
+		for _, tag := range tags {
+			if seen[tag.Key] {
+				continue
+			}
+			seen[tag.Key] = true
+			s.recordTag(tag.Key, tag.AsString())
+		}
+	}
+	count(span.Tags)
+	if span.Process != nil {
+		count(span.Process.Tags)
+	}
+}
+
+func (s *TagStats) recordTag(key, value string) {
+	stats, ok := s.keys[key]
+	if !ok {
+		if len(s.keys) >= maxTagStatsKeys {
+			s.untrackedKeys++
+			return
+		}
+		stats = &tagKeyStats{values: make(map[string]uint64)}
+		s.keys[key] = stats
+	}
+	stats.count++
+	if _, ok := stats.values[value]; ok || len(stats.values) < maxTagStatsValues {
+		stats.values[value]++
+	} else {
+		stats.untrackedValues++
+	}
+}
+
+// Report returns up to limit most frequent tag keys with their most frequent values
+func (s *TagStats) Report(limit int) TagStatsReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	report := TagStatsReport{SampledSpans: s.sampled, UntrackedKeys: s.untrackedKeys, Keys: make([]TagKeyReport, 0, len(s.keys))}
+	for key, stats := range s.keys {
+		keyReport := TagKeyReport{
+			Key:            key,
+			Count:          stats.count,
+			Frequency:      float64(stats.count) / float64(s.sampled),
+			DistinctValues: len(stats.values),
+			ManyValues:     stats.untrackedValues > 0,
+			TopValues:      make([]TagValueReport, 0, len(stats.values)),
+		}
+		for value, count := range stats.values {
+			keyReport.TopValues = append(keyReport.TopValues, TagValueReport{Value: value, Count: count})
+		}
+		sort.Slice(keyReport.TopValues, func(i, j int) bool {
+			a, b := keyReport.TopValues[i], keyReport.TopValues[j]
+			return a.Count > b.Count || (a.Count == b.Count && a.Value < b.Value)
+		})
+		if len(keyReport.TopValues) > tagStatsReportedValues {
+			keyReport.TopValues = keyReport.TopValues[:tagStatsReportedValues]
+		}
+		report.Keys = append(report.Keys, keyReport)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Key < b.Key)
+	})
+	if limit > 0 && len(report.Keys) > limit {
+		report.Keys = report.Keys[:limit]
+	}
+	return report
+}
+
+// ServeHTTP returns the report of tag statistics as JSON, the number of keys is set by the limit query parameter
+func (s *TagStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s == nil {
+		http.Error(w, "tag statistics are not enabled", http.StatusNotFound)
+		return
+	}
+	limit := defaultTagStatsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Report(limit))
+}
@@ -0,0 +1,98 @@
+package clickhousespanstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagStats_Report(t *testing.T) {
+	stats := NewTagStats(1)
+	for i := 0; i < 4; i++ {
+		stats.record(&model.Span{
+			Tags: []model.KeyValue{
+				model.String("http.method", []string{"GET", "GET", "POST", "GET"}[i]),
+				model.Int64("http.status_code", 200),
+			},
+			Process: &model.Process{Tags: []model.KeyValue{model.String("http.method", "ignored")}},
+		})
+	}
+	stats.record(&model.Span{Tags: []model.KeyValue{model.Bool("error", true)}})
+
+	assert.Equal(t, TagStatsReport{
+		SampledSpans: 5,
+		Keys: []TagKeyReport{
+			{
+				Key:            "http.method",
+				Count:          4,
+				Frequency:      0.8,
+				DistinctValues: 2,
+				TopValues:      []TagValueReport{{Value: "GET", Count: 3}, {Value: "POST", Count: 1}},
+			},
+			{
+				Key:            "http.status_code",
+				Count:          4,
+				Frequency:      0.8,
+				DistinctValues: 1,
+				TopValues:      []TagValueReport{{Value: "200", Count: 4}},
+			},
+		},
+	}, stats.Report(2))
+}
+
+func TestTagStats_ReportBounded(t *testing.T) {
+	stats := NewTagStats(1)
+	for i := 0; i < maxTagStatsKeys+1; i++ {
+		stats.record(&model.Span{Tags: []model.KeyValue{model.String(fmt.Sprintf("key%d", i), "value")}})
+	}
+	for i := 0; i < maxTagStatsValues+1; i++ {
+		stats.record(&model.Span{Tags: []model.KeyValue{model.String("key0", fmt.Sprintf("value%d", i))}})
+	}
+
+	report := stats.Report(1)
+	assert.Equal(t, uint64(1), report.UntrackedKeys)
+	require.Len(t, report.Keys, 1)
+	assert.Equal(t, "key0", report.Keys[0].Key)
+	assert.Equal(t, maxTagStatsValues, report.Keys[0].DistinctValues)
+	assert.True(t, report.Keys[0].ManyValues)
+	assert.Len(t, report.Keys[0].TopValues, tagStatsReportedValues)
+}
+
+func TestTagStats_sample(t *testing.T) {
+	stats := NewTagStats(2)
+	span := testSpan
+	for i := 0; i < 4; i++ {
+		stats.sample(&span)
+	}
+	assert.Len(t, stats.spans, 2, "every second span is sampled")
+
+	var disabled *TagStats
+	disabled.sample(&span)
+}
+
+func TestTagStats_ServeHTTP(t *testing.T) {
+	stats := NewTagStats(1)
+	stats.record(&model.Span{Tags: []model.KeyValue{model.String("a", "1"), model.String("b", "2")}})
+
+	recorder := httptest.NewRecorder()
+	stats.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/tag-stats?limit=1", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var report TagStatsReport
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Len(t, report.Keys, 1)
+
+	recorder = httptest.NewRecorder()
+	stats.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/tag-stats?limit=none", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var disabled *TagStats
+	recorder = httptest.NewRecorder()
+	disabled.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/tag-stats", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
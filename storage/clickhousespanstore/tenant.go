@@ -0,0 +1,20 @@
+package clickhousespanstore
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TenantFromContext returns the tenant passed in the incoming gRPC metadata under the header key or "" if there is none
+func TenantFromContext(ctx context.Context, header string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(header)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
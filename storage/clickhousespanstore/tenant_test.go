@@ -0,0 +1,33 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+const testTenantHeader = "x-tenant"
+
+func TestTenantFromContext(t *testing.T) {
+	tests := map[string]struct {
+		ctx      context.Context
+		expected string
+	}{
+		"no metadata":    {ctx: context.Background(), expected: ""},
+		"no tenant":      {ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("other", "value")), expected: ""},
+		"tenant":         {ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1")), expected: "tenant_1"},
+		"case of header": {ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("X-Tenant", "tenant_1")), expected: "tenant_1"},
+		"outgoing metadata": {
+			ctx:      metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1")),
+			expected: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, TenantFromContext(test.ctx, testTenantHeader))
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"time"
+)
+
+// QueryTimeouts limit how long methods of TraceReader wait for ClickHouse, so that a hung node does not
+// tie up requests of the query service. A method is not limited if its timeout is 0.
+type QueryTimeouts struct {
+	// GetTrace limits GetTrace
+	GetTrace time.Duration
+	// FindTraces limits FindTraces and FindTraceIDs
+	FindTraces time.Duration
+	// GetServices limits GetServices and GetOperations
+	GetServices time.Duration
+}
+
+// WithQueryTimeouts cancels queries of methods of the reader running longer than their timeouts
+func WithQueryTimeouts(timeouts QueryTimeouts) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.timeouts = timeouts
+	}
+}
+
+// withTimeout returns the context of the request cancelled after the timeout, unless the timeout is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
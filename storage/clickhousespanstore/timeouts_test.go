@@ -0,0 +1,41 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceReader_QueryTimeouts(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		WithQueryTimeouts(QueryTimeouts{GetServices: time.Millisecond * 10}))
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"service"}).AddRow("frontend"))
+	started := time.Now()
+	_, err = traceReader.GetServices(context.Background())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(started), time.Second, "the query is cancelled after the timeout")
+
+	// Other methods are not limited
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(testSpan.TraceID.String()).
+		WillDelayFor(time.Millisecond * 50).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}))
+	_, err = traceReader.GetTrace(context.Background(), testSpan.TraceID)
+	assert.Equal(t, spanstore.ErrTraceNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,155 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	"google.golang.org/grpc/metadata"
+)
+
+// TraceArchiver copies spans of traces from the spans table to the archive table within ClickHouse, so that archiving
+// a trace does not read it through the query service and write it back, and spans keep the encoding they were written in.
+// Traces already in the archive table are not copied again.
+type TraceArchiver struct {
+	db           *sql.DB
+	spansTable   TableName
+	archiveTable TableName
+	tenantHeader string
+	// Whether trace IDs are stored as 16 bytes
+	binaryTraceIDs bool
+	// Whether the priority column is copied
+	samplingPriority bool
+}
+
+// TraceArchiverOption configures optional behaviour of TraceArchiver
+type TraceArchiverOption func(archiver *TraceArchiver)
+
+// WithArchiverTenantHeader copies only spans of the tenant from the header of the request
+func WithArchiverTenantHeader(header string) TraceArchiverOption {
+	return func(archiver *TraceArchiver) {
+		archiver.tenantHeader = header
+	}
+}
+
+// WithArchiverBinaryTraceIDs archives traces whose IDs are stored as 16 bytes
+func WithArchiverBinaryTraceIDs() TraceArchiverOption {
+	return func(archiver *TraceArchiver) {
+		archiver.binaryTraceIDs = true
+	}
+}
+
+// WithArchiverSamplingPriority copies the priority column of spans
+func WithArchiverSamplingPriority() TraceArchiverOption {
+	return func(archiver *TraceArchiver) {
+		archiver.samplingPriority = true
+	}
+}
+
+// NewTraceArchiver returns a TraceArchiver copying traces from the spans table to the archive table
+func NewTraceArchiver(db *sql.DB, spansTable, archiveTable TableName, opts ...TraceArchiverOption) *TraceArchiver {
+	archiver := &TraceArchiver{db: db, spansTable: spansTable, archiveTable: archiveTable}
+	for _, opt := range opts {
+		opt(archiver)
+	}
+	return archiver
+}
+
+// archivedColumns returns columns of the archive table copied from the spans table
+func archivedColumns(multiTenant, samplingPriority bool) []string {
+	columns := []string{"timestamp", "traceID", "model"}
+	if multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	if samplingPriority {
+		columns = append(columns, samplingPriorityColumn)
+	}
+	return columns
+}
+
+// Archive copies spans of the traces to the archive table, unless the traces are archived already
+func (a *TraceArchiver) Archive(ctx context.Context, traceIDs []model.TraceID) error {
+	if len(traceIDs) == 0 {
+		return nil
+	}
+	columns := archivedColumns(a.tenantHeader != "", a.samplingPriority)
+	placeholder := "?"
+	if a.binaryTraceIDs {
+		placeholder = "unhex(?)"
+	}
+	traceIDArgs := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		if a.binaryTraceIDs {
+			traceIDArgs[i] = fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+		} else {
+			traceIDArgs[i] = traceID.String()
+		}
+	}
+	condition := fmt.Sprintf("traceID IN (%s%s)", placeholder, strings.Repeat(", "+placeholder, len(traceIDs)-1))
+	conditionArgs := traceIDArgs
+	if a.tenantHeader != "" {
+		condition += " AND tenant = ?"
+		conditionArgs = append(conditionArgs[:len(conditionArgs):len(conditionArgs)], TenantFromContext(ctx, a.tenantHeader))
+	}
+
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s AND traceID NOT IN (SELECT traceID FROM %s WHERE %s)",
+		a.archiveTable,
+		strings.Join(columns, ", "),
+		strings.Join(columns, ", "),
+		a.spansTable,
+		condition,
+		a.archiveTable,
+		condition,
+	)
+	_, err := a.db.ExecContext(ctx, query, append(conditionArgs, conditionArgs...)...)
+	return err
+}
+
+// ServeHTTP archives traces given by traceID query parameters on POST.
+// The tenant is taken from the HTTP header with the same name as the gRPC metadata key.
+func (a *TraceArchiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a == nil {
+		http.Error(w, "archive is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()["traceID"]
+	if len(values) == 0 {
+		http.Error(w, "traceID is required", http.StatusBadRequest)
+		return
+	}
+	traceIDs := make([]model.TraceID, 0, len(values))
+	for _, value := range values {
+		traceID, err := model.TraceIDFromString(strings.TrimSpace(value))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid traceID %q", value), http.StatusBadRequest)
+			return
+		}
+		traceIDs = append(traceIDs, traceID)
+	}
+
+	ctx := r.Context()
+	if a.tenantHeader != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(a.tenantHeader, r.Header.Get(a.tenantHeader)))
+	}
+	if err := a.Archive(ctx, traceIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := make([]string, len(traceIDs))
+	for i, traceID := range traceIDs {
+		result[i] = traceID.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"traceIDs": result, "archived": true})
+}
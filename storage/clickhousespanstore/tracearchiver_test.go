@@ -0,0 +1,77 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTraceArchiver_Archive(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceIDs := []model.TraceID{model.NewTraceID(0, 1), model.NewTraceID(0x1a, 2)}
+	mock.ExpectExec("INSERT INTO test_archive_table (tenant, timestamp, traceID, model, priority)"+
+		" SELECT tenant, timestamp, traceID, model, priority FROM test_spans_table"+
+		" WHERE traceID IN (unhex(?), unhex(?)) AND tenant = ?"+
+		" AND traceID NOT IN (SELECT traceID FROM test_archive_table WHERE traceID IN (unhex(?), unhex(?)) AND tenant = ?)").
+		WithArgs(
+			"00000000000000000000000000000001", "000000000000001a0000000000000002", "tenant_1",
+			"00000000000000000000000000000001", "000000000000001a0000000000000002", "tenant_1",
+		).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	archiver := NewTraceArchiver(db, testSpansTable, testArchiveTable,
+		WithArchiverTenantHeader("x-tenant"), WithArchiverBinaryTraceIDs(), WithArchiverSamplingPriority())
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "tenant_1"))
+	require.NoError(t, archiver.Archive(ctx, traceIDs))
+	require.NoError(t, archiver.Archive(ctx, nil))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceArchiver_ServeHTTP(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO test_archive_table (timestamp, traceID, model) SELECT timestamp, traceID, model"+
+		" FROM test_spans_table WHERE traceID IN (?)"+
+		" AND traceID NOT IN (SELECT traceID FROM test_archive_table WHERE traceID IN (?))").
+		WithArgs("000000000000001a", "000000000000001a").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	archiver := NewTraceArchiver(db, testSpansTable, testArchiveTable)
+	recorder := httptest.NewRecorder()
+	archiver.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/archive?traceID=1a", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"traceIDs": ["000000000000001a"], "archived": true}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	tests := map[string]struct {
+		archiver *TraceArchiver
+		request  *http.Request
+		code     int
+	}{
+		"disabled":         {archiver: nil, request: httptest.NewRequest(http.MethodPost, "/api/archive?traceID=1", nil), code: http.StatusNotFound},
+		"wrong method":     {archiver: archiver, request: httptest.NewRequest(http.MethodGet, "/api/archive?traceID=1", nil), code: http.StatusMethodNotAllowed},
+		"missing trace ID": {archiver: archiver, request: httptest.NewRequest(http.MethodPost, "/api/archive", nil), code: http.StatusBadRequest},
+		"invalid trace ID": {archiver: archiver, request: httptest.NewRequest(http.MethodPost, "/api/archive?traceID=xyz", nil), code: http.StatusBadRequest},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.archiver.ServeHTTP(recorder, test.request)
+			assert.Equal(t, test.code, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceFetchDuration compares fetching traces from the traces table with fetching them from the spans table
+var traceFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "jaeger_clickhouse_trace_fetch_duration_seconds",
+	Help: "Duration of fetching spans of traces by their IDs, by the table the spans are read from",
+}, []string{"table"})
+
+// WithTracesTable reads traces from the table aggregating spans of every trace into a single row, so that fetching
+// a trace is a lookup of a row per day of the trace instead of a row per span.
+// Traces not found in the table, e.g. written before it was created, are read from the spans table.
+func WithTracesTable(table TableName) TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.tracesTable = table
+	}
+}
+
+// getTraceModels returns serialized spans of the traces from the traces table and the traces not found in it
+func (r *TraceReader) getTraceModels(ctx context.Context, traceIDs []model.TraceID) (storedSpans, []model.TraceID, error) {
+	span := opentracing.SpanFromContext(ctx)
+
+	args := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		args[i] = traceID.String()
+	}
+	// Rows of a trace are not merged until parts are, so models of all its rows are read
+	//nolint:gosec  , G201: SQL string formatting
+	query := fmt.Sprintf("SELECT traceID, arrayJoin(models) FROM %s WHERE traceID IN (%s)", r.tracesTable, "?"+strings.Repeat(",?", len(args)-1))
+	if r.multiTenant() {
+		query += " AND tenant = ?"
+		args = append(args, TenantFromContext(ctx, r.tenantHeader))
+	}
+	query += r.fetchSettings()
+
+	if span != nil {
+		span.SetTag("db.statement", query)
+		span.SetTag("db.args", args)
+	}
+
+	defer observeTraceFetch("traces", time.Now())
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return storedSpans{}, nil, err
+	}
+	defer rows.Close()
+
+	var stored storedSpans
+	found := make(map[string]bool, len(traceIDs))
+	for rows.Next() {
+		var traceID, data string
+		if err := rows.Scan(&traceID, &data); err != nil {
+			return storedSpans{}, nil, err
+		}
+		found[traceID] = true
+		stored.models = append(stored.models, []byte(data))
+		stored.traceIDs = append(stored.traceIDs, traceID)
+	}
+	if err := rows.Err(); err != nil {
+		return storedSpans{}, nil, err
+	}
+
+	var missing []model.TraceID
+	for _, traceID := range traceIDs {
+		if !found[traceID.String()] {
+			missing = append(missing, traceID)
+		}
+	}
+	return stored, missing, nil
+}
+
+// observeTraceFetch observes the duration of fetching traces from the table since start
+func observeTraceFetch(table string, start time.Time) {
+	traceFetchDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,53 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testTracesTable TableName = "test_traces"
+
+func TestTraceReader_GetTraceFromTracesTable(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spans := generateRandomSpans(3)
+	spans[1].TraceID = spans[0].TraceID
+	models := make([]string, len(spans))
+	for i, span := range spans {
+		serialized, err := marshalSpan(span, EncodingJSON)
+		require.NoError(t, err)
+		models[i] = string(serialized)
+	}
+	aggregated, missing := spans[0].TraceID, spans[2].TraceID
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT traceID, arrayJoin(models) FROM %s WHERE traceID IN (?,?)", testTracesTable)).
+		WithArgs(aggregated.String(), missing.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "model"}).
+			AddRow(aggregated.String(), models[0]).
+			AddRow(aggregated.String(), models[1]))
+	// Traces written before the traces table was created are read from the spans table
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansTable)).
+		WithArgs(missing.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(models[2]))
+
+	reader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, WithTracesTable(testTracesTable))
+	traces, err := reader.getTraces(context.Background(), []model.TraceID{aggregated, missing})
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+	require.Len(t, traces[0].Spans, 2)
+	assert.Equal(t, spans[0].SpanID, traces[0].Spans[0].SpanID)
+	assert.Equal(t, spans[1].SpanID, traces[0].Spans[1].SpanID)
+	require.Len(t, traces[1].Spans, 1)
+	assert.Equal(t, spans[2].SpanID, traces[1].Spans[0].SpanID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
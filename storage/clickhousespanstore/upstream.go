@@ -0,0 +1,90 @@
+package clickhousespanstore
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const upstreamColumnsQuery = "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?"
+
+// UpstreamLayout is the layout of existing tables created by releases of jaeger-clickhouse, which differ from
+// tables created by the embedded scripts in columns added later and in types chosen by options
+type UpstreamLayout struct {
+	// OperationsWithoutSpanKind is set if the operations table has no spankind column,
+	// as created by releases storing only names of operations
+	OperationsWithoutSpanKind bool
+	// StringTraceIDs is set if the spans table stores trace IDs as hexadecimal strings
+	StringTraceIDs bool
+	// Tenants is set if the index table has the tenant column of multi tenant tables
+	Tenants bool
+}
+
+// DetectUpstreamLayout looks up columns of the operations, index and spans tables of the current database,
+// a table is skipped if its name is empty
+func DetectUpstreamLayout(db *sql.DB, operationsTable, indexTable, spansTable TableName) (UpstreamLayout, error) {
+	var layout UpstreamLayout
+	if operationsTable != "" {
+		columns, err := tableColumns(db, operationsTable)
+		if err != nil {
+			return layout, err
+		}
+		_, ok := columns["spankind"]
+		layout.OperationsWithoutSpanKind = !ok
+	}
+	if indexTable != "" {
+		columns, err := tableColumns(db, indexTable)
+		if err != nil {
+			return layout, err
+		}
+		_, layout.Tenants = columns["tenant"]
+	}
+	if spansTable != "" {
+		columns, err := tableColumns(db, spansTable)
+		if err != nil {
+			return layout, err
+		}
+		layout.StringTraceIDs = columns["traceID"] == "String"
+	}
+	return layout, nil
+}
+
+// tableColumns returns types of columns of the table by their names
+func tableColumns(db *sql.DB, table TableName) (map[string]string, error) {
+	rows, err := db.Query(upstreamColumnsQuery, string(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+		columns[name] = columnType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	return columns, nil
+}
+
+// WithWriterOperationsWithoutSpanKind writes operations to an operations table without the spankind column,
+// spans of an operation are counted together regardless of their span kinds
+func WithWriterOperationsWithoutSpanKind() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.operationsWithoutSpanKind = true
+	}
+}
+
+// WithReaderOperationsWithoutSpanKind reads operations from an operations table without the spankind column,
+// operations are returned without span kinds
+func WithReaderOperationsWithoutSpanKind() TraceReaderOption {
+	return func(reader *TraceReader) {
+		reader.operationsWithoutSpanKind = true
+	}
+}
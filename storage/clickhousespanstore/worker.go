@@ -1,71 +1,63 @@
 package clickhousespanstore
 
 import (
-	"encoding/json"
 	"fmt"
 	"sort"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
-
 	"github.com/jaegertracing/jaeger/model"
 )
 
 var delays = []int{2, 3, 5, 8}
 
 // WriteWorker writes spans to CLickHouse.
-// Given a batch of spans, WriteWorker attempts to write them to database.
+// Given a batch of spans, WriteWorker attempts to write them to database until it succeeds or the worker is stopped.
 // Interval in seconds between attempts changes due to delays slice, then it remains the same as the last value in delays.
 type WriteWorker struct {
 	params *WriteParams
-
-	counter    *int
-	mutex      *sync.Mutex
-	finish     chan bool
-	workerDone chan *WriteWorker
-	done       sync.WaitGroup
+	tenant string
+	// pending tracks spans of the batch until they are written or dropped
+	pending *pendingBatch
+
+	// insertedAt is the insert time of index rows of the batch, the same for all attempts, so that blocks of retries
+	// are deduplicated
+	insertedAt time.Time
+
+	// pool is notified when the worker finishes, size is the number of spans of its batch
+	pool   *WriteWorkerPool
+	size   int
+	finish chan bool
 }
 
 func (worker *WriteWorker) Work(
 	batch []*model.Span,
 ) {
-	worker.done.Add(1)
-	worker.mutex.Lock()
-	*worker.counter += len(batch)
-	worker.mutex.Unlock()
+	defer worker.close()
 
-	defer worker.done.Done()
-
-	// TODO: look for specific error(connection refused | database error)
-	if err := worker.writeBatch(batch); err != nil {
-		worker.params.logger.Error("Could not write a batch of spans", "error", err)
-	} else {
-		worker.close(len(batch))
-		return
-	}
+	worker.insertedAt = time.Now()
 	attempt := 0
 	for {
-		currentDelay := worker.getCurrentDelay(&attempt, worker.params.delay)
-		timer := time.After(currentDelay)
+		// TODO: look for specific error(connection refused | database error)
+		err := worker.writeBatch(batch)
+		if err == nil {
+			return
+		}
+		worker.params.logger.Error("Could not write a batch of spans", "error", err)
+		worker.params.health.failed(time.Now())
+
 		select {
 		case <-worker.finish:
-			worker.close(len(batch))
+			worker.params.logger.Error("Dropped a batch of spans that could not be written", "size", len(batch))
 			return
-		case <-timer:
-			if err := worker.writeBatch(batch); err != nil {
-				worker.params.logger.Error("Could not write a batch of spans", "error", err)
-			} else {
-				worker.close(len(batch))
-				return
-			}
+		case <-time.After(worker.getCurrentDelay(&attempt, worker.params.delay)):
 		}
 	}
 }
 
-func (worker *WriteWorker) CLose() {
-	worker.finish <- true
-	worker.done.Wait()
+// stop stops retries of the batch, a write in progress is finished first
+func (worker *WriteWorker) stop() {
+	close(worker.finish)
 }
 
 func (worker *WriteWorker) getCurrentDelay(attempt *int, delay time.Duration) time.Duration {
@@ -75,21 +67,62 @@ func (worker *WriteWorker) getCurrentDelay(attempt *int, delay time.Duration) ti
 	return time.Duration(int64(delays[*attempt-1]) * delay.Nanoseconds())
 }
 
-func (worker *WriteWorker) close(batchSize int) {
-	worker.mutex.Lock()
-	*worker.counter -= batchSize
-	worker.mutex.Unlock()
-	worker.workerDone <- worker
+func (worker *WriteWorker) close() {
+	worker.params.health.release(worker.pending)
+	worker.pool.remove(worker)
 }
 
 func (worker *WriteWorker) writeBatch(batch []*model.Span) error {
+	start := time.Now()
+	err := worker.insertBatch(batch)
+	worker.params.shedder.observe(err, time.Since(start))
+	return err
+}
+
+func (worker *WriteWorker) insertBatch(batch []*model.Span) error {
 	worker.params.logger.Debug("Writing spans", "size", len(batch))
-	if err := worker.writeModelBatch(batch); err != nil {
+	if len(worker.params.batchOrder) > 0 && worker.params.indexTable != "" {
+		sortBatch(batch, worker.params.batchOrder)
+	}
+	// Processes are written first, so that spans are never read before their processes
+	if worker.params.processes != nil {
+		if err := worker.writeProcessesBatch(batch); err != nil {
+			return err
+		}
+	}
+	if rotation := worker.params.rotation; rotation != nil {
+		for suffix, spans := range rotation.split(batch) {
+			if err := rotation.ensureTables(suffix); err != nil {
+				return err
+			}
+			params := *worker.params
+			params.spansTable = rotation.Table(params.spansTable, suffix)
+			if params.indexTable != "" {
+				params.indexTable = rotation.Table(params.indexTable, suffix)
+			}
+			periodWorker := &WriteWorker{params: &params, tenant: worker.tenant, insertedAt: worker.insertedAt}
+			if err := periodWorker.insertSpans(spans); err != nil {
+				return err
+			}
+		}
+	} else if err := worker.insertSpans(batch); err != nil {
 		return err
 	}
 
-	if worker.params.indexTable != "" {
-		if err := worker.writeIndexBatch(batch); err != nil {
+	if worker.params.callsTable != "" {
+		if err := worker.writeCallsBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	if worker.params.operationsTable != "" {
+		if err := worker.writeOperationsBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	if worker.params.spanLogsTable != "" {
+		if err := worker.writeSpanLogsBatch(batch); err != nil {
 			return err
 		}
 	}
@@ -97,7 +130,22 @@ func (worker *WriteWorker) writeBatch(batch []*model.Span) error {
 	return nil
 }
 
+// insertSpans writes spans and their index, unless the index is written by a materialized view from the spans table
+func (worker *WriteWorker) insertSpans(batch []*model.Span) error {
+	if err := worker.writeModelBatch(batch); err != nil {
+		return err
+	}
+	if worker.params.indexTable != "" && !worker.params.indexFromSpans {
+		return worker.writeIndexBatch(batch)
+	}
+	return nil
+}
+
 func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
+	if worker.params.rowBinary != nil && !worker.params.indexFromSpans {
+		return worker.writeModelBatchRowBinary(batch)
+	}
+	ctx, observe := worker.startInsert(insertedSpans)
 	tx, err := worker.params.db.Begin()
 	if err != nil {
 		return err
@@ -112,7 +160,26 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 		}
 	}()
 
-	statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) VALUES (?, ?, ?)", worker.params.spansTable))
+	columns := []string{"timestamp", "traceID", "model"}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	if worker.params.samplingPriority {
+		columns = append(columns, samplingPriorityColumn)
+	}
+	var indexValues func(span *model.Span) []interface{}
+	if worker.params.indexFromSpans {
+		var indexColumns []string
+		indexColumns, indexValues = worker.indexColumns(false)
+		columns = append(columns, indexColumns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		worker.params.spansTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.PrepareContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -120,19 +187,22 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 	defer statement.Close()
 
 	for _, span := range batch {
-		var serialized []byte
-
-		if worker.params.encoding == EncodingJSON {
-			serialized, err = json.Marshal(span)
-		} else {
-			serialized, err = proto.Marshal(span)
-		}
-
+		serialized, err := worker.marshalStoredSpan(span)
 		if err != nil {
 			return err
 		}
 
-		_, err = statement.Exec(span.StartTime, span.TraceID.String(), serialized)
+		args := []interface{}{span.StartTime, encodeTraceID(span.TraceID, worker.params.binaryTraceIDs), serialized}
+		if worker.params.multiTenant {
+			args = append([]interface{}{worker.tenant}, args...)
+		}
+		if worker.params.samplingPriority {
+			args = append(args, samplingPriority(span))
+		}
+		if indexValues != nil {
+			args = append(args, indexValues(span)...)
+		}
+		_, err = statement.Exec(args...)
 		if err != nil {
 			return err
 		}
@@ -140,10 +210,11 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 
 	committed = true
 
-	return tx.Commit()
+	return observe(tx.Commit())
 }
 
 func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
+	ctx, observe := worker.startInsert(insertedIndex)
 	tx, err := worker.params.db.Begin()
 	if err != nil {
 		return err
@@ -158,11 +229,19 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 		}
 	}()
 
-	statement, err := tx.Prepare(
-		fmt.Sprintf(
-			"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?)",
-			worker.params.indexTable,
-		))
+	columns := []string{"timestamp", "traceID"}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	indexColumns, indexValues := worker.indexColumns(worker.params.samplingPriority)
+	columns = append(columns, indexColumns...)
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		worker.params.indexTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.PrepareContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -170,16 +249,161 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 	defer statement.Close()
 
 	for _, span := range batch {
+		args := []interface{}{span.StartTime, encodeTraceID(span.TraceID, worker.params.binaryTraceIDs)}
+		if worker.params.multiTenant {
+			args = append([]interface{}{worker.tenant}, args...)
+		}
+		args = append(args, indexValues(span)...)
+		_, err = statement.Exec(args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	committed = true
+
+	return observe(tx.Commit())
+}
+
+// indexColumns returns columns of the index following timestamp and traceID and a function returning their values
+// for a span. Optional columns found missing are skipped, the priority column is included only if withPriority.
+func (worker *WriteWorker) indexColumns(withPriority bool) ([]string, func(span *model.Span) []interface{}) {
+	schema := worker.params.schema
+	indexFlags := worker.params.indexFlags && schema.hasColumn(flagsColumn)
+	indexLinks := worker.params.indexLinks && schema.hasColumn(linkedTraceIDsColumn)
+	indexStatusCodes := worker.params.indexStatusCodes &&
+		schema.hasColumn(httpStatusCodeColumn) && schema.hasColumn(grpcStatusCodeColumn)
+	indexSpanKind := worker.params.indexSpanKind && schema.hasColumn(spanKindColumn)
+	indexRoots := worker.params.indexRoots && schema.hasColumn(isRootColumn)
+	indexInsertTime := worker.params.indexInsertTime && schema.hasColumn(insertedAtColumn)
+	insertedAt := worker.insertedAt
+	if insertedAt.IsZero() {
+		insertedAt = time.Now()
+	}
+	extractedTags := make([]ExtractedTag, 0, len(worker.params.extractedTags))
+	for _, tag := range worker.params.extractedTags {
+		if schema.hasColumn(tag.Column()) {
+			extractedTags = append(extractedTags, tag)
+		}
+	}
+
+	columns := []string{"service", "operation", "durationUs"}
+	if indexFlags {
+		columns = append(columns, flagsColumn)
+	}
+	if indexLinks {
+		columns = append(columns, linkedTraceIDsColumn)
+	}
+	if indexStatusCodes {
+		columns = append(columns, httpStatusCodeColumn, grpcStatusCodeColumn)
+	}
+	if indexSpanKind {
+		columns = append(columns, spanKindColumn)
+	}
+	if indexRoots {
+		columns = append(columns, isRootColumn)
+	}
+	if indexInsertTime {
+		columns = append(columns, insertedAtColumn)
+	}
+	if withPriority {
+		columns = append(columns, samplingPriorityColumn)
+	}
+	for _, tag := range extractedTags {
+		columns = append(columns, tag.Column())
+	}
+	columns = append(columns, "tags.key", "tags.value")
+
+	return columns, func(span *model.Span) []interface{} {
 		keys, values := uniqueTagsForSpan(span)
-		_, err = statement.Exec(
+		args := []interface{}{
+			span.Process.ServiceName,
+			span.OperationName,
+			span.Duration.Microseconds(),
+		}
+		if indexFlags {
+			args = append(args, int64(span.Flags))
+		}
+		if indexLinks {
+			args = append(args, linkedTraceIDs(span))
+		}
+		if indexStatusCodes {
+			args = append(args, statusCodeValues(span)...)
+		}
+		if indexSpanKind {
+			args = append(args, spanKindValue(span))
+		}
+		if indexRoots {
+			args = append(args, isRootValue(span))
+		}
+		if indexInsertTime {
+			args = append(args, insertedAt)
+		}
+		if withPriority {
+			args = append(args, samplingPriority(span))
+		}
+		if len(extractedTags) > 0 {
+			args = append(args, extractedTagValues(span, extractedTags)...)
+		}
+		return append(args, keys, values)
+	}
+}
+
+func (worker *WriteWorker) writeCallsBatch(batch []*model.Span) error {
+	ctx, observe := worker.startInsert(insertedCalls)
+	tx, err := worker.params.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	defer func() {
+		if !committed {
+			// Clickhouse does not support real rollback
+			_ = tx.Rollback()
+		}
+	}()
+
+	columns := []string{"timestamp", "traceID", "spanID", "parentSpanID", "service", "operation", "error"}
+	if worker.params.multiTenant {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (?%s)",
+		worker.params.callsTable,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+	statement, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	for _, span := range batch {
+		var parentSpanID string
+		if parent := span.ParentSpanID(); parent != 0 {
+			parentSpanID = parent.String()
+		}
+		var spanError int64
+		if hasError(span) {
+			spanError = 1
+		}
+		args := []interface{}{
 			span.StartTime,
 			span.TraceID.String(),
+			span.SpanID.String(),
+			parentSpanID,
 			span.Process.ServiceName,
 			span.OperationName,
-			span.Duration.Microseconds(),
-			keys,
-			values,
-		)
+			spanError,
+		}
+		if worker.params.multiTenant {
+			args = append([]interface{}{worker.tenant}, args...)
+		}
+		_, err = statement.Exec(args...)
 		if err != nil {
 			return err
 		}
@@ -187,7 +411,17 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 
 	committed = true
 
-	return tx.Commit()
+	return observe(tx.Commit())
+}
+
+// hasError returns whether the span is tagged as failed by the error tag
+func hasError(span *model.Span) bool {
+	for _, tag := range span.Tags {
+		if tag.Key == "error" {
+			return tag.AsString() == "true"
+		}
+	}
+	return false
 }
 
 type kvArray []*model.KeyValue
@@ -210,6 +444,25 @@ func (arr kvArray) Less(i, j int) bool {
 	return arr[i].Key < arr[j].Key || (arr[i].Key == arr[j].Key && arr[i].AsString() < arr[j].AsString())
 }
 
+// linkedTraceIDs returns IDs of other traces the span references, e.g. by follows-from references of batch jobs
+func linkedTraceIDs(span *model.Span) []string {
+	linked := make([]string, 0)
+	for _, ref := range span.References {
+		if ref.TraceID == span.TraceID {
+			continue
+		}
+		traceID := ref.TraceID.String()
+		duplicate := false
+		for _, seen := range linked {
+			duplicate = duplicate || seen == traceID
+		}
+		if !duplicate {
+			linked = append(linked, traceID)
+		}
+	}
+	return linked
+}
+
 func uniqueTagsForSpan(span *model.Span) (keys, values []string) {
 	uniqueTags := make(map[string]*model.KeyValue, len(span.Tags)+len(span.Process.Tags))
 
@@ -376,7 +376,6 @@ func getWriteWorker(spyLogger mocks.SpyLogger, db *sql.DB, encoding Encoding, in
 			indexTable: indexTable,
 			encoding:   encoding,
 		},
-		workerDone: make(chan *WriteWorker),
 	}
 }
 
@@ -404,6 +403,8 @@ func generateRandomSpan() model.Span {
 		Tags:          generateRandomKeyValues(testTagCount),
 		Logs:          generateRandomLogs(),
 		Duration:      time.Unix(rand.Int63n(1<<32), 0).Sub(time.Unix(0, 0)),
+		Flags:         model.Flags(rand.Uint32()),
+		Warnings:      []string{"warning" + strconv.FormatUint(rand.Uint64(), 10)},
 	}
 	return span
 }
@@ -443,3 +444,388 @@ func getModelWriteExpectation(spanJSON []byte) expectation {
 		}},
 	}
 }
+
+func TestSpanWriter_MultiTenant(t *testing.T) {
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	tenant := "tenant_1"
+	expectations := []expectation{
+		{
+			preparation: fmt.Sprintf("INSERT INTO %s (tenant, timestamp, traceID, model) VALUES (?, ?, ?, ?)", testSpansTable),
+			execArgs:    [][]driver.Value{{tenant, testSpan.StartTime, testSpan.TraceID.String(), spanJSON}},
+		},
+		{
+			preparation: fmt.Sprintf(
+				"INSERT INTO %s (tenant, timestamp, traceID, service, operation, durationUs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				testIndexTable,
+			),
+			execArgs: [][]driver.Value{append([]driver.Value{tenant}, indexWriteExpectation.execArgs[0]...)},
+		},
+	}
+
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.multiTenant = true
+	worker.tenant = tenant
+
+	for _, expectation := range expectations {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	assert.NoError(t, worker.writeBatch(testSpans))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Debug, writeBatchLogs)
+}
+
+func TestSpanWriter_TableRotation(t *testing.T) {
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	tenant := "tenant_1"
+	expectations := []expectation{
+		{
+			preparation: fmt.Sprintf("INSERT INTO %s_201003 (tenant, timestamp, traceID, model) VALUES (?, ?, ?, ?)", testSpansTable),
+			execArgs:    [][]driver.Value{{tenant, testSpan.StartTime, testSpan.TraceID.String(), spanJSON}},
+		},
+		{
+			preparation: fmt.Sprintf(
+				"INSERT INTO %s_201003 (tenant, timestamp, traceID, service, operation, durationUs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				testIndexTable,
+			),
+			execArgs: [][]driver.Value{append([]driver.Value{tenant}, indexWriteExpectation.execArgs[0]...)},
+		},
+	}
+
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	var created []string
+	rotation, err := NewTableRotation(RotationMonthly, func(suffix string) error {
+		created = append(created, suffix)
+		return nil
+	})
+	require.NoError(t, err)
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.multiTenant = true
+	worker.params.rotation = rotation
+	worker.tenant = tenant
+
+	for _, expectation := range expectations {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	assert.NoError(t, worker.writeBatch(testSpans))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []string{"201003"}, created)
+	assert.Equal(t, TableName(testSpansTable), worker.params.spansTable, "tables of the worker are not changed")
+}
+
+func TestSpanWriter_FlagsIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexFlags = true
+
+	span := testSpan
+	span.Flags = model.SampledFlag | model.DebugFlag
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, flags, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(append(args[:5:5], int64(3)), args[5:]...)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_IndexFromSpans(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexFromSpans = true
+	worker.params.indexFlags = true
+	worker.params.samplingPriority = true
+
+	span := testSpan
+	span.Flags = model.SampledFlag
+	spanJSON, err := json.Marshal(&span)
+	require.NoError(t, err)
+	keys, values := uniqueTagsForSpan(&span)
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, model, priority, service, operation, durationUs, flags, tags.key, tags.value)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		testSpansTable,
+	)).
+		ExpectExec().
+		WithArgs(
+			span.StartTime, span.TraceID.String(), spanJSON, int64(0),
+			span.Process.ServiceName, span.OperationName, span.Duration.Microseconds(), int64(1), keys, values,
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeBatch([]*model.Span{&span}), "the index is not written by the worker")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_BinaryTraceIDs(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexFromSpans = true
+	worker.params.binaryTraceIDs = true
+
+	span := testSpan
+	span.TraceID = model.NewTraceID(0, 1)
+	spanJSON, err := json.Marshal(&span)
+	require.NoError(t, err)
+	keys, values := uniqueTagsForSpan(&span)
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, model, service, operation, durationUs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testSpansTable,
+	)).
+		ExpectExec().
+		WithArgs(
+			span.StartTime, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01", spanJSON,
+			span.Process.ServiceName, span.OperationName, span.Duration.Microseconds(), keys, values,
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_LinksIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexLinks = true
+
+	span := testSpan
+	span.References = []model.SpanRef{
+		model.NewChildOfRef(span.TraceID, 1),
+		model.NewFollowsFromRef(model.TraceID{Low: 0xabc}, 2),
+		model.NewFollowsFromRef(model.TraceID{Low: 0xabc}, 3),
+		model.NewFollowsFromRef(model.TraceID{High: 3, Low: 4}, 4),
+	}
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, linkedTraceIDs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(append(args[:5:5], []string{"0000000000000abc", "00000000000000030000000000000004"}), args[5:]...)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_StatusCodesIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexStatusCodes = true
+
+	span := testSpan
+	span.Tags = append(model.KeyValues{model.Int64(httpStatusCodeTag, 503)}, span.Tags...)
+	keys, values := uniqueTagsForSpan(&span)
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, httpStatusCode, grpcStatusCode, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(args[:5:5], int64(503), nil, keys, values)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_SpanKindIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.indexSpanKind = true
+
+	span := testSpan
+	span.Tags = append(model.KeyValues{model.String(spanKindTag, "Server")}, span.Tags...)
+	keys, values := uniqueTagsForSpan(&span)
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, spanKind, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(args[:5:5], "server", keys, values)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&span}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_ExtractedTags(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.extractedTags = []ExtractedTag{
+		{Key: "test_int64_key", Type: "UInt8"},
+		{Key: "test_process_key", Type: "String"},
+		{Key: "test_string_key", Type: "Int32"},
+		{Key: "missing_key", Type: "Float64"},
+	}
+
+	args := indexWriteExpectation.execArgs[0]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf(
+		"INSERT INTO %s (timestamp, traceID, service, operation, durationUs, "+
+			"tag_test_int64_key, tag_test_process_key, tag_test_string_key, tag_missing_key, tags.key, tags.value) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		testIndexTable,
+	)).
+		ExpectExec().
+		WithArgs(append(append(args[:5:5], uint64(4), "test_process_value", nil, nil), args[5:]...)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeIndexBatch([]*model.Span{&testSpan}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_OperationsBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.operationsTable = "test_operations_table"
+
+	server := testSpan
+	server.Tags = []model.KeyValue{model.String(spanKindTag, "server")}
+	nextDay := testSpan
+	nextDay.StartTime = testSpan.StartTime.Add(24 * time.Hour)
+	start := testSpan.StartTime.UTC()
+	date := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(
+		"INSERT INTO test_operations_table (date, service, operation, count, spankind) VALUES (?, ?, ?, ?, ?)",
+	)
+	prep.ExpectExec().
+		WithArgs(date, "test_service", testSpan.OperationName, int64(2), "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().
+		WithArgs(date, "test_service", testSpan.OperationName, int64(1), "server").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().
+		WithArgs(date.AddDate(0, 0, 1), "test_service", testSpan.OperationName, int64(1), "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeOperationsBatch([]*model.Span{&testSpan, &server, &nextDay, &testSpan}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_OperationsBatchWithoutSpanKind(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.operationsTable = "test_operations_table"
+	worker.params.operationsWithoutSpanKind = true
+
+	server := testSpan
+	server.Tags = []model.KeyValue{model.String(spanKindTag, "server")}
+	start := testSpan.StartTime.UTC()
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO test_operations_table (date, service, operation, count) VALUES (?, ?, ?, ?)").
+		ExpectExec().
+		WithArgs(time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC), "test_service", testSpan.OperationName, int64(2)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeOperationsBatch([]*model.Span{&testSpan, &server}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_CallsBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spyLogger := mocks.NewSpyLogger()
+	worker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable)
+	worker.params.callsTable = "test_calls_table"
+
+	child := testSpan
+	child.SpanID = model.NewSpanID(4)
+	child.References = []model.SpanRef{model.NewChildOfRef(testSpan.TraceID, testSpan.SpanID)}
+	child.Tags = []model.KeyValue{model.Bool("error", true)}
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(
+		"INSERT INTO test_calls_table (timestamp, traceID, spanID, parentSpanID, service, operation, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	)
+	prep.ExpectExec().
+		WithArgs(testSpan.StartTime, testSpan.TraceID.String(), testSpan.SpanID.String(), "", "test_service", testSpan.OperationName, int64(0)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().
+		WithArgs(child.StartTime, child.TraceID.String(), child.SpanID.String(), testSpan.SpanID.String(), "test_service", child.OperationName, int64(1)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, worker.writeCallsBatch([]*model.Span{&testSpan, &child}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
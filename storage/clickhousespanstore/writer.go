@@ -3,6 +3,7 @@ package clickhousespanstore
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"sync"
 	"time"
 
@@ -15,6 +16,9 @@ import (
 
 type Encoding string
 
+// ErrQueueFull is returned by WriteSpan when the queue of the writer is full, e.g. because writes fall behind
+var ErrQueueFull = errors.New("queue of spans waiting for a batch is full")
+
 const (
 	// EncodingJSON is used for spans encoded as JSON.
 	EncodingJSON Encoding = "json"
@@ -31,16 +35,125 @@ var (
 		Name: "jaeger_clickhouse_writes_with_flush_interval_total",
 		Help: "Number of clickhouse writes due to flush interval criteria",
 	})
+	numWritesWithBatchBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_writes_with_batch_bytes_total",
+		Help: "Number of clickhouse writes due to batch bytes criteria",
+	})
+	queuedSpans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_queued_spans",
+		Help: "Number of spans queued for the batch of the writer, by the table the writer writes spans to",
+	}, []string{"table"})
+	batchedSpans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_batched_spans",
+		Help: "Number of spans in the batch of the writer waiting to be flushed, by the table the writer writes spans to",
+	}, []string{"table"})
+	spanQueueDelay = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_span_queue_delay_seconds",
+		Help:    "Time spans wait in the queue of the writer until they are added to a batch, by the table the writer writes spans to",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"table"})
+	numRejectedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_rejected_spans_total",
+		Help: "Number of spans rejected because the queue of the writer was full, by the table the writer writes spans to",
+	}, []string{"table"})
 )
 
 // SpanWriter for writing spans to ClickHouse
 type SpanWriter struct {
 	writeParams WriteParams
 
-	size   int64
-	spans  chan *model.Span
-	finish chan bool
-	done   sync.WaitGroup
+	size          int64
+	queueSize     int64
+	maxBytes      int64
+	tenantHeader  string
+	clockSkew     clockSkew
+	serviceNames  *ServiceNameNormalizer
+	serviceFilter *ServiceFilter
+	quotas        *ByteQuotas
+	pruner        *SpanPruner
+	tagStats      *TagStats
+	partsMonitor  *PartsMonitor
+	autoArchiver  *AutoArchiver
+	criticalPaths *CriticalPathAnalyzer
+	latency       *LatencyHistogram
+	alarms        BufferAlarms
+	spans         chan tenantSpan
+	finish        chan bool
+	done          sync.WaitGroup
+}
+
+type tenantSpan struct {
+	tenant string
+	span   *model.Span
+	// bytes is the estimated serialized size of the span
+	bytes int64
+	// accepted is when the writer accepted the span
+	accepted time.Time
+}
+
+// SpanWriterOption configures optional behaviour of SpanWriter
+type SpanWriterOption func(writer *SpanWriter)
+
+// WithMaxBatchBytes flushes a batch before its estimated serialized size exceeds maxBytes. Zero disables the limit.
+func WithMaxBatchBytes(maxBytes int64) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.maxBytes = maxBytes
+	}
+}
+
+// WithQueueSize sets the maximal number of spans waiting to be added to a batch, WriteSpan rejects spans
+// when it is reached. It is never less than the batch size.
+func WithQueueSize(size int64) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.queueSize = size
+	}
+}
+
+// WithWriterTenantHeader stores every span with the tenant from the gRPC metadata key header of the write request
+func WithWriterTenantHeader(header string) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.tenantHeader = header
+		writer.writeParams.multiTenant = true
+	}
+}
+
+// WithWriterFlagsIndex writes span flags to the flags column of the index table
+func WithWriterFlagsIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexFlags = true
+	}
+}
+
+// WithWriterLinksIndex writes IDs of other traces referenced by spans to the linkedTraceIDs column of the index table
+func WithWriterLinksIndex() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexLinks = true
+	}
+}
+
+// WithSortedBatches sorts spans of every batch by the expressions of the sort key of the index table, by default
+// service and descending start time, so that inserted blocks are already sorted by its key. Batches are per tenant,
+// so the tenant does not need sorting. Spans are sorted up to the first expression other than service, operation,
+// traceID, durationUs, timestamp and toUnixTimestamp(timestamp), each optionally negated for descending order.
+func WithSortedBatches(orderBy ...string) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.batchOrder = batchOrder(orderBy)
+	}
+}
+
+// WithIndexFromSpans writes columns of the index to the spans table instead of writing the index table,
+// so that spans are inserted once and the index is written by a materialized view from the spans table
+func WithIndexFromSpans() SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.indexFromSpans = true
+	}
+}
+
+// WithCallsTable writes a call of every span to its parent to the table, so that dependencies can be computed
+func WithCallsTable(table TableName) SpanWriterOption {
+	return func(writer *SpanWriter) {
+		writer.writeParams.callsTable = table
+	}
 }
 
 var registerMetrics sync.Once
@@ -56,6 +169,7 @@ func NewSpanWriter(
 	delay time.Duration,
 	size int64,
 	maxSpanCount int,
+	opts ...SpanWriterOption,
 ) *SpanWriter {
 	writer := &SpanWriter{
 		writeParams: WriteParams{
@@ -66,12 +180,21 @@ func NewSpanWriter(
 			encoding:   encoding,
 			delay:      delay,
 		},
-		size:   size,
-		spans:  make(chan *model.Span, size),
-		finish: make(chan bool),
+		size:      size,
+		queueSize: size,
+		finish:    make(chan bool),
 	}
+	for _, opt := range opts {
+		opt(writer)
+	}
+	if writer.queueSize < size {
+		writer.queueSize = size
+	}
+	writer.spans = make(chan tenantSpan, writer.queueSize)
+	writer.writeParams.health = newBufferHealth(logger, spansTable, writer.alarms)
 
 	writer.registerMetrics()
+	writer.writeParams.health.start()
 	go writer.backgroundWriter(maxSpanCount)
 
 	return writer
@@ -81,16 +204,65 @@ func (w *SpanWriter) registerMetrics() {
 	registerMetrics.Do(func() {
 		prometheus.MustRegister(numWritesWithBatchSize)
 		prometheus.MustRegister(numWritesWithFlushInterval)
+		prometheus.MustRegister(numWritesWithBatchBytes)
+		prometheus.MustRegister(queuedSpans)
+		prometheus.MustRegister(batchedSpans)
+		prometheus.MustRegister(spanQueueDelay)
+		prometheus.MustRegister(numRejectedSpans)
+		prometheus.MustRegister(oldestUnwrittenSpanAge)
+		prometheus.MustRegister(unwrittenSpanBytes)
+		prometheus.MustRegister(numFlushFailures)
+		prometheus.MustRegister(recentFlushFailures)
+		prometheus.MustRegister(numClockSkewedSpans)
+		prometheus.MustRegister(loadSheddingActive)
+		prometheus.MustRegister(numShedSpans)
+		prometheus.MustRegister(numFilteredSpans)
+		prometheus.MustRegister(numSpanBytes)
+		prometheus.MustRegister(numOverQuotaSpans)
+		prometheus.MustRegister(numPrunedSpans)
+		prometheus.MustRegister(activeParts)
+		prometheus.MustRegister(runningMerges)
+		prometheus.MustRegister(flushSlowdown)
+		prometheus.MustRegister(numAutoArchivedTraces)
+		prometheus.MustRegister(numProfiledTraces)
+		prometheus.MustRegister(traceFetchDuration)
+		prometheus.MustRegister(circuitBreakerOpen)
+		prometheus.MustRegister(numDecodeFailures)
+		prometheus.MustRegister(numDroppedAuditRecords)
+		prometheus.MustRegister(insertDuration)
+		prometheus.MustRegister(insertServerDuration)
+		prometheus.MustRegister(insertWrittenRows)
+		prometheus.MustRegister(insertWrittenBytes)
 	})
 }
 
 func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 	pool := NewWorkerPool(&w.writeParams, maxSpanCount)
 	go pool.Work()
-	batch := make([]*model.Span, 0, w.size)
+	// Spans of different tenants are written in separate batches
+	batches := make(map[string][]*model.Span)
+	pending := make(map[string]*pendingBatch)
+	var (
+		batchSize  int64
+		batchBytes int64
+	)
 
 	timer := time.After(w.writeParams.delay)
 	last := time.Now()
+	queued := queuedSpans.WithLabelValues(string(w.writeParams.spansTable))
+	batched := batchedSpans.WithLabelValues(string(w.writeParams.spansTable))
+	queueDelay := spanQueueDelay.WithLabelValues(string(w.writeParams.spansTable))
+
+	writeBatches := func() {
+		for tenant, batch := range batches {
+			pool.writeBatch(tenantBatch{tenant: tenant, spans: batch, pending: pending[tenant]})
+		}
+		batches = make(map[string][]*model.Span)
+		pending = make(map[string]*pendingBatch)
+		batchSize = 0
+		batchBytes = 0
+		last = time.Now()
+	}
 
 	for {
 		w.done.Add(1)
@@ -98,33 +270,45 @@ func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 		flush := false
 		finish := false
 
+		// While the parts monitor slows down flushes, batches are bigger and flushed less often
+		slowdown := w.partsMonitor.flushFactor()
+
 		select {
 		case span := <-w.spans:
-			batch = append(batch, span)
-			flush = len(batch) == cap(batch)
+			queueDelay.Observe(time.Since(span.accepted).Seconds())
+			spanBytes := span.bytes
+			if w.maxBytes > 0 && batchSize > 0 && batchBytes+spanBytes > w.maxBytes {
+				w.writeParams.logger.Debug("Flush due to batch bytes", "size", batchSize, "bytes", batchBytes)
+				numWritesWithBatchBytes.Inc()
+				writeBatches()
+			}
+			batches[span.tenant] = append(batches[span.tenant], span.span)
+			pending[span.tenant] = w.writeParams.health.batch(pending[span.tenant], span.accepted, spanBytes)
+			batchSize++
+			batchBytes += spanBytes
+			flush = batchSize >= w.size*slowdown
 			if flush {
-				w.writeParams.logger.Debug("Flush due to batch size", "size", len(batch))
+				w.writeParams.logger.Debug("Flush due to batch size", "size", batchSize)
 				numWritesWithBatchSize.Inc()
 			}
 		case <-timer:
 			timer = time.After(w.writeParams.delay)
-			flush = time.Since(last) > w.writeParams.delay && len(batch) > 0
+			flush = time.Since(last) > w.writeParams.delay*time.Duration(slowdown) && batchSize > 0
 			if flush {
 				w.writeParams.logger.Debug("Flush due to timer")
 				numWritesWithFlushInterval.Inc()
 			}
 		case <-w.finish:
 			finish = true
-			flush = len(batch) > 0
+			flush = batchSize > 0
 			w.writeParams.logger.Debug("Finish channel")
 		}
 
 		if flush {
-			pool.WriteBatch(batch)
-
-			batch = make([]*model.Span, 0, w.size)
-			last = time.Now()
+			writeBatches()
 		}
+		queued.Set(float64(len(w.spans)))
+		batched.Set(float64(batchSize))
 
 		if finish {
 			pool.CLose()
@@ -137,15 +321,71 @@ func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 	}
 }
 
-// WriteSpan writes the encoded span
-func (w *SpanWriter) WriteSpan(_ context.Context, span *model.Span) error {
-	w.spans <- span
-	return nil
+// WriteSpan queues the span for the next batch. It never waits for writes to ClickHouse, which are retried
+// in the background, ErrQueueFull is returned instead if the queue is full.
+func (w *SpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	tenant := ""
+	if w.tenantHeader != "" {
+		tenant = TenantFromContext(ctx, w.tenantHeader)
+	}
+	span = w.serviceNames.normalize(span)
+	if !w.serviceFilter.filter(span) {
+		return nil
+	}
+	span, err := w.clockSkew.handle(ctx, span, time.Now())
+	if span == nil || err != nil {
+		return err
+	}
+	if w.writeParams.shedder.shed(span) {
+		return nil
+	}
+	span = w.pruner.prune(span)
+	// Protobuf size is used as a cheap estimate of the serialized size for both encodings
+	size := int64(span.Size())
+	if !w.quotas.allow(span, size) {
+		return nil
+	}
+	w.tagStats.sample(span)
+	w.autoArchiver.observe(span)
+	w.criticalPaths.observe(tenant, span)
+	w.latency.observe(span)
+	w.writeParams.health.queue(size)
+	select {
+	case w.spans <- tenantSpan{tenant: tenant, span: span, bytes: size, accepted: time.Now()}:
+		return nil
+	default:
+		w.writeParams.health.queue(-size)
+		numRejectedSpans.WithLabelValues(string(w.writeParams.spansTable)).Inc()
+		return ErrQueueFull
+	}
+}
+
+// WriteBatch writes the spans synchronously in one batch of the tenant of the request, e.g. to import history.
+// Unlike WriteSpan, it bypasses the clock skew policy, load shedding, byte quotas and auto archiving, spans are only
+// normalized, filtered by their services and pruned.
+func (w *SpanWriter) WriteBatch(ctx context.Context, spans []*model.Span) error {
+	tenant := ""
+	if w.tenantHeader != "" {
+		tenant = TenantFromContext(ctx, w.tenantHeader)
+	}
+	batch := make([]*model.Span, 0, len(spans))
+	for _, span := range spans {
+		span = w.serviceNames.normalize(span)
+		if w.serviceFilter.filter(span) {
+			batch = append(batch, w.pruner.prune(span))
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	worker := &WriteWorker{params: &w.writeParams, tenant: tenant}
+	return worker.insertBatch(batch)
 }
 
 // Close Implements io.Closer and closes the underlying storage
 func (w *SpanWriter) Close() error {
 	w.finish <- true
 	w.done.Wait()
+	w.writeParams.health.close()
 	return nil
 }
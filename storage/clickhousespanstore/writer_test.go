@@ -0,0 +1,95 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestSpanWriter_FlushOnBatchBytes(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	for _, expectation := range []expectation{getModelWriteExpectation(spanJSON), indexWriteExpectation} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	// The second span does not fit into the batch, so the first one is flushed alone
+	writer := NewSpanWriter(hclog.NewNullLogger(), db, testIndexTable, testSpansTable, EncodingJSON, time.Hour, 10, 100,
+		WithMaxBatchBytes(int64(testSpan.Size())))
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+
+	assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, time.Millisecond*10)
+}
+
+func TestSpanWriter_WriteBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	for _, expectation := range []expectation{getModelWriteExpectation(spanJSON), indexWriteExpectation} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	writer := NewSpanWriter(hclog.NewNullLogger(), db, testIndexTable, testSpansTable, EncodingJSON, time.Hour, 10, 100)
+	require.NoError(t, writer.WriteBatch(context.Background(), []*model.Span{&testSpan}))
+	// The batch is written before WriteBatch returns
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_WriteSpanQueueFull(t *testing.T) {
+	// The writer has no background writer, so queued spans are never added to a batch
+	writer := &SpanWriter{writeParams: WriteParams{spansTable: testSpansTable}, spans: make(chan tenantSpan, 1)}
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	assert.Equal(t, ErrQueueFull, writer.WriteSpan(context.Background(), &testSpan))
+}
+
+func TestSpanWriter_RetriesDoNotBlock(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+	mock.ExpectBegin().WillReturnError(assert.AnError)
+
+	// Every span is flushed in its own batch, which fails and is retried an hour later,
+	// the oldest batch is dropped when the next one does not fit
+	writer := NewSpanWriter(hclog.NewNullLogger(), db, testIndexTable, testSpansTable, EncodingJSON, time.Hour, 1, 1, WithQueueSize(10))
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+		}
+		assert.NoError(t, writer.Close())
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes waited for retries of failed batches")
+	}
+}
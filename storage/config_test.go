@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
 
 	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSetDefaults(t *testing.T) {
@@ -39,10 +46,123 @@ func TestSetDefaults(t *testing.T) {
 			getField: func(config Configuration) interface{} { return config.MaxSpanCount },
 			expected: defaultMaxSpanCount,
 		},
+		"queue size": {
+			getField: func(config Configuration) interface{} { return config.QueueSize },
+			expected: int64(defaultQueueSize),
+		},
+		"insert format": {
+			getField: func(config Configuration) interface{} { return config.InsertFormat },
+			expected: InsertNative,
+		},
+		"fetch chunk size": {
+			getField: func(config Configuration) interface{} { return config.FetchChunkSize },
+			expected: defaultFetchChunkSize,
+		},
 		"metrics endpoint": {
 			getField: func(config Configuration) interface{} { return config.MetricsEndpoint },
 			expected: defaultMetricsEndpoint,
 		},
+		"tenant header": {
+			getField: func(config Configuration) interface{} { return config.TenantHeader },
+			expected: defaultTenantHeader,
+		},
+		"hidden traces table": {
+			getField: func(config Configuration) interface{} { return config.HiddenTracesTable },
+			expected: defaultHiddenTracesTable,
+		},
+		"replica name": {
+			getField: func(config Configuration) interface{} { return config.ReplicaName },
+			expected: defaultReplicaName,
+		},
+		"search cache TTL": {
+			getField: func(config Configuration) interface{} { return config.SearchCacheTTL },
+			expected: defaultSearchCacheTTL,
+		},
+		"default number of traces": {
+			getField: func(config Configuration) interface{} { return config.DefaultNumTraces },
+			expected: clickhousespanstore.DefaultNumTraces,
+		},
+		"query queue timeout": {
+			getField: func(config Configuration) interface{} { return config.QueryQueueTimeout },
+			expected: defaultQueryQueueTimeout,
+		},
+		"clock skew policy": {
+			getField: func(config Configuration) interface{} { return config.ClockSkewPolicy },
+			expected: clickhousespanstore.ClockSkewKeep,
+		},
+		"decode failure policy": {
+			getField: func(config Configuration) interface{} { return config.DecodeFailurePolicy },
+			expected: clickhousespanstore.DecodeFailureIgnore,
+		},
+		"prewhere": {
+			getField: func(config Configuration) interface{} { return config.Prewhere },
+			expected: PrewhereAuto,
+		},
+		"max span age": {
+			getField: func(config Configuration) interface{} { return config.MaxSpanAge },
+			expected: defaultMaxSpanAge,
+		},
+		"max span future": {
+			getField: func(config Configuration) interface{} { return config.MaxSpanFuture },
+			expected: defaultMaxSpanFuture,
+		},
+		"quarantine table name local": {
+			getField: func(config Configuration) interface{} { return config.GetSpansQuarantineTable() },
+			expected: (defaultSpansTable + "_quarantine").ToLocal(),
+		},
+		"quarantine table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.GetSpansQuarantineTable() },
+			expected:    defaultSpansTable + "_quarantine",
+		},
+		"buffer alarms window": {
+			getField: func(config Configuration) interface{} { return config.BufferAlarms.Window },
+			expected: defaultAlarmWindow,
+		},
+		"max insert latency": {
+			getField: func(config Configuration) interface{} { return config.LoadShedding.MaxLatency },
+			expected: defaultMaxInsertLatency,
+		},
+		"load shedding failure threshold": {
+			getField: func(config Configuration) interface{} { return config.LoadShedding.FailureThreshold },
+			expected: defaultFailureThreshold,
+		},
+		"load shedding recovery threshold": {
+			getField: func(config Configuration) interface{} { return config.LoadShedding.RecoveryThreshold },
+			expected: defaultRecoveryThreshold,
+		},
+		"circuit breaker cool down": {
+			getField: func(config Configuration) interface{} { return config.CircuitBreaker.CoolDown },
+			expected: defaultCoolDown,
+		},
+		"recent traces window": {
+			getField: func(config Configuration) interface{} { return config.RecentTracesWindow },
+			expected: defaultRecentTracesWindow,
+		},
+		"hot index window": {
+			getField: func(config Configuration) interface{} { return config.HotIndexWindow },
+			expected: defaultHotIndexWindow,
+		},
+		"duration baselines window": {
+			getField: func(config Configuration) interface{} { return config.DurationBaselinesWindow },
+			expected: defaultBaselinesWindow,
+		},
+		"max partition parts": {
+			getField: func(config Configuration) interface{} { return config.PartsMonitor.MaxPartitionParts },
+			expected: uint64(defaultMaxPartitionParts),
+		},
+		"max merges": {
+			getField: func(config Configuration) interface{} { return config.PartsMonitor.MaxMerges },
+			expected: uint64(defaultMaxMerges),
+		},
+		"reencode interval": {
+			getField: func(config Configuration) interface{} { return config.ReencodeInterval },
+			expected: defaultReencodeInterval,
+		},
+		"failover probe interval": {
+			getField: func(config Configuration) interface{} { return config.Failover.ProbeInterval },
+			expected: defaultProbeInterval,
+		},
 		"spans table name local": {
 			getField: func(config Configuration) interface{} { return config.SpansTable },
 			expected: defaultSpansTable.ToLocal(),
@@ -70,6 +190,127 @@ func TestSetDefaults(t *testing.T) {
 			getField:    func(config Configuration) interface{} { return config.OperationsTable },
 			expected:    defaultOperationsTable,
 		},
+		"trace summaries table name local": {
+			getField: func(config Configuration) interface{} { return config.TraceSummariesTable },
+			expected: defaultTraceSummariesTable.ToLocal(),
+		},
+		"trace summaries table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.TraceSummariesTable },
+			expected:    defaultTraceSummariesTable,
+		},
+		"traces table name local": {
+			getField: func(config Configuration) interface{} { return config.TracesTable },
+			expected: defaultTracesTable.ToLocal(),
+		},
+		"traces table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.TracesTable },
+			expected:    defaultTracesTable,
+		},
+		"recent traces table name local": {
+			getField: func(config Configuration) interface{} { return config.RecentTracesTable },
+			expected: defaultRecentTracesTable.ToLocal(),
+		},
+		"recent traces table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.RecentTracesTable },
+			expected:    defaultRecentTracesTable,
+		},
+		"duration baselines table name local": {
+			getField: func(config Configuration) interface{} { return config.DurationBaselinesTable },
+			expected: defaultBaselinesTable.ToLocal(),
+		},
+		"duration baselines table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.DurationBaselinesTable },
+			expected:    defaultBaselinesTable,
+		},
+		"operation profiles table name local": {
+			getField: func(config Configuration) interface{} { return config.OperationProfiles.Table },
+			expected: defaultProfilesTable.ToLocal(),
+		},
+		"operation profiles table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.OperationProfiles.Table },
+			expected:    defaultProfilesTable,
+		},
+		"audit log table name local": {
+			getField: func(config Configuration) interface{} { return config.AuditLog.Table },
+			expected: defaultAuditLogTable.ToLocal(),
+		},
+		"audit log table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.AuditLog.Table },
+			expected:    defaultAuditLogTable,
+		},
+		"audit log sample rate": {
+			getField: func(config Configuration) interface{} { return config.AuditLog.SampleRate },
+			expected: 1,
+		},
+		"service aliases table name": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.ServiceAliasesTable },
+			expected:    defaultServiceAliasesTable,
+		},
+		"service aliases dictionary name": {
+			getField: func(config Configuration) interface{} { return config.serviceAliasesDictionary() },
+			expected: defaultServiceAliasesTable + "_dict",
+		},
+		"calls table name local": {
+			getField: func(config Configuration) interface{} { return config.CallsTable },
+			expected: defaultCallsTable.ToLocal(),
+		},
+		"calls table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.CallsTable },
+			expected:    defaultCallsTable,
+		},
+		"dependencies table name local": {
+			getField: func(config Configuration) interface{} { return config.DependenciesTable },
+			expected: defaultDependenciesTable.ToLocal(),
+		},
+		"dependencies table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.DependenciesTable },
+			expected:    defaultDependenciesTable,
+		},
+		"hot index table name local": {
+			getField: func(config Configuration) interface{} { return config.HotIndexTable },
+			expected: defaultHotIndexTable.ToLocal(),
+		},
+		"hot index table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.HotIndexTable },
+			expected:    defaultHotIndexTable,
+		},
+		"archive index table name local": {
+			getField: func(config Configuration) interface{} { return config.Archive.IndexTable },
+			expected: defaultArchiveIndexTable.ToLocal(),
+		},
+		"archive index table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.Archive.IndexTable },
+			expected:    defaultArchiveIndexTable,
+		},
+		"processes table name local": {
+			getField: func(config Configuration) interface{} { return config.ProcessesTable },
+			expected: defaultProcessesTable.ToLocal(),
+		},
+		"processes table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.ProcessesTable },
+			expected:    defaultProcessesTable,
+		},
+		"span logs table name local": {
+			getField: func(config Configuration) interface{} { return config.SpanLogsTable },
+			expected: defaultSpanLogsTable.ToLocal(),
+		},
+		"span logs table name replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return config.SpanLogsTable },
+			expected:    defaultSpanLogsTable,
+		},
 	}
 
 	for name, test := range tests {
@@ -89,6 +330,10 @@ func TestConfiguration_GetSpansArchiveTable(t *testing.T) {
 		"default_config_local":       {config: Configuration{}, expectedSpansArchiveTableName: (defaultSpansTable + "_archive").ToLocal()},
 		"default_config_replication": {config: Configuration{Replication: true}, expectedSpansArchiveTableName: defaultSpansTable + "_archive"},
 		"custom_spans_table":         {config: Configuration{SpansTable: "custom_table_name"}, expectedSpansArchiveTableName: "custom_table_name_archive"},
+		"custom_archive_table": {
+			config:                        Configuration{Replication: true, Archive: ArchiveConfiguration{Table: "custom_archive"}},
+			expectedSpansArchiveTableName: "custom_archive",
+		},
 	}
 
 	for name, test := range tests {
@@ -98,3 +343,357 @@ func TestConfiguration_GetSpansArchiveTable(t *testing.T) {
 		})
 	}
 }
+
+func TestConfiguration_clockSkewOption(t *testing.T) {
+	quarantine := func() spanstore.Writer {
+		t.Fatal("quarantine writer is created only for the quarantine policy")
+		return nil
+	}
+	for _, policy := range []clickhousespanstore.ClockSkewPolicy{clickhousespanstore.ClockSkewClamp, clickhousespanstore.ClockSkewDrop} {
+		config := Configuration{ClockSkewPolicy: policy}
+		opt, err := config.clockSkewOption(quarantine)
+		assert.NoError(t, err)
+		assert.NotNil(t, opt)
+	}
+
+	config := Configuration{ClockSkewPolicy: clickhousespanstore.ClockSkewKeep}
+	opt, err := config.clockSkewOption(quarantine)
+	assert.NoError(t, err)
+	assert.Nil(t, opt)
+
+	config = Configuration{ClockSkewPolicy: "fix"}
+	_, err = config.clockSkewOption(quarantine)
+	assert.EqualError(t, err, `unknown clock skew policy "fix"`)
+}
+
+func TestConfiguration_rowBinaryOption(t *testing.T) {
+	config := Configuration{InsertFormat: InsertNative}
+	opt, err := config.rowBinaryOption()
+	assert.NoError(t, err)
+	assert.Nil(t, opt)
+
+	config = Configuration{InsertFormat: InsertRowBinary, HTTPAddress: "http://localhost:8123", Proxy: ProxyConfiguration{URL: "unix:///tmp/clickhouse.sock"}}
+	opt, err = config.rowBinaryOption()
+	assert.NoError(t, err)
+	assert.NotNil(t, opt)
+
+	config = Configuration{InsertFormat: InsertRowBinary, HTTPAddress: "https://localhost:8443", CaFile: "missing.pem"}
+	_, err = config.rowBinaryOption()
+	assert.Error(t, err)
+}
+
+func TestConfiguration_prewhereOption(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	config := Configuration{}
+	config.setDefaults()
+	probe := fmt.Sprintf(prewhereProbe, config.SpansTable)
+
+	mock.ExpectQuery(probe).WillReturnError(sql.ErrNoRows)
+	opt, err := config.prewhereOption(mocks.NewSpyLogger(), db)
+	assert.NoError(t, err)
+	assert.Nil(t, opt, "PREWHERE is used when supported")
+
+	mock.ExpectQuery(probe).WillReturnError(errorMock)
+	opt, err = config.prewhereOption(mocks.NewSpyLogger(), db)
+	assert.NoError(t, err)
+	assert.NotNil(t, opt, "PREWHERE is disabled when the probe fails")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	config.Prewhere = PrewhereEnabled
+	opt, err = config.prewhereOption(mocks.NewSpyLogger(), db)
+	assert.NoError(t, err)
+	assert.Nil(t, opt)
+
+	config.Prewhere = PrewhereDisabled
+	opt, err = config.prewhereOption(mocks.NewSpyLogger(), db)
+	assert.NoError(t, err)
+	assert.NotNil(t, opt)
+
+	config.Prewhere = "sometimes"
+	_, err = config.prewhereOption(mocks.NewSpyLogger(), db)
+	assert.EqualError(t, err, `unknown prewhere mode "sometimes"`)
+}
+
+func TestConfiguration_adaptToUpstreamTables(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	config := Configuration{BinaryTraceIDs: true}
+	config.setDefaults()
+	writerOpts, readerOpts, err := config.adaptToUpstreamTables(mocks.NewSpyLogger(), db)
+	require.NoError(t, err)
+	assert.Empty(t, writerOpts, "tables are not detected without upstream compatibility")
+	assert.Empty(t, readerOpts)
+
+	query := "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?"
+	expectColumns := func(tenants bool) {
+		columns := sqlmock.NewRows([]string{"name", "type"}).AddRow("timestamp", "DateTime").AddRow("traceID", "String")
+		if tenants {
+			columns.AddRow("tenant", "LowCardinality(String)")
+		}
+		mock.ExpectQuery(query).WithArgs(string(config.OperationsTable)).
+			WillReturnRows(sqlmock.NewRows([]string{"name", "type"}).AddRow("date", "Date").AddRow("operation", "String"))
+		mock.ExpectQuery(query).WithArgs(string(config.SpansIndexTable)).WillReturnRows(columns)
+		mock.ExpectQuery(query).WithArgs(string(config.SpansTable)).
+			WillReturnRows(sqlmock.NewRows([]string{"name", "type"}).AddRow("traceID", "String").AddRow("model", "String"))
+	}
+
+	config.UpstreamCompatibility = true
+	expectColumns(false)
+	writerOpts, readerOpts, err = config.adaptToUpstreamTables(mocks.NewSpyLogger(), db)
+	require.NoError(t, err)
+	assert.Len(t, writerOpts, 1, "operations are written without span kinds")
+	assert.Len(t, readerOpts, 1, "operations are read without span kinds")
+	assert.False(t, config.BinaryTraceIDs, "string trace IDs disable binary trace IDs")
+
+	config.MultiTenant = true
+	expectColumns(false)
+	_, _, err = config.adaptToUpstreamTables(mocks.NewSpyLogger(), db)
+	assert.EqualError(t, err, "multi_tenant requires the tenant column of jaeger_index_local")
+
+	expectColumns(true)
+	_, _, err = config.adaptToUpstreamTables(mocks.NewSpyLogger(), db)
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(query).WithArgs(string(config.OperationsTable)).WillReturnRows(sqlmock.NewRows([]string{"name", "type"}))
+	_, _, err = config.adaptToUpstreamTables(mocks.NewSpyLogger(), db)
+	assert.EqualError(t, err, "could not detect layouts of existing tables: table jaeger_operations_local does not exist")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConfiguration_loadSheddingOption(t *testing.T) {
+	config := Configuration{}
+	opt, err := config.loadSheddingOption()
+	assert.NoError(t, err)
+	assert.Nil(t, opt, "load shedding is disabled by default")
+
+	config.LoadShedding.Fraction = 0.5
+	opt, err = config.loadSheddingOption()
+	assert.NoError(t, err)
+	assert.NotNil(t, opt)
+
+	config.LoadShedding.Fraction = 1.5
+	_, err = config.loadSheddingOption()
+	assert.EqualError(t, err, "load shedding fraction must be between 0 and 1, got 1.5")
+}
+
+func TestConfiguration_circuitBreakerOption(t *testing.T) {
+	config := Configuration{}
+	assert.Nil(t, config.circuitBreakerOption(), "circuit breaker is disabled by default")
+
+	config.CircuitBreaker.FailureThreshold = 5
+	assert.NotNil(t, config.circuitBreakerOption())
+}
+
+func TestConfiguration_partsMonitor(t *testing.T) {
+	config := Configuration{}
+	config.setDefaults()
+	assert.Nil(t, config.partsMonitor(mocks.NewSpyLogger(), nil), "parts monitor is disabled by default")
+
+	config.PartsMonitor.Interval = time.Minute
+	assert.NotNil(t, config.partsMonitor(mocks.NewSpyLogger(), nil))
+}
+
+func TestConfiguration_federatedSearchEnabled(t *testing.T) {
+	config := Configuration{Archive: ArchiveConfiguration{FederatedSearch: true}}
+	assert.False(t, config.federatedSearchEnabled(), "the archive is searched through its index or by scanning it")
+
+	config.SpansSearchLimit = 1000
+	assert.True(t, config.federatedSearchEnabled())
+	config.SpansSearchLimit = 0
+	config.Archive.Index = true
+	assert.True(t, config.federatedSearchEnabled())
+
+	disabled := false
+	config.Archive.Enabled = &disabled
+	assert.False(t, config.federatedSearchEnabled())
+}
+
+func TestConfiguration_readSettings(t *testing.T) {
+	config := Configuration{Settings: SettingsConfiguration{Read: map[string]string{"max_memory_usage": "1000"}}}
+	assert.Equal(t, map[string]string{"max_memory_usage": "1000"}, config.readSettings())
+
+	config.ReadQueryIDs, config.ReplaceRunningQueries = true, true
+	assert.Equal(t, map[string]string{"max_memory_usage": "1000", "replace_running_query": "1"}, config.readSettings())
+	assert.Len(t, config.Settings.Read, 1, "configured settings are not modified")
+}
+
+func TestConfiguration_writeSettings(t *testing.T) {
+	config := Configuration{Settings: SettingsConfiguration{Write: map[string]string{"max_insert_block_size": "100000"}}}
+	assert.Equal(t, map[string]string{"max_insert_block_size": "100000"}, config.writeSettings())
+
+	deduplicate := false
+	config.InsertDeduplicate = &deduplicate
+	assert.Equal(t, map[string]string{"max_insert_block_size": "100000", "insert_deduplicate": "0"}, config.writeSettings())
+	deduplicate = true
+	assert.Equal(t, map[string]string{"max_insert_block_size": "100000", "insert_deduplicate": "1"}, config.writeSettings())
+	assert.Len(t, config.Settings.Write, 1, "configured settings are not modified")
+}
+
+func TestConfiguration_schemaMonitor(t *testing.T) {
+	config := Configuration{}
+	config.setDefaults()
+	assert.Nil(t, config.schemaMonitor(mocks.NewSpyLogger(), nil, nil), "there are no optional columns to check")
+
+	config.IndexFlags = true
+	assert.NotNil(t, config.schemaMonitor(mocks.NewSpyLogger(), nil, nil))
+	config.IndexFlags = false
+	assert.NotNil(t, config.schemaMonitor(mocks.NewSpyLogger(), nil, []clickhousespanstore.ExtractedTag{{Key: "user.id", Type: "String"}}))
+}
+
+func TestConfiguration_serviceNameNormalizerOption(t *testing.T) {
+	config := Configuration{}
+	opt, err := config.serviceNameNormalizerOption()
+	require.NoError(t, err)
+	assert.Nil(t, opt, "normalization is disabled by default")
+
+	config.ServiceNameNormalization.Lowercase = true
+	opt, err = config.serviceNameNormalizerOption()
+	require.NoError(t, err)
+	assert.NotNil(t, opt)
+
+	config.ServiceNameNormalization.Replacements = []ServiceNameReplacement{{Pattern: "["}}
+	_, err = config.serviceNameNormalizerOption()
+	assert.Error(t, err)
+}
+
+func TestConfiguration_latencyHistogramOption(t *testing.T) {
+	config := Configuration{}
+	opt, err := config.latencyHistogramOption()
+	require.NoError(t, err)
+	assert.Nil(t, opt, "latency histogram is disabled by default")
+
+	config.LatencyHistogram.Enabled = true
+	opt, err = config.latencyHistogramOption()
+	require.NoError(t, err)
+	assert.NotNil(t, opt)
+
+	// Another store observes with the registered histogram
+	opt, err = config.latencyHistogramOption()
+	require.NoError(t, err)
+	assert.NotNil(t, opt)
+}
+
+func TestConfiguration_codecs(t *testing.T) {
+	config := Configuration{Codecs: map[string]string{"model": " ZSTD(3) ", "timestamp": "Delta(4),ZSTD", "key": "AES_128_GCM_SIV"}}
+	codecs, err := config.codecs()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"model": "ZSTD(3)", "timestamp": "Delta(4),ZSTD", "key": "AES_128_GCM_SIV"}, codecs)
+
+	for _, codec := range []string{"", "ZSTD(1)) DEFAULT 1", "ZSTD,", "ZSTD(a)", "LZ4; DROP TABLE jaeger_spans"} {
+		config.Codecs = map[string]string{"model": codec}
+		_, err = config.codecs()
+		assert.Error(t, err, codec)
+	}
+}
+
+func TestConfiguration_orderBy(t *testing.T) {
+	config := Configuration{
+		SpansOrderBy: []string{"tenant", " traceID "},
+		IndexOrderBy: []string{"service", "operation", "-toUnixTimestamp(timestamp)"},
+	}
+	spans, index, err := config.orderBy()
+	require.NoError(t, err)
+	assert.Equal(t, "tenant, traceID", spans)
+	assert.Equal(t, "service, operation, -toUnixTimestamp(timestamp)", index)
+
+	config = Configuration{}
+	spans, index, err = config.orderBy()
+	require.NoError(t, err)
+	assert.Empty(t, spans)
+	assert.Empty(t, index)
+
+	for name, config := range map[string]*Configuration{
+		"spans without trace ID":  {SpansOrderBy: []string{"timestamp"}},
+		"index without timestamp": {IndexOrderBy: []string{"service", "operation"}},
+		"injection":               {IndexOrderBy: []string{"service", "timestamp) SETTINGS index_granularity = 1; --"}},
+	} {
+		_, _, err := config.orderBy()
+		assert.Error(t, err, name)
+	}
+}
+
+func TestConfiguration_replication(t *testing.T) {
+	config := Configuration{ReplicationPath: "/clickhouse/{installation}/tables/{shard}/{database}/{table}", ReplicaName: "{replica}"}
+	path, replica, err := config.replication()
+	require.NoError(t, err)
+	assert.Equal(t, "/clickhouse/{installation}/tables/{shard}/{database}/{table}", path)
+	assert.Equal(t, "{replica}", replica)
+
+	config.ReplicaName = "{replica}', 'x"
+	_, _, err = config.replication()
+	assert.Error(t, err)
+	config = Configuration{ReplicationPath: `/clickhouse/tables\`}
+	_, _, err = config.replication()
+	assert.Error(t, err)
+}
+
+func TestConfiguration_autoArchiver(t *testing.T) {
+	config := Configuration{}
+	config.setDefaults()
+	archiver, err := config.autoArchiver(mocks.NewSpyLogger(), nil)
+	require.NoError(t, err)
+	assert.Nil(t, archiver, "auto archive is disabled by default")
+
+	config.AutoArchive.Rules = []AutoArchiveRuleConfiguration{{Error: true}}
+	archiver, err = config.autoArchiver(mocks.NewSpyLogger(), nil)
+	require.NoError(t, err)
+	assert.NotNil(t, archiver)
+
+	config.AutoArchive.Rules = append(config.AutoArchive.Rules, AutoArchiveRuleConfiguration{})
+	_, err = config.autoArchiver(mocks.NewSpyLogger(), nil)
+	assert.EqualError(t, err, "auto archive rule 2 has no criteria")
+
+	disabled := false
+	config.Archive.Enabled = &disabled
+	_, err = config.autoArchiver(mocks.NewSpyLogger(), nil)
+	assert.EqualError(t, err, "auto archive requires the archive storage")
+}
+
+func TestConfiguration_extractedTags(t *testing.T) {
+	config := Configuration{ExtractedTags: []string{"http.status_code:UInt16", "user.id:String"}}
+	tags, err := config.extractedTags()
+	require.NoError(t, err)
+	assert.Equal(t, []clickhousespanstore.ExtractedTag{
+		{Key: "http.status_code", Type: "UInt16"},
+		{Key: "user.id", Type: "String"},
+	}, tags)
+
+	config.ExtractedTags = append(config.ExtractedTags, "user_id:String")
+	_, err = config.extractedTags()
+	assert.EqualError(t, err, `extracted tags "user.id" and "user_id" have the same column tag_user_id`)
+
+	config.ExtractedTags = []string{"user.id:UUID"}
+	_, err = config.extractedTags()
+	assert.EqualError(t, err, `unsupported type "UUID" of extracted tag "user.id"`)
+}
+
+func TestConfiguration_tableRotation(t *testing.T) {
+	config := Configuration{}
+	rotation, err := config.tableRotation(nil)
+	require.NoError(t, err)
+	assert.Nil(t, rotation, "tables are not rotated by default")
+
+	config.TableRotation = clickhousespanstore.RotationDaily
+	rotation, err = config.tableRotation(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, rotation)
+
+	config.TraceSummaries = true
+	_, err = config.tableRotation(nil)
+	assert.EqualError(t, err, "table rotation does not support trace summaries")
+
+	config.TraceSummaries = false
+	config.AggregateTraces = true
+	_, err = config.tableRotation(nil)
+	assert.EqualError(t, err, "table rotation does not support aggregated traces")
+
+	config.AggregateTraces = false
+	config.TableRotation = "yearly"
+	_, err = config.tableRotation(nil)
+	assert.EqualError(t, err, `unknown table rotation period "yearly"`)
+}
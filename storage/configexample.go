@@ -0,0 +1,107 @@
+package storage
+
+import (
+	// Package embeds the source of the configuration to annotate the example configuration by its documentation
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+//go:embed config.go
+var configSource []byte
+
+// WriteExampleConfiguration writes a YAML configuration with all options set to their defaults, every option
+// annotated by its documentation in Configuration, so that the example cannot get out of date with the options
+func WriteExampleConfiguration(w io.Writer) error {
+	file, err := parser.ParseFile(token.NewFileSet(), "config.go", configSource, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	structs := make(map[string]*ast.StructType)
+	ast.Inspect(file, func(node ast.Node) bool {
+		if spec, ok := node.(*ast.TypeSpec); ok {
+			if structType, ok := spec.Type.(*ast.StructType); ok {
+				structs[spec.Name.Name] = structType
+			}
+		}
+		return true
+	})
+
+	var cfg Configuration
+	cfg.setDefaults()
+	return writeExample(w, structs, reflect.ValueOf(cfg), "")
+}
+
+// writeExample writes options of the struct value with their documentation from the source, indented by indent
+func writeExample(w io.Writer, structs map[string]*ast.StructType, value reflect.Value, indent string) error {
+	structType, ok := structs[value.Type().Name()]
+	if !ok {
+		return fmt.Errorf("no documentation of %s", value.Type().Name())
+	}
+	docs := make(map[string]string)
+	for _, field := range structType.Fields.List {
+		for _, name := range field.Names {
+			docs[name.Name] = field.Doc.Text()
+		}
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSpace(docs[field.Name]), "\n") {
+			if line != "" {
+				if _, err := fmt.Fprintf(w, "%s# %s\n", indent, line); err != nil {
+					return err
+				}
+			}
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.Kind() == reflect.Struct && fieldValue.Type() != reflect.TypeOf(time.Time{}) {
+			if _, err := fmt.Fprintf(w, "%s%s:\n", indent, key); err != nil {
+				return err
+			}
+			if err := writeExample(w, structs, fieldValue, indent+"  "); err != nil {
+				return err
+			}
+			continue
+		}
+		example, err := exampleValue(fieldValue)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s%s:%s\n", indent, key, example); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exampleValue returns the value following the key and the colon, empty for zero values like in config.yaml.
+// Tables are empty too, as their defaults depend on replication and names of archive tables on spans tables.
+func exampleValue(value reflect.Value) (string, error) {
+	if value.IsZero() || value.Type() == reflect.TypeOf(clickhousespanstore.TableName("")) {
+		return "", nil
+	}
+	if duration, ok := value.Interface().(time.Duration); ok {
+		return " " + duration.String(), nil
+	}
+	serialized, err := yaml.Marshal(value.Interface())
+	if err != nil {
+		return "", err
+	}
+	return " " + strings.TrimSpace(string(serialized)), nil
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteExampleConfiguration(t *testing.T) {
+	var example bytes.Buffer
+	require.NoError(t, WriteExampleConfiguration(&example))
+
+	assert.Contains(t, example.String(), "# Batch write size. Default is 10_000.\nbatch_write_size: 10000\n")
+	assert.Contains(t, example.String(), "grpc_server:\n  # Address the remote storage server listens on e.g. :17271.\n  address:\n")
+
+	// The example is a valid configuration with the defaults
+	var cfg Configuration
+	require.NoError(t, yaml.Unmarshal(example.Bytes(), &cfg))
+	require.NoError(t, cfg.Validate())
+	expected := Configuration{}
+	expected.setDefaults()
+	cfg.setDefaults()
+	assert.Equal(t, expected, cfg)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables overriding options of the configuration file, followed by
+// the upper-cased path of the option joined by underscores, e.g. JAEGER_CLICKHOUSE_GRPC_SERVER_ADDRESS
+const EnvPrefix = "JAEGER_CLICKHOUSE_"
+
+// gzipMagic starts gzip compressed files, e.g. configurations stored compressed in Kubernetes config maps
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// LoadConfiguration reads the configuration from layered sources, later sources take precedence: the configuration
+// file, environment variables with EnvPrefix and overrides as path=value, e.g. grpc_server.address=:17271.
+// Values of environment variables and overrides are YAML, e.g. [a, b] for lists. The file is optional and can be
+// gzip compressed. Unknown environment variables are ignored, e.g. those set by Kubernetes for services, unknown
+// overrides are errors.
+func LoadConfiguration(configPath string, environ, overrides []string) (Configuration, error) {
+	var cfg Configuration
+	document := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	if configPath != "" {
+		content, err := readConfigFile(configPath)
+		if err != nil {
+			return cfg, err
+		}
+		var parsed yaml.Node
+		if err = yaml.Unmarshal(content, &parsed); err != nil {
+			return cfg, fmt.Errorf("could not parse config file: %w", err)
+		}
+		if len(parsed.Content) > 0 {
+			document = &parsed
+		}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return cfg, fmt.Errorf("config file must be a mapping of options")
+	}
+
+	options := configurationOptions(reflect.TypeOf(cfg), nil)
+	byEnv := make(map[string][]string, len(options))
+	byPath := make(map[string][]string, len(options))
+	for _, path := range options {
+		byEnv[EnvPrefix+strings.ToUpper(strings.Join(path, "_"))] = path
+		byPath[strings.Join(path, ".")] = path
+	}
+
+	// Environment variables are sorted, so that the result does not depend on their order
+	sortedEnviron := append([]string(nil), environ...)
+	sort.Strings(sortedEnviron)
+	for _, variable := range sortedEnviron {
+		name, value, ok := cut(variable, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		path, ok := byEnv[name]
+		if !ok {
+			continue
+		}
+		if err := setOption(root, path, value); err != nil {
+			return cfg, fmt.Errorf("invalid environment variable %s: %w", name, err)
+		}
+	}
+	for _, override := range overrides {
+		key, value, ok := cut(override, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid override %q, expected path=value", override)
+		}
+		path, ok := byPath[strings.TrimSpace(key)]
+		if !ok {
+			return cfg, fmt.Errorf("unknown configuration option %q", key)
+		}
+		if err := setOption(root, path, value); err != nil {
+			return cfg, fmt.Errorf("invalid override %q: %w", override, err)
+		}
+	}
+
+	if err := document.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("could not parse configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// readConfigFile returns the content of the file, decompressed if it is gzip compressed
+func readConfigFile(configPath string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	if !bytes.HasPrefix(content, gzipMagic) {
+		return content, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress config file: %w", err)
+	}
+	defer reader.Close()
+	if content, err = ioutil.ReadAll(reader); err != nil {
+		return nil, fmt.Errorf("could not decompress config file: %w", err)
+	}
+	return content, nil
+}
+
+// configurationOptions returns paths of all options of the struct type by their YAML keys, nested structs
+// are options only through their fields
+func configurationOptions(structType reflect.Type, prefix []string) [][]string {
+	var options [][]string
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		path := append(append([]string(nil), prefix...), key)
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			options = append(options, configurationOptions(field.Type, path)...)
+			continue
+		}
+		options = append(options, path)
+	}
+	return options
+}
+
+// setOption sets the option of the path in the mapping to the value parsed as YAML, missing parents are added
+func setOption(mapping *yaml.Node, path []string, value string) error {
+	var parsed yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+		return err
+	}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+	if len(parsed.Content) > 0 {
+		valueNode = parsed.Content[0]
+	}
+
+	for i, key := range path {
+		var child *yaml.Node
+		for j := 0; j+1 < len(mapping.Content); j += 2 {
+			if mapping.Content[j].Value == key {
+				child = mapping.Content[j+1]
+			}
+		}
+		last := i == len(path)-1
+		switch {
+		case last && child != nil:
+			*child = *valueNode
+		case last:
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, valueNode)
+		case child == nil:
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+		case child.Kind != yaml.MappingNode:
+			// Sections left empty in the file, like in config.yaml, are null
+			*child = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		mapping = child
+	}
+	return nil
+}
+
+// cut slices s around the first instance of sep, like strings.Cut of newer Go versions
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfiguration(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+address: tcp://some-clickhouse-server:9000
+batch_write_size: 100
+batch_flush_interval: 5s
+grpc_server:
+pruning:
+  max_logs: 10
+`), 0600))
+
+	cfg, err := LoadConfiguration(file, []string{
+		"JAEGER_CLICKHOUSE_BATCH_WRITE_SIZE=200",
+		"JAEGER_CLICKHOUSE_GRPC_SERVER_ADDRESS=:17271",
+		"JAEGER_CLICKHOUSE_ALT_HOSTS=[other-server:9000, third-server:9000]",
+		"JAEGER_CLICKHOUSE_PORT=tcp://10.0.0.1:9090",
+		"PATH=/usr/bin",
+	}, []string{
+		"batch_write_size=300",
+		"pruning.drop_logs=true",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://some-clickhouse-server:9000", cfg.Address, "options not overridden are kept")
+	assert.Equal(t, int64(300), cfg.BatchWriteSize, "overrides take precedence over environment variables")
+	assert.Equal(t, 5*time.Second, cfg.BatchFlushInterval)
+	assert.Equal(t, ":17271", cfg.GRPCServer.Address, "empty sections are filled")
+	assert.Equal(t, []string{"other-server:9000", "third-server:9000"}, cfg.AltHosts)
+	assert.Equal(t, PruningConfiguration{DropLogs: true, MaxLogs: 10}, cfg.Pruning, "other options of sections are kept")
+
+	_, err = LoadConfiguration(file, nil, []string{"batch_size=1"})
+	assert.EqualError(t, err, `unknown configuration option "batch_size"`)
+	_, err = LoadConfiguration(file, nil, []string{"batch_write_size"})
+	assert.EqualError(t, err, `invalid override "batch_write_size", expected path=value`)
+}
+
+func TestLoadConfiguration_withoutFile(t *testing.T) {
+	cfg, err := LoadConfiguration("", []string{"JAEGER_CLICKHOUSE_ADDRESS=tcp://clickhouse:9000"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, Configuration{Address: "tcp://clickhouse:9000"}, cfg)
+}
+
+func TestLoadConfiguration_compressed(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte("address: tcp://clickhouse:9000\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	file := filepath.Join(t.TempDir(), "config.yaml.gz")
+	require.NoError(t, ioutil.WriteFile(file, compressed.Bytes(), 0600))
+
+	cfg, err := LoadConfiguration(file, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://clickhouse:9000", cfg.Address)
+}
@@ -0,0 +1,466 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "OK"
+	CheckWarning CheckStatus = "WARN"
+	CheckFailed  CheckStatus = "FAIL"
+
+	minSupportedMajorVersion = 21
+	// maxPartsPerPartition is the default parts_to_delay_insert, above it ClickHouse slows inserts down
+	maxPartsPerPartition = 150
+	// maxReplicationQueueSize is the size of a replication queue considered as lagging replica
+	maxReplicationQueueSize = 100
+
+	doctorVersionQuery          = "SELECT version()"
+	doctorTablesQuery           = "SELECT name, engine, engine_full FROM system.tables WHERE database = ?"
+	doctorPartsQuery            = "SELECT table, partition, count() FROM system.parts WHERE database = ? AND active GROUP BY table, partition HAVING count() > ?"
+	doctorReplicationQueueQuery = "SELECT table, count() FROM system.replication_queue WHERE database = ? GROUP BY table HAVING count() > ?"
+	doctorReadonlyReplicasQuery = "SELECT table FROM system.replicas WHERE database = ? AND is_readonly"
+	doctorGrantsQuery           = "SHOW GRANTS"
+)
+
+// CheckResult is an outcome of a single diagnostic check with an advice how to fix a problem
+type CheckResult struct {
+	Check   string
+	Status  CheckStatus
+	Message string
+	Advice  string
+}
+
+// Doctor connects to ClickHouse and diagnoses whether it is set up correctly for the plugin.
+// Unlike NewStore, it does not run init scripts.
+func Doctor(logger hclog.Logger, cfg Configuration) ([]CheckResult, error) {
+	cfg.setDefaults()
+	db, err := connector(logger, cfg, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %q", err)
+	}
+	defer db.Close()
+
+	return runDoctorChecks(db, cfg), nil
+}
+
+// WriteDoctorReport writes results of checks to w and returns false if any of them failed
+func WriteDoctorReport(w io.Writer, results []CheckResult) (bool, error) {
+	healthy := true
+	for _, result := range results {
+		if result.Status == CheckFailed {
+			healthy = false
+		}
+		if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Check, result.Message); err != nil {
+			return false, err
+		}
+		if result.Advice != "" {
+			if _, err := fmt.Fprintf(w, "    %s\n", result.Advice); err != nil {
+				return false, err
+			}
+		}
+	}
+	return healthy, nil
+}
+
+func runDoctorChecks(db *sql.DB, cfg Configuration) []CheckResult {
+	results := []CheckResult{checkVersion(db)}
+	results = append(results, checkTables(db, cfg)...)
+	results = append(results, checkParts(db, cfg))
+	if cfg.Replication {
+		results = append(results, checkReplication(db, cfg)...)
+	}
+	return append(results, checkGrants(db, cfg))
+}
+
+func checkVersion(db *sql.DB) CheckResult {
+	result := CheckResult{Check: "version"}
+	var version string
+	if err := db.QueryRow(doctorVersionQuery).Scan(&version); err != nil {
+		return failedQuery(result, err)
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		result.Status = CheckWarning
+		result.Message = fmt.Sprintf("could not parse ClickHouse version %q", version)
+		return result
+	}
+	if major < minSupportedMajorVersion {
+		result.Status = CheckFailed
+		result.Message = fmt.Sprintf("ClickHouse %s is not supported", version)
+		result.Advice = fmt.Sprintf("Upgrade ClickHouse to version %d or newer.", minSupportedMajorVersion)
+		return result
+	}
+	result.Status = CheckOK
+	result.Message = fmt.Sprintf("ClickHouse %s is supported", version)
+	return result
+}
+
+type expectedTable struct {
+	name    clickhousespanstore.TableName
+	engines []string
+	// Whether the table stores data, so TTL applies to it
+	data bool
+}
+
+func expectedTables(cfg Configuration) []expectedTable {
+	dataEngine := "MergeTree"
+	if cfg.Replication {
+		dataEngine = "ReplicatedMergeTree"
+	}
+	// The operations table is a table the writer or materialized views of rotated index tables write to,
+	// unless the materialized view of the index table is the operations table
+	operationsEngine := "SummingMergeTree"
+	if cfg.Replication {
+		operationsEngine = dataEngine
+	}
+	if cfg.TableRotation == "" && !cfg.WriteOperations {
+		operationsEngine = "MaterializedView"
+	}
+	local := cfg.localTable
+	var (
+		tables      []expectedTable
+		distributed []clickhousespanstore.TableName
+	)
+	if cfg.TableRotation == "" {
+		tables = []expectedTable{
+			{name: local(cfg.SpansTable), engines: []string{dataEngine}, data: true},
+			{name: local(cfg.SpansIndexTable), engines: []string{dataEngine}, data: true},
+			{name: local(cfg.OperationsTable), engines: []string{operationsEngine}},
+		}
+		distributed = []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable, cfg.OperationsTable}
+	} else {
+		// Tables of periods are created as spans are written, only Merge tables over them are checked
+		tables = []expectedTable{
+			{name: cfg.SpansTable, engines: []string{"Merge"}},
+			{name: cfg.SpansIndexTable, engines: []string{"Merge"}},
+			{name: local(cfg.OperationsTable), engines: []string{operationsEngine}},
+		}
+		distributed = []clickhousespanstore.TableName{cfg.OperationsTable}
+	}
+	if cfg.ArchiveEnabled() {
+		tables = append(tables, expectedTable{name: local(cfg.GetSpansArchiveTable()), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.GetSpansArchiveTable())
+	}
+	if cfg.archiveIndexEnabled() {
+		tables = append(tables, expectedTable{name: local(cfg.Archive.IndexTable), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.Archive.IndexTable)
+	}
+	if cfg.Dependencies {
+		tables = append(tables, expectedTable{name: local(cfg.CallsTable), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.CallsTable)
+	}
+	if cfg.SpanLogs {
+		tables = append(tables, expectedTable{name: local(cfg.SpanLogsTable), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.SpanLogsTable)
+	}
+	if cfg.DeduplicateProcesses {
+		// Processes of archived spans are needed as long as the spans, so they have no TTL
+		processesEngine := "ReplacingMergeTree"
+		if cfg.Replication {
+			processesEngine = "ReplicatedReplacingMergeTree"
+		}
+		tables = append(tables, expectedTable{name: local(cfg.ProcessesTable), engines: []string{processesEngine}})
+		distributed = append(distributed, cfg.ProcessesTable)
+	}
+	if cfg.StoredDependencies {
+		tables = append(tables, expectedTable{name: local(cfg.DependenciesTable), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.DependenciesTable)
+	}
+	if cfg.IndexFromSpans {
+		tables = append(tables, expectedTable{name: cfg.indexView(), engines: []string{"MaterializedView"}})
+	}
+	if cfg.TraceSummaries {
+		tables = append(tables, expectedTable{name: local(cfg.TraceSummariesTable), engines: []string{"MaterializedView"}})
+		distributed = append(distributed, cfg.TraceSummariesTable)
+	}
+	if cfg.RecentTraces {
+		tables = append(tables, expectedTable{name: local(cfg.RecentTracesTable), engines: []string{"MaterializedView"}})
+		distributed = append(distributed, cfg.RecentTracesTable)
+	}
+	if cfg.HotIndex {
+		tables = append(tables, expectedTable{name: local(cfg.HotIndexTable), engines: []string{"MaterializedView"}})
+		distributed = append(distributed, cfg.HotIndexTable)
+	}
+	if cfg.DurationBaselines {
+		tables = append(tables, expectedTable{name: local(cfg.DurationBaselinesTable), engines: []string{"MaterializedView"}})
+		distributed = append(distributed, cfg.DurationBaselinesTable)
+	}
+	if cfg.AggregateTraces {
+		tables = append(tables, expectedTable{name: local(cfg.TracesTable), engines: []string{"MaterializedView"}})
+		distributed = append(distributed, cfg.TracesTable)
+	}
+	if len(cfg.ServiceAliases) > 0 {
+		tables = append(tables,
+			expectedTable{name: cfg.ServiceAliasesTable, engines: []string{dataEngine}},
+			expectedTable{name: cfg.serviceAliasesDictionary(), engines: []string{"Dictionary"}},
+		)
+	}
+	if cfg.AuditLog.Enabled {
+		tables = append(tables, expectedTable{name: local(cfg.AuditLog.Table), engines: []string{dataEngine}})
+		distributed = append(distributed, cfg.AuditLog.Table)
+	}
+	if cfg.ClockSkewPolicy == clickhousespanstore.ClockSkewQuarantine {
+		tables = append(tables, expectedTable{name: local(cfg.GetSpansQuarantineTable()), engines: []string{dataEngine}, data: true})
+		distributed = append(distributed, cfg.GetSpansQuarantineTable())
+	}
+	if cfg.Replication {
+		for _, table := range distributed {
+			tables = append(tables, expectedTable{name: table, engines: []string{"Distributed"}})
+		}
+	}
+	return tables
+}
+
+func checkTables(db *sql.DB, cfg Configuration) []CheckResult {
+	rows, err := db.Query(doctorTablesQuery, cfg.Database)
+	if err != nil {
+		return []CheckResult{failedQuery(CheckResult{Check: "tables"}, err)}
+	}
+	defer rows.Close()
+
+	type tableInfo struct {
+		engine     string
+		engineFull string
+	}
+	existing := make(map[clickhousespanstore.TableName]tableInfo)
+	for rows.Next() {
+		var name, engine, engineFull string
+		if err := rows.Scan(&name, &engine, &engineFull); err != nil {
+			return []CheckResult{failedQuery(CheckResult{Check: "tables"}, err)}
+		}
+		existing[clickhousespanstore.TableName(name)] = tableInfo{engine: engine, engineFull: engineFull}
+	}
+	if err := rows.Err(); err != nil {
+		return []CheckResult{failedQuery(CheckResult{Check: "tables"}, err)}
+	}
+
+	var results []CheckResult
+	for _, table := range expectedTables(cfg) {
+		check := fmt.Sprintf("table %s", table.name)
+		info, ok := existing[table.name]
+		if !ok {
+			results = append(results, CheckResult{
+				Check:   check,
+				Status:  CheckFailed,
+				Message: "table does not exist",
+				Advice:  "Start the plugin once without init_sql_scripts_dir to create the tables, or create them with the scripts from the sqlscripts directory.",
+			})
+			continue
+		}
+		if !hasEngine(info.engine, table.engines) {
+			results = append(results, CheckResult{
+				Check:   check,
+				Status:  CheckFailed,
+				Message: fmt.Sprintf("unexpected engine %s, expected %s", info.engine, strings.Join(table.engines, " or ")),
+				Advice:  "Check that the replication option matches how the tables were created.",
+			})
+			continue
+		}
+		if table.data {
+			results = append(results, checkTTL(check, table.name, info.engineFull, cfg.TTLDays))
+			continue
+		}
+		results = append(results, CheckResult{Check: check, Status: CheckOK, Message: fmt.Sprintf("engine %s", info.engine)})
+	}
+	return results
+}
+
+func hasEngine(engine string, engines []string) bool {
+	for _, expected := range engines {
+		if engine == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func checkTTL(check string, table clickhousespanstore.TableName, engineFull string, ttlDays uint) CheckResult {
+	hasTTL := strings.Contains(engineFull, " TTL ")
+	switch {
+	case ttlDays > 0 && !hasTTL:
+		return CheckResult{
+			Check:   check,
+			Status:  CheckWarning,
+			Message: fmt.Sprintf("ttl is set to %d days, but the table has no TTL", ttlDays),
+			Advice:  fmt.Sprintf("Run ALTER TABLE %s MODIFY TTL timestamp + INTERVAL %d DAY DELETE", table, ttlDays),
+		}
+	case ttlDays == 0 && hasTTL:
+		return CheckResult{
+			Check:   check,
+			Status:  CheckWarning,
+			Message: "ttl is not set, but the table has TTL",
+			Advice:  "Set ttl in the configuration to document how long spans are kept.",
+		}
+	default:
+		return CheckResult{Check: check, Status: CheckOK, Message: "engine and TTL match the configuration"}
+	}
+}
+
+func checkParts(db *sql.DB, cfg Configuration) CheckResult {
+	result := CheckResult{Check: "parts"}
+	rows, err := db.Query(doctorPartsQuery, cfg.Database, maxPartsPerPartition)
+	if err != nil {
+		return failedQuery(result, err)
+	}
+	defer rows.Close()
+
+	var partitions []string
+	for rows.Next() {
+		var (
+			table, partition string
+			count            uint64
+		)
+		if err := rows.Scan(&table, &partition, &count); err != nil {
+			return failedQuery(result, err)
+		}
+		partitions = append(partitions, fmt.Sprintf("%s partition %s has %d parts", table, partition, count))
+	}
+	if err := rows.Err(); err != nil {
+		return failedQuery(result, err)
+	}
+
+	if len(partitions) > 0 {
+		result.Status = CheckWarning
+		result.Message = strings.Join(partitions, ", ")
+		result.Advice = "Inserts will be delayed soon. Increase batch_write_size or batch_flush_interval to insert less often."
+		return result
+	}
+	result.Status = CheckOK
+	result.Message = fmt.Sprintf("no partition has more than %d active parts", maxPartsPerPartition)
+	return result
+}
+
+func checkReplication(db *sql.DB, cfg Configuration) []CheckResult {
+	queue := CheckResult{Check: "replication queue"}
+	tables, err := queryTableCounts(db, doctorReplicationQueueQuery, cfg.Database, maxReplicationQueueSize)
+	switch {
+	case err != nil:
+		queue = failedQuery(queue, err)
+	case len(tables) > 0:
+		queue.Status = CheckWarning
+		queue.Message = fmt.Sprintf("replication queue is longer than %d for %s", maxReplicationQueueSize, strings.Join(tables, ", "))
+		queue.Advice = "Check system.replication_queue for errors and ZooKeeper availability."
+	default:
+		queue.Status = CheckOK
+		queue.Message = "replicas are in sync"
+	}
+
+	readonly := CheckResult{Check: "readonly replicas"}
+	tables, err = queryStrings(db, doctorReadonlyReplicasQuery, cfg.Database)
+	switch {
+	case err != nil:
+		readonly = failedQuery(readonly, err)
+	case len(tables) > 0:
+		readonly.Status = CheckFailed
+		readonly.Message = fmt.Sprintf("replicas of %s are readonly", strings.Join(tables, ", "))
+		readonly.Advice = "Check the connection of the node to ZooKeeper, spans cannot be written to readonly replicas."
+	default:
+		readonly.Status = CheckOK
+		readonly.Message = "no replica is readonly"
+	}
+	return []CheckResult{queue, readonly}
+}
+
+func checkGrants(db *sql.DB, cfg Configuration) CheckResult {
+	result := CheckResult{Check: "grants"}
+	grants, err := queryStrings(db, doctorGrantsQuery)
+	if err != nil {
+		return failedQuery(result, err)
+	}
+
+	var missing []string
+	for _, privilege := range []string{"SELECT", "INSERT"} {
+		if !hasGrant(grants, privilege, cfg.Database) {
+			missing = append(missing, privilege)
+		}
+	}
+	if len(missing) > 0 {
+		result.Status = CheckWarning
+		result.Message = fmt.Sprintf("could not find %s grants of user %s on database %s", strings.Join(missing, " and "), cfg.Username, cfg.Database)
+		result.Advice = fmt.Sprintf("Run GRANT %s ON %s.* TO %s, unless the privileges are granted via roles.", strings.Join(missing, ", "), cfg.Database, cfg.Username)
+		return result
+	}
+	result.Status = CheckOK
+	result.Message = fmt.Sprintf("user %s can read and write database %s", cfg.Username, cfg.Database)
+	return result
+}
+
+// hasGrant returns whether any of SHOW GRANTS statements grants privilege on the whole database
+func hasGrant(grants []string, privilege, database string) bool {
+	for _, grant := range grants {
+		on := strings.LastIndex(grant, " ON ")
+		if on < 0 {
+			continue
+		}
+		privileges, target := grant[:on], strings.Fields(grant[on+len(" ON "):])
+		if len(target) == 0 || (target[0] != "*.*" && target[0] != database+".*") {
+			continue
+		}
+		if strings.HasPrefix(privileges, "GRANT ALL") {
+			return true
+		}
+		for _, granted := range strings.Split(strings.TrimPrefix(privileges, "GRANT "), ",") {
+			if strings.HasPrefix(strings.TrimSpace(granted), privilege) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func queryTableCounts(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var (
+			table string
+			count uint64
+		)
+		if err := rows.Scan(&table, &count); err != nil {
+			return nil, err
+		}
+		tables = append(tables, fmt.Sprintf("%s (%d)", table, count))
+	}
+	return tables, rows.Err()
+}
+
+func failedQuery(result CheckResult, err error) CheckResult {
+	result.Status = CheckFailed
+	result.Message = fmt.Sprintf("could not run the check: %s", err)
+	result.Advice = "Check that the user may read system tables."
+	return result
+}
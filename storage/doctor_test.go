@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestDoctor_checkVersion(t *testing.T) {
+	tests := map[string]struct {
+		version        string
+		expectedStatus CheckStatus
+	}{
+		"supported":   {version: "21.8.3.44", expectedStatus: CheckOK},
+		"unsupported": {version: "20.3.1", expectedStatus: CheckFailed},
+		"unparsable":  {version: "unknown", expectedStatus: CheckWarning},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery(doctorVersionQuery).WillReturnRows(sqlmock.NewRows([]string{"version()"}).AddRow(test.version))
+			assert.Equal(t, test.expectedStatus, checkVersion(db).Status)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDoctor_checkTables(t *testing.T) {
+	ttlEngine := "MergeTree PARTITION BY toDate(timestamp) ORDER BY service TTL timestamp + toIntervalDay(3) SETTINGS index_granularity = 1024"
+	noTTLEngine := "MergeTree PARTITION BY toDate(timestamp) ORDER BY service SETTINGS index_granularity = 1024"
+	tests := map[string]struct {
+		config         Configuration
+		rows           *sqlmock.Rows
+		expectedStatus map[string]CheckStatus
+	}{
+		"healthy": {
+			config: Configuration{TTLDays: 3},
+			rows: sqlmock.NewRows([]string{"name", "engine", "engine_full"}).
+				AddRow("jaeger_spans_local", "MergeTree", ttlEngine).
+				AddRow("jaeger_index_local", "MergeTree", ttlEngine).
+				AddRow("jaeger_spans_archive_local", "MergeTree", ttlEngine).
+				AddRow("jaeger_operations_local", "MaterializedView", ""),
+			expectedStatus: map[string]CheckStatus{
+				"table jaeger_spans_local":         CheckOK,
+				"table jaeger_index_local":         CheckOK,
+				"table jaeger_spans_archive_local": CheckOK,
+				"table jaeger_operations_local":    CheckOK,
+			},
+		},
+		"problems": {
+			config: Configuration{TTLDays: 3},
+			rows: sqlmock.NewRows([]string{"name", "engine", "engine_full"}).
+				AddRow("jaeger_spans_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_index_local", "Log", "Log").
+				AddRow("jaeger_operations_local", "MaterializedView", ""),
+			expectedStatus: map[string]CheckStatus{
+				"table jaeger_spans_local":         CheckWarning,
+				"table jaeger_index_local":         CheckFailed,
+				"table jaeger_spans_archive_local": CheckFailed,
+				"table jaeger_operations_local":    CheckOK,
+			},
+		},
+		"replication": {
+			config: Configuration{Replication: true},
+			rows: sqlmock.NewRows([]string{"name", "engine", "engine_full"}).
+				AddRow("jaeger_spans_local", "ReplicatedMergeTree", noTTLEngine).
+				AddRow("jaeger_index_local", "ReplicatedMergeTree", noTTLEngine).
+				AddRow("jaeger_spans_archive_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_operations_local", "MaterializedView", "").
+				AddRow("jaeger_spans", "Distributed", "").
+				AddRow("jaeger_index", "Distributed", "").
+				AddRow("jaeger_spans_archive", "Distributed", "").
+				AddRow("jaeger_operations", "Distributed", ""),
+			expectedStatus: map[string]CheckStatus{
+				"table jaeger_spans_local":         CheckOK,
+				"table jaeger_index_local":         CheckOK,
+				"table jaeger_spans_archive_local": CheckFailed,
+				"table jaeger_operations_local":    CheckOK,
+				"table jaeger_spans":               CheckOK,
+				"table jaeger_index":               CheckOK,
+				"table jaeger_spans_archive":       CheckOK,
+				"table jaeger_operations":          CheckOK,
+			},
+		},
+		"written operations": {
+			config: Configuration{WriteOperations: true},
+			rows: sqlmock.NewRows([]string{"name", "engine", "engine_full"}).
+				AddRow("jaeger_spans_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_index_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_spans_archive_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_operations_local", "MaterializedView", ""),
+			expectedStatus: map[string]CheckStatus{
+				"table jaeger_spans_local":         CheckOK,
+				"table jaeger_index_local":         CheckOK,
+				"table jaeger_spans_archive_local": CheckOK,
+				"table jaeger_operations_local":    CheckFailed,
+			},
+		},
+		"table rotation": {
+			config: Configuration{TableRotation: clickhousespanstore.RotationMonthly},
+			rows: sqlmock.NewRows([]string{"name", "engine", "engine_full"}).
+				AddRow("jaeger_spans_local", "Merge", "").
+				AddRow("jaeger_index_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_spans_archive_local", "MergeTree", noTTLEngine).
+				AddRow("jaeger_operations_local", "SummingMergeTree", ""),
+			expectedStatus: map[string]CheckStatus{
+				"table jaeger_spans_local":         CheckOK,
+				"table jaeger_index_local":         CheckFailed,
+				"table jaeger_spans_archive_local": CheckOK,
+				"table jaeger_operations_local":    CheckOK,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err)
+			defer db.Close()
+
+			test.config.setDefaults()
+			mock.ExpectQuery(doctorTablesQuery).WithArgs(test.config.Database).WillReturnRows(test.rows)
+
+			statuses := make(map[string]CheckStatus)
+			for _, result := range checkTables(db, test.config) {
+				statuses[result.Check] = result.Status
+			}
+			assert.Equal(t, test.expectedStatus, statuses)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDoctor_checkParts(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(doctorPartsQuery).
+		WithArgs(defaultDatabaseName, maxPartsPerPartition).
+		WillReturnRows(sqlmock.NewRows([]string{"table", "partition", "count()"}).AddRow("jaeger_index_local", "2021-08-01", uint64(200)))
+
+	result := checkParts(db, Configuration{Database: defaultDatabaseName})
+	assert.Equal(t, CheckWarning, result.Status)
+	assert.Equal(t, "jaeger_index_local partition 2021-08-01 has 200 parts", result.Message)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDoctor_checkReplication(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(doctorReplicationQueueQuery).
+		WithArgs(defaultDatabaseName, maxReplicationQueueSize).
+		WillReturnRows(sqlmock.NewRows([]string{"table", "count()"}))
+	mock.ExpectQuery(doctorReadonlyReplicasQuery).
+		WithArgs(defaultDatabaseName).
+		WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("jaeger_spans_local"))
+
+	results := checkReplication(db, Configuration{Database: defaultDatabaseName})
+	require.Len(t, results, 2)
+	assert.Equal(t, CheckOK, results[0].Status)
+	assert.Equal(t, CheckFailed, results[1].Status)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDoctor_hasGrant(t *testing.T) {
+	tests := map[string]struct {
+		grants   []string
+		expected bool
+	}{
+		"all":             {grants: []string{"GRANT ALL ON *.* TO default"}, expected: true},
+		"database":        {grants: []string{"GRANT SELECT, INSERT ON jaeger.* TO jaeger"}, expected: true},
+		"column level":    {grants: []string{"GRANT SELECT(traceID), INSERT ON jaeger.* TO jaeger"}, expected: true},
+		"other database":  {grants: []string{"GRANT INSERT ON other.* TO jaeger"}},
+		"other privilege": {grants: []string{"GRANT SELECT ON jaeger.* TO jaeger"}},
+		"role":            {grants: []string{"GRANT writer TO jaeger"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, hasGrant(test.grants, "INSERT", "jaeger"))
+		})
+	}
+}
+
+func TestDoctor_checkQueryError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(doctorGrantsQuery).WillReturnError(errorMock)
+	result := checkGrants(db, Configuration{})
+	assert.Equal(t, CheckFailed, result.Status)
+	assert.Equal(t, "could not run the check: error mock", result.Message)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDoctor_WriteDoctorReport(t *testing.T) {
+	var report bytes.Buffer
+	healthy, err := WriteDoctorReport(&report, []CheckResult{
+		{Check: "version", Status: CheckOK, Message: "ClickHouse 21.8 is supported"},
+		{Check: "table jaeger_spans_local", Status: CheckFailed, Message: "table does not exist", Advice: "Create it."},
+	})
+	require.NoError(t, err)
+	assert.False(t, healthy)
+	assert.Equal(t,
+		"[OK] version: ClickHouse 21.8 is supported\n"+
+			"[FAIL] table jaeger_spans_local: table does not exist\n"+
+			"    Create it.\n",
+		report.String(),
+	)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// ExportParams select spans to export
+type ExportParams struct {
+	Format clickhousespanstore.ExportFormat
+	// Spans started at or after Start and before End are exported
+	Start time.Time
+	End   time.Time
+	// Tenant whose spans are exported when multi_tenant is enabled, spans of all tenants are exported if empty
+	Tenant string
+	// Whether spans are exported from the archive table
+	Archive bool
+}
+
+// Export connects to ClickHouse and writes spans to w, it returns the number of exported spans.
+// Unlike NewStore, it does not run init scripts.
+func Export(ctx context.Context, logger hclog.Logger, cfg Configuration, w io.Writer, params ExportParams) (int, error) {
+	cfg.setDefaults()
+	if params.Archive && !cfg.ArchiveEnabled() {
+		return 0, fmt.Errorf("archive is disabled")
+	}
+	if params.Tenant != "" && !cfg.MultiTenant {
+		return 0, fmt.Errorf("tenant can be exported only when multi_tenant is enabled")
+	}
+
+	db, err := connector(logger, cfg, cfg.Settings.Read)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect to database: %q", err)
+	}
+	defer db.Close()
+
+	table := cfg.SpansTable
+	if params.Archive {
+		table = cfg.GetSpansArchiveTable()
+	}
+	var opts []clickhousespanstore.ExporterOption
+	if params.Tenant != "" {
+		opts = append(opts, clickhousespanstore.WithExportTenant(params.Tenant))
+	}
+	if cfg.DeduplicateProcesses {
+		opts = append(opts, clickhousespanstore.WithExportProcessesTable(cfg.ProcessesTable))
+	}
+	return clickhousespanstore.NewExporter(db, table, opts...).Export(ctx, w, params.Format, params.Start, params.End)
+}
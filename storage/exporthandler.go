@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// exportFlushRows is the number of exported index rows after which they are sent to the client
+const exportFlushRows = 1000
+
+var exportContentTypes = map[clickhousespanstore.ExportFormat]string{
+	clickhousespanstore.ExportCSV: "text/csv",
+	clickhousespanstore.ExportTSV: "text/tab-separated-values",
+}
+
+// ExportHandler streams index rows of spans matching a search on GET as CSV or TSV with traceID, service, operation,
+// durationUs and timestamp columns, for offline analysis. Like Jaeger query API, it accepts service, operation,
+// start and end in microseconds, minDuration, maxDuration, tags as a JSON object and limit query parameters.
+// The as_of query parameter, a time in RFC 3339 format, exports spans as they were stored at that time.
+// The format query parameter is either csv, the default, or tsv. The tenant is taken from the HTTP header
+// with the same name as the gRPC metadata key.
+func (s *Store) ExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reader, ok := s.reader.(*clickhousespanstore.TraceReader)
+		if !ok {
+			http.Error(w, "export of index rows is not supported by the reader", http.StatusNotFound)
+			return
+		}
+		format := clickhousespanstore.ExportFormat(r.URL.Query().Get("format"))
+		if format == "" {
+			format = clickhousespanstore.ExportCSV
+		}
+		rowWriter, err := clickhousespanstore.NewIndexRowWriter(w, format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params, err := parseSearchParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Headers are sent with the first row, so that failed queries are answered with errors
+		rows := 0
+		err = reader.ExportIndexRows(s.requestContext(r), params, func(row clickhousespanstore.IndexRow) error {
+			if rows == 0 {
+				setExportHeaders(w, format)
+			}
+			if err := rowWriter.Write(row); err != nil {
+				return err
+			}
+			if rows++; rows%exportFlushRows == 0 {
+				if err := rowWriter.Flush(); err != nil {
+					return err
+				}
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, clickhousespanstore.ErrUnsupportedExportSearch):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil && rows == 0:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case err == nil:
+			if rows == 0 {
+				setExportHeaders(w, format)
+			}
+			_ = rowWriter.Flush()
+		}
+		// Rows of a failed export are not flushed, so that the response is cut short instead of looking complete
+	})
+}
+
+func setExportHeaders(w http.ResponseWriter, format clickhousespanstore.ExportFormat) {
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"spans.%s\"", format))
+}
+
+// parseSearchParams returns the search of the query parameters of the request
+func parseSearchParams(r *http.Request) (*spanstore.TraceQueryParameters, error) {
+	query := r.URL.Query()
+	params := &spanstore.TraceQueryParameters{
+		ServiceName:   query.Get("service"),
+		OperationName: query.Get("operation"),
+		Tags:          map[string]string{},
+	}
+	var err error
+	if params.StartTimeMin, err = parseMicros(query.Get("start")); err != nil || params.StartTimeMin.IsZero() {
+		return nil, errors.New("start in microseconds since epoch is required")
+	}
+	if params.StartTimeMax, err = parseMicros(query.Get("end")); err != nil {
+		return nil, errors.New("invalid end, expected microseconds since epoch")
+	}
+	for name, duration := range map[string]*time.Duration{"minDuration": &params.DurationMin, "maxDuration": &params.DurationMax} {
+		if value := query.Get(name); value != "" {
+			if *duration, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, value)
+			}
+		}
+	}
+	if value := query.Get("tags"); value != "" {
+		if err := json.Unmarshal([]byte(value), &params.Tags); err != nil {
+			return nil, fmt.Errorf("invalid tags, expected a JSON object: %w", err)
+		}
+	}
+	if value := query.Get("as_of"); value != "" {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("invalid as_of %q, expected a time in RFC 3339 format", value)
+		}
+		params.Tags[clickhousespanstore.AsOfTag] = value
+	}
+	if value := query.Get("limit"); value != "" {
+		if params.NumTraces, err = strconv.Atoi(value); err != nil || params.NumTraces < 0 {
+			return nil, fmt.Errorf("invalid limit %q", value)
+		}
+	}
+	return params, nil
+}
+
+// parseMicros parses microseconds since epoch, the zero time if the value is empty
+func parseMicros(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	micros, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, micros*int64(time.Microsecond)), nil
+}
+
+// requestContext returns the context of the request with the tenant from HTTP headers
+func (s *Store) requestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	md := metadata.MD{}
+	for _, header := range s.requestHeaders {
+		md.Set(header, r.Header.Get(header))
+	}
+	if len(md) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	return ctx
+}
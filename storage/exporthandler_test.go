@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestStore_ExportHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Hour)
+	mock.ExpectQuery("SELECT traceID, service, operation, durationUs, timestamp FROM test_index_table"+
+		" PREWHERE durationUs >= ? WHERE tenant = ? AND service = ? AND timestamp >= ? AND timestamp <= ? LIMIT ?").
+		WithArgs(int64(1000000), "tenant_1", "frontend", start, end, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "service", "operation", "durationUs", "timestamp"}).
+			AddRow("1a", "frontend", "GET /", uint64(1500000), start).
+			AddRow("2b", "frontend", "GET /dispatch", uint64(2000000), start.Add(time.Minute)))
+
+	reader := clickhousespanstore.NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		clickhousespanstore.WithReaderTenantHeader("x-tenant"))
+	handler := (&Store{reader: reader, requestHeaders: []string{"x-tenant"}}).ExportHandler()
+
+	request := httptest.NewRequest(http.MethodGet,
+		"/api/export?service=frontend&start=1628000000000000&end=1628003600000000&minDuration=1s&limit=2", nil)
+	request.Header.Set("x-tenant", "tenant_1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "traceID,service,operation,durationUs,timestamp\n"+
+		"000000000000001a,frontend,GET /,1500000,2021-08-03T14:13:20Z\n"+
+		"000000000000002b,frontend,GET /dispatch,2000000,2021-08-03T14:14:20Z\n", recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_ExportHandlerErrors(t *testing.T) {
+	handler := (&Store{reader: clickhousespanstore.NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)}).ExportHandler()
+	tests := map[string]struct {
+		method       string
+		target       string
+		expectedCode int
+	}{
+		"wrong method":    {method: http.MethodPost, target: "/?start=1", expectedCode: http.StatusMethodNotAllowed},
+		"no start":        {method: http.MethodGet, target: "/", expectedCode: http.StatusBadRequest},
+		"unknown format":  {method: http.MethodGet, target: "/?start=1&format=parquet", expectedCode: http.StatusBadRequest},
+		"invalid tags":    {method: http.MethodGet, target: "/?start=1&tags=error", expectedCode: http.StatusBadRequest},
+		"invalid as of":   {method: http.MethodGet, target: "/?start=1&as_of=yesterday", expectedCode: http.StatusBadRequest},
+		"invalid limit":   {method: http.MethodGet, target: "/?start=1&limit=-1", expectedCode: http.StatusBadRequest},
+		"trace ID prefix": {method: http.MethodGet, target: `/?start=1&tags={"trace.id_prefix":"1a"}`, expectedCode: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	primaryCluster int32 = iota
+	secondaryCluster
+)
+
+var clusterNames = map[int32]string{
+	primaryCluster:   "primary",
+	secondaryCluster: "secondary",
+}
+
+var (
+	failoverActiveCluster = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_failover_active_cluster",
+		Help: "ClickHouse cluster the plugin is connected to, 0 for primary and 1 for secondary",
+	})
+	failoverSwitches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_failover_switches_total",
+		Help: "Number of switches between primary and secondary ClickHouse clusters",
+	})
+	failoverProbeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_failover_probe_failures_total",
+		Help: "Number of failed health probes of ClickHouse clusters",
+	}, []string{"cluster"})
+)
+
+var registerFailoverMetrics sync.Once
+
+// dsnDriver opens driver connections with a function, e.g. clickhouse.Open
+type dsnDriver func(dsn string) (driver.Conn, error)
+
+func (d dsnDriver) Open(dsn string) (driver.Conn, error) {
+	return d(dsn)
+}
+
+// failoverConnector connects to the primary ClickHouse cluster while it is healthy and to the secondary one otherwise.
+// Health of both clusters is probed in the background. After failureThreshold consecutive failed probes of the primary
+// cluster, new connections are opened to the secondary cluster, after recoveryThreshold consecutive successful probes
+// they are opened to the primary cluster again. Pooled connections to the inactive cluster are discarded,
+// so both writes, including retries of queued batches, and reads follow the active cluster.
+type failoverConnector struct {
+	logger hclog.Logger
+	driver driver.Driver
+	dsns   [2]string
+
+	probeInterval     time.Duration
+	failureThreshold  int
+	recoveryThreshold int
+
+	active             int32
+	primaryFailures    int
+	primarySuccesses   int
+	secondaryReachable bool
+	probeDone          chan struct{}
+	closeOnce          sync.Once
+}
+
+var (
+	_ driver.Connector = (*failoverConnector)(nil)
+	_ io.Closer        = (*failoverConnector)(nil)
+)
+
+func newFailoverConnector(
+	logger hclog.Logger,
+	drv driver.Driver,
+	primaryDSN,
+	secondaryDSN string,
+	cfg FailoverConfiguration,
+) *failoverConnector {
+	registerFailoverMetrics.Do(func() {
+		prometheus.MustRegister(failoverActiveCluster)
+		prometheus.MustRegister(failoverSwitches)
+		prometheus.MustRegister(failoverProbeFailures)
+	})
+
+	c := &failoverConnector{
+		logger:            logger,
+		driver:            drv,
+		dsns:              [2]string{primaryDSN, secondaryDSN},
+		probeInterval:     cfg.ProbeInterval,
+		failureThreshold:  cfg.FailureThreshold,
+		recoveryThreshold: cfg.RecoveryThreshold,
+		probeDone:         make(chan struct{}),
+	}
+	// Start on the secondary cluster only if the primary one is down and the secondary one is not
+	if c.ping(primaryCluster) != nil && c.ping(secondaryCluster) == nil {
+		c.switchTo(secondaryCluster)
+	}
+	failoverActiveCluster.Set(float64(c.activeCluster()))
+	return c
+}
+
+// Start probes health of the clusters until the connector is closed
+func (c *failoverConnector) Start() {
+	go func() {
+		ticker := time.NewTicker(c.probeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.probeDone:
+				return
+			case <-ticker.C:
+				c.probe()
+			}
+		}
+	}()
+}
+
+func (c *failoverConnector) probe() {
+	c.secondaryReachable = c.ping(secondaryCluster) == nil
+	if err := c.ping(primaryCluster); err != nil {
+		c.primaryFailures++
+		c.primarySuccesses = 0
+		if c.activeCluster() == primaryCluster && c.primaryFailures >= c.failureThreshold {
+			if !c.secondaryReachable {
+				c.logger.Warn("Primary cluster is down, but secondary cluster is not reachable", "error", err)
+				return
+			}
+			c.logger.Warn("Primary cluster is down, switching to secondary cluster", "error", err)
+			c.switchTo(secondaryCluster)
+		}
+		return
+	}
+
+	c.primaryFailures = 0
+	c.primarySuccesses++
+	if c.activeCluster() == secondaryCluster && c.primarySuccesses >= c.recoveryThreshold {
+		c.logger.Info("Primary cluster recovered, switching back to primary cluster")
+		c.switchTo(primaryCluster)
+	}
+}
+
+func (c *failoverConnector) ping(cluster int32) error {
+	err := c.pingDSN(c.dsns[cluster])
+	if err != nil {
+		failoverProbeFailures.WithLabelValues(clusterNames[cluster]).Inc()
+		c.logger.Debug("Health probe failed", "cluster", clusterNames[cluster], "error", err)
+	}
+	return err
+}
+
+func (c *failoverConnector) pingDSN(dsn string) error {
+	conn, err := c.driver.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if pinger, ok := conn.(driver.Pinger); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), c.probeInterval)
+		defer cancel()
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *failoverConnector) switchTo(cluster int32) {
+	atomic.StoreInt32(&c.active, cluster)
+	failoverSwitches.Inc()
+	failoverActiveCluster.Set(float64(cluster))
+}
+
+func (c *failoverConnector) activeCluster() int32 {
+	return atomic.LoadInt32(&c.active)
+}
+
+func (c *failoverConnector) Connect(context.Context) (driver.Conn, error) {
+	cluster := c.activeCluster()
+	conn, err := c.driver.Open(c.dsns[cluster])
+	if err != nil {
+		return nil, err
+	}
+	return &failoverConn{Conn: conn, cluster: cluster, connector: c}, nil
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close stops health probes, it is called when the database is closed
+func (c *failoverConnector) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.probeDone)
+	})
+	return nil
+}
+
+// failoverConn is a connection to one of the clusters, it becomes invalid when the other cluster gets active
+type failoverConn struct {
+	driver.Conn
+	cluster   int32
+	connector *failoverConnector
+}
+
+var (
+	_ driver.Validator          = (*failoverConn)(nil)
+	_ driver.ConnPrepareContext = (*failoverConn)(nil)
+	_ driver.ConnBeginTx        = (*failoverConn)(nil)
+	_ driver.ExecerContext      = (*failoverConn)(nil)
+	_ driver.NamedValueChecker  = (*failoverConn)(nil)
+	_ driver.Pinger             = (*failoverConn)(nil)
+)
+
+func (c *failoverConn) IsValid() bool {
+	if c.cluster != c.connector.activeCluster() {
+		return false
+	}
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *failoverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *failoverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck // fallback for drivers without BeginTx
+}
+
+func (c *failoverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := c.Conn.(driver.ExecerContext); ok {
+		return execer.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *failoverConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func (c *failoverConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
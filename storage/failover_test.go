@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const (
+	testPrimaryDSN   = "tcp://primary:9000"
+	testSecondaryDSN = "tcp://secondary:9000"
+)
+
+// fakeDriver opens connections to DSNs that are not marked as down
+type fakeDriver struct {
+	mutex sync.Mutex
+	down  map[string]bool
+}
+
+type fakeConn struct {
+	driver.Conn
+	dsn string
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.down[dsn] {
+		return nil, errorMock
+	}
+	return &fakeConn{dsn: dsn}, nil
+}
+
+func (d *fakeDriver) setDown(dsn string, down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down[dsn] = down
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func newTestFailoverConnector(logger hclog.Logger, drv *fakeDriver) *failoverConnector {
+	return newFailoverConnector(logger, drv, testPrimaryDSN, testSecondaryDSN, FailoverConfiguration{
+		ProbeInterval:     defaultProbeInterval,
+		FailureThreshold:  2,
+		RecoveryThreshold: 2,
+	})
+}
+
+func TestFailoverConnector_StartCluster(t *testing.T) {
+	tests := map[string]struct {
+		down            []string
+		expectedCluster int32
+	}{
+		"all up":         {expectedCluster: primaryCluster},
+		"primary down":   {down: []string{testPrimaryDSN}, expectedCluster: secondaryCluster},
+		"secondary down": {down: []string{testSecondaryDSN}, expectedCluster: primaryCluster},
+		"all down":       {down: []string{testPrimaryDSN, testSecondaryDSN}, expectedCluster: primaryCluster},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			drv := &fakeDriver{down: map[string]bool{}}
+			for _, dsn := range test.down {
+				drv.setDown(dsn, true)
+			}
+			connector := newTestFailoverConnector(mocks.NewSpyLogger(), drv)
+			assert.Equal(t, test.expectedCluster, connector.activeCluster())
+		})
+	}
+}
+
+func TestFailoverConnector_Probe(t *testing.T) {
+	drv := &fakeDriver{down: map[string]bool{}}
+	spyLogger := mocks.NewSpyLogger()
+	connector := newTestFailoverConnector(spyLogger, drv)
+
+	conn, err := connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testPrimaryDSN, conn.(*failoverConn).Conn.(*fakeConn).dsn)
+	assert.True(t, conn.(driver.Validator).IsValid())
+
+	drv.setDown(testPrimaryDSN, true)
+	connector.probe()
+	assert.Equal(t, primaryCluster, connector.activeCluster(), "single failure does not switch the cluster")
+	connector.probe()
+	assert.Equal(t, secondaryCluster, connector.activeCluster())
+	assert.False(t, conn.(driver.Validator).IsValid(), "connections to the inactive cluster are discarded")
+
+	conn, err = connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testSecondaryDSN, conn.(*failoverConn).Conn.(*fakeConn).dsn)
+
+	drv.setDown(testPrimaryDSN, false)
+	connector.probe()
+	assert.Equal(t, secondaryCluster, connector.activeCluster(), "single success does not switch the cluster back")
+	connector.probe()
+	assert.Equal(t, primaryCluster, connector.activeCluster())
+	assert.False(t, conn.(driver.Validator).IsValid())
+
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{{
+		Msg:  "Primary cluster is down, switching to secondary cluster",
+		Args: []interface{}{"error", errorMock},
+	}})
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Info, []mocks.LogMock{{Msg: "Primary cluster recovered, switching back to primary cluster"}})
+}
+
+func TestFailoverConnector_ProbeSecondaryDown(t *testing.T) {
+	drv := &fakeDriver{down: map[string]bool{}}
+	spyLogger := mocks.NewSpyLogger()
+	connector := newTestFailoverConnector(spyLogger, drv)
+
+	drv.setDown(testPrimaryDSN, true)
+	drv.setDown(testSecondaryDSN, true)
+	connector.probe()
+	connector.probe()
+	assert.Equal(t, primaryCluster, connector.activeCluster())
+	spyLogger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{{
+		Msg:  "Primary cluster is down, but secondary cluster is not reachable",
+		Args: []interface{}{"error", errorMock},
+	}})
+}
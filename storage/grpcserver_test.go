@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGRPCServerConfiguration_ServerOptions(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tests := map[string]struct {
+		config        GRPCServerConfiguration
+		expectedCount int
+	}{
+		"defaults": {},
+		"limits": {
+			config:        GRPCServerConfiguration{MaxMessageSize: 64 << 20, MaxConcurrentStreams: 100},
+			expectedCount: 3,
+		},
+		"keepalive": {
+			config: GRPCServerConfiguration{
+				KeepaliveTime:                time.Minute,
+				KeepaliveMinTime:             time.Second * 10,
+				KeepalivePermitWithoutStream: true,
+			},
+			expectedCount: 2,
+		},
+		"TLS": {
+			config:        GRPCServerConfiguration{TLSCertFile: certFile, TLSKeyFile: keyFile},
+			expectedCount: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts, err := test.config.ServerOptions()
+			require.NoError(t, err)
+			assert.Len(t, opts, test.expectedCount)
+		})
+	}
+}
+
+func TestGRPCServerConfiguration_tlsConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tlsConfig, err := GRPCServerConfiguration{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: certFile}.tlsConfig()
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	_, err = GRPCServerConfiguration{TLSClientCAFile: certFile}.tlsConfig()
+	assert.EqualError(t, err, "client CA file requires server certificate and key")
+
+	_, err = GRPCServerConfiguration{TLSCertFile: "missing.crt", TLSKeyFile: "missing.key"}.tlsConfig()
+	assert.Error(t, err)
+}
+
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+	return certFile, keyFile
+}
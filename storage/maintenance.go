@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// MaintenanceOperation is an operation run on tables on demand instead of waiting for ClickHouse to run it
+type MaintenanceOperation string
+
+const (
+	// MaintenanceOptimize merges parts of tables with OPTIMIZE TABLE ... FINAL, e.g. to collapse rows of aggregated tables
+	MaintenanceOptimize MaintenanceOperation = "optimize"
+	// MaintenanceMaterializeTTL removes expired rows with ALTER TABLE ... MATERIALIZE TTL, e.g. after TTL was lowered
+	MaintenanceMaterializeTTL MaintenanceOperation = "materialize-ttl"
+	// MaintenanceDropPartitions drops partitions with data only before a time, e.g. to free disk space quickly
+	MaintenanceDropPartitions MaintenanceOperation = "drop-partitions"
+
+	// maintenancePartitionsQuery returns IDs of partitions of a table with data only before a time. Partitions by dates
+	// have bounds in max_date, partitions by times in max_time.
+	maintenancePartitionsQuery = "SELECT DISTINCT partition_id FROM system.parts WHERE database = currentDatabase() AND table = ? AND active" +
+		" AND greatest(toDateTime(max_date), max_time) < ? ORDER BY partition_id"
+)
+
+var (
+	errMaintenanceNotSupported = errors.New("maintenance is not supported with table rotation")
+	errMaintenanceNotConfirmed = errors.New("dropping partitions must be confirmed, run it as a dry run first to see the dropped partitions")
+	// partitionIDPattern matches IDs of partitions, they are written to statements
+	partitionIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+)
+
+// MaintenanceParams select the operation and the partitions it is run on
+type MaintenanceParams struct {
+	Operation MaintenanceOperation
+	// Local tables the operation is run on, all tables storing spans or derived from them if empty
+	Tables []string
+	// ID of the partition optimize and materialize-ttl are run on, e.g. 20210801, all partitions if empty
+	Partition string
+	// Partitions with data only before this time are dropped by drop-partitions
+	Before time.Time
+	// Whether the statements are only returned, not run
+	DryRun bool
+	// Whether partitions are really dropped, drop-partitions fails without confirmation unless it is a dry run
+	Confirm bool
+}
+
+// Maintain connects to ClickHouse and runs the maintenance operation, it returns the run statements.
+// Unlike NewStore, it does not run init scripts.
+func Maintain(ctx context.Context, logger hclog.Logger, cfg Configuration, params MaintenanceParams) ([]string, error) {
+	cfg.setDefaults()
+	db, err := connector(logger, cfg, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %q", err)
+	}
+	defer db.Close()
+
+	return runMaintenance(ctx, db, cfg.dataTables(), cfg.Replication, params)
+}
+
+// Maintain runs the maintenance operation on every node of the cluster with replication, it returns the run statements
+func (s *Store) Maintain(ctx context.Context, params MaintenanceParams) ([]string, error) {
+	return runMaintenance(ctx, s.db, s.dataTables, s.replication, params)
+}
+
+// MaintenanceHandler runs maintenance operations on POST, see MaintenanceParams for the query parameters
+func (s *Store) MaintenanceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		params := MaintenanceParams{
+			Operation: MaintenanceOperation(query.Get("operation")),
+			Tables:    query["table"],
+			Partition: query.Get("partition"),
+			DryRun:    query.Get("dry_run") == "true",
+			Confirm:   query.Get("confirm") == "true",
+		}
+		if before := query.Get("before"); before != "" {
+			var err error
+			if params.Before, err = ParseMaintenanceTime(before); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := params.validate(s.dataTables); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		statements, err := s.Maintain(r.Context(), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"statements": statements, "dryRun": params.DryRun})
+	})
+}
+
+// ParseMaintenanceTime parses either an RFC 3339 time or a date, e.g. 2021-08-01
+func ParseMaintenanceTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a date or an RFC 3339 time", value)
+	}
+	return t, nil
+}
+
+// validate checks the parameters before any statement is run
+func (params *MaintenanceParams) validate(dataTables []clickhousespanstore.TableName) error {
+	if len(dataTables) == 0 {
+		return errMaintenanceNotSupported
+	}
+	for _, table := range params.Tables {
+		if !containsTable(dataTables, table) {
+			return fmt.Errorf("table %q is not maintained, use one of %v", table, dataTables)
+		}
+	}
+	if params.Partition != "" && !partitionIDPattern.MatchString(params.Partition) {
+		return fmt.Errorf("invalid partition ID %q", params.Partition)
+	}
+	switch params.Operation {
+	case MaintenanceOptimize, MaintenanceMaterializeTTL:
+		if !params.Before.IsZero() {
+			return fmt.Errorf("before is used only by %s", MaintenanceDropPartitions)
+		}
+	case MaintenanceDropPartitions:
+		if params.Partition != "" {
+			return fmt.Errorf("partition is not used by %s, partitions are selected by before", MaintenanceDropPartitions)
+		}
+		if params.Before.IsZero() {
+			return fmt.Errorf("%s requires before", MaintenanceDropPartitions)
+		}
+		if !params.DryRun && !params.Confirm {
+			return errMaintenanceNotConfirmed
+		}
+	default:
+		return fmt.Errorf("unknown maintenance operation %q", params.Operation)
+	}
+	return nil
+}
+
+// runMaintenance runs the statements of the operation one by one and returns the run statements, in a dry run
+// partitions to drop are still queried but nothing is changed
+func runMaintenance(
+	ctx context.Context,
+	db *sql.DB,
+	dataTables []clickhousespanstore.TableName,
+	replication bool,
+	params MaintenanceParams,
+) ([]string, error) {
+	if err := params.validate(dataTables); err != nil {
+		return nil, err
+	}
+	onCluster := ""
+	if replication {
+		onCluster = " ON CLUSTER '{cluster}'"
+	}
+
+	var statements []string
+	for _, table := range dataTables {
+		if len(params.Tables) > 0 && !containsString(params.Tables, string(table)) {
+			continue
+		}
+		switch params.Operation {
+		case MaintenanceOptimize:
+			statements = append(statements, fmt.Sprintf("OPTIMIZE TABLE %s%s%s FINAL", table, onCluster, inPartition("PARTITION", params.Partition)))
+		case MaintenanceMaterializeTTL:
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s%s MATERIALIZE TTL%s", table, onCluster, inPartition("IN PARTITION", params.Partition)))
+		case MaintenanceDropPartitions:
+			partitions, err := oldPartitions(ctx, db, table, params.Before)
+			if err != nil {
+				return nil, err
+			}
+			for _, partition := range partitions {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s%s DROP PARTITION ID '%s'", table, onCluster, partition))
+			}
+		}
+	}
+	if params.DryRun {
+		return statements, nil
+	}
+	for i, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return statements[:i], fmt.Errorf("could not run %q: %w", statement, err)
+		}
+	}
+	return statements, nil
+}
+
+// oldPartitions returns IDs of partitions of the table with data only before the time
+func oldPartitions(ctx context.Context, db *sql.DB, table clickhousespanstore.TableName, before time.Time) ([]string, error) {
+	rows, err := db.QueryContext(ctx, maintenancePartitionsQuery, string(table), before)
+	if err != nil {
+		return nil, fmt.Errorf("could not query partitions of table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var partitions []string
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			return nil, err
+		}
+		// Partition IDs are written to statements, they cannot be passed as arguments
+		if !partitionIDPattern.MatchString(partition) {
+			return nil, fmt.Errorf("invalid partition ID %q of table %s", partition, table)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, rows.Err()
+}
+
+// inPartition returns the clause restricting a statement to the partition, empty for all partitions
+func inPartition(clause, partition string) string {
+	if partition == "" {
+		return ""
+	}
+	return fmt.Sprintf(" %s ID '%s'", clause, partition)
+}
+
+func containsTable(tables []clickhousespanstore.TableName, name string) bool {
+	for _, table := range tables {
+		if string(table) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
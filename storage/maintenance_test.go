@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+var testDataTables = []clickhousespanstore.TableName{"jaeger_spans_local", "jaeger_index_local"}
+
+func TestMaintenanceParams_validate(t *testing.T) {
+	before := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		params   MaintenanceParams
+		expected string
+	}{
+		"unknown operation": {
+			params:   MaintenanceParams{Operation: "vacuum"},
+			expected: `unknown maintenance operation "vacuum"`,
+		},
+		"unknown table": {
+			params:   MaintenanceParams{Operation: MaintenanceOptimize, Tables: []string{"system.users"}},
+			expected: `table "system.users" is not maintained, use one of [jaeger_spans_local jaeger_index_local]`,
+		},
+		"invalid partition": {
+			params:   MaintenanceParams{Operation: MaintenanceOptimize, Partition: "2021' SETTINGS x=1"},
+			expected: `invalid partition ID "2021' SETTINGS x=1"`,
+		},
+		"optimize before": {
+			params:   MaintenanceParams{Operation: MaintenanceOptimize, Before: before},
+			expected: "before is used only by drop-partitions",
+		},
+		"drop without before": {
+			params:   MaintenanceParams{Operation: MaintenanceDropPartitions, Confirm: true},
+			expected: "drop-partitions requires before",
+		},
+		"drop not confirmed": {
+			params:   MaintenanceParams{Operation: MaintenanceDropPartitions, Before: before},
+			expected: errMaintenanceNotConfirmed.Error(),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualError(t, test.params.validate(testDataTables), test.expected)
+		})
+	}
+
+	assert.NoError(t, (&MaintenanceParams{Operation: MaintenanceDropPartitions, Before: before, DryRun: true}).validate(testDataTables))
+	assert.Equal(t, errMaintenanceNotSupported, (&MaintenanceParams{Operation: MaintenanceOptimize}).validate(nil))
+}
+
+func TestRunMaintenance(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("optimize", func(t *testing.T) {
+		mock.ExpectExec("OPTIMIZE TABLE jaeger_index_local ON CLUSTER '{cluster}' PARTITION ID '20210801' FINAL").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		statements, err := runMaintenance(context.Background(), db, testDataTables, true, MaintenanceParams{
+			Operation: MaintenanceOptimize,
+			Tables:    []string{"jaeger_index_local"},
+			Partition: "20210801",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"OPTIMIZE TABLE jaeger_index_local ON CLUSTER '{cluster}' PARTITION ID '20210801' FINAL"}, statements)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("materialize ttl", func(t *testing.T) {
+		mock.ExpectExec("ALTER TABLE jaeger_spans_local MATERIALIZE TTL").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ALTER TABLE jaeger_index_local MATERIALIZE TTL").WillReturnError(errorMock)
+		statements, err := runMaintenance(context.Background(), db, testDataTables, false, MaintenanceParams{Operation: MaintenanceMaterializeTTL})
+		assert.EqualError(t, err, `could not run "ALTER TABLE jaeger_index_local MATERIALIZE TTL": `+errorMock.Error())
+		assert.Equal(t, []string{"ALTER TABLE jaeger_spans_local MATERIALIZE TTL"}, statements, "only run statements are returned")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("drop partitions dry run", func(t *testing.T) {
+		before := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(maintenancePartitionsQuery).
+			WithArgs("jaeger_spans_local", before).
+			WillReturnRows(sqlmock.NewRows([]string{"partition_id"}).AddRow("20210730").AddRow("20210731"))
+		mock.ExpectQuery(maintenancePartitionsQuery).
+			WithArgs("jaeger_index_local", before).
+			WillReturnRows(sqlmock.NewRows([]string{"partition_id"}).AddRow("20210731"))
+		statements, err := runMaintenance(context.Background(), db, testDataTables, false, MaintenanceParams{
+			Operation: MaintenanceDropPartitions,
+			Before:    before,
+			DryRun:    true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"ALTER TABLE jaeger_spans_local DROP PARTITION ID '20210730'",
+			"ALTER TABLE jaeger_spans_local DROP PARTITION ID '20210731'",
+			"ALTER TABLE jaeger_index_local DROP PARTITION ID '20210731'",
+		}, statements)
+		assert.NoError(t, mock.ExpectationsWereMet(), "nothing is dropped in a dry run")
+	})
+}
+
+func TestStore_MaintenanceHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	handler := (&Store{db: db, dataTables: testDataTables}).MaintenanceHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/maintenance", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/maintenance?operation=drop-partitions&before=2021-08-01", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/maintenance?operation=optimize&table=jaeger_spans_local&dry_run=true", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"statements": ["OPTIMIZE TABLE jaeger_spans_local FINAL"], "dryRun": true}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestParseMaintenanceTime(t *testing.T) {
+	parsed, err := ParseMaintenanceTime("2021-08-01")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC), parsed)
+
+	parsed, err = ParseMaintenanceTime("2021-08-01T12:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC), parsed)
+
+	_, err = ParseMaintenanceTime("yesterday")
+	assert.EqualError(t, err, `invalid time "yesterday", expected a date or an RFC 3339 time`)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+const defaultMigrationChunkSize = 1000
+
+// MigrationSource reads spans of another backend chunk by chunk
+type MigrationSource interface {
+	// Next returns spans of the chunk following the checkpoint with the checkpoint of the chunk,
+	// io.EOF when there are no more chunks. The empty checkpoint is the beginning.
+	Next(ctx context.Context, checkpoint string) ([]*model.Span, string, error)
+}
+
+// MigrateParams configure writing of migrated spans
+type MigrateParams struct {
+	// MaxSpansPerSecond throttles writes, so that migration does not compete with live writes.
+	// Spans are written as fast as possible if 0.
+	MaxSpansPerSecond int
+	// CheckpointFile keeps the checkpoint of the last written chunk, so that an interrupted migration resumes
+	// after it. Migration starts from the beginning if empty.
+	CheckpointFile string
+	// Tenant the spans are written for when multi_tenant is enabled
+	Tenant string
+}
+
+// Migrate writes spans read from the source to ClickHouse chunk by chunk and returns the number of written spans.
+// The checkpoint of every chunk is saved after the chunk is written, a chunk written again after an interruption
+// is deduplicated by insert_deduplication_window.
+func Migrate(ctx context.Context, logger hclog.Logger, cfg Configuration, source MigrationSource, params MigrateParams) (int, error) {
+	if params.Tenant != "" && !cfg.MultiTenant {
+		return 0, fmt.Errorf("tenant can be migrated only when multi_tenant is enabled")
+	}
+	checkpoint, err := readCheckpoint(params.CheckpointFile)
+	if err != nil {
+		return 0, err
+	}
+
+	store, err := NewStore(logger, cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	writer := store.writer.(*clickhousespanstore.SpanWriter)
+	if cfg.MultiTenant {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(cfg.TenantHeader, params.Tenant))
+	}
+
+	if checkpoint != "" {
+		logger.Info("Resuming migration", "checkpoint", checkpoint)
+	}
+	count := 0
+	start := time.Now()
+	for {
+		spans, next, err := source.Next(ctx, checkpoint)
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("could not read spans after checkpoint %q: %w", checkpoint, err)
+		}
+		if len(spans) > 0 {
+			if err := writer.WriteBatch(ctx, spans); err != nil {
+				return count, fmt.Errorf("could not write spans after checkpoint %q: %w", checkpoint, err)
+			}
+		}
+		count += len(spans)
+		checkpoint = next
+		if err := writeCheckpoint(params.CheckpointFile, checkpoint); err != nil {
+			return count, err
+		}
+		logger.Info("Migrated spans", "count", count, "checkpoint", checkpoint)
+
+		if params.MaxSpansPerSecond > 0 {
+			ahead := time.Duration(count)*time.Second/time.Duration(params.MaxSpansPerSecond) - time.Since(start)
+			select {
+			case <-ctx.Done():
+				return count, ctx.Err()
+			case <-time.After(ahead):
+			}
+		}
+	}
+}
+
+func readCheckpoint(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	checkpoint, err := ioutil.ReadFile(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read checkpoint: %w", err)
+	}
+	return string(checkpoint), nil
+}
+
+// writeCheckpoint replaces the checkpoint file by renaming, so that it is never partially written
+func writeCheckpoint(path, checkpoint string) error {
+	if path == "" {
+		return nil
+	}
+	temporary := path + ".tmp"
+	if err := ioutil.WriteFile(filepath.Clean(temporary), []byte(checkpoint), 0600); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// fileMigrationSource reads spans from lines of a file written by export or in the same format,
+// the checkpoint is the number of read lines
+type fileMigrationSource struct {
+	scanner   *bufio.Scanner
+	format    clickhousespanstore.ExportFormat
+	chunkSize int
+	line      int
+}
+
+// NewFileMigrationSource returns a MigrationSource of spans in r in the format of export, chunks have at least
+// chunkSize spans, except for the last one
+func NewFileMigrationSource(r io.Reader, format clickhousespanstore.ExportFormat, chunkSize int) MigrationSource {
+	if chunkSize <= 0 {
+		chunkSize = defaultMigrationChunkSize
+	}
+	scanner := bufio.NewScanner(r)
+	// Lines of big spans are longer than the default limit of 64KiB
+	scanner.Buffer(nil, 64<<20)
+	return &fileMigrationSource{scanner: scanner, format: format, chunkSize: chunkSize}
+}
+
+func (s *fileMigrationSource) Next(_ context.Context, checkpoint string) ([]*model.Span, string, error) {
+	if checkpoint != "" {
+		skipped, err := strconv.Atoi(checkpoint)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid checkpoint %q: %w", checkpoint, err)
+		}
+		for s.line < skipped && s.scanner.Scan() {
+			s.line++
+		}
+	}
+
+	var spans []*model.Span
+	for len(spans) < s.chunkSize && s.scanner.Scan() {
+		s.line++
+		if len(s.scanner.Bytes()) == 0 {
+			continue
+		}
+		decoded, err := clickhousespanstore.DecodeExportedSpans(s.format, s.scanner.Bytes())
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid line %d: %w", s.line, err)
+		}
+		spans = append(spans, decoded...)
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(spans) == 0 {
+		return nil, "", io.EOF
+	}
+	return spans, strconv.Itoa(s.line), nil
+}
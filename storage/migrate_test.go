@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	uiconverter "github.com/jaegertracing/jaeger/model/converter/json"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+func testMigrationSpan(spanID uint64, service string, start time.Time) *model.Span {
+	return &model.Span{
+		TraceID:       model.NewTraceID(0, spanID),
+		SpanID:        model.NewSpanID(spanID),
+		OperationName: "GET /",
+		StartTime:     start.UTC(),
+		Duration:      time.Millisecond,
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.Int64("http.status_code", 200),
+			model.Bool("error", false),
+			model.Float64("ratio", 0.5),
+			model.Binary("payload", []byte{1, 2}),
+		},
+		Logs:    []model.Log{{Timestamp: start.UTC(), Fields: []model.KeyValue{model.String("event", "retry")}}},
+		Process: model.NewProcess(service, []model.KeyValue{model.String("hostname", "host")}),
+	}
+}
+
+func TestFileMigrationSource(t *testing.T) {
+	start := time.Unix(1628000000, 0)
+	var lines []string
+	for i := uint64(1); i <= 5; i++ {
+		line, err := json.Marshal(testMigrationSpan(i, "frontend", start))
+		require.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+	// Empty lines are skipped
+	input := strings.Join(lines[:2], "\n") + "\n\n" + strings.Join(lines[2:], "\n") + "\n"
+
+	source := NewFileMigrationSource(strings.NewReader(input), clickhousespanstore.ExportNDJSON, 2)
+	spans, checkpoint, err := source.Next(context.Background(), "")
+	require.NoError(t, err)
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "2", checkpoint)
+
+	// A resumed migration skips lines up to the checkpoint
+	source = NewFileMigrationSource(strings.NewReader(input), clickhousespanstore.ExportNDJSON, 2)
+	spans, checkpoint, err = source.Next(context.Background(), checkpoint)
+	require.NoError(t, err)
+	require.Len(t, spans, 2)
+	assert.Equal(t, model.NewSpanID(3), spans[0].SpanID)
+	assert.Equal(t, model.NewSpanID(4), spans[1].SpanID)
+	assert.Equal(t, "5", checkpoint)
+
+	spans, checkpoint, err = source.Next(context.Background(), checkpoint)
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	assert.Equal(t, model.NewSpanID(5), spans[0].SpanID)
+	assert.Equal(t, "6", checkpoint)
+
+	_, _, err = source.Next(context.Background(), checkpoint)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFileMigrationSourceErrors(t *testing.T) {
+	source := NewFileMigrationSource(strings.NewReader("{}\nnot json\n"), clickhousespanstore.ExportNDJSON, 10)
+	_, _, err := source.Next(context.Background(), "")
+	assert.EqualError(t, err, "invalid line 2: invalid character 'o' in literal null (expecting 'u')")
+
+	source = NewFileMigrationSource(strings.NewReader("{}\n"), clickhousespanstore.ExportNDJSON, 10)
+	_, _, err = source.Next(context.Background(), "line")
+	assert.Error(t, err)
+}
+
+func TestMigrationCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	checkpoint, err := readCheckpoint(path)
+	require.NoError(t, err)
+	assert.Equal(t, "", checkpoint)
+
+	require.NoError(t, writeCheckpoint(path, "10"))
+	require.NoError(t, writeCheckpoint(path, "20"))
+	checkpoint, err = readCheckpoint(path)
+	require.NoError(t, err)
+	assert.Equal(t, "20", checkpoint)
+
+	require.NoError(t, writeCheckpoint("", "30"))
+	checkpoint, err = readCheckpoint("")
+	require.NoError(t, err)
+	assert.Equal(t, "", checkpoint)
+}
+
+func TestMigrate_TenantWithoutMultiTenant(t *testing.T) {
+	_, err := Migrate(context.Background(), hclog.NewNullLogger(), Configuration{}, nil, MigrateParams{Tenant: "tenant_1"})
+	assert.EqualError(t, err, "tenant can be migrated only when multi_tenant is enabled")
+}
+
+// fakeJaegerQuery serves traces of the spans started in the searched time range,
+// at most limit traces per search like the Jaeger Query API
+func fakeJaegerQuery(t *testing.T, spans []*model.Span, searches *[]string) *httptest.Server {
+	respond := func(w http.ResponseWriter, data interface{}) {
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/services":
+			respond(w, []string{"backend", "frontend"})
+		case "/api/traces":
+			query := r.URL.Query()
+			start, err := strconv.ParseInt(query.Get("start"), 10, 64)
+			require.NoError(t, err)
+			end, err := strconv.ParseInt(query.Get("end"), 10, 64)
+			require.NoError(t, err)
+			limit, err := strconv.Atoi(query.Get("limit"))
+			require.NoError(t, err)
+			*searches = append(*searches, fmt.Sprintf("%s %d-%d", query.Get("service"), start, end))
+
+			traces := make(map[model.TraceID]*model.Trace)
+			var ordered []*model.Trace
+			for _, span := range spans {
+				micros := int64(model.TimeAsEpochMicroseconds(span.StartTime))
+				if span.Process.ServiceName != query.Get("service") || micros < start || micros > end {
+					continue
+				}
+				if traces[span.TraceID] == nil && len(ordered) < limit {
+					traces[span.TraceID] = &model.Trace{}
+					ordered = append(ordered, traces[span.TraceID])
+				}
+			}
+			// Traces contain spans of all services and time ranges
+			for _, span := range spans {
+				if trace := traces[span.TraceID]; trace != nil {
+					trace.Spans = append(trace.Spans, span)
+				}
+			}
+			data := make([]*uimodel.Trace, 0, len(ordered))
+			for _, trace := range ordered {
+				data = append(data, uiconverter.FromDomain(trace))
+			}
+			respond(w, data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			respond(w, nil)
+		}
+	}))
+}
+
+func TestQueryMigrationSource(t *testing.T) {
+	start := time.Unix(1628000000, 0)
+	root := testMigrationSpan(1, "frontend", start)
+	child := testMigrationSpan(2, "backend", start.Add(time.Minute))
+	child.TraceID = root.TraceID
+	child.References = []model.SpanRef{model.NewChildOfRef(root.TraceID, root.SpanID)}
+	// The search depth is hit in the second window, so it is split
+	other := testMigrationSpan(3, "frontend", start.Add(11*time.Minute))
+	another := testMigrationSpan(4, "frontend", start.Add(19*time.Minute))
+
+	var searches []string
+	server := fakeJaegerQuery(t, []*model.Span{root, child, other, another}, &searches)
+	defer server.Close()
+
+	source := NewQueryMigrationSource(hclog.NewNullLogger(), server.Client(), QueryMigrationParams{
+		Address:     server.URL + "/",
+		Start:       start,
+		End:         start.Add(20 * time.Minute),
+		SearchDepth: 2,
+	})
+	spans, checkpoint, err := source.Next(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(10*time.Minute).UTC().Format(time.RFC3339Nano), checkpoint)
+	// Every span is read once by the search of its service
+	assert.Equal(t, []*model.Span{child, root}, spans)
+
+	spans, checkpoint, err = source.Next(context.Background(), checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(20*time.Minute).UTC().Format(time.RFC3339Nano), checkpoint)
+	assert.Equal(t, []*model.Span{other, another}, spans)
+
+	_, _, err = source.Next(context.Background(), checkpoint)
+	assert.ErrorIs(t, err, io.EOF)
+
+	micros := func(t time.Time) int64 { return int64(model.TimeAsEpochMicroseconds(t)) }
+	window := func(from, to time.Duration) string {
+		return fmt.Sprintf("%d-%d", micros(start.Add(from)), micros(start.Add(to))-1)
+	}
+	assert.Equal(t, []string{
+		"backend " + window(0, 10*time.Minute),
+		"frontend " + window(0, 10*time.Minute),
+		"backend " + window(10*time.Minute, 20*time.Minute),
+		"frontend " + window(10*time.Minute, 20*time.Minute),
+		"frontend " + window(10*time.Minute, 15*time.Minute),
+		"frontend " + window(15*time.Minute, 20*time.Minute),
+	}, searches)
+}
+
+func TestQueryMigrationSourceErrors(t *testing.T) {
+	var searches []string
+	server := fakeJaegerQuery(t, nil, &searches)
+	defer server.Close()
+
+	source := NewQueryMigrationSource(hclog.NewNullLogger(), server.Client(), QueryMigrationParams{
+		Address: server.URL + "/missing",
+		Start:   time.Unix(1628000000, 0),
+		End:     time.Unix(1628003600, 0),
+	})
+	_, _, err := source.Next(context.Background(), "")
+	assert.EqualError(t, err, "could not get services: status 404 Not Found")
+
+	_, _, err = source.Next(context.Background(), "yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+)
+
+const (
+	defaultMigrationWindow      = 10 * time.Minute
+	defaultMigrationSearchDepth = 1000
+	// minMigrationWindow is the shortest window a query source splits windows with too many traces to
+	minMigrationWindow = time.Second
+)
+
+// QueryMigrationParams select spans read from the Jaeger Query API
+type QueryMigrationParams struct {
+	// Address of Jaeger Query, e.g. http://jaeger-query:16686
+	Address string
+	// Spans started at or after Start and before End are read
+	Start time.Time
+	End   time.Time
+	// Window is the time range of spans read in one chunk. Default 10m.
+	Window time.Duration
+	// SearchDepth is the maximal number of traces of a service found in a window. Windows with more traces
+	// are split. Default 1000.
+	SearchDepth int
+}
+
+// queryMigrationSource reads spans window by window from the HTTP API of Jaeger Query of any storage backend,
+// the checkpoint is the end of the last read window
+type queryMigrationSource struct {
+	logger   hclog.Logger
+	client   *http.Client
+	params   QueryMigrationParams
+	services []string
+}
+
+// NewQueryMigrationSource returns a MigrationSource of spans found by searches of all services
+// of the Jaeger Query HTTP API, e.g. of Jaeger backed by Cassandra, Elasticsearch or Badger
+func NewQueryMigrationSource(logger hclog.Logger, client *http.Client, params QueryMigrationParams) MigrationSource {
+	if params.Window <= 0 {
+		params.Window = defaultMigrationWindow
+	}
+	if params.SearchDepth <= 0 {
+		params.SearchDepth = defaultMigrationSearchDepth
+	}
+	params.Address = strings.TrimSuffix(params.Address, "/")
+	return &queryMigrationSource{logger: logger, client: client, params: params}
+}
+
+func (s *queryMigrationSource) Next(ctx context.Context, checkpoint string) ([]*model.Span, string, error) {
+	start := s.params.Start
+	if checkpoint != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339Nano, checkpoint); err != nil {
+			return nil, "", fmt.Errorf("invalid checkpoint %q: %w", checkpoint, err)
+		}
+	}
+	if !start.Before(s.params.End) {
+		return nil, "", io.EOF
+	}
+	end := start.Add(s.params.Window)
+	if end.After(s.params.End) {
+		end = s.params.End
+	}
+
+	if s.services == nil {
+		if err := s.get(ctx, "/api/services", nil, &s.services); err != nil {
+			return nil, "", fmt.Errorf("could not get services: %w", err)
+		}
+	}
+	var spans []*model.Span
+	for _, service := range s.services {
+		found, err := s.findSpans(ctx, service, start, end)
+		if err != nil {
+			return nil, "", err
+		}
+		spans = append(spans, found...)
+	}
+	return spans, end.UTC().Format(time.RFC3339Nano), nil
+}
+
+// findSpans returns spans of the service started in the time range of traces found by searches of the service.
+// Searches finding as many traces as the search depth may miss traces, so their time ranges are split.
+// Only spans of the service are returned, so that spans of traces found by searches of several services
+// or in several time ranges are returned once.
+func (s *queryMigrationSource) findSpans(ctx context.Context, service string, start, end time.Time) ([]*model.Span, error) {
+	query := url.Values{}
+	query.Set("service", service)
+	query.Set("start", strconv.FormatInt(start.UnixNano()/1000, 10))
+	// end is inclusive
+	query.Set("end", strconv.FormatInt(end.UnixNano()/1000-1, 10))
+	query.Set("limit", strconv.Itoa(s.params.SearchDepth))
+	var traces []uimodel.Trace
+	if err := s.get(ctx, "/api/traces", query, &traces); err != nil {
+		return nil, fmt.Errorf("could not find traces of service %q: %w", service, err)
+	}
+
+	var spans []*model.Span
+	for _, trace := range traces {
+		converted, err := fromUITrace(trace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace %s: %w", trace.TraceID, err)
+		}
+		for _, span := range converted {
+			if span.Process.ServiceName == service && !span.StartTime.Before(start) && span.StartTime.Before(end) {
+				spans = append(spans, span)
+			}
+		}
+	}
+
+	if len(traces) < s.params.SearchDepth {
+		return spans, nil
+	}
+	if end.Sub(start) <= minMigrationWindow {
+		s.logger.Warn("Too many traces to migrate all of them", "service", service, "start", start, "end", end)
+		return spans, nil
+	}
+	middle := start.Add(end.Sub(start) / 2)
+	first, err := s.findSpans(ctx, service, start, middle)
+	if err != nil {
+		return nil, err
+	}
+	second, err := s.findSpans(ctx, service, middle, end)
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// get decodes data of the response of the Jaeger Query API to data
+func (s *queryMigrationSource) get(ctx context.Context, path string, query url.Values, data interface{}) error {
+	address := s.params.Address + path
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Msg string `json:"msg"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return fmt.Errorf("invalid response with status %s: %w", response.Status, err)
+	}
+	if len(body.Errors) > 0 {
+		return fmt.Errorf("status %s: %s", response.Status, body.Errors[0].Msg)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(body.Data)))
+	// int64 tags do not fit into float64
+	decoder.UseNumber()
+	return decoder.Decode(data)
+}
+
+// fromUITrace converts the trace returned by the Jaeger Query API to spans
+func fromUITrace(trace uimodel.Trace) ([]*model.Span, error) {
+	spans := make([]*model.Span, 0, len(trace.Spans))
+	for _, uiSpan := range trace.Spans {
+		process := uiSpan.Process
+		if process == nil {
+			p, ok := trace.Processes[uiSpan.ProcessID]
+			if !ok {
+				return nil, fmt.Errorf("span %s has unknown process %s", uiSpan.SpanID, uiSpan.ProcessID)
+			}
+			process = &p
+		}
+		span, err := fromUISpan(uiSpan, process)
+		if err != nil {
+			return nil, fmt.Errorf("invalid span %s: %w", uiSpan.SpanID, err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+func fromUISpan(uiSpan uimodel.Span, process *uimodel.Process) (*model.Span, error) {
+	traceID, err := model.TraceIDFromString(string(uiSpan.TraceID))
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := model.SpanIDFromString(string(uiSpan.SpanID))
+	if err != nil {
+		return nil, err
+	}
+	span := &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: uiSpan.OperationName,
+		Flags:         model.Flags(uiSpan.Flags),
+		StartTime:     model.EpochMicrosecondsAsTime(uiSpan.StartTime),
+		Duration:      model.MicrosecondsAsDuration(uiSpan.Duration),
+		Warnings:      uiSpan.Warnings,
+		Process:       &model.Process{ServiceName: process.ServiceName},
+	}
+	for _, reference := range uiSpan.References {
+		referenceTraceID, err := model.TraceIDFromString(string(reference.TraceID))
+		if err != nil {
+			return nil, err
+		}
+		referenceSpanID, err := model.SpanIDFromString(string(reference.SpanID))
+		if err != nil {
+			return nil, err
+		}
+		refType := model.SpanRefType_CHILD_OF
+		if reference.RefType == uimodel.FollowsFrom {
+			refType = model.SpanRefType_FOLLOWS_FROM
+		}
+		span.References = append(span.References, model.SpanRef{TraceID: referenceTraceID, SpanID: referenceSpanID, RefType: refType})
+	}
+	if span.Tags, err = fromUIKeyValues(uiSpan.Tags); err != nil {
+		return nil, err
+	}
+	if span.Process.Tags, err = fromUIKeyValues(process.Tags); err != nil {
+		return nil, err
+	}
+	for _, log := range uiSpan.Logs {
+		fields, err := fromUIKeyValues(log.Fields)
+		if err != nil {
+			return nil, err
+		}
+		span.Logs = append(span.Logs, model.Log{Timestamp: model.EpochMicrosecondsAsTime(log.Timestamp), Fields: fields})
+	}
+	return span, nil
+}
+
+func fromUIKeyValues(uiKeyValues []uimodel.KeyValue) ([]model.KeyValue, error) {
+	keyValues := make([]model.KeyValue, 0, len(uiKeyValues))
+	for _, kv := range uiKeyValues {
+		converted, err := fromUIKeyValue(kv)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %q: %w", kv.Key, err)
+		}
+		keyValues = append(keyValues, converted)
+	}
+	return keyValues, nil
+}
+
+func fromUIKeyValue(kv uimodel.KeyValue) (model.KeyValue, error) {
+	switch kv.Type {
+	case uimodel.BoolType:
+		if value, ok := kv.Value.(bool); ok {
+			return model.Bool(kv.Key, value), nil
+		}
+	case uimodel.Int64Type:
+		if value, ok := kv.Value.(json.Number); ok {
+			converted, err := value.Int64()
+			return model.Int64(kv.Key, converted), err
+		}
+	case uimodel.Float64Type:
+		if value, ok := kv.Value.(json.Number); ok {
+			converted, err := value.Float64()
+			return model.Float64(kv.Key, converted), err
+		}
+	case uimodel.BinaryType:
+		if value, ok := kv.Value.(string); ok {
+			converted, err := base64.StdEncoding.DecodeString(value)
+			return model.Binary(kv.Key, converted), err
+		}
+	default:
+		if value, ok := kv.Value.(string); ok {
+			return model.String(kv.Key, value), nil
+		}
+	}
+	return model.KeyValue{}, fmt.Errorf("%v is not of type %s", kv.Value, kv.Type)
+}
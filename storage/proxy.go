@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc opens network connections to ClickHouse hosts, e.g. through a tunnel
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialer returns the function dialing ClickHouse, the configured hook or a dialer of the proxy URL, nil to connect directly
+func (cfg *Configuration) dialer() (DialFunc, error) {
+	if cfg.Dial != nil {
+		return cfg.Dial, nil
+	}
+	if cfg.Proxy.URL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(cfg.Proxy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "unix":
+		if proxyURL.Path == "" {
+			return nil, fmt.Errorf("proxy url %q has no socket path", cfg.Proxy.URL)
+		}
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", proxyURL.Path)
+		}, nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext, nil
+	case "http":
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, proxyURL, address)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown proxy url scheme %q, only unix, socks5, socks5h and http are supported", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to the address with the CONNECT method of the HTTP proxy.
+// ClickHouse clients speak first, so no bytes of the tunnel are buffered while reading the response.
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", address, response.Status)
+	}
+	return conn, nil
+}
+
+// forwarder listens on a local port and forwards its connections to the target host through the dial function.
+// The driver dials hosts itself, so it connects to the forwarder instead of the target host.
+type forwarder struct {
+	logger   hclog.Logger
+	target   string
+	dial     DialFunc
+	listener net.Listener
+
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+var _ io.Closer = (*forwarder)(nil)
+
+// forward starts a forwarder to the host of the ClickHouse address and returns the address of the forwarder
+func forward(logger hclog.Logger, address string, dial DialFunc) (string, *forwarder, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid ClickHouse address %q: %w", address, err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	f := &forwarder{
+		logger:   logger,
+		target:   parsed.Host,
+		dial:     dial,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	go f.serve()
+	parsed.Host = listener.Addr().String()
+	return parsed.String(), f, nil
+}
+
+func (f *forwarder) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *forwarder) handle(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := f.dial(context.Background(), "tcp", f.target)
+	if err != nil {
+		f.logger.Warn("Could not connect to ClickHouse through the proxy", "address", f.target, "error", err)
+		return
+	}
+	defer upstream.Close()
+	if !f.track(conn, upstream) {
+		return
+	}
+	defer f.untrack(conn, upstream)
+
+	done := make(chan struct{}, 2)
+	for _, pipe := range [][2]net.Conn{{upstream, conn}, {conn, upstream}} {
+		go func(dst, src net.Conn) {
+			_, _ = io.Copy(dst, src)
+			done <- struct{}{}
+		}(pipe[0], pipe[1])
+	}
+	// Either side closing ends the forwarded connection
+	<-done
+}
+
+// track records open connections, so that they are closed with the forwarder, false if it is closed already
+func (f *forwarder) track(conns ...net.Conn) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return false
+	}
+	for _, conn := range conns {
+		f.conns[conn] = true
+	}
+	return true
+}
+
+func (f *forwarder) untrack(conns ...net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range conns {
+		delete(f.conns, conn)
+	}
+}
+
+// Close stops listening and closes forwarded connections
+func (f *forwarder) Close() error {
+	f.mutex.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.mutex.Unlock()
+	return f.listener.Close()
+}
+
+// dsnConnector opens driver connections to the DSN
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// forwardingConnector closes forwarders of its connections when the connection pool is closed
+type forwardingConnector struct {
+	driver.Connector
+	forwarders []*forwarder
+}
+
+var _ io.Closer = (*forwardingConnector)(nil)
+
+func (c *forwardingConnector) Close() error {
+	var err error
+	if closer, ok := c.Connector.(io.Closer); ok {
+		err = closer.Close()
+	}
+	for _, f := range c.forwarders {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
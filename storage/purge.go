@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+var errPurgeNotSupported = errors.New("purging of all spans is not supported with table rotation")
+
+// dataTables returns the local tables whose data is removed by purging all spans and maintained on demand: spans,
+// index, operations and tables derived from spans, nil with table rotation. Hidden traces and service aliases are kept.
+func (cfg *Configuration) dataTables() []clickhousespanstore.TableName {
+	if cfg.TableRotation != "" {
+		return nil
+	}
+	tables := []clickhousespanstore.TableName{
+		cfg.localTable(cfg.SpansTable),
+		cfg.localTable(cfg.SpansIndexTable),
+		cfg.localTable(cfg.OperationsTable),
+	}
+	if cfg.ArchiveEnabled() {
+		tables = append(tables, cfg.localTable(cfg.GetSpansArchiveTable()))
+	}
+	if cfg.archiveIndexEnabled() {
+		tables = append(tables, cfg.localTable(cfg.Archive.IndexTable))
+	}
+	if cfg.Dependencies {
+		tables = append(tables, cfg.localTable(cfg.CallsTable))
+	}
+	if cfg.SpanLogs {
+		tables = append(tables, cfg.localTable(cfg.SpanLogsTable))
+	}
+	if cfg.DeduplicateProcesses {
+		tables = append(tables, cfg.localTable(cfg.ProcessesTable))
+	}
+	if cfg.StoredDependencies {
+		tables = append(tables, cfg.localTable(cfg.DependenciesTable))
+	}
+	if cfg.TraceSummaries {
+		tables = append(tables, cfg.localTable(cfg.TraceSummariesTable))
+	}
+	if cfg.RecentTraces {
+		tables = append(tables, cfg.localTable(cfg.RecentTracesTable))
+	}
+	if cfg.HotIndex {
+		tables = append(tables, cfg.localTable(cfg.HotIndexTable))
+	}
+	if cfg.DurationBaselines {
+		tables = append(tables, cfg.localTable(cfg.DurationBaselinesTable))
+	}
+	if cfg.AggregateTraces {
+		tables = append(tables, cfg.localTable(cfg.TracesTable))
+	}
+	if cfg.ClockSkewPolicy == clickhousespanstore.ClockSkewQuarantine {
+		tables = append(tables, cfg.localTable(cfg.GetSpansQuarantineTable()))
+	}
+	return tables
+}
+
+// keptProcessesTable returns the local processes table, which is kept by purging, empty if processes are not
+// deduplicated
+func (cfg *Configuration) keptProcessesTable() clickhousespanstore.TableName {
+	if !cfg.DeduplicateProcesses || cfg.TableRotation != "" {
+		return ""
+	}
+	return cfg.localTable(cfg.ProcessesTable)
+}
+
+// Purge removes all spans of all tenants by truncating the spans, index and operations tables and tables derived
+// from spans, on every node of the cluster with replication. It is meant for integration tests and resets
+// of local environments. Spans queued by the writer are still written afterwards. Processes are kept, as writers
+// of all collectors remember which processes they have written and do not write them again for later spans.
+func (s *Store) Purge(ctx context.Context) error {
+	if len(s.dataTables) == 0 {
+		return errPurgeNotSupported
+	}
+	onCluster := ""
+	if s.replication {
+		onCluster = " ON CLUSTER '{cluster}'"
+	}
+	for _, table := range s.dataTables {
+		if table == s.processesTable {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("TRUNCATE TABLE IF EXISTS %s%s", table, onCluster)); err != nil {
+			return fmt.Errorf("could not truncate table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// PurgeHandler removes all spans on POST, like the storage cleaner of Jaeger integration tests
+func (s *Store) PurgeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Purge(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"purged": true})
+	})
+}
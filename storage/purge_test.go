@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestConfiguration_dataTables(t *testing.T) {
+	cfg := Configuration{Replication: true, Dependencies: true, AggregateTraces: true}
+	cfg.setDefaults()
+	assert.Equal(t, []clickhousespanstore.TableName{
+		"jaeger_spans_local",
+		"jaeger_index_local",
+		"jaeger_operations_local",
+		"jaeger_spans_archive_local",
+		"jaeger_calls_local",
+		"jaeger_traces_local",
+	}, cfg.dataTables())
+
+	deduplicated := Configuration{DeduplicateProcesses: true}
+	deduplicated.setDefaults()
+	assert.Contains(t, deduplicated.dataTables(), clickhousespanstore.TableName("jaeger_processes_local"), "processes are maintained")
+	assert.Equal(t, clickhousespanstore.TableName("jaeger_processes_local"), deduplicated.keptProcessesTable())
+
+	rotated := Configuration{TableRotation: clickhousespanstore.RotationDaily}
+	rotated.setDefaults()
+	assert.Nil(t, rotated.dataTables())
+}
+
+func TestStore_Purge(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := &Store{db: db, dataTables: []clickhousespanstore.TableName{"jaeger_spans_local", "jaeger_processes_local", "jaeger_index_local"},
+		processesTable: "jaeger_processes_local", replication: true}
+	mock.ExpectExec("TRUNCATE TABLE IF EXISTS jaeger_spans_local ON CLUSTER '{cluster}'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("TRUNCATE TABLE IF EXISTS jaeger_index_local ON CLUSTER '{cluster}'").WillReturnError(errorMock)
+
+	assert.EqualError(t, store.Purge(context.Background()), "could not truncate table jaeger_index_local: "+errorMock.Error())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, errPurgeNotSupported, (&Store{db: db}).Purge(context.Background()))
+}
+
+func TestStore_PurgeHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	handler := (&Store{db: db, dataTables: []clickhousespanstore.TableName{"jaeger_spans"}}).PurgeHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/purge", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	mock.ExpectExec("TRUNCATE TABLE IF EXISTS jaeger_spans").WillReturnResult(sqlmock.NewResult(0, 0))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/purge", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"purged": true}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	reconnectHealthCheck = "health_check"
+	reconnectAddresses   = "addresses"
+)
+
+var reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_reconnects_total",
+	Help: "Number of times pooled ClickHouse connections were discarded, by failed health checks or changed addresses",
+}, []string{"reason"})
+
+var registerReconnectMetrics sync.Once
+
+// reconnectingConnector checks health of ClickHouse and resolves its host name every interval. When a check fails or
+// the host name resolves to other addresses, e.g. after ClickHouse pods behind a Kubernetes Service are restarted,
+// pooled connections opened before are discarded when they are taken from the pool, so that queries dial the new
+// addresses instead of failing on stale connections until they time out.
+type reconnectingConnector struct {
+	driver.Connector
+	logger   hclog.Logger
+	host     string
+	interval time.Duration
+	lookup   func(ctx context.Context, host string) ([]string, error)
+
+	generation int64
+	addresses  []string
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+var (
+	_ driver.Connector = (*reconnectingConnector)(nil)
+	_ io.Closer        = (*reconnectingConnector)(nil)
+)
+
+// newReconnectingConnector returns a connector of connections of the connector to the address, its host name
+// is not resolved if it is an IP address
+func newReconnectingConnector(
+	logger hclog.Logger,
+	connector driver.Connector,
+	address string,
+	interval time.Duration,
+) *reconnectingConnector {
+	registerReconnectMetrics.Do(func() {
+		prometheus.MustRegister(reconnects)
+	})
+
+	c := &reconnectingConnector{
+		Connector: connector,
+		logger:    logger,
+		interval:  interval,
+		lookup:    net.DefaultResolver.LookupHost,
+		done:      make(chan struct{}),
+	}
+	if parsed, err := url.Parse(address); err == nil && net.ParseIP(parsed.Hostname()) == nil {
+		c.host = parsed.Hostname()
+	}
+	return c
+}
+
+// Start checks health and addresses of ClickHouse until the connector is closed
+func (c *reconnectingConnector) Start() {
+	if c.host != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+		if addresses, err := c.lookup(ctx, c.host); err == nil {
+			sort.Strings(addresses)
+			c.addresses = addresses
+		}
+		cancel()
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.check()
+			}
+		}
+	}()
+}
+
+// check discards pooled connections if ClickHouse is not healthy or its host name resolves to other addresses
+// than at the previous check
+func (c *reconnectingConnector) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+
+	if err := c.ping(ctx); err != nil {
+		c.logger.Warn("ClickHouse health check failed, discarding pooled connections", "error", err)
+		c.discard(reconnectHealthCheck)
+		return
+	}
+	if c.host == "" {
+		return
+	}
+	addresses, err := c.lookup(ctx, c.host)
+	if err != nil {
+		c.logger.Warn("Could not resolve ClickHouse host", "host", c.host, "error", err)
+		return
+	}
+	sort.Strings(addresses)
+	if c.addresses != nil && !equalStrings(c.addresses, addresses) {
+		c.logger.Info("ClickHouse host resolves to other addresses, discarding pooled connections",
+			"host", c.host, "addresses", addresses)
+		c.discard(reconnectAddresses)
+	}
+	c.addresses = addresses
+}
+
+// ping opens a new connection and pings it
+func (c *reconnectingConnector) ping(ctx context.Context) error {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if pinger, ok := conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *reconnectingConnector) discard(reason string) {
+	atomic.AddInt64(&c.generation, 1)
+	reconnects.WithLabelValues(reason).Inc()
+}
+
+func (c *reconnectingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	generation := atomic.LoadInt64(&c.generation)
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reconnectingConn{Conn: conn, generation: generation, connector: c}, nil
+}
+
+// Close stops checks and closes the connector of connections, it is called when the database is closed
+func (c *reconnectingConnector) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if closer, ok := c.Connector.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// reconnectingConn is a pooled connection, it becomes invalid when connections opened before a check
+// of the connector are discarded
+type reconnectingConn struct {
+	driver.Conn
+	generation int64
+	connector  *reconnectingConnector
+}
+
+var (
+	_ driver.Validator          = (*reconnectingConn)(nil)
+	_ driver.SessionResetter    = (*reconnectingConn)(nil)
+	_ driver.ConnPrepareContext = (*reconnectingConn)(nil)
+	_ driver.ConnBeginTx        = (*reconnectingConn)(nil)
+	_ driver.ExecerContext      = (*reconnectingConn)(nil)
+	_ driver.NamedValueChecker  = (*reconnectingConn)(nil)
+	_ driver.Pinger             = (*reconnectingConn)(nil)
+)
+
+func (c *reconnectingConn) IsValid() bool {
+	if c.generation != atomic.LoadInt64(&c.connector.generation) {
+		return false
+	}
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// ResetSession is called before an idle connection is taken from the pool, which does not validate it, so idle
+// connections opened before connections were discarded are closed instead of being reused
+func (c *reconnectingConn) ResetSession(ctx context.Context) error {
+	if c.generation != atomic.LoadInt64(&c.connector.generation) {
+		return driver.ErrBadConn
+	}
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *reconnectingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *reconnectingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck // fallback for drivers without BeginTx
+}
+
+func (c *reconnectingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := c.Conn.(driver.ExecerContext); ok {
+		return execer.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *reconnectingConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func (c *reconnectingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestReconnectingConnector_Check(t *testing.T) {
+	drv := &fakeDriver{down: map[string]bool{}}
+	connector := newReconnectingConnector(mocks.NewSpyLogger(), dsnConnector{dsn: testPrimaryDSN, driver: drv},
+		"tcp://clickhouse:9000", time.Hour)
+	assert.Equal(t, "clickhouse", connector.host)
+	addresses := []string{"10.0.0.2", "10.0.0.1"}
+	connector.lookup = func(_ context.Context, host string) ([]string, error) {
+		assert.Equal(t, "clickhouse", host)
+		return addresses, nil
+	}
+	connector.Start()
+	defer connector.Close()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, connector.addresses)
+
+	conn, err := connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testPrimaryDSN, conn.(*reconnectingConn).Conn.(*fakeConn).dsn)
+	connector.check()
+	assert.True(t, conn.(driver.Validator).IsValid(), "connections are kept while ClickHouse is healthy")
+
+	addresses = []string{"10.0.0.1", "10.0.0.2"}
+	connector.check()
+	assert.True(t, conn.(driver.Validator).IsValid(), "order of addresses does not matter")
+
+	drv.setDown(testPrimaryDSN, true)
+	connector.check()
+	assert.False(t, conn.(driver.Validator).IsValid(), "connections are discarded when a health check fails")
+
+	drv.setDown(testPrimaryDSN, false)
+	conn, err = connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.True(t, conn.(driver.Validator).IsValid())
+
+	addresses = []string{"10.0.0.3"}
+	connector.check()
+	assert.False(t, conn.(driver.Validator).IsValid(), "connections are discarded when the host resolves to other addresses")
+}
+
+func TestReconnectingConnector_IPAddress(t *testing.T) {
+	drv := &fakeDriver{down: map[string]bool{}}
+	for _, address := range []string{"tcp://127.0.0.1:9000", "tcp://[::1]:9000"} {
+		connector := newReconnectingConnector(mocks.NewSpyLogger(), dsnConnector{dsn: testPrimaryDSN, driver: drv},
+			address, time.Second)
+		assert.Empty(t, connector.host, "IP addresses are not resolved")
+		assert.NoError(t, connector.Close())
+	}
+}
+
+// countingConnector counts connections opened by the connector
+type countingConnector struct {
+	driver.Connector
+	connects int
+}
+
+func (c *countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.connects++
+	return c.Connector.Connect(ctx)
+}
+
+func TestReconnectingConnector_IdleConnections(t *testing.T) {
+	counting := &countingConnector{Connector: dsnConnector{dsn: testPrimaryDSN, driver: &fakeDriver{down: map[string]bool{}}}}
+	connector := newReconnectingConnector(mocks.NewSpyLogger(), counting, "tcp://127.0.0.1:9000", time.Hour)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+	require.NoError(t, db.Ping())
+	assert.Equal(t, 1, counting.connects, "idle connections are reused")
+	assert.Equal(t, 1, db.Stats().Idle)
+
+	connector.discard(reconnectHealthCheck)
+	require.NoError(t, db.Ping())
+	assert.Equal(t, 2, counting.connects, "idle connections opened before they were discarded are not reused")
+	assert.Equal(t, 1, db.Stats().OpenConnections)
+}
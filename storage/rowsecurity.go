@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/pkg/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// userConnections opens a connection pool per ClickHouse user, so that ClickHouse row policies of the user
+// making a request apply to its queries. Pools are opened on first use and kept until the store is closed or
+// pools of max_user_pools users used more recently are open, so that users of unlisted names cannot open pools
+// without bound. Evicted pools are closed once queries still running on them release them.
+type userConnections struct {
+	cfg     RowLevelSecurityConfiguration
+	address string
+	params  url.Values
+	open    func(dsn string) (*sql.DB, error)
+
+	mutex sync.Mutex
+	// pools are the open pools by ClickHouse users, recent has them by recent use and evicts least recently used ones
+	pools  map[string]*userPool
+	recent cache.Cache
+}
+
+// userPool is a connection pool of a user with the number of queries using it
+type userPool struct {
+	db      *sql.DB
+	refs    int
+	evicted bool
+}
+
+func newUserConnections(cfg Configuration) (*userConnections, error) {
+	address, params, err := connectionParams(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Users only read, so their connections have the read settings
+	values, err := url.ParseQuery(strings.TrimPrefix(withSettings(params, cfg.readSettings()), "?"))
+	if err != nil {
+		return nil, err
+	}
+	users := &userConnections{
+		cfg:     cfg.RowLevelSecurity,
+		address: address,
+		params:  values,
+		open: func(dsn string) (*sql.DB, error) {
+			db, err := sql.Open("clickhouse", dsn)
+			if err != nil {
+				return nil, err
+			}
+			db.SetConnMaxLifetime(cfg.Reconnect.MaxConnectionAge)
+			return db, nil
+		},
+		pools: make(map[string]*userPool),
+	}
+	users.recent = cache.NewLRUWithOptions(cfg.RowLevelSecurity.MaxUserPools, &cache.Options{
+		// Evictions happen while the mutex is held, pools still used are closed by their last release
+		OnEvict: func(user string, _ interface{}) {
+			if pool, ok := users.pools[user]; ok {
+				pool.evicted = true
+				if pool.refs == 0 {
+					_ = pool.db.Close()
+				}
+				delete(users.pools, user)
+			}
+		},
+	})
+	return users, nil
+}
+
+// DB returns the connection pool of the ClickHouse user of the Jaeger user from the request metadata,
+// release has to be called once queries on the pool are done, so that an evicted pool can be closed
+func (c *userConnections) DB(ctx context.Context) (*sql.DB, func(), error) {
+	user := clickhousespanstore.TenantFromContext(ctx, c.cfg.UserHeader)
+	if user == "" {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "user is missing in %s metadata", c.cfg.UserHeader)
+	}
+	credentials, ok := c.cfg.Users[user]
+	if !ok {
+		if !c.cfg.AllowUnlisted {
+			return nil, nil, status.Errorf(codes.PermissionDenied, "user %q has no ClickHouse credentials", user)
+		}
+		credentials = ClickHouseCredentials{Username: user, Password: c.cfg.UnlistedPassword}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pool, ok := c.pools[credentials.Username]
+	if ok {
+		c.recent.Get(credentials.Username)
+	} else {
+		params := url.Values{}
+		for key, values := range c.params {
+			params[key] = values
+		}
+		params.Set("username", credentials.Username)
+		params.Set("password", credentials.Password)
+		db, err := c.open(c.address + "?" + params.Encode())
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = &userPool{db: db}
+		c.pools[credentials.Username] = pool
+		c.recent.Put(credentials.Username, true)
+	}
+	pool.refs++
+	var once sync.Once
+	return pool.db, func() { once.Do(func() { c.release(pool) }) }, nil
+}
+
+// release ends a use of the pool and closes it if it was evicted and this was its last use
+func (c *userConnections) release(pool *userPool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pool.refs--
+	if pool.evicted && pool.refs == 0 {
+		_ = pool.db.Close()
+	}
+}
+
+// Close closes connection pools of all users
+func (c *userConnections) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var closeErr error
+	for user, pool := range c.pools {
+		if err := pool.db.Close(); err != nil {
+			closeErr = err
+		}
+		delete(c.pools, user)
+	}
+	return closeErr
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestUserConnections_DB(t *testing.T) {
+	cfg := Configuration{
+		Address:  "tcp://localhost:9000",
+		Database: "jaeger",
+		Username: "plugin",
+		Password: "plugin secret",
+		Settings: SettingsConfiguration{
+			Read:  map[string]string{"max_execution_time": "60"},
+			Write: map[string]string{"max_insert_block_size": "100000"},
+		},
+		RowLevelSecurity: RowLevelSecurityConfiguration{
+			UserHeader:   "x-jaeger-user",
+			Users:        map[string]ClickHouseCredentials{"alice": {Username: "team_a", Password: "secret"}},
+			MaxUserPools: 10,
+		},
+	}
+	users, err := newUserConnections(cfg)
+	require.NoError(t, err)
+	var opened []string
+	users.open = func(dsn string) (*sql.DB, error) {
+		opened = append(opened, dsn)
+		return &sql.DB{}, nil
+	}
+	userContext := func(user string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-jaeger-user", user))
+	}
+
+	_, _, err = users.DB(context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, _, err = users.DB(userContext("bob"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	first, _, err := users.DB(userContext("alice"))
+	require.NoError(t, err)
+	second, _, err := users.DB(userContext("alice"))
+	require.NoError(t, err)
+	assert.Same(t, first, second, "connection pool of a user is reused")
+
+	users.cfg.AllowUnlisted = true
+	users.cfg.UnlistedPassword = "common"
+	_, _, err = users.DB(userContext("bob"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"tcp://localhost:9000?database=jaeger&max_execution_time=60&password=secret&username=team_a",
+		"tcp://localhost:9000?database=jaeger&max_execution_time=60&password=common&username=bob",
+	}, opened)
+}
+
+func TestUserConnections_DBEvictsPools(t *testing.T) {
+	users, err := newUserConnections(Configuration{
+		Address: "tcp://localhost:9000",
+		RowLevelSecurity: RowLevelSecurityConfiguration{
+			UserHeader:    "x-jaeger-user",
+			AllowUnlisted: true,
+			MaxUserPools:  2,
+		},
+	})
+	require.NoError(t, err)
+	var opened []*sql.DB
+	users.open = func(string) (*sql.DB, error) {
+		db, mock, err := mocks.GetDbMock()
+		mock.ExpectClose()
+		opened = append(opened, db)
+		return db, err
+	}
+	userDB := func(user string) *sql.DB {
+		db, release, err := users.DB(metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-jaeger-user", user)))
+		require.NoError(t, err)
+		release()
+		return db
+	}
+
+	alice := userDB("alice")
+	userDB("bob")
+	assert.Same(t, alice, userDB("alice"))
+	userDB("carol")
+	require.Len(t, opened, 3)
+	assert.Len(t, users.pools, 2)
+	assert.NoError(t, alice.Ping(), "the recently used pool is kept open")
+	assert.EqualError(t, opened[1].Ping(), "sql: database is closed", "the least recently used pool is closed")
+	assert.NotSame(t, opened[1], userDB("bob"), "a closed pool is opened again")
+	require.NoError(t, users.Close())
+}
+
+func TestUserConnections_DBKeepsEvictedPoolsInUse(t *testing.T) {
+	users, err := newUserConnections(Configuration{
+		Address: "tcp://localhost:9000",
+		RowLevelSecurity: RowLevelSecurityConfiguration{
+			UserHeader:    "x-jaeger-user",
+			AllowUnlisted: true,
+			MaxUserPools:  1,
+		},
+	})
+	require.NoError(t, err)
+	var userMocks []sqlmock.Sqlmock
+	users.open = func(string) (*sql.DB, error) {
+		db, mock, err := mocks.GetDbMock()
+		userMocks = append(userMocks, mock)
+		return db, err
+	}
+	userContext := func(user string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-jaeger-user", user))
+	}
+
+	alice, release, err := users.DB(userContext("alice"))
+	require.NoError(t, err)
+	userMocks[0].ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	userMocks[0].ExpectClose()
+	_, releaseBob, err := users.DB(userContext("bob"))
+	require.NoError(t, err)
+	userMocks[1].ExpectClose()
+	releaseBob()
+	assert.NotContains(t, users.pools, "alice", "the pool of alice is evicted")
+
+	var one int
+	require.NoError(t, alice.QueryRow("SELECT 1").Scan(&one), "a pool still in use is not closed by its eviction")
+	release()
+	release()
+	assert.EqualError(t, alice.Ping(), "sql: database is closed", "the evicted pool is closed by its last release")
+	require.NoError(t, users.Close())
+	for _, mock := range userMocks {
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+}
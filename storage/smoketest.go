@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+const (
+	smokeTestService   = "jaeger-clickhouse-smoketest"
+	smokeTestOperation = "smoketest"
+	// smokeTestRunTag identifies spans of a run, so that searches do not find traces of other runs
+	smokeTestRunTag = "smoketest.run"
+
+	defaultSmokeTestTimeout = 30 * time.Second
+	smokeTestPollInterval   = 500 * time.Millisecond
+)
+
+// SmokeTestParams configure a smoke test
+type SmokeTestParams struct {
+	// Tenant the synthetic trace is written and read for when multi_tenant is enabled
+	Tenant string
+	// User the synthetic trace is read as when row_level_security is enabled
+	User string
+	// Timeout is how long reads are retried until the synthetic trace is found. Default 30s.
+	Timeout time.Duration
+}
+
+// batchWriter writes spans synchronously
+type batchWriter interface {
+	WriteBatch(ctx context.Context, spans []*model.Span) error
+}
+
+// SmokeTest writes a synthetic trace, reads it back with GetTrace and FindTraces and returns the outcome of every step
+// with its duration, e.g. as a post-deploy check. The trace is kept in ClickHouse until it expires with other spans.
+func SmokeTest(ctx context.Context, logger hclog.Logger, cfg Configuration, params SmokeTestParams) ([]CheckResult, error) {
+	if params.Tenant != "" && !cfg.MultiTenant {
+		return nil, fmt.Errorf("tenant can be smoke tested only when multi_tenant is enabled")
+	}
+	store, err := NewStore(logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	md := metadata.MD{}
+	if cfg.MultiTenant {
+		md.Set(cfg.TenantHeader, params.Tenant)
+	}
+	if cfg.RowLevelSecurity.UserHeader != "" {
+		md.Set(cfg.RowLevelSecurity.UserHeader, params.User)
+	}
+	if len(md) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	writer := store.writer.(*clickhousespanstore.SpanWriter)
+	return runSmokeTest(ctx, writer, store.SpanReader(), params.Timeout), nil
+}
+
+// runSmokeTest writes the synthetic trace with the writer and reads it with the reader, retrying reads until timeout
+func runSmokeTest(ctx context.Context, writer batchWriter, reader spanstore.Reader, timeout time.Duration) []CheckResult {
+	if timeout <= 0 {
+		timeout = defaultSmokeTestTimeout
+	}
+	spans := smokeTestTrace(time.Now())
+	traceID := spans[0].TraceID
+
+	start := time.Now()
+	if err := writer.WriteBatch(ctx, spans); err != nil {
+		// Nothing can be read back
+		return []CheckResult{smokeTestResult("write", start, err)}
+	}
+	results := []CheckResult{smokeTestResult("write", start, nil)}
+
+	start = time.Now()
+	err := pollSmokeTest(ctx, timeout, func() error {
+		trace, err := reader.GetTrace(ctx, traceID)
+		if err != nil {
+			return err
+		}
+		if len(trace.Spans) != len(spans) {
+			return fmt.Errorf("trace %s has %d spans, expected %d", traceID, len(trace.Spans), len(spans))
+		}
+		return nil
+	})
+	results = append(results, smokeTestResult("get trace", start, err))
+
+	start = time.Now()
+	err = pollSmokeTest(ctx, timeout, func() error {
+		traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+			ServiceName:   smokeTestService,
+			OperationName: smokeTestOperation,
+			Tags:          map[string]string{smokeTestRunTag: traceID.String()},
+			StartTimeMin:  spans[0].StartTime.Add(-time.Minute),
+			StartTimeMax:  spans[0].StartTime.Add(time.Minute),
+			NumTraces:     1,
+		})
+		if err != nil {
+			return err
+		}
+		for _, trace := range traces {
+			if len(trace.Spans) > 0 && trace.Spans[0].TraceID == traceID {
+				return nil
+			}
+		}
+		return fmt.Errorf("trace %s is not found by service %s", traceID, smokeTestService)
+	})
+	return append(results, smokeTestResult("find traces", start, err))
+}
+
+// smokeTestTrace returns spans of a synthetic trace with a random ID, a root span and its child
+func smokeTestTrace(now time.Time) []*model.Span {
+	//nolint:gosec  , G404: trace IDs do not need a secure random generator
+	traceID := model.NewTraceID(rand.Uint64(), rand.Uint64())
+	start := now.Truncate(time.Microsecond)
+	process := model.NewProcess(smokeTestService, nil)
+	tags := model.KeyValues{model.String(smokeTestRunTag, traceID.String())}
+	root := &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(1),
+		OperationName: smokeTestOperation,
+		StartTime:     start,
+		Duration:      2 * time.Millisecond,
+		Tags:          append(tags, model.String("span.kind", "server")),
+		Process:       process,
+	}
+	child := &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(2),
+		OperationName: smokeTestOperation + "-child",
+		References:    []model.SpanRef{model.NewChildOfRef(traceID, root.SpanID)},
+		StartTime:     start.Add(time.Millisecond),
+		Duration:      time.Millisecond,
+		Tags:          tags,
+		Process:       process,
+	}
+	return []*model.Span{root, child}
+}
+
+// pollSmokeTest retries the read until it succeeds or the timeout passes and returns its last error
+func pollSmokeTest(ctx context.Context, timeout time.Duration, read func() error) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		err := read()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return err
+		case <-time.After(smokeTestPollInterval):
+		}
+	}
+}
+
+// smokeTestResult returns the outcome of a step started at start with its duration
+func smokeTestResult(step string, start time.Time, err error) CheckResult {
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		return CheckResult{Check: step, Status: CheckFailed, Message: fmt.Sprintf("failed after %s: %s", took, err)}
+	}
+	return CheckResult{Check: step, Status: CheckOK, Message: fmt.Sprintf("took %s", took)}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memorySmokeTestStore keeps written spans, reads find them only after the number of reads in visibleAfter
+type memorySmokeTestStore struct {
+	spans        []*model.Span
+	writeErr     error
+	visibleAfter int
+	reads        int
+}
+
+func (s *memorySmokeTestStore) WriteBatch(_ context.Context, spans []*model.Span) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.spans = append(s.spans, spans...)
+	return nil
+}
+
+func (s *memorySmokeTestStore) visible() bool {
+	s.reads++
+	return s.reads > s.visibleAfter
+}
+
+func (s *memorySmokeTestStore) GetTrace(_ context.Context, traceID model.TraceID) (*model.Trace, error) {
+	if !s.visible() {
+		return nil, spanstore.ErrTraceNotFound
+	}
+	return &model.Trace{Spans: s.spans}, nil
+}
+
+func (s *memorySmokeTestStore) GetServices(context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (s *memorySmokeTestStore) GetOperations(context.Context, spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, nil
+}
+
+func (s *memorySmokeTestStore) FindTraces(_ context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	if !s.visible() || query.ServiceName != smokeTestService {
+		return nil, nil
+	}
+	return []*model.Trace{{Spans: s.spans}}, nil
+}
+
+func (s *memorySmokeTestStore) FindTraceIDs(context.Context, *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, nil
+}
+
+func TestRunSmokeTest(t *testing.T) {
+	store := &memorySmokeTestStore{visibleAfter: 1}
+	results := runSmokeTest(context.Background(), store, store, time.Second)
+	require.Len(t, results, 3)
+	for i, step := range []string{"write", "get trace", "find traces"} {
+		assert.Equal(t, step, results[i].Check)
+		assert.Equal(t, CheckOK, results[i].Status, results[i].Message)
+		assert.True(t, strings.HasPrefix(results[i].Message, "took "), results[i].Message)
+	}
+	require.Len(t, store.spans, 2)
+	assert.Equal(t, store.spans[0].TraceID, store.spans[1].TraceID)
+	assert.Equal(t, smokeTestService, store.spans[0].Process.ServiceName)
+	assert.Equal(t, store.spans[0].SpanID, store.spans[1].ParentSpanID())
+}
+
+func TestRunSmokeTestFailures(t *testing.T) {
+	store := &memorySmokeTestStore{writeErr: errors.New("connection refused")}
+	results := runSmokeTest(context.Background(), store, store, time.Second)
+	require.Len(t, results, 1, "reads are skipped when the write fails")
+	assert.Equal(t, CheckFailed, results[0].Status)
+	assert.Contains(t, results[0].Message, "connection refused")
+
+	store = &memorySmokeTestStore{visibleAfter: 1000}
+	results = runSmokeTest(context.Background(), store, store, 10*time.Millisecond)
+	require.Len(t, results, 3)
+	assert.Equal(t, CheckOK, results[0].Status)
+	assert.Equal(t, CheckFailed, results[1].Status)
+	assert.Contains(t, results[1].Message, spanstore.ErrTraceNotFound.Error())
+	assert.Equal(t, CheckFailed, results[2].Status)
+	assert.Contains(t, results[2].Message, "is not found by service "+smokeTestService)
+}
+
+func TestSmokeTest_TenantWithoutMultiTenant(t *testing.T) {
+	_, err := SmokeTest(context.Background(), hclog.NewNullLogger(), Configuration{}, SmokeTestParams{Tenant: "tenant_1"})
+	assert.EqualError(t, err, "tenant can be smoke tested only when multi_tenant is enabled")
+}
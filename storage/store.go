@@ -4,13 +4,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
-	"embed"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	jaegerclickhouse "github.com/jaegertracing/jaeger-clickhouse"
 
@@ -25,15 +33,46 @@ import (
 )
 
 type Store struct {
-	db            *sql.DB
-	writer        spanstore.Writer
-	reader        spanstore.Reader
-	archiveWriter spanstore.Writer
-	archiveReader spanstore.Reader
+	db *sql.DB
+	// readDB is the connection pool of readers with read settings, db if there are no settings
+	readDB         *sql.DB
+	writer         spanstore.Writer
+	reader         spanstore.Reader
+	archiveWriter  spanstore.Writer
+	archiveReader  spanstore.Reader
+	reencoders     []*clickhousespanstore.Reencoder
+	dependencies   *clickhousedependencystore.DependencyStore
+	tagStats       *clickhousespanstore.TagStats
+	auditLog       *clickhousespanstore.AuditLog
+	partsMonitor   *clickhousespanstore.PartsMonitor
+	insertProfiler *clickhousespanstore.InsertProfiler
+	schemaMonitor  *clickhousespanstore.SchemaMonitor
+	autoArchiver   *clickhousespanstore.AutoArchiver
+	criticalPaths  *clickhousespanstore.CriticalPathAnalyzer
+	hiddenTraces   *clickhousespanstore.HiddenTraces
+	traceArchiver  *clickhousespanstore.TraceArchiver
+	users          *userConnections
+	// dataTables are truncated by Purge and maintained by Maintain, on every node of the cluster with replication
+	dataTables []clickhousespanstore.TableName
+	// processesTable is the local processes table, it is maintained but not purged
+	processesTable clickhousespanstore.TableName
+	replication    bool
+	// requestHeaders are HTTP headers of requests passed to the reader as gRPC metadata keys, the tenant
+	requestHeaders []string
+	// ownsDB is whether the connection pool was opened by the store and is closed with it
+	ownsDB bool
+
+	// newArchiveWriter and newArchiveReader construct the archive storage on its first use, it is rarely used
+	newArchiveWriter  func() spanstore.Writer
+	newArchiveReader  func() spanstore.Reader
+	archiveWriterOnce sync.Once
+	archiveReaderOnce sync.Once
 }
 
 const (
 	tlsConfigKey = "clickhouse_tls_config_key"
+	// localShardQuery counts replicas of the cluster that are served by the node the plugin is connected to
+	localShardQuery = "SELECT count() FROM system.clusters WHERE cluster = getMacro('cluster') AND (is_local = 1 OR host_name = hostName())"
 )
 
 var (
@@ -43,84 +82,682 @@ var (
 )
 
 func NewStore(logger hclog.Logger, cfg Configuration) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	cfg.setDefaults()
-	db, err := connector(cfg)
+	writeSettings := cfg.writeSettings()
+	db, err := connector(logger, cfg, writeSettings)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to database: %q", err)
 	}
+	// Settings are sent with every query of a pool, so reads with their own settings need their own pool
+	readDB := db
+	if readSettings := cfg.readSettings(); len(readSettings) > 0 || len(writeSettings) > 0 {
+		if readDB, err = connector(logger, cfg, readSettings); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("could not connect to database: %q", err)
+		}
+	}
 
-	if err := runInitScripts(logger, db, cfg); err != nil {
+	store, err := newStoreWithPools(logger, cfg, db, readDB)
+	if err != nil {
 		_ = db.Close()
+		if readDB != db {
+			_ = readDB.Close()
+		}
 		return nil, err
 	}
-	if cfg.Replication {
-		return &Store{
-			db: db,
-			writer: clickhousespanstore.NewSpanWriter(logger, db, cfg.SpansIndexTable, cfg.SpansTable,
-				clickhousespanstore.Encoding(cfg.Encoding), cfg.BatchFlushInterval, cfg.BatchWriteSize, cfg.MaxSpanCount),
-			reader: clickhousespanstore.NewTraceReader(db, cfg.OperationsTable, cfg.SpansIndexTable, cfg.SpansTable),
-			archiveWriter: clickhousespanstore.NewSpanWriter(logger, db, "", cfg.GetSpansArchiveTable(),
-				clickhousespanstore.Encoding(cfg.Encoding), cfg.BatchFlushInterval, cfg.BatchWriteSize, cfg.MaxSpanCount),
-			archiveReader: clickhousespanstore.NewTraceReader(db, "", "", cfg.GetSpansArchiveTable()),
-		}, nil
-	}
-	return &Store{
-		db: db,
-		writer: clickhousespanstore.NewSpanWriter(logger, db, cfg.SpansIndexTable, cfg.SpansTable,
-			clickhousespanstore.Encoding(cfg.Encoding), cfg.BatchFlushInterval, cfg.BatchWriteSize, cfg.MaxSpanCount),
-		reader: clickhousespanstore.NewTraceReader(db, cfg.OperationsTable, cfg.SpansIndexTable, cfg.SpansTable),
-		archiveWriter: clickhousespanstore.NewSpanWriter(logger, db, "", cfg.GetSpansArchiveTable(),
-			clickhousespanstore.Encoding(cfg.Encoding), cfg.BatchFlushInterval, cfg.BatchWriteSize, cfg.MaxSpanCount),
-		archiveReader: clickhousespanstore.NewTraceReader(db, "", "", cfg.GetSpansArchiveTable()),
-	}, nil
-}
-
-func connector(cfg Configuration) (*sql.DB, error) {
-	params := fmt.Sprintf("%s?database=%s&username=%s&password=%s",
-		cfg.Address,
-		cfg.Database,
-		cfg.Username,
-		cfg.Password,
-	)
+	store.ownsDB = true
+	return store, nil
+}
+
+// NewStoreWithDB returns a Store using the connection pool, e.g. wrapped with instrumentation, connected through a proxy
+// or opened with a custom driver. The pool has to be connected to the configured database, address, DSN, TLS and
+// failover settings are not used for it, neither are read and write settings. The pool is managed by the caller,
+// it is not closed by the store.
+func NewStoreWithDB(logger hclog.Logger, cfg Configuration, db *sql.DB) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	return newStoreWithPools(logger, cfg, db, db)
+}
+
+// newStoreWithPools returns a Store writing with the db pool and reading with the readDB pool
+func newStoreWithPools(logger hclog.Logger, cfg Configuration, db, readDB *sql.DB) (*Store, error) {
+	// Pools of users are opened on first use, so they are set up before any component is started
+	var users *userConnections
+	if cfg.RowLevelSecurity.UserHeader != "" {
+		var err error
+		if users, err = newUserConnections(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := runInitScripts(logger, db, cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.ServiceAliases) > 0 {
+		if err := syncServiceAliases(logger, db, cfg); err != nil {
+			return nil, fmt.Errorf("could not update service aliases: %q", err)
+		}
+	}
+	// Existing tables of older releases are read and written as they are instead of being migrated
+	upstreamWriterOpts, upstreamReaderOpts, err := cfg.adaptToUpstreamTables(logger, db)
+	if err != nil {
+		return nil, err
+	}
+	tables := writeTables(logger, db, cfg)
+	writerOpts := append(cfg.spanWriterOptions(), upstreamWriterOpts...)
+	if cfg.IndexFromSpans {
+		writerOpts = append(writerOpts, clickhousespanstore.WithIndexFromSpans())
+	}
+	readerOpts := append(cfg.traceReaderOptions(), upstreamReaderOpts...)
+	extractedTags, err := cfg.extractedTags()
+	if err != nil {
+		return nil, err
+	}
+	if len(extractedTags) > 0 {
+		writerOpts = append(writerOpts, clickhousespanstore.WithWriterExtractedTags(extractedTags))
+		readerOpts = append(readerOpts, clickhousespanstore.WithReaderExtractedTags(extractedTags))
+	}
+	// Missing columns of a partial migration disable their features instead of failing every query
+	schemaMonitor := cfg.schemaMonitor(logger, db, extractedTags)
+	if schemaMonitor != nil {
+		if err := schemaMonitor.Check(); err != nil {
+			logger.Error("Could not check columns of the index table", "error", err)
+		}
+		writerOpts = append(writerOpts, clickhousespanstore.WithSchemaMonitor(schemaMonitor))
+		readerOpts = append(readerOpts, clickhousespanstore.WithReaderSchemaMonitor(schemaMonitor))
+	}
+	// Tables of new periods are created on the first write to them
+	var rotation *clickhousespanstore.TableRotation
+	rotation, err = cfg.tableRotation(func(suffix string) error {
+		statements, err := renderPeriodScripts(cfg, rotation, suffix)
+		if err != nil {
+			return err
+		}
+		return executeScripts(logger, statements, db)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		writerOpts = append(writerOpts, clickhousespanstore.WithTableRotation(rotation))
+		readerOpts = append(readerOpts, clickhousespanstore.WithReaderTableRotation(rotation))
+	}
+	if cfg.Dependencies {
+		writerOpts = append(writerOpts, clickhousespanstore.WithCallsTable(tables.calls))
+	}
+	if cfg.SpanLogs {
+		writerOpts = append(writerOpts, clickhousespanstore.WithSpanLogsTable(tables.spanLogs))
+		readerOpts = append(readerOpts, clickhousespanstore.WithReaderSpanLogsTable(cfg.SpanLogsTable))
+	}
+	if cfg.DeduplicateProcesses {
+		writerOpts = append(writerOpts, clickhousespanstore.WithProcessesTable(tables.processes))
+	}
+	if cfg.WriteOperations {
+		writerOpts = append(writerOpts, clickhousespanstore.WithOperationsTable(tables.operations))
+	}
+	archiveReaderOpts := cfg.traceReaderOptions()
+	prewhereOpt, err := cfg.prewhereOption(logger, db)
+	if err != nil {
+		return nil, err
+	}
+	if prewhereOpt != nil {
+		readerOpts = append(readerOpts, prewhereOpt)
+		archiveReaderOpts = append(archiveReaderOpts, prewhereOpt)
+	}
+	// Readers share the limit, so that archive searches cannot bypass it
+	if limitOpt := cfg.queryLimitOption(); limitOpt != nil {
+		readerOpts = append(readerOpts, limitOpt)
+		archiveReaderOpts = append(archiveReaderOpts, limitOpt)
+	}
+	// Readers share the circuit breaker, as they query the same ClickHouse
+	if breakerOpt := cfg.circuitBreakerOption(); breakerOpt != nil {
+		readerOpts = append(readerOpts, breakerOpt)
+		archiveReaderOpts = append(archiveReaderOpts, breakerOpt)
+	}
+	if decodeOpt := cfg.decodeFailureOption(logger); decodeOpt != nil {
+		readerOpts = append(readerOpts, decodeOpt)
+		archiveReaderOpts = append(archiveReaderOpts, decodeOpt)
+	}
+	auditLog := cfg.auditLog(logger, db)
+	if auditLog != nil {
+		readerOpts = append(readerOpts, clickhousespanstore.WithAuditLog(auditLog))
+		archiveReaderOpts = append(archiveReaderOpts, clickhousespanstore.WithAuditLog(auditLog))
+	}
+	if users != nil {
+		readerOpts = append(readerOpts, clickhousespanstore.WithUserDB(users.DB))
+		archiveReaderOpts = append(archiveReaderOpts, clickhousespanstore.WithUserDB(users.DB))
+	}
+	if len(cfg.ServiceAliases) > 0 {
+		readerOpts = append(readerOpts, clickhousespanstore.WithServiceAliases(
+			cfg.serviceAliasesDictionary().AddDbName(cfg.Database),
+			cfg.ServiceAliasesTable.AddDbName(cfg.Database),
+		))
+	}
+	if cfg.TraceSummaries {
+		readerOpts = append(readerOpts, clickhousespanstore.WithTraceSummaries(cfg.TraceSummariesTable))
+	}
+	if cfg.RecentTraces {
+		readerOpts = append(readerOpts, clickhousespanstore.WithRecentTraces(cfg.RecentTracesTable, cfg.RecentTracesWindow))
+	}
+	if cfg.HotIndex {
+		readerOpts = append(readerOpts, clickhousespanstore.WithHotIndex(cfg.HotIndexTable, cfg.HotIndexWindow))
+	}
+	if cfg.DurationBaselines {
+		readerOpts = append(readerOpts, clickhousespanstore.WithDurationBaselines(cfg.DurationBaselinesTable, cfg.DurationBaselinesWindow))
+	}
+	if cfg.AggregateTraces {
+		readerOpts = append(readerOpts, clickhousespanstore.WithTracesTable(cfg.TracesTable))
+	}
+	clockSkewOpt, err := cfg.clockSkewOption(func() spanstore.Writer {
+		return cfg.secondaryWriter(logger, db, "", tables.quarantine)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if clockSkewOpt != nil {
+		writerOpts = append(writerOpts, clockSkewOpt)
+	}
+	// Spans are normalized before the clock skew policy, so that quarantined spans are normalized too
+	serviceNamesOpt, err := cfg.serviceNameNormalizerOption()
+	if err != nil {
+		return nil, err
+	}
+	if serviceNamesOpt != nil {
+		writerOpts = append(writerOpts, serviceNamesOpt)
+	}
+	serviceFilterOpt, err := cfg.serviceFilterOption()
+	if err != nil {
+		return nil, err
+	}
+	if serviceFilterOpt != nil {
+		writerOpts = append(writerOpts, serviceFilterOpt)
+	}
+	rowBinaryOpt, err := cfg.rowBinaryOption()
+	if err != nil {
+		return nil, err
+	}
+	if rowBinaryOpt != nil {
+		writerOpts = append(writerOpts, rowBinaryOpt)
+	}
+	latencyOpt, err := cfg.latencyHistogramOption()
+	if err != nil {
+		return nil, err
+	}
+	if latencyOpt != nil {
+		writerOpts = append(writerOpts, latencyOpt)
+	}
+	// Archived spans are saved on request, they are never shed
+	sheddingOpt, err := cfg.loadSheddingOption()
+	if err != nil {
+		return nil, err
+	}
+	if sheddingOpt != nil {
+		writerOpts = append(writerOpts, sheddingOpt)
+	}
+	quotasOpt, err := cfg.byteQuotasOption()
+	if err != nil {
+		return nil, err
+	}
+	if quotasOpt != nil {
+		writerOpts = append(writerOpts, quotasOpt)
+	}
+	if pruningOpt := cfg.pruningOption(); pruningOpt != nil {
+		writerOpts = append(writerOpts, pruningOpt)
+	}
+	autoArchiver, err := cfg.autoArchiver(logger, db)
+	if err != nil {
+		return nil, err
+	}
+	criticalPaths := cfg.criticalPathAnalyzer(logger, db)
+	var tagStats *clickhousespanstore.TagStats
+	if cfg.TagStatsSampleRate > 0 {
+		tagStats = clickhousespanstore.NewTagStats(cfg.TagStatsSampleRate)
+		tagStats.Start()
+		writerOpts = append(writerOpts, clickhousespanstore.WithTagStats(tagStats))
+	}
+	if schemaMonitor != nil {
+		schemaMonitor.Start()
+	}
+	if auditLog != nil {
+		auditLog.Start()
+	}
+	if autoArchiver != nil {
+		autoArchiver.Start()
+		writerOpts = append(writerOpts, clickhousespanstore.WithAutoArchiver(autoArchiver))
+	}
+	if criticalPaths != nil {
+		criticalPaths.Start()
+		writerOpts = append(writerOpts, clickhousespanstore.WithCriticalPathAnalyzer(criticalPaths))
+	}
+	insertProfiler := cfg.insertProfiler(logger, db)
+	if insertProfiler != nil {
+		insertProfiler.Start()
+		writerOpts = append(writerOpts, clickhousespanstore.WithInsertProfiler(insertProfiler))
+	}
+	partsMonitor := cfg.partsMonitor(logger, db)
+	if partsMonitor != nil {
+		partsMonitor.Start()
+		writerOpts = append(writerOpts, clickhousespanstore.WithPartsMonitor(partsMonitor))
+	}
+	if cfg.federatedSearchEnabled() {
+		var archiveIndexTable clickhousespanstore.TableName
+		if cfg.archiveIndexEnabled() {
+			archiveIndexTable = cfg.Archive.IndexTable
+		}
+		readerOpts = append(readerOpts, clickhousespanstore.WithArchiveSearch(
+			clickhousespanstore.NewTraceReader(readDB, "", archiveIndexTable, cfg.GetSpansArchiveTable(), archiveReaderOpts...),
+		))
+	}
+	reencoders := cfg.reencoders(logger, db)
+	for _, reencoder := range reencoders {
+		reencoder.Start()
+	}
+	store := &Store{
+		db:     db,
+		readDB: readDB,
+		writer: clickhousespanstore.NewSpanWriter(logger, db, tables.index, tables.spans,
+			clickhousespanstore.Encoding(cfg.Encoding), cfg.BatchFlushInterval, cfg.BatchWriteSize, cfg.MaxSpanCount,
+			writerOpts...),
+		reader: clickhousespanstore.NewTraceReader(readDB, cfg.OperationsTable, cfg.SpansIndexTable, cfg.SpansTable,
+			readerOpts...),
+		reencoders:     reencoders,
+		dependencies:   cfg.dependencyStore(readDB, users),
+		tagStats:       tagStats,
+		partsMonitor:   partsMonitor,
+		insertProfiler: insertProfiler,
+		schemaMonitor:  schemaMonitor,
+		autoArchiver:   autoArchiver,
+		criticalPaths:  criticalPaths,
+		auditLog:       auditLog,
+		hiddenTraces:   cfg.hiddenTraces(db),
+		traceArchiver:  cfg.traceArchiver(db),
+		users:          users,
+		dataTables:     cfg.dataTables(),
+		processesTable: cfg.keptProcessesTable(),
+		replication:    cfg.Replication,
+	}
+	if cfg.MultiTenant {
+		store.requestHeaders = append(store.requestHeaders, cfg.TenantHeader)
+	}
+	if !cfg.ArchiveEnabled() {
+		store.archiveWriter, store.archiveReader = disabledArchive{}, disabledArchive{}
+		return store, nil
+	}
+	var archiveIndexTable, archiveInsertIndexTable clickhousespanstore.TableName
+	if cfg.archiveIndexEnabled() {
+		archiveIndexTable, archiveInsertIndexTable = cfg.Archive.IndexTable, tables.archiveIndex
+	}
+	store.newArchiveWriter = func() spanstore.Writer {
+		return cfg.secondaryWriter(logger, db, archiveInsertIndexTable, tables.archive)
+	}
+	store.newArchiveReader = func() spanstore.Reader {
+		return clickhousespanstore.NewTraceReader(readDB, "", archiveIndexTable, cfg.GetSpansArchiveTable(), archiveReaderOpts...)
+	}
+	return store, nil
+}
+
+// insertTables are the tables spans are inserted into
+type insertTables struct {
+	index        clickhousespanstore.TableName
+	spans        clickhousespanstore.TableName
+	archive      clickhousespanstore.TableName
+	archiveIndex clickhousespanstore.TableName
+	calls        clickhousespanstore.TableName
+	operations   clickhousespanstore.TableName
+	quarantine   clickhousespanstore.TableName
+	spanLogs     clickhousespanstore.TableName
+	processes    clickhousespanstore.TableName
+}
+
+// writeTables returns the tables spans are inserted into.
+// When writing to the local shard is enabled and the node is found in the cluster, its local tables are used,
+// otherwise the configured (distributed) tables.
+func writeTables(logger hclog.Logger, db *sql.DB, cfg Configuration) insertTables {
+	tables := insertTables{
+		index:        cfg.SpansIndexTable,
+		spans:        cfg.SpansTable,
+		archive:      cfg.GetSpansArchiveTable(),
+		archiveIndex: cfg.Archive.IndexTable,
+		calls:        cfg.CallsTable,
+		operations:   cfg.OperationsTable,
+		quarantine:   cfg.GetSpansQuarantineTable(),
+		spanLogs:     cfg.SpanLogsTable,
+		processes:    cfg.ProcessesTable,
+	}
+	if !cfg.Replication || !cfg.WriteLocalShard {
+		return tables
+	}
+
+	var count uint64
+	if err := db.QueryRow(localShardQuery).Scan(&count); err != nil {
+		logger.Warn("Could not discover local shard, writing to distributed tables", "error", err)
+		return tables
+	}
+	if count == 0 {
+		logger.Warn("Node is not found in the cluster, writing to distributed tables")
+		return tables
+	}
+
+	logger.Info("Writing to local shard tables")
+	return insertTables{
+		index:        tables.index.ToLocal(),
+		spans:        tables.spans.ToLocal(),
+		archive:      tables.archive.ToLocal(),
+		archiveIndex: tables.archiveIndex.ToLocal(),
+		calls:        tables.calls.ToLocal(),
+		operations:   tables.operations.ToLocal(),
+		quarantine:   tables.quarantine.ToLocal(),
+		spanLogs:     tables.spanLogs.ToLocal(),
+		processes:    tables.processes.ToLocal(),
+	}
+}
+
+// connector opens a connection pool sending the ClickHouse settings with every query
+func connector(logger hclog.Logger, cfg Configuration, settings map[string]string) (*sql.DB, error) {
+	address, params, err := connectionParams(cfg)
+	if err != nil {
+		return nil, err
+	}
+	params = withSettings(params, settings)
+	dial, err := cfg.dialer()
+	if err != nil {
+		return nil, err
+	}
+	// reconnect discards pooled connections when checks of ClickHouse fail or its host resolves to other addresses,
+	// the host is resolved before the address is replaced by the address of a forwarder
+	host := address
+	reconnect := func(connector driver.Connector) driver.Connector {
+		if cfg.Reconnect.CheckInterval == 0 {
+			return connector
+		}
+		reconnecting := newReconnectingConnector(logger, connector, host, cfg.Reconnect.CheckInterval)
+		reconnecting.Start()
+		return reconnecting
+	}
+	var forwarders []*forwarder
+	// forwardAddress returns the address of a forwarder to the ClickHouse address, if it is dialed through a proxy
+	forwardAddress := func(address string) (string, error) {
+		if dial == nil {
+			return address, nil
+		}
+		local, f, err := forward(logger, address, dial)
+		if err != nil {
+			return "", err
+		}
+		forwarders = append(forwarders, f)
+		return local, nil
+	}
+	closeForwarders := func() {
+		for _, f := range forwarders {
+			_ = f.Close()
+		}
+	}
+
+	if address, err = forwardAddress(address); err != nil {
+		return nil, err
+	}
+	if cfg.Failover.SecondaryAddress != "" {
+		// The secondary cluster would fail over to alt hosts of the primary one
+		if len(cfg.AltHosts) > 0 {
+			closeForwarders()
+			return nil, errors.New("alt_hosts cannot be used with failover")
+		}
+		secondary, err := normalizeAddress(cfg.Failover.SecondaryAddress)
+		if err == nil {
+			secondary, err = forwardAddress(secondary)
+		}
+		if err != nil {
+			closeForwarders()
+			return nil, err
+		}
+		db, err := failoverClickhouseConnector(logger, address+params, secondary+params, cfg.Failover, forwarders, reconnect)
+		if err != nil {
+			return nil, err
+		}
+		db.SetConnMaxLifetime(cfg.Reconnect.MaxConnectionAge)
+		return db, nil
+	}
+	db, err := clickhouseConnector(address+params, forwarders, reconnect)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(cfg.Reconnect.MaxConnectionAge)
+	return db, nil
+}
+
+// connectionParams returns the address and the query parameters of the DSN, either the configured DSN
+// or the one built from the address, alternative hosts and credentials. Parameters of the configured DSN are used
+// as they are, also for the secondary cluster, only TLS parameters are added when the CA file is set.
+func connectionParams(cfg Configuration) (string, string, error) {
+	var address, params string
+	if cfg.DSN != "" {
+		address = cfg.DSN
+		if i := strings.Index(cfg.DSN, "?"); i >= 0 {
+			address, params = cfg.DSN[:i], cfg.DSN[i+1:]
+		}
+	} else {
+		var err error
+		if address, err = normalizeAddress(cfg.Address); err != nil {
+			return "", "", err
+		}
+		params = addParam(params, "database", cfg.Database)
+		params = addParam(params, "username", cfg.Username)
+		params = addParam(params, "password", cfg.Password)
+		if len(cfg.AltHosts) > 0 {
+			hosts := make([]string, len(cfg.AltHosts))
+			for i, host := range cfg.AltHosts {
+				var err error
+				if hosts[i], err = withDefaultPort(host); err != nil {
+					return "", "", fmt.Errorf("invalid ClickHouse alt host %q: %w", host, err)
+				}
+			}
+			params = addParam(params, "alt_hosts", strings.Join(hosts, ","))
+		}
+		if cfg.ConnectionOpenStrategy != "" {
+			switch cfg.ConnectionOpenStrategy {
+			case "random", "in_order", "time_random":
+			default:
+				return "", "", fmt.Errorf("unknown connection open strategy %q", cfg.ConnectionOpenStrategy)
+			}
+			params = addParam(params, "connection_open_strategy", cfg.ConnectionOpenStrategy)
+		}
+	}
 
 	if cfg.CaFile != "" {
 		caCert, err := ioutil.ReadFile(cfg.CaFile)
 		if err != nil {
-			return nil, err
+			return "", "", err
 		}
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(caCert)
-		err = clickhouse.RegisterTLSConfig(tlsConfigKey, &tls.Config{RootCAs: caCertPool})
+		tlsConfig := &tls.Config{RootCAs: caCertPool}
+		// Connections through a proxy are made to a local forwarder, the certificate is of the ClickHouse host
+		if cfg.Proxy.URL != "" || cfg.Dial != nil {
+			parsed, err := url.Parse(address)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid ClickHouse address %q: %w", address, err)
+			}
+			tlsConfig.ServerName = parsed.Hostname()
+		}
+		err = clickhouse.RegisterTLSConfig(tlsConfigKey, tlsConfig)
 		if err != nil {
-			return nil, err
+			return "", "", err
 		}
-		params += fmt.Sprintf(
-			"&secure=true&tls_config=%s",
-			tlsConfigKey,
-		)
+		params = addParam(params, "secure", "true")
+		params = addParam(params, "tls_config", tlsConfigKey)
 	}
-	return clickhouseConnector(params)
+	if cfg.Replication && cfg.PartialResults {
+		params = addParam(params, "skip_unavailable_shards", "true")
+	}
+	if params != "" {
+		params = "?" + params
+	}
+	return address, params, nil
 }
 
-func runInitScripts(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
-	var embeddedScripts embed.FS
-	if cfg.Replication {
-		embeddedScripts = jaegerclickhouse.EmbeddedFilesReplication
-	} else {
-		embeddedScripts = jaegerclickhouse.EmbeddedFilesNoReplication
+// withSettings adds ClickHouse settings to the query parameters of the DSN in the order of their names,
+// the driver sends them with every query
+func withSettings(params string, settings map[string]string) string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	query := strings.TrimPrefix(params, "?")
+	for _, name := range names {
+		query = addParam(query, name, settings[name])
 	}
+	if query != "" {
+		query = "?" + query
+	}
+	return query
+}
 
-	var (
-		sqlStatements []string
-		ttlTimestamp  string
-		ttlDate       string
-	)
-	if cfg.TTLDays > 0 {
-		ttlTimestamp = fmt.Sprintf("TTL timestamp + INTERVAL %d DAY DELETE", cfg.TTLDays)
-		ttlDate = fmt.Sprintf("TTL date + INTERVAL %d DAY DELETE", cfg.TTLDays)
+// addParam appends the query parameter with the escaped value, parameters keep their order unlike with url.Values
+func addParam(params, key, value string) string {
+	if params != "" {
+		params += "&"
+	}
+	return params + key + "=" + url.QueryEscape(value)
+}
+
+// defaultClickHousePort is the port of the native protocol used for hosts without a port
+const defaultClickHousePort = "9000"
+
+// normalizeAddress returns the address with the tcp scheme if it has none, e.g. for [::1]:9000, and the default port
+// if it has none. IPv6 hosts have to be in brackets, so that the port can be told apart.
+func normalizeAddress(address string) (string, error) {
+	if address == "" {
+		return "", nil
 	}
-	switch {
-	case cfg.InitSQLScriptsDir != "":
+	if !strings.Contains(address, "://") {
+		address = "tcp://" + address
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid ClickHouse address %q: %w", address, err)
+	}
+	host, err := withDefaultPort(parsed.Host)
+	if err != nil {
+		return "", fmt.Errorf("invalid ClickHouse address %q: %w", address, err)
+	}
+	return parsed.Scheme + "://" + host, nil
+}
+
+// withDefaultPort returns the host with defaultClickHousePort if it has no port
+func withDefaultPort(host string) (string, error) {
+	_, _, err := net.SplitHostPort(host)
+	var addrErr *net.AddrError
+	if errors.As(err, &addrErr) && addrErr.Err == "missing port in address" {
+		return net.JoinHostPort(strings.Trim(host, "[]"), defaultClickHousePort), nil
+	}
+	return host, err
+}
+
+// tableArgs are passed to the templates of the embedded SQL scripts
+type tableArgs struct {
+	Database         string
+	Table            clickhousespanstore.TableName
+	LocalTable       clickhousespanstore.TableName
+	IndexTable       clickhousespanstore.TableName
+	SpansTable       clickhousespanstore.TableName
+	Hash             string
+	TTLTimestamp     string
+	TTLDate          string
+	Replication      bool
+	MultiTenant      bool
+	IndexFlags       bool
+	IndexLinks       bool
+	IndexStatusCodes bool
+	IndexSpanKind    bool
+	IndexRoots       bool
+	// IndexInsertTime adds the insertedAt column to index tables, rows written without it count as inserted
+	// at their timestamps
+	IndexInsertTime bool
+	// TraceIDType is the type of the traceID column of spans and index tables
+	TraceIDType string
+	// SamplingPriority adds the priority column to spans tables, TTLPriority is TTL keeping spans with priority longer
+	SamplingPriority bool
+	TTLPriority      string
+	// ExtractedTags have their own columns in the index table
+	ExtractedTags []clickhousespanstore.ExtractedTag
+
+	// TTLInsertedAt is TTL of tables without meaningful timestamps, counted from the insertion
+	TTLInsertedAt string
+	// TTLRecentTraces is TTL of the recent traces table, the window of recent traces
+	TTLRecentTraces string
+	// HotIndexWindow is the interval of index rows kept in the hot index table
+	HotIndexWindow string
+	// TTLAudit is TTL of the audit table
+	TTLAudit string
+	// TTLProfiles is TTL of the operation profiles table
+	TTLProfiles string
+	// SourceTable is the table a dictionary is loaded from or a Merge table copies its structure from
+	SourceTable clickhousespanstore.TableName
+	// TargetTable is the table a materialized view writes to
+	TargetTable clickhousespanstore.TableName
+	// MergePattern matches names of tables read by a Merge table
+	MergePattern string
+	// Codecs are configured codecs by column names
+	Codecs map[string]string
+	// DeduplicationWindow is the number of inserted blocks kept for deduplication of retries, the default if 0
+	DeduplicationWindow uint
+	// DeduplicationWindowSeconds is the age of inserted blocks of replicated tables kept for deduplication,
+	// the default if 0
+	DeduplicationWindowSeconds uint
+	// ReplicationPath is the path of replicated tables, default_replica_path of ClickHouse if empty
+	ReplicationPath string
+	ReplicaName     string
+	// SpansOrderBy and IndexOrderBy are the configured sort keys of spans and index tables,
+	// the sort keys of the scripts if empty
+	SpansOrderBy string
+	IndexOrderBy string
+}
+
+// ReplicatedArgs returns the arguments of the replicated engine of the table,
+// none if the defaults of ClickHouse are used
+func (args tableArgs) ReplicatedArgs() string {
+	if args.ReplicationPath == "" {
+		return ""
+	}
+	return args.replicatedArgs(args.ReplicationPath)
+}
+
+// SharedReplicatedArgs returns the arguments of the replicated engine of the table that is not sharded,
+// all nodes of the cluster keep the same data
+func (args tableArgs) SharedReplicatedArgs() string {
+	path := "/clickhouse/tables/all/{database}/{table}"
+	if args.ReplicationPath != "" {
+		path = strings.ReplaceAll(args.ReplicationPath, "{shard}", "all")
+	}
+	return args.replicatedArgs(path)
+}
+
+func (args tableArgs) replicatedArgs(path string) string {
+	path = strings.NewReplacer("{database}", args.Database, "{table}", string(args.Table)).Replace(path)
+	return fmt.Sprintf("('%s', '%s')", path, args.ReplicaName)
+}
+
+// QuotedDatabase returns the database quoted for queries
+func (args tableArgs) QuotedDatabase() string {
+	return clickhousespanstore.QuoteIdentifier(args.Database)
+}
+
+// Codec returns the configured codec of the column, or the fallback codec of the script
+func (args tableArgs) Codec(column, fallback string) string {
+	if codec, ok := args.Codecs[column]; ok {
+		return codec
+	}
+	return fallback
+}
+
+func runInitScripts(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
+	var sqlStatements []string
+	if cfg.InitSQLScriptsDir != "" {
 		filePaths, err := walkMatch(cfg.InitSQLScriptsDir, "*.sql")
 		if err != nil {
 			return fmt.Errorf("could not list sql files: %q", err)
@@ -133,86 +770,339 @@ func runInitScripts(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
 			}
 			sqlStatements = append(sqlStatements, string(sqlStatement))
 		}
-	case cfg.Replication:
-		f, err := embeddedScripts.ReadFile("sqlscripts/replication/0001-jaeger-index-local.sql")
+	} else {
+		var err error
+		sqlStatements, err = renderEmbeddedScripts(cfg)
 		if err != nil {
 			return err
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.SpansIndexTable.ToLocal(), ttlTimestamp))
-		f, err = embeddedScripts.ReadFile("sqlscripts/replication/0002-jaeger-spans-local.sql")
-		if err != nil {
-			return err
+	}
+	return executeScripts(logger, sqlStatements, db)
+}
+
+// sqlScript is an embedded SQL script rendered for a table
+type sqlScript struct {
+	template string
+	table    clickhousespanstore.TableName
+	// configure sets arguments specific to the script
+	configure func(args *tableArgs)
+}
+
+func renderEmbeddedScripts(cfg Configuration) ([]string, error) {
+	rotation, err := cfg.tableRotation(nil)
+	if err != nil {
+		return nil, err
+	}
+	extractedTags, err := cfg.extractedTags()
+	if err != nil {
+		return nil, err
+	}
+
+	localTable := cfg.localTable
+	var scripts []sqlScript
+	var distributed []clickhousespanstore.TableName
+	if rotation == nil {
+		operationsTemplate := "jaeger-operations.tmpl.sql"
+		if cfg.WriteOperations {
+			// Operations are written by the writer into a table instead of by the materialized view
+			operationsTemplate = "jaeger-operations-table.tmpl.sql"
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.SpansTable.ToLocal(), ttlTimestamp))
-		f, err = embeddedScripts.ReadFile("sqlscripts/replication/0003-jaeger-operations-local.sql")
-		if err != nil {
-			return err
+		scripts = []sqlScript{
+			{template: "jaeger-index.tmpl.sql", table: localTable(cfg.SpansIndexTable)},
+			{template: "jaeger-spans.tmpl.sql", table: localTable(cfg.SpansTable)},
+			{template: operationsTemplate, table: localTable(cfg.OperationsTable)},
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.OperationsTable.ToLocal(), ttlDate, cfg.SpansIndexTable.ToLocal().AddDbName(cfg.Database)))
-		f, err = embeddedScripts.ReadFile("sqlscripts/replication/0004-jaeger-spans-archive-local.sql")
-		if err != nil {
-			return err
+		distributed = []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable, cfg.OperationsTable}
+		if cfg.IndexFromSpans {
+			// Spans tables created before the index was written from spans lack its columns
+			scripts = append(scripts,
+				sqlScript{template: "jaeger-spans-index-columns.tmpl.sql", table: localTable(cfg.SpansTable)},
+				sqlScript{template: "jaeger-index-mv.tmpl.sql", table: cfg.indexView()},
+			)
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.GetSpansArchiveTable().ToLocal(), ttlTimestamp))
-		f, err = embeddedScripts.ReadFile("sqlscripts/replication/0005-distributed-city-hash.sql")
-		if err != nil {
-			return err
+	} else {
+		// Operations of every period are written to the operations table by the materialized view of the period
+		scripts = []sqlScript{{template: "jaeger-operations-table.tmpl.sql", table: localTable(cfg.OperationsTable)}}
+		distributed = []clickhousespanstore.TableName{cfg.OperationsTable}
+	}
+	if cfg.ArchiveEnabled() {
+		scripts = append(scripts, sqlScript{template: "jaeger-spans-archive.tmpl.sql", table: localTable(cfg.GetSpansArchiveTable())})
+		distributed = append(distributed, cfg.GetSpansArchiveTable())
+	}
+	if cfg.archiveIndexEnabled() {
+		scripts = append(scripts, sqlScript{template: "jaeger-index.tmpl.sql", table: localTable(cfg.Archive.IndexTable)})
+		distributed = append(distributed, cfg.Archive.IndexTable)
+	}
+	if cfg.Dependencies {
+		scripts = append(scripts, sqlScript{template: "jaeger-calls.tmpl.sql", table: localTable(cfg.CallsTable)})
+		distributed = append(distributed, cfg.CallsTable)
+	}
+	if cfg.SpanLogs {
+		scripts = append(scripts, sqlScript{template: "jaeger-span-logs.tmpl.sql", table: localTable(cfg.SpanLogsTable)})
+		distributed = append(distributed, cfg.SpanLogsTable)
+	}
+	if cfg.DeduplicateProcesses {
+		scripts = append(scripts, sqlScript{template: "jaeger-processes.tmpl.sql", table: localTable(cfg.ProcessesTable)})
+		distributed = append(distributed, cfg.ProcessesTable)
+	}
+	if cfg.StoredDependencies {
+		scripts = append(scripts, sqlScript{template: "jaeger-dependencies.tmpl.sql", table: localTable(cfg.DependenciesTable)})
+		distributed = append(distributed, cfg.DependenciesTable)
+	}
+	if cfg.TraceSummaries {
+		scripts = append(scripts, sqlScript{template: "jaeger-trace-summaries.tmpl.sql", table: localTable(cfg.TraceSummariesTable)})
+		distributed = append(distributed, cfg.TraceSummariesTable)
+	}
+	if cfg.AggregateTraces {
+		scripts = append(scripts, sqlScript{template: "jaeger-traces.tmpl.sql", table: localTable(cfg.TracesTable)})
+		distributed = append(distributed, cfg.TracesTable)
+	}
+	if cfg.RecentTraces {
+		scripts = append(scripts, sqlScript{template: "jaeger-recent-traces.tmpl.sql", table: localTable(cfg.RecentTracesTable)})
+		distributed = append(distributed, cfg.RecentTracesTable)
+	}
+	if cfg.DurationBaselines {
+		scripts = append(scripts, sqlScript{template: "jaeger-operation-durations.tmpl.sql", table: localTable(cfg.DurationBaselinesTable)})
+		distributed = append(distributed, cfg.DurationBaselinesTable)
+	}
+	if len(cfg.ServiceAliases) > 0 {
+		// Aliases are few, every node has all of them
+		scripts = append(scripts,
+			sqlScript{template: "jaeger-service-aliases.tmpl.sql", table: cfg.ServiceAliasesTable},
+			sqlScript{template: "jaeger-service-aliases-dict.tmpl.sql", table: cfg.serviceAliasesDictionary()},
+		)
+	}
+	if cfg.HiddenTraces {
+		// Tombstones are few, every node has all of them
+		scripts = append(scripts, sqlScript{template: "jaeger-hidden-traces.tmpl.sql", table: cfg.HiddenTracesTable})
+	}
+	if cfg.AuditLog.Enabled {
+		scripts = append(scripts, sqlScript{template: "jaeger-audit-log.tmpl.sql", table: localTable(cfg.AuditLog.Table)})
+		distributed = append(distributed, cfg.AuditLog.Table)
+	}
+	if cfg.OperationProfiles.Enabled {
+		scripts = append(scripts, sqlScript{template: "jaeger-operation-profiles.tmpl.sql", table: localTable(cfg.OperationProfiles.Table)})
+		distributed = append(distributed, cfg.OperationProfiles.Table)
+	}
+	if cfg.ClockSkewPolicy == clickhousespanstore.ClockSkewQuarantine {
+		scripts = append(scripts, sqlScript{template: "jaeger-spans-quarantine.tmpl.sql", table: localTable(cfg.GetSpansQuarantineTable())})
+		distributed = append(distributed, cfg.GetSpansQuarantineTable())
+	}
+	if cfg.Replication {
+		for _, table := range distributed {
+			scripts = append(scripts, sqlScript{template: "distributed-table.tmpl.sql", table: table})
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(
-			string(f),
-			cfg.SpansTable,
-			cfg.SpansTable.ToLocal().AddDbName(cfg.Database),
-			cfg.Database,
-			cfg.SpansTable.ToLocal(),
-		))
-		sqlStatements = append(sqlStatements, fmt.Sprintf(
-			string(f),
-			cfg.SpansIndexTable,
-			cfg.SpansIndexTable.ToLocal().AddDbName(cfg.Database),
-			cfg.Database,
-			cfg.SpansIndexTable.ToLocal(),
-		))
-		sqlStatements = append(sqlStatements, fmt.Sprintf(
-			string(f),
-			cfg.GetSpansArchiveTable(),
-			cfg.GetSpansArchiveTable().ToLocal().AddDbName(cfg.Database),
-			cfg.Database,
-			cfg.GetSpansArchiveTable().ToLocal(),
-		))
-		f, err = embeddedScripts.ReadFile("sqlscripts/replication/0006-distributed-rand.sql")
-		if err != nil {
-			return err
+	}
+	if rotation != nil {
+		// Merge tables need tables of at least one period to copy their structure from
+		suffix := rotation.Suffix(time.Now())
+		scripts = append(scripts, cfg.periodScripts(rotation, suffix)...)
+		for _, table := range []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable} {
+			table := table
+			scripts = append(scripts, sqlScript{
+				template: "merge-table.tmpl.sql",
+				table:    table,
+				configure: func(args *tableArgs) {
+					args.SourceTable = rotation.Table(table, suffix)
+					args.MergePattern = rotation.Pattern(table)
+				},
+			})
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(
-			string(f),
-			cfg.OperationsTable,
-			cfg.OperationsTable.ToLocal().AddDbName(cfg.Database),
-			cfg.Database,
-			cfg.OperationsTable.ToLocal(),
-		))
-	default:
-		f, err := embeddedScripts.ReadFile("sqlscripts/local/0001-jaeger-index.sql")
-		if err != nil {
-			return err
+	}
+	if cfg.IndexFromSpans && cfg.Replication {
+		scripts = append(scripts, sqlScript{template: "jaeger-spans-index-columns.tmpl.sql", table: cfg.SpansTable})
+	}
+	// Index tables created before tags were extracted lack their columns
+	if len(extractedTags) > 0 {
+		if rotation != nil {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: cfg.SpansIndexTable})
+		} else {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: localTable(cfg.SpansIndexTable)})
+			if cfg.Replication {
+				scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: cfg.SpansIndexTable})
+			}
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.SpansIndexTable, ttlTimestamp))
-		f, err = embeddedScripts.ReadFile("sqlscripts/local/0002-jaeger-spans.sql")
-		if err != nil {
-			return err
+		if cfg.archiveIndexEnabled() {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: localTable(cfg.Archive.IndexTable)})
+			if cfg.Replication {
+				scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: cfg.Archive.IndexTable})
+			}
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.SpansTable, ttlTimestamp))
-		f, err = embeddedScripts.ReadFile("sqlscripts/local/0003-jaeger-operations.sql")
-		if err != nil {
-			return err
+	}
+	// Index tables created before insert times were indexed lack their column
+	if cfg.IndexInsertTime {
+		if rotation != nil {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-insert-time.tmpl.sql", table: cfg.SpansIndexTable})
+		} else {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-insert-time.tmpl.sql", table: localTable(cfg.SpansIndexTable)})
+			if cfg.Replication {
+				scripts = append(scripts, sqlScript{template: "jaeger-index-insert-time.tmpl.sql", table: cfg.SpansIndexTable})
+			}
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.OperationsTable, ttlDate, cfg.SpansIndexTable))
-		f, err = embeddedScripts.ReadFile("sqlscripts/local/0004-jaeger-spans-archive.sql")
-		if err != nil {
-			return err
+		if cfg.archiveIndexEnabled() {
+			scripts = append(scripts, sqlScript{template: "jaeger-index-insert-time.tmpl.sql", table: localTable(cfg.Archive.IndexTable)})
+			if cfg.Replication {
+				scripts = append(scripts, sqlScript{template: "jaeger-index-insert-time.tmpl.sql", table: cfg.Archive.IndexTable})
+			}
 		}
-		sqlStatements = append(sqlStatements, fmt.Sprintf(string(f), cfg.GetSpansArchiveTable(), ttlTimestamp))
 	}
-	return executeScripts(logger, sqlStatements, db)
+	// The hot index copies columns of the index table when it is created, so it is created after they are added
+	if cfg.HotIndex {
+		scripts = append(scripts, sqlScript{template: "jaeger-hot-index.tmpl.sql", table: localTable(cfg.HotIndexTable)})
+		if cfg.Replication {
+			scripts = append(scripts, sqlScript{template: "distributed-table.tmpl.sql", table: cfg.HotIndexTable})
+		}
+	}
+	return renderScripts(cfg, scripts)
+}
+
+// renderPeriodScripts renders scripts creating tables of the rotation period with the suffix
+func renderPeriodScripts(cfg Configuration, rotation *clickhousespanstore.TableRotation, suffix string) ([]string, error) {
+	return renderScripts(cfg, cfg.periodScripts(rotation, suffix))
+}
+
+// periodScripts are scripts creating spans and index tables of the rotation period with the suffix, adding columns
+// of extracted tags to its index tables, and the materialized view writing its operations to the operations table,
+// unless the writer writes them
+func (cfg *Configuration) periodScripts(rotation *clickhousespanstore.TableRotation, suffix string) []sqlScript {
+	qualified := func(table clickhousespanstore.TableName) clickhousespanstore.TableName {
+		if cfg.Replication {
+			return table.AddDbName(cfg.Database)
+		}
+		return table
+	}
+	index := rotation.Table(cfg.localTable(cfg.SpansIndexTable), suffix)
+	scripts := []sqlScript{
+		{template: "jaeger-index.tmpl.sql", table: index},
+		{template: "jaeger-spans.tmpl.sql", table: rotation.Table(cfg.localTable(cfg.SpansTable), suffix)},
+	}
+	if !cfg.WriteOperations {
+		scripts = append(scripts, sqlScript{
+			template: "jaeger-operations-mv.tmpl.sql",
+			table:    rotation.Table(cfg.localTable(cfg.OperationsTable), suffix),
+			configure: func(args *tableArgs) {
+				args.IndexTable = qualified(index)
+				args.TargetTable = qualified(cfg.localTable(cfg.OperationsTable))
+			},
+		})
+	}
+	// Index tables of the period created before tags were extracted lack their columns
+	if len(cfg.ExtractedTags) > 0 {
+		scripts = append(scripts, sqlScript{template: "jaeger-index-extracted-tags.tmpl.sql", table: index})
+	}
+	if cfg.Replication {
+		scripts = append(scripts,
+			sqlScript{template: "distributed-table.tmpl.sql", table: rotation.Table(cfg.SpansTable, suffix)},
+			sqlScript{template: "distributed-table.tmpl.sql", table: rotation.Table(cfg.SpansIndexTable, suffix)},
+		)
+		if len(cfg.ExtractedTags) > 0 {
+			scripts = append(scripts, sqlScript{
+				template: "jaeger-index-extracted-tags.tmpl.sql",
+				table:    rotation.Table(cfg.SpansIndexTable, suffix),
+			})
+		}
+	}
+	return scripts
+}
+
+func renderScripts(cfg Configuration, scripts []sqlScript) ([]string, error) {
+	templates, err := template.ParseFS(jaegerclickhouse.SQLScripts, "sqlscripts/*.tmpl.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	extractedTags, err := cfg.extractedTags()
+	if err != nil {
+		return nil, err
+	}
+	codecs, err := cfg.codecs()
+	if err != nil {
+		return nil, err
+	}
+	replicationPath, replicaName, err := cfg.replication()
+	if err != nil {
+		return nil, err
+	}
+	spansOrderBy, indexOrderBy, err := cfg.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	args := tableArgs{
+		Database:                   cfg.Database,
+		Replication:                cfg.Replication,
+		MultiTenant:                cfg.MultiTenant,
+		IndexFlags:                 cfg.IndexFlags,
+		IndexLinks:                 cfg.IndexLinks,
+		IndexStatusCodes:           cfg.IndexStatusCodes,
+		IndexSpanKind:              cfg.IndexSpanKind,
+		IndexRoots:                 cfg.IndexRoots,
+		IndexInsertTime:            cfg.IndexInsertTime,
+		TraceIDType:                "String",
+		ExtractedTags:              extractedTags,
+		Codecs:                     codecs,
+		DeduplicationWindow:        cfg.InsertDeduplicationWindow,
+		DeduplicationWindowSeconds: cfg.InsertDeduplicationWindowSeconds,
+		ReplicationPath:            replicationPath,
+		ReplicaName:                replicaName,
+		SpansOrderBy:               spansOrderBy,
+		IndexOrderBy:               indexOrderBy,
+	}
+	if cfg.TTLDays > 0 {
+		args.TTLTimestamp = fmt.Sprintf("TTL timestamp + INTERVAL %d DAY DELETE", cfg.TTLDays)
+		args.TTLDate = fmt.Sprintf("TTL date + INTERVAL %d DAY DELETE", cfg.TTLDays)
+		args.TTLInsertedAt = fmt.Sprintf("TTL insertedAt + INTERVAL %d DAY DELETE", cfg.TTLDays)
+	}
+	if cfg.BinaryTraceIDs {
+		args.TraceIDType = "FixedString(16)"
+	}
+	if cfg.AuditLog.TTLDays > 0 {
+		args.TTLAudit = fmt.Sprintf("TTL timestamp + INTERVAL %d DAY DELETE", cfg.AuditLog.TTLDays)
+	}
+	if cfg.OperationProfiles.TTLDays > 0 {
+		args.TTLProfiles = fmt.Sprintf("TTL timestamp + INTERVAL %d DAY DELETE", cfg.OperationProfiles.TTLDays)
+	}
+	args.TTLRecentTraces = fmt.Sprintf("TTL timestamp + INTERVAL %d SECOND DELETE", int64(cfg.RecentTracesWindow.Seconds()))
+	args.HotIndexWindow = fmt.Sprintf("INTERVAL %d SECOND", int64(cfg.HotIndexWindow.Seconds()))
+	if cfg.PriorityTTLDays > 0 {
+		args.SamplingPriority = true
+		args.TTLPriority = fmt.Sprintf(
+			"TTL timestamp + INTERVAL %d DAY DELETE WHERE priority = 0, timestamp + INTERVAL %d DAY DELETE",
+			cfg.TTLDays, cfg.PriorityTTLDays,
+		)
+	}
+	args.IndexTable = cfg.localTable(cfg.SpansIndexTable)
+	args.SpansTable = cfg.localTable(cfg.SpansTable)
+	if cfg.Replication {
+		args.IndexTable = args.IndexTable.AddDbName(cfg.Database)
+		args.SpansTable = args.SpansTable.AddDbName(cfg.Database)
+	}
+
+	sqlStatements := make([]string, 0, len(scripts))
+	for _, script := range scripts {
+		scriptArgs := args
+		scriptArgs.Table = script.table
+		scriptArgs.LocalTable = script.table.ToLocal()
+		scriptArgs.Hash = "cityHash64(traceID)"
+		scriptArgs.SourceTable = cfg.ServiceAliasesTable
+		// Tables without traces are sharded randomly
+		if script.table == cfg.OperationsTable || script.table == cfg.DurationBaselinesTable || script.table == cfg.AuditLog.Table ||
+			script.table == cfg.DependenciesTable {
+			scriptArgs.Hash = "rand()"
+		}
+		if script.table == cfg.ProcessesTable {
+			scriptArgs.Hash = "cityHash64(hash)"
+		}
+		if script.configure != nil {
+			script.configure(&scriptArgs)
+		}
+
+		var statement strings.Builder
+		if err := templates.ExecuteTemplate(&statement, script.template, scriptArgs); err != nil {
+			return nil, fmt.Errorf("could not render sql script %q: %q", script.template, err)
+		}
+		sqlStatements = append(sqlStatements, statement.String())
+	}
+	return sqlStatements, nil
 }
 
 func (s *Store) SpanReader() spanstore.Reader {
@@ -224,31 +1114,200 @@ func (s *Store) SpanWriter() spanstore.Writer {
 }
 
 func (s *Store) DependencyReader() dependencystore.Reader {
-	return clickhousedependencystore.NewDependencyStore()
+	if s.dependencies == nil {
+		return clickhousedependencystore.NewDependencyStore()
+	}
+	return s.dependencies
+}
+
+// DependencyHandler serves operation dependencies for Jaeger UI deep dependency graph over HTTP
+func (s *Store) DependencyHandler() http.Handler {
+	if s.dependencies == nil {
+		return clickhousedependencystore.NewDependencyStore()
+	}
+	return s.dependencies
+}
+
+// DependencyWriteHandler stores service dependencies computed by external jobs posted over HTTP
+func (s *Store) DependencyWriteHandler() http.Handler {
+	if s.dependencies == nil {
+		return clickhousedependencystore.NewDependencyStore().WriteHandler()
+	}
+	return s.dependencies.WriteHandler()
+}
+
+// TraceQualityHandler serves completeness scores of services computed from calls between spans over HTTP
+func (s *Store) TraceQualityHandler() http.Handler {
+	if s.dependencies == nil {
+		return clickhousedependencystore.NewDependencyStore().QualityHandler()
+	}
+	return s.dependencies.QualityHandler()
+}
+
+// OperationProfilesHandler serves critical paths and self times of operations of sampled traces over HTTP
+func (s *Store) OperationProfilesHandler() http.Handler {
+	if s.dependencies == nil {
+		return clickhousedependencystore.NewDependencyStore().ProfilesHandler()
+	}
+	return s.dependencies.ProfilesHandler()
+}
+
+// TagStatsHandler serves statistics of tag keys and values of written spans over HTTP
+func (s *Store) TagStatsHandler() http.Handler {
+	return s.tagStats
+}
+
+// HiddenTracesHandler hides, unhides and purges traces over HTTP
+func (s *Store) HiddenTracesHandler() http.Handler {
+	return s.hiddenTraces
+}
+
+// ArchiveHandler archives traces within ClickHouse on POST, it responds with 404 if the archive endpoint is disabled
+func (s *Store) ArchiveHandler() http.Handler {
+	return s.traceArchiver
 }
 
 func (s *Store) ArchiveSpanReader() spanstore.Reader {
+	s.archiveReaderOnce.Do(func() {
+		if s.newArchiveReader != nil {
+			s.archiveReader = s.newArchiveReader()
+		}
+	})
 	return s.archiveReader
 }
 
 func (s *Store) ArchiveSpanWriter() spanstore.Writer {
+	s.archiveWriterOnce.Do(func() {
+		if s.newArchiveWriter != nil {
+			s.archiveWriter = s.newArchiveWriter()
+		}
+	})
 	return s.archiveWriter
 }
 
 func (s *Store) Close() error {
+	for _, reencoder := range s.reencoders {
+		reencoder.Close()
+	}
+	if s.tagStats != nil {
+		s.tagStats.Close()
+	}
+	if s.partsMonitor != nil {
+		s.partsMonitor.Close()
+	}
+	if s.insertProfiler != nil {
+		s.insertProfiler.Close()
+	}
+	if s.schemaMonitor != nil {
+		s.schemaMonitor.Close()
+	}
+	if s.autoArchiver != nil {
+		s.autoArchiver.Close()
+	}
+	if s.criticalPaths != nil {
+		s.criticalPaths.Close()
+	}
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	if s.users != nil {
+		if err := s.users.Close(); err != nil {
+			return err
+		}
+	}
+	if !s.ownsDB {
+		return nil
+	}
+	if s.readDB != nil && s.readDB != s.db {
+		if err := s.readDB.Close(); err != nil {
+			return err
+		}
+	}
 	return s.db.Close()
 }
 
-func clickhouseConnector(params string) (*sql.DB, error) {
-	db, err := sql.Open("clickhouse", params)
+// syncServiceAliases replaces service aliases in ClickHouse with the configured ones and reloads their dictionary
+func syncServiceAliases(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
+	if _, err := db.Exec(fmt.Sprintf("TRUNCATE TABLE %s", cfg.ServiceAliasesTable)); err != nil {
+		return err
+	}
+
+	aliases := make([]string, 0, len(cfg.ServiceAliases))
+	for alias := range cfg.ServiceAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (alias, service) VALUES (?, ?)", cfg.ServiceAliasesTable))
+	if err != nil {
+		return err
 	}
+	defer statement.Close()
 
+	for _, alias := range aliases {
+		if _, err := statement.Exec(alias, cfg.ServiceAliases[alias]); err != nil {
+			return err
+		}
+	}
+	committed = true
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	onCluster := ""
+	if cfg.Replication {
+		onCluster = "ON CLUSTER '{cluster}' "
+	}
+	if _, err := db.Exec(fmt.Sprintf("SYSTEM RELOAD DICTIONARY %s%s", onCluster, cfg.serviceAliasesDictionary())); err != nil {
+		return err
+	}
+	logger.Info("Updated service aliases", "count", len(aliases))
+	return nil
+}
+
+// clickhouseConnector opens a connection pool to the DSN, connectors of the pool are wrapped by reconnect,
+// forwarders of its addresses are closed with the pool
+func clickhouseConnector(
+	params string,
+	forwarders []*forwarder,
+	reconnect func(driver.Connector) driver.Connector,
+) (*sql.DB, error) {
+	db := sql.OpenDB(&forwardingConnector{
+		Connector:  reconnect(dsnConnector{dsn: params, driver: dsnDriver(clickhouse.Open)}),
+		forwarders: forwarders,
+	})
 	if err := db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
+func failoverClickhouseConnector(
+	logger hclog.Logger,
+	primary, secondary string,
+	cfg FailoverConfiguration,
+	forwarders []*forwarder,
+	reconnect func(driver.Connector) driver.Connector,
+) (*sql.DB, error) {
+	connector := newFailoverConnector(logger, dsnDriver(clickhouse.Open), primary, secondary, cfg)
+	db := sql.OpenDB(&forwardingConnector{Connector: reconnect(connector), forwarders: forwarders})
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	connector.Start()
 	return db, nil
 }
 
@@ -1,14 +1,24 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousedependencystore"
 	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
@@ -56,6 +66,41 @@ func TestStore_ArchiveSpanReader(t *testing.T) {
 	assert.Equal(t, &reader, store.ArchiveSpanReader())
 }
 
+func TestStore_ArchiveLazy(t *testing.T) {
+	constructed := 0
+	reader := clickhousespanstore.TraceReader{}
+	store := Store{
+		newArchiveReader: func() spanstore.Reader {
+			constructed++
+			return &reader
+		},
+	}
+	assert.Equal(t, 0, constructed, "archive reader is constructed on first use")
+	assert.Equal(t, &reader, store.ArchiveSpanReader())
+	assert.Equal(t, &reader, store.ArchiveSpanReader())
+	assert.Equal(t, 1, constructed)
+}
+
+func TestStore_ArchiveDisabled(t *testing.T) {
+	store := Store{archiveWriter: disabledArchive{}, archiveReader: disabledArchive{}}
+
+	err := store.ArchiveSpanWriter().WriteSpan(context.Background(), &model.Span{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = store.ArchiveSpanReader().GetTrace(context.Background(), model.TraceID{Low: 1})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestStore_Capabilities(t *testing.T) {
+	capabilities, err := (&Store{archiveWriter: disabledArchive{}, archiveReader: disabledArchive{}}).Capabilities()
+	require.NoError(t, err)
+	assert.Equal(t, &shared.Capabilities{}, capabilities)
+
+	enabled := Store{newArchiveWriter: func() spanstore.Writer { return nil }, newArchiveReader: func() spanstore.Reader { return nil }}
+	capabilities, err = enabled.Capabilities()
+	require.NoError(t, err)
+	assert.Equal(t, &shared.Capabilities{ArchiveSpanReader: true, ArchiveSpanWriter: true}, capabilities)
+}
+
 func TestStore_DependencyReader(t *testing.T) {
 	store := Store{}
 	assert.Equal(t, &clickhousedependencystore.DependencyStore{}, store.DependencyReader())
@@ -75,9 +120,22 @@ func TestStore_Close(t *testing.T) {
 	logger.AssertLogsEmpty(t)
 }
 
+func TestStore_CloseExternalDB(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := newStore(db, mocks.NewSpyLogger())
+	store.ownsDB = false
+
+	require.NoError(t, store.Close())
+	assert.NoError(t, mock.ExpectationsWereMet(), "connection pools of embedders are not closed")
+}
+
 func newStore(db *sql.DB, logger mocks.SpyLogger) Store {
 	return Store{
-		db: db,
+		db:     db,
+		ownsDB: true,
 		writer: clickhousespanstore.NewSpanWriter(
 			logger,
 			db,
@@ -179,3 +237,764 @@ func TestStore_executeScriptBeginError(t *testing.T) {
 	err = executeScripts(spyLogger, scripts, db)
 	assert.EqualError(t, err, errorMock.Error())
 }
+
+func TestStore_syncServiceAliases(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	cfg := Configuration{
+		Replication:    true,
+		ServiceAliases: map[string]string{"orders": "order-service", "cart": "cart-service"},
+	}
+	cfg.setDefaults()
+
+	mock.ExpectExec("TRUNCATE TABLE jaeger_service_aliases").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare("INSERT INTO jaeger_service_aliases (alias, service) VALUES (?, ?)")
+	prepare.ExpectExec().WithArgs("cart", "cart-service").WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WithArgs("orders", "order-service").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SYSTEM RELOAD DICTIONARY ON CLUSTER '{cluster}' jaeger_service_aliases_dict").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	require.NoError(t, syncServiceAliases(mocks.NewSpyLogger(), db, cfg))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_syncServiceAliasesError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	cfg := Configuration{ServiceAliases: map[string]string{"cart": "cart-service"}}
+	cfg.setDefaults()
+
+	mock.ExpectExec("TRUNCATE TABLE jaeger_service_aliases").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO jaeger_service_aliases (alias, service) VALUES (?, ?)").
+		ExpectExec().WithArgs("cart", "cart-service").WillReturnError(errorMock)
+	mock.ExpectRollback()
+
+	assert.EqualError(t, syncServiceAliases(mocks.NewSpyLogger(), db, cfg), errorMock.Error())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_connectionParams(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, []byte{}, 0600))
+
+	tests := map[string]struct {
+		config          Configuration
+		expectedAddress string
+		expectedParams  string
+	}{
+		"address": {
+			config:          Configuration{Address: "tcp://localhost:9000", Database: "jaeger", Username: "user", Password: "secret"},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=user&password=secret",
+		},
+		"address with TLS": {
+			config:          Configuration{Address: "tcp://localhost:9000", Database: "jaeger", CaFile: caFile},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=&password=&secure=true&tls_config=" + tlsConfigKey,
+		},
+		"DSN": {
+			config:          Configuration{Address: "tcp://ignored:9000", DSN: "tcp://localhost:9000?read_timeout=30&alt_hosts=other:9000"},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?read_timeout=30&alt_hosts=other:9000",
+		},
+		"DSN with TLS": {
+			config:          Configuration{DSN: "tcp://localhost:9000?read_timeout=30", CaFile: caFile},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?read_timeout=30&secure=true&tls_config=" + tlsConfigKey,
+		},
+		"DSN without parameters with TLS": {
+			config:          Configuration{DSN: "tcp://localhost:9000", CaFile: caFile},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?secure=true&tls_config=" + tlsConfigKey,
+		},
+		"partial results": {
+			config:          Configuration{DSN: "tcp://localhost:9000", Replication: true, PartialResults: true},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?skip_unavailable_shards=true",
+		},
+		"partial results without replication": {
+			config:          Configuration{Address: "tcp://localhost:9000", Database: "jaeger", PartialResults: true},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=&password=",
+		},
+		"IPv6 address without scheme": {
+			config:          Configuration{Address: "[::1]:9000", Database: "jaeger"},
+			expectedAddress: "tcp://[::1]:9000",
+			expectedParams:  "?database=jaeger&username=&password=",
+		},
+		"address without port": {
+			config:          Configuration{Address: "localhost", Database: "jaeger", AltHosts: []string{"other", "[::1]"}},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=&password=&alt_hosts=other%3A9000%2C%5B%3A%3A1%5D%3A9000",
+		},
+		"IPv6 address without port": {
+			config:          Configuration{Address: "tcp://[::1]", Database: "jaeger"},
+			expectedAddress: "tcp://[::1]:9000",
+			expectedParams:  "?database=jaeger&username=&password=",
+		},
+		"escaped password": {
+			config:          Configuration{Address: "tcp://localhost:9000", Database: "jaeger", Username: "user", Password: "p&ss=w?rd"},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=user&password=p%26ss%3Dw%3Frd",
+		},
+		"alt hosts": {
+			config: Configuration{
+				Address:                "tcp://localhost:9000",
+				Database:               "jaeger",
+				AltHosts:               []string{"other:9000", "[::1]:9000"},
+				ConnectionOpenStrategy: "in_order",
+			},
+			expectedAddress: "tcp://localhost:9000",
+			expectedParams:  "?database=jaeger&username=&password=&alt_hosts=other%3A9000%2C%5B%3A%3A1%5D%3A9000&connection_open_strategy=in_order",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			address, params, err := connectionParams(test.config)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedAddress, address)
+			assert.Equal(t, test.expectedParams, params)
+		})
+	}
+}
+
+func TestStore_withSettings(t *testing.T) {
+	assert.Equal(t, "", withSettings("", nil))
+	assert.Equal(t, "?database=jaeger", withSettings("?database=jaeger", nil))
+	assert.Equal(t,
+		"?database=jaeger&max_memory_usage=20000000000&optimize_read_in_order=1",
+		withSettings("?database=jaeger", map[string]string{"optimize_read_in_order": "1", "max_memory_usage": "20000000000"}),
+	)
+	assert.Equal(t, "?max_execution_time=60", withSettings("", map[string]string{"max_execution_time": "60"}))
+}
+
+func TestStore_connectionParamsError(t *testing.T) {
+	tests := map[string]Configuration{
+		"IPv6 address without brackets": {Address: "tcp://::1:9000"},
+		"alt host with too many colons": {Address: "tcp://localhost:9000", AltHosts: []string{"::1:9000"}},
+		"unknown strategy":              {Address: "tcp://localhost:9000", ConnectionOpenStrategy: "fastest"},
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := connectionParams(config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStore_renderEmbeddedScripts(t *testing.T) {
+	disabled := false
+	month := time.Now().UTC().Format("200601")
+	day := time.Now().UTC().Format("20060102")
+	tests := map[string]struct {
+		config           Configuration
+		expectedCount    int
+		expectedContains []string
+	}{
+		"local": {
+			config:           Configuration{},
+			expectedCount:    4,
+			expectedContains: []string{"CREATE TABLE IF NOT EXISTS jaeger_index_local\n", "ENGINE MergeTree()", "FROM jaeger_index_local"},
+		},
+		"replication": {
+			config:        Configuration{Replication: true, Database: "jaeger"},
+			expectedCount: 8,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_index_local ON CLUSTER '{cluster}'",
+				"ENGINE ReplicatedMergeTree",
+				"FROM jaeger.jaeger_index_local",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_spans_local, cityHash64(traceID))",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_operations_local, rand())",
+			},
+		},
+		"archive replication": {
+			config: Configuration{
+				Replication:     true,
+				Database:        "jaeger",
+				ReplicationPath: "/clickhouse/tables/{shard}/{database}/{table}",
+				Archive:         ArchiveConfiguration{Table: "custom_archive"},
+			},
+			expectedCount: 8,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS custom_archive_local ON CLUSTER '{cluster}'",
+				"ENGINE ReplicatedMergeTree('/clickhouse/tables/{shard}/jaeger/custom_archive_local', '{replica}')",
+				"CREATE TABLE IF NOT EXISTS custom_archive\nON CLUSTER '{cluster}' AS jaeger.custom_archive_local\n" +
+					"ENGINE = Distributed('{cluster}', jaeger, custom_archive_local, cityHash64(traceID))",
+			},
+		},
+		"ttl": {
+			config:           Configuration{TTLDays: 3},
+			expectedCount:    4,
+			expectedContains: []string{"TTL timestamp + INTERVAL 3 DAY DELETE", "TTL date + INTERVAL 3 DAY DELETE"},
+		},
+		"multi tenant": {
+			config:        Configuration{MultiTenant: true},
+			expectedCount: 4,
+			expectedContains: []string{
+				"tenant     LowCardinality(String) CODEC (ZSTD(1)),",
+				"ORDER BY (tenant, service, -toUnixTimestamp(timestamp))",
+				"GROUP BY tenant, date, service, operation",
+			},
+		},
+		"dependencies": {
+			config:           Configuration{Dependencies: true, Replication: true, Database: "jaeger"},
+			expectedCount:    10,
+			expectedContains: []string{"CREATE TABLE IF NOT EXISTS jaeger_calls_local ON CLUSTER '{cluster}'", "ENGINE = Distributed('{cluster}', jaeger, jaeger_calls_local, cityHash64(traceID))"},
+		},
+		"binary trace IDs": {
+			config:        Configuration{BinaryTraceIDs: true},
+			expectedCount: 4,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_index_local\n(\n    timestamp  DateTime CODEC (Delta, ZSTD(1)),\n    traceID    FixedString(16) CODEC (ZSTD(1)),",
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local\n(\n    timestamp DateTime CODEC (Delta, ZSTD(1)),\n    traceID   FixedString(16) CODEC (ZSTD(1)),",
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_archive_local\n(\n    timestamp DateTime CODEC (Delta, ZSTD(1)),\n    traceID   FixedString(16) CODEC (ZSTD(1)),",
+			},
+		},
+		"stored dependencies": {
+			config:        Configuration{StoredDependencies: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_dependencies_local ON CLUSTER '{cluster}'\n(\n    tenant    LowCardinality(String)",
+				"ORDER BY (tenant, timestamp, parent, child)",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_dependencies_local, rand())",
+			},
+		},
+		"span logs": {
+			config:        Configuration{SpanLogs: true, BinaryTraceIDs: true},
+			expectedCount: 5,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_span_logs_local\n(\n    timestamp DateTime CODEC (Delta, ZSTD(1)),\n    traceID   FixedString(16)",
+				"fields Nested\n    (\n        key LowCardinality(String),\n        value String\n    ) CODEC (ZSTD(1)),",
+				"ORDER BY (service, timestamp)",
+			},
+		},
+		"deduplicate processes": {
+			config:        Configuration{DeduplicateProcesses: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_processes_local ON CLUSTER '{cluster}'\n(\n    tenant  LowCardinality(String)",
+				"ENGINE ReplicatedReplacingMergeTree\nORDER BY (tenant, hash)",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_processes_local, cityHash64(hash))",
+			},
+		},
+		"index from spans": {
+			config:        Configuration{IndexFromSpans: true, IndexRoots: true, Replication: true, Database: "jaeger"},
+			expectedCount: 11,
+			expectedContains: []string{
+				"ALTER TABLE jaeger_spans_local ON CLUSTER '{cluster}'\nADD COLUMN IF NOT EXISTS service LowCardinality(String)",
+				"ADD COLUMN IF NOT EXISTS isRoot UInt8 CODEC (ZSTD(1)),\nADD COLUMN IF NOT EXISTS tags Nested",
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_index_local_mv ON CLUSTER '{cluster}'\nTO jaeger.jaeger_index_local",
+				"isRoot,\n    tags.key,\n    tags.value\nFROM jaeger.jaeger_spans_local",
+				"ALTER TABLE jaeger_spans ON CLUSTER '{cluster}'\nADD COLUMN IF NOT EXISTS service",
+			},
+		},
+		"audit log": {
+			config:        Configuration{AuditLog: AuditLogConfiguration{Enabled: true, TTLDays: 90}, MultiTenant: true},
+			expectedCount: 5,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_audit_log_local\n(\n    tenant    LowCardinality(String)",
+				") ENGINE MergeTree()\nTTL timestamp + INTERVAL 90 DAY DELETE\nPARTITION BY toYYYYMM(timestamp)\nORDER BY (tenant, user, timestamp)",
+			},
+		},
+		"trace summaries": {
+			config:        Configuration{TraceSummaries: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_trace_summaries_local ON CLUSTER '{cluster}'\nENGINE ReplicatedAggregatingMergeTree",
+				"ORDER BY (tenant, traceID)",
+				"FROM jaeger.jaeger_index_local\nGROUP BY tenant, date, traceID",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_trace_summaries_local, cityHash64(traceID))",
+			},
+		},
+		"recent traces": {
+			config:        Configuration{RecentTraces: true, RecentTracesWindow: 2 * time.Hour},
+			expectedCount: 5,
+			expectedContains: []string{
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_recent_traces_local\nENGINE ReplacingMergeTree\nTTL timestamp + INTERVAL 7200 SECOND DELETE",
+				"ORDER BY (service, traceID)",
+				"max(timestamp) AS timestamp\nFROM jaeger_index_local\nGROUP BY service, traceID",
+			},
+		},
+		"archive index": {
+			config: Configuration{
+				Archive:       ArchiveConfiguration{Index: true, FederatedSearch: true},
+				ExtractedTags: []string{"http.method:String"},
+				MultiTenant:   true,
+				Replication:   true,
+				Database:      "jaeger",
+			},
+			expectedCount: 14,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_index_archive_local ON CLUSTER '{cluster}'",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_index_archive_local, cityHash64(traceID))",
+				"ALTER TABLE jaeger_index_archive_local ON CLUSTER '{cluster}'",
+				"ALTER TABLE jaeger_index_archive ON CLUSTER '{cluster}'",
+			},
+		},
+		"hot index": {
+			config:        Configuration{HotIndex: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_hot_index_local ON CLUSTER '{cluster}'\nENGINE ReplicatedMergeTree\n" +
+					"TTL timestamp + INTERVAL 86400 SECOND DELETE",
+				"ORDER BY (tenant, service, -toUnixTimestamp(timestamp))",
+				"POPULATE\nAS SELECT *\nFROM jaeger.jaeger_index_local\nWHERE timestamp >= now() - INTERVAL 86400 SECOND",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_hot_index_local, cityHash64(traceID))",
+			},
+		},
+		"duration baselines": {
+			config:        Configuration{DurationBaselines: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_operation_durations_local ON CLUSTER '{cluster}'\nENGINE ReplicatedAggregatingMergeTree",
+				"ORDER BY (tenant, service, operation, date)",
+				"quantilesTDigestState(0.5, 0.9, 0.95, 0.99)(durationUs) AS durations\nFROM jaeger.jaeger_index_local\nGROUP BY tenant, date, service, operation",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_operation_durations_local, rand())",
+			},
+		},
+		"operation profiles": {
+			config: Configuration{
+				OperationProfiles: OperationProfilesConfiguration{Enabled: true, TTLDays: 30},
+				MultiTenant:       true,
+				Replication:       true,
+				Database:          "jaeger",
+			},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_operation_profiles_local ON CLUSTER '{cluster}'",
+				"TTL timestamp + INTERVAL 30 DAY DELETE",
+				"ORDER BY (tenant, rootService, rootOperation, timestamp)",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_operation_profiles_local, cityHash64(traceID))",
+			},
+		},
+		"aggregated traces": {
+			config:        Configuration{AggregateTraces: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_traces_local ON CLUSTER '{cluster}'\nENGINE ReplicatedAggregatingMergeTree",
+				"CAST(groupArray(model) AS SimpleAggregateFunction(groupArrayArray, Array(String))) AS models",
+				"FROM jaeger.jaeger_spans_local\nGROUP BY tenant, date, traceID",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_traces_local, cityHash64(traceID))",
+			},
+		},
+		"service aliases": {
+			config:        Configuration{ServiceAliases: map[string]string{"cart": "cart-service"}, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_service_aliases ON CLUSTER '{cluster}'",
+				"ENGINE ReplicatedMergeTree('/clickhouse/tables/all/jaeger/jaeger_service_aliases', '{replica}')",
+				"CREATE DICTIONARY IF NOT EXISTS jaeger_service_aliases_dict ON CLUSTER '{cluster}'",
+				"SOURCE(CLICKHOUSE(DB 'jaeger' TABLE 'jaeger_service_aliases'))",
+			},
+		},
+		"quoted names": {
+			config: Configuration{
+				ServiceAliases:      map[string]string{"cart": "cart-service"},
+				ServiceAliasesTable: "service-aliases",
+				SpansTable:          "jaeger-spans",
+				Replication:         true,
+				Database:            "jaeger-prod",
+			},
+			expectedCount: 10,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS `jaeger-spans_local` ON CLUSTER '{cluster}'",
+				"CREATE TABLE IF NOT EXISTS `jaeger-spans`\nON CLUSTER '{cluster}' AS `jaeger-prod`.`jaeger-spans_local`\n" +
+					"ENGINE = Distributed('{cluster}', `jaeger-prod`, `jaeger-spans_local`, cityHash64(traceID))",
+				"FROM `jaeger-prod`.jaeger_index_local",
+				"ENGINE ReplicatedMergeTree('/clickhouse/tables/all/jaeger-prod/service-aliases', '{replica}')",
+				"CREATE DICTIONARY IF NOT EXISTS `service-aliases_dict` ON CLUSTER '{cluster}'",
+				"SOURCE(CLICKHOUSE(DB 'jaeger-prod' TABLE 'service-aliases'))",
+			},
+		},
+		"replication path": {
+			config: Configuration{
+				ServiceAliases:  map[string]string{"cart": "cart-service"},
+				Replication:     true,
+				Database:        "jaeger",
+				ReplicationPath: "/clickhouse/jaeger-prod/tables/{shard}/{database}/{table}",
+				ReplicaName:     "{replica}-prod",
+			},
+			expectedCount: 10,
+			expectedContains: []string{
+				"ENGINE ReplicatedMergeTree('/clickhouse/jaeger-prod/tables/{shard}/jaeger/jaeger_index_local', '{replica}-prod')",
+				"ENGINE ReplicatedMergeTree('/clickhouse/jaeger-prod/tables/{shard}/jaeger/jaeger_spans_local', '{replica}-prod')",
+				"ENGINE ReplicatedMergeTree('/clickhouse/jaeger-prod/tables/all/jaeger/jaeger_service_aliases', '{replica}-prod')",
+			},
+		},
+		"hidden traces": {
+			config:        Configuration{HiddenTraces: true, MultiTenant: true, Replication: true, Database: "jaeger"},
+			expectedCount: 9,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_hidden_traces ON CLUSTER '{cluster}'",
+				"ENGINE ReplicatedMergeTree('/clickhouse/tables/all/jaeger/jaeger_hidden_traces', '{replica}')\nORDER BY (tenant, traceID)",
+			},
+		},
+		"clock skew quarantine": {
+			config:        Configuration{ClockSkewPolicy: clickhousespanstore.ClockSkewQuarantine, TTLDays: 3},
+			expectedCount: 5,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_quarantine_local\n",
+				"TTL insertedAt + INTERVAL 3 DAY DELETE\nPARTITION BY toDate(insertedAt)",
+			},
+		},
+		"archive disabled": {
+			config:        Configuration{Archive: ArchiveConfiguration{Enabled: &disabled}, Replication: true, Database: "jaeger"},
+			expectedCount: 6,
+		},
+		"index links": {
+			config:        Configuration{IndexLinks: true},
+			expectedCount: 4,
+			expectedContains: []string{
+				"linkedTraceIDs Array(String) CODEC (ZSTD(1)),\n",
+				"INDEX idx_linked_trace_ids linkedTraceIDs TYPE bloom_filter(0.01) GRANULARITY 64,\n",
+			},
+		},
+		"index status codes": {
+			config:        Configuration{IndexStatusCodes: true},
+			expectedCount: 4,
+			expectedContains: []string{
+				"httpStatusCode Nullable(UInt16) CODEC (ZSTD(1)),\n",
+				"grpcStatusCode Nullable(UInt16) CODEC (ZSTD(1)),\n",
+			},
+		},
+		"written operations": {
+			config:           Configuration{WriteOperations: true},
+			expectedCount:    4,
+			expectedContains: []string{"CREATE TABLE IF NOT EXISTS jaeger_operations_local\n"},
+		},
+		"index span kind": {
+			config:           Configuration{IndexSpanKind: true},
+			expectedCount:    4,
+			expectedContains: []string{"spanKind   LowCardinality(String) CODEC (ZSTD(1)),\n"},
+		},
+		"index roots": {
+			config:           Configuration{IndexRoots: true},
+			expectedCount:    4,
+			expectedContains: []string{"isRoot     UInt8 CODEC (ZSTD(1)),\n"},
+		},
+		"index insert time": {
+			config:        Configuration{IndexInsertTime: true},
+			expectedCount: 5,
+			expectedContains: []string{
+				"insertedAt DateTime DEFAULT timestamp CODEC (Delta, ZSTD(1)),\n",
+				"ALTER TABLE jaeger_index_local\nADD COLUMN IF NOT EXISTS insertedAt DateTime DEFAULT timestamp CODEC (Delta, ZSTD(1))",
+			},
+		},
+		"deduplication window": {
+			config:        Configuration{InsertDeduplicationWindow: 1000, Dependencies: true},
+			expectedCount: 5,
+			expectedContains: []string{
+				"ORDER BY traceID\nSETTINGS index_granularity = 1024, non_replicated_deduplication_window = 1000",
+				"ORDER BY (service, -toUnixTimestamp(timestamp))\nSETTINGS index_granularity = 1024, non_replicated_deduplication_window = 1000",
+				"ORDER BY (timestamp, traceID)\nSETTINGS index_granularity = 1024, non_replicated_deduplication_window = 1000",
+			},
+		},
+		"replicated deduplication window": {
+			config:        Configuration{InsertDeduplicationWindow: 1000, Replication: true, Database: "jaeger"},
+			expectedCount: 8,
+			expectedContains: []string{
+				"ORDER BY traceID\nSETTINGS index_granularity = 1024, replicated_deduplication_window = 1000",
+			},
+		},
+		"replicated deduplication window seconds": {
+			config:        Configuration{InsertDeduplicationWindowSeconds: 3600, Replication: true, Database: "jaeger"},
+			expectedCount: 8,
+			expectedContains: []string{
+				"ORDER BY traceID\nSETTINGS index_granularity = 1024, replicated_deduplication_window_seconds = 3600",
+				"ORDER BY (service, -toUnixTimestamp(timestamp))\nSETTINGS index_granularity = 1024, replicated_deduplication_window_seconds = 3600",
+			},
+		},
+		"priority ttl": {
+			config:        Configuration{TTLDays: 3, PriorityTTLDays: 30},
+			expectedCount: 4,
+			expectedContains: []string{
+				"    priority  UInt8 CODEC (ZSTD(1))\n",
+				"    priority   UInt8 CODEC (ZSTD(1)),\n",
+				"TTL timestamp + INTERVAL 3 DAY DELETE WHERE priority = 0, timestamp + INTERVAL 30 DAY DELETE\n",
+			},
+		},
+		"sort keys": {
+			config: Configuration{
+				SpansOrderBy: []string{"tenant", "traceID"},
+				IndexOrderBy: []string{"tenant", "service", "operation", "-toUnixTimestamp(timestamp)"},
+				MultiTenant:  true,
+			},
+			expectedCount: 4,
+			expectedContains: []string{
+				"ORDER BY (tenant, traceID)\n",
+				"ORDER BY (tenant, service, operation, -toUnixTimestamp(timestamp))\n",
+			},
+		},
+		"codecs": {
+			config: Configuration{
+				Codecs:        map[string]string{"model": "ZSTD(6)", "timestamp": "DoubleDelta, LZ4", "tag_user_id": "LZ4HC(9)"},
+				ExtractedTags: []string{"user.id:String"},
+			},
+			expectedCount: 5,
+			expectedContains: []string{
+				"model     String CODEC (ZSTD(6))\n",
+				"timestamp  DateTime CODEC (DoubleDelta, LZ4),\n",
+				"traceID    String CODEC (ZSTD(1)),\n",
+				"tag_user_id Nullable(String) CODEC (LZ4HC(9)),\n",
+				"ADD COLUMN IF NOT EXISTS tag_user_id Nullable(String) CODEC (LZ4HC(9))",
+			},
+		},
+		"extracted tags": {
+			config:        Configuration{ExtractedTags: []string{"http.status_code:UInt16", "user.id:String"}, Replication: true, Database: "jaeger"},
+			expectedCount: 10,
+			expectedContains: []string{
+				"tag_http_status_code Nullable(UInt16) CODEC (ZSTD(1)),\n    tag_user_id Nullable(String) CODEC (ZSTD(1)),\n",
+				"ALTER TABLE jaeger_index_local ON CLUSTER '{cluster}'\n" +
+					"ADD COLUMN IF NOT EXISTS tag_http_status_code Nullable(UInt16) CODEC (ZSTD(1)),\n" +
+					"ADD COLUMN IF NOT EXISTS tag_user_id Nullable(String) CODEC (ZSTD(1))",
+				"ALTER TABLE jaeger_index ON CLUSTER '{cluster}'\n",
+			},
+		},
+		"table rotation": {
+			config:        Configuration{TableRotation: clickhousespanstore.RotationMonthly},
+			expectedCount: 7,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_operations_local\n(",
+				"ENGINE SummingMergeTree",
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_" + month + "_local\n",
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_operations_" + month + "_local\n" +
+					"TO jaeger_operations_local\n",
+				"FROM jaeger_index_" + month + "_local\n",
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local\nAS default.jaeger_spans_" + month + "_local\n" +
+					"ENGINE = Merge(default, '^jaeger_spans_[0-9]+_local$')",
+			},
+		},
+		"replicated table rotation": {
+			config:        Configuration{TableRotation: clickhousespanstore.RotationDaily, Replication: true, Database: "jaeger"},
+			expectedCount: 11,
+			expectedContains: []string{
+				"TO jaeger.jaeger_operations_local\n",
+				"FROM jaeger.jaeger_index_" + day + "_local\n",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_index_" + day + "_local, cityHash64(traceID))",
+				"CREATE TABLE IF NOT EXISTS jaeger_index ON CLUSTER '{cluster}'\nAS jaeger.jaeger_index_" + day + "\n" +
+					"ENGINE = Merge(jaeger, '^jaeger_index_[0-9]+$')",
+			},
+		},
+		"index flags": {
+			config:           Configuration{IndexFlags: true},
+			expectedCount:    4,
+			expectedContains: []string{"durationUs UInt64 CODEC (ZSTD(1)),\n    flags      UInt32 CODEC (ZSTD(1)),\n"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.config.setDefaults()
+			statements, err := renderEmbeddedScripts(test.config)
+			require.NoError(t, err)
+			assert.Len(t, statements, test.expectedCount)
+			all := strings.Join(statements, "\n")
+			for _, expected := range test.expectedContains {
+				assert.Contains(t, all, expected)
+			}
+			if !test.config.MultiTenant {
+				assert.NotContains(t, all, "tenant")
+			}
+			if !test.config.ArchiveEnabled() {
+				assert.NotContains(t, all, "archive")
+			}
+		})
+	}
+}
+
+func TestStore_renderPeriodScripts(t *testing.T) {
+	config := Configuration{TableRotation: clickhousespanstore.RotationMonthly, MultiTenant: true}
+	config.setDefaults()
+	rotation, err := config.tableRotation(nil)
+	require.NoError(t, err)
+
+	statements, err := renderPeriodScripts(config, rotation, "202110")
+	require.NoError(t, err)
+	require.Len(t, statements, 3)
+	assert.Contains(t, statements[0], "CREATE TABLE IF NOT EXISTS jaeger_index_202110_local\n")
+	assert.Contains(t, statements[1], "CREATE TABLE IF NOT EXISTS jaeger_spans_202110_local\n")
+	assert.Contains(t, statements[2], "CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_operations_202110_local\nTO jaeger_operations_local\n")
+	assert.Contains(t, statements[2], "FROM jaeger_index_202110_local\nGROUP BY tenant, date")
+}
+
+func TestStore_renderPeriodScriptsExtractedTags(t *testing.T) {
+	config := Configuration{
+		TableRotation: clickhousespanstore.RotationMonthly,
+		ExtractedTags: []string{"http.method:String"},
+		Replication:   true,
+	}
+	config.setDefaults()
+	rotation, err := config.tableRotation(nil)
+	require.NoError(t, err)
+
+	statements, err := renderPeriodScripts(config, rotation, "202110")
+	require.NoError(t, err)
+	require.Len(t, statements, 7)
+	assert.Contains(t, statements[3], "ALTER TABLE jaeger_index_202110_local ON CLUSTER '{cluster}'\nADD COLUMN IF NOT EXISTS")
+	assert.Contains(t, statements[6], "ALTER TABLE jaeger_index_202110 ON CLUSTER '{cluster}'\nADD COLUMN IF NOT EXISTS",
+		"index tables of the current period get columns of tags extracted after they were created")
+}
+
+func TestStore_writeTables(t *testing.T) {
+	tests := map[string]struct {
+		config          Configuration
+		queryResult     *sqlmock.Rows
+		queryError      error
+		expectedTables  insertTables
+		expectedWarning []mocks.LogMock
+		expectedInfo    []mocks.LogMock
+	}{
+		"no replication": {
+			config: Configuration{WriteLocalShard: true},
+			expectedTables: insertTables{
+				index:        "jaeger_index_local",
+				spans:        "jaeger_spans_local",
+				archive:      "jaeger_spans_archive_local",
+				archiveIndex: "jaeger_index_archive_local",
+				calls:        "jaeger_calls_local",
+				operations:   "jaeger_operations_local",
+				quarantine:   "jaeger_spans_quarantine_local",
+				spanLogs:     "jaeger_span_logs_local",
+				processes:    "jaeger_processes_local",
+			},
+		},
+		"distributed": {
+			config: Configuration{Replication: true},
+			expectedTables: insertTables{
+				index:        "jaeger_index",
+				spans:        "jaeger_spans",
+				archive:      "jaeger_spans_archive",
+				archiveIndex: "jaeger_index_archive",
+				calls:        "jaeger_calls",
+				operations:   "jaeger_operations",
+				quarantine:   "jaeger_spans_quarantine",
+				spanLogs:     "jaeger_span_logs",
+				processes:    "jaeger_processes",
+			},
+		},
+		"local shard": {
+			config:      Configuration{Replication: true, WriteLocalShard: true},
+			queryResult: sqlmock.NewRows([]string{"count()"}).AddRow(uint64(1)),
+			expectedTables: insertTables{
+				index:        "jaeger_index_local",
+				spans:        "jaeger_spans_local",
+				archive:      "jaeger_spans_archive_local",
+				archiveIndex: "jaeger_index_archive_local",
+				calls:        "jaeger_calls_local",
+				operations:   "jaeger_operations_local",
+				quarantine:   "jaeger_spans_quarantine_local",
+				spanLogs:     "jaeger_span_logs_local",
+				processes:    "jaeger_processes_local",
+			},
+			expectedInfo: []mocks.LogMock{{Msg: "Writing to local shard tables"}},
+		},
+		"node not in cluster": {
+			config:      Configuration{Replication: true, WriteLocalShard: true},
+			queryResult: sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)),
+			expectedTables: insertTables{
+				index:        "jaeger_index",
+				spans:        "jaeger_spans",
+				archive:      "jaeger_spans_archive",
+				archiveIndex: "jaeger_index_archive",
+				calls:        "jaeger_calls",
+				operations:   "jaeger_operations",
+				quarantine:   "jaeger_spans_quarantine",
+				spanLogs:     "jaeger_span_logs",
+				processes:    "jaeger_processes",
+			},
+			expectedWarning: []mocks.LogMock{{Msg: "Node is not found in the cluster, writing to distributed tables"}},
+		},
+		"query error": {
+			config:     Configuration{Replication: true, WriteLocalShard: true},
+			queryError: errorMock,
+			expectedTables: insertTables{
+				index:        "jaeger_index",
+				spans:        "jaeger_spans",
+				archive:      "jaeger_spans_archive",
+				archiveIndex: "jaeger_index_archive",
+				calls:        "jaeger_calls",
+				operations:   "jaeger_operations",
+				quarantine:   "jaeger_spans_quarantine",
+				spanLogs:     "jaeger_span_logs",
+				processes:    "jaeger_processes",
+			},
+			expectedWarning: []mocks.LogMock{{
+				Msg:  "Could not discover local shard, writing to distributed tables",
+				Args: []interface{}{"error", errorMock},
+			}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err)
+			defer db.Close()
+
+			if test.queryResult != nil {
+				mock.ExpectQuery(localShardQuery).WillReturnRows(test.queryResult)
+			} else if test.queryError != nil {
+				mock.ExpectQuery(localShardQuery).WillReturnError(test.queryError)
+			}
+
+			spyLogger := mocks.NewSpyLogger()
+			test.config.setDefaults()
+			assert.Equal(t, test.expectedTables, writeTables(spyLogger, db, test.config))
+			assert.NoError(t, mock.ExpectationsWereMet())
+			spyLogger.AssertLogsOfLevelEqual(t, hclog.Warn, test.expectedWarning)
+			spyLogger.AssertLogsOfLevelEqual(t, hclog.Info, test.expectedInfo)
+		})
+	}
+}
+
+func TestConfiguration_secondaryWriter(t *testing.T) {
+	cfg := Configuration{IndexFromSpans: true}
+	cfg.setDefaults()
+	span := &model.Span{TraceID: model.TraceID{Low: 1}, SpanID: 2, Process: model.NewProcess("service", nil)}
+
+	for name, table := range map[string]clickhousespanstore.TableName{
+		"archive":    cfg.GetSpansArchiveTable(),
+		"quarantine": cfg.GetSpansQuarantineTable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err, "an error was not expected when opening a stub database connection")
+			defer db.Close()
+
+			// Only the spans table has index columns
+			mock.ExpectBegin()
+			mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) VALUES (?, ?, ?)", table)).
+				ExpectExec().
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			writer := cfg.secondaryWriter(hclog.NewNullLogger(), db, "", table)
+			require.NoError(t, writer.WriteBatch(context.Background(), []*model.Span{span}))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestStore_NewStoreWithDBUserConnectionsError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = NewStoreWithDB(hclog.NewNullLogger(), Configuration{
+		Address:          "tcp://localhost:9000",
+		AltHosts:         []string{"::1:9000"},
+		RowLevelSecurity: RowLevelSecurityConfiguration{UserHeader: "x-jaeger-user"},
+	}, db)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid ClickHouse alt host", "pools of users are set up before anything else")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// traceSummary is a summary of a trace in responses of the trace summaries endpoint, times in microseconds
+type traceSummary struct {
+	TraceID       string `json:"traceID"`
+	SpanCount     uint64 `json:"spanCount"`
+	StartTime     int64  `json:"startTime"`
+	Duration      int64  `json:"duration"`
+	RootService   string `json:"rootService"`
+	RootOperation string `json:"rootOperation,omitempty"`
+}
+
+// TraceSummariesHandler serves summaries of traces matching a search on GET as JSON, without fetching their spans.
+// It accepts the search query parameters of the export endpoint but format, the tenant is taken from the HTTP header
+// with the same name as the gRPC metadata key.
+func (s *Store) TraceSummariesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reader, ok := s.reader.(*clickhousespanstore.TraceReader)
+		if !ok {
+			http.Error(w, "trace summaries are not supported by the reader", http.StatusNotFound)
+			return
+		}
+		params, err := parseSearchParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		summaries, err := reader.FindTraceSummaries(s.requestContext(r), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := make([]traceSummary, len(summaries))
+		for i, summary := range summaries {
+			data[i] = traceSummary{
+				TraceID:       summary.TraceID.String(),
+				SpanCount:     summary.SpanCount,
+				StartTime:     summary.StartTime.UnixNano() / 1000,
+				Duration:      summary.Duration.Microseconds(),
+				RootService:   summary.RootService,
+				RootOperation: summary.RootOperation,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestStore_TraceSummariesHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Hour)
+	mock.ExpectQuery("SELECT DISTINCT traceID FROM test_index_table WHERE tenant = ? AND service = ? AND timestamp >= ?"+
+		" AND timestamp <= ? ORDER BY tenant, service, timestamp DESC LIMIT ?").
+		WithArgs("tenant_1", "frontend", start, end, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID"}).AddRow("000000000000001a").AddRow("000000000000002b"))
+	mock.ExpectQuery("SELECT traceID, sum(spans), min(start), max(durationUs), argMaxMerge(rootService) FROM test_summaries_table"+
+		" WHERE tenant = ? AND traceID IN (?,?) GROUP BY traceID").
+		WithArgs("tenant_1", "000000000000001a", "000000000000002b").
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "sum(spans)", "min(start)", "max(durationUs)", "argMaxMerge(rootService)"}).
+			AddRow("000000000000001a", uint64(10), start, uint64(2000000), "gateway"))
+
+	reader := clickhousespanstore.NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		clickhousespanstore.WithReaderTenantHeader("x-tenant"), clickhousespanstore.WithTraceSummaries("test_summaries_table"))
+	handler := (&Store{reader: reader, requestHeaders: []string{"x-tenant"}}).TraceSummariesHandler()
+
+	request := httptest.NewRequest(http.MethodGet,
+		"/api/trace-summaries?service=frontend&start=1628000000000000&end=1628003600000000&limit=2", nil)
+	request.Header.Set("x-tenant", "tenant_1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"data": [{"traceID": "000000000000001a", "spanCount": 10, "startTime": 1628000000000000,
+		"duration": 2000000, "rootService": "gateway"}]}`, recorder.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_TraceSummariesHandlerErrors(t *testing.T) {
+	handler := (&Store{reader: clickhousespanstore.NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)}).
+		TraceSummariesHandler()
+	tests := map[string]struct {
+		method       string
+		target       string
+		expectedCode int
+	}{
+		"wrong method":  {method: http.MethodPost, target: "/?start=1", expectedCode: http.StatusMethodNotAllowed},
+		"no start":      {method: http.MethodGet, target: "/", expectedCode: http.StatusBadRequest},
+		"invalid limit": {method: http.MethodGet, target: "/?start=1&limit=-1", expectedCode: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
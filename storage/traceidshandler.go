@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// traceIDsPage is a page of IDs of found traces in responses of the trace IDs endpoint
+type traceIDsPage struct {
+	TraceIDs      []string `json:"traceIDs"`
+	NextPageToken string   `json:"nextPageToken"`
+}
+
+// TraceIDsHandler serves pages of IDs of traces matching a search on GET as JSON, the most recent traces first.
+// It accepts the search query parameters of the export endpoint but format, and the pageToken query parameter with
+// the nextPageToken of the previous page. The tenant is taken from the HTTP header with the same name as the gRPC
+// metadata key.
+func (s *Store) TraceIDsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reader, ok := s.reader.(*clickhousespanstore.TraceReader)
+		if !ok {
+			http.Error(w, "pages of trace IDs are not supported by the reader", http.StatusNotFound)
+			return
+		}
+		params, err := parseSearchParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		traceIDs, token, err := reader.FindTraceIDsPage(s.requestContext(r), params, r.URL.Query().Get("pageToken"))
+		if errors.Is(err, clickhousespanstore.ErrInvalidPageToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page := traceIDsPage{TraceIDs: make([]string, len(traceIDs)), NextPageToken: token}
+		for i, traceID := range traceIDs {
+			page.TraceIDs[i] = traceID.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+	})
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestStore_TraceIDsHandler(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Unix(1628000000, 0)
+	end := start.Add(time.Hour)
+	last := start.Add(10 * time.Minute)
+	query := "SELECT traceID, max(timestamp) AS lastTimestamp FROM test_index_table WHERE tenant = ? AND service = ?" +
+		" AND timestamp >= ? AND timestamp <= ? GROUP BY traceID"
+	order := " ORDER BY lastTimestamp DESC, traceID LIMIT ?"
+	mock.ExpectQuery(query+order).
+		WithArgs("tenant_1", "frontend", start, end, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "lastTimestamp"}).
+			AddRow("000000000000001a", start.Add(30*time.Minute)).
+			AddRow("000000000000002b", last))
+	mock.ExpectQuery(query+" HAVING lastTimestamp < ? OR (lastTimestamp = ? AND traceID NOT IN (?))"+order).
+		WithArgs("tenant_1", "frontend", start, end, last, last, "000000000000002b", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"traceID", "lastTimestamp"}))
+
+	reader := clickhousespanstore.NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable,
+		clickhousespanstore.WithReaderTenantHeader("x-tenant"))
+	handler := (&Store{reader: reader, requestHeaders: []string{"x-tenant"}}).TraceIDsHandler()
+	getPage := func(token string) traceIDsPage {
+		request := httptest.NewRequest(http.MethodGet, "/api/trace-ids?service=frontend&start=1628000000000000"+
+			"&end=1628003600000000&limit=2&pageToken="+url.QueryEscape(token), nil)
+		request.Header.Set("x-tenant", "tenant_1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		var page traceIDsPage
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+		return page
+	}
+
+	first := getPage("")
+	assert.Equal(t, []string{"000000000000001a", "000000000000002b"}, first.TraceIDs)
+	require.NotEmpty(t, first.NextPageToken)
+	second := getPage(first.NextPageToken)
+	assert.Empty(t, second.TraceIDs)
+	assert.Empty(t, second.NextPageToken, "there is no page after the last one")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_TraceIDsHandlerErrors(t *testing.T) {
+	handler := (&Store{reader: clickhousespanstore.NewTraceReader(nil, testOperationsTable, testIndexTable, testSpansTable)}).
+		TraceIDsHandler()
+	tests := map[string]struct {
+		method       string
+		target       string
+		expectedCode int
+	}{
+		"wrong method":       {method: http.MethodPost, target: "/?start=1", expectedCode: http.StatusMethodNotAllowed},
+		"no start":           {method: http.MethodGet, target: "/", expectedCode: http.StatusBadRequest},
+		"invalid page token": {method: http.MethodGet, target: "/?start=1&pageToken=e30", expectedCode: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+			assert.Equal(t, test.expectedCode, recorder.Code)
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// databasePattern and tablePattern match names of databases and tables with an optional database, which are quoted
+// in queries unless they are plain identifiers, settingPattern names of ClickHouse settings
+var (
+	databasePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	settingPattern  = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	tablePattern    = regexp.MustCompile(`^([A-Za-z0-9_-]+\.)?[A-Za-z0-9_-]+$`)
+)
+
+// connectionParameters are query parameters of the DSN configuring the connection, not ClickHouse settings
+var connectionParameters = map[string]bool{
+	"database": true, "username": true, "password": true, "alt_hosts": true, "connection_open_strategy": true,
+	"secure": true, "skip_verify": true, "tls_config": true, "debug": true, "compress": true, "block_size": true,
+	"pool_size": true, "read_timeout": true, "write_timeout": true, "no_delay": true,
+}
+
+// ValidationErrors are all problems found in a configuration
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// Validate checks that the configuration has no contradicting options, values are in their ranges and names
+// of the database and tables are safe to be used in queries. Options that are not set are checked with their defaults.
+// All found problems are returned together as ValidationErrors.
+func (cfg Configuration) Validate() error {
+	cfg.setDefaults()
+	var errs ValidationErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	collect := func(_ interface{}, err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Contradicting options
+	if cfg.InitSQLScriptsDir != "" {
+		if cfg.ReplicationPath != "" {
+			fail("replication_path is used only by the embedded scripts, not with init_sql_scripts_dir")
+		}
+		if len(cfg.Codecs) > 0 {
+			fail("codecs are used only by the embedded scripts, not with init_sql_scripts_dir")
+		}
+		if cfg.TTLDays > 0 {
+			fail("ttl is used only by the embedded scripts, not with init_sql_scripts_dir")
+		}
+		if cfg.PriorityTTLDays > 0 {
+			fail("priority_ttl is used only by the embedded scripts, not with init_sql_scripts_dir")
+		}
+		if len(cfg.SpansOrderBy) > 0 || len(cfg.IndexOrderBy) > 0 {
+			fail("spans_order_by and index_order_by are used only by the embedded scripts, not with init_sql_scripts_dir")
+		}
+	}
+	if !cfg.Replication {
+		if cfg.WriteLocalShard {
+			fail("write_local_shard requires replication")
+		}
+		if cfg.PartialResults {
+			fail("partial_results requires replication")
+		}
+		if cfg.SequentialConsistency {
+			fail("sequential_consistency requires replication")
+		}
+		if cfg.ReplicationPath != "" {
+			fail("replication_path requires replication")
+		}
+		if cfg.InsertDeduplicationWindowSeconds > 0 {
+			fail("insert_deduplication_window_seconds requires replication")
+		}
+		if cfg.InsertDeduplicate != nil && *cfg.InsertDeduplicate && cfg.InsertDeduplicationWindow == 0 {
+			fail("insert_deduplicate requires insert_deduplication_window unless replication is enabled")
+		}
+	}
+	if cfg.SequentialConsistency && cfg.Settings.Write["insert_quorum"] == "" {
+		fail("sequential_consistency requires the insert_quorum write setting")
+	}
+	if _, ok := cfg.Settings.Write["insert_deduplicate"]; ok && cfg.InsertDeduplicate != nil {
+		fail("insert_deduplicate cannot be used with the insert_deduplicate write setting")
+	}
+	if cfg.PurgeEndpoint && cfg.TableRotation != "" {
+		fail("purge_endpoint cannot be used with table_rotation")
+	}
+	if cfg.MaintenanceEndpoint && cfg.TableRotation != "" {
+		fail("maintenance_endpoint cannot be used with table_rotation")
+	}
+	if cfg.IndexFromSpans {
+		// Columns of tags extracted later would be missing in the view, re-encoded spans would be indexed again
+		if len(cfg.ExtractedTags) > 0 {
+			fail("index_from_spans cannot be used with extracted_tags")
+		}
+		if !cfg.DualEncodingUntil.IsZero() {
+			fail("index_from_spans cannot be used with dual_encoding_until")
+		}
+		// The view would insert rows without insert times
+		if cfg.IndexInsertTime {
+			fail("index_from_spans cannot be used with index_insert_time")
+		}
+	}
+	// The re-encoder inserts spans as they are stored, so spans written before deduplication keep their processes
+	if cfg.DeduplicateProcesses && !cfg.DualEncodingUntil.IsZero() {
+		fail("deduplicate_processes cannot be used with dual_encoding_until")
+	}
+	if cfg.ReplaceRunningQueries && !cfg.ReadQueryIDs {
+		fail("replace_running_queries requires read_query_ids")
+	}
+	if cfg.InsertFormat == InsertRowBinary {
+		if cfg.HTTPAddress == "" {
+			fail("insert_format row_binary requires http_address")
+		}
+		// Index columns of the spans table are inserted over the native protocol only
+		if cfg.IndexFromSpans {
+			fail("insert_format row_binary cannot be used with index_from_spans")
+		}
+	}
+	if cfg.BinaryTraceIDs {
+		// Tables derived from spans and their readers keep hexadecimal trace IDs
+		for _, option := range []struct {
+			name    string
+			enabled bool
+		}{
+			{name: "trace_summaries", enabled: cfg.TraceSummaries},
+			{name: "aggregate_traces", enabled: cfg.AggregateTraces},
+			{name: "recent_traces", enabled: cfg.RecentTraces},
+			{name: "hidden_traces", enabled: cfg.HiddenTraces},
+			{name: "auto_archive", enabled: len(cfg.AutoArchive.Rules) > 0},
+			{name: "operation_profiles", enabled: cfg.OperationProfiles.Enabled},
+		} {
+			if option.enabled {
+				fail("binary_trace_ids cannot be used with %s", option.name)
+			}
+		}
+	}
+	if cfg.AuditLog.Enabled && cfg.AuditLog.UserHeader == "" {
+		fail("audit_log requires user_header")
+	}
+	if cfg.TraceQuality && !cfg.Dependencies {
+		fail("trace_quality requires dependencies")
+	}
+	if cfg.PriorityTTLDays > 0 && cfg.TTLDays == 0 {
+		fail("priority_ttl requires ttl")
+	}
+	if len(cfg.AltHosts) > 0 {
+		if cfg.DSN != "" {
+			fail("alt_hosts cannot be used with dsn, alt_hosts parameter of the dsn is used instead")
+		}
+		if cfg.Failover.SecondaryAddress != "" {
+			fail("alt_hosts cannot be used with failover")
+		}
+	}
+	if cfg.Proxy.URL != "" || cfg.Dial != nil {
+		// Alternative hosts and connections of users are dialed by the driver, not through the proxy
+		if len(cfg.AltHosts) > 0 {
+			fail("proxy cannot be used with alt_hosts")
+		}
+		if cfg.RowLevelSecurity.UserHeader != "" {
+			fail("proxy cannot be used with row_level_security")
+		}
+	}
+	// Connections of users go to the address, reads of users would not fail over to the secondary cluster
+	if cfg.Failover.SecondaryAddress != "" && cfg.RowLevelSecurity.UserHeader != "" {
+		fail("failover cannot be used with row_level_security")
+	}
+	// Users of HTTP requests are taken from headers any client can set, they are not authenticated like gRPC users
+	if cfg.ExportEndpoint && cfg.RowLevelSecurity.UserHeader != "" {
+		fail("export_endpoint cannot be used with row_level_security")
+	}
+	if cfg.TraceIDsEndpoint && cfg.RowLevelSecurity.UserHeader != "" {
+		fail("trace_ids_endpoint cannot be used with row_level_security")
+	}
+	if cfg.Archive.Endpoint && !cfg.ArchiveEnabled() {
+		fail("archive endpoint requires the archive storage")
+	}
+	if len(cfg.AutoArchive.Rules) > 0 && !cfg.ArchiveEnabled() {
+		fail("auto archive requires the archive storage")
+	}
+	if cfg.Archive.Index && !cfg.ArchiveEnabled() {
+		fail("archive index requires the archive storage")
+	}
+	// Index rows would be written by the view from the spans table only, not from the archive table
+	if cfg.Archive.Index && cfg.IndexFromSpans {
+		fail("archive index cannot be used with index_from_spans")
+	}
+	if cfg.Archive.FederatedSearch && !cfg.Archive.Index && cfg.SpansSearchLimit == 0 {
+		fail("archive federated_search requires archive index or spans_search_limit")
+	}
+	for i, rule := range cfg.AutoArchive.Rules {
+		if rule.MinDuration == 0 && !rule.Error && len(rule.Tags) == 0 {
+			fail("auto archive rule %d has no criteria", i+1)
+		}
+	}
+	if cfg.GRPCServer.TLSClientCAFile != "" && (cfg.GRPCServer.TLSCertFile == "" || cfg.GRPCServer.TLSKeyFile == "") {
+		fail("grpc_server tls_client_ca_file requires server certificate and key")
+	}
+	if (cfg.GRPCServer.TLSCertFile == "") != (cfg.GRPCServer.TLSKeyFile == "") {
+		fail("grpc_server tls_cert_file and tls_key_file have to be set together")
+	}
+	collect(cfg.tableRotation(nil))
+
+	// Values
+	switch cfg.Encoding {
+	case JSONEncoding, ProtobufEncoding:
+	default:
+		fail("unknown encoding %q", cfg.Encoding)
+	}
+	switch cfg.InsertFormat {
+	case InsertNative, InsertRowBinary:
+	default:
+		fail("unknown insert format %q", cfg.InsertFormat)
+	}
+	if cfg.HTTPAddress != "" {
+		if parsed, err := url.Parse(cfg.HTTPAddress); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			fail("invalid http_address %q, expected http://host:port or https://host:port", cfg.HTTPAddress)
+		}
+	}
+	switch cfg.ConnectionOpenStrategy {
+	case "", "random", "in_order", "time_random":
+	default:
+		fail("unknown connection open strategy %q", cfg.ConnectionOpenStrategy)
+	}
+	switch cfg.Prewhere {
+	case PrewhereAuto, PrewhereEnabled, PrewhereDisabled:
+	default:
+		fail("unknown prewhere mode %q", cfg.Prewhere)
+	}
+	switch cfg.ClockSkewPolicy {
+	case clickhousespanstore.ClockSkewKeep, clickhousespanstore.ClockSkewClamp,
+		clickhousespanstore.ClockSkewDrop, clickhousespanstore.ClockSkewQuarantine:
+	default:
+		fail("unknown clock skew policy %q", cfg.ClockSkewPolicy)
+	}
+	switch cfg.DecodeFailurePolicy {
+	case clickhousespanstore.DecodeFailureIgnore, clickhousespanstore.DecodeFailureFail, clickhousespanstore.DecodeFailureAnnotate:
+	default:
+		fail("unknown decode failure policy %q", cfg.DecodeFailurePolicy)
+	}
+	if cfg.LoadShedding.Fraction < 0 || cfg.LoadShedding.Fraction > 1 {
+		fail("load shedding fraction must be between 0 and 1, got %v", cfg.LoadShedding.Fraction)
+	}
+	if cfg.DefaultNumTraces > 0 && cfg.MaxNumTraces > 0 && cfg.DefaultNumTraces > cfg.MaxNumTraces {
+		fail("default_num_traces must not exceed max_num_traces, got %d and %d", cfg.DefaultNumTraces, cfg.MaxNumTraces)
+	}
+	if !sort.Float64sAreSorted(cfg.LatencyHistogram.Buckets) {
+		fail("latency histogram buckets must be in increasing order")
+	}
+	for _, value := range []struct {
+		name  string
+		value int64
+	}{
+		{name: "batch_write_size", value: cfg.BatchWriteSize},
+		{name: "batch_max_bytes", value: cfg.BatchMaxBytes},
+		{name: "max_span_count", value: int64(cfg.MaxSpanCount)},
+		{name: "queue_size", value: cfg.QueueSize},
+		{name: "decoding_workers", value: int64(cfg.DecodingWorkers)},
+		{name: "fetch_chunk_size", value: int64(cfg.FetchChunkSize)},
+		{name: "audit_log sample_rate", value: int64(cfg.AuditLog.SampleRate)},
+		{name: "operation_profiles sample_rate", value: int64(cfg.OperationProfiles.SampleRate)},
+		{name: "search_cache_size", value: int64(cfg.SearchCacheSize)},
+		{name: "default_num_traces", value: int64(cfg.DefaultNumTraces)},
+		{name: "max_num_traces", value: int64(cfg.MaxNumTraces)},
+		{name: "spans_search_limit", value: int64(cfg.SpansSearchLimit)},
+		{name: "max_concurrent_queries", value: int64(cfg.MaxConcurrentQueries)},
+		{name: "tag_stats_sample_rate", value: int64(cfg.TagStatsSampleRate)},
+		{name: "failover failure_threshold", value: int64(cfg.Failover.FailureThreshold)},
+		{name: "failover recovery_threshold", value: int64(cfg.Failover.RecoveryThreshold)},
+		{name: "load_shedding failure_threshold", value: int64(cfg.LoadShedding.FailureThreshold)},
+		{name: "load_shedding recovery_threshold", value: int64(cfg.LoadShedding.RecoveryThreshold)},
+		{name: "byte_quotas default", value: cfg.ByteQuotas.Default},
+		{name: "pruning max_logs", value: int64(cfg.Pruning.MaxLogs)},
+		{name: "buffer_alarms max_flush_failures", value: int64(cfg.BufferAlarms.MaxFlushFailures)},
+		{name: "buffer_alarms max_unwritten_bytes", value: cfg.BufferAlarms.MaxUnwrittenBytes},
+		{name: "pruning max_tag_value_bytes", value: int64(cfg.Pruning.MaxTagValueBytes)},
+		{name: "circuit_breaker failure_threshold", value: int64(cfg.CircuitBreaker.FailureThreshold)},
+		{name: "parts_monitor flush_slowdown", value: int64(cfg.PartsMonitor.FlushSlowdown)},
+		{name: "grpc_server max_message_size", value: int64(cfg.GRPCServer.MaxMessageSize)},
+		{name: "row_level_security max_user_pools", value: int64(cfg.RowLevelSecurity.MaxUserPools)},
+	} {
+		if value.value < 0 {
+			fail("%s must not be negative, got %d", value.name, value.value)
+		}
+	}
+	for _, duration := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{name: "batch_flush_interval", value: cfg.BatchFlushInterval},
+		{name: "schema_check_interval", value: cfg.SchemaCheckInterval},
+		{name: "search_cache_ttl", value: cfg.SearchCacheTTL},
+		{name: "query_queue_timeout", value: cfg.QueryQueueTimeout},
+		{name: "reencode_interval", value: cfg.ReencodeInterval},
+		{name: "max_span_age", value: cfg.MaxSpanAge},
+		{name: "max_span_future", value: cfg.MaxSpanFuture},
+		{name: "auto_archive delay", value: cfg.AutoArchive.Delay},
+		{name: "operation_profiles delay", value: cfg.OperationProfiles.Delay},
+		{name: "failover probe_interval", value: cfg.Failover.ProbeInterval},
+		{name: "reconnect max_connection_age", value: cfg.Reconnect.MaxConnectionAge},
+		{name: "reconnect check_interval", value: cfg.Reconnect.CheckInterval},
+		{name: "load_shedding max_latency", value: cfg.LoadShedding.MaxLatency},
+		{name: "buffer_alarms window", value: cfg.BufferAlarms.Window},
+		{name: "buffer_alarms max_span_age", value: cfg.BufferAlarms.MaxSpanAge},
+		{name: "circuit_breaker cool_down", value: cfg.CircuitBreaker.CoolDown},
+		{name: "timeouts get_trace", value: cfg.Timeouts.GetTrace},
+		{name: "timeouts find_traces", value: cfg.Timeouts.FindTraces},
+		{name: "timeouts get_services", value: cfg.Timeouts.GetServices},
+		{name: "services_lookback", value: cfg.ServicesLookback},
+		{name: "recent_traces_window", value: cfg.RecentTracesWindow},
+		{name: "hot_index_window", value: cfg.HotIndexWindow},
+		{name: "duration_baselines_window", value: cfg.DurationBaselinesWindow},
+		{name: "parts_monitor interval", value: cfg.PartsMonitor.Interval},
+		{name: "insert_profiling_interval", value: cfg.InsertProfilingInterval},
+	} {
+		if duration.value < 0 {
+			fail("%s must not be negative, got %s", duration.name, duration.value)
+		}
+	}
+	collect(cfg.extractedTags())
+	collect(cfg.codecs())
+	collect(cfg.dialer())
+	collect(cfg.serviceNameNormalizerOption())
+	collect(cfg.serviceFilterOption())
+	collect(cfg.byteQuotasOption())
+	if _, _, err := cfg.replication(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := cfg.orderBy(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Settings must not override connection parameters of the DSN
+	for _, settings := range []struct {
+		name  string
+		value map[string]string
+	}{
+		{name: "settings read", value: cfg.Settings.Read},
+		{name: "settings write", value: cfg.Settings.Write},
+	} {
+		for setting := range settings.value {
+			switch {
+			case !settingPattern.MatchString(setting):
+				fail("invalid %s setting name %q", settings.name, setting)
+			case connectionParameters[setting]:
+				fail("%s cannot set connection parameter %s", settings.name, setting)
+			}
+		}
+	}
+
+	// Names inserted into queries
+	if !databasePattern.MatchString(cfg.Database) {
+		fail("invalid database name %q, only letters, digits, underscores and dashes are allowed", cfg.Database)
+	}
+	for _, table := range []struct {
+		name  string
+		value clickhousespanstore.TableName
+	}{
+		{name: "spans_table", value: cfg.SpansTable},
+		{name: "spans_index_table", value: cfg.SpansIndexTable},
+		{name: "operations_table", value: cfg.OperationsTable},
+		{name: "calls_table", value: cfg.CallsTable},
+		{name: "dependencies_table", value: cfg.DependenciesTable},
+		{name: "archive index_table", value: cfg.Archive.IndexTable},
+		{name: "span_logs_table", value: cfg.SpanLogsTable},
+		{name: "processes_table", value: cfg.ProcessesTable},
+		{name: "trace_summaries_table", value: cfg.TraceSummariesTable},
+		{name: "traces_table", value: cfg.TracesTable},
+		{name: "recent_traces_table", value: cfg.RecentTracesTable},
+		{name: "hot_index_table", value: cfg.HotIndexTable},
+		{name: "duration_baselines_table", value: cfg.DurationBaselinesTable},
+		{name: "audit_log table", value: cfg.AuditLog.Table},
+		{name: "operation_profiles table", value: cfg.OperationProfiles.Table},
+		{name: "service_aliases_table", value: cfg.ServiceAliasesTable},
+		{name: "hidden_traces_table", value: cfg.HiddenTracesTable},
+	} {
+		if !tablePattern.MatchString(string(table.value)) {
+			fail("invalid %s %q, only letters, digits, underscores and dashes with an optional database are allowed", table.name, string(table.value))
+		}
+	}
+	// The archive table is derived from the spans table unless it is set
+	if cfg.Archive.Table != "" && !tablePattern.MatchString(string(cfg.Archive.Table)) {
+		fail("invalid archive table %q, only letters, digits, underscores and dashes with an optional database are allowed", string(cfg.Archive.Table))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
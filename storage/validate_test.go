@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+func TestConfiguration_Validate(t *testing.T) {
+	assert.NoError(t, Configuration{}.Validate())
+	assert.NoError(t, Configuration{Replication: true, PartialResults: true, SpansTable: "jaeger.spans"}.Validate())
+
+	tests := map[string]struct {
+		cfg      Configuration
+		expected string
+	}{
+		"init scripts with codecs": {
+			cfg:      Configuration{InitSQLScriptsDir: "scripts", Codecs: map[string]string{"model": "ZSTD(3)"}},
+			expected: "codecs are used only by the embedded scripts, not with init_sql_scripts_dir",
+		},
+		"sort key without required column": {
+			cfg:      Configuration{IndexOrderBy: []string{"service", "operation"}},
+			expected: "index_order_by must include column timestamp",
+		},
+		"setting overriding connection": {
+			cfg:      Configuration{Settings: SettingsConfiguration{Read: map[string]string{"password": "secret"}}},
+			expected: "settings read cannot set connection parameter password",
+		},
+		"default number of traces above maximum": {
+			cfg:      Configuration{DefaultNumTraces: 50, MaxNumTraces: 20},
+			expected: "default_num_traces must not exceed max_num_traces, got 50 and 20",
+		},
+		"negative maximal number of traces": {
+			cfg:      Configuration{MaxNumTraces: -1},
+			expected: "max_num_traces must not be negative, got -1",
+		},
+		"archive index without archive": {
+			cfg:      Configuration{Archive: ArchiveConfiguration{Enabled: new(bool), Index: true}},
+			expected: "archive index requires the archive storage",
+		},
+		"archive index with index from spans": {
+			cfg:      Configuration{Archive: ArchiveConfiguration{Index: true}, IndexFromSpans: true},
+			expected: "archive index cannot be used with index_from_spans",
+		},
+		"federated search without archive index": {
+			cfg:      Configuration{Archive: ArchiveConfiguration{FederatedSearch: true}},
+			expected: "archive federated_search requires archive index or spans_search_limit",
+		},
+		"priority ttl without ttl": {
+			cfg:      Configuration{PriorityTTLDays: 30},
+			expected: "priority_ttl requires ttl",
+		},
+		"trace quality without dependencies": {
+			cfg:      Configuration{TraceQuality: true},
+			expected: "trace_quality requires dependencies",
+		},
+		"partial results without replication": {
+			cfg:      Configuration{PartialResults: true},
+			expected: "partial_results requires replication",
+		},
+		"proxy with alt hosts": {
+			cfg:      Configuration{Proxy: ProxyConfiguration{URL: "socks5://localhost:1080"}, AltHosts: []string{"localhost:9001"}},
+			expected: "proxy cannot be used with alt_hosts",
+		},
+		"invalid service filter pattern": {
+			cfg:      Configuration{ServiceFilter: ServiceFilterConfiguration{DenyPatterns: []string{"("}}},
+			expected: "invalid service pattern \"(\": error parsing regexp: missing closing ): `(`",
+		},
+		"alt hosts with dsn": {
+			cfg:      Configuration{DSN: "tcp://localhost:9000", AltHosts: []string{"localhost:9001"}},
+			expected: "alt_hosts cannot be used with dsn, alt_hosts parameter of the dsn is used instead",
+		},
+		"unknown insert format": {
+			cfg:      Configuration{InsertFormat: "values"},
+			expected: `unknown insert format "values"`,
+		},
+		"unknown encoding": {
+			cfg:      Configuration{Encoding: "xml"},
+			expected: `unknown encoding "xml"`,
+		},
+		"purge endpoint with table rotation": {
+			cfg:      Configuration{PurgeEndpoint: true, TableRotation: clickhousespanstore.RotationDaily},
+			expected: "purge_endpoint cannot be used with table_rotation",
+		},
+		"sequential consistency without replication": {
+			cfg: Configuration{
+				SequentialConsistency: true,
+				Settings:              SettingsConfiguration{Write: map[string]string{"insert_quorum": "2"}},
+			},
+			expected: "sequential_consistency requires replication",
+		},
+		"sequential consistency without insert quorum": {
+			cfg:      Configuration{Replication: true, SequentialConsistency: true},
+			expected: "sequential_consistency requires the insert_quorum write setting",
+		},
+		"maintenance endpoint with table rotation": {
+			cfg:      Configuration{MaintenanceEndpoint: true, TableRotation: clickhousespanstore.RotationDaily},
+			expected: "maintenance_endpoint cannot be used with table_rotation",
+		},
+		"export endpoint with row level security": {
+			cfg:      Configuration{ExportEndpoint: true, RowLevelSecurity: RowLevelSecurityConfiguration{UserHeader: "x-jaeger-user"}},
+			expected: "export_endpoint cannot be used with row_level_security",
+		},
+		"failover with row level security": {
+			cfg: Configuration{
+				Failover:         FailoverConfiguration{SecondaryAddress: "tcp://secondary:9000"},
+				RowLevelSecurity: RowLevelSecurityConfiguration{UserHeader: "x-jaeger-user"},
+			},
+			expected: "failover cannot be used with row_level_security",
+		},
+		"trace IDs endpoint with row level security": {
+			cfg:      Configuration{TraceIDsEndpoint: true, RowLevelSecurity: RowLevelSecurityConfiguration{UserHeader: "x-jaeger-user"}},
+			expected: "trace_ids_endpoint cannot be used with row_level_security",
+		},
+		"unknown decode failure policy": {
+			cfg:      Configuration{DecodeFailurePolicy: "repair"},
+			expected: `unknown decode failure policy "repair"`,
+		},
+		"negative batch size": {
+			cfg:      Configuration{BatchWriteSize: -1},
+			expected: "batch_write_size must not be negative, got -1",
+		},
+		"negative pruning max logs": {
+			cfg:      Configuration{Pruning: PruningConfiguration{MaxLogs: -1}},
+			expected: "pruning max_logs must not be negative, got -1",
+		},
+		"negative buffer alarms max span age": {
+			cfg:      Configuration{BufferAlarms: BufferAlarmsConfiguration{MaxSpanAge: -time.Second}},
+			expected: "buffer_alarms max_span_age must not be negative, got -1s",
+		},
+		"byte quotas keep fraction": {
+			cfg:      Configuration{ByteQuotas: ByteQuotasConfiguration{Default: 1000, KeepFraction: 2}},
+			expected: "byte quotas keep fraction must be between 0 and 1, got 2",
+		},
+		"shedding fraction": {
+			cfg:      Configuration{LoadShedding: LoadSheddingConfiguration{Fraction: 2}},
+			expected: "load shedding fraction must be between 0 and 1, got 2",
+		},
+		"rotation with summaries": {
+			cfg:      Configuration{TableRotation: clickhousespanstore.RotationDaily, TraceSummaries: true},
+			expected: "table rotation does not support trace summaries",
+		},
+		"index from spans with extracted tags": {
+			cfg:      Configuration{IndexFromSpans: true, ExtractedTags: []string{"http.method:String"}},
+			expected: "index_from_spans cannot be used with extracted_tags",
+		},
+		"index from spans with insert times": {
+			cfg:      Configuration{IndexFromSpans: true, IndexInsertTime: true},
+			expected: "index_from_spans cannot be used with index_insert_time",
+		},
+		"deduplicated processes with dual encoding": {
+			cfg:      Configuration{DeduplicateProcesses: true, DualEncodingUntil: time.Now()},
+			expected: "deduplicate_processes cannot be used with dual_encoding_until",
+		},
+		"rotation with index from spans": {
+			cfg:      Configuration{TableRotation: clickhousespanstore.RotationDaily, IndexFromSpans: true},
+			expected: "table rotation does not support the index written from spans",
+		},
+		"row binary inserts without http address": {
+			cfg:      Configuration{InsertFormat: InsertRowBinary},
+			expected: "insert_format row_binary requires http_address",
+		},
+		"replaced running queries without query IDs": {
+			cfg:      Configuration{ReplaceRunningQueries: true},
+			expected: "replace_running_queries requires read_query_ids",
+		},
+		"row binary inserts with index from spans": {
+			cfg:      Configuration{InsertFormat: InsertRowBinary, HTTPAddress: "http://localhost:8123", IndexFromSpans: true},
+			expected: "insert_format row_binary cannot be used with index_from_spans",
+		},
+		"http address without scheme": {
+			cfg:      Configuration{InsertFormat: InsertRowBinary, HTTPAddress: "localhost:8123"},
+			expected: `invalid http_address "localhost:8123", expected http://host:port or https://host:port`,
+		},
+		"binary trace IDs with hidden traces": {
+			cfg:      Configuration{BinaryTraceIDs: true, HiddenTraces: true},
+			expected: "binary_trace_ids cannot be used with hidden_traces",
+		},
+		"audit log without user": {
+			cfg:      Configuration{AuditLog: AuditLogConfiguration{Enabled: true}},
+			expected: "audit_log requires user_header",
+		},
+		"rotation with duration baselines": {
+			cfg:      Configuration{TableRotation: clickhousespanstore.RotationDaily, DurationBaselines: true},
+			expected: "table rotation does not support duration baselines",
+		},
+		"rotation with operation profiles": {
+			cfg:      Configuration{TableRotation: clickhousespanstore.RotationDaily, OperationProfiles: OperationProfilesConfiguration{Enabled: true}},
+			expected: "table rotation does not support operation profiles",
+		},
+		"rotation with upstream compatibility": {
+			cfg:      Configuration{TableRotation: clickhousespanstore.RotationDaily, UpstreamCompatibility: true},
+			expected: "table rotation does not support upstream compatibility",
+		},
+		"deduplication window seconds without replication": {
+			cfg:      Configuration{InsertDeduplicationWindowSeconds: 3600},
+			expected: "insert_deduplication_window_seconds requires replication",
+		},
+		"insert deduplicate set twice": {
+			cfg:      Configuration{InsertDeduplicate: new(bool), Settings: SettingsConfiguration{Write: map[string]string{"insert_deduplicate": "1"}}},
+			expected: "insert_deduplicate cannot be used with the insert_deduplicate write setting",
+		},
+		"archive endpoint without archive": {
+			cfg:      Configuration{Archive: ArchiveConfiguration{Enabled: new(bool), Endpoint: true}},
+			expected: "archive endpoint requires the archive storage",
+		},
+		"table name injection": {
+			cfg:      Configuration{SpansTable: "spans; DROP TABLE jaeger_index_local"},
+			expected: `invalid spans_table "spans; DROP TABLE jaeger_index_local", only letters, digits, underscores and dashes with an optional database are allowed`,
+		},
+		"archive table name injection": {
+			cfg:      Configuration{Archive: ArchiveConfiguration{Table: "archive; DROP TABLE jaeger_spans_local"}},
+			expected: `invalid archive table "archive; DROP TABLE jaeger_spans_local", only letters, digits, underscores and dashes with an optional database are allowed`,
+		},
+		"database name": {
+			cfg:      Configuration{Database: "jaeger.prod"},
+			expected: `invalid database name "jaeger.prod", only letters, digits, underscores and dashes are allowed`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.EqualError(t, test.cfg.Validate(), "invalid configuration: "+test.expected)
+		})
+	}
+
+	deduplicate := true
+	assert.EqualError(t, Configuration{InsertDeduplicate: &deduplicate}.Validate(),
+		"invalid configuration: insert_deduplicate requires insert_deduplication_window unless replication is enabled")
+	assert.NoError(t, Configuration{InsertDeduplicate: &deduplicate, InsertDeduplicationWindow: 1000}.Validate())
+	// Names which are not plain identifiers are quoted in queries
+	assert.NoError(t, Configuration{Database: "jaeger-prod", SpansTable: "Spans-2021", HiddenTracesTable: "other-db.hidden"}.Validate())
+}
+
+func TestConfiguration_ValidateAggregatesErrors(t *testing.T) {
+	err := Configuration{WriteLocalShard: true, Prewhere: "sometimes", HiddenTracesTable: "hidden traces"}.Validate()
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 3)
+	assert.EqualError(t, err, "invalid configuration: write_local_shard requires replication; "+
+		`unknown prewhere mode "sometimes"; `+
+		`invalid hidden_traces_table "hidden traces", only letters, digits, underscores and dashes with an optional database are allowed`)
+}